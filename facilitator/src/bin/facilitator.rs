@@ -1826,46 +1826,77 @@ fn intake_batch_worker(
 
             let trace_id = task_handle.task.trace_id;
 
-            let result = intake_batch(
-                &trace_id,
-                &task_handle.task.aggregation_id,
-                &task_handle.task.batch_id,
-                &task_handle.task.date,
-                sub_matches,
-                runtime_handle,
-                aws_provider_factory,
-                gcp_access_token_provider_factory,
-                Some(&metrics_collector),
-                api_metrics,
-                parent_logger,
-                |logger| match queue.maybe_extend_task_deadline(&task_handle, last_refresh) {
-                    Ok(new_last_refresh) => last_refresh = new_last_refresh,
-                    Err(err) => error!(
-                        logger, "{}", err;
-                        event::TRACE_ID => trace_id.to_string(),
-                        event::TASK_HANDLE => task_handle.clone(),
-                    ),
-                },
-            );
-
-            match result {
-                Ok(_) => queue.acknowledge_task(task_handle)?,
-                Err(err) if !err.is_retryable() => {
-                    error!(parent_logger, "error while processing intake task (non-retryable): {:?}", err;
+            let batches = match task_handle.task.batches() {
+                Ok(batches) => batches,
+                Err(err) => {
+                    error!(parent_logger, "invalid intake task: {:?}", err;
                         event::TASK_HANDLE => task_handle.clone(),
                         event::TRACE_ID => trace_id.to_string(),
                     );
                     queue.forward_to_rejected_queue(task_handle)?;
+                    continue;
                 }
-                Err(err) => {
-                    error!(
-                        parent_logger, "error while processing intake task: {:?}", err;
-                        event::TASK_HANDLE => task_handle.clone(),
-                        event::TRACE_ID => trace_id.to_string(),
-                    );
-                    queue.nacknowledge_task(task_handle)?;
+            };
+
+            // A task coalesced by workflow-manager intakes several batches.
+            // Each is attempted even if an earlier one fails, since intake is
+            // idempotent: if any fails with a retryable error the whole task is
+            // retried, and otherwise, if any fails with a non-retryable error,
+            // the task is rejected.
+            let mut retryable_error = None;
+            let mut non_retryable_error = None;
+            for (batch_id, date) in batches {
+                let result = intake_batch(
+                    &trace_id,
+                    &task_handle.task.aggregation_id,
+                    batch_id,
+                    date,
+                    sub_matches,
+                    runtime_handle,
+                    aws_provider_factory,
+                    gcp_access_token_provider_factory,
+                    Some(&metrics_collector),
+                    api_metrics,
+                    parent_logger,
+                    |logger| match queue.maybe_extend_task_deadline(&task_handle, last_refresh) {
+                        Ok(new_last_refresh) => last_refresh = new_last_refresh,
+                        Err(err) => error!(
+                            logger, "{}", err;
+                            event::TRACE_ID => trace_id.to_string(),
+                            event::TASK_HANDLE => task_handle.clone(),
+                        ),
+                    },
+                );
+
+                match result {
+                    Ok(_) => {}
+                    Err(err) if !err.is_retryable() => {
+                        error!(parent_logger, "error while processing intake task (non-retryable): {:?}", err;
+                            event::TASK_HANDLE => task_handle.clone(),
+                            event::TRACE_ID => trace_id.to_string(),
+                            event::BATCH_ID => batch_id.to_owned(),
+                        );
+                        non_retryable_error.get_or_insert(err);
+                    }
+                    Err(err) => {
+                        error!(
+                            parent_logger, "error while processing intake task: {:?}", err;
+                            event::TASK_HANDLE => task_handle.clone(),
+                            event::TRACE_ID => trace_id.to_string(),
+                            event::BATCH_ID => batch_id.to_owned(),
+                        );
+                        retryable_error.get_or_insert(err);
+                    }
                 }
             }
+
+            if retryable_error.is_some() {
+                queue.nacknowledge_task(task_handle)?;
+            } else if non_retryable_error.is_some() {
+                queue.forward_to_rejected_queue(task_handle)?;
+            } else {
+                queue.acknowledge_task(task_handle)?;
+            }
         }
     }
     Ok(())
@@ -34,7 +34,7 @@ pub mod event {
     /// The UUID of a packet that something happened to
     pub(crate) const PACKET_UUID: EventKey = "packet_uuid";
     /// The ID (usually a UUID) of a batch that something happened to
-    pub(crate) const BATCH_ID: EventKey = "batch_id";
+    pub const BATCH_ID: EventKey = "batch_id";
     /// The date of a batch that something happened to
     pub(crate) const BATCH_DATE: EventKey = "batch_date";
     /// The path to some object store (e.g., an S3 bucket or a local directory)
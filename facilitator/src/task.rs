@@ -1,7 +1,7 @@
 mod pubsub;
 mod sqs;
 
-use anyhow::Result;
+use anyhow::{anyhow, Result};
 use chrono::NaiveDateTime;
 use dyn_clone::{clone_trait_object, DynClone};
 use serde::Deserialize;
@@ -83,7 +83,9 @@ pub trait Task:
 {
 }
 
-/// Represents an intake batch task to be executed
+/// Represents an intake batch task to be executed. A task either intakes a
+/// single batch, identified by batch_id and date, or, if it was coalesced by
+/// workflow-manager, the several batches listed in batches.
 #[derive(Clone, Debug, Deserialize, PartialEq, Eq)]
 #[serde(rename_all = "kebab-case")]
 pub struct IntakeBatchTask {
@@ -92,20 +94,57 @@ pub struct IntakeBatchTask {
     /// The identifier for the aggregation
     pub aggregation_id: String,
     /// The identifier of the batch, typically a UUID
-    pub batch_id: String,
+    #[serde(default)]
+    pub batch_id: Option<String>,
     /// The UTC timestamp on the batch, with minute precision, formatted like
     /// "2006/01/02/15/04"
-    pub date: String,
+    #[serde(default)]
+    pub date: Option<String>,
+    /// The batches intaken by a coalesced task, oldest first
+    #[serde(default)]
+    pub batches: Vec<Batch>,
+}
+
+impl IntakeBatchTask {
+    /// Returns the (batch ID, date) pairs of the batches intaken by this task,
+    /// or an error if the task identifies no batches.
+    pub fn batches(&self) -> Result<Vec<(&str, &str)>> {
+        if !self.batches.is_empty() {
+            return Ok(self
+                .batches
+                .iter()
+                .map(|b| (b.id.as_str(), b.time.as_str()))
+                .collect());
+        }
+        match (&self.batch_id, &self.date) {
+            (Some(batch_id), Some(date)) => Ok(vec![(batch_id.as_str(), date.as_str())]),
+            _ => Err(anyhow!(
+                "intake task has neither batches nor a batch ID and date"
+            )),
+        }
+    }
 }
 
 impl Task for IntakeBatchTask {}
 
 impl Display for IntakeBatchTask {
     fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        if !self.batches.is_empty() {
+            return write!(
+                f,
+                "trace ID: {}\naggregation ID: {}\nnumber of batches: {}",
+                self.trace_id,
+                self.aggregation_id,
+                self.batches.len()
+            );
+        }
         write!(
             f,
             "trace ID: {}\naggregation ID: {}\nbatch ID: {}\ndate: {}",
-            self.trace_id, self.aggregation_id, self.batch_id, self.date
+            self.trace_id,
+            self.aggregation_id,
+            self.batch_id.as_deref().unwrap_or_default(),
+            self.date.as_deref().unwrap_or_default()
         )
     }
 }
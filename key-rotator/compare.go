@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+	"github.com/abetterinternet/prio-server/key-rotator/manifest"
+	"github.com/abetterinternet/prio-server/key-rotator/storage"
+)
+
+// compareEnvironment is one of the two environments compared by compareKeys.
+type compareEnvironment struct {
+	// Dependencies.
+	keyStore      storage.Key
+	manifestStore storage.Manifest
+
+	// Configuration.
+	name string // a human-readable name for the environment, used in reported divergences
+}
+
+// compareKeysConfig configures a read-only comparison of the keys & manifests
+// of a single locality between two environments, e.g. a production
+// environment and its disaster-recovery replica.
+type compareKeysConfig struct {
+	a, b      compareEnvironment
+	locality  string
+	ingestors []string
+}
+
+// compareKeys reads keys & manifests from both environments, returning a
+// human-readable description of each divergence between them: differing key
+// versions, primary versions, or key material, and differing manifest
+// contents. No divergences are returned if the environments match.
+func compareKeys(ctx context.Context, cfg compareKeysConfig) ([]string, error) {
+	// Retrieve keys & manifests from both environments.
+	var aPacketEncryptionKey, bPacketEncryptionKey key.Key
+	var aBatchSigningKeyByIngestor, bBatchSigningKeyByIngestor map[string]key.Key
+	var aManifestByIngestor, bManifestByIngestor map[string]manifest.DataShareProcessorSpecificManifest
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		var err error
+		aPacketEncryptionKey, aBatchSigningKeyByIngestor, aManifestByIngestor, err =
+			readKeysAndManifests(ctx, cfg.a.keyStore, cfg.a.manifestStore, cfg.locality, cfg.ingestors)
+		if err != nil {
+			return fmt.Errorf("couldn't get keys & manifests from %s: %w", cfg.a.name, err)
+		}
+		return nil
+	})
+	eg.Go(func() error {
+		var err error
+		bPacketEncryptionKey, bBatchSigningKeyByIngestor, bManifestByIngestor, err =
+			readKeysAndManifests(ctx, cfg.b.keyStore, cfg.b.manifestStore, cfg.locality, cfg.ingestors)
+		if err != nil {
+			return fmt.Errorf("couldn't get keys & manifests from %s: %w", cfg.b.name, err)
+		}
+		return nil
+	})
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	// Compare. Diffs describe the changes required to get from environment a
+	// to environment b.
+	var divergences []string
+	if diff := bPacketEncryptionKey.Diff(aPacketEncryptionKey); diff != "" {
+		divergences = append(divergences, fmt.Sprintf(
+			"packet encryption key for %q differs (%s → %s): %s", cfg.locality, cfg.a.name, cfg.b.name, diff))
+	}
+	for _, ingestor := range cfg.ingestors {
+		if diff := bBatchSigningKeyByIngestor[ingestor].Diff(aBatchSigningKeyByIngestor[ingestor]); diff != "" {
+			divergences = append(divergences, fmt.Sprintf(
+				"batch signing key for (%q, %q) differs (%s → %s): %s", cfg.locality, ingestor, cfg.a.name, cfg.b.name, diff))
+		}
+		aManifest := aManifestByIngestor[ingestor]
+		bManifest := withPacketEncryptionCSRsFrom(bManifestByIngestor[ingestor], aManifest)
+		if diff := bManifest.Diff(aManifest); diff != "" {
+			divergences = append(divergences, fmt.Sprintf(
+				"manifest for (%q, %q) differs (%s → %s): %s", cfg.locality, ingestor, cfg.a.name, cfg.b.name, diff))
+		}
+	}
+	return divergences, nil
+}
+
+// withPacketEncryptionCSRsFrom returns a copy of m in which each packet
+// encryption certificate holding the same public key as the certificate of
+// the same key version in o is replaced by o's. Each environment signs its
+// own CSRs, and ECDSA signatures are randomized, so CSRs for the same key
+// material differ between environments.
+func withPacketEncryptionCSRsFrom(m, o manifest.DataShareProcessorSpecificManifest) manifest.DataShareProcessorSpecificManifest {
+	if m.PacketEncryptionKeyCSRs == nil {
+		return m
+	}
+	csrs := manifest.PacketEncryptionKeyCSRs{}
+	for kid, cert := range m.PacketEncryptionKeyCSRs {
+		if oCert, ok := o.PacketEncryptionKeyCSRs[kid]; ok && cert.PublicKeyEqual(oCert) {
+			cert = oCert
+		}
+		csrs[kid] = cert
+	}
+	m.PacketEncryptionKeyCSRs = csrs
+	return m
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+type daemonConfig struct {
+	// Dependencies.
+	health *daemonHealth // updated as each rotation starts & completes
+
+	// Configuration.
+	runInterval time.Duration // the time between the start of consecutive rotations
+}
+
+// daemon runs rotate immediately, then every cfg.runInterval, until ctx is
+// canceled. Errors from rotate are logged, but do not stop the daemon. A
+// rotation in progress when ctx is canceled is allowed to complete, so that a
+// shutdown never interrupts a rotation between writing keys & writing
+// manifests; rotate is responsible for bounding its own duration.
+func daemon(ctx context.Context, cfg daemonConfig, rotate func() error) {
+	for {
+		start := time.Now()
+		cfg.health.started(start)
+		err := rotate()
+		if err != nil {
+			log.Error().Err(err).Msgf("Couldn't rotate keys: %v", err)
+		}
+		cfg.health.completed(time.Now(), err)
+		if ctx.Err() != nil {
+			return
+		}
+
+		next := time.NewTimer(time.Until(start.Add(cfg.runInterval)))
+		select {
+		case <-ctx.Done():
+			next.Stop()
+			return
+		case <-next.C:
+		}
+	}
+}
+
+// daemonHealth tracks the progress of rotations in daemon mode, for the
+// /healthz endpoint. The daemon is considered healthy as long as a rotation
+// has completed (successfully or not) within maxAge; a failing rotation is
+// reported through metrics rather than by failing liveness probes, since
+// restarting key-rotator is unlikely to fix it.
+type daemonHealth struct {
+	maxAge time.Duration
+	now    func() time.Time // time.Now, except in tests
+
+	mu            sync.Mutex
+	start         time.Time // when the daemon started
+	lastStarted   time.Time // when the most recent rotation started
+	lastCompleted time.Time // when the most recent rotation completed; zero if none has
+	lastErr       error     // the error from the most recent completed rotation
+}
+
+func newDaemonHealth(maxAge time.Duration) *daemonHealth {
+	return &daemonHealth{maxAge: maxAge, now: time.Now, start: time.Now()}
+}
+
+func (h *daemonHealth) started(when time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastStarted = when
+}
+
+func (h *daemonHealth) completed(when time.Time, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastCompleted, h.lastErr = when, err
+}
+
+// check returns an error if no rotation has completed within maxAge, counting
+// from the daemon's start if no rotation has yet completed.
+func (h *daemonHealth) check() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	since := h.lastCompleted
+	if since.IsZero() {
+		since = h.start
+	}
+	if age := h.now().Sub(since); age > h.maxAge {
+		return fmt.Errorf("no rotation completed in %v (last rotation started at %s)", age.Round(time.Second), h.lastStarted.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (h *daemonHealth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h.check(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	h.mu.Lock()
+	lastErr := h.lastErr
+	h.mu.Unlock()
+	if lastErr != nil {
+		fmt.Fprintf(w, "ok (last rotation failed: %v)\n", lastErr)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// daemonHandler returns a handler serving /healthz from health and /metrics
+// from gatherer, in OpenMetrics format if the scraper accepts it, so that
+// exemplars are served.
+func daemonHandler(health *daemonHealth, gatherer prometheus.Gatherer) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", health)
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+	return mux
+}
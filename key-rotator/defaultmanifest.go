@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/abetterinternet/prio-server/key-rotator/manifest"
+	"github.com/abetterinternet/prio-server/key-rotator/storage"
+)
+
+// openDefaultManifests opens the map from ingestor to default manifest named
+// by --default-manifest-by-ingestor-file, which may be a local path or a GCS or
+// S3 object URL. Object storage clients are configured by opts.
+func openDefaultManifests(ctx context.Context, path string, opts []storage.ManifestOption) (io.ReadCloser, error) {
+	if strings.HasPrefix(path, "gs://") || strings.HasPrefix(path, "s3://") {
+		return storage.OpenObject(ctx, path, opts...)
+	}
+	return os.Open(path)
+}
+
+// readDefaultManifests reads a JSON map from ingestor to default manifest, as
+// accepted by --default-manifest-by-ingestor, from the given reader. The map
+// is decoded one entry at a time, so that at most one manifest is held in
+// memory beyond those returned. An error is returned if more than maxBytes
+// bytes would need to be read, if an entry names an ingestor not in
+// ingestors, or if an ingestor appears more than once.
+func readDefaultManifests(r io.Reader, maxBytes int64, ingestors []string) (map[string]manifest.DataShareProcessorSpecificManifest, error) {
+	knownIngestors := map[string]bool{}
+	for _, ingestor := range ingestors {
+		knownIngestors[ingestor] = true
+	}
+
+	// Read one byte beyond the limit, so that we can distinguish an input
+	// of exactly maxBytes bytes from one that was truncated.
+	lr := &io.LimitedReader{R: r, N: maxBytes + 1}
+	dec := json.NewDecoder(lr)
+	wrapErr := func(err error) error {
+		if lr.N <= 0 {
+			return fmt.Errorf("default manifests exceed %d bytes", maxBytes)
+		}
+		return err
+	}
+
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, wrapErr(err)
+	}
+	defaultManifestByIngestor := map[string]manifest.DataShareProcessorSpecificManifest{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, wrapErr(fmt.Errorf("couldn't read ingestor: %w", err))
+		}
+		ingestor, ok := tok.(string)
+		if !ok {
+			return nil, wrapErr(fmt.Errorf("unexpected token %v, wanted ingestor", tok))
+		}
+		if !knownIngestors[ingestor] {
+			return nil, fmt.Errorf("default manifest given for ingestor %q, which is not in --ingestors", ingestor)
+		}
+		if _, ok := defaultManifestByIngestor[ingestor]; ok {
+			return nil, fmt.Errorf("default manifest given more than once for ingestor %q", ingestor)
+		}
+		var m manifest.DataShareProcessorSpecificManifest
+		if err := dec.Decode(&m); err != nil {
+			return nil, wrapErr(fmt.Errorf("couldn't decode default manifest for ingestor %q: %w", ingestor, err))
+		}
+		defaultManifestByIngestor[ingestor] = m
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, wrapErr(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		if err == nil {
+			err = errors.New("unexpected data after default manifests")
+		}
+		return nil, wrapErr(err)
+	}
+	return defaultManifestByIngestor, nil
+}
+
+// expectDelim reads the next token from dec, returning an error if it is not
+// the given delimiter.
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("couldn't read %q: %w", want, err)
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != want {
+		return fmt.Errorf("unexpected token %v, wanted %q", tok, want)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+	"github.com/abetterinternet/prio-server/key-rotator/manifest"
+	"github.com/abetterinternet/prio-server/key-rotator/storage"
+)
+
+// packetEncryptionPublicKeyField names the packet encryption public key field
+// written by exportPublic. The other fields are named by the manifest package.
+const packetEncryptionPublicKeyField = "packet-encryption-public-key"
+
+// exportPublicConfig configures an export of the public portions of the
+// primary versions of a locality's keys.
+type exportPublicConfig struct {
+	// Dependencies.
+	keyStore storage.Key
+
+	// Configuration.
+	prioEnvironment string
+	locality        string
+	ingestors       []string
+	taskSigningKey  bool                // if set, the task signing key is also exported
+	format          key.PublicKeyFormat // PEM-encoded keys are written as-is; other formats are base64-encoded
+}
+
+// exportPublic reads the locality's keys from the key store and writes the key
+// IDs & public keys of their primary versions to w, as a JSON object mapping
+// "${locality}-${ingestor}.${field}" (e.g. "us-ca-apple.batch-signing-key-id")
+// to the field's value, in the same shape as --public-keys-file. Unlike
+// --public-keys-file, the packet encryption key is exported as a public key
+// rather than a CSR, and manifests are not read.
+func exportPublic(ctx context.Context, cfg exportPublicConfig, w io.Writer) error {
+	packetEncryptionKey, err := cfg.keyStore.GetPacketEncryptionKey(ctx, cfg.locality)
+	if err != nil {
+		return fmt.Errorf("couldn't get packet encryption key for %q: %w", cfg.locality, err)
+	}
+	var taskSigningKey key.Key
+	if cfg.taskSigningKey {
+		if taskSigningKey, err = cfg.keyStore.GetTaskSigningKey(ctx, cfg.locality); err != nil {
+			return fmt.Errorf("couldn't get task signing key for %q: %w", cfg.locality, err)
+		}
+	}
+
+	encode := func(m key.Material) (string, error) {
+		publicKey, err := m.ExportPublic(cfg.format)
+		if err != nil {
+			return "", err
+		}
+		if cfg.format == key.PEM {
+			return string(publicKey), nil
+		}
+		return base64.StdEncoding.EncodeToString(publicKey), nil
+	}
+
+	rotateCFG := rotateKeysConfig{prioEnvironment: cfg.prioEnvironment, locality: cfg.locality}
+	publicKeys := map[string]string{}
+	for _, ingestor := range cfg.ingestors {
+		batchSigningKey, err := cfg.keyStore.GetBatchSigningKey(ctx, cfg.locality, ingestor)
+		if err != nil {
+			return fmt.Errorf("couldn't get batch signing key for (%q, %q): %w", cfg.locality, ingestor, err)
+		}
+		fields, err := rotateCFG.updateKeysConfig(ingestor, batchSigningKey, packetEncryptionKey, taskSigningKey).PrimaryKeyIDs()
+		if err != nil {
+			return fmt.Errorf("couldn't get key IDs for (%q, %q): %w", cfg.locality, ingestor, err)
+		}
+		if fields[manifest.BatchSigningPublicKeyField], err = encode(batchSigningKey.Primary().KeyMaterial); err != nil {
+			return fmt.Errorf("couldn't export batch signing key for (%q, %q): %w", cfg.locality, ingestor, err)
+		}
+		if fields[packetEncryptionPublicKeyField], err = encode(packetEncryptionKey.Primary().KeyMaterial); err != nil {
+			return fmt.Errorf("couldn't export packet encryption key for %q: %w", cfg.locality, err)
+		}
+		if !taskSigningKey.IsEmpty() {
+			if fields[manifest.TaskSigningPublicKeyField], err = encode(taskSigningKey.Primary().KeyMaterial); err != nil {
+				return fmt.Errorf("couldn't export task signing key for %q: %w", cfg.locality, err)
+			}
+		}
+		for field, value := range fields {
+			publicKeys[fmt.Sprintf("%s.%s", dspName(cfg.locality, ingestor), field)] = value
+		}
+	}
+
+	publicKeysBytes, err := json.MarshalIndent(publicKeys, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't marshal public keys as JSON: %w", err)
+	}
+	if _, err := w.Write(append(publicKeysBytes, '\n')); err != nil {
+		return fmt.Errorf("couldn't write public keys: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/abetterinternet/prio-server/key-rotator/manifest"
+)
+
+// Phases at which manifest hooks are invoked.
+const (
+	preWritePhase  = "pre-write"
+	postWritePhase = "post-write"
+)
+
+// manifestHookEvent describes a manifest write to a manifest hook. It is
+// provided to hooks as JSON.
+type manifestHookEvent struct {
+	Phase        string `json:"phase"`         // preWritePhase or postWritePhase
+	ManifestName string `json:"manifest-name"` // the name of the data share processor whose manifest is written
+	Locality     string `json:"locality"`
+	Ingestor     string `json:"ingestor"`
+	Diff         string `json:"diff"`    // a human-readable description of the changes to the manifest
+	DryRun       bool   `json:"dry-run"` // if set, the manifest is not actually written
+
+	OldManifest manifest.DataShareProcessorSpecificManifest `json:"old-manifest"`
+	NewManifest manifest.DataShareProcessorSpecificManifest `json:"new-manifest"`
+}
+
+// manifestHook is invoked around manifest writes, allowing custom checks or
+// notifications to be integrated with rotation.
+type manifestHook interface {
+	// run invokes the hook for the given event, returning an error if the
+	// hook could not be invoked or reported failure.
+	run(ctx context.Context, event manifestHookEvent) error
+}
+
+// manifestHooks are the hooks invoked around each manifest write. The zero
+// value invokes no hooks.
+type manifestHooks struct {
+	// preWrite, if non-nil, is invoked before each manifest write. If it
+	// fails, the manifest is not written.
+	preWrite manifestHook
+	// postWrite, if non-nil, is invoked after each successful manifest write.
+	// Failures are logged, but are not otherwise treated as errors since the
+	// manifest has already been written.
+	postWrite manifestHook
+	// dryRun is reported to hooks, so that they may e.g. perform checks
+	// without recording that a change was made.
+	dryRun bool
+}
+
+// newManifestHook creates a manifest hook from a specification, which is
+// either an HTTP(S) URL, to which events are POSTed, or "exec:" followed by
+// the path of an executable, which is run with the event on its standard
+// input. Webhooks are called using client. An empty specification returns a
+// nil hook.
+func newManifestHook(spec string, client *http.Client) (manifestHook, error) {
+	switch {
+	case spec == "":
+		return nil, nil
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return webhookManifestHook{url: spec, client: client}, nil
+	case strings.HasPrefix(spec, "exec:"):
+		path := strings.TrimPrefix(spec, "exec:")
+		if path == "" {
+			return nil, fmt.Errorf("exec hook %q has no command", spec)
+		}
+		return execManifestHook{path: path}, nil
+	default:
+		return nil, fmt.Errorf("hook %q must be an http:// or https:// URL or an exec: command", spec)
+	}
+}
+
+// webhookManifestHook POSTs events, as JSON, to a URL. The hook fails unless
+// the response status is 2xx.
+type webhookManifestHook struct {
+	url    string
+	client *http.Client
+}
+
+var _ manifestHook = webhookManifestHook{}
+
+func (h webhookManifestHook) run(ctx context.Context, event manifestHookEvent) error {
+	return postJSON(ctx, h.client, h.url, event)
+}
+
+// postJSON POSTs v, serialized as JSON, to a webhook URL using client. It
+// fails unless the response status is 2xx.
+func postJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("couldn't serialize webhook request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("couldn't create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("couldn't call webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("webhook returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
+
+// execManifestHook runs an executable with the event, as JSON, on its
+// standard input. The phase & manifest name are also provided in the
+// KEY_ROTATOR_HOOK_PHASE & KEY_ROTATOR_MANIFEST_NAME environment variables.
+// The hook fails unless the executable exits successfully.
+type execManifestHook struct {
+	path string
+}
+
+var _ manifestHook = execManifestHook{}
+
+func (h execManifestHook) run(ctx context.Context, event manifestHookEvent) error {
+	input, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("couldn't serialize hook event: %w", err)
+	}
+	cmd := exec.CommandContext(ctx, h.path)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Env = append(cmd.Environ(),
+		"KEY_ROTATOR_HOOK_PHASE="+event.Phase,
+		"KEY_ROTATOR_MANIFEST_NAME="+event.ManifestName)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("hook %q failed: %w: %s", h.path, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// beforeWrite invokes the pre-write hook, if any, for a manifest write.
+func (h manifestHooks) beforeWrite(ctx context.Context, event manifestHookEvent) error {
+	if h.preWrite == nil {
+		return nil
+	}
+	event.Phase, event.DryRun = preWritePhase, h.dryRun
+	if err := h.preWrite.run(ctx, event); err != nil {
+		return fmt.Errorf("pre-write hook rejected manifest %q: %w", event.ManifestName, err)
+	}
+	return nil
+}
+
+// afterWrite invokes the post-write hook, if any, for a manifest write,
+// logging any failure.
+func (h manifestHooks) afterWrite(ctx context.Context, event manifestHookEvent) {
+	if h.postWrite == nil {
+		return
+	}
+	event.Phase, event.DryRun = postWritePhase, h.dryRun
+	if err := h.postWrite.run(ctx, event); err != nil {
+		log.Error().Err(err).Str("manifest", event.ManifestName).Msgf("Post-write hook failed for manifest %q: %v", event.ManifestName, err)
+	}
+}
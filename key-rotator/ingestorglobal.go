@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+	"github.com/abetterinternet/prio-server/key-rotator/manifest"
+	"github.com/abetterinternet/prio-server/key-rotator/storage"
+)
+
+// ingestorGlobalLocality is the locality under which the batch signing key of
+// a singleton ingestor is stored & identified in key IDs, since the ingestor
+// advertises a single global manifest for every locality.
+const ingestorGlobalLocality = "global"
+
+// ingestorGlobalConfig configures the rotation of a singleton ingestor's batch
+// signing key, & the update of the ingestor global manifest advertising it,
+// i.e. --ingestor-global-manifest.
+type ingestorGlobalConfig struct {
+	ingestor      string           // the name of the singleton ingestor
+	manifestStore storage.Manifest // the store holding the ingestor global manifest
+}
+
+// readIngestorGlobal reads the singleton ingestor's batch signing key &
+// global manifest. The manifest must already exist, since it advertises the
+// ingestor's server identity, which key-rotator does not manage.
+func readIngestorGlobal(ctx context.Context, cfg rotateKeysConfig) (key.Key, manifest.IngestorGlobalManifest, error) {
+	ingestor := cfg.ingestorGlobal.ingestor
+	k, err := cfg.keyStore.GetBatchSigningKey(ctx, ingestorGlobalLocality, ingestor)
+	if err != nil {
+		return key.Key{}, manifest.IngestorGlobalManifest{}, fmt.Errorf("couldn't get batch signing key for singleton ingestor %q: %w", ingestor, err)
+	}
+	m, err := cfg.ingestorGlobal.manifestStore.GetIngestorGlobalManifest(ctx)
+	if err != nil {
+		return key.Key{}, manifest.IngestorGlobalManifest{}, fmt.Errorf("couldn't get global manifest for singleton ingestor %q: %w", ingestor, err)
+	}
+	return k, m, nil
+}
+
+// rotateIngestorGlobal rotates the singleton ingestor's batch signing key per
+// the batch signing key's rotation config, then updates its global manifest
+// to match the rotated key.
+func rotateIngestorGlobal(cfg rotateKeysConfig, oldKey key.Key, oldManifest manifest.IngestorGlobalManifest) (key.Key, manifest.IngestorGlobalManifest, error) {
+	ingestor := cfg.ingestorGlobal.ingestor
+	newKey := oldKey
+	if oldKey.IsEmpty() || cfg.batchCFG.enableRotation {
+		k, err := oldKey.Rotate(cfg.now, cfg.batchCFG.rotationCFG)
+		if err != nil {
+			return key.Key{}, manifest.IngestorGlobalManifest{}, fmt.Errorf("couldn't rotate batch signing key for singleton ingestor %q: %w", ingestor, err)
+		}
+		newKey = k
+	} else {
+		log.Info().Str("ingestor", ingestor).Msgf("Skipping rotation of batch signing key for singleton ingestor %q: --batch-signing-key-enable-rotation set to false", ingestor)
+	}
+
+	// Key IDs are generated as for data share processor specific manifests,
+	// with ingestorGlobalLocality in place of the locality.
+	globalCFG := cfg
+	globalCFG.locality = ingestorGlobalLocality
+	newManifest, err := oldManifest.UpdateKeys(globalCFG.updateKeysConfig(ingestor, newKey, key.Key{}, key.Key{}))
+	if err != nil {
+		return key.Key{}, manifest.IngestorGlobalManifest{}, manifestError{fmt.Errorf("couldn't update global manifest for singleton ingestor %q: %w", ingestor, err)}
+	}
+	return newKey, newManifest, nil
+}
+
+// writeIngestorGlobalKey writes the singleton ingestor's batch signing key, if
+// it has changed or --batch-signing-key-always-write is specified.
+func writeIngestorGlobalKey(ctx context.Context, cfg rotateKeysConfig, oldKey, newKey key.Key) error {
+	ingestor := cfg.ingestorGlobal.ingestor
+	if !cfg.batchCFG.alwaysWrite && oldKey.Equal(newKey) {
+		log.Debug().Str("ingestor", ingestor).Msgf("Skipping write for batch signing key for singleton ingestor %q: key unchanged", ingestor)
+		return nil
+	}
+	diffs := newKey.Diff(oldKey)
+	if cfg.batchCFG.alwaysWrite {
+		diffs = semicolonJoin("--batch-signing-key-always-write is specified", diffs)
+	}
+	log.Info().Str("ingestor", ingestor).Msgf("Writing batch signing key for singleton ingestor %q because: %s", ingestor, diffs)
+	if err := cfg.keyStore.PutBatchSigningKey(ctx, ingestorGlobalLocality, ingestor, newKey); err != nil {
+		return fmt.Errorf("couldn't write batch signing key for singleton ingestor %q: %w", ingestor, err)
+	}
+	keysWritten.WithLabelValues(ingestorGlobalLocality, ingestor, batchSigningKeyKind).Inc()
+	recordKeyVersionChanges(ctx, ingestorGlobalLocality, batchSigningKeyKind, oldKey, newKey)
+	cfg.notifier.notify(ctx, keyEvents(batchSigningKeyKind, ingestorGlobalLocality, ingestor, oldKey, newKey)...)
+	cfg.report.addKey(batchSigningKeyKind, ingestorGlobalLocality, ingestor, oldKey, newKey)
+	return nil
+}
+
+// writeIngestorGlobalManifest writes the singleton ingestor's global manifest,
+// if it has changed. Manifest hooks, which are given data share processor
+// specific manifests, are not invoked.
+func writeIngestorGlobalManifest(ctx context.Context, cfg rotateKeysConfig, oldManifest, newManifest manifest.IngestorGlobalManifest) error {
+	ingestor := cfg.ingestorGlobal.ingestor
+	if oldManifest.Equal(newManifest) {
+		log.Debug().Str("ingestor", ingestor).Msgf("Skipping write for global manifest for singleton ingestor %q: manifest unchanged", ingestor)
+		return nil
+	}
+	diff := newManifest.Diff(oldManifest)
+	log.Info().Str("ingestor", ingestor).Msgf("Writing global manifest for singleton ingestor %q: %s", ingestor, diff)
+	if err := cfg.ingestorGlobal.manifestStore.PutIngestorGlobalManifest(ctx, newManifest); err != nil {
+		return fmt.Errorf("couldn't write global manifest for singleton ingestor %q: %w", ingestor, err)
+	}
+	manifestsWritten.WithLabelValues(ingestorGlobalLocality, ingestor).Inc()
+	cfg.notifier.notify(ctx, rotationEvent{
+		Event:        manifestChangedEvent,
+		Locality:     ingestorGlobalLocality,
+		Ingestor:     ingestor,
+		ManifestName: ingestor + "/global-manifest.json",
+		Diff:         diff,
+	})
+	cfg.report.addManifest(ingestorGlobalLocality, ingestor, ingestor+"/global-manifest.json", diff)
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+)
+
+// inspectConfig configures a read-only inspection of the state of a
+// locality's keys & manifests.
+type inspectConfig struct {
+	rotate rotateKeysConfig // keys & manifests are read from rotate's stores; rotate's rotation configs determine eligibility times
+	json   bool             // if set, the report is written as JSON rather than as human-readable text
+}
+
+// inspectReport describes the keys & manifests of a single locality, as of a
+// given time, as written by inspect.
+type inspectReport struct {
+	Locality            string                `json:"locality"`
+	Time                string                `json:"time"` // formatted per RFC 3339
+	PacketEncryptionKey inspectKey            `json:"packet-encryption-key"`
+	BatchSigningKeys    map[string]inspectKey `json:"batch-signing-keys"`         // by ingestor
+	TaskSigningKey      *inspectKey           `json:"task-signing-key,omitempty"` // only if the task signing key is managed
+	Mismatches          []string              `json:"mismatches"`                 // between keys & the public keys published in manifests
+}
+
+// inspectKey describes a single key.
+type inspectKey struct {
+	RotationEnabled bool                `json:"rotation-enabled"`
+	NextCreation    string              `json:"next-creation,omitempty"` // after this time, the next rotation creates a new version; empty if the key has no versions
+	Versions        []inspectKeyVersion `json:"versions"`                // in try order, primary first
+}
+
+// inspectKeyVersion describes a single key version. Eligibility times are
+// those after which rotation may make the version primary, or delete it; a
+// version is deleted only while more than the minimum number of versions
+// remain, oldest first.
+type inspectKeyVersion struct {
+	KeyID             string `json:"key-id"`
+	Algorithm         string `json:"algorithm"`
+	CreationTimestamp int64  `json:"creation-timestamp"`
+	AgeSeconds        int64  `json:"age-seconds"`
+	Primary           bool   `json:"primary"`
+	PrimaryEligible   string `json:"primary-eligible"`
+	DeletionEligible  string `json:"deletion-eligible"`
+}
+
+// inspect reads the locality's keys & manifests, and writes a report of their
+// state to w: each key's versions, their ages, which is primary, when
+// rotation may create, promote or delete versions, and any mismatches between
+// keys & the public keys published in manifests. Nothing is written to the key
+// or manifest stores.
+func inspect(ctx context.Context, cfg inspectConfig, w io.Writer) error {
+	report, err := newInspectReport(ctx, cfg.rotate)
+	if err != nil {
+		return err
+	}
+	if cfg.json {
+		reportBytes, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("couldn't marshal report as JSON: %w", err)
+		}
+		if _, err := w.Write(append(reportBytes, '\n')); err != nil {
+			return fmt.Errorf("couldn't write report: %w", err)
+		}
+		return nil
+	}
+	if err := report.writeText(w); err != nil {
+		return fmt.Errorf("couldn't write report: %w", err)
+	}
+	return nil
+}
+
+func newInspectReport(ctx context.Context, cfg rotateKeysConfig) (inspectReport, error) {
+	now := cfg.now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	packetEncryptionKey, batchSigningKeyByIngestor, manifestByIngestor, err :=
+		readKeysAndManifests(ctx, cfg.keyStore, cfg.manifestStore, cfg.locality, cfg.ingestors)
+	if err != nil {
+		return inspectReport{}, err
+	}
+	var taskSigningKey key.Key
+	if cfg.manageTaskSigningKey {
+		if taskSigningKey, err = cfg.keyStore.GetTaskSigningKey(ctx, cfg.locality); err != nil {
+			return inspectReport{}, fmt.Errorf("couldn't get task signing key for %q: %w", cfg.locality, err)
+		}
+	}
+
+	report := inspectReport{
+		Locality:         cfg.locality,
+		Time:             now.UTC().Format(time.RFC3339),
+		BatchSigningKeys: map[string]inspectKey{},
+		Mismatches:       []string{},
+	}
+	// Packet encryption & task signing key IDs are the same in every
+	// ingestor's manifest.
+	localityCFG := cfg.updateKeysConfig("", key.Key{}, packetEncryptionKey, taskSigningKey)
+	report.PacketEncryptionKey = newInspectKey(now, packetEncryptionKey, localityCFG.PacketEncryptionKeyIDPrefix, cfg.packetCFG)
+	if cfg.manageTaskSigningKey {
+		tsk := newInspectKey(now, taskSigningKey, localityCFG.TaskSigningKeyIDPrefix, cfg.taskCFG)
+		report.TaskSigningKey = &tsk
+	}
+	for _, ingestor := range cfg.ingestors {
+		updateCFG := cfg.updateKeysConfig(ingestor, batchSigningKeyByIngestor[ingestor], packetEncryptionKey, taskSigningKey)
+		report.BatchSigningKeys[ingestor] = newInspectKey(now, batchSigningKeyByIngestor[ingestor], updateCFG.BatchSigningKeyIDPrefix, cfg.batchCFG)
+		for _, mismatch := range manifestByIngestor[ingestor].Mismatches(updateCFG) {
+			report.Mismatches = append(report.Mismatches, fmt.Sprintf("manifest for (%q, %q): %s", cfg.locality, ingestor, mismatch))
+		}
+	}
+	return report, nil
+}
+
+func newInspectKey(now time.Time, k key.Key, keyIDPrefix string, cfg rotateKeyConfig) inspectKey {
+	formatTime := func(ts int64, after time.Duration) string {
+		return time.Unix(ts, 0).Add(after).UTC().Format(time.RFC3339)
+	}
+
+	ik := inspectKey{RotationEnabled: cfg.enableRotation, Versions: []inspectKeyVersion{}}
+	var youngest int64
+	_ = k.Versions(func(v key.Version) error {
+		if len(ik.Versions) == 0 || v.CreationTimestamp > youngest {
+			youngest = v.CreationTimestamp
+		}
+		keyID := keyIDPrefix
+		if v.CreationTimestamp != 0 {
+			keyID = fmt.Sprintf("%s-%d", keyIDPrefix, v.CreationTimestamp)
+		}
+		ik.Versions = append(ik.Versions, inspectKeyVersion{
+			KeyID:             keyID,
+			Algorithm:         v.KeyMaterial.Type().String(),
+			CreationTimestamp: v.CreationTimestamp,
+			AgeSeconds:        now.Unix() - v.CreationTimestamp,
+			Primary:           len(ik.Versions) == 0,
+			PrimaryEligible:   formatTime(v.CreationTimestamp, cfg.rotationCFG.PrimaryMinAge),
+			DeletionEligible:  formatTime(v.CreationTimestamp, cfg.rotationCFG.DeleteMinAge),
+		})
+		return nil
+	})
+	if len(ik.Versions) > 0 {
+		ik.NextCreation = formatTime(youngest, cfg.rotationCFG.CreateMinAge)
+	}
+	return ik
+}
+
+func (r inspectReport) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Keys & manifests for locality %q as of %s\n", r.Locality, r.Time)
+
+	writeKey := func(name string, k inspectKey) {
+		fmt.Fprintf(tw, "\n%s", name)
+		switch {
+		case !k.RotationEnabled:
+			fmt.Fprintf(tw, " (rotation disabled)")
+		case k.NextCreation != "":
+			fmt.Fprintf(tw, " (next version created after %s)", k.NextCreation)
+		}
+		fmt.Fprintln(tw, ":")
+		if len(k.Versions) == 0 {
+			fmt.Fprintln(tw, "  (no versions)")
+			return
+		}
+		fmt.Fprintln(tw, "  KEY ID\tALGORITHM\tCREATED\tAGE\tPRIMARY\tPRIMARY ELIGIBLE\tDELETION ELIGIBLE")
+		for _, v := range k.Versions {
+			primary := ""
+			if v.Primary {
+				primary = "yes"
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				v.KeyID, v.Algorithm, time.Unix(v.CreationTimestamp, 0).UTC().Format(time.RFC3339),
+				formatAge(time.Duration(v.AgeSeconds)*time.Second), primary, v.PrimaryEligible, v.DeletionEligible)
+		}
+	}
+
+	writeKey("Packet encryption key", r.PacketEncryptionKey)
+	var ingestors []string
+	for ingestor := range r.BatchSigningKeys {
+		ingestors = append(ingestors, ingestor)
+	}
+	sort.Strings(ingestors)
+	for _, ingestor := range ingestors {
+		writeKey(fmt.Sprintf("Batch signing key for %q", ingestor), r.BatchSigningKeys[ingestor])
+	}
+	if r.TaskSigningKey != nil {
+		writeKey("Task signing key", *r.TaskSigningKey)
+	}
+
+	if len(r.Mismatches) == 0 {
+		fmt.Fprintln(tw, "\nKeys match manifests")
+	} else {
+		fmt.Fprintf(tw, "\n%d mismatches between keys & manifests:\n", len(r.Mismatches))
+		fmt.Fprintf(tw, "  %s\n", strings.Join(r.Mismatches, "\n  "))
+	}
+	return tw.Flush()
+}
+
+// formatAge formats a key version's age in days & hours, e.g. "273d4h".
+func formatAge(age time.Duration) string {
+	if age < 0 {
+		return age.String()
+	}
+	return fmt.Sprintf("%dd%dh", age/(24*time.Hour), age%(24*time.Hour)/time.Hour)
+}
@@ -15,7 +15,8 @@ import (
 // in decryption or signature verification. A single version will be considered
 // "primary": this version will be used for encryption or signing.
 type Key struct {
-	// structure of v: if v is not empty, the first element is the primary version.
+	// structure of v: if v is not empty, the first element is the primary
+	// version, and the remaining elements are in try order (see TryOrder).
 	// note well: all new, non-empty Key values should be created via `fromVersionSlice`.
 	v []Version
 }
@@ -130,6 +131,13 @@ func (k Key) Diff(o Key) string {
 			diffs = append(diffs, fmt.Sprintf("modified key material for version %d", ts))
 		}
 	}
+
+	// Generate try-order diffs. A change in try order is only reported if
+	// there are no other differences, since adding, removing or changing the
+	// primary version otherwise changes the try order too.
+	if len(diffs) == 0 && !k.Equal(o) {
+		diffs = append(diffs, fmt.Sprintf("changed try order %v → %v", o.TryOrder(), k.TryOrder()))
+	}
 	return strings.Join(diffs, "; ")
 }
 
@@ -137,8 +145,8 @@ func (k Key) Diff(o Key) string {
 // no versions.
 func (k Key) IsEmpty() bool { return len(k.v) == 0 }
 
-// Versions visits the versions contained within this key in an unspecified
-// order, calling the provided function on each version. If the provided
+// Versions visits the versions contained within this key in try order (see
+// TryOrder), calling the provided function on each version. If the provided
 // function returns an error, Versions stops visiting versions and returns that
 // error. Otherwise, Versions will never return an error.
 func (k Key) Versions(f func(Version) error) error {
@@ -154,6 +162,51 @@ func (k Key) Versions(f func(Version) error) error {
 // empty key.
 func (k Key) Primary() Version { return k.v[0] }
 
+// TryOrder returns the creation timestamps of this key's versions in the order
+// in which they should be attempted for decryption or signature verification:
+// the primary version first, then the other versions. Unless reordered by
+// WithTryOrder, the other versions are ordered youngest to oldest.
+func (k Key) TryOrder() []int64 {
+	order := make([]int64, len(k.v))
+	for i, v := range k.v {
+		order[i] = v.CreationTimestamp
+	}
+	return order
+}
+
+// WithTryOrder returns a copy of this key whose non-primary versions are
+// reordered so that those with the given creation timestamps are attempted
+// first, in the given order. The remaining non-primary versions are attempted
+// after them, youngest to oldest. Timestamps which do not identify a
+// non-primary version of this key are ignored.
+func (k Key) WithTryOrder(order []int64) Key {
+	if len(k.v) == 0 {
+		return k
+	}
+	rank := map[int64]int{}
+	for i, ts := range order {
+		if _, ok := rank[ts]; !ok {
+			rank[ts] = i
+		}
+	}
+	vs := make([]Version, len(k.v))
+	copy(vs, k.v)
+	nonPrimaryVs := vs[1:]
+	sort.SliceStable(nonPrimaryVs, func(i, j int) bool {
+		iRank, iOK := rank[nonPrimaryVs[i].CreationTimestamp]
+		jRank, jOK := rank[nonPrimaryVs[j].CreationTimestamp]
+		switch {
+		case iOK && jOK:
+			return iRank < jRank
+		case iOK != jOK:
+			return iOK
+		default:
+			return nonPrimaryVs[j].CreationTimestamp < nonPrimaryVs[i].CreationTimestamp
+		}
+	})
+	return Key{vs}
+}
+
 // RotationConfig defines the configuration for a key-rotation operation.
 type RotationConfig struct {
 	CreateKeyFunc func() (Material, error) // CreateKeyFunc returns newly-generated key material, or an error if it can't.
@@ -212,6 +265,32 @@ func (cfg RotationConfig) Validate() error {
 //
 // The returned key is guaranteed to include at least one version.
 func (k Key) Rotate(now time.Time, cfg RotationConfig) (Key, error) {
+	return k.rotate(now, cfg, false)
+}
+
+// Revoke removes the version with the given creation timestamp from the key,
+// e.g. because its key material may have been compromised, then rotates the
+// key as Rotate does, except that a new key version is always created,
+// irrespective of `create_min_age`. The primary version is determined by the
+// usual policy, so if the revoked version was primary, the youngest remaining
+// version not younger than `primary_min_age` becomes primary. It is an error
+// if the key has no version with the given creation timestamp.
+func (k Key) Revoke(now time.Time, creationTimestamp int64, cfg RotationConfig) (Key, error) {
+	vs := make([]Version, 0, len(k.v))
+	for _, v := range k.v {
+		if v.CreationTimestamp != creationTimestamp {
+			vs = append(vs, v)
+		}
+	}
+	if len(vs) == len(k.v) {
+		return Key{}, fmt.Errorf("key has no version with creation timestamp %d", creationTimestamp)
+	}
+	return Key{vs}.rotate(now, cfg, true)
+}
+
+// rotate implements Rotate & Revoke. If forceCreate is set, a new key version
+// is created irrespective of `create_min_age`.
+func (k Key) rotate(now time.Time, cfg RotationConfig, forceCreate bool) (Key, error) {
 	// Validate parameters.
 	if err := cfg.Validate(); err != nil {
 		return Key{}, fmt.Errorf("invalid rotation config: %w", err)
@@ -237,7 +316,7 @@ func (k Key) Rotate(now time.Time, cfg RotationConfig) (Key, error) {
 	// (The version at the largest index is guaranteed to be the youngest due
 	// to the sort criteria.)
 	youngestVersionIdx := len(vs) - 1
-	if len(vs) == 0 || age(vs[youngestVersionIdx]) > cfg.CreateMinAge {
+	if forceCreate || len(vs) == 0 || age(vs[youngestVersionIdx]) > cfg.CreateMinAge {
 		m, err := cfg.CreateKeyFunc()
 		if err != nil {
 			return Key{}, fmt.Errorf("couldn't create new key version: %w", err)
@@ -291,6 +370,7 @@ func (k Key) MarshalJSON() ([]byte, error) {
 			KeyMaterial:       v.KeyMaterial,
 			CreationTimestamp: v.CreationTimestamp,
 			Primary:           i == 0,
+			TryOrder:          i,
 		}
 	}
 	return json.Marshal(jvs)
@@ -325,6 +405,21 @@ func (k *Key) UnmarshalJSON(data []byte) error {
 	if err != nil {
 		return fmt.Errorf("key validation error: %w", err)
 	}
+
+	// Restore the try order of non-primary versions, if recorded. Keys
+	// serialized before try order was recorded use the canonical order.
+	var ordered []jsonVersion
+	for _, jv := range jvs {
+		if !jv.Primary && jv.TryOrder > 0 {
+			ordered = append(ordered, jv)
+		}
+	}
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].TryOrder < ordered[j].TryOrder })
+	order := make([]int64, len(ordered))
+	for i, jv := range ordered {
+		order[i] = jv.CreationTimestamp
+	}
+	*k = k.WithTryOrder(order)
 	return nil
 }
 
@@ -349,4 +444,8 @@ type jsonVersion struct {
 	KeyMaterial       Material `json:"key"`
 	CreationTimestamp int64    `json:"creation_time,string"`
 	Primary           bool     `json:"primary,omitempty"`
+	// TryOrder is the position of this version in the key's try order, e.g.
+	// 1 for the first non-primary version to be attempted. It is omitted for
+	// the primary version, which is always attempted first.
+	TryOrder int `json:"try_order,omitempty"`
 }
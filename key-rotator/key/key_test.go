@@ -72,7 +72,7 @@ func TestKeyMarshal(t *testing.T) {
 		t.Parallel()
 
 		// wantKey generated from a run of the SerializeDeserialize test.
-		const wantKey = `[{"key":"ACrYJ2YS9Oem","creation_time":"200000","primary":true},{"key":"AQKtg3k806wsd0ld/FUSjr+9B9ZjvNIjL4Thwp/olCLNTDIpxAWKwzYAuqyCcChbQ72AShRIQQOJgkSVT6kw/N9b","creation_time":"250000"},{"key":"AQMp62hRUAKqVHXfhwApjJPMV21kxQpb0OYqk7/IxU5etbiIdgHv1+d5EHApWJrCD0a/QI4RtPx0iOkjr1Pitwsp","creation_time":"150000"},{"key":"ACdcLaKY8VsN","creation_time":"100000"}]`
+		const wantKey = `[{"key":"ACrYJ2YS9Oem","creation_time":"200000","primary":true},{"key":"AQKtg3k806wsd0ld/FUSjr+9B9ZjvNIjL4Thwp/olCLNTDIpxAWKwzYAuqyCcChbQ72AShRIQQOJgkSVT6kw/N9b","creation_time":"250000","try_order":1},{"key":"AQMp62hRUAKqVHXfhwApjJPMV21kxQpb0OYqk7/IxU5etbiIdgHv1+d5EHApWJrCD0a/QI4RtPx0iOkjr1Pitwsp","creation_time":"150000","try_order":2},{"key":"ACdcLaKY8VsN","creation_time":"100000","try_order":3}]`
 
 		var k Key
 		if err := json.Unmarshal([]byte(wantKey), &k); err != nil {
@@ -88,6 +88,57 @@ func TestKeyMarshal(t *testing.T) {
 		}
 	})
 
+	t.Run("DeserializeTryOrder", func(t *testing.T) {
+		t.Parallel()
+
+		for _, test := range []struct {
+			name          string
+			serializedKey string
+			wantTryOrder  []int64
+		}{
+			{
+				name:          "no try order",
+				serializedKey: `[{"key":"ACdcLaKY8VsN","creation_time":"100000"},{"key":"ACrYJ2YS9Oem","creation_time":"200000","primary":true},{"key":"ACdcLaKY8VsN","creation_time":"150000"}]`,
+				wantTryOrder:  []int64{200000, 150000, 100000},
+			},
+			{
+				name:          "recorded try order",
+				serializedKey: `[{"key":"ACrYJ2YS9Oem","creation_time":"200000","primary":true},{"key":"ACdcLaKY8VsN","creation_time":"150000","try_order":2},{"key":"ACdcLaKY8VsN","creation_time":"100000","try_order":1}]`,
+				wantTryOrder:  []int64{200000, 100000, 150000},
+			},
+			{
+				name:          "partial try order",
+				serializedKey: `[{"key":"ACrYJ2YS9Oem","creation_time":"200000","primary":true},{"key":"ACdcLaKY8VsN","creation_time":"150000"},{"key":"ACdcLaKY8VsN","creation_time":"125000"},{"key":"ACdcLaKY8VsN","creation_time":"100000","try_order":1}]`,
+				wantTryOrder:  []int64{200000, 100000, 150000, 125000},
+			},
+		} {
+			test := test
+			t.Run(test.name, func(t *testing.T) {
+				t.Parallel()
+				var k Key
+				if err := json.Unmarshal([]byte(test.serializedKey), &k); err != nil {
+					t.Fatalf("Couldn't JSON-unmarshal key: %v", err)
+				}
+				if diff := cmp.Diff(test.wantTryOrder, k.TryOrder()); diff != "" {
+					t.Errorf("Unexpected try order (-want +got):\n%s", diff)
+				}
+
+				// Check that the try order survives a round trip.
+				buf, err := json.Marshal(k)
+				if err != nil {
+					t.Fatalf("Couldn't JSON-marshal key: %v", err)
+				}
+				var gotKey Key
+				if err := json.Unmarshal(buf, &gotKey); err != nil {
+					t.Fatalf("Couldn't JSON-unmarshal key: %v", err)
+				}
+				if !k.Equal(gotKey) {
+					t.Errorf("Key changed after round trip: %s", gotKey.Diff(k))
+				}
+			})
+		}
+	})
+
 	t.Run("DeserializeValidation", func(t *testing.T) {
 		t.Parallel()
 
@@ -304,6 +355,75 @@ func TestKeyRotate(t *testing.T) {
 	})
 }
 
+func TestKeyRevoke(t *testing.T) {
+	t.Parallel()
+
+	const now = 100000
+
+	cfg := RotationConfig{
+		CreateKeyFunc: func() (Material, error) { return newTestKey(now), nil },
+		CreateMinAge:  10000 * time.Second,
+
+		PrimaryMinAge: 1000 * time.Second,
+
+		DeleteMinAge:      20000 * time.Second,
+		DeleteMinKeyCount: 2,
+	}
+
+	for _, test := range []struct {
+		name    string
+		key     Key
+		revoke  int64
+		wantKey Key
+	}{
+		{
+			name:    "non-primary version",
+			key:     k(98000, 95000),
+			revoke:  95000,
+			wantKey: k(98000, now),
+		},
+		{
+			name:    "primary version",
+			key:     k(98000, 95000),
+			revoke:  98000,
+			wantKey: k(95000, now),
+		},
+		{
+			name:    "only version",
+			key:     k(98000),
+			revoke:  98000,
+			wantKey: k(now),
+		},
+		{
+			name:    "deletion still applies",
+			key:     k(98000, 79999, 97000),
+			revoke:  97000,
+			wantKey: k(98000, now),
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			gotKey, err := test.key.Revoke(time.Unix(now, 0), test.revoke, cfg)
+			if err != nil {
+				t.Fatalf("Unexpected error from Revoke: %v", err)
+			}
+			if !gotKey.Equal(test.wantKey) {
+				t.Errorf("gotKey differs from wantKey (-want +got):\n%s", cmp.Diff(test.wantKey, gotKey))
+			}
+		})
+	}
+
+	t.Run("unknown version", func(t *testing.T) {
+		t.Parallel()
+		const wantErrString = "no version with creation timestamp 97000"
+		_, err := k(98000, 95000).Revoke(time.Unix(now, 0), 97000, cfg)
+		if err == nil || !strings.Contains(err.Error(), wantErrString) {
+			t.Errorf("Wanted error containing %q, got: %v", wantErrString, err)
+		}
+	})
+}
+
 func TestDiff(t *testing.T) {
 	t.Parallel()
 
@@ -368,6 +488,12 @@ func TestDiff(t *testing.T) {
 			after:    must(FromVersions(Version{KeyMaterial: newTestKey(1), CreationTimestamp: 100000})),
 			wantDiff: "modified key material for version 100000",
 		},
+		{
+			name:     "changed try order",
+			before:   k(200000, 150000, 100000),
+			after:    k(200000, 150000, 100000).WithTryOrder([]int64{100000}),
+			wantDiff: "changed try order [200000 150000 100000] → [200000 100000 150000]",
+		},
 	} {
 		test := test
 		t.Run(test.name, func(t *testing.T) {
@@ -388,6 +514,62 @@ func TestDiff(t *testing.T) {
 	}
 }
 
+func TestWithTryOrder(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name         string
+		key          Key
+		order        []int64
+		wantTryOrder []int64
+	}{
+		{
+			name:         "empty key",
+			key:          Key{},
+			order:        []int64{100000},
+			wantTryOrder: []int64{},
+		},
+		{
+			name:         "no order",
+			key:          k(200000, 100000, 150000, 125000),
+			order:        nil,
+			wantTryOrder: []int64{200000, 150000, 125000, 100000},
+		},
+		{
+			name:         "full order",
+			key:          k(200000, 100000, 150000, 125000),
+			order:        []int64{125000, 100000, 150000},
+			wantTryOrder: []int64{200000, 125000, 100000, 150000},
+		},
+		{
+			name:         "partial order",
+			key:          k(200000, 100000, 150000, 125000),
+			order:        []int64{100000},
+			wantTryOrder: []int64{200000, 100000, 150000, 125000},
+		},
+		{
+			name:         "primary & unknown versions ignored",
+			key:          k(200000, 100000, 150000),
+			order:        []int64{200000, 175000, 100000},
+			wantTryOrder: []int64{200000, 100000, 150000},
+		},
+		{
+			name:         "reordered key reset",
+			key:          k(200000, 100000, 150000).WithTryOrder([]int64{100000}),
+			order:        nil,
+			wantTryOrder: []int64{200000, 150000, 100000},
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			if diff := cmp.Diff(test.wantTryOrder, test.key.WithTryOrder(test.order).TryOrder()); diff != "" {
+				t.Errorf("Unexpected try order (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 // k creates a new key or dies trying with the given version timestamps and
 // bogus key material. pkvTS is the primary key version timestamp, vtss are the
 // non-primary version timestamps.
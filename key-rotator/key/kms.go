@@ -0,0 +1,140 @@
+package key
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// KMS is a cloud key management service, such as GCP KMS or AWS KMS, which
+// holds private keys that never leave it. Each key is identified by a
+// provider-specific reference, e.g. a GCP KMS crypto key version name or an
+// AWS KMS key ARN.
+type KMS interface {
+	// CreateKey creates a new P-256 signing key, returning its reference.
+	CreateKey(ctx context.Context) (string, error)
+
+	// PublicKey returns the public portion of the referenced key.
+	PublicKey(ctx context.Context, ref string) (crypto.PublicKey, error)
+}
+
+// NewKMSMaterial creates a new P-256 key in the given KMS, returning key
+// material referring to it.
+func NewKMSMaterial(ctx context.Context, kms KMS) (Material, error) {
+	ref, err := kms.CreateKey(ctx)
+	if err != nil {
+		return Material{}, fmt.Errorf("couldn't create KMS key: %w", err)
+	}
+	pub, err := kms.PublicKey(ctx, ref)
+	if err != nil {
+		return Material{}, fmt.Errorf("couldn't get public key of KMS key %q: %w", ref, err)
+	}
+	return KMSMaterialFrom(ref, pub)
+}
+
+// KMSMaterialFrom returns a new Material of type P256 referring to the KMS key
+// with the given reference, whose public portion is the given public key. The
+// private portion of the key is held only by the KMS, so the returned Material
+// cannot be exported as a private key, nor used to sign CSRs; it serializes
+// to the reference & public key alone.
+func KMSMaterialFrom(ref string, pub crypto.PublicKey) (Material, error) {
+	if ref == "" {
+		return Material{}, errors.New("empty KMS key reference")
+	}
+	ecPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return Material{}, fmt.Errorf("KMS key %q is not an ECDSA key (was %T)", ref, pub)
+	}
+	if ecPub.Curve != elliptic.P256() {
+		return Material{}, fmt.Errorf("KMS key %q was %s rather than P-256", ref, ecPub.Curve.Params().Name)
+	}
+	return Material{&kmsMaterial{ref, ecPub}}, nil
+}
+
+// KMSKeyRef returns the reference to the KMS key holding the private portion
+// of this key material, and whether the key material is held in a KMS at all.
+func (m Material) KMSKeyRef() (string, bool) {
+	if km, ok := m.m.(*kmsMaterial); ok {
+		return km.ref, true
+	}
+	return "", false
+}
+
+// kmsTag is set in the type byte of serialized key material which is held in
+// a KMS, to distinguish it from raw key material of the same type.
+const kmsTag = 0x80
+
+// kmsMaterial is P-256 key material whose private portion is held in a KMS.
+type kmsMaterial struct {
+	ref    string
+	pubKey *ecdsa.PublicKey
+}
+
+var _ material = &kmsMaterial{} // verify kmsMaterial implements material
+
+func newUninitializedKMS() material { return &kmsMaterial{} }
+
+// errKMSPrivateKey is returned by operations requiring the private portion of
+// key material held in a KMS.
+func errKMSPrivateKey(ref string) error {
+	return fmt.Errorf("private key is held in KMS key %q", ref)
+}
+
+func (kmsMaterial) keyType() Type { return P256 }
+
+func (m kmsMaterial) equal(o material) bool {
+	om, ok := o.(*kmsMaterial)
+	return ok && m.ref == om.ref && m.pubKey.Equal(om.pubKey)
+}
+
+func (m kmsMaterial) public() PublicKey { return m.pubKey }
+
+func (m kmsMaterial) publicAsCSRDER(io.Reader, string) ([]byte, error) {
+	return nil, errKMSPrivateKey(m.ref)
+}
+
+func (m kmsMaterial) publicAsPKIXDER() ([]byte, error) {
+	pubkeyBytes, err := x509.MarshalPKIXPublicKey(m.pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encode as PKIX: %w", err)
+	}
+	return pubkeyBytes, nil
+}
+
+func (m kmsMaterial) publicAsX962Compressed() ([]byte, error) {
+	return elliptic.MarshalCompressed(elliptic.P256(), m.pubKey.X, m.pubKey.Y), nil
+}
+
+func (m kmsMaterial) publicAsRaw() ([]byte, error) { return m.publicAsX962Compressed() }
+
+func (m kmsMaterial) asX962Uncompressed() (string, error) { return "", errKMSPrivateKey(m.ref) }
+
+func (m kmsMaterial) asPKCS8() (string, error) { return "", errKMSPrivateKey(m.ref) }
+
+func (m kmsMaterial) MarshalBinary() ([]byte, error) {
+	// KMS key material's raw format is the X9.62 compressed encoding of the
+	// public key, concatenated with the reference to the KMS key.
+	pubkeyBytes, _ := m.publicAsX962Compressed()
+	return append(pubkeyBytes, m.ref...), nil
+}
+
+func (m *kmsMaterial) UnmarshalBinary(data []byte) error {
+	if len(data) <= p256PubkeyCompressedLen {
+		return fmt.Errorf("serialized data too short (want more than %d bytes, got %d)", p256PubkeyCompressedLen, len(data))
+	}
+	c := elliptic.P256()
+	x, y := elliptic.UnmarshalCompressed(c, data[:p256PubkeyCompressedLen])
+	if x == nil {
+		return errors.New("couldn't unmarshal compressed public key")
+	}
+	*m = kmsMaterial{
+		ref:    string(data[p256PubkeyCompressedLen:]),
+		pubKey: &ecdsa.PublicKey{Curve: c, X: x, Y: y},
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package key
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// fakeKMS creates P-256 keys in memory, referring to them by sequence number.
+type fakeKMS struct{ keys []*ecdsa.PrivateKey }
+
+func (k *fakeKMS) CreateKey(context.Context) (string, error) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	k.keys = append(k.keys, privKey)
+	return fmt.Sprintf("fake-kms/%d", len(k.keys)-1), nil
+}
+
+func (k *fakeKMS) PublicKey(_ context.Context, ref string) (crypto.PublicKey, error) {
+	var i int
+	if _, err := fmt.Sscanf(ref, "fake-kms/%d", &i); err != nil || i >= len(k.keys) {
+		return nil, fmt.Errorf("no such key %q", ref)
+	}
+	return k.keys[i].Public(), nil
+}
+
+func TestKMSMaterial(t *testing.T) {
+	t.Parallel()
+
+	kms := &fakeKMS{}
+	key, err := NewKMSMaterial(context.Background(), kms)
+	if err != nil {
+		t.Fatalf("Couldn't create new KMS key: %v", err)
+	}
+	if got, want := key.Type(), P256; got != want {
+		t.Errorf("Type() = %v, want %v", got, want)
+	}
+	if ref, ok := key.KMSKeyRef(); !ok || ref != "fake-kms/0" {
+		t.Errorf("KMSKeyRef() = (%q, %v), want (%q, true)", ref, ok, "fake-kms/0")
+	}
+	if !key.Public().Equal(kms.keys[0].Public()) {
+		t.Errorf("Public key does not match KMS public key")
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		t.Parallel()
+		keyBytes, err := json.Marshal(key)
+		if err != nil {
+			t.Fatalf("Couldn't marshal key: %v", err)
+		}
+		var newKey Material
+		if err := json.Unmarshal(keyBytes, &newKey); err != nil {
+			t.Fatalf("Couldn't unmarshal key: %v", err)
+		}
+		if !newKey.Equal(key) {
+			t.Errorf("Round-tripped key does not equal original key")
+		}
+		if ref, ok := newKey.KMSKeyRef(); !ok || ref != "fake-kms/0" {
+			t.Errorf("Round-tripped KMSKeyRef() = (%q, %v), want (%q, true)", ref, ok, "fake-kms/0")
+		}
+	})
+
+	t.Run("equal", func(t *testing.T) {
+		t.Parallel()
+		otherRef, err := KMSMaterialFrom("fake-kms/1", kms.keys[0].Public())
+		if err != nil {
+			t.Fatalf("Couldn't create KMS key material: %v", err)
+		}
+		if key.Equal(otherRef) {
+			t.Errorf("Keys with different references are equal")
+		}
+		raw, err := P256MaterialFrom(kms.keys[0])
+		if err != nil {
+			t.Fatalf("Couldn't create P256 key material: %v", err)
+		}
+		if key.Equal(raw) || raw.Equal(key) {
+			t.Errorf("KMS key is equal to raw key with the same public key")
+		}
+		if _, ok := raw.KMSKeyRef(); ok {
+			t.Errorf("Raw key has a KMS key reference")
+		}
+	})
+
+	t.Run("public encodings", func(t *testing.T) {
+		t.Parallel()
+		raw, err := P256MaterialFrom(kms.keys[0])
+		if err != nil {
+			t.Fatalf("Couldn't create P256 key material: %v", err)
+		}
+		for _, format := range []PublicKeyFormat{PEM, DER, Raw} {
+			got, err := key.ExportPublic(format)
+			if err != nil {
+				t.Fatalf("Couldn't export public key as %q: %v", format, err)
+			}
+			want, err := raw.ExportPublic(format)
+			if err != nil {
+				t.Fatalf("Couldn't export raw public key as %q: %v", format, err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("ExportPublic(%q) = %q, want %q", format, got, want)
+			}
+		}
+	})
+
+	t.Run("private key operations", func(t *testing.T) {
+		t.Parallel()
+		if _, err := key.AsPKCS8(); err == nil {
+			t.Errorf("Wanted error from AsPKCS8")
+		}
+		if _, err := key.AsX962Uncompressed(); err == nil {
+			t.Errorf("Wanted error from AsX962Uncompressed")
+		}
+		if _, err := key.PublicAsCSR("my.bogus.fqdn"); err == nil {
+			t.Errorf("Wanted error from PublicAsCSR")
+		}
+	})
+}
+
+func TestKMSMaterialFrom(t *testing.T) {
+	t.Parallel()
+
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Couldn't create P-384 key: %v", err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Couldn't create P-256 key: %v", err)
+	}
+	for _, test := range []struct {
+		name string
+		ref  string
+		pub  crypto.PublicKey
+	}{
+		{"empty reference", "", p256Key.Public()},
+		{"P-384", "fake-kms/0", p384Key.Public()},
+		{"not ECDSA", "fake-kms/0", "not a key"},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			if _, err := KMSMaterialFrom(test.ref, test.pub); err == nil {
+				t.Errorf("Wanted error")
+			}
+		})
+	}
+}
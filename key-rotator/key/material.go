@@ -1,7 +1,11 @@
 package key
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
@@ -11,6 +15,7 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
 )
 
@@ -20,16 +25,34 @@ type Type uint8
 const (
 	// P256 represents an ECDSA P-256 key.
 	P256 Type = 1 + iota
+	// Ed25519 represents an Ed25519 (RFC 8032) key.
+	Ed25519
+	// X25519 represents an X25519 (RFC 7748) key, which can be used for key
+	// agreement (e.g. HPKE packet encryption), but not for signing.
+	X25519
 )
 
 type typeInfo struct {
-	name             string                   // string name of type
-	newRandom        func() (material, error) // function returning a newly-initialized random key
-	newUninitialized func() material          // function returning an uninitialized key of this type, e.g. for use in unmarshalling
+	name             string                                // string name of type
+	newRandom        func(rnd io.Reader) (material, error) // function returning a new key initialized with randomness read from rnd
+	newUninitialized func() material                       // function returning an uninitialized key of this type, e.g. for use in unmarshalling
 }
 
 var typeInfos = map[Type]*typeInfo{
-	P256: {"P256", newRandomP256, newUninitializedP256},
+	P256:    {"P256", newRandomP256, newUninitializedP256},
+	Ed25519: {"Ed25519", newRandomEd25519, newUninitializedEd25519},
+	X25519:  {"X25519", newRandomX25519, newUninitializedX25519},
+}
+
+// ParseType parses a Type from its string name, e.g. "P256", "Ed25519" or
+// "X25519".
+func ParseType(s string) (Type, error) {
+	for t, ti := range typeInfos {
+		if ti.name == s {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown key type %q", s)
 }
 
 func (t Type) String() string {
@@ -40,12 +63,19 @@ func (t Type) String() string {
 }
 
 // New creates a new, randomly-initialized key.
-func (t Type) New() (Material, error) {
+func (t Type) New() (Material, error) { return t.NewFrom(rand.Reader) }
+
+// NewFrom creates a new key, initialized with randomness read from rnd. Key
+// creation reads the same bytes from rnd regardless of Go version, so a
+// deterministic rnd (such as a seeded math/rand.Rand) always produces the same
+// key, which is useful for reproducible tests. Keys created from anything
+// other than a cryptographically secure rnd are not secure.
+func (t Type) NewFrom(rnd io.Reader) (Material, error) {
 	ti := typeInfos[t]
 	if ti == nil {
 		return Material{}, fmt.Errorf("unknown key type %v (%d)", t, t)
 	}
-	m, err := ti.newRandom()
+	m, err := ti.newRandom(rnd)
 	if err != nil {
 		return Material{}, fmt.Errorf("couldn't create %v key: %w", t, err)
 	}
@@ -68,7 +98,11 @@ func (m Material) MarshalBinary() ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("couldn't serialize %v key: %w", m.Type(), err)
 	}
-	return append([]byte{byte(m.Type())}, kBytes...), nil
+	t := byte(m.Type())
+	if _, ok := m.m.(*kmsMaterial); ok {
+		t |= kmsTag
+	}
+	return append([]byte{t}, kBytes...), nil
 }
 
 func (m *Material) UnmarshalBinary(data []byte) error {
@@ -76,12 +110,18 @@ func (m *Material) UnmarshalBinary(data []byte) error {
 		return errors.New("empty input")
 	}
 
-	t := Type(data[0])
+	t := Type(data[0] &^ kmsTag)
 	ti := typeInfos[t]
 	if ti == nil {
 		return fmt.Errorf("unknown key type %v (%d)", t, t)
 	}
 	newM := ti.newUninitialized()
+	if data[0]&kmsTag != 0 {
+		if t != P256 {
+			return fmt.Errorf("unsupported KMS key type %v", t)
+		}
+		newM = newUninitializedKMS()
+	}
 	if err := newM.UnmarshalBinary(data[1:]); err != nil {
 		return fmt.Errorf("couldn't unmarshal %v key: %w", t, err)
 	}
@@ -118,23 +158,121 @@ func (m Material) Equal(o Material) bool {
 // Type returns the type of the key material.
 func (m Material) Type() Type { return m.m.keyType() }
 
-// Public returns the public key associated with this key material as an
-// ecdsa.PublicKey.
-func (m Material) Public() *ecdsa.PublicKey { return m.m.public() }
+// PublicKey is the public portion of key material: an *ecdsa.PublicKey for
+// P256 keys, an ed25519.PublicKey for Ed25519 keys, or an *ecdh.PublicKey for
+// X25519 keys.
+type PublicKey interface {
+	Equal(crypto.PublicKey) bool
+}
+
+// Public returns the public key associated with this key material.
+func (m Material) Public() PublicKey { return m.m.public() }
+
+// Signer returns a crypto.Signer signing with the private portion of the key
+// material: an *ecdsa.PrivateKey for P256 keys, or an ed25519.PrivateKey for
+// Ed25519 keys. An error is returned for key material held in a KMS, whose
+// private portion is not available, and for X25519 key material, which cannot
+// sign.
+func (m Material) Signer() (crypto.Signer, error) {
+	switch km := m.m.(type) {
+	case *p256:
+		return km.privKey, nil
+	case *ed25519Material:
+		return km.privKey, nil
+	case *kmsMaterial:
+		return nil, fmt.Errorf("private portion of KMS key %q is not available", km.ref)
+	case nil:
+		return nil, errors.New("empty key material")
+	default:
+		return nil, fmt.Errorf("%s key material cannot sign", m.Type())
+	}
+}
 
 // PublicAsCSR returns a PEM-encoding of the ASN.1 DER-encoding of a PKCS#10
 // (RFC 2986) CSR over the public portion of the key, signed using the private
 // portion of the key, using the provided FQDN as the common name for the
-// request.
-func (m Material) PublicAsCSR(csrFQDN string) (string, error) { return m.m.publicAsCSR(csrFQDN) }
+// request. X25519 keys cannot sign, so have no CSR; publish their PKIX
+// encoding instead.
+func (m Material) PublicAsCSR(csrFQDN string) (string, error) {
+	return m.PublicAsCSRFrom(rand.Reader, csrFQDN)
+}
+
+// PublicAsCSRFrom returns a CSR as PublicAsCSR does, reading any randomness
+// needed to sign it from rnd. Ed25519 signatures are deterministic, so an
+// Ed25519 key's CSR is reproducible from a deterministic rnd; ECDSA signing
+// mixes in randomness of its own, so a P256 key's CSR never is.
+func (m Material) PublicAsCSRFrom(rnd io.Reader, csrFQDN string) (string, error) {
+	csrBytes, err := m.m.publicAsCSRDER(rnd, csrFQDN)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrBytes})), nil
+}
+
+// PublicAsCSRDER returns the ASN.1 DER-encoding of a PKCS#10 (RFC 2986) CSR
+// over the public portion of the key, as PublicAsCSR does, but without PEM
+// encoding.
+func (m Material) PublicAsCSRDER(csrFQDN string) ([]byte, error) {
+	return m.m.publicAsCSRDER(rand.Reader, csrFQDN)
+}
 
 // PublicAsPKIX returns a PEM-encoding of the ASN.1 DER-encoding of the
 // public portion of the key in PKIX (RFC 5280) format.
-func (m Material) PublicAsPKIX() (string, error) { return m.m.publicAsPKIX() }
+func (m Material) PublicAsPKIX() (string, error) {
+	pubkeyBytes, err := m.m.publicAsPKIXDER()
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubkeyBytes})), nil
+}
+
+// PublicAsPKIXDER returns the ASN.1 DER-encoding of the public portion of the
+// key in PKIX (RFC 5280) format, as PublicAsPKIX does, but without PEM
+// encoding.
+func (m Material) PublicAsPKIXDER() ([]byte, error) { return m.m.publicAsPKIXDER() }
+
+// PublicAsX962Compressed returns the X9.62 compressed encoding of the public
+// portion of the key, i.e. the raw compressed point. Only P256 keys have an
+// X9.62 encoding.
+func (m Material) PublicAsX962Compressed() ([]byte, error) { return m.m.publicAsX962Compressed() }
+
+// PublicKeyFormat is a format in which the public portion of key material may
+// be exported.
+type PublicKeyFormat string
+
+const (
+	PEM PublicKeyFormat = "pem" // PEM-encoded PKIX, as returned by PublicAsPKIX
+	DER PublicKeyFormat = "der" // DER-encoded PKIX, as returned by PublicAsPKIXDER
+	Raw PublicKeyFormat = "raw" // X9.62 compressed point for P256 keys, as returned by PublicAsX962Compressed; RFC 8032 encoding for Ed25519 keys; RFC 7748 encoding for X25519 keys
+)
+
+// ParsePublicKeyFormat parses a PublicKeyFormat from one of "pem", "der", or
+// "raw".
+func ParsePublicKeyFormat(s string) (PublicKeyFormat, error) {
+	switch f := PublicKeyFormat(s); f {
+	case PEM, DER, Raw:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown public key format %q (must be one of 'pem', 'der', or 'raw')", s)
+}
+
+// ExportPublic returns the public portion of the key in the given format.
+func (m Material) ExportPublic(format PublicKeyFormat) ([]byte, error) {
+	switch format {
+	case PEM:
+		pkix, err := m.PublicAsPKIX()
+		return []byte(pkix), err
+	case DER:
+		return m.PublicAsPKIXDER()
+	case Raw:
+		return m.m.publicAsRaw()
+	}
+	return nil, fmt.Errorf("unknown public key format %q", format)
+}
 
 // AsX962Uncompressed returns a base64 encoding of the X9.62 uncompressed
 // encoding of the public portion of the key, concatenated with the secret
-// "D" scalar.
+// "D" scalar. Only P256 keys have an X9.62 encoding.
 func (m Material) AsX962Uncompressed() (string, error) { return m.m.asX962Uncompressed() }
 
 // AsPKCS8 returns a base64 encoding of the ASN.1 DER-encoding of the key
@@ -150,22 +288,30 @@ type material interface {
 	keyType() Type
 
 	// equal determines if this key material is equal to the given key
-	// material, which can be assumed to be of the same key type.
+	// material, which can be assumed to be of the same key type, though not
+	// necessarily held in the same way (e.g. in a KMS).
 	equal(o material) bool
 
-	// public returns the public key associated with this key material as an
-	// *ecdsa.PublicKey.
-	public() *ecdsa.PublicKey
+	// public returns the public key associated with this key material.
+	public() PublicKey
+
+	// publicAsCSRDER returns the ASN.1 DER-encoding of a PKCS#10 (RFC 2986)
+	// CSR over the public portion of the key, signed using the private
+	// portion of the key with randomness read from rnd, using the provided
+	// FQDN as the common name for the request.
+	publicAsCSRDER(rnd io.Reader, csrFQDN string) ([]byte, error)
+
+	// publicAsPKIXDER returns the ASN.1 DER-encoding of the public portion of
+	// the key in PKIX (RFC 5280) format.
+	publicAsPKIXDER() ([]byte, error)
 
-	// publicAsCSR returns a PEM-encoding of the ASN.1 DER-encoding of a
-	// PKCS#10 (RFC 2986) CSR over the public portion of the key, signed using
-	// the private portion of the key, using the provided FQDN as the common
-	// name for the request.
-	publicAsCSR(csrFQDN string) (string, error)
+	// publicAsX962Compressed returns the X9.62 compressed encoding of the
+	// public portion of the key.
+	publicAsX962Compressed() ([]byte, error)
 
-	// publicAsPKIX returns a PEM-encoding of the ASN.1 DER-encoding of the
-	// public portion of the key in PKIX (RFC 5280) format.
-	publicAsPKIX() (string, error)
+	// publicAsRaw returns the public portion of the key in the raw format
+	// conventional for its type.
+	publicAsRaw() ([]byte, error)
 
 	// asX962Uncompressed returns a base64 encoding of the X9.62 uncompressed
 	// encoding of the public portion of the key, concatenated with the secret
@@ -198,13 +344,26 @@ func P256MaterialFrom(key *ecdsa.PrivateKey) (Material, error) {
 	return Material{&m}, nil
 }
 
-func newRandomP256() (material, error) {
-	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
+func newRandomP256(rnd io.Reader) (material, error) {
+	// ecdsa.GenerateKey may read a varying number of bytes from rnd (and
+	// recent Go versions ignore rnd entirely), so the private scalar is
+	// derived directly, as in FIPS 186-4 B.4.1: read 64 extra bits to make
+	// the bias from the modular reduction negligible, then reduce into
+	// [1, N-1].
+	c := elliptic.P256()
+	params := c.Params()
+	b := make([]byte, params.BitSize/8+8)
+	if _, err := io.ReadFull(rnd, b); err != nil {
 		return nil, fmt.Errorf("couldn't generate new key: %w", err)
 	}
+	n := new(big.Int).Sub(params.N, big.NewInt(1))
+	d := new(big.Int).SetBytes(b)
+	d.Mod(d, n)
+	d.Add(d, big.NewInt(1))
+	x, y := c.ScalarBaseMult(d.FillBytes(make([]byte, p256PrivateKeyLen)))
+
 	var m p256
-	if err := m.setKey(key); err != nil {
+	if err := m.setKey(&ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: c, X: x, Y: y}, D: d}); err != nil {
 		return nil, err
 	}
 	return &m, nil
@@ -214,30 +373,43 @@ func newUninitializedP256() material { return &p256{} }
 
 func (p256) keyType() Type { return P256 }
 
-func (m p256) equal(o material) bool { return m.privKey.Equal(o.(*p256).privKey) }
+func (m p256) equal(o material) bool {
+	om, ok := o.(*p256)
+	return ok && m.privKey.Equal(om.privKey)
+}
 
-func (m p256) public() *ecdsa.PublicKey { return &m.privKey.PublicKey }
+func (m p256) public() PublicKey { return &m.privKey.PublicKey }
 
-func (m p256) publicAsCSR(csrFQDN string) (string, error) {
+func (m p256) publicAsCSRDER(rnd io.Reader, csrFQDN string) ([]byte, error) {
 	tmpl := &x509.CertificateRequest{
 		SignatureAlgorithm: x509.ECDSAWithSHA256,
 		Subject:            pkix.Name{CommonName: csrFQDN},
 	}
-	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, tmpl, m.privKey)
+	csrBytes, err := x509.CreateCertificateRequest(rnd, tmpl, m.privKey)
 	if err != nil {
-		return "", fmt.Errorf("couldn't create certificate request: %w", err)
+		return nil, fmt.Errorf("couldn't create certificate request: %w", err)
 	}
-	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrBytes})), nil
+	return csrBytes, nil
 }
 
-func (m p256) publicAsPKIX() (string, error) {
+func (m p256) publicAsPKIXDER() ([]byte, error) {
 	pubkeyBytes, err := x509.MarshalPKIXPublicKey(m.privKey.Public())
 	if err != nil {
-		return "", fmt.Errorf("couldn't encode as PKIX: %w", err)
+		return nil, fmt.Errorf("couldn't encode as PKIX: %w", err)
 	}
-	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubkeyBytes})), nil
+	return pubkeyBytes, nil
+}
+
+func (m p256) publicAsX962Compressed() ([]byte, error) {
+	pubkeyBytes := elliptic.MarshalCompressed(elliptic.P256(), m.privKey.PublicKey.X, m.privKey.PublicKey.Y)
+	if len(pubkeyBytes) != p256PubkeyCompressedLen {
+		panic(fmt.Sprintf("Unexpected length from elliptic.MarshalCompressed: wanted %d, got %d", p256PubkeyCompressedLen, len(pubkeyBytes)))
+	}
+	return pubkeyBytes, nil
 }
 
+func (m p256) publicAsRaw() ([]byte, error) { return m.publicAsX962Compressed() }
+
 func (m p256) asX962Uncompressed() (string, error) {
 	var keyBytes [p256PubkeyUncompressedLen + p256PrivateKeyLen]byte
 	pubkeyBytes := elliptic.Marshal(elliptic.P256(), m.privKey.PublicKey.X, m.privKey.PublicKey.Y)
@@ -318,3 +490,205 @@ func (m *p256) setKey(k *ecdsa.PrivateKey) error {
 	*m = p256{k}
 	return nil
 }
+
+type ed25519Material struct{ privKey ed25519.PrivateKey }
+
+var _ material = &ed25519Material{} // verify ed25519Material implements material
+
+// Ed25519MaterialFrom returns a new Material of type Ed25519 based on the
+// given Ed25519 private key.
+func Ed25519MaterialFrom(key ed25519.PrivateKey) (Material, error) {
+	var m ed25519Material
+	if err := m.setKey(key); err != nil {
+		return Material{}, err
+	}
+	return Material{&m}, nil
+}
+
+func newRandomEd25519(rnd io.Reader) (material, error) {
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := io.ReadFull(rnd, seed); err != nil {
+		return nil, fmt.Errorf("couldn't generate new key: %w", err)
+	}
+	return &ed25519Material{ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+func newUninitializedEd25519() material { return &ed25519Material{} }
+
+func (ed25519Material) keyType() Type { return Ed25519 }
+
+func (m ed25519Material) equal(o material) bool {
+	om, ok := o.(*ed25519Material)
+	return ok && m.privKey.Equal(om.privKey)
+}
+
+func (m ed25519Material) public() PublicKey { return m.privKey.Public().(ed25519.PublicKey) }
+
+func (m ed25519Material) publicAsCSRDER(rnd io.Reader, csrFQDN string) ([]byte, error) {
+	tmpl := &x509.CertificateRequest{
+		SignatureAlgorithm: x509.PureEd25519,
+		Subject:            pkix.Name{CommonName: csrFQDN},
+	}
+	csrBytes, err := x509.CreateCertificateRequest(rnd, tmpl, m.privKey)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create certificate request: %w", err)
+	}
+	return csrBytes, nil
+}
+
+func (m ed25519Material) publicAsPKIXDER() ([]byte, error) {
+	pubkeyBytes, err := x509.MarshalPKIXPublicKey(m.privKey.Public())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encode as PKIX: %w", err)
+	}
+	return pubkeyBytes, nil
+}
+
+func (ed25519Material) publicAsX962Compressed() ([]byte, error) {
+	return nil, errors.New("Ed25519 keys have no X9.62 encoding")
+}
+
+func (m ed25519Material) publicAsRaw() ([]byte, error) {
+	return []byte(m.privKey.Public().(ed25519.PublicKey)), nil
+}
+
+func (ed25519Material) asX962Uncompressed() (string, error) {
+	return "", errors.New("Ed25519 keys have no X9.62 encoding")
+}
+
+func (m ed25519Material) asPKCS8() (string, error) {
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(m.privKey)
+	if err != nil {
+		return "", fmt.Errorf("couldn't encode as PKCS#8: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(keyBytes), nil
+}
+
+func (m ed25519Material) MarshalBinary() ([]byte, error) {
+	// Ed25519's raw key format is the RFC 8032 private key, i.e. the seed from
+	// which both the public & private portions of the key are derived.
+	return append([]byte(nil), m.privKey.Seed()...), nil
+}
+
+func (m *ed25519Material) UnmarshalBinary(data []byte) error {
+	if len(data) != ed25519.SeedSize {
+		return fmt.Errorf("serialized data has wrong length (want %d, got %d)", ed25519.SeedSize, len(data))
+	}
+	*m = ed25519Material{ed25519.NewKeyFromSeed(data)}
+	return nil
+}
+
+func (m *ed25519Material) setKey(k ed25519.PrivateKey) error {
+	if len(k) != ed25519.PrivateKeySize {
+		return fmt.Errorf("key has wrong length (want %d, got %d)", ed25519.PrivateKeySize, len(k))
+	}
+
+	// Check that the public key (the second half of k) corresponds to the
+	// seed (the first half of k).
+	if !bytes.Equal(ed25519.NewKeyFromSeed(k.Seed()), k) {
+		return errors.New("public/private key mismatch")
+	}
+
+	*m = ed25519Material{k}
+	return nil
+}
+
+type x25519Material struct{ privKey *ecdh.PrivateKey }
+
+// x25519KeyLen is the length of both X25519 private keys (scalars) and public
+// keys (u-coordinates), per RFC 7748.
+const x25519KeyLen = 32
+
+var _ material = &x25519Material{} // verify x25519Material implements material
+
+// X25519MaterialFrom returns a new Material of type X25519 based on the given
+// X25519 private key.
+func X25519MaterialFrom(key *ecdh.PrivateKey) (Material, error) {
+	var m x25519Material
+	if err := m.setKey(key); err != nil {
+		return Material{}, err
+	}
+	return Material{&m}, nil
+}
+
+func newRandomX25519(rnd io.Reader) (material, error) {
+	// ecdh.Curve.GenerateKey may read a varying number of bytes from rnd, so
+	// the private key is read directly; every 32-byte string is a valid
+	// X25519 private key.
+	b := make([]byte, x25519KeyLen)
+	if _, err := io.ReadFull(rnd, b); err != nil {
+		return nil, fmt.Errorf("couldn't generate new key: %w", err)
+	}
+	privKey, err := ecdh.X25519().NewPrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't generate new key: %w", err)
+	}
+	return &x25519Material{privKey}, nil
+}
+
+func newUninitializedX25519() material { return &x25519Material{} }
+
+func (x25519Material) keyType() Type { return X25519 }
+
+func (m x25519Material) equal(o material) bool {
+	om, ok := o.(*x25519Material)
+	return ok && m.privKey.Equal(om.privKey)
+}
+
+func (m x25519Material) public() PublicKey { return m.privKey.PublicKey() }
+
+func (x25519Material) publicAsCSRDER(io.Reader, string) ([]byte, error) {
+	return nil, errors.New("X25519 keys cannot sign a CSR")
+}
+
+func (m x25519Material) publicAsPKIXDER() ([]byte, error) {
+	pubkeyBytes, err := x509.MarshalPKIXPublicKey(m.privKey.PublicKey())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encode as PKIX: %w", err)
+	}
+	return pubkeyBytes, nil
+}
+
+func (x25519Material) publicAsX962Compressed() ([]byte, error) {
+	return nil, errors.New("X25519 keys have no X9.62 encoding")
+}
+
+func (m x25519Material) publicAsRaw() ([]byte, error) { return m.privKey.PublicKey().Bytes(), nil }
+
+func (x25519Material) asX962Uncompressed() (string, error) {
+	return "", errors.New("X25519 keys have no X9.62 encoding")
+}
+
+func (m x25519Material) asPKCS8() (string, error) {
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(m.privKey)
+	if err != nil {
+		return "", fmt.Errorf("couldn't encode as PKCS#8: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(keyBytes), nil
+}
+
+func (m x25519Material) MarshalBinary() ([]byte, error) {
+	// X25519's raw key format is the RFC 7748 private key, from which the
+	// public key is derived.
+	return m.privKey.Bytes(), nil
+}
+
+func (m *x25519Material) UnmarshalBinary(data []byte) error {
+	if len(data) != x25519KeyLen {
+		return fmt.Errorf("serialized data has wrong length (want %d, got %d)", x25519KeyLen, len(data))
+	}
+	privKey, err := ecdh.X25519().NewPrivateKey(data)
+	if err != nil {
+		return fmt.Errorf("couldn't unmarshal private key: %w", err)
+	}
+	*m = x25519Material{privKey}
+	return nil
+}
+
+func (m *x25519Material) setKey(k *ecdh.PrivateKey) error {
+	if k.Curve() != ecdh.X25519() {
+		return fmt.Errorf("key was %v rather than X25519", k.Curve())
+	}
+	*m = x25519Material{k}
+	return nil
+}
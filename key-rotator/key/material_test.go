@@ -1,9 +1,14 @@
 package key
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/base64"
@@ -13,6 +18,7 @@ import (
 	"fmt"
 	"io"
 	"math/big"
+	mathrand "math/rand"
 	"strings"
 	"testing"
 )
@@ -160,6 +166,101 @@ func TestP256(t *testing.T) {
 		}
 	})
 
+	t.Run("PublicAsPKIXDER", func(t *testing.T) {
+		t.Parallel()
+		derPKIXBytes, err := key.PublicAsPKIXDER()
+		if err != nil {
+			t.Fatalf("Couldn't serialize public key as PKIX: %v", err)
+		}
+		pkix, err := x509.ParsePKIXPublicKey(derPKIXBytes)
+		if err != nil {
+			t.Fatalf("Couldn't parse as PKIX: %v", err)
+		}
+		pkixPubkey, ok := pkix.(*ecdsa.PublicKey)
+		if !ok {
+			t.Fatalf("PKIX public key was a %T, want %T", pkix, (*ecdsa.PublicKey)(nil))
+		}
+		if !pkixPubkey.Equal(wantPK.Public()) {
+			t.Errorf("PKIX public key does not match generated public key")
+		}
+	})
+
+	t.Run("PublicAsCSRDER", func(t *testing.T) {
+		t.Parallel()
+		const fqdn = "my.bogus.fqdn"
+		derCSRBytes, err := key.PublicAsCSRDER(fqdn)
+		if err != nil {
+			t.Fatalf("Couldn't serialize public key as CSR: %v", err)
+		}
+		csr, err := x509.ParseCertificateRequest(derCSRBytes)
+		if err != nil {
+			t.Fatalf("Couldn't parse as CSR: %v", err)
+		}
+		if err := csr.CheckSignature(); err != nil {
+			t.Errorf("CSR not properly signed: %v", err)
+		}
+		csrPubkey, ok := csr.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			t.Fatalf("CSR public key was a %T, want %T", csr.PublicKey, (*ecdsa.PublicKey)(nil))
+		}
+		if !csrPubkey.Equal(wantPK.Public()) {
+			t.Errorf("CSR public key does not match generated public key")
+		}
+	})
+
+	t.Run("PublicAsX962Compressed", func(t *testing.T) {
+		t.Parallel()
+		x962Bytes, err := key.PublicAsX962Compressed()
+		if err != nil {
+			t.Fatalf("Couldn't serialize public key as X9.62: %v", err)
+		}
+		x, y := elliptic.UnmarshalCompressed(elliptic.P256(), x962Bytes)
+		if x == nil {
+			t.Fatalf("Couldn't unmarshal compressed public key %x", x962Bytes)
+		}
+		x962Pubkey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !x962Pubkey.Equal(wantPK.Public()) {
+			t.Errorf("X9.62 public key does not match generated public key")
+		}
+	})
+
+	t.Run("ExportPublic", func(t *testing.T) {
+		t.Parallel()
+		for _, f := range []struct {
+			name   string
+			format PublicKeyFormat
+			want   func() ([]byte, error)
+		}{
+			{"pem", PEM, func() ([]byte, error) { pkix, err := key.PublicAsPKIX(); return []byte(pkix), err }},
+			{"der", DER, key.PublicAsPKIXDER},
+			{"raw", Raw, key.PublicAsX962Compressed},
+		} {
+			format, err := ParsePublicKeyFormat(f.name)
+			if err != nil {
+				t.Errorf("Unexpected error from ParsePublicKeyFormat(%q): %v", f.name, err)
+				continue
+			}
+			if format != f.format {
+				t.Errorf("ParsePublicKeyFormat(%q) = %q, want %q", f.name, format, f.format)
+			}
+			got, err := key.ExportPublic(format)
+			if err != nil {
+				t.Errorf("Unexpected error from ExportPublic(%q): %v", format, err)
+				continue
+			}
+			want, err := f.want()
+			if err != nil {
+				t.Fatalf("Couldn't serialize public key as %q: %v", format, err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("ExportPublic(%q) = %x, want %x", format, got, want)
+			}
+		}
+		if _, err := ParsePublicKeyFormat("jwk"); err == nil {
+			t.Errorf("Wanted error from ParsePublicKeyFormat(%q), got none", "jwk")
+		}
+	})
+
 	t.Run("AsX962Uncompressed", func(t *testing.T) {
 		t.Parallel()
 		b64X962Bytes, err := key.AsX962Uncompressed()
@@ -279,6 +380,446 @@ func TestP256(t *testing.T) {
 	})
 }
 
+func TestEd25519(t *testing.T) {
+	t.Parallel()
+
+	key, err := Ed25519.New()
+	if err != nil {
+		t.Fatalf("Couldn't create new key: %v", err)
+	}
+	wantPK := key.m.(*ed25519Material).privKey // grab ed25519.PrivateKey from guts of raw key
+
+	t.Run("binary", func(t *testing.T) {
+		t.Parallel()
+		binaryBytes, err := key.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Couldn't marshal to binary: %v", err)
+		}
+
+		var newKey Material
+		if err := newKey.UnmarshalBinary(binaryBytes); err != nil {
+			t.Fatalf("Couldn't unmarshal from binary: %v", err)
+		}
+		if newKey.Type() != Ed25519 {
+			t.Errorf("Binary-encoded key had type %v, want %v", newKey.Type(), Ed25519)
+		}
+		if !newKey.Equal(key) {
+			t.Errorf("Binary-encoded key does not match generated private key")
+		}
+	})
+
+	t.Run("text", func(t *testing.T) {
+		t.Parallel()
+		textBytes, err := key.MarshalText()
+		if err != nil {
+			t.Errorf("Couldn't marshal to text: %v", err)
+		}
+
+		var newKey Material
+		if err := newKey.UnmarshalText(textBytes); err != nil {
+			t.Fatalf("Couldn't unmarshal from text: %v", err)
+		}
+		if !newKey.Equal(key) {
+			t.Errorf("Text-encoded key does not match generated private key")
+		}
+	})
+
+	t.Run("Public", func(t *testing.T) {
+		t.Parallel()
+		if !key.Public().Equal(wantPK.Public()) {
+			t.Errorf("Public key does not match generated public key")
+		}
+	})
+
+	t.Run("PublicAsCSR", func(t *testing.T) {
+		t.Parallel()
+		const fqdn = "my.bogus.fqdn"
+		pemCSRBytes, err := key.PublicAsCSR(fqdn)
+		if err != nil {
+			t.Fatalf("Couldn't serialize public key as CSR: %v", err)
+		}
+		pemCSR, _ := pem.Decode([]byte(pemCSRBytes))
+		if pemCSR == nil {
+			t.Fatalf("Couldn't parse as PEM: %q", pemCSRBytes)
+		}
+		csr, err := x509.ParseCertificateRequest(pemCSR.Bytes)
+		if err != nil {
+			t.Fatalf("Couldn't parse as CSR: %v", err)
+		}
+		if err := csr.CheckSignature(); err != nil {
+			t.Errorf("CSR not properly signed: %v", err)
+		}
+		csrPubkey, ok := csr.PublicKey.(ed25519.PublicKey)
+		if !ok {
+			t.Fatalf("CSR public key was a %T, want %T", csr.PublicKey, ed25519.PublicKey(nil))
+		}
+		if !csrPubkey.Equal(wantPK.Public()) {
+			t.Errorf("CSR public key does not match generated public key")
+		}
+	})
+
+	t.Run("PublicAsPKIX", func(t *testing.T) {
+		t.Parallel()
+		pemPKIXBytes, err := key.PublicAsPKIX()
+		if err != nil {
+			t.Fatalf("Couldn't serialize public key as PKIX: %v", err)
+		}
+		pemPKIX, _ := pem.Decode([]byte(pemPKIXBytes))
+		if pemPKIX == nil {
+			t.Fatalf("Couldn't parse as PEM: %q", pemPKIXBytes)
+		}
+		pkix, err := x509.ParsePKIXPublicKey(pemPKIX.Bytes)
+		if err != nil {
+			t.Fatalf("Couldn't parse as PKIX: %v", err)
+		}
+		pkixPubkey, ok := pkix.(ed25519.PublicKey)
+		if !ok {
+			t.Fatalf("PKIX public key was a %T, want %T", pkix, ed25519.PublicKey(nil))
+		}
+		if !pkixPubkey.Equal(wantPK.Public()) {
+			t.Errorf("PKIX public key does not match generated public key")
+		}
+	})
+
+	t.Run("ExportPublic", func(t *testing.T) {
+		t.Parallel()
+		raw, err := key.ExportPublic(Raw)
+		if err != nil {
+			t.Fatalf("Couldn't export public key as raw: %v", err)
+		}
+		if !bytes.Equal(raw, wantPK.Public().(ed25519.PublicKey)) {
+			t.Errorf("Raw public key does not match generated public key")
+		}
+	})
+
+	t.Run("X9.62", func(t *testing.T) {
+		t.Parallel()
+		if _, err := key.PublicAsX962Compressed(); err == nil {
+			t.Errorf("Expected error from PublicAsX962Compressed")
+		}
+		if _, err := key.AsX962Uncompressed(); err == nil {
+			t.Errorf("Expected error from AsX962Uncompressed")
+		}
+	})
+
+	t.Run("AsPKCS8", func(t *testing.T) {
+		t.Parallel()
+		b64PKCS8Bytes, err := key.AsPKCS8()
+		if err != nil {
+			t.Fatalf("Couldn't serialize private key as PKCS #8: %v", err)
+		}
+		pkcs8Bytes, err := base64.StdEncoding.DecodeString(b64PKCS8Bytes)
+		if err != nil {
+			t.Fatalf("Couldn't base64-decode: %v", err)
+		}
+		pkcs8, err := x509.ParsePKCS8PrivateKey(pkcs8Bytes)
+		if err != nil {
+			t.Fatalf("Couldn't parse as PKCS #8 private key: %v", err)
+		}
+		pkcs8Key, ok := pkcs8.(ed25519.PrivateKey)
+		if !ok {
+			t.Fatalf("PKCS #8 private key was a %T, want %T", pkcs8, ed25519.PrivateKey(nil))
+		}
+		if !pkcs8Key.Equal(wantPK) {
+			t.Fatalf("PKCS #8 private key does not match generated private key")
+		}
+	})
+
+	t.Run("Ed25519MaterialFrom", func(t *testing.T) {
+		t.Parallel()
+		if _, err := Ed25519MaterialFrom(wantPK); err != nil {
+			t.Errorf("Unexpected error from Ed25519MaterialFrom: %v", err)
+		}
+
+		mismatched := append(ed25519.PrivateKey(nil), wantPK...)
+		mismatched[len(mismatched)-1] ^= 1
+		for _, test := range []struct {
+			name       string
+			key        ed25519.PrivateKey
+			wantErrStr string
+		}{
+			{name: "wrong length", key: wantPK[:ed25519.SeedSize], wantErrStr: "wrong length"},
+			{name: "public key does not correspond to private key", key: mismatched, wantErrStr: "key mismatch"},
+		} {
+			test := test
+			t.Run(test.name, func(t *testing.T) {
+				t.Parallel()
+				_, err := Ed25519MaterialFrom(test.key)
+				if err == nil || !strings.Contains(err.Error(), test.wantErrStr) {
+					t.Errorf("Wanted error containing %q, got: %v", test.wantErrStr, err)
+				}
+			})
+		}
+	})
+}
+
+func TestX25519(t *testing.T) {
+	t.Parallel()
+
+	key, err := X25519.New()
+	if err != nil {
+		t.Fatalf("Couldn't create new key: %v", err)
+	}
+	wantPK := key.m.(*x25519Material).privKey // grab *ecdh.PrivateKey from guts of raw key
+
+	t.Run("binary", func(t *testing.T) {
+		t.Parallel()
+		binaryBytes, err := key.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Couldn't marshal to binary: %v", err)
+		}
+
+		var newKey Material
+		if err := newKey.UnmarshalBinary(binaryBytes); err != nil {
+			t.Fatalf("Couldn't unmarshal from binary: %v", err)
+		}
+		if newKey.Type() != X25519 {
+			t.Errorf("Binary-encoded key had type %v, want %v", newKey.Type(), X25519)
+		}
+		if !newKey.Equal(key) {
+			t.Errorf("Binary-encoded key does not match generated private key")
+		}
+	})
+
+	t.Run("text", func(t *testing.T) {
+		t.Parallel()
+		textBytes, err := key.MarshalText()
+		if err != nil {
+			t.Errorf("Couldn't marshal to text: %v", err)
+		}
+
+		var newKey Material
+		if err := newKey.UnmarshalText(textBytes); err != nil {
+			t.Fatalf("Couldn't unmarshal from text: %v", err)
+		}
+		if !newKey.Equal(key) {
+			t.Errorf("Text-encoded key does not match generated private key")
+		}
+	})
+
+	t.Run("Public", func(t *testing.T) {
+		t.Parallel()
+		if !key.Public().Equal(wantPK.PublicKey()) {
+			t.Errorf("Public key does not match generated public key")
+		}
+	})
+
+	t.Run("PublicAsCSR", func(t *testing.T) {
+		t.Parallel()
+		if _, err := key.PublicAsCSR("my.bogus.fqdn"); err == nil {
+			t.Errorf("Expected error from PublicAsCSR")
+		}
+	})
+
+	t.Run("PublicAsPKIX", func(t *testing.T) {
+		t.Parallel()
+		pemPKIXBytes, err := key.PublicAsPKIX()
+		if err != nil {
+			t.Fatalf("Couldn't serialize public key as PKIX: %v", err)
+		}
+		pemPKIX, _ := pem.Decode([]byte(pemPKIXBytes))
+		if pemPKIX == nil {
+			t.Fatalf("Couldn't parse as PEM: %q", pemPKIXBytes)
+		}
+		pkix, err := x509.ParsePKIXPublicKey(pemPKIX.Bytes)
+		if err != nil {
+			t.Fatalf("Couldn't parse as PKIX: %v", err)
+		}
+		pkixPubkey, ok := pkix.(*ecdh.PublicKey)
+		if !ok {
+			t.Fatalf("PKIX public key was a %T, want %T", pkix, (*ecdh.PublicKey)(nil))
+		}
+		if !pkixPubkey.Equal(wantPK.PublicKey()) {
+			t.Errorf("PKIX public key does not match generated public key")
+		}
+	})
+
+	t.Run("ExportPublic", func(t *testing.T) {
+		t.Parallel()
+		raw, err := key.ExportPublic(Raw)
+		if err != nil {
+			t.Fatalf("Couldn't export public key as raw: %v", err)
+		}
+		if !bytes.Equal(raw, wantPK.PublicKey().Bytes()) {
+			t.Errorf("Raw public key does not match generated public key")
+		}
+	})
+
+	t.Run("X9.62", func(t *testing.T) {
+		t.Parallel()
+		if _, err := key.PublicAsX962Compressed(); err == nil {
+			t.Errorf("Expected error from PublicAsX962Compressed")
+		}
+		if _, err := key.AsX962Uncompressed(); err == nil {
+			t.Errorf("Expected error from AsX962Uncompressed")
+		}
+	})
+
+	t.Run("AsPKCS8", func(t *testing.T) {
+		t.Parallel()
+		b64PKCS8Bytes, err := key.AsPKCS8()
+		if err != nil {
+			t.Fatalf("Couldn't serialize private key as PKCS #8: %v", err)
+		}
+		pkcs8Bytes, err := base64.StdEncoding.DecodeString(b64PKCS8Bytes)
+		if err != nil {
+			t.Fatalf("Couldn't base64-decode: %v", err)
+		}
+		pkcs8, err := x509.ParsePKCS8PrivateKey(pkcs8Bytes)
+		if err != nil {
+			t.Fatalf("Couldn't parse as PKCS #8 private key: %v", err)
+		}
+		pkcs8Key, ok := pkcs8.(*ecdh.PrivateKey)
+		if !ok {
+			t.Fatalf("PKCS #8 private key was a %T, want %T", pkcs8, (*ecdh.PrivateKey)(nil))
+		}
+		if !pkcs8Key.Equal(wantPK) {
+			t.Fatalf("PKCS #8 private key does not match generated private key")
+		}
+	})
+
+	t.Run("X25519MaterialFrom", func(t *testing.T) {
+		t.Parallel()
+		if _, err := X25519MaterialFrom(wantPK); err != nil {
+			t.Errorf("Unexpected error from X25519MaterialFrom: %v", err)
+		}
+		p256Key, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("Couldn't generate P-256 ECDH key: %v", err)
+		}
+		if _, err := X25519MaterialFrom(p256Key); err == nil || !strings.Contains(err.Error(), "rather than X25519") {
+			t.Errorf("Wanted error containing %q, got: %v", "rather than X25519", err)
+		}
+	})
+
+	t.Run("UnmarshalBinary wrong length", func(t *testing.T) {
+		t.Parallel()
+		var m Material
+		if err := m.UnmarshalBinary(append([]byte{byte(X25519)}, make([]byte, x25519KeyLen-1)...)); err == nil || !strings.Contains(err.Error(), "wrong length") {
+			t.Errorf("Wanted error containing %q, got: %v", "wrong length", err)
+		}
+	})
+}
+
+func TestNewFrom(t *testing.T) {
+	t.Parallel()
+	for _, typ := range []Type{P256, Ed25519, X25519} {
+		typ := typ
+		t.Run(typ.String(), func(t *testing.T) {
+			t.Parallel()
+			newKey := func(seed int64) Material {
+				m, err := typ.NewFrom(mathrand.New(mathrand.NewSource(seed))) // nolint:gosec // Use of non-cryptographic RNG is purposeful here.
+				if err != nil {
+					t.Fatalf("Couldn't create new key: %v", err)
+				}
+				return m
+			}
+			if !newKey(1).Equal(newKey(1)) {
+				t.Errorf("Keys created from identically-seeded sources differ")
+			}
+			if newKey(1).Equal(newKey(2)) {
+				t.Errorf("Keys created from differently-seeded sources are equal")
+			}
+		})
+	}
+
+	t.Run("short read", func(t *testing.T) {
+		t.Parallel()
+		if _, err := P256.NewFrom(strings.NewReader("short")); err == nil {
+			t.Errorf("Expected error from NewFrom with short reader")
+		}
+	})
+}
+
+func TestSigner(t *testing.T) {
+	t.Parallel()
+	msg := []byte("message")
+	digest := sha256.Sum256(msg)
+
+	t.Run("P256", func(t *testing.T) {
+		t.Parallel()
+		m, err := P256.New()
+		if err != nil {
+			t.Fatalf("Couldn't create key: %v", err)
+		}
+		signer, err := m.Signer()
+		if err != nil {
+			t.Fatalf("Unexpected error from Signer: %v", err)
+		}
+		sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			t.Fatalf("Couldn't sign: %v", err)
+		}
+		if !ecdsa.VerifyASN1(m.Public().(*ecdsa.PublicKey), digest[:], sig) {
+			t.Errorf("Signature didn't verify")
+		}
+	})
+
+	t.Run("Ed25519", func(t *testing.T) {
+		t.Parallel()
+		m, err := Ed25519.New()
+		if err != nil {
+			t.Fatalf("Couldn't create key: %v", err)
+		}
+		signer, err := m.Signer()
+		if err != nil {
+			t.Fatalf("Unexpected error from Signer: %v", err)
+		}
+		sig, err := signer.Sign(nil, msg, crypto.Hash(0))
+		if err != nil {
+			t.Fatalf("Couldn't sign: %v", err)
+		}
+		if !ed25519.Verify(m.Public().(ed25519.PublicKey), msg, sig) {
+			t.Errorf("Signature didn't verify")
+		}
+	})
+
+	t.Run("KMS", func(t *testing.T) {
+		t.Parallel()
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("Couldn't generate key: %v", err)
+		}
+		m, err := KMSMaterialFrom("kms-key-ref", &priv.PublicKey)
+		if err != nil {
+			t.Fatalf("Couldn't create KMS key material: %v", err)
+		}
+		if _, err := m.Signer(); err == nil {
+			t.Errorf("Expected error from Signer for KMS key material")
+		}
+	})
+
+	t.Run("X25519", func(t *testing.T) {
+		t.Parallel()
+		m, err := X25519.New()
+		if err != nil {
+			t.Fatalf("Couldn't create key: %v", err)
+		}
+		if _, err := m.Signer(); err == nil {
+			t.Errorf("Expected error from Signer for X25519 key material")
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		t.Parallel()
+		if _, err := (Material{}).Signer(); err == nil {
+			t.Errorf("Expected error from Signer for empty key material")
+		}
+	})
+}
+
+func TestParseType(t *testing.T) {
+	t.Parallel()
+	for _, want := range []Type{P256, Ed25519, X25519} {
+		if got, err := ParseType(want.String()); err != nil || got != want {
+			t.Errorf("ParseType(%q) = (%v, %v), want (%v, nil)", want.String(), got, err, want)
+		}
+	}
+	if _, err := ParseType("RSA"); err == nil {
+		t.Errorf("Expected error from ParseType(%q)", "RSA")
+	}
+}
+
 func mustInt(digits string) *big.Int {
 	var z big.Int
 	if _, ok := z.SetString(digits, 10); !ok {
@@ -314,9 +855,9 @@ var _ material = &testKey{} // verify *testKey satisfies material
 
 func newTestKey(pk int64) Material { return Material{&testKey{pk}} }
 
-func newRandomTestKey() (material, error) {
+func newRandomTestKey(rnd io.Reader) (material, error) {
 	var buf [8]byte
-	if _, err := io.ReadFull(rand.Reader, buf[:]); err != nil {
+	if _, err := io.ReadFull(rnd, buf[:]); err != nil {
 		return nil, fmt.Errorf("couldn't read from random: %v", err)
 	}
 	return &testKey{(int64)(binary.BigEndian.Uint64(buf[:]))}, nil
@@ -328,11 +869,17 @@ func (testKey) keyType() Type { return Test }
 
 func (k testKey) equal(o material) bool { return k.privKey == o.(*testKey).privKey }
 
-func (k testKey) public() *ecdsa.PublicKey { panic("unimplemented") }
+func (k testKey) public() PublicKey { panic("unimplemented") }
+
+func (k testKey) publicAsCSRDER(rnd io.Reader, csrFQDN string) ([]byte, error) {
+	return nil, errors.New("unimplemented")
+}
+
+func (k testKey) publicAsPKIXDER() ([]byte, error) { return nil, errors.New("unimplemented") }
 
-func (k testKey) publicAsCSR(csrFQDN string) (string, error) { return "", errors.New("unimplemented") }
+func (k testKey) publicAsX962Compressed() ([]byte, error) { return nil, errors.New("unimplemented") }
 
-func (k testKey) publicAsPKIX() (string, error) { return "", errors.New("unimplemented") }
+func (k testKey) publicAsRaw() ([]byte, error) { return nil, errors.New("unimplemented") }
 
 func (k testKey) asX962Uncompressed() (string, error) { return "", errors.New("unimplemented") }
 
@@ -2,8 +2,6 @@
 package test
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
 	"fmt"
 	"hash/fnv"
 	"math/rand"
@@ -20,14 +18,10 @@ func Material(kid string) key.Material {
 	h.Write([]byte(kid))
 	rnd := rand.New(rand.NewSource(int64(h.Sum64()))) // nolint:gosec // Use of non-cryptographic RNG is purposeful here.
 
-	// Use byte stream to generate a P256 key, and wrap it into a key.Material.
-	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rnd)
+	// Use byte stream to generate a P256 key.
+	m, err := key.P256.NewFrom(rnd)
 	if err != nil {
 		panic(fmt.Sprintf("Couldn't create new P256 key: %v", err))
 	}
-	m, err := key.P256MaterialFrom(privKey)
-	if err != nil {
-		panic(fmt.Sprintf("Couldn't create P256 material: %v", err))
-	}
 	return m
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/abetterinternet/prio-server/key-rotator/storage"
+)
+
+// allLocalities is the value of --localities which selects every locality
+// discovered from the manifest bucket.
+const allLocalities = "all"
+
+// discoverLocalities returns, in lexicographic order, each locality for which
+// a manifest exists for any of the given ingestors. Throwaway localities left
+// behind by the smoke-test command are ignored.
+func discoverLocalities(ctx context.Context, manifestStore storage.Manifest, ingestors []string) ([]string, error) {
+	dspNames, err := manifestStore.ListDataShareProcessorSpecificManifests(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list manifests: %w", err)
+	}
+	found := map[string]bool{}
+	for _, name := range dspNames {
+		for _, ingestor := range ingestors {
+			locality := strings.TrimSuffix(name, "-"+ingestor)
+			if locality == name || locality == "" || strings.HasPrefix(locality, smokeTestLocalityPrefix) {
+				continue
+			}
+			found[locality] = true
+		}
+	}
+	var localities []string
+	for locality := range found {
+		localities = append(localities, locality)
+	}
+	sort.Strings(localities)
+	return localities, nil
+}
+
+// rotateLocalitiesConfig configures rotation of the keys of several
+// localities in a single run.
+type rotateLocalitiesConfig struct {
+	// Dependencies.
+	rotate func(ctx context.Context, locality string) error // rotates a single locality's keys
+
+	// Configuration.
+	localities  []string
+	concurrency int // the maximum number of localities rotated concurrently
+}
+
+// rotateLocalities rotates the keys of each locality, at most cfg.concurrency
+// at a time. A failure to rotate one locality's keys does not prevent the
+// rotation of the others' keys: every locality is attempted, and the
+// localities which failed are returned, in order, along with an error
+// describing each failure. The last success & last failure metrics are
+// updated for each locality.
+func rotateLocalities(ctx context.Context, cfg rotateLocalitiesConfig) (failed []string, _ error) {
+	errs := make([]error, len(cfg.localities))
+	sem := make(chan struct{}, cfg.concurrency)
+	var wg sync.WaitGroup
+	for i, locality := range cfg.localities {
+		i, locality := i, locality
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			log.Info().Str("locality", locality).Msgf("Rotating keys for %q", locality)
+			if err := cfg.rotate(ctx, locality); err != nil {
+				log.Error().Str("locality", locality).Err(err).Msgf("Couldn't rotate keys for %q: %v", locality, err)
+				lastFailure.WithLabelValues(locality).SetToCurrentTime()
+				errs[i] = err
+				return
+			}
+			lastSuccess.WithLabelValues(locality).SetToCurrentTime()
+		}()
+	}
+	wg.Wait()
+
+	var errStrs []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, cfg.localities[i])
+			errStrs = append(errStrs, fmt.Sprintf("%q: %v", cfg.localities[i], err))
+		}
+	}
+	if len(failed) > 0 {
+		return failed, fmt.Errorf("couldn't rotate keys for %d of %d localities: %s", len(failed), len(cfg.localities), strings.Join(errStrs, "; "))
+	}
+	return nil, nil
+}
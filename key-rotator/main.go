@@ -2,25 +2,41 @@ package main
 
 import (
 	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	awskms "github.com/aws/aws-sdk-go/service/kms"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/push"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/cloudkms/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -34,13 +50,31 @@ import (
 
 var (
 	// Required configuration.
-	prioEnv           = flag.String("prio-environment", "", "Required. The prio `environment`, e.g. 'prod-us' or 'prod-intl'")
-	namespace         = flag.String("kubernetes-namespace", "", "Required. The Kubernetes `namespace`, e.g. 'us-ca' or 'ta-ta'")
+	prioEnv           = flag.String("prio-environment", "", "Required unless migrating with --read-prio-environment. The prio `environment`, e.g. 'prod-us' or 'prod-intl'")
+	namespace         = flag.String("kubernetes-namespace", "", "Required unless --localities is specified. The Kubernetes `namespace`, e.g. 'us-ca' or 'ta-ta'")
 	manifestBucketURL = flag.String("manifest-bucket-url", "", "Required. The URL of the manifest `bucket`, e.g. 's3://bucket-name' or 'gs://bucket-name'")
-	locality          = flag.String("locality", "", "Required. The Prio `locality`, e.g. 'us-ca' or 'ta-ta'")
+	locality          = flag.String("locality", "", "Required unless --localities is specified. The Prio `locality`, e.g. 'us-ca' or 'ta-ta'")
 	ingestors         = flag.String("ingestors", "", "Required. Comma-separated list of `ingestors`, e.g. 'apple' or 'g-enpa'")
 	csrFQDN           = flag.String("csr-fqdn", "", "Required. FQDN to use as common name in generated CSRs")
 
+	// Multiple localities. If --localities is specified in place of --locality,
+	// each locality's keys are rotated in turn, with a failure to rotate one
+	// locality's keys not preventing the rotation of the others'.
+	localities          = flag.String("localities", "", "A comma-separated list of Prio `localities` whose keys are rotated in a single run, or 'all' for every locality with a manifest for any of --ingestors. Mutually exclusive with --locality. Unless --kubernetes-namespace is specified, each locality's keys are stored in the namespace of the same name")
+	localityConcurrency = flag.Int("locality-concurrency", 4, "With --localities, the maximum `number` of localities whose keys are rotated concurrently")
+
+	// Multiple targets. If --targets-file is specified, key-rotator runs
+	// itself once for each target listed in the file, e.g. each environment,
+	// with the other flags given shared by every target.
+	targetsFile       = flag.String("targets-file", "", "If specified, the `path` of a YAML or JSON file listing targets, each an environment, locality or localities, ingestors, manifest bucket & Kubernetes cluster & namespace, whose keys are rotated in a single run. The result of each target is written to standard output as a line of JSON. Cannot be used with --locality, --localities, a command, --watch, --run-interval, --read-prio-environment or --migrate-keys")
+	targetConcurrency = flag.Int("target-concurrency", 1, "With --targets-file, the maximum `number` of targets whose keys are rotated concurrently")
+
+	// Ingestor exclusions. Excluded ingestors' batch signing keys & manifests
+	// are left untouched by rotation, e.g. while their integration is
+	// misbehaving, without having to remove them from --ingestors.
+	skipIngestors          = flag.String("skip-ingestors", "", "Comma-separated list of `ingestors`, from --ingestors, to temporarily exclude from rotation")
+	skipIngestorsConfigMap = flag.String("skip-ingestors-configmap", "", "If specified, the `name` of a ConfigMap in --kubernetes-namespace whose 'skip-ingestors' key lists further ingestors to exclude from rotation, comma-separated. Re-read on each rotation; a missing ConfigMap excludes no ingestors")
+
 	// Rotation configuration.
 	batchSigningKeyEnableRotation = flag.Bool("batch-signing-key-enable-rotation", true, "Determines if batch signing keys are rotated. If no key versions exist, a new one will be created irrespective of this flag's value")
 	batchSigningKeyCreateMinAge   = flag.Duration("batch-signing-key-create-min-age", 9*30*24*time.Hour, "How frequently to create a new batch signing key version")               // default: 9 months
@@ -48,6 +82,8 @@ var (
 	batchSigningKeyDeleteMinAge   = flag.Duration("batch-signing-key-delete-min-age", 13*30*24*time.Hour, "How old a batch signing key version must be before it can be deleted")  // default: 13 months
 	batchSigningKeyDeleteMinCount = flag.Int("batch-signing-key-delete-min-count", 2, "The minimum number of batch signing key versions left undeleted after rotation")
 	batchSigningKeyAlwaysWrite    = flag.Bool("batch-signing-key-always-write", false, "If set, always write batch signing key to backing storage, even if no changes are detected")
+	batchSigningKeyAlgorithm      = flag.String("batch-signing-key-algorithm", "P256", "The `algorithm` of newly-created batch signing key versions: 'P256' or 'Ed25519'. Existing versions of either algorithm remain valid until deleted by rotation")
+	batchSigningKeyKMS            = flag.String("batch-signing-key-kms", "", "If specified, new batch signing key versions are created in a cloud KMS, so that their private keys never leave it: 'gcp:projects/P/locations/L/keyRings/R/cryptoKeys/K' to create versions of the given GCP KMS crypto key, which must have algorithm EC_SIGN_P256_SHA256, or 'aws' to create AWS KMS keys. Key storage holds only references to such versions, and manifests publish their public keys. Requires --batch-signing-key-algorithm=P256")
 
 	packetEncryptionKeyEnableRotation = flag.Bool("packet-encryption-key-enable-rotation", true, "Determines if packet encryption keys are rotated. If no key versions exist, a new one will be created irrespective of this flag's value")
 	packetEncryptionKeyCreateMinAge   = flag.Duration("packet-encryption-key-create-min-age", 9*30*24*time.Hour, "How frequently to create a new packet encryption key version")              // default: 9 months
@@ -55,49 +91,224 @@ var (
 	packetEncryptionKeyDeleteMinAge   = flag.Duration("packet-encryption-key-delete-min-age", 13*30*24*time.Hour, "How old a packet encryption key version must be before it can be deleted") // default: 13 months
 	packetEncryptionKeyDeleteMinCount = flag.Int("packet-encryption-key-delete-min-count", 2, "The minimum number of packet encryption key versions left undeleted after rotation")
 	packetEncryptionKeyAlwaysWrite    = flag.Bool("packet-encryption-key-always-write", false, "If set, always write packet encryption key to backing storage, even if no changes are detected")
+	packetEncryptionKeyTryOrderPolicy = flag.String("packet-encryption-key-try-order", youngestFirst, "The `policy` determining the order, recorded in the packet encryption key secret, in which facilitators attempt non-primary key versions: 'youngest-first', or 'most-recently-used-first' (by usage read from --packet-encryption-key-usage-configmap)")
+	packetEncryptionKeyAlgorithm      = flag.String("packet-encryption-key-algorithm", "P256", "The `algorithm` of newly-created packet encryption key versions: 'P256', or 'X25519' for HPKE packet encryption. X25519 versions are published in manifests as PKIX public keys rather than CSRs, and stored in secret_key as PKCS#8 keys, so all peers, ingestors & facilitators must support X25519 before it is selected. Existing versions of either algorithm remain valid until deleted by rotation, so ingestors may continue to encrypt to a legacy P256 version during the transition")
+	packetEncryptionKeyUsageConfigMap = flag.String("packet-encryption-key-usage-configmap", "", "With --packet-encryption-key-try-order=most-recently-used-first, the `name` of a ConfigMap in --kubernetes-namespace whose 'packet-encryption-key-last-used' key maps packet encryption key version creation timestamps to the RFC 3339 time each last decrypted a packet, as JSON. Re-read on each rotation; a missing ConfigMap leaves versions youngest-first")
+
+	taskSigningKeyEnable         = flag.Bool("task-signing-key-enable", false, "If set, manage a task signing key for the locality, used by workflow-manager to sign tasks, and publish its public key versions in manifests")
+	taskSigningKeyCreateMinAge   = flag.Duration("task-signing-key-create-min-age", 9*30*24*time.Hour, "How frequently to create a new task signing key version")               // default: 9 months
+	taskSigningKeyPrimaryMinAge  = flag.Duration("task-signing-key-primary-min-age", 7*24*time.Hour, "How old a task signing key version must be before it can become primary") // default: 1 week
+	taskSigningKeyDeleteMinAge   = flag.Duration("task-signing-key-delete-min-age", 13*30*24*time.Hour, "How old a task signing key version must be before it can be deleted")  // default: 13 months
+	taskSigningKeyDeleteMinCount = flag.Int("task-signing-key-delete-min-count", 2, "The minimum number of task signing key versions left undeleted after rotation")
+
+	manifestKeyExpirationRenewalWindow = flag.Duration("manifest-key-expiration-renewal-window", 90*24*time.Hour, "Public keys advertised in manifests whose expiration falls within this `duration` have their expiration refreshed. Set to 0 to never refresh expirations") // default: 3 months
+	manifestKeyExpirationMinValidity   = flag.Duration("manifest-key-expiration-min-validity", 24*time.Hour, "Rotation fails if any public key advertised in a manifest would expire within this `duration`, which should be at least the interval between rotations. Set to 0 to only fail if a key has already expired")
+
+	batchSigningKeyExpiration = flag.Duration("batch-signing-key-expiration", 100*365*24*time.Hour, "The `duration` for which batch signing public keys newly advertised in manifests, or whose expiration is refreshed, remain valid. Must exceed --manifest-key-expiration-renewal-window, or every rotation would refresh every expiration") // default: 100 years
 
 	skipManifestPreUpdateValidations  = flag.Bool("unsafe-skip-manifest-pre-update-validations", false, "If set, skip manifest pre-update validations. This flag is unsafe; do not set unless you know what you are doing")
 	skipManifestPostUpdateValidations = flag.Bool("unsafe-skip-manifest-post-update-validations", false, "If set, skip manifest post-update validations. This flag is unsafe; do not set unless you know what you are doing")
 
 	// Other flags.
-	backup                        = flag.String("backup", "", "Set to 'aws' or 'gcp:gcp-project-id' to back up secrets to the respective cloud's secrets manager")
+	keyStoreKind                  = flag.String("key-store", "kubernetes", "Where keys are stored: 'kubernetes', as secrets in --kubernetes-namespace; 'vault', in the HashiCorp Vault KV v2 secrets engine configured by the --vault-* flags; or 'aws' or 'gcp:gcp-project-id', in the respective clouds' secrets managers. The facilitator reads keys from Kubernetes secrets only")
+	keyStoreFallback              = flag.String("key-store-fallback", "", "If set, keys are being migrated to --key-store from this key store, which takes the same values as --key-store: reads which fail or find an empty key in --key-store fall back to this key store, and keys are written to both, this key store first")
+	migrateKeyStoreMode           = flag.Bool("migrate-keys", false, "If set, copy each of the locality's keys from --key-store-fallback to --key-store, where missing or different, then exit. Requires --key-store-fallback")
+	namespaceByIngestorJSON       = flag.String("namespace-by-ingestor", "", "If set, a JSON map from ingestor to the Kubernetes `namespace` in which the secrets holding that ingestor's batch signing keys are stored, instead of --kubernetes-namespace (or, with --localities, each locality's namespace). Every namespace must be reachable at startup. Requires --key-store=kubernetes or --key-store-fallback=kubernetes")
+	backup                        = flag.String("backup", "", "Set to a comma-separated list of 'aws', 'gcp:gcp-project-id' or 'vault' to back up secrets to each of the respective clouds' secrets managers or to HashiCorp Vault, in the given order")
+	backupWriteMode               = flag.String("backup-write-mode", "all", "Which writes to backups must succeed for a write to succeed: 'all', 'quorum' (a majority of --key-store & the backups), or 'best-effort' (backup failures are logged only). Keys are always written to --key-store last, and that write must always succeed")
+	backupReadFallback            = flag.Bool("backup-read-fallback", false, "If set, reads which fail against --key-store are retried against each backup in the order given by --backup")
+	backupReplicaRegions          = flag.String("backup-replica-regions", "", "Comma-separated list of `regions` to which backed-up secrets are replicated. With --backup=aws, secrets are replicated to each AWS region in addition to the session's region; with --backup=gcp:..., secrets are stored in exactly the given GCP locations, so at least two should be given. Writes fail unless every replica exists")
 	dryRun                        = flag.Bool("dry-run", true, "If set, do not actually write any keys or manifests back (only report what would have changed)")
-	timeout                       = flag.Duration("timeout", 10*time.Minute, "The `deadline` before key-rotator terminates. Set to 0 to disable timeout")
+	insecureRandomSeed            = flag.Int64("insecure-random-seed", 0, "If non-zero, new keys are created from a pseudorandom generator seeded with this value rather than a secure source of randomness, so that --dry-run output is reproducible, e.g. in tests. Keys created this way are predictable, so this requires --dry-run")
+	timeout                       = flag.Duration("timeout", 10*time.Minute, "The `deadline` before key-rotator terminates. Set to 0 to disable timeout. Caps the per-phase timeouts below")
+	readTimeout                   = flag.Duration("read-timeout", 3*time.Minute, "The maximum `duration` of reading keys & manifests during a rotation. Set to 0 to bound it only by --timeout")
+	rotateTimeout                 = flag.Duration("rotate-timeout", time.Minute, "The maximum `duration` of rotating keys & updating manifests in memory during a rotation. Set to 0 to bound it only by --timeout")
+	writeKeysTimeout              = flag.Duration("write-keys-timeout", 3*time.Minute, "The maximum `duration` of writing keys during a rotation. Keys are not written unless at least this much time remains before --timeout. Set to 0 to bound it only by --timeout")
+	writeManifestsTimeout         = flag.Duration("write-manifests-timeout", 3*time.Minute, "The maximum `duration` of writing manifests during a rotation. Set to 0 to bound it only by --timeout")
 	defaultManifestByIngestorJSON = flag.String("default-manifest-by-ingestor", "", "If set to a JSON map from ingestor to manifest, the specified manifest will be used as a template if there is no pre-existing manifest (i.e. for newly-provisioned localities)")
+	defaultManifestByIngestorFile = flag.String("default-manifest-by-ingestor-file", "", "As --default-manifest-by-ingestor, but read from the `path` of a local file or a GCS or S3 object URL (gs://bucket/key or s3://bucket/key), for maps too large to pass on the command line")
+	defaultManifestMaxBytes       = flag.Int64("default-manifest-max-bytes", 16<<20, "The maximum size, in `bytes`, of the map given by --default-manifest-by-ingestor or --default-manifest-by-ingestor-file")
+	exportFormat                  = flag.String("export-format", "pem", "For the export-public command, the `format` of exported public keys: 'pem' (PEM-encoded PKIX), 'der' (base64 DER-encoded PKIX), or 'raw' (base64 X9.62 compressed point)")
+	outputFormat                  = flag.String("output", "text", "The `format` in which the changes made by a rotation are reported on standard output: 'text', for none beyond the log, or 'json', for a JSON report of every key & manifest written, or with --dry-run which would have been written, with their diffs & key version timestamps, e.g. for review before rotating with --dry-run=false. 'json' can only be used for a single rotation, or the revoke or rollback command")
+	inspectFormat                 = flag.String("inspect-format", "text", "For the inspect command, the `format` of the report: 'text' (human-readable) or 'json'")
+	restoreFrom                   = flag.String("restore-from", "", "For the restore command, the `backup` from --backup (e.g. 'aws' or 'gcp:gcp-project-id') from which keys are restored to --key-store. Defaults to the first of --backup")
+	publicKeysFile                = flag.String("public-keys-file", "", "If specified, after each successful rotation, write the key IDs & public keys (or, for packet encryption keys, CSRs) of the primary key versions published in each manifest to `file`, as a JSON object of strings suitable for a Terraform external data source. Not written in --dry-run mode")
+	writeJWKS                     = flag.Bool("write-jwks", false, "If set, after writing manifests, also write the batch signing public keys published in each manifest as an RFC 7517 JSON Web Key Set to '${locality}-${ingestor}-jwks.json' alongside the manifest in the manifest bucket, for peers using off-the-shelf JOSE libraries")
+	manifestSigningKey            = flag.String("manifest-signing-key", "", "If specified, after writing manifests, also write a detached signature over each manifest to '${locality}-${ingestor}-manifest.json.sig' alongside it, and verify the signatures of manifests as they are read: 'batch-signing-key' to sign each manifest with the primary version of the batch signing key published in it, or the `path` of a PEM-encoded PKCS #8 P-256 or Ed25519 private key. Manifests without a signature are accepted with a warning")
+	manifestSigningKeyID          = flag.String("manifest-signing-key-id", "", "The key `ID` identifying the key given by --manifest-signing-key in signatures, unless it is 'batch-signing-key'. Defaults to '${prio-environment}-manifest-signing-key'")
+	ingestorGlobalManifest        = flag.String("ingestor-global-manifest", "", "If specified, the `name` of a singleton ingestor, such as a test ingestor, whose batch signing key is also rotated, per the --batch-signing-key-* flags, & whose global manifest at '${name}/global-manifest.json' in the manifest bucket is updated to advertise it. The key is stored as that of ingestor ${name} in locality 'global'. The global manifest must already exist")
 	awsRegion                     = flag.String("aws-region", "", "If specified, the AWS `region` to use for manifest storage")
 	pushGateway                   = flag.String("push-gateway", "", "Set this to the gateway to use with prometheus. If left empty, metrics will not be pushed to prometheus.")
 	kubeconfig                    = flag.String("kubeconfig", "", "The `path` to user's kubeconfig file; if unspecified, assumed to be running in-cluster") // typical value is $HOME/.kube/config
 	cpuProfile                    = flag.String("cpuprofile", "", "Write a CPU profile to `file`")
 	memProfile                    = flag.String("memprofile", "", "Write a memory profile to `file`")
 
-	// Metrics.
+	// Watch mode.
+	watchMode                 = flag.Bool("watch", false, "If set, run continuously, re-running rotation whenever a managed secret or manifest is modified. --timeout applies to each rotation rather than to the process as a whole")
+	watchManifestPollInterval = flag.Duration("watch-manifest-poll-interval", 5*time.Minute, "In --watch mode, how frequently manifests are checked for modification")
+	watchMinInterval          = flag.Duration("watch-min-interval", time.Minute, "In --watch mode, the minimum time between the start of consecutive rotations")
+
+	// Daemon mode. If --run-interval is specified, key-rotator runs as a
+	// long-lived process rotating keys on a schedule, rather than as a
+	// Kubernetes CronJob which rotates keys once per invocation.
+	runInterval   = flag.Duration("run-interval", 0, "If non-zero, run as a daemon, rotating keys every `interval` until terminated, and serving /healthz and /metrics on --listen-address. --timeout applies to each rotation rather than to the process as a whole, and a rotation in progress on SIGTERM is completed before exiting")
+	listenAddress = flag.String("listen-address", ":8080", "With --run-interval, the `address` on which /healthz and /metrics are served. /healthz fails if no rotation has completed within twice --run-interval plus --timeout")
+
+	// Environment migration. If specified, key-rotator performs a one-time
+	// migration of keys & manifests between environment names rather than
+	// rotating keys.
+	readPrioEnv  = flag.String("read-prio-environment", "", "If specified, the prio `environment` from which keys are read for migration. Must be specified with --write-prio-environment")
+	writePrioEnv = flag.String("write-prio-environment", "", "If specified, the prio `environment` to which keys are copied, without rotation, and under whose name manifests are rewritten. Must be specified with --read-prio-environment")
+
+	// Manifest hooks. Each is either an HTTP(S) URL, to which a JSON
+	// description of the manifest write is POSTed, or "exec:" followed by the
+	// path of an executable, which is run with that description on its
+	// standard input.
+	manifestPreWriteHook  = flag.String("manifest-pre-write-hook", "", "If specified, a `hook` invoked before each manifest write; if it fails (non-2xx response or non-zero exit), the manifest is not written. Either an http(s):// URL or 'exec:/path/to/command'")
+	manifestPostWriteHook = flag.String("manifest-post-write-hook", "", "If specified, a `hook` invoked after each successful manifest write; failures are logged. Either an http(s):// URL or 'exec:/path/to/command'")
+
+	// Rotation notifications. An event is delivered for each key version
+	// created, promoted to primary or deleted, and for each manifest changed,
+	// once the change has been written.
+	notifyWebhook      = flag.String("notify-webhook", "", "If specified, an http(s):// `URL` to which a JSON description of each rotation event, including a diff, is POSTed; failures are logged")
+	notifySlackWebhook = flag.String("notify-slack-webhook", "", "If specified, a Slack incoming webhook `URL` to which a summary of each rotation event is posted; failures are logged")
+
+	// Environment comparison. If key-rotator is invoked with the "compare"
+	// command, it compares keys & manifests with those of another environment
+	// (e.g. a disaster-recovery replica) rather than rotating keys. Each of
+	// these flags defaults to the value of the corresponding flag above.
+	comparePrioEnv           = flag.String("compare-prio-environment", "", "For the compare command, the prio `environment` to compare against. Note that manifests' key IDs include the environment name")
+	compareNamespace         = flag.String("compare-kubernetes-namespace", "", "For the compare command, the Kubernetes `namespace` of the environment to compare against")
+	compareKubeconfig        = flag.String("compare-kubeconfig", "", "For the compare command, the `path` to a kubeconfig file for the cluster of the environment to compare against")
+	compareManifestBucketURL = flag.String("compare-manifest-bucket-url", "", "For the compare command, the URL of the manifest `bucket` of the environment to compare against")
+
+	// Emergency key revocation. If key-rotator is invoked with the "revoke"
+	// command, it removes a single key version, e.g. one whose key material
+	// may have been compromised, from a key, creates a new version of that
+	// key irrespective of its create-min-age, and updates manifests, as part
+	// of an otherwise-normal rotation.
+	revokeKey        = flag.String("revoke-key", "", "For the revoke command, the `kind` of key from which a version is revoked: 'batch-signing' or 'packet-encryption'")
+	revokeKeyVersion = flag.Int64("revoke-key-version", 0, "For the revoke command, the creation `timestamp` of the revoked key version, as in its key ID")
+	revokeIngestors  = flag.String("revoke-ingestors", "", "For the revoke command with --revoke-key=batch-signing, a comma-separated list of `ingestors`, from --ingestors, whose batch signing keys' versions are revoked. Defaults to every ingestor")
+	revokeConfirm    = flag.Int64("revoke-confirm", 0, "For the revoke command, must equal --revoke-key-version unless --dry-run is set, confirming that the revoked key version is to be irrecoverably deleted")
+
+	// Key rollback. If key-rotator is invoked with the "rollback" command, it
+	// restores a single key to a previous key kept in its Kubernetes secret
+	// per --kubernetes-key-history, e.g. after a bad rotation, and updates
+	// manifests to match, as part of an otherwise-normal rotation.
+	kubernetesKeyHistory = flag.Int("kubernetes-key-history", 0, "The `number` of previous keys kept in each key's Kubernetes secret, as 'key_versions.1' (the most recently replaced) onwards, whenever a write replaces a key with a different one, so that the rollback command can restore them. The revoke command removes the revoked version from previous keys too. If 0, no previous keys are kept, and any already kept are left untouched. Requires --key-store=kubernetes or --key-store-fallback=kubernetes")
+	rollbackKey          = flag.String("rollback-key", "", "For the rollback command, the `kind` of key rolled back: 'batch-signing', 'packet-encryption' or 'task-signing'")
+	rollbackIngestor     = flag.String("rollback-ingestor", "", "For the rollback command with --rollback-key=batch-signing, the `ingestor`, from --ingestors, whose batch signing key is rolled back")
+	rollbackSteps        = flag.Int("rollback-steps", 1, "For the rollback command, the `number` of writes of the key rolled back: 1 restores the key replaced by the most recent write, 2 the key before that, and so on. The key replaced by the rollback is itself kept, so a rollback can be undone by another")
+
+	// Operator status. If configured, the outcome of each rotation is
+	// recorded as status conditions on a KeyRotation custom resource.
+	keyRotationResource = flag.String("keyrotation-resource", "", "If specified, the `name` of a KeyRotation custom resource in --kubernetes-namespace whose status is updated with the outcome of each rotation. Ignored in --dry-run mode")
+
+	// Cloud client networking.
+	s3Endpoint     = flag.String("s3-endpoint", "", "If specified, the `URL` of the endpoint to use for S3, e.g. a VPC endpoint, or an S3-compatible service such as MinIO holding the manifest bucket")
+	gcsEndpoint    = flag.String("gcs-endpoint", "", "If specified, the `URL` of the endpoint to use for GCS, e.g. a Private Service Connect endpoint")
+	awsSTSEndpoint = flag.String("aws-sts-endpoint", "", "If specified, the `URL` of the endpoint to use for AWS STS when assuming --spiffe-aws-role-arn, e.g. a VPC endpoint")
+	minTLSVersion  = flag.String("min-tls-version", "1.2", "The minimum TLS `version` ('1.2' or '1.3') negotiated by S3, GCS, STS, AWS Secrets Manager & Vault clients")
+
+	// S3 manifest storage. Used if --manifest-bucket-url is an s3:// URL.
+	s3ForcePathStyle      = flag.Bool("s3-force-path-style", false, "If set, address the manifest bucket by path rather than by host name, as MinIO & most other S3-compatible services set by --s3-endpoint require")
+	s3AccessKeyID         = flag.String("s3-access-key-id", "", "If specified, the static AWS access key `ID` used to access the manifest bucket in place of the default credential chain, e.g. that of a MinIO user. Requires --s3-secret-access-key-file")
+	s3SecretAccessKeyFile = flag.String("s3-secret-access-key-file", "", "The `path` of a file holding the secret access key for --s3-access-key-id")
+	s3AssumeRoleARN       = flag.String("s3-assume-role-arn", "", "If specified, the `ARN` of an AWS IAM role assumed to access the manifest bucket, e.g. one granting access to a bucket in another account. The role is assumed with --s3-access-key-id, --spiffe-aws-role-arn or the default credential chain, which includes IRSA web identities")
+
+	// HashiCorp Vault. Used if --key-store=vault, or if --backup includes
+	// vault.
+	vaultAddress            = flag.String("vault-address", "", "The `URL` of the Vault server, e.g. https://vault.example.com:8200")
+	vaultNamespace          = flag.String("vault-namespace", "", "If specified, the Vault Enterprise `namespace` in which secrets are stored")
+	vaultMount              = flag.String("vault-mount", "secret", "The `path` at which the Vault KV v2 secrets engine is mounted")
+	vaultTokenFile          = flag.String("vault-token-file", "", "The `path` of a file holding the Vault token to use. If neither this nor --vault-kubernetes-auth-role is specified, the VAULT_TOKEN environment variable is used")
+	vaultKubernetesAuthRole = flag.String("vault-kubernetes-auth-role", "", "If specified, log in to Vault with the Kubernetes auth method as this `role`, using the pod's service account token. The key rotator logs in again whenever Vault rejects its token, e.g. once the token's TTL has passed")
+	vaultKubernetesAuthPath = flag.String("vault-kubernetes-auth-mount", "kubernetes", "The `path` at which the Vault Kubernetes auth method is mounted")
+
+	// SPIFFE authentication. If configured, JWT-SVIDs provided by a SPIRE
+	// agent are used to authenticate to cloud providers for key backup &
+	// manifest writes, in place of ambient credentials.
+	spiffeAWSRoleARN                  = flag.String("spiffe-aws-role-arn", "", "If specified, the ARN of an AWS IAM `role` to assume with the JWT-SVID at --spiffe-aws-jwt-svid-path as a web identity token")
+	spiffeAWSJWTSVIDPath              = flag.String("spiffe-aws-jwt-svid-path", "", "The `path` to a JWT-SVID, kept up-to-date by the SPIRE agent, whose audience is accepted by AWS STS")
+	spiffeGCPWorkloadIdentityProvider = flag.String("spiffe-gcp-workload-identity-provider", "", "If specified, the `resource name` of a GCP workload identity pool provider, e.g. 'projects/1234/locations/global/workloadIdentityPools/pool/providers/provider', which accepts the JWT-SVID at --spiffe-gcp-jwt-svid-path")
+	spiffeGCPJWTSVIDPath              = flag.String("spiffe-gcp-jwt-svid-path", "", "The `path` to a JWT-SVID, kept up-to-date by the SPIRE agent, whose audience is accepted by the GCP workload identity pool provider")
+	spiffeGCPServiceAccount           = flag.String("spiffe-gcp-service-account", "", "If specified, the `email` of a GCP service account to impersonate after exchanging the JWT-SVID for a federated token")
+
+	// Metrics. These are pushed grouped by the value of --locality or
+	// --localities, so that runs for different localities do not replace each
+	// other's metrics. A single run may rotate several localities' keys, so
+	// each metric also carries its own locality label; the push gateway
+	// rejects metrics which also carry a grouping label themselves, so the
+	// grouping label is named "localities".
 	pusher      *push.Pusher // populated only if --push-gateway is specified.
-	keysWritten = promauto.NewGauge(prometheus.GaugeOpts{
+	keysWritten = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "key_rotator_keys_written",
 		Help: "Number of keys written by the key rotator.",
-	})
-	manifestsWritten = promauto.NewGauge(prometheus.GaugeOpts{
+	}, []string{"locality", "ingestor", "kind"})
+	manifestsWritten = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "key_rotator_manifests_written",
 		Help: "Number of manifests written by the key rotator.",
-	})
-	lastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+	}, []string{"locality", "ingestor"})
+	lastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "key_rotator_last_success",
 		Help: "Time of last successful run, as a UNIX seconds timestamp.",
-	})
-	lastFailure = promauto.NewGauge(prometheus.GaugeOpts{
+	}, []string{"locality"})
+	lastFailure = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "key_rotator_last_failure",
 		Help: "Time of last failed run, as a UNIX seconds timestamp.",
-	})
+	}, []string{"locality"})
+
+	// failingLocalities are the localities whose last failure metric is set
+	// by fail: those given by --locality or --localities until the
+	// localities to rotate are known, and then those whose rotation failed.
+	failingLocalities []string
 )
 
 func main() {
 	// Parse & validate flags.
 	flag.Parse()
 
+	if *targetsFile != "" {
+		switch {
+		case *locality != "" || *localities != "":
+			fail("--targets-file cannot be used with --locality or --localities, which are set by each target")
+		case flag.NArg() > 0 || *watchMode || *runInterval > 0 || *readPrioEnv != "" || *migrateKeyStoreMode || *outputFormat != "text":
+			fail("--targets-file cannot be used with a command, --watch, --run-interval, --read-prio-environment, --migrate-keys or --output")
+		case *targetConcurrency <= 0:
+			fail("--target-concurrency must be positive")
+		}
+		targets, err := readTargetsFile(*targetsFile)
+		if err != nil {
+			fail("--targets-file: %v", err)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		failed, err := rotateTargets(ctx, rotateTargetsConfig{
+			run:         runTargetSubprocess,
+			targets:     targets,
+			sharedArgs:  sharedTargetArgs(flag.CommandLine),
+			concurrency: *targetConcurrency,
+		}, os.Stdout)
+		if err != nil {
+			failingLocalities = nil
+			fail("Couldn't rotate keys for targets %s: %v", strings.Join(failed, ", "), err)
+		}
+		log.Info().Msgf("Rotated keys for %d targets", len(targets))
+		return
+	}
+
+	failingLocalities = []string{*locality}
+	if *localities != "" {
+		failingLocalities = strings.Split(*localities, ",")
+	}
 	if *pushGateway != "" {
 		pusher = push.New(*pushGateway, "key-rotator").
 			Gatherer(prometheus.DefaultGatherer).
-			Grouping("locality", *locality)
+			Grouping("localities", *locality+*localities)
+		if target := os.Getenv(targetEnvVar); target != "" {
+			pusher = pusher.Grouping("target", target)
+		}
 	}
 
 	if *kubeconfig != "" {
@@ -123,14 +334,22 @@ func main() {
 	}
 
 	switch {
-	case *prioEnv == "":
+	case *prioEnv == "" && *readPrioEnv == "":
 		fail("--prio-environment is required")
-	case *namespace == "":
+	case *namespace == "" && *localities == "":
 		fail("--kubernetes-namespace is required")
 	case *manifestBucketURL == "":
 		fail("--manifest-bucket-url is required")
-	case *locality == "":
-		fail("--locality is required")
+	case *locality == "" && *localities == "":
+		fail("--locality or --localities is required")
+	case *locality != "" && *localities != "":
+		fail("--locality and --localities are mutually exclusive")
+	case *localities != "" && (flag.NArg() > 0 || *watchMode || *readPrioEnv != ""):
+		fail("--localities cannot be used with a command, --watch or --read-prio-environment")
+	case *localities != "" && (*publicKeysFile != "" || *defaultManifestByIngestorJSON != "" || *defaultManifestByIngestorFile != "" || *keyRotationResource != ""):
+		fail("--localities cannot be used with --public-keys-file, --default-manifest-by-ingestor, --default-manifest-by-ingestor-file or --keyrotation-resource")
+	case *localityConcurrency <= 0:
+		fail("--locality-concurrency must be positive")
 	case *csrFQDN == "":
 		fail("--csr-fqdn is required")
 	case *batchSigningKeyCreateMinAge < 0:
@@ -149,10 +368,190 @@ func main() {
 		fail("--packet-encryption-key-delete-min-age must be non-negative")
 	case *packetEncryptionKeyDeleteMinCount < 0:
 		fail("--packet-encryption-key-delete-min-count must be non-negative")
-	case *backup != "" && *backup != "aws" && !strings.HasPrefix(*backup, "gcp:"):
-		fail("--backup must be one of 'aws' or 'gcp:gcp-project-id' if specified")
+	case *packetEncryptionKeyTryOrderPolicy != youngestFirst && *packetEncryptionKeyTryOrderPolicy != mostRecentlyUsedFirst:
+		fail("--packet-encryption-key-try-order must be one of 'youngest-first' or 'most-recently-used-first'")
+	case (*packetEncryptionKeyTryOrderPolicy == mostRecentlyUsedFirst) != (*packetEncryptionKeyUsageConfigMap != ""):
+		fail("--packet-encryption-key-try-order=most-recently-used-first and --packet-encryption-key-usage-configmap must be specified together")
+	case *taskSigningKeyCreateMinAge < 0 || *taskSigningKeyPrimaryMinAge < 0 || *taskSigningKeyDeleteMinAge < 0 || *taskSigningKeyDeleteMinCount < 0:
+		fail("--task-signing-key-create-min-age, --task-signing-key-primary-min-age, --task-signing-key-delete-min-age and --task-signing-key-delete-min-count must be non-negative")
+	case *manifestKeyExpirationRenewalWindow < 0 || *manifestKeyExpirationMinValidity < 0:
+		fail("--manifest-key-expiration-renewal-window and --manifest-key-expiration-min-validity must be non-negative")
+	case *manifestKeyExpirationRenewalWindow > 0 && *manifestKeyExpirationMinValidity > *manifestKeyExpirationRenewalWindow:
+		fail("--manifest-key-expiration-min-validity must not exceed --manifest-key-expiration-renewal-window")
+	case *batchSigningKeyExpiration <= *manifestKeyExpirationRenewalWindow || *batchSigningKeyExpiration <= *manifestKeyExpirationMinValidity:
+		fail("--batch-signing-key-expiration must exceed --manifest-key-expiration-renewal-window and --manifest-key-expiration-min-validity")
+	case *batchSigningKeyKMS != "" && *batchSigningKeyKMS != "aws" && !strings.HasPrefix(*batchSigningKeyKMS, "gcp:"):
+		fail("--batch-signing-key-kms must be one of 'gcp:crypto-key-name' or 'aws' if specified")
+	case *batchSigningKeyKMS != "" && *batchSigningKeyAlgorithm != key.P256.String():
+		fail("--batch-signing-key-kms requires --batch-signing-key-algorithm=P256")
+	case *batchSigningKeyKMS != "" && *manifestSigningKey == "batch-signing-key":
+		fail("--manifest-signing-key=batch-signing-key cannot be used with --batch-signing-key-kms, as KMS-backed batch signing keys cannot sign manifests")
+	case (*manifestSigningKey == "" || *manifestSigningKey == "batch-signing-key") && *manifestSigningKeyID != "":
+		fail("--manifest-signing-key-id requires --manifest-signing-key to be the path of a private key")
+	case (*s3AccessKeyID != "") != (*s3SecretAccessKeyFile != ""):
+		fail("--s3-access-key-id and --s3-secret-access-key-file must be specified together")
+	case *s3AccessKeyID != "" && *spiffeAWSRoleARN != "":
+		fail("--s3-access-key-id cannot be used with --spiffe-aws-role-arn")
+	case (*s3ForcePathStyle || *s3AccessKeyID != "" || *s3AssumeRoleARN != "") && !strings.HasPrefix(*manifestBucketURL, "s3://"):
+		fail("--s3-force-path-style, --s3-access-key-id and --s3-assume-role-arn require an s3:// --manifest-bucket-url")
+	case *ingestorGlobalManifest != "" && *localities != "":
+		fail("--ingestor-global-manifest cannot be used with --localities, which would rotate the singleton ingestor's key once per locality")
+	case *insecureRandomSeed != 0 && !*dryRun:
+		fail("--insecure-random-seed creates predictable keys, so requires --dry-run")
+	case *backup == "" && *backupReplicaRegions != "":
+		fail("--backup-replica-regions requires --backup")
+	case *backup == "" && *backupReadFallback:
+		fail("--backup-read-fallback requires --backup")
+	case !isKeyStoreKind(*keyStoreKind):
+		fail("--key-store must be one of 'kubernetes', 'vault', 'aws' or 'gcp:gcp-project-id'")
+	case *keyStoreFallback != "" && !isKeyStoreKind(*keyStoreFallback):
+		fail("--key-store-fallback must be one of 'kubernetes', 'vault', 'aws' or 'gcp:gcp-project-id' if specified")
+	case *keyStoreFallback == *keyStoreKind:
+		fail("--key-store-fallback must differ from --key-store")
+	case *migrateKeyStoreMode && *keyStoreFallback == "":
+		fail("--migrate-keys requires --key-store-fallback")
+	case *migrateKeyStoreMode && (flag.NArg() > 0 || *watchMode || *readPrioEnv != "" || *localities != "" || *runInterval > 0):
+		fail("--migrate-keys cannot be used with a command, --watch, --read-prio-environment, --localities or --run-interval")
+	case *keyStoreKind != "kubernetes" && (*watchMode || flag.Arg(0) == "compare" || flag.Arg(0) == "verify-schema"):
+		fail("--watch and the compare and verify-schema commands require --key-store=kubernetes")
+	case *namespaceByIngestorJSON != "" && *keyStoreKind != "kubernetes" && *keyStoreFallback != "kubernetes":
+		fail("--namespace-by-ingestor requires --key-store=kubernetes or --key-store-fallback=kubernetes")
+	case *vaultTokenFile != "" && *vaultKubernetesAuthRole != "":
+		fail("At most one of --vault-token-file and --vault-kubernetes-auth-role may be specified")
 	case *timeout < 0:
 		fail("--timeout must be non-negative")
+	case *readTimeout < 0 || *rotateTimeout < 0 || *writeKeysTimeout < 0 || *writeManifestsTimeout < 0:
+		fail("--read-timeout, --rotate-timeout, --write-keys-timeout and --write-manifests-timeout must be non-negative")
+	case *timeout > 0 && *writeKeysTimeout > *timeout:
+		fail("--write-keys-timeout must not exceed --timeout")
+	case *watchManifestPollInterval <= 0:
+		fail("--watch-manifest-poll-interval must be positive")
+	case *watchMinInterval < 0:
+		fail("--watch-min-interval must be non-negative")
+	case *runInterval < 0:
+		fail("--run-interval must be non-negative")
+	case *runInterval > 0 && (flag.NArg() > 0 || *watchMode || *readPrioEnv != ""):
+		fail("--run-interval cannot be used with a command, --watch or --read-prio-environment")
+	case (*readPrioEnv == "") != (*writePrioEnv == ""):
+		fail("--read-prio-environment and --write-prio-environment must be specified together")
+	case *readPrioEnv != "" && *readPrioEnv == *writePrioEnv:
+		fail("--read-prio-environment and --write-prio-environment must differ")
+	case *readPrioEnv != "" && *watchMode:
+		fail("--read-prio-environment and --write-prio-environment cannot be used with --watch")
+	case flag.NArg() > 1 || (flag.NArg() == 1 && flag.Arg(0) != "compare" && flag.Arg(0) != "verify-schema" && flag.Arg(0) != "smoke-test" && flag.Arg(0) != "export-public" && flag.Arg(0) != "inspect" && flag.Arg(0) != "revoke" && flag.Arg(0) != "verify-backups" && flag.Arg(0) != "restore" && flag.Arg(0) != "rollback" && flag.Arg(0) != "preflight"):
+		fail("The only supported commands are 'compare', 'verify-schema', 'smoke-test', 'export-public', 'inspect', 'revoke', 'verify-backups', 'restore', 'rollback' and 'preflight'")
+	case flag.Arg(0) == "verify-schema" && (*readPrioEnv != "" || *watchMode):
+		fail("The verify-schema command cannot be used with --read-prio-environment or --watch")
+	case flag.Arg(0) == "smoke-test" && (*readPrioEnv != "" || *watchMode):
+		fail("The smoke-test command cannot be used with --read-prio-environment or --watch")
+	case flag.Arg(0) == "smoke-test" && *keyStoreFallback != "":
+		fail("The smoke-test command cannot be used with --key-store-fallback")
+	case flag.Arg(0) == "smoke-test" && *dryRun:
+		fail("The smoke-test command writes keys & manifests for a throwaway locality, so requires --dry-run=false")
+	case flag.Arg(0) == "export-public" && (*readPrioEnv != "" || *watchMode):
+		fail("The export-public command cannot be used with --read-prio-environment or --watch")
+	case flag.Arg(0) == "inspect" && (*readPrioEnv != "" || *watchMode):
+		fail("The inspect command cannot be used with --read-prio-environment or --watch")
+	case *inspectFormat != "text" && *inspectFormat != "json":
+		fail("--inspect-format must be one of 'text' or 'json'")
+	case *outputFormat != "text" && *outputFormat != "json":
+		fail("--output must be one of 'text' or 'json'")
+	case *outputFormat == "json" && ((flag.NArg() > 0 && flag.Arg(0) != "revoke" && flag.Arg(0) != "rollback") || *watchMode || *runInterval > 0 || *readPrioEnv != "" || *migrateKeyStoreMode):
+		fail("--output=json can only be used for a single rotation, or the revoke or rollback command, so cannot be used with other commands, --watch, --run-interval, --read-prio-environment or --migrate-keys")
+	case flag.Arg(0) == "revoke" && (*readPrioEnv != "" || *watchMode):
+		fail("The revoke command cannot be used with --read-prio-environment or --watch")
+	case flag.Arg(0) == "revoke" && !*dryRun && *revokeConfirm != *revokeKeyVersion:
+		fail("The revoke command irrecoverably deletes key version %d: pass --revoke-confirm=%d to confirm, or --dry-run to check what would change", *revokeKeyVersion, *revokeKeyVersion)
+	case flag.Arg(0) == "verify-backups" && (*readPrioEnv != "" || *watchMode):
+		fail("The verify-backups command cannot be used with --read-prio-environment or --watch")
+	case flag.Arg(0) == "verify-backups" && *backup == "":
+		fail("The verify-backups command requires --backup")
+	case flag.Arg(0) == "restore" && (*readPrioEnv != "" || *watchMode):
+		fail("The restore command cannot be used with --read-prio-environment or --watch")
+	case flag.Arg(0) == "restore" && *backup == "":
+		fail("The restore command requires --backup")
+	case flag.Arg(0) != "restore" && *restoreFrom != "":
+		fail("--restore-from requires the restore command")
+	case flag.Arg(0) != "revoke" && (*revokeKey != "" || *revokeKeyVersion != 0 || *revokeIngestors != "" || *revokeConfirm != 0):
+		fail("--revoke-key, --revoke-key-version, --revoke-ingestors and --revoke-confirm require the revoke command")
+	case *kubernetesKeyHistory < 0:
+		fail("--kubernetes-key-history must be non-negative")
+	case *kubernetesKeyHistory > 0 && *keyStoreKind != "kubernetes" && *keyStoreFallback != "kubernetes":
+		fail("--kubernetes-key-history requires --key-store=kubernetes or --key-store-fallback=kubernetes")
+	case flag.Arg(0) == "rollback" && (*readPrioEnv != "" || *watchMode || *localities != ""):
+		fail("The rollback command cannot be used with --read-prio-environment, --watch or --localities")
+	case flag.Arg(0) == "rollback" && *keyStoreKind != "kubernetes":
+		fail("The rollback command restores keys kept in Kubernetes secrets, so requires --key-store=kubernetes")
+	case flag.Arg(0) != "rollback" && (*rollbackKey != "" || *rollbackIngestor != "" || *rollbackSteps != 1):
+		fail("--rollback-key, --rollback-ingestor and --rollback-steps require the rollback command")
+	case flag.Arg(0) == "preflight" && (*readPrioEnv != "" || *watchMode || *localities != ""):
+		fail("The preflight command cannot be used with --read-prio-environment, --watch or --localities")
+	}
+	compareMode := flag.Arg(0) == "compare"
+	verifySchemaMode := flag.Arg(0) == "verify-schema"
+	smokeTestMode := flag.Arg(0) == "smoke-test"
+	exportPublicMode := flag.Arg(0) == "export-public"
+	inspectMode := flag.Arg(0) == "inspect"
+	revokeMode := flag.Arg(0) == "revoke"
+	verifyBackupsMode := flag.Arg(0) == "verify-backups"
+	restoreMode := flag.Arg(0) == "restore"
+	rollbackMode := flag.Arg(0) == "rollback"
+	preflightMode := flag.Arg(0) == "preflight"
+	if compareMode {
+		if *comparePrioEnv == "" {
+			*comparePrioEnv = *prioEnv
+		}
+		if *compareNamespace == "" {
+			*compareNamespace = *namespace
+		}
+		if *compareKubeconfig == "" {
+			*compareKubeconfig = *kubeconfig
+		}
+		if *compareManifestBucketURL == "" {
+			*compareManifestBucketURL = *manifestBucketURL
+		}
+		switch {
+		case *prioEnv == "":
+			fail("--prio-environment is required")
+		case *readPrioEnv != "" || *watchMode:
+			fail("The compare command cannot be used with --read-prio-environment or --watch")
+		case *defaultManifestByIngestorJSON != "" || *defaultManifestByIngestorFile != "":
+			fail("The compare command cannot be used with --default-manifest-by-ingestor or --default-manifest-by-ingestor-file")
+		case *comparePrioEnv == *prioEnv && *compareNamespace == *namespace &&
+			*compareKubeconfig == *kubeconfig && *compareManifestBucketURL == *manifestBucketURL:
+			fail("The compare command requires at least one --compare-* flag which differs from the corresponding flag")
+		}
+	}
+
+	spiffeCFG := spiffeConfig{
+		awsRoleARN:                  *spiffeAWSRoleARN,
+		awsJWTSVIDPath:              *spiffeAWSJWTSVIDPath,
+		gcpWorkloadIdentityProvider: *spiffeGCPWorkloadIdentityProvider,
+		gcpJWTSVIDPath:              *spiffeGCPJWTSVIDPath,
+		gcpServiceAccount:           *spiffeGCPServiceAccount,
+	}
+	if err := spiffeCFG.validate(); err != nil {
+		fail("Bad SPIFFE configuration: %v", err)
+	}
+
+	minTLS, ok := tlsVersions[*minTLSVersion]
+	if !ok {
+		fail("--min-tls-version must be one of '1.2' or '1.3'")
+	}
+	awsHTTPClient := &http.Client{Transport: storage.NewHTTPTransport(minTLS)}
+
+	hooks := manifestHooks{dryRun: *dryRun}
+	hookHTTPClient := &http.Client{Transport: storage.NewHTTPTransport(minTLS)}
+	var err error
+	if hooks.preWrite, err = newManifestHook(*manifestPreWriteHook, hookHTTPClient); err != nil {
+		fail("Bad --manifest-pre-write-hook: %v", err)
+	}
+	if hooks.postWrite, err = newManifestHook(*manifestPostWriteHook, hookHTTPClient); err != nil {
+		fail("Bad --manifest-post-write-hook: %v", err)
+	}
+	notify, err := newNotifier(*notifyWebhook, *notifySlackWebhook, hookHTTPClient, *dryRun)
+	if err != nil {
+		fail("Bad --notify-webhook or --notify-slack-webhook: %v", err)
 	}
 
 	ingestorLst := strings.Split(*ingestors, ",")
@@ -163,19 +562,94 @@ func main() {
 		}
 		ingestorLst[i] = v
 	}
+	namespaceByIngestor, err := parseNamespaceByIngestor(*namespaceByIngestorJSON, ingestorLst)
+	if err != nil {
+		fail("Bad --namespace-by-ingestor: %v", err)
+	}
 
-	var defaultManifestByDSP map[string]manifest.DataShareProcessorSpecificManifest
-	if *defaultManifestByIngestorJSON != "" {
-		var defaultManifestByIngestor map[string]manifest.DataShareProcessorSpecificManifest
-		if err := json.Unmarshal([]byte(*defaultManifestByIngestorJSON), &defaultManifestByIngestor); err != nil {
-			fail("--default-manifest cannot be deserialized: %v", err)
+	var revocation *keyRevocation
+	if revokeMode {
+		if revocation, err = newKeyRevocation(*revokeKey, *revokeKeyVersion, *revokeIngestors, ingestorLst); err != nil {
+			fail("Bad revocation: %v", err)
 		}
-		defaultManifestByDSP = map[string]manifest.DataShareProcessorSpecificManifest{}
-		for ingestor, manifest := range defaultManifestByIngestor {
-			defaultManifestByDSP[dspName(*locality, ingestor)] = manifest
+	}
+
+	var rollback *keyRollback
+	if rollbackMode {
+		if rollback, err = newKeyRollback(*rollbackKey, *rollbackIngestor, *rollbackSteps, ingestorLst, *taskSigningKeyEnable); err != nil {
+			fail("Bad rollback: %v", err)
+		}
+	}
+
+	var skipIngestorLst []string
+	for _, v := range strings.Split(*skipIngestors, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			skipIngestorLst = append(skipIngestorLst, v)
+		}
+	}
+
+	var backupLst []string
+	for _, v := range strings.Split(*backup, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if v != "aws" && !strings.HasPrefix(v, "gcp:") && v != "vault" {
+			fail("--backup must be a list of 'aws', 'gcp:gcp-project-id' or 'vault' if specified")
+		}
+		if v == *keyStoreKind || v == *keyStoreFallback {
+			fail("--backup cannot include --key-store or --key-store-fallback")
+		}
+		backupLst = append(backupLst, v)
+	}
+	restoreBackupIdx := 0
+	if *restoreFrom != "" {
+		restoreBackupIdx = indexOfString(backupLst, *restoreFrom)
+		if restoreBackupIdx < 0 {
+			fail("--restore-from must be one of --backup")
+		}
+	}
+	backupKeyCFG := storage.CompositeKeyConfig{ReadFallback: *backupReadFallback}
+	if backupKeyCFG.WriteMode, err = storage.ParseWriteMode(*backupWriteMode); err != nil {
+		fail("--backup-write-mode: %v", err)
+	}
+	exportPublicFormat, err := key.ParsePublicKeyFormat(*exportFormat)
+	if err != nil {
+		fail("--export-format: %v", err)
+	}
+	batchSigningKeyType, err := key.ParseType(*batchSigningKeyAlgorithm)
+	if err != nil {
+		fail("--batch-signing-key-algorithm: %v", err)
+	}
+	if batchSigningKeyType != key.P256 && batchSigningKeyType != key.Ed25519 {
+		fail("--batch-signing-key-algorithm must be one of 'P256' or 'Ed25519'")
+	}
+	packetEncryptionKeyType, err := key.ParseType(*packetEncryptionKeyAlgorithm)
+	if err != nil {
+		fail("--packet-encryption-key-algorithm: %v", err)
+	}
+	if packetEncryptionKeyType != key.P256 && packetEncryptionKeyType != key.X25519 {
+		fail("--packet-encryption-key-algorithm must be one of 'P256' or 'X25519'")
+	}
+	var keyRand io.Reader = rand.Reader
+	if *insecureRandomSeed != 0 {
+		log.Warn().Int64("seed", *insecureRandomSeed).Msgf("Creating predictable keys from --insecure-random-seed")
+		keyRand = &lockedReader{r: mathrand.New(mathrand.NewSource(*insecureRandomSeed))} // nolint:gosec // Use of non-cryptographic RNG is purposeful here.
+	}
+
+	var backupReplicaRegionLst []string
+	for _, v := range strings.Split(*backupReplicaRegions, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			backupReplicaRegionLst = append(backupReplicaRegionLst, v)
 		}
 	}
 
+	if *defaultManifestByIngestorJSON != "" && *defaultManifestByIngestorFile != "" {
+		fail("--default-manifest-by-ingestor and --default-manifest-by-ingestor-file are mutually exclusive")
+	}
+	if *defaultManifestMaxBytes <= 0 {
+		fail("--default-manifest-max-bytes must be positive")
+	}
+
 	log.Info().Msgf("Starting up")
 	if *skipManifestPreUpdateValidations {
 		log.Warn().Msgf("--unsafe-skip-manifest-pre-update-validations is set; this flag is inherently unsafe and should only be set temporarily in order to fix an ongoing incident")
@@ -184,11 +658,26 @@ func main() {
 		log.Warn().Msgf("--unsafe-skip-manifest-post-update-validations is set; this flag is inherently unsafe and should only be set temporarily in order to fix an ongoing incident")
 	}
 	ctx := context.Background()
-	if *timeout > 0 {
+	if *watchMode || *runInterval > 0 {
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+	} else if *timeout > 0 {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, *timeout)
 		defer cancel()
 	}
+	if tracingEnabled(os.Getenv) {
+		log.Info().Msgf("Exporting traces over OTLP")
+		if err := initTracing(ctx); err != nil {
+			fail("Couldn't initialize tracing: %v", err)
+		}
+		defer func() {
+			if err := tryFlushTraces(); err != nil {
+				log.Error().Err(err).Msgf("Couldn't flush traces: %v", err)
+			}
+		}()
+	}
 
 	// Get Kubernetes client & create key store from it.
 	log.Info().Msgf("Creating key store")
@@ -216,24 +705,199 @@ func main() {
 	if err != nil {
 		fail("Couldn't create Kubernetes client: %v", err)
 	}
-	keyStore := storage.NewKubernetesKey(k8s.CoreV1().Secrets(*namespace), *prioEnv)
+	keyNamespaces := []string{*namespace}
+	for _, ns := range namespaceByIngestor {
+		keyNamespaces = append(keyNamespaces, ns)
+	}
+	// The preflight command reports unreachable namespaces itself.
+	if len(namespaceByIngestor) > 0 && !preflightMode {
+		if err := checkNamespaces(ctx, k8s.CoreV1().Secrets, keyNamespaces); err != nil {
+			fail("Kubernetes namespace unreachable: %v", err)
+		}
+	}
 
-	// Create backup key store if configured to do so.
-	switch {
-	case *backup == "aws":
-		sess, err := session.NewSession()
+	// Create KeyRotation status reporter if configured to do so.
+	var statusReporter *keyRotationStatusReporter
+	if *keyRotationResource != "" && !*dryRun {
+		dyn, err := dynamic.NewForConfig(cfg)
 		if err != nil {
-			fail("Couldn't create AWS session: %v", err)
+			fail("Couldn't create Kubernetes dynamic client: %v", err)
+		}
+		log.Info().Msgf("Reporting rotation status to KeyRotation %q", *keyRotationResource)
+		statusReporter = &keyRotationStatusReporter{
+			client: dyn.Resource(keyRotationGVR).Namespace(*namespace),
+			name:   *keyRotationResource,
 		}
-		keyStore = storage.NewBackupKey(keyStore, storage.NewAWSKey(secretsmanager.New(sess), *prioEnv))
+	}
+	reportStatus := func(ctx context.Context, rotationErr error) {
+		if statusReporter == nil {
+			return
+		}
+		if err := statusReporter.report(ctx, time.Now(), rotationErr); err != nil {
+			log.Error().Err(err).Msgf("Couldn't report rotation status: %v", err)
+		}
+	}
 
-	case strings.HasPrefix(*backup, "gcp:"):
-		gcpProjectID := strings.TrimPrefix(*backup, "gcp:")
-		sm, err := secretmanager.NewClient(ctx)
+	// Get cloud credentials from SPIFFE identities, if configured to do so.
+	var awsCreds *credentials.Credentials
+	if spiffeCFG.awsRoleARN != "" {
+		log.Info().Msgf("Using SPIFFE identity to assume AWS role %q", spiffeCFG.awsRoleARN)
+		config := aws.NewConfig().WithHTTPClient(awsHTTPClient)
+		if *awsRegion != "" {
+			config = config.WithRegion(*awsRegion)
+		}
+		if *awsSTSEndpoint != "" {
+			config = config.WithEndpoint(*awsSTSEndpoint)
+		}
+		sess, err := session.NewSession(config)
 		if err != nil {
-			fail("Couldn't create GCP secret manager client: %v", err)
+			fail("Couldn't create AWS session: %v", err)
+		}
+		sessionName := "key-rotator"
+		if *locality != "" {
+			sessionName = fmt.Sprintf("key-rotator-%s", *locality)
+		}
+		awsCreds = spiffeCFG.awsCredentials(sess, sessionName)
+	}
+	gcpOpts, err := spiffeCFG.gcpClientOptions()
+	if err != nil {
+		fail("Couldn't create GCP client options from SPIFFE identity: %v", err)
+	}
+	if len(gcpOpts) > 0 {
+		log.Info().Msgf("Using SPIFFE identity with GCP workload identity provider %q", spiffeCFG.gcpWorkloadIdentityProvider)
+	}
+
+	// Create batch signing keys in a KMS, if configured to do so. In dry-run
+	// mode, no KMS keys are created; a stand-in for each is created locally.
+	batchSigningKeyFunc := newKeyFunc(batchSigningKeyType, keyRand)
+	if *batchSigningKeyKMS != "" {
+		var kms key.KMS
+		switch {
+		case *dryRun:
+			kms = &dryRunKMS{rnd: keyRand, pubs: map[string]key.PublicKey{}}
+		case *batchSigningKeyKMS == "aws":
+			sess, err := session.NewSession()
+			if err != nil {
+				fail("Couldn't create AWS session: %v", err)
+			}
+			config := aws.NewConfig().WithHTTPClient(awsHTTPClient)
+			if *awsRegion != "" {
+				config = config.WithRegion(*awsRegion)
+			}
+			if awsCreds != nil {
+				config = config.WithCredentials(awsCreds)
+			}
+			kms = storage.NewAWSKMS(awskms.New(sess, config), fmt.Sprintf("prio-server %s batch signing key", *prioEnv))
+		default:
+			svc, err := cloudkms.NewService(ctx, gcpOpts...)
+			if err != nil {
+				fail("Couldn't create GCP KMS client: %v", err)
+			}
+			kms = storage.NewGCPKMS(svc, strings.TrimPrefix(*batchSigningKeyKMS, "gcp:"))
+		}
+		batchSigningKeyFunc = newKMSKeyFunc(ctx, kms)
+	}
+
+	var vaultCFG storage.VaultConfig
+	vaultHTTPClient := &http.Client{Transport: storage.NewHTTPTransport(minTLS)}
+	if *keyStoreKind == "vault" || *keyStoreFallback == "vault" || containsString(backupLst, "vault") {
+		if *vaultAddress == "" {
+			fail("--vault-address is required to store keys in Vault")
+		}
+		vaultCFG = storage.VaultConfig{
+			Address:   *vaultAddress,
+			Namespace: *vaultNamespace,
+			Mount:     *vaultMount,
+		}
+		switch {
+		case *vaultKubernetesAuthRole != "":
+			// Tokens obtained by logging in expire, so log in again whenever
+			// Vault rejects the token, re-reading the service account token
+			// since it may have been rotated too.
+			loginCFG := vaultCFG
+			login := func(ctx context.Context) (string, error) {
+				saToken, err := os.ReadFile(kubernetesServiceAccountTokenPath)
+				if err != nil {
+					return "", fmt.Errorf("couldn't read Kubernetes service account token: %w", err)
+				}
+				return storage.VaultKubernetesLogin(ctx, vaultHTTPClient, loginCFG, *vaultKubernetesAuthPath, *vaultKubernetesAuthRole, strings.TrimSpace(string(saToken)))
+			}
+			var err error
+			if vaultCFG.Token, err = login(ctx); err != nil {
+				fail("%v", err)
+			}
+			vaultCFG.Login = login
+		case *vaultTokenFile != "":
+			token, err := os.ReadFile(*vaultTokenFile)
+			if err != nil {
+				fail("Couldn't read --vault-token-file: %v", err)
+			}
+			vaultCFG.Token = strings.TrimSpace(string(token))
+		default:
+			vaultCFG.Token = os.Getenv("VAULT_TOKEN")
+		}
+		if vaultCFG.Token == "" {
+			fail("No Vault token: specify --vault-token-file or --vault-kubernetes-auth-role, or set VAULT_TOKEN")
+		}
+	}
+
+	// Get key storage of the given kind, as accepted by --key-store, for the
+	// given environment. Secrets stored in AWS or GCP are replicated to
+	// replicaRegions.
+	newKeyStoreOfKind := func(kind, env, namespace string, replicaRegions []string) storage.Key {
+		switch {
+		case kind == "aws":
+			sess, err := session.NewSession()
+			if err != nil {
+				fail("Couldn't create AWS session: %v", err)
+			}
+			config := aws.NewConfig().WithHTTPClient(awsHTTPClient)
+			if awsCreds != nil {
+				config = config.WithCredentials(awsCreds)
+			}
+			return storage.NewTracedKey(storage.NewAWSKey(secretsmanager.New(sess, config), env, replicaRegions), "aws")
+
+		case strings.HasPrefix(kind, "gcp:"):
+			gcpProjectID := strings.TrimPrefix(kind, "gcp:")
+			sm, err := secretmanager.NewClient(ctx, gcpOpts...)
+			if err != nil {
+				fail("Couldn't create GCP secret manager client: %v", err)
+			}
+			return storage.NewTracedKey(storage.NewGCPKey(sm, env, gcpProjectID, replicaRegions), "gcp")
+
+		case kind == "vault":
+			return storage.NewTracedKey(storage.NewVaultKey(vaultHTTPClient, vaultCFG, env), "vault")
+
+		default:
+			return storage.NewTracedKey(storage.NewKubernetesKeyWithHistory(kubernetesSecrets(k8s.CoreV1().Secrets, namespace, namespaceByIngestor), env, *kubernetesKeyHistory), "kubernetes")
 		}
-		keyStore = storage.NewBackupKey(keyStore, storage.NewGCPKey(sm, *prioEnv, gcpProjectID))
+	}
+
+	// Get key storage for the given environment, migrating keys from
+	// --key-store-fallback & with backup key stores if configured to do so.
+	newBackupKeyStores := func(env string) []storage.Key {
+		var keyStores []storage.Key
+		for _, b := range backupLst {
+			keyStores = append(keyStores, newKeyStoreOfKind(b, env, "", backupReplicaRegionLst))
+		}
+		return keyStores
+	}
+	newPrimaryKeyStore := func(env, namespace string) storage.Key {
+		keyStore := newKeyStoreOfKind(*keyStoreKind, env, namespace, nil)
+		if *keyStoreFallback != "" {
+			keyStore = storage.NewMigratingKey(keyStore, newKeyStoreOfKind(*keyStoreFallback, env, namespace, nil))
+		}
+		return keyStore
+	}
+	newKeyStore := func(env, namespace string) storage.Key {
+		keyStore := newPrimaryKeyStore(env, namespace)
+		if backupKeyStores := newBackupKeyStores(env); len(backupKeyStores) > 0 {
+			keyStore = storage.NewCompositeKey(keyStore, backupKeyStores, backupKeyCFG)
+		}
+		if *dryRun {
+			keyStore = dryRunKeyStore{keyStore}
+		}
+		return keyStore
 	}
 
 	// Get Manifest storage client.
@@ -242,24 +906,272 @@ func main() {
 	if *awsRegion != "" {
 		opts = append(opts, storage.WithAWSRegion(*awsRegion))
 	}
-	if defaultManifestByDSP != nil {
+	opts = append(opts, storage.WithMinTLSVersion(minTLS))
+	if *s3Endpoint != "" {
+		opts = append(opts, storage.WithS3Endpoint(*s3Endpoint))
+	}
+	if *gcsEndpoint != "" {
+		opts = append(opts, storage.WithGCSEndpoint(*gcsEndpoint))
+	}
+	if *s3ForcePathStyle {
+		opts = append(opts, storage.WithS3ForcePathStyle(true))
+	}
+	if awsCreds != nil {
+		opts = append(opts, storage.WithAWSCredentials(awsCreds))
+	}
+	if *s3AccessKeyID != "" {
+		secretAccessKey, err := os.ReadFile(*s3SecretAccessKeyFile)
+		if err != nil {
+			fail("Couldn't read --s3-secret-access-key-file: %v", err)
+		}
+		opts = append(opts, storage.WithAWSStaticCredentials(*s3AccessKeyID, strings.TrimSpace(string(secretAccessKey))))
+	}
+	if *s3AssumeRoleARN != "" {
+		opts = append(opts, storage.WithAWSAssumeRole(*s3AssumeRoleARN))
+	}
+	if len(gcpOpts) > 0 {
+		opts = append(opts, storage.WithGCPClientOptions(gcpOpts...))
+	}
+	if *defaultManifestByIngestorJSON != "" || *defaultManifestByIngestorFile != "" {
+		var r io.ReadCloser = io.NopCloser(strings.NewReader(*defaultManifestByIngestorJSON))
+		if *defaultManifestByIngestorFile != "" {
+			if r, err = openDefaultManifests(ctx, *defaultManifestByIngestorFile, opts); err != nil {
+				fail("Couldn't open --default-manifest-by-ingestor-file: %v", err)
+			}
+		}
+		defaultManifestByIngestor, err := readDefaultManifests(r, *defaultManifestMaxBytes, ingestorLst)
+		r.Close()
+		if err != nil {
+			fail("Default manifests cannot be deserialized: %v", err)
+		}
+		defaultManifestByDSP := map[string]manifest.DataShareProcessorSpecificManifest{}
+		for ingestor, manifest := range defaultManifestByIngestor {
+			defaultManifestByDSP[dspName(*locality, ingestor)] = manifest
+		}
 		opts = append(opts, storage.WithDefaultDataShareProcessorManifests(defaultManifestByDSP))
 	}
 	manifestStore, err := storage.NewManifest(ctx, *manifestBucketURL, opts...)
 	if err != nil {
 		fail("Couldn't create manifest store: %v", err)
 	}
+	manifestStore = storage.NewTracedManifest(manifestStore, *manifestBucketURL)
+
+	if compareMode {
+		compareK8s := k8s
+		if *compareKubeconfig != *kubeconfig {
+			c, err := clientcmd.BuildConfigFromFlags("", *compareKubeconfig)
+			if err != nil {
+				fail("Couldn't get Kubernetes config for --compare-kubeconfig: %v", err)
+			}
+			if compareK8s, err = kubernetes.NewForConfig(c); err != nil {
+				fail("Couldn't create Kubernetes client for --compare-kubeconfig: %v", err)
+			}
+		}
+		compareManifestStore := manifestStore
+		if *compareManifestBucketURL != *manifestBucketURL {
+			if compareManifestStore, err = storage.NewManifest(ctx, *compareManifestBucketURL, opts...); err != nil {
+				fail("Couldn't create manifest store for --compare-manifest-bucket-url: %v", err)
+			}
+		}
+
+		log.Info().Msgf("compare command is specified: comparing keys & manifests with environment %q", *comparePrioEnv)
+		divergences, err := compareKeys(ctx, compareKeysConfig{
+			a: compareEnvironment{
+				keyStore:      storage.NewKubernetesKeyWithSecrets(kubernetesSecrets(k8s.CoreV1().Secrets, *namespace, namespaceByIngestor), *prioEnv),
+				manifestStore: manifestStore,
+				name:          fmt.Sprintf("%q (namespace %q, manifest bucket %q)", *prioEnv, *namespace, *manifestBucketURL),
+			},
+			b: compareEnvironment{
+				keyStore:      storage.NewKubernetesKey(compareK8s.CoreV1().Secrets(*compareNamespace), *comparePrioEnv),
+				manifestStore: compareManifestStore,
+				name:          fmt.Sprintf("%q (namespace %q, manifest bucket %q)", *comparePrioEnv, *compareNamespace, *compareManifestBucketURL),
+			},
+			locality:  *locality,
+			ingestors: ingestorLst,
+		})
+		if err != nil {
+			fail("Couldn't compare keys: %v", err)
+		}
+		for _, d := range divergences {
+			log.Warn().Msgf("Divergence: %s", d)
+		}
+		if len(divergences) > 0 {
+			fail("Found %d divergences between environments", len(divergences))
+		}
+		log.Info().Msgf("Keys & manifests match")
+		return
+	}
+
+	if verifyBackupsMode {
+		var backups []verifyBackup
+		for i, backupKeyStore := range newBackupKeyStores(*prioEnv) {
+			backups = append(backups, verifyBackup{keyStore: backupKeyStore, name: backupLst[i]})
+		}
+		log.Info().Msgf("verify-backups command is specified: comparing keys against backups (repairing divergent backups: %v)", !*dryRun)
+		divergences, err := verifyBackups(ctx, verifyBackupsConfig{
+			keyStore:       newPrimaryKeyStore(*prioEnv, *namespace),
+			backups:        backups,
+			locality:       *locality,
+			ingestors:      ingestorLst,
+			taskSigningKey: *taskSigningKeyEnable,
+			repair:         !*dryRun,
+		})
+		unrepaired := 0
+		for _, d := range divergences {
+			if d.repaired {
+				log.Info().Msgf("Repaired divergence: %s", d.description)
+			} else {
+				log.Warn().Msgf("Divergence: %s", d.description)
+				unrepaired++
+			}
+		}
+		if err != nil {
+			fail("Couldn't verify backups: %v", err)
+		}
+		if unrepaired > 0 {
+			fail("Found %d divergences between keys & backups", unrepaired)
+		}
+		log.Info().Msgf("Backups match keys")
+		return
+	}
+
+	if *migrateKeyStoreMode {
+		to := newKeyStoreOfKind(*keyStoreKind, *prioEnv, *namespace, nil)
+		if *dryRun {
+			to = dryRunKeyStore{to}
+		}
+		log.Info().Msgf("--migrate-keys is specified: copying keys from %q to %q", *keyStoreFallback, *keyStoreKind)
+		copied, err := migrateKeyStore(ctx, migrateKeyStoreConfig{
+			from:             newKeyStoreOfKind(*keyStoreFallback, *prioEnv, *namespace, nil),
+			to:               to,
+			locality:         *locality,
+			ingestors:        ingestorLst,
+			taskSigningKey:   *taskSigningKeyEnable,
+			skipVerification: *dryRun,
+		})
+		if err != nil {
+			fail("Couldn't migrate keys to --key-store: %v", err)
+		}
+		log.Info().Msgf("Migrated %d keys to %q", copied, *keyStoreKind)
+		return
+	}
+
+	if verifySchemaMode {
+		log.Info().Msgf("verify-schema command is specified: verifying schema of key secrets (migrating outdated secrets: %v)", !*dryRun)
+		if err := verifySchema(ctx, verifySchemaConfig{
+			secrets:         kubernetesSecrets(k8s.CoreV1().Secrets, *namespace, namespaceByIngestor),
+			prioEnvironment: *prioEnv,
+			locality:        *locality,
+			ingestors:       ingestorLst,
+			taskSigningKey:  *taskSigningKeyEnable,
+			migrate:         !*dryRun,
+		}); err != nil {
+			fail("Couldn't verify key secret schema: %v", err)
+		}
+		log.Info().Msgf("Key secrets are consistent & use the current schema")
+		return
+	}
+
+	if exportPublicMode {
+		log.Info().Msgf("export-public command is specified: writing %s-encoded public keys to standard output", exportPublicFormat)
+		if err := exportPublic(ctx, exportPublicConfig{
+			keyStore:        newKeyStore(*prioEnv, *namespace),
+			prioEnvironment: *prioEnv,
+			locality:        *locality,
+			ingestors:       ingestorLst,
+			taskSigningKey:  *taskSigningKeyEnable,
+			format:          exportPublicFormat,
+		}, os.Stdout); err != nil {
+			fail("Couldn't export public keys: %v", err)
+		}
+		return
+	}
+
+	if preflightMode {
+		cfg := preflightConfig{
+			manifestStore: manifestStore,
+			checkManifestWrite: func(ctx context.Context) error {
+				return storage.CheckManifestWriteAccess(ctx, *manifestBucketURL, opts...)
+			},
+			namespaces:     keyNamespaces,
+			manifestBucket: *manifestBucketURL,
+			locality:       *locality,
+			ingestors:      ingestorLst,
+			taskSigningKey: *taskSigningKeyEnable,
+		}
+		for _, storeKind := range []string{*keyStoreKind, *keyStoreFallback} {
+			switch storeKind {
+			case "":
+			case "kubernetes":
+				secrets := kubernetesSecrets(k8s.CoreV1().Secrets, *namespace, namespaceByIngestor)
+				cfg.secrets = k8s.CoreV1().Secrets
+				cfg.checkKeySecret = func(ctx context.Context, kind, ingestor string) (string, error, error) {
+					return storage.CheckKubernetesKeySecret(ctx, secrets, *prioEnv, kind, *locality, ingestor)
+				}
+			default:
+				cfg.keyStores = append(cfg.keyStores, verifyBackup{keyStore: newKeyStoreOfKind(storeKind, *prioEnv, *namespace, nil), name: storeKind})
+			}
+		}
+		for i, backupKeyStore := range newBackupKeyStores(*prioEnv) {
+			cfg.keyStores = append(cfg.keyStores, verifyBackup{keyStore: backupKeyStore, name: backupLst[i]})
+		}
+		log.Info().Msgf("preflight command is specified: checking access to key & manifest storage, writing results to standard output")
+		failed, err := preflight(ctx, cfg, os.Stdout)
+		if err != nil {
+			fail("Couldn't run preflight checks: %v", err)
+		}
+		if failed > 0 {
+			fail("%d preflight checks failed", failed)
+		}
+		log.Info().Msgf("All preflight checks passed")
+		return
+	}
 
 	// ...and go!
 	if *dryRun {
 		log.Info().Msgf("--dry-run is specified: no writes will actually occur")
-		keyStore = dryRunKeyStore{keyStore}
 		manifestStore = dryRunManifestStore{manifestStore}
 	}
-	if err := rotateKeys(ctx, rotateKeysConfig{
-		keyStore:        keyStore,
+
+	if *readPrioEnv != "" {
+		log.Info().Msgf("--read-prio-environment & --write-prio-environment are specified: migrating keys from %q to %q", *readPrioEnv, *writePrioEnv)
+		if err := migrateKeys(ctx, migrateKeysConfig{
+			readKeyStore:         newKeyStore(*readPrioEnv, *namespace),
+			writeKeyStore:        newKeyStore(*writePrioEnv, *namespace),
+			manifestStore:        manifestStore,
+			locality:             *locality,
+			ingestors:            ingestorLst,
+			readPrioEnvironment:  *readPrioEnv,
+			writePrioEnvironment: *writePrioEnv,
+			csrFQDN:              *csrFQDN,
+			manifestHooks:        hooks,
+			skipVerification:     *dryRun,
+		}); err != nil {
+			fail("Couldn't migrate keys: %v", err)
+		}
+		lastSuccess.WithLabelValues(*locality).SetToCurrentTime()
+		if err := tryPushMetrics(); err != nil {
+			log.Error().Err(err).Msgf("Couldn't push metrics: %v", err)
+		}
+		return
+	}
+
+	exclusions := ingestorExclusions{
+		configMaps:    k8s.CoreV1().ConfigMaps(*namespace),
+		locality:      *locality,
+		skipped:       skipIngestorLst,
+		configMapName: *skipIngestorsConfigMap,
+	}
+	tryOrder := packetEncryptionKeyTryOrder{
+		configMaps:    k8s.CoreV1().ConfigMaps(*namespace),
+		policy:        *packetEncryptionKeyTryOrderPolicy,
+		configMapName: *packetEncryptionKeyUsageConfigMap,
+	}
+
+	rotateCFG := rotateKeysConfig{
+		keyStore:        newKeyStore(*prioEnv, *namespace),
 		manifestStore:   manifestStore,
-		now:             time.Now(),
+		rand:            keyRand,
 		locality:        *locality,
 		ingestors:       ingestorLst,
 		prioEnvironment: *prioEnv,
@@ -268,7 +1180,7 @@ func main() {
 			enableRotation: *batchSigningKeyEnableRotation,
 			alwaysWrite:    *batchSigningKeyAlwaysWrite,
 			rotationCFG: key.RotationConfig{
-				CreateKeyFunc:     key.P256.New,
+				CreateKeyFunc:     batchSigningKeyFunc,
 				CreateMinAge:      *batchSigningKeyCreateMinAge,
 				PrimaryMinAge:     *batchSigningKeyPrimaryMinAge,
 				DeleteMinAge:      *batchSigningKeyDeleteMinAge,
@@ -279,20 +1191,350 @@ func main() {
 			enableRotation: *packetEncryptionKeyEnableRotation,
 			alwaysWrite:    *packetEncryptionKeyAlwaysWrite,
 			rotationCFG: key.RotationConfig{
-				CreateKeyFunc:     key.P256.New,
+				CreateKeyFunc:     newKeyFunc(packetEncryptionKeyType, keyRand),
 				CreateMinAge:      *packetEncryptionKeyCreateMinAge,
 				PrimaryMinAge:     *packetEncryptionKeyPrimaryMinAge,
 				DeleteMinAge:      *packetEncryptionKeyDeleteMinAge,
 				DeleteMinKeyCount: *packetEncryptionKeyDeleteMinCount,
 			},
 		},
-		skipManifestPreUpdateValidations:  *skipManifestPreUpdateValidations,
-		skipManifestPostUpdateValidations: *skipManifestPostUpdateValidations,
-	}); err != nil {
+		manageTaskSigningKey: *taskSigningKeyEnable,
+		taskCFG: rotateKeyConfig{
+			enableRotation: true,
+			rotationCFG: key.RotationConfig{
+				CreateKeyFunc:     newKeyFunc(key.P256, keyRand),
+				CreateMinAge:      *taskSigningKeyCreateMinAge,
+				PrimaryMinAge:     *taskSigningKeyPrimaryMinAge,
+				DeleteMinAge:      *taskSigningKeyDeleteMinAge,
+				DeleteMinKeyCount: *taskSigningKeyDeleteMinCount,
+			},
+		},
+		manifestKeyExpirationRenewalWindow: *manifestKeyExpirationRenewalWindow,
+		manifestKeyExpirationMinValidity:   *manifestKeyExpirationMinValidity,
+		batchSigningKeyExpiration:          *batchSigningKeyExpiration,
+		skipManifestPreUpdateValidations:   *skipManifestPreUpdateValidations,
+		skipManifestPostUpdateValidations:  *skipManifestPostUpdateValidations,
+		manifestHooks:                      hooks,
+		notifier:                           notify,
+		timeouts: phaseTimeouts{
+			read:           *readTimeout,
+			rotate:         *rotateTimeout,
+			writeKeys:      *writeKeysTimeout,
+			writeManifests: *writeManifestsTimeout,
+		},
+	}
+	if *publicKeysFile != "" {
+		if *dryRun {
+			log.Info().Msgf("--dry-run is specified: public keys will not be written to %q", *publicKeysFile)
+		} else {
+			rotateCFG.publicKeysFile = *publicKeysFile
+		}
+	}
+	rotateCFG.writeJWKS = *writeJWKS
+	if *outputFormat == "json" {
+		rotateCFG.report = &changeReport{dryRun: *dryRun}
+	}
+	switch *manifestSigningKey {
+	case "":
+	case "batch-signing-key":
+		rotateCFG.manifestSigning = &manifestSigningConfig{batchSigningKey: true}
+	default:
+		material, err := loadManifestSigningKey(*manifestSigningKey)
+		if err != nil {
+			fail("Couldn't load --manifest-signing-key: %v", err)
+		}
+		keyID := *manifestSigningKeyID
+		if keyID == "" {
+			keyID = fmt.Sprintf("%s-manifest-signing-key", rotateCFG.prioEnvironment)
+		}
+		rotateCFG.manifestSigning = &manifestSigningConfig{material: material, keyID: keyID}
+	}
+	if *ingestorGlobalManifest != "" {
+		globalManifestStore, err := storage.NewManifest(ctx, *manifestBucketURL, append(opts, storage.WithKeyPrefix(*ingestorGlobalManifest))...)
+		if err != nil {
+			fail("Couldn't create manifest store for --ingestor-global-manifest: %v", err)
+		}
+		globalManifestStore = storage.NewTracedManifest(globalManifestStore, *manifestBucketURL)
+		if *dryRun {
+			globalManifestStore = dryRunManifestStore{globalManifestStore}
+		}
+		rotateCFG.ingestorGlobal = &ingestorGlobalConfig{ingestor: *ingestorGlobalManifest, manifestStore: globalManifestStore}
+	}
+
+	if inspectMode {
+		log.Info().Msgf("inspect command is specified: writing a report of keys & manifests to standard output")
+		if err := inspect(ctx, inspectConfig{rotate: rotateCFG, json: *inspectFormat == "json"}, os.Stdout); err != nil {
+			fail("Couldn't inspect keys: %v", err)
+		}
+		return
+	}
+
+	if restoreMode {
+		from := backupLst[restoreBackupIdx]
+		to := newPrimaryKeyStore(*prioEnv, *namespace)
+		if *dryRun {
+			to = dryRunKeyStore{to}
+		}
+		log.Info().Msgf("restore command is specified: restoring keys from %q to %q (writing keys: %v) & writing a report to standard output", from, *keyStoreKind, !*dryRun)
+		cfg := rotateCFG
+		cfg.keyStore = newBackupKeyStores(*prioEnv)[restoreBackupIdx]
+		if err := restore(ctx, restoreConfig{rotate: cfg, to: to, from: from, dryRun: *dryRun}, os.Stdout); err != nil {
+			fail("Couldn't restore keys: %v", err)
+		}
+		return
+	}
+
+	if revokeMode {
+		// Every ingestor's manifest is updated, even those excluded from
+		// rotation by --skip-ingestors, since a manifest left unchanged may
+		// continue to publish the revoked key version.
+		log.Warn().Msgf("revoke command is specified: revoking %s for %q", revocation, *locality)
+		cfg := rotateCFG
+		cfg.now = time.Now()
+		cfg.revocation = revocation
+		cfg.packetEncryptionKeyTryOrder, err = tryOrder.order(ctx)
+		if err == nil {
+			err = rotateKeys(ctx, cfg)
+		}
+		reportStatus(ctx, err)
+		writeChangeReport(cfg.report)
+		if err != nil {
+			fail("Couldn't revoke key version: %v", err)
+		}
+		// Previous keys kept per --kubernetes-key-history may still contain
+		// the revoked version, so it is removed from them too, lest a
+		// rollback restore it.
+		if !*dryRun && (*keyStoreKind == "kubernetes" || *keyStoreFallback == "kubernetes") {
+			secrets := kubernetesSecrets(k8s.CoreV1().Secrets, *namespace, namespaceByIngestor)
+			n, err := revocation.removeFromHistory(ctx, func(ctx context.Context, kind, ingestor string, creationTimestamp int64) (int, error) {
+				return storage.RemoveKubernetesKeyHistoryVersion(ctx, secrets, *prioEnv, kind, *locality, ingestor, creationTimestamp)
+			})
+			if err != nil {
+				fail("Couldn't revoke key version: %v", err)
+			}
+			log.Info().Msgf("Removed revoked key version from %d previous keys", n)
+		}
+		lastSuccess.WithLabelValues(*locality).SetToCurrentTime()
+		if err := tryPushMetrics(); err != nil {
+			log.Error().Err(err).Msgf("Couldn't push metrics: %v", err)
+		}
+		log.Info().Msgf("Key version revoked successfully")
+		return
+	}
+
+	if rollbackMode {
+		// As with revocation, every ingestor's manifest is updated, so that
+		// the rolled-back key is published even if its ingestor is excluded
+		// from rotation by --skip-ingestors.
+		secrets := kubernetesSecrets(k8s.CoreV1().Secrets, *namespace, namespaceByIngestor)
+		if err := rollback.load(ctx, func(ctx context.Context, kind, ingestor string) ([]key.Key, error) {
+			return storage.GetKubernetesKeyHistory(ctx, secrets, *prioEnv, kind, *locality, ingestor)
+		}); err != nil {
+			fail("Bad rollback: %v", err)
+		}
+		log.Warn().Msgf("rollback command is specified: rolling back %s for %q by %d writes", rollback, *locality, rollback.steps)
+		cfg := rotateCFG
+		cfg.now = time.Now()
+		cfg.rollback = rollback
+		cfg.packetEncryptionKeyTryOrder, err = tryOrder.order(ctx)
+		if err == nil {
+			err = rotateKeys(ctx, cfg)
+		}
+		reportStatus(ctx, err)
+		writeChangeReport(cfg.report)
+		if err != nil {
+			fail("Couldn't roll back key: %v", err)
+		}
+		lastSuccess.WithLabelValues(*locality).SetToCurrentTime()
+		if err := tryPushMetrics(); err != nil {
+			log.Error().Err(err).Msgf("Couldn't push metrics: %v", err)
+		}
+		log.Info().Msgf("Key rolled back successfully")
+		return
+	}
+
+	if smokeTestMode {
+		smokeCFG := smokeTestConfig{
+			backupKeyStores: newBackupKeyStores(*prioEnv),
+			rotate:          rotateCFG,
+		}
+		// The smoke test always validates manifests, and neither invokes
+		// hooks for, sends notifications about, nor writes public keys of
+		// the throwaway locality's keys & manifests.
+		smokeCFG.rotate.now = time.Now()
+		smokeCFG.rotate.locality = smokeTestLocality(*locality, smokeCFG.rotate.now)
+		smokeCFG.rotate.skipManifestPreUpdateValidations = false
+		smokeCFG.rotate.skipManifestPostUpdateValidations = false
+		smokeCFG.rotate.manifestHooks = manifestHooks{}
+		smokeCFG.rotate.notifier = notifier{}
+		smokeCFG.rotate.publicKeysFile = ""
+		smokeCFG.createKeys = func(ctx context.Context) error {
+			return storage.CreateKubernetesKeys(ctx, kubernetesSecrets(k8s.CoreV1().Secrets, *namespace, namespaceByIngestor), *prioEnv, smokeCFG.rotate.locality, ingestorLst, *taskSigningKeyEnable)
+		}
+		if *keyStoreKind != "kubernetes" {
+			// Vault & cloud secrets are created on first write, so writing empty
+			// keys stands in for Terraform creating them.
+			smokeCFG.createKeys = func(ctx context.Context) error {
+				return createEmptyKeys(ctx, smokeCFG.rotate.keyStore, smokeCFG.rotate.locality, ingestorLst, *taskSigningKeyEnable)
+			}
+		}
+		log.Info().Msgf("smoke-test command is specified: rotating keys for throwaway locality %q", smokeCFG.rotate.locality)
+		if err := smokeTest(ctx, smokeCFG); err != nil {
+			fail("Smoke test failed: %v", err)
+		}
+		log.Info().Msgf("Smoke test passed")
+		return
+	}
+
+	if *watchMode {
+		secretChanges, err := storage.WatchKubernetesKeys(ctx, kubernetesSecrets(k8s.CoreV1().Secrets, *namespace, namespaceByIngestor), *prioEnv, *locality, ingestorLst)
+		if err != nil {
+			fail("Couldn't watch secrets: %v", err)
+		}
+		var dspNames []string
+		for _, ingestor := range ingestorLst {
+			dspNames = append(dspNames, dspName(*locality, ingestor))
+		}
+		log.Info().Msgf("--watch is specified: rotating keys whenever secrets or manifests change")
+		if err := watch(ctx, watchConfig{
+			secretChanges: secretChanges,
+			manifestStore: manifestStore,
+			dspNames:      dspNames,
+			pollInterval:  *watchManifestPollInterval,
+			minInterval:   *watchMinInterval,
+		}, func(ctx context.Context) error {
+			if *timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, *timeout)
+				defer cancel()
+			}
+			cfg := rotateCFG
+			cfg.now = time.Now()
+			ingestors, err := exclusions.apply(ctx, ingestorLst)
+			if err == nil {
+				cfg.ingestors = ingestors
+				cfg.packetEncryptionKeyTryOrder, err = tryOrder.order(ctx)
+			}
+			if err == nil {
+				err = rotateKeys(ctx, cfg)
+			}
+			reportStatus(ctx, err)
+			if err != nil {
+				lastFailure.WithLabelValues(*locality).SetToCurrentTime()
+			} else {
+				lastSuccess.WithLabelValues(*locality).SetToCurrentTime()
+			}
+			if err := tryPushMetrics(); err != nil {
+				log.Error().Err(err).Msgf("Couldn't push metrics: %v", err)
+			}
+			return err
+		}); err != nil {
+			fail("Couldn't watch for changes: %v", err)
+		}
+		log.Info().Msgf("Shutting down")
+		return
+	}
+
+	// rotate rotates the keys of each locality given by --locality or
+	// --localities, returning the localities whose rotation failed, if known.
+	rotate := func(ctx context.Context) (failed []string, _ error) {
+		localityLst := []string{*locality}
+		if *localities != "" {
+			localityLst = nil
+			for _, v := range strings.Split(*localities, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					localityLst = append(localityLst, v)
+				}
+			}
+			if len(localityLst) == 1 && localityLst[0] == allLocalities {
+				var err error
+				if localityLst, err = discoverLocalities(ctx, manifestStore, ingestorLst); err != nil {
+					return nil, fmt.Errorf("couldn't discover localities: %w", err)
+				}
+				log.Info().Msgf("--localities=%s is specified: rotating keys for discovered localities %s", allLocalities, strings.Join(localityLst, ", "))
+			}
+			if len(localityLst) == 0 {
+				return nil, errors.New("no localities to rotate")
+			}
+		}
+		return rotateLocalities(ctx, rotateLocalitiesConfig{
+			rotate: func(ctx context.Context, locality string) error {
+				ns := *namespace
+				if ns == "" {
+					ns = locality
+				}
+				cfg := rotateCFG
+				cfg.now = time.Now()
+				cfg.locality = locality
+				cfg.keyStore = newKeyStore(*prioEnv, ns)
+				exclusions := exclusions
+				exclusions.configMaps = k8s.CoreV1().ConfigMaps(ns)
+				exclusions.locality = locality
+				tryOrder := tryOrder
+				tryOrder.configMaps = k8s.CoreV1().ConfigMaps(ns)
+				ingestors, err := exclusions.apply(ctx, ingestorLst)
+				if err == nil {
+					cfg.ingestors = ingestors
+					cfg.packetEncryptionKeyTryOrder, err = tryOrder.order(ctx)
+				}
+				if err == nil {
+					err = rotateKeys(ctx, cfg)
+				}
+				reportStatus(ctx, err)
+				return err
+			},
+			localities:  localityLst,
+			concurrency: *localityConcurrency,
+		})
+	}
+
+	if *runInterval > 0 {
+		health := newDaemonHealth(2**runInterval + *timeout)
+		server := &http.Server{Addr: *listenAddress, Handler: daemonHandler(health, prometheus.DefaultGatherer)}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fail("Couldn't serve HTTP on %q: %v", *listenAddress, err)
+			}
+		}()
+		log.Info().Msgf("--run-interval is specified: rotating keys every %v, serving /healthz and /metrics on %q", *runInterval, *listenAddress)
+		daemon(ctx, daemonConfig{health: health, runInterval: *runInterval}, func() error {
+			// Rotations are not canceled on SIGTERM, so that they are never
+			// interrupted partway through writing keys & manifests.
+			rotateCtx := context.Background()
+			if *timeout > 0 {
+				var cancel context.CancelFunc
+				rotateCtx, cancel = context.WithTimeout(rotateCtx, *timeout)
+				defer cancel()
+			}
+			failed, err := rotate(rotateCtx)
+			if err != nil && failed == nil {
+				for _, locality := range failingLocalities {
+					lastFailure.WithLabelValues(locality).SetToCurrentTime()
+				}
+			}
+			if err := tryPushMetrics(); err != nil {
+				log.Error().Err(err).Msgf("Couldn't push metrics: %v", err)
+			}
+			return err
+		})
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Error().Err(err).Msgf("Couldn't shut down HTTP server: %v", err)
+		}
+		log.Info().Msgf("Shutting down")
+		return
+	}
+
+	failed, err := rotate(ctx)
+	writeChangeReport(rotateCFG.report)
+	if err != nil {
+		if failed != nil {
+			failingLocalities = failed
+		}
 		fail("Couldn't rotate keys: %v", err)
 	}
 
-	lastSuccess.SetToCurrentTime()
 	if err := tryPushMetrics(); err != nil {
 		log.Error().Err(err).Msgf("Couldn't push metrics: %v", err)
 	}
@@ -318,17 +1560,34 @@ type rotateKeysConfig struct {
 	// Dependencies.
 	keyStore      storage.Key
 	manifestStore storage.Manifest
+	rand          io.Reader // the source of randomness for CSR signatures; if nil, crypto/rand.Reader is used
 
 	// Configuration.
-	now                               time.Time
-	locality                          string
-	ingestors                         []string
-	prioEnvironment                   string
-	csrFQDN                           string
-	batchCFG                          rotateKeyConfig
-	packetCFG                         rotateKeyConfig
-	skipManifestPreUpdateValidations  bool
-	skipManifestPostUpdateValidations bool
+	now                                time.Time
+	locality                           string
+	ingestors                          []string
+	prioEnvironment                    string
+	csrFQDN                            string
+	batchCFG                           rotateKeyConfig
+	packetCFG                          rotateKeyConfig
+	packetEncryptionKeyTryOrder        []int64         // creation timestamps of non-primary packet encryption key versions to attempt first; see key.Key.WithTryOrder
+	manageTaskSigningKey               bool            // if set, the task signing key is rotated & published in manifests
+	taskCFG                            rotateKeyConfig // used only if manageTaskSigningKey is set
+	manifestKeyExpirationRenewalWindow time.Duration   // advertised public keys expiring within this duration have their expiration refreshed
+	manifestKeyExpirationMinValidity   time.Duration   // rotation fails if an advertised public key would expire within this duration
+	batchSigningKeyExpiration          time.Duration   // the validity period of newly-advertised & refreshed batch signing public keys
+	skipManifestPreUpdateValidations   bool
+	skipManifestPostUpdateValidations  bool
+	manifestHooks                      manifestHooks
+	notifier                           notifier      // notified of each key & manifest change once written
+	report                             *changeReport // if not nil, records each key & manifest change once written
+	timeouts                           phaseTimeouts
+	publicKeysFile                     string                 // if set, public keys are written here after a successful rotation
+	writeJWKS                          bool                   // if set, a JWKS of each manifest's batch signing keys is written alongside it
+	manifestSigning                    *manifestSigningConfig // if set, a signature over each manifest is written alongside it, & verified on read
+	ingestorGlobal                     *ingestorGlobalConfig  // if set, a singleton ingestor's batch signing key & global manifest are also rotated
+	revocation                         *keyRevocation         // if set, the rotation revokes this key version
+	rollback                           *keyRollback           // if set, the rotation restores this key to a previous key
 }
 
 type rotateKeyConfig struct {
@@ -337,39 +1596,216 @@ type rotateKeyConfig struct {
 	rotationCFG    key.RotationConfig
 }
 
-func rotateKeys(ctx context.Context, cfg rotateKeysConfig) error {
+func rotateKeys(ctx context.Context, cfg rotateKeysConfig) (err error) {
+	ctx, span := startSpan(ctx, "rotateKeys", attribute.String("locality", cfg.locality))
+	defer func() { storage.EndSpan(span, err) }()
+	start := time.Now()
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		observeDuration(ctx, rotationDuration.WithLabelValues(cfg.locality, result), start)
+	}()
+
 	// Retrieve keys & manifests.
 	log.Info().Msgf("Reading keys & manifests")
-	oldPacketEncryptionKey, oldBatchSigningKeyByIngestor, oldManifestByIngestor, err :=
-		readKeysAndManifests(ctx, cfg.keyStore, cfg.manifestStore, cfg.locality, cfg.ingestors)
-	if err != nil {
+	var oldPacketEncryptionKey key.Key
+	var oldBatchSigningKeyByIngestor map[string]key.Key
+	var oldManifestByIngestor map[string]manifest.DataShareProcessorSpecificManifest
+	var oldTaskSigningKey key.Key
+	var oldIngestorGlobalKey key.Key
+	var oldIngestorGlobalManifest manifest.IngestorGlobalManifest
+	if err := runPhase(ctx, cfg.locality, readPhase, cfg.timeouts.read, func(ctx context.Context) error {
+		var err error
+		oldPacketEncryptionKey, oldBatchSigningKeyByIngestor, oldManifestByIngestor, err =
+			readKeysAndManifests(ctx, cfg.keyStore, cfg.manifestStore, cfg.locality, cfg.ingestors)
+		if err != nil {
+			return err
+		}
+		if cfg.manifestSigning != nil {
+			if err := verifyManifestSignatures(ctx, cfg, oldManifestByIngestor); err != nil {
+				return err
+			}
+		}
+		if cfg.manageTaskSigningKey {
+			if oldTaskSigningKey, err = cfg.keyStore.GetTaskSigningKey(ctx, cfg.locality); err != nil {
+				return fmt.Errorf("couldn't get task signing key for %q: %w", cfg.locality, err)
+			}
+		}
+		if cfg.ingestorGlobal != nil {
+			if oldIngestorGlobalKey, oldIngestorGlobalManifest, err = readIngestorGlobal(ctx, cfg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
 		return fmt.Errorf("couldn't get keys & manifests: %w", err)
 	}
 
-	// Rotate keys.
+	// Rotate keys & update manifests. Neither operation observes the context,
+	// so the phase's deadline is checked once they complete.
 	log.Info().Msgf("Rotating keys & updating manifests")
 	var newPacketEncryptionKey key.Key
-	if oldPacketEncryptionKey.IsEmpty() || cfg.packetCFG.enableRotation {
+	var newBatchSigningKeyByIngestor map[string]key.Key
+	var newManifestByIngestor map[string]manifest.DataShareProcessorSpecificManifest
+	var newTaskSigningKey key.Key
+	var newIngestorGlobalKey key.Key
+	var newIngestorGlobalManifest manifest.IngestorGlobalManifest
+	if err := runPhase(ctx, cfg.locality, rotatePhase, cfg.timeouts.rotate, func(ctx context.Context) error {
+		var err error
+		switch {
+		case cfg.rollback.appliesTo(rollbackTaskSigningKey, ""):
+			newTaskSigningKey = cfg.rollback.key
+		case cfg.manageTaskSigningKey:
+			if newTaskSigningKey, err = oldTaskSigningKey.Rotate(cfg.now, cfg.taskCFG.rotationCFG); err != nil {
+				return fmt.Errorf("couldn't rotate task signing key for %q: %w", cfg.locality, err)
+			}
+		}
+		newPacketEncryptionKey, newBatchSigningKeyByIngestor, newManifestByIngestor, err = rotateAndUpdateManifests(
+			cfg, oldPacketEncryptionKey, oldBatchSigningKeyByIngestor, newTaskSigningKey, oldManifestByIngestor)
+		if err != nil {
+			return err
+		}
+		if cfg.ingestorGlobal != nil {
+			if newIngestorGlobalKey, newIngestorGlobalManifest, err = rotateIngestorGlobal(cfg, oldIngestorGlobalKey, oldIngestorGlobalManifest); err != nil {
+				return err
+			}
+		}
+		return ctx.Err()
+	}); err != nil {
+		return err
+	}
+
+	// Write keys, then write manifests.
+	// We write keys first so that on failure, we avoid the situation of having
+	// written the public portion of a key to some manifest, while not having
+	// written the associated private key to a secret (which would then be
+	// lost).
+	if err := checkWriteKeysBudget(ctx, time.Now(), cfg.timeouts); err != nil {
+		return err
+	}
+	log.Info().Msgf("Writing keys")
+	if err := runPhase(ctx, cfg.locality, writeKeysPhase, cfg.timeouts.writeKeys, func(ctx context.Context) error {
+		if err := writeKeys(ctx, cfg,
+			oldPacketEncryptionKey, oldBatchSigningKeyByIngestor,
+			newPacketEncryptionKey, newBatchSigningKeyByIngestor); err != nil {
+			return err
+		}
+		if err := writeTaskSigningKey(ctx, cfg, oldTaskSigningKey, newTaskSigningKey); err != nil {
+			return err
+		}
+		if cfg.ingestorGlobal != nil {
+			return writeIngestorGlobalKey(ctx, cfg, oldIngestorGlobalKey, newIngestorGlobalKey)
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("couldn't write keys: %w", err)
+	}
+	if err := runPhase(ctx, cfg.locality, writeManifestsPhase, cfg.timeouts.writeManifests, func(ctx context.Context) error {
+		log.Info().Msgf("Writing manifests")
+		if err := writeManifests(
+			ctx, cfg,
+			oldManifestByIngestor, newManifestByIngestor); err != nil {
+			return manifestError{fmt.Errorf("couldn't write manifests: %w", err)}
+		}
+		if cfg.ingestorGlobal != nil {
+			if err := writeIngestorGlobalManifest(ctx, cfg, oldIngestorGlobalManifest, newIngestorGlobalManifest); err != nil {
+				return manifestError{err}
+			}
+		}
+		if cfg.writeJWKS {
+			log.Info().Msgf("Writing JWKS")
+			if err := writeJWKSByIngestor(ctx, cfg, newManifestByIngestor); err != nil {
+				return manifestError{fmt.Errorf("couldn't write JWKS: %w", err)}
+			}
+		}
+		if cfg.manifestSigning != nil {
+			log.Info().Msgf("Writing manifest signatures")
+			if err := writeManifestSignatures(ctx, cfg,
+				newPacketEncryptionKey, newBatchSigningKeyByIngestor,
+				newTaskSigningKey, newManifestByIngestor); err != nil {
+				return manifestError{fmt.Errorf("couldn't write manifest signatures: %w", err)}
+			}
+		}
+
+		// Publish rotation status, last, so that it is only updated once all
+		// keys & manifests have been written.
+		log.Info().Msgf("Writing rotation status")
+		status, err := manifest.NewRotationStatus(cfg.now, newPacketEncryptionKey, newBatchSigningKeyByIngestor, newManifestByIngestor)
+		if err != nil {
+			return manifestError{fmt.Errorf("couldn't create rotation status for %q: %w", cfg.locality, err)}
+		}
+		if err := cfg.manifestStore.PutRotationStatus(ctx, cfg.locality, status); err != nil {
+			return manifestError{fmt.Errorf("couldn't write rotation status for %q: %w", cfg.locality, err)}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Write public keys, so that infrastructure embedding them can be updated
+	// to match the manifests just written.
+	if cfg.publicKeysFile != "" {
+		log.Info().Msgf("Writing public keys to %q", cfg.publicKeysFile)
+		if err := writePublicKeys(cfg, newPacketEncryptionKey, newBatchSigningKeyByIngestor, newTaskSigningKey, newManifestByIngestor); err != nil {
+			return fmt.Errorf("couldn't write public keys: %w", err)
+		}
+	}
+	return nil
+}
+
+// rotateAndUpdateManifests rotates keys, then updates manifests to match the
+// rotated keys & the (already-rotated) task signing key, which is empty if the
+// task signing key is not managed.
+func rotateAndUpdateManifests(cfg rotateKeysConfig,
+	oldPacketEncryptionKey key.Key, oldBatchSigningKeyByIngestor map[string]key.Key,
+	taskSigningKey key.Key, oldManifestByIngestor map[string]manifest.DataShareProcessorSpecificManifest,
+) (newPacketEncryptionKey key.Key, newBatchSigningKeyByIngestor map[string]key.Key,
+	newManifestByIngestor map[string]manifest.DataShareProcessorSpecificManifest, _ error) {
+	// Rotate keys. Revocation applies even if rotation is disabled. A
+	// rolled-back key is restored in place of being rotated.
+	switch {
+	case cfg.rollback.appliesTo(rollbackPacketEncryptionKey, ""):
+		newPacketEncryptionKey = cfg.rollback.key
+	case cfg.revocation.appliesTo(revokePacketEncryptionKey, ""):
+		k, err := oldPacketEncryptionKey.Revoke(cfg.now, cfg.revocation.creationTimestamp, cfg.packetCFG.rotationCFG)
+		if err != nil {
+			return key.Key{}, nil, nil, fmt.Errorf("couldn't revoke packet encryption key version for %q: %w", cfg.locality, err)
+		}
+		newPacketEncryptionKey = k
+	case oldPacketEncryptionKey.IsEmpty() || cfg.packetCFG.enableRotation:
 		k, err := oldPacketEncryptionKey.Rotate(cfg.now, cfg.packetCFG.rotationCFG)
 		if err != nil {
-			return fmt.Errorf("couldn't rotate packet encryption key for %q: %w", cfg.locality, err)
+			return key.Key{}, nil, nil, fmt.Errorf("couldn't rotate packet encryption key for %q: %w", cfg.locality, err)
 		}
 		newPacketEncryptionKey = k
-	} else {
+	default:
 		log.Info().Str("locality", cfg.locality).Msgf("Skipping rotation of packet encryption key for %q: --packet-encryption-key-enable-rotation set to false", cfg.locality)
 		newPacketEncryptionKey = oldPacketEncryptionKey
 	}
+	newPacketEncryptionKey = newPacketEncryptionKey.WithTryOrder(cfg.packetEncryptionKeyTryOrder)
 
-	newBatchSigningKeyByIngestor := map[string]key.Key{}
+	newBatchSigningKeyByIngestor = map[string]key.Key{}
 	for ingestor, oldKey := range oldBatchSigningKeyByIngestor {
-		if oldKey.IsEmpty() || cfg.batchCFG.enableRotation {
+		switch {
+		case cfg.rollback.appliesTo(rollbackBatchSigningKey, ingestor):
+			newBatchSigningKeyByIngestor[ingestor] = cfg.rollback.key
+		case cfg.revocation.appliesTo(revokeBatchSigningKey, ingestor):
+			newKey, err := oldKey.Revoke(cfg.now, cfg.revocation.creationTimestamp, cfg.batchCFG.rotationCFG)
+			if err != nil {
+				return key.Key{}, nil, nil, fmt.Errorf("couldn't revoke batch signing key version for (%q, %q): %w",
+					cfg.locality, ingestor, err)
+			}
+			newBatchSigningKeyByIngestor[ingestor] = newKey
+		case oldKey.IsEmpty() || cfg.batchCFG.enableRotation:
 			newKey, err := oldKey.Rotate(cfg.now, cfg.batchCFG.rotationCFG)
 			if err != nil {
-				return fmt.Errorf("couldn't rotate batch signing key for (%q, %q): %w",
+				return key.Key{}, nil, nil, fmt.Errorf("couldn't rotate batch signing key for (%q, %q): %w",
 					cfg.locality, ingestor, err)
 			}
 			newBatchSigningKeyByIngestor[ingestor] = newKey
-		} else {
+		default:
 			log.Info().Str("locality", cfg.locality).Str("ingestor", ingestor).Msgf("Skipping rotation of batch signing key for (%q, %q): --batch-signing-key-enable-rotation set to false", cfg.locality, ingestor)
 			newBatchSigningKeyByIngestor[ingestor] = oldKey
 		}
@@ -381,52 +1817,61 @@ func rotateKeys(ctx context.Context, cfg rotateKeysConfig) error {
 	// that a previous run managed to rotate & write some keys but then failed
 	// at updating manifests. By re-evaluating manifests for update we will
 	// re-attempt writing updated manifests on subsequent runs.
-	newManifestByIngestor := map[string]manifest.DataShareProcessorSpecificManifest{}
+	newManifestByIngestor = map[string]manifest.DataShareProcessorSpecificManifest{}
 	for ingestor, oldManifest := range oldManifestByIngestor {
-		newManifest, err := oldManifest.UpdateKeys(manifest.UpdateKeysConfig{
-			BatchSigningKey: newBatchSigningKeyByIngestor[ingestor],
-			BatchSigningKeyIDPrefix: fmt.Sprintf(
-				"%s-%s-%s-batch-signing-key", cfg.prioEnvironment, cfg.locality, ingestor),
-
-			PacketEncryptionKey: newPacketEncryptionKey,
-			PacketEncryptionKeyIDPrefix: fmt.Sprintf(
-				"%s-%s-ingestion-packet-decryption-key", cfg.prioEnvironment, cfg.locality),
-			PacketEncryptionKeyCSRFQDN: cfg.csrFQDN,
-			SkipPreUpdateValidations:   cfg.skipManifestPreUpdateValidations,
-			SkipPostUpdateValidations:  cfg.skipManifestPostUpdateValidations,
-		})
+		updateCFG := cfg.updateKeysConfig(ingestor, newBatchSigningKeyByIngestor[ingestor], newPacketEncryptionKey, taskSigningKey)
+		if cfg.revocation != nil || cfg.rollback != nil {
+			// Pre-update validations require that the manifest's key versions
+			// remain in the keys, which a revoked version doesn't, nor do
+			// versions created since a rolled-back key was written.
+			updateCFG.SkipPreUpdateValidations = true
+		}
+		newManifest, err := oldManifest.UpdateKeys(updateCFG)
 		if err != nil {
-			return fmt.Errorf("couldn't update manifest for (%q, %q): %w",
-				cfg.locality, ingestor, err)
+			return key.Key{}, nil, nil, manifestError{fmt.Errorf("couldn't update manifest for (%q, %q): %w",
+				cfg.locality, ingestor, err)}
 		}
 		newManifestByIngestor[ingestor] = newManifest
 	}
+	return newPacketEncryptionKey, newBatchSigningKeyByIngestor, newManifestByIngestor, nil
+}
 
-	// Write keys, then write manifests.
-	// We write keys first so that on failure, we avoid the situation of having
-	// written the public portion of a key to some manifest, while not having
-	// written the associated private key to a secret (which would then be
-	// lost).
-	log.Info().Msgf("Writing keys")
-	if err := writeKeys(ctx, cfg,
-		oldPacketEncryptionKey, oldBatchSigningKeyByIngestor,
-		newPacketEncryptionKey, newBatchSigningKeyByIngestor); err != nil {
-		return fmt.Errorf("couldn't write keys: %w", err)
-	}
-	log.Info().Msgf("Writing manifests")
-	if err := writeManifests(
-		ctx, cfg,
-		oldManifestByIngestor, newManifestByIngestor); err != nil {
-		return fmt.Errorf("couldn't write manifests: %w", err)
+// updateKeysConfig returns the configuration used to update the given
+// ingestor's manifest to match the given keys.
+func (cfg rotateKeysConfig) updateKeysConfig(ingestor string, batchSigningKey, packetEncryptionKey, taskSigningKey key.Key) manifest.UpdateKeysConfig {
+	return manifest.UpdateKeysConfig{
+		BatchSigningKey: batchSigningKey,
+		BatchSigningKeyIDPrefix: fmt.Sprintf(
+			"%s-%s-%s-batch-signing-key", cfg.prioEnvironment, cfg.locality, ingestor),
+
+		PacketEncryptionKey: packetEncryptionKey,
+		PacketEncryptionKeyIDPrefix: fmt.Sprintf(
+			"%s-%s-ingestion-packet-decryption-key", cfg.prioEnvironment, cfg.locality),
+		PacketEncryptionKeyCSRFQDN: cfg.csrFQDN,
+
+		TaskSigningKey: taskSigningKey,
+		TaskSigningKeyIDPrefix: fmt.Sprintf(
+			"%s-%s-task-signing-key", cfg.prioEnvironment, cfg.locality),
+
+		Now:                       cfg.now,
+		ExpirationRenewalWindow:   cfg.manifestKeyExpirationRenewalWindow,
+		MinimumExpirationValidity: cfg.manifestKeyExpirationMinValidity,
+		BatchSigningKeyExpiration: cfg.batchSigningKeyExpiration,
+
+		SkipPreUpdateValidations:  cfg.skipManifestPreUpdateValidations,
+		SkipPostUpdateValidations: cfg.skipManifestPostUpdateValidations,
+
+		Rand: cfg.rand,
 	}
-	return nil
 }
 
 func readKeysAndManifests(
 	ctx context.Context, keyStore storage.Key,
 	manifestStore storage.Manifest, locality string, ingestors []string,
 ) (packetEncryptionKey key.Key, batchSigningKeyByIngestor map[string]key.Key,
-	manifestByIngestor map[string]manifest.DataShareProcessorSpecificManifest, _ error) {
+	manifestByIngestor map[string]manifest.DataShareProcessorSpecificManifest, err error) {
+	ctx, span := startSpan(ctx, "readKeysAndManifests", attribute.String("locality", locality))
+	defer func() { storage.EndSpan(span, err) }()
 	eg, ctx := errgroup.WithContext(ctx)
 	var mu sync.Mutex                                                             // protects packetEncryptionKey, batchSigningKeyByIngestor, manifestByIngestor
 	batchSigningKeyByIngestor = map[string]key.Key{}                              // ingestor -> batch signing key
@@ -482,11 +1927,15 @@ func readKeysAndManifests(
 
 func writeKeys(ctx context.Context, cfg rotateKeysConfig,
 	oldPacketEncryptionKey key.Key, oldBatchSigningKeyByIngestor map[string]key.Key,
-	newPacketEncryptionKey key.Key, newBatchSigningKeyByIngestor map[string]key.Key) error {
+	newPacketEncryptionKey key.Key, newBatchSigningKeyByIngestor map[string]key.Key) (err error) {
+	ctx, span := startSpan(ctx, "writeKeys", attribute.String("locality", cfg.locality))
+	defer func() { storage.EndSpan(span, err) }()
 	eg, ctx := errgroup.WithContext(ctx)
 
 	// Write packet encryption key.
-	eg.Go(func() error {
+	eg.Go(func() (err error) {
+		ctx, span := startSpan(ctx, "writePacketEncryptionKey", attribute.String("locality", cfg.locality))
+		defer func() { storage.EndSpan(span, err) }()
 		if !cfg.packetCFG.alwaysWrite && oldPacketEncryptionKey.Equal(newPacketEncryptionKey) {
 			log.Debug().Str("locality", cfg.locality).Msgf("Skipping write for packet encryption key for %q: key unchanged", cfg.locality)
 			return nil
@@ -501,14 +1950,19 @@ func writeKeys(ctx context.Context, cfg rotateKeysConfig,
 		if err := cfg.keyStore.PutPacketEncryptionKey(ctx, cfg.locality, newPacketEncryptionKey); err != nil {
 			return fmt.Errorf("couldn't write packet encryption key for %q: %w", cfg.locality, err)
 		}
-		keysWritten.Inc()
+		keysWritten.WithLabelValues(cfg.locality, "", packetEncryptionKeyKind).Inc()
+		recordKeyVersionChanges(ctx, cfg.locality, packetEncryptionKeyKind, oldPacketEncryptionKey, newPacketEncryptionKey)
+		cfg.notifier.notify(ctx, keyEvents(packetEncryptionKeyKind, cfg.locality, "", oldPacketEncryptionKey, newPacketEncryptionKey)...)
+		cfg.report.addKey(packetEncryptionKeyKind, cfg.locality, "", oldPacketEncryptionKey, newPacketEncryptionKey)
 		return nil
 	})
 
 	// Write batch signing keys.
 	for ingestor, oldKey := range oldBatchSigningKeyByIngestor {
 		ingestor, oldKey, newKey := ingestor, oldKey, newBatchSigningKeyByIngestor[ingestor]
-		eg.Go(func() error {
+		eg.Go(func() (err error) {
+			ctx, span := startSpan(ctx, "writeBatchSigningKey", attribute.String("locality", cfg.locality), attribute.String("ingestor", ingestor))
+			defer func() { storage.EndSpan(span, err) }()
 			if !cfg.batchCFG.alwaysWrite && oldKey.Equal(newKey) {
 				log.Debug().Str("locality", cfg.locality).Str("ingestor", ingestor).Msgf("Skipping write for batch signing key for (%q, %q): key unchanged", cfg.locality, ingestor)
 				return nil
@@ -523,7 +1977,10 @@ func writeKeys(ctx context.Context, cfg rotateKeysConfig,
 			if err := cfg.keyStore.PutBatchSigningKey(ctx, cfg.locality, ingestor, newKey); err != nil {
 				return fmt.Errorf("couldn't write batch signing key for (%q, %q): %w", cfg.locality, ingestor, err)
 			}
-			keysWritten.Inc()
+			keysWritten.WithLabelValues(cfg.locality, ingestor, batchSigningKeyKind).Inc()
+			recordKeyVersionChanges(ctx, cfg.locality, batchSigningKeyKind, oldKey, newKey)
+			cfg.notifier.notify(ctx, keyEvents(batchSigningKeyKind, cfg.locality, ingestor, oldKey, newKey)...)
+			cfg.report.addKey(batchSigningKeyKind, cfg.locality, ingestor, oldKey, newKey)
 			return nil
 		})
 	}
@@ -531,23 +1988,69 @@ func writeKeys(ctx context.Context, cfg rotateKeysConfig,
 	return eg.Wait()
 }
 
+// writeTaskSigningKey writes the task signing key, if it is managed and has
+// changed.
+func writeTaskSigningKey(ctx context.Context, cfg rotateKeysConfig, oldKey, newKey key.Key) error {
+	if !cfg.manageTaskSigningKey {
+		return nil
+	}
+	if oldKey.Equal(newKey) {
+		log.Debug().Str("locality", cfg.locality).Msgf("Skipping write for task signing key for %q: key unchanged", cfg.locality)
+		return nil
+	}
+	log.Info().Str("locality", cfg.locality).Msgf("Writing task signing key for %q because: %s", cfg.locality, newKey.Diff(oldKey))
+	if err := cfg.keyStore.PutTaskSigningKey(ctx, cfg.locality, newKey); err != nil {
+		return fmt.Errorf("couldn't write task signing key for %q: %w", cfg.locality, err)
+	}
+	keysWritten.WithLabelValues(cfg.locality, "", taskSigningKeyKind).Inc()
+	recordKeyVersionChanges(ctx, cfg.locality, taskSigningKeyKind, oldKey, newKey)
+	cfg.notifier.notify(ctx, keyEvents(taskSigningKeyKind, cfg.locality, "", oldKey, newKey)...)
+	cfg.report.addKey(taskSigningKeyKind, cfg.locality, "", oldKey, newKey)
+	return nil
+}
+
 func writeManifests(
 	ctx context.Context, cfg rotateKeysConfig,
-	oldManifestByIngestor, newManifestByIngestor map[string]manifest.DataShareProcessorSpecificManifest) error {
+	oldManifestByIngestor, newManifestByIngestor map[string]manifest.DataShareProcessorSpecificManifest) (err error) {
+	ctx, span := startSpan(ctx, "writeManifests", attribute.String("locality", cfg.locality))
+	defer func() { storage.EndSpan(span, err) }()
 	eg, ctx := errgroup.WithContext(ctx)
 
 	for ingestor, oldManifest := range oldManifestByIngestor {
 		ingestor, oldManifest, newManifest := ingestor, oldManifest, newManifestByIngestor[ingestor]
-		eg.Go(func() error {
+		eg.Go(func() (err error) {
+			ctx, span := startSpan(ctx, "writeManifest", attribute.String("locality", cfg.locality), attribute.String("ingestor", ingestor))
+			defer func() { storage.EndSpan(span, err) }()
 			if oldManifest.Equal(newManifest) {
 				log.Debug().Str("locality", cfg.locality).Str("ingestor", ingestor).Msgf("Skipping write for manifest for (%q, %q): key unchanged", cfg.locality, ingestor)
 				return nil
 			}
-			log.Info().Str("locality", cfg.locality).Str("ingestor", ingestor).Msgf("Writing manifest for (%q, %q): %s", cfg.locality, ingestor, newManifest.Diff(oldManifest))
+			diff := newManifest.Diff(oldManifest)
+			event := manifestHookEvent{
+				ManifestName: dspName(cfg.locality, ingestor),
+				Locality:     cfg.locality,
+				Ingestor:     ingestor,
+				Diff:         diff,
+				OldManifest:  oldManifest,
+				NewManifest:  newManifest,
+			}
+			if err := cfg.manifestHooks.beforeWrite(ctx, event); err != nil {
+				return fmt.Errorf("couldn't write manifest for (%q, %q): %w", cfg.locality, ingestor, err)
+			}
+			log.Info().Str("locality", cfg.locality).Str("ingestor", ingestor).Msgf("Writing manifest for (%q, %q): %s", cfg.locality, ingestor, diff)
 			if err := cfg.manifestStore.PutDataShareProcessorSpecificManifest(ctx, dspName(cfg.locality, ingestor), newManifest); err != nil {
 				return fmt.Errorf("couldn't write manifest for (%q, %q): %w", cfg.locality, ingestor, err)
 			}
-			manifestsWritten.Inc()
+			manifestsWritten.WithLabelValues(cfg.locality, ingestor).Inc()
+			cfg.manifestHooks.afterWrite(ctx, event)
+			cfg.notifier.notify(ctx, rotationEvent{
+				Event:        manifestChangedEvent,
+				Locality:     cfg.locality,
+				Ingestor:     ingestor,
+				ManifestName: event.ManifestName,
+				Diff:         diff,
+			})
+			cfg.report.addManifest(cfg.locality, ingestor, event.ManifestName, diff)
 			return nil
 		})
 	}
@@ -555,13 +2058,140 @@ func writeManifests(
 	return eg.Wait()
 }
 
+// writeJWKSByIngestor writes the batch signing public keys published in each ingestor's
+// manifest as a JSON Web Key Set alongside the manifest. Key sets are written
+// on every rotation, whether or not the manifest changed, so that they are
+// written for existing manifests once cfg.writeJWKS is enabled.
+func writeJWKSByIngestor(ctx context.Context, cfg rotateKeysConfig, manifestByIngestor map[string]manifest.DataShareProcessorSpecificManifest) error {
+	for ingestor, m := range manifestByIngestor {
+		jwks, err := m.BatchSigningJWKS()
+		if err != nil {
+			return fmt.Errorf("couldn't create JWKS for (%q, %q): %w", cfg.locality, ingestor, err)
+		}
+		if err := cfg.manifestStore.PutJWKS(ctx, dspName(cfg.locality, ingestor), jwks); err != nil {
+			return fmt.Errorf("couldn't write JWKS for (%q, %q): %w", cfg.locality, ingestor, err)
+		}
+	}
+	return nil
+}
+
+// writePublicKeys writes the key IDs & public keys of the primary key versions
+// published in each ingestor's manifest to cfg.publicKeysFile, as a JSON
+// object mapping "${locality}-${ingestor}.${field}" (e.g.
+// "us-ca-apple.batch-signing-public-key") to the field's value. A Terraform
+// external data source requires a flat object of strings. The file is
+// replaced atomically, so that readers never observe a partial write.
+func writePublicKeys(cfg rotateKeysConfig,
+	packetEncryptionKey key.Key, batchSigningKeyByIngestor map[string]key.Key,
+	taskSigningKey key.Key, manifestByIngestor map[string]manifest.DataShareProcessorSpecificManifest) error {
+	publicKeys := map[string]string{}
+	for ingestor, m := range manifestByIngestor {
+		fields, err := m.PublicKeys(cfg.updateKeysConfig(ingestor, batchSigningKeyByIngestor[ingestor], packetEncryptionKey, taskSigningKey))
+		if err != nil {
+			return fmt.Errorf("couldn't get public keys from manifest for (%q, %q): %w", cfg.locality, ingestor, err)
+		}
+		for field, value := range fields {
+			publicKeys[fmt.Sprintf("%s.%s", dspName(cfg.locality, ingestor), field)] = value
+		}
+	}
+	publicKeysBytes, err := json.MarshalIndent(publicKeys, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't marshal public keys as JSON: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(cfg.publicKeysFile), filepath.Base(cfg.publicKeysFile)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("couldn't create temporary file: %w", err)
+	}
+	defer os.Remove(f.Name()) // no-op once renamed
+	if _, err := f.Write(publicKeysBytes); err != nil {
+		f.Close()
+		return fmt.Errorf("couldn't write %q: %w", f.Name(), err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("couldn't close %q: %w", f.Name(), err)
+	}
+	if err := os.Rename(f.Name(), cfg.publicKeysFile); err != nil {
+		return fmt.Errorf("couldn't rename %q to %q: %w", f.Name(), cfg.publicKeysFile, err)
+	}
+	return nil
+}
+
+// Values of the "kind" label of the key_rotator_keys_written metric.
+const (
+	packetEncryptionKeyKind = "packet-encryption-key"
+	batchSigningKeyKind     = "batch-signing-key"
+	taskSigningKeyKind      = "task-signing-key"
+)
+
+// kubernetesServiceAccountTokenPath is the path at which Kubernetes mounts the
+// pod's service account token, used to log in to Vault.
+const kubernetesServiceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// tlsVersions maps the accepted values of --min-tls-version to TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// indexOfString returns the index of the first occurrence of str in strs, or
+// -1 if str is not present.
+func indexOfString(strs []string, str string) int {
+	for i, s := range strs {
+		if s == str {
+			return i
+		}
+	}
+	return -1
+}
+
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+// newKeyFunc returns a function creating keys of the given type from
+// randomness read from rnd, for use as a key.RotationConfig's CreateKeyFunc.
+func newKeyFunc(t key.Type, rnd io.Reader) func() (key.Material, error) {
+	return func() (key.Material, error) { return t.NewFrom(rnd) }
+}
+
+// newKMSKeyFunc returns a function creating keys in the given KMS, for use as
+// a key.RotationConfig's CreateKeyFunc.
+func newKMSKeyFunc(ctx context.Context, kms key.KMS) func() (key.Material, error) {
+	return func() (key.Material, error) { return key.NewKMSMaterial(ctx, kms) }
+}
+
+// lockedReader serializes reads from an io.Reader which is not safe for
+// concurrent use, such as a math/rand.Rand, for use when rotating localities
+// concurrently.
+type lockedReader struct {
+	mu sync.Mutex
+	r  io.Reader
+}
+
+func (r *lockedReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.Read(p)
+}
+
 func dspName(locality, ingestor string) string { return fmt.Sprintf("%s-%s", locality, ingestor) }
 
 func fail(format string, v ...interface{}) {
-	lastFailure.SetToCurrentTime()
+	for _, locality := range failingLocalities {
+		lastFailure.WithLabelValues(locality).SetToCurrentTime()
+	}
 	if err := tryPushMetrics(); err != nil {
 		log.Error().Msgf("Couldn't push metrics while failing: %v", err)
 	}
+	if err := tryFlushTraces(); err != nil {
+		log.Error().Msgf("Couldn't flush traces while failing: %v", err)
+	}
 	log.Fatal().Msgf(format, v...)
 }
 
@@ -587,8 +2217,8 @@ func semicolonJoin(vals ...string) string {
 	return sb.String()
 }
 
-// dryRunKeyStore logs (but otherwise ignores) puts, and allows gets by
-// deferring to the internal storage.Key's implementation.
+// dryRunKeyStore logs (but otherwise ignores) puts & deletes, and allows gets
+// by deferring to the internal storage.Key's implementation.
 type dryRunKeyStore struct{ k storage.Key }
 
 var _ storage.Key = dryRunKeyStore{}
@@ -603,6 +2233,11 @@ func (dryRunKeyStore) PutPacketEncryptionKey(_ context.Context, locality string,
 	return nil
 }
 
+func (dryRunKeyStore) PutTaskSigningKey(_ context.Context, locality string, _ key.Key) error {
+	log.Info().Msgf("DRY RUN: would have written task signing key for %q", locality)
+	return nil
+}
+
 func (k dryRunKeyStore) GetBatchSigningKey(ctx context.Context, locality, ingestor string) (key.Key, error) {
 	return k.k.GetBatchSigningKey(ctx, locality, ingestor)
 }
@@ -611,8 +2246,51 @@ func (k dryRunKeyStore) GetPacketEncryptionKey(ctx context.Context, locality str
 	return k.k.GetPacketEncryptionKey(ctx, locality)
 }
 
-// dryRunManifestStore logs (but otherwise ignores) puts, and allows gets by
-// deferring to the internal storage.Manifest's implementation.
+func (k dryRunKeyStore) GetTaskSigningKey(ctx context.Context, locality string) (key.Key, error) {
+	return k.k.GetTaskSigningKey(ctx, locality)
+}
+
+func (dryRunKeyStore) DeleteKeys(_ context.Context, locality string, _ []string) error {
+	log.Info().Msgf("DRY RUN: would have deleted keys for %q", locality)
+	return nil
+}
+
+// dryRunKMS logs (but otherwise ignores) key creation, creating a local P256
+// key in place of each KMS key, whose private portion is discarded.
+type dryRunKMS struct {
+	rnd io.Reader
+
+	mu   sync.Mutex               // protects pubs
+	pubs map[string]key.PublicKey // by reference
+}
+
+var _ key.KMS = &dryRunKMS{}
+
+func (k *dryRunKMS) CreateKey(context.Context) (string, error) {
+	m, err := key.P256.NewFrom(k.rnd)
+	if err != nil {
+		return "", err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	ref := fmt.Sprintf("dry-run-%d", len(k.pubs))
+	k.pubs[ref] = m.Public()
+	log.Info().Msgf("DRY RUN: would have created KMS key (using %q)", ref)
+	return ref, nil
+}
+
+func (k *dryRunKMS) PublicKey(_ context.Context, ref string) (crypto.PublicKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	pub, ok := k.pubs[ref]
+	if !ok {
+		return nil, fmt.Errorf("no dry-run KMS key %q", ref)
+	}
+	return pub, nil
+}
+
+// dryRunManifestStore logs (but otherwise ignores) puts & deletes, and allows
+// gets by deferring to the internal storage.Manifest's implementation.
 type dryRunManifestStore struct{ m storage.Manifest }
 
 var _ storage.Manifest = dryRunManifestStore{}
@@ -622,6 +2300,16 @@ func (dryRunManifestStore) PutDataShareProcessorSpecificManifest(_ context.Conte
 	return nil
 }
 
+func (dryRunManifestStore) PutJWKS(_ context.Context, dataShareProcessorName string, _ manifest.JSONWebKeySet) error {
+	log.Info().Msgf("DRY RUN: would have written JWKS for %q", dataShareProcessorName)
+	return nil
+}
+
+func (dryRunManifestStore) PutManifestSignature(_ context.Context, dataShareProcessorName string, _ manifest.Signature) error {
+	log.Info().Msgf("DRY RUN: would have written manifest signature for %q", dataShareProcessorName)
+	return nil
+}
+
 func (dryRunManifestStore) PutIngestorGlobalManifest(context.Context, manifest.IngestorGlobalManifest) error {
 	log.Info().Msgf("DRY RUN: would have written global manifest")
 	return nil
@@ -634,3 +2322,30 @@ func (m dryRunManifestStore) GetDataShareProcessorSpecificManifest(ctx context.C
 func (m dryRunManifestStore) GetIngestorGlobalManifest(ctx context.Context) (manifest.IngestorGlobalManifest, error) {
 	return m.m.GetIngestorGlobalManifest(ctx)
 }
+
+func (m dryRunManifestStore) GetManifestSignature(ctx context.Context, dataShareProcessorName string) (manifest.Signature, error) {
+	return m.m.GetManifestSignature(ctx, dataShareProcessorName)
+}
+
+func (m dryRunManifestStore) GetDataShareProcessorSpecificManifestVersion(ctx context.Context, dataShareProcessorName string) (string, error) {
+	return m.m.GetDataShareProcessorSpecificManifestVersion(ctx, dataShareProcessorName)
+}
+
+func (m dryRunManifestStore) ListDataShareProcessorSpecificManifests(ctx context.Context) ([]string, error) {
+	return m.m.ListDataShareProcessorSpecificManifests(ctx)
+}
+
+func (dryRunManifestStore) PutRotationStatus(_ context.Context, locality string, _ manifest.RotationStatus) error {
+	log.Info().Msgf("DRY RUN: would have written rotation status for %q", locality)
+	return nil
+}
+
+func (dryRunManifestStore) DeleteDataShareProcessorSpecificManifest(_ context.Context, dataShareProcessorName string) error {
+	log.Info().Msgf("DRY RUN: would have deleted manifest for %q", dataShareProcessorName)
+	return nil
+}
+
+func (dryRunManifestStore) DeleteRotationStatus(_ context.Context, locality string) error {
+	log.Info().Msgf("DRY RUN: would have deleted rotation status for %q", locality)
+	return nil
+}
@@ -1,15 +1,44 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/abetterinternet/prio-server/key-rotator/key"
 	keytest "github.com/abetterinternet/prio-server/key-rotator/key/test"
 	"github.com/abetterinternet/prio-server/key-rotator/manifest"
+	"github.com/abetterinternet/prio-server/key-rotator/storage"
 	storagetest "github.com/abetterinternet/prio-server/key-rotator/storage/test"
+	k8sapi "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	k8swatch "k8s.io/apimachinery/pkg/watch"
+	k8s "k8s.io/client-go/kubernetes/typed/core/v1"
 )
 
 var ctx = context.Background()
@@ -518,174 +547,3170 @@ func TestRotateKeys(t *testing.T) {
 					t.Errorf("Missing expected manifest for %q", dsp)
 				}
 			}
+
+			// Verify rotation status.
+			gotStatuses := manifestStore.GetRotationStatuses()
+			for loc, wantPEKVers := range test.postPEKVersions {
+				gotStatus, ok := gotStatuses[loc]
+				if !ok {
+					t.Errorf("Missing expected rotation status for %q", loc)
+					continue
+				}
+				if got, want := gotStatus.PacketEncryptionKey.VersionCount, len(wantPEKVers); got != want {
+					t.Errorf("Rotation status for %q has packet encryption key version count %d, want %d", loc, got, want)
+				}
+				for li := range test.postManifestInfo {
+					if li.Locality != loc {
+						continue
+					}
+					wantDigest, err := manifestDigest(gotManifests[liToDSP(li)])
+					if err != nil {
+						t.Fatalf("Couldn't compute digest of manifest for %q: %v", liToDSP(li), err)
+					}
+					if gotDigest := gotStatus.ManifestDigests[li.Ingestor]; gotDigest != wantDigest {
+						t.Errorf("Rotation status for %q has manifest digest %q for %q, want %q", loc, gotDigest, li.Ingestor, wantDigest)
+					}
+				}
+			}
 		})
 	}
 }
 
-// keyStore creates a keystore with the given batch signing/packet encryption
-// key versions, specified as a map from (locality, ingestor) or locality
-// (respectively) to versions identified by UNIX second timestamps.
-func keyStore(bskVersions map[LI][]int64, pekVersions map[string][]int64) *storagetest.Key {
-	ks := storagetest.NewKey()
+func TestRotateKeysTaskSigningKey(t *testing.T) {
+	t.Parallel()
 
-	bsks := ks.BatchSigningKeys()
-	for li, vers := range bskVersions {
-		bsks[li] = bsk(li, vers...)
+	tskKID := func(ts int64) string { return fmt.Sprintf("prio-env-asgard-task-signing-key-%d", ts) }
+	newCFG := func(keyStore *storagetest.Key, manifestStore *storagetest.Manifest) rotateKeysConfig {
+		stableCFG := rotateKeyConfig{rotationCFG: key.RotationConfig{
+			CreateKeyFunc:     key.P256.New,
+			CreateMinAge:      10000 * time.Second,
+			PrimaryMinAge:     1000 * time.Second,
+			DeleteMinAge:      20000 * time.Second,
+			DeleteMinKeyCount: 2,
+		}}
+		return rotateKeysConfig{
+			keyStore:             keyStore,
+			manifestStore:        manifestStore,
+			now:                  time.Unix(100000, 0),
+			locality:             "asgard",
+			ingestors:            []string{"ingestor-1"},
+			prioEnvironment:      "prio-env",
+			csrFQDN:              "some.fqdn",
+			batchCFG:             stableCFG,
+			packetCFG:            stableCFG,
+			manageTaskSigningKey: true,
+			taskCFG:              stableCFG,
+		}
 	}
-
-	peks := ks.PacketEncryptionKeys()
-	for loc, vers := range pekVersions {
-		peks[loc] = pek(loc, vers...)
+	newStores := func() (*storagetest.Key, *storagetest.Manifest) {
+		ks := keyStore(map[LI][]int64{li("asgard", "ingestor-1"): {99600}}, map[string][]int64{"asgard": {99500}})
+		ms := manifestStore(map[LI]manifestInfo{li("asgard", "ingestor-1"): {
+			batchSigningKeyVersions:     []int64{99600},
+			packetEncryptionKeyVersions: []int64{99500},
+		}})
+		return ks, ms
 	}
 
-	return ks
-}
+	t.Run("rotate", func(t *testing.T) {
+		t.Parallel()
+		keyStore, manifestStore := newStores()
+		preTSK, err := key.FromVersions(key.Version{KeyMaterial: keytest.Material(tskKID(80000)), CreationTimestamp: 80000})
+		if err != nil {
+			t.Fatalf("Couldn't create task signing key: %v", err)
+		}
+		if err := keyStore.PutTaskSigningKey(ctx, "asgard", preTSK); err != nil {
+			t.Fatalf("Couldn't store task signing key: %v", err)
+		}
 
-// manifestStore creates a manifest store with the given manifests, specified
-// as a map from data-share processor (i.e. locality & ingestor) to
-// manifestInfo.
-func manifestStore(manifestInfos map[LI]manifestInfo) *storagetest.Manifest {
-	m := storagetest.NewManifest()
-	ms := m.GetDataShareProcessorSpecificManifests()
-	for li, info := range manifestInfos {
-		bsks := manifest.BatchSigningPublicKeys{}
-		for _, ts := range info.batchSigningKeyVersions {
-			kid := bskKID(li, ts)
-			pkix, err := keytest.Material(kid).PublicAsPKIX()
-			if err != nil {
-				panic(fmt.Sprintf("Couldn't serialize key material as PKIX: %v", err))
-			}
-			bsks[kid] = manifest.BatchSigningPublicKey{PublicKey: pkix}
+		if err := rotateKeys(ctx, newCFG(keyStore, manifestStore)); err != nil {
+			t.Fatalf("Unexpected error from rotateKeys: %v", err)
 		}
-		peks := manifest.PacketEncryptionKeyCSRs{}
-		for _, ts := range info.packetEncryptionKeyVersions {
-			kid := pekKID(li.Locality, ts)
-			csr, err := keytest.Material(kid).PublicAsCSR("some.fqdn")
-			if err != nil {
-				panic(fmt.Sprintf("Couldn't serialize key material as CSR: %v", err))
+
+		// The task signing key is old enough that a new version should have
+		// been created, but not yet made primary.
+		gotTSK := keyStore.TaskSigningKeys()["asgard"]
+		gotVers := keyToVersionMap(gotTSK)
+		if len(gotVers) != 2 {
+			t.Errorf("Task signing key has %d versions, want 2", len(gotVers))
+		}
+		if _, ok := gotVers[100000]; !ok {
+			t.Errorf("Task signing key missing new version 100000")
+		}
+		if gotVer, ok := gotVers[80000]; !ok || !gotVer.KeyMaterial.Equal(preTSK.Primary().KeyMaterial) {
+			t.Errorf("Task signing key missing, or changed key material of, version 80000")
+		}
+		if got, want := gotTSK.Primary().CreationTimestamp, int64(80000); got != want {
+			t.Errorf("Task signing key has primary version %d, want %d", got, want)
+		}
+
+		// The manifest should publish every task signing key version.
+		m := manifestStore.GetDataShareProcessorSpecificManifests()["asgard-ingestor-1"]
+		for _, ts := range []int64{80000, 100000} {
+			if _, ok := m.TaskSigningPublicKeys[tskKID(ts)]; !ok {
+				t.Errorf("Manifest missing task signing public key %q", tskKID(ts))
 			}
-			peks[kid] = manifest.PacketEncryptionCertificate{CertificateSigningRequest: csr}
 		}
-		ms[liToDSP(li)] = manifest.DataShareProcessorSpecificManifest{
-			Format:                  1,
-			IngestionIdentity:       "ingestion-identity",
-			IngestionBucket:         "ingestion-bucket",
-			PeerValidationIdentity:  "peer-validation-identity",
-			PeerValidationBucket:    "peer-validation-bucket",
-			BatchSigningPublicKeys:  bsks,
-			PacketEncryptionKeyCSRs: peks,
+		if got, want := len(m.TaskSigningPublicKeys), 2; got != want {
+			t.Errorf("Manifest has %d task signing public keys, want %d", got, want)
 		}
-	}
-	return m
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		t.Parallel()
+		keyStore, manifestStore := newStores()
+
+		if err := rotateKeys(ctx, newCFG(keyStore, manifestStore)); err == nil {
+			t.Errorf("Wanted error from rotateKeys with no stored task signing key, got none")
+		}
+		if got := manifestStore.GetDataShareProcessorSpecificManifestPutCount("asgard-ingestor-1"); got != 0 {
+			t.Errorf("Manifest written %d times despite error, want 0", got)
+		}
+	})
 }
 
-// bsk creates a batch signing key with the given timestamps. Key material is
-// arbitrary, but will match that of other batch signing keys at the same
-// timestamp, locality, & ingestor, and will very likely not match other
-// key materials. If timestamps are provided, the first timestamp is used as
-// the primary key version.
-func bsk(li LI, tss ...int64) key.Key {
-	if len(tss) == 0 {
-		return key.Key{}
-	}
-	var vs []key.Version
-	for _, ts := range tss {
-		vs = append(vs, key.Version{
-			KeyMaterial:       keytest.Material(bskKID(li, ts)),
-			CreationTimestamp: ts,
-		})
+func TestRotateKeysPublicKeysFile(t *testing.T) {
+	t.Parallel()
+
+	stableCFG := rotateKeyConfig{rotationCFG: key.RotationConfig{
+		CreateKeyFunc:     key.P256.New,
+		CreateMinAge:      10000 * time.Second,
+		PrimaryMinAge:     1000 * time.Second,
+		DeleteMinAge:      20000 * time.Second,
+		DeleteMinKeyCount: 2,
+	}}
+	ks := keyStore(map[LI][]int64{li("asgard", "ingestor-1"): {99600, 99000}}, map[string][]int64{"asgard": {99500}})
+	ms := manifestStore(map[LI]manifestInfo{li("asgard", "ingestor-1"): {
+		batchSigningKeyVersions:     []int64{99600, 99000},
+		packetEncryptionKeyVersions: []int64{99500},
+	}})
+	publicKeysFile := filepath.Join(t.TempDir(), "public-keys.json")
+	if err := rotateKeys(ctx, rotateKeysConfig{
+		keyStore:        ks,
+		manifestStore:   ms,
+		now:             time.Unix(100000, 0),
+		locality:        "asgard",
+		ingestors:       []string{"ingestor-1"},
+		prioEnvironment: "prio-env",
+		csrFQDN:         "some.fqdn",
+		batchCFG:        stableCFG,
+		packetCFG:       stableCFG,
+		publicKeysFile:  publicKeysFile,
+	}); err != nil {
+		t.Fatalf("Unexpected error from rotateKeys: %v", err)
 	}
-	k, err := key.FromVersions(vs[0], vs[1:]...)
+
+	publicKeysBytes, err := os.ReadFile(publicKeysFile)
 	if err != nil {
-		panic(fmt.Sprintf("Couldn't create key: %v", err))
+		t.Fatalf("Couldn't read public keys file: %v", err)
+	}
+	var gotPublicKeys map[string]string
+	if err := json.Unmarshal(publicKeysBytes, &gotPublicKeys); err != nil {
+		t.Fatalf("Couldn't parse public keys file as a JSON object of strings: %v", err)
+	}
+	m := ms.GetDataShareProcessorSpecificManifests()["asgard-ingestor-1"]
+	bskID, pekID := bskKID(li("asgard", "ingestor-1"), 99600), pekKID("asgard", 99500)
+	wantPublicKeys := map[string]string{
+		"asgard-ingestor-1.batch-signing-key-id":      bskID,
+		"asgard-ingestor-1.batch-signing-public-key":  m.BatchSigningPublicKeys[bskID].PublicKey,
+		"asgard-ingestor-1.packet-encryption-key-id":  pekID,
+		"asgard-ingestor-1.packet-encryption-key-csr": m.PacketEncryptionKeyCSRs[pekID].CertificateSigningRequest,
+	}
+	if diff := cmp.Diff(wantPublicKeys, gotPublicKeys); diff != "" {
+		t.Errorf("Unexpected public keys (-want +got):\n%s", diff)
 	}
-	return k
 }
 
-// pek creates a packet encryption key with the given timestamps. Key material
-// is arbitrary, but will match that of other packet encryption keys at the
-// same timestamp & locality, and will very likely not match other key
-// materials. If timestamps are provided, the first timestamp is used as the
-// primary key version.
-func pek(locality string, tss ...int64) key.Key {
-	if len(tss) == 0 {
-		return key.Key{}
+func TestRotateKeysJWKS(t *testing.T) {
+	t.Parallel()
+
+	stableCFG := rotateKeyConfig{rotationCFG: key.RotationConfig{
+		CreateKeyFunc:     key.P256.New,
+		CreateMinAge:      10000 * time.Second,
+		PrimaryMinAge:     1000 * time.Second,
+		DeleteMinAge:      20000 * time.Second,
+		DeleteMinKeyCount: 2,
+	}}
+	ks := keyStore(map[LI][]int64{li("asgard", "ingestor-1"): {99600, 99000}}, map[string][]int64{"asgard": {99500}})
+	ms := manifestStore(map[LI]manifestInfo{li("asgard", "ingestor-1"): {
+		batchSigningKeyVersions:     []int64{99600, 99000},
+		packetEncryptionKeyVersions: []int64{99500},
+	}})
+	if err := rotateKeys(ctx, rotateKeysConfig{
+		keyStore:        ks,
+		manifestStore:   ms,
+		now:             time.Unix(100000, 0),
+		locality:        "asgard",
+		ingestors:       []string{"ingestor-1"},
+		prioEnvironment: "prio-env",
+		csrFQDN:         "some.fqdn",
+		batchCFG:        stableCFG,
+		packetCFG:       stableCFG,
+		writeJWKS:       true,
+	}); err != nil {
+		t.Fatalf("Unexpected error from rotateKeys: %v", err)
 	}
-	var vs []key.Version
-	for _, ts := range tss {
-		vs = append(vs, key.Version{
-			KeyMaterial:       keytest.Material(pekKID(locality, ts)),
-			CreationTimestamp: ts,
-		})
+
+	// The manifest is unchanged, but its JWKS is written anyway.
+	if got := ms.GetDataShareProcessorSpecificManifestPutCount("asgard-ingestor-1"); got != 0 {
+		t.Errorf("Manifest was written %d times, want 0", got)
 	}
-	k, err := key.FromVersions(vs[0], vs[1:]...)
-	if err != nil {
-		panic(fmt.Sprintf("Couldn't create key: %v", err))
+	jwks, ok := ms.GetJWKS()["asgard-ingestor-1"]
+	if !ok {
+		t.Fatalf("No JWKS was written for asgard-ingestor-1")
+	}
+	var gotKIDs []string
+	for _, jwk := range jwks.Keys {
+		gotKIDs = append(gotKIDs, jwk.KeyID)
+	}
+	wantKIDs := []string{bskKID(li("asgard", "ingestor-1"), 99000), bskKID(li("asgard", "ingestor-1"), 99600)}
+	if diff := cmp.Diff(wantKIDs, gotKIDs); diff != "" {
+		t.Errorf("Unexpected JWKS key IDs (-want +got):\n%s", diff)
 	}
-	return k
 }
 
-func bskKID(li LI, ts int64) string {
-	if ts == 0 {
-		return fmt.Sprintf("prio-env-%s-%s-batch-signing-key", li.Locality, li.Ingestor)
+func TestRotateKeysManifestSigning(t *testing.T) {
+	t.Parallel()
+
+	stableCFG := rotateKeyConfig{rotationCFG: key.RotationConfig{
+		CreateKeyFunc:     key.P256.New,
+		CreateMinAge:      10000 * time.Second,
+		PrimaryMinAge:     1000 * time.Second,
+		DeleteMinAge:      20000 * time.Second,
+		DeleteMinKeyCount: 2,
+	}}
+	newCFG := func(ms storage.Manifest, signing *manifestSigningConfig) rotateKeysConfig {
+		return rotateKeysConfig{
+			keyStore:        keyStore(map[LI][]int64{li("asgard", "ingestor-1"): {99600, 99000}}, map[string][]int64{"asgard": {99500}}),
+			manifestStore:   ms,
+			now:             time.Unix(100000, 0),
+			locality:        "asgard",
+			ingestors:       []string{"ingestor-1"},
+			prioEnvironment: "prio-env",
+			csrFQDN:         "some.fqdn",
+			batchCFG:        stableCFG,
+			packetCFG:       stableCFG,
+			manifestSigning: signing,
+		}
 	}
-	return fmt.Sprintf("prio-env-%s-%s-batch-signing-key-%d", li.Locality, li.Ingestor, ts)
+	newManifestStore := func() *storagetest.Manifest {
+		return manifestStore(map[LI]manifestInfo{li("asgard", "ingestor-1"): {
+			batchSigningKeyVersions:     []int64{99600, 99000},
+			packetEncryptionKeyVersions: []int64{99500},
+		}})
+	}
+
+	t.Run("batch signing key", func(t *testing.T) {
+		t.Parallel()
+		ms := newManifestStore()
+		cfg := newCFG(ms, &manifestSigningConfig{batchSigningKey: true})
+
+		// The unsigned manifest is accepted, and signed by the primary batch
+		// signing key version.
+		if err := rotateKeys(ctx, cfg); err != nil {
+			t.Fatalf("Unexpected error from rotateKeys: %v", err)
+		}
+		sig, ok := ms.GetManifestSignatures()["asgard-ingestor-1"]
+		if !ok {
+			t.Fatalf("No manifest signature was written for asgard-ingestor-1")
+		}
+		if want := bskKID(li("asgard", "ingestor-1"), 99600); sig.KeyIdentifier != want {
+			t.Errorf("Manifest signed by %q, want %q", sig.KeyIdentifier, want)
+		}
+		m := ms.GetDataShareProcessorSpecificManifests()["asgard-ingestor-1"]
+		if err := m.VerifySignature(sig, keytest.Material(sig.KeyIdentifier).Public()); err != nil {
+			t.Errorf("Unexpected error verifying manifest signature: %v", err)
+		}
+
+		// The signed manifest is verified.
+		if err := rotateKeys(ctx, cfg); err != nil {
+			t.Fatalf("Unexpected error from rotateKeys (second rotation): %v", err)
+		}
+
+		// A modified manifest is not.
+		m.IngestionBucket = "tampered-bucket"
+		ms.GetDataShareProcessorSpecificManifests()["asgard-ingestor-1"] = m
+		const wantErrStr = "does not match manifest"
+		if err := rotateKeys(ctx, cfg); err == nil || !strings.Contains(err.Error(), wantErrStr) {
+			t.Errorf("Wanted error containing %q from rotateKeys with modified manifest, got: %v", wantErrStr, err)
+		}
+	})
+
+	t.Run("key file", func(t *testing.T) {
+		t.Parallel()
+		pkcs8, err := keytest.Material("manifest-signing-key").AsPKCS8()
+		if err != nil {
+			t.Fatalf("Couldn't serialize key material as PKCS #8: %v", err)
+		}
+		pkcs8DER, err := base64.StdEncoding.DecodeString(pkcs8)
+		if err != nil {
+			t.Fatalf("Couldn't decode PKCS #8 key: %v", err)
+		}
+		keyFile := filepath.Join(t.TempDir(), "manifest-signing-key.pem")
+		if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8DER}), 0600); err != nil {
+			t.Fatalf("Couldn't write key file: %v", err)
+		}
+		material, err := loadManifestSigningKey(keyFile)
+		if err != nil {
+			t.Fatalf("Unexpected error from loadManifestSigningKey: %v", err)
+		}
+
+		ms := newManifestStore()
+		if err := rotateKeys(ctx, newCFG(ms, &manifestSigningConfig{material: material, keyID: "manifest-signing-key"})); err != nil {
+			t.Fatalf("Unexpected error from rotateKeys: %v", err)
+		}
+		sig := ms.GetManifestSignatures()["asgard-ingestor-1"]
+		m := ms.GetDataShareProcessorSpecificManifests()["asgard-ingestor-1"]
+		if err := m.VerifySignature(sig, keytest.Material("manifest-signing-key").Public()); err != nil {
+			t.Errorf("Unexpected error verifying manifest signature: %v", err)
+		}
+
+		// Manifests signed by another key are rejected.
+		const wantErrStr = "is signed by"
+		if err := rotateKeys(ctx, newCFG(ms, &manifestSigningConfig{material: material, keyID: "other-key"})); err == nil || !strings.Contains(err.Error(), wantErrStr) {
+			t.Errorf("Wanted error containing %q from rotateKeys with other key ID, got: %v", wantErrStr, err)
+		}
+	})
 }
 
-func pekKID(locality string, ts int64) string {
-	if ts == 0 {
-		return fmt.Sprintf("prio-env-%s-ingestion-packet-decryption-key", locality)
+func TestRotateKeysIngestorGlobalManifest(t *testing.T) {
+	t.Parallel()
+
+	stableCFG := rotateKeyConfig{enableRotation: true, rotationCFG: key.RotationConfig{
+		CreateKeyFunc:     key.P256.New,
+		CreateMinAge:      10000 * time.Second,
+		PrimaryMinAge:     1000 * time.Second,
+		DeleteMinAge:      20000 * time.Second,
+		DeleteMinKeyCount: 2,
+	}}
+	globalLI := li(ingestorGlobalLocality, "singleton-ingestor")
+	identity := manifest.ServerIdentity{GCPServiceAccountEmail: "singleton-ingestor@example.com"}
+	ks := keyStore(map[LI][]int64{
+		li("asgard", "ingestor-1"): {99600},
+		globalLI:                   {80000},
+	}, map[string][]int64{"asgard": {99500}})
+	ms := manifestStore(map[LI]manifestInfo{li("asgard", "ingestor-1"): {
+		batchSigningKeyVersions:     []int64{99600},
+		packetEncryptionKeyVersions: []int64{99500},
+	}})
+	globalMS := storagetest.NewManifest()
+	pkix, err := keytest.Material(bskKID(globalLI, 80000)).PublicAsPKIX()
+	if err != nil {
+		t.Fatalf("Couldn't serialize key material as PKIX: %v", err)
+	}
+	if err := globalMS.PutIngestorGlobalManifest(ctx, manifest.IngestorGlobalManifest{
+		Format:                 1,
+		ServerIdentity:         identity,
+		BatchSigningPublicKeys: manifest.BatchSigningPublicKeys{bskKID(globalLI, 80000): manifest.BatchSigningPublicKey{PublicKey: pkix}},
+	}); err != nil {
+		t.Fatalf("Couldn't store global manifest: %v", err)
+	}
+	cfg := rotateKeysConfig{
+		keyStore:        ks,
+		manifestStore:   ms,
+		now:             time.Unix(100000, 0),
+		locality:        "asgard",
+		ingestors:       []string{"ingestor-1"},
+		prioEnvironment: "prio-env",
+		csrFQDN:         "some.fqdn",
+		batchCFG:        stableCFG,
+		packetCFG:       stableCFG,
+		ingestorGlobal:  &ingestorGlobalConfig{ingestor: "singleton-ingestor", manifestStore: globalMS},
+	}
+	if err := rotateKeys(ctx, cfg); err != nil {
+		t.Fatalf("Unexpected error from rotateKeys: %v", err)
 	}
-	return fmt.Sprintf("prio-env-%s-ingestion-packet-decryption-key-%d", locality, ts)
-}
 
-func liToDSP(li LI) string { return fmt.Sprintf("%s-%s", li.Locality, li.Ingestor) }
+	// The singleton ingestor's key is old enough that a new version should
+	// have been created, but not yet made primary.
+	gotKey := ks.BatchSigningKeys()[globalLI]
+	gotVers := keyToVersionMap(gotKey)
+	if _, ok := gotVers[100000]; !ok || len(gotVers) != 2 {
+		t.Errorf("Singleton ingestor's batch signing key has versions %v, want 80000 & 100000", gotVers)
+	}
+	if got, want := gotKey.Primary().CreationTimestamp, int64(80000); got != want {
+		t.Errorf("Singleton ingestor's batch signing key has primary version %d, want %d", got, want)
+	}
 
-// int64sToSet converts a slice of int64 to an equivalent set.
-func int64sToSet(vals []int64) map[int64]struct{} {
-	rslt := map[int64]struct{}{}
-	for _, i := range vals {
-		rslt[i] = struct{}{}
+	// The global manifest should publish every version, & keep its server
+	// identity.
+	if got := globalMS.GetIngestorGlobalManifestPutCount() - 1; got != 1 { // less the initial write
+		t.Errorf("Global manifest was written %d times, want 1", got)
+	}
+	m, err := globalMS.GetIngestorGlobalManifest(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get global manifest: %v", err)
+	}
+	if m.ServerIdentity != identity {
+		t.Errorf("Global manifest has server identity %+v, want %+v", m.ServerIdentity, identity)
+	}
+	for _, ts := range []int64{80000, 100000} {
+		wantPKIX, err := gotVers[ts].KeyMaterial.PublicAsPKIX()
+		if err != nil {
+			t.Fatalf("Couldn't serialize key material as PKIX: %v", err)
+		}
+		if m.BatchSigningPublicKeys[bskKID(globalLI, ts)].PublicKey != wantPKIX {
+			t.Errorf("Global manifest's batch signing public key %q doesn't match key", bskKID(globalLI, ts))
+		}
+	}
+	if got, want := len(m.BatchSigningPublicKeys), 2; got != want {
+		t.Errorf("Global manifest has %d batch signing public keys, want %d", got, want)
+	}
+
+	// A missing global manifest fails the rotation.
+	cfg.ingestorGlobal.manifestStore = storagetest.NewManifest()
+	if err := rotateKeys(ctx, cfg); err == nil {
+		t.Errorf("Wanted error from rotateKeys with missing global manifest")
 	}
-	return rslt
 }
 
-// keyToVersionMap returns a map from UNIX second creation timestamps to key.
-// versions.
-func keyToVersionMap(k key.Key) map[int64]key.Version {
-	rslt := map[int64]key.Version{}
+func TestRotateKeysKMS(t *testing.T) {
+	t.Parallel()
+
+	kms := &dryRunKMS{rnd: rand.Reader, pubs: map[string]key.PublicKey{}}
+	batchCFG := rotateKeyConfig{enableRotation: true, rotationCFG: key.RotationConfig{
+		CreateKeyFunc:     newKMSKeyFunc(ctx, kms),
+		CreateMinAge:      300 * time.Second,
+		PrimaryMinAge:     100 * time.Second,
+		DeleteMinAge:      20000 * time.Second,
+		DeleteMinKeyCount: 2,
+	}}
+	packetCFG := rotateKeyConfig{rotationCFG: key.RotationConfig{
+		CreateKeyFunc:     key.P256.New,
+		CreateMinAge:      10000 * time.Second,
+		PrimaryMinAge:     1000 * time.Second,
+		DeleteMinAge:      20000 * time.Second,
+		DeleteMinKeyCount: 2,
+	}}
+	ks := keyStore(map[LI][]int64{li("asgard", "ingestor-1"): {99600, 99000}}, map[string][]int64{"asgard": {99500}})
+	ms := manifestStore(map[LI]manifestInfo{li("asgard", "ingestor-1"): {
+		batchSigningKeyVersions:     []int64{99600, 99000},
+		packetEncryptionKeyVersions: []int64{99500},
+	}})
+	if err := rotateKeys(ctx, rotateKeysConfig{
+		keyStore:        ks,
+		manifestStore:   ms,
+		now:             time.Unix(100000, 0),
+		locality:        "asgard",
+		ingestors:       []string{"ingestor-1"},
+		prioEnvironment: "prio-env",
+		csrFQDN:         "some.fqdn",
+		batchCFG:        batchCFG,
+		packetCFG:       packetCFG,
+	}); err != nil {
+		t.Fatalf("Unexpected error from rotateKeys: %v", err)
+	}
+
+	// The new batch signing key version is held in the KMS, and its public
+	// key is published in the manifest.
+	k, err := ks.GetBatchSigningKey(ctx, "asgard", "ingestor-1")
+	if err != nil {
+		t.Fatalf("Couldn't get batch signing key: %v", err)
+	}
+	var newVersion *key.Version
 	_ = k.Versions(func(v key.Version) error {
-		rslt[v.CreationTimestamp] = v
+		if v.CreationTimestamp == 100000 {
+			newVersion = &v
+		}
 		return nil
 	})
-	return rslt
+	if newVersion == nil {
+		t.Fatalf("No batch signing key version created")
+	}
+	if ref, ok := newVersion.KeyMaterial.KMSKeyRef(); !ok || ref != "dry-run-0" {
+		t.Errorf("KMSKeyRef() = (%q, %v), want (%q, true)", ref, ok, "dry-run-0")
+	}
+	if kmsPub, ok := kms.pubs["dry-run-0"]; !ok || !kmsPub.Equal(newVersion.KeyMaterial.Public()) {
+		t.Errorf("New batch signing key version's public key doesn't match KMS key %q", "dry-run-0")
+	}
+	wantPublicKey, err := newVersion.KeyMaterial.PublicAsPKIX()
+	if err != nil {
+		t.Fatalf("Couldn't serialize public key: %v", err)
+	}
+	m := ms.GetDataShareProcessorSpecificManifests()["asgard-ingestor-1"]
+	if got := m.BatchSigningPublicKeys[bskKID(li("asgard", "ingestor-1"), 100000)].PublicKey; got != wantPublicKey {
+		t.Errorf("Manifest publishes batch signing public key %q, want %q", got, wantPublicKey)
+	}
 }
 
-// dupStrToKeyMap duplicates a map of strings to key.Keys.
-func dupStrToKeyMap(m map[string]key.Key) map[string]key.Key {
-	rslt := map[string]key.Key{}
-	for k, v := range m {
-		rslt[k] = v
+func TestRotateKeysWrittenMetrics(t *testing.T) {
+	t.Parallel()
+
+	// Metrics are global, so this test uses a locality no other test does.
+	const locality = "niflheim"
+	batchCFG := rotateKeyConfig{enableRotation: true, rotationCFG: key.RotationConfig{
+		CreateKeyFunc:     key.P256.New,
+		CreateMinAge:      300 * time.Second,
+		PrimaryMinAge:     100 * time.Second,
+		DeleteMinAge:      20000 * time.Second,
+		DeleteMinKeyCount: 2,
+	}}
+	packetCFG := rotateKeyConfig{rotationCFG: key.RotationConfig{
+		CreateKeyFunc:     key.P256.New,
+		CreateMinAge:      10000 * time.Second,
+		PrimaryMinAge:     1000 * time.Second,
+		DeleteMinAge:      20000 * time.Second,
+		DeleteMinKeyCount: 2,
+	}}
+	ks := keyStore(map[LI][]int64{
+		li(locality, "ingestor-1"): {99600, 99000},
+		li(locality, "ingestor-2"): {99600, 99000},
+	}, map[string][]int64{locality: {99500}})
+	ms := manifestStore(map[LI]manifestInfo{
+		li(locality, "ingestor-1"): {batchSigningKeyVersions: []int64{99600, 99000}, packetEncryptionKeyVersions: []int64{99500}},
+		li(locality, "ingestor-2"): {batchSigningKeyVersions: []int64{99600, 99000}, packetEncryptionKeyVersions: []int64{99500}},
+	})
+	if err := rotateKeys(ctx, rotateKeysConfig{
+		keyStore:        ks,
+		manifestStore:   ms,
+		now:             time.Unix(100000, 0),
+		locality:        locality,
+		ingestors:       []string{"ingestor-1"},
+		prioEnvironment: "prio-env",
+		csrFQDN:         "some.fqdn",
+		batchCFG:        batchCFG,
+		packetCFG:       packetCFG,
+	}); err != nil {
+		t.Fatalf("Unexpected error from rotateKeys: %v", err)
 	}
-	return rslt
-}
 
-// dupLIToKeyMap duplicates a map of LIs to key.Keys.
-func dupLIToKeyMap(m map[LI]key.Key) map[LI]key.Key {
-	rslt := map[LI]key.Key{}
-	for k, v := range m {
-		rslt[k] = v
+	// Only ingestor-1's batch signing key & manifest are rotated & written.
+	for _, test := range []struct {
+		ingestor, kind string
+		want           float64
+	}{
+		{"ingestor-1", batchSigningKeyKind, 1},
+		{"ingestor-2", batchSigningKeyKind, 0},
+		{"", packetEncryptionKeyKind, 0},
+	} {
+		if got := testutil.ToFloat64(keysWritten.WithLabelValues(locality, test.ingestor, test.kind)); got != test.want {
+			t.Errorf("Got %v %s keys written for (%q, %q), want %v", got, test.kind, locality, test.ingestor, test.want)
+		}
+	}
+	for ingestor, want := range map[string]float64{"ingestor-1": 1, "ingestor-2": 0} {
+		if got := testutil.ToFloat64(manifestsWritten.WithLabelValues(locality, ingestor)); got != want {
+			t.Errorf("Got %v manifests written for (%q, %q), want %v", got, locality, ingestor, want)
+		}
 	}
-	return rslt
 }
 
-// dupStrToManifestMap duplicates a map of strings to manifests.
-func dupStrToManifestMap(m map[string]manifest.DataShareProcessorSpecificManifest) map[string]manifest.DataShareProcessorSpecificManifest {
-	rslt := map[string]manifest.DataShareProcessorSpecificManifest{}
-	for k, v := range m {
-		rslt[k] = v
+func TestRotateKeysRevocation(t *testing.T) {
+	t.Parallel()
+
+	stableCFG := rotateKeyConfig{rotationCFG: key.RotationConfig{
+		CreateKeyFunc:     key.P256.New,
+		CreateMinAge:      10000 * time.Second,
+		PrimaryMinAge:     1000 * time.Second,
+		DeleteMinAge:      20000 * time.Second,
+		DeleteMinKeyCount: 2,
+	}}
+	ingestor1, ingestor2 := li("asgard", "ingestor-1"), li("asgard", "ingestor-2")
+	newStores := func() (*storagetest.Key, *storagetest.Manifest) {
+		ks := keyStore(map[LI][]int64{ingestor1: {99000, 95000}, ingestor2: {99000, 95000}}, map[string][]int64{"asgard": {99500}})
+		ms := manifestStore(map[LI]manifestInfo{
+			ingestor1: {batchSigningKeyVersions: []int64{99000, 95000}, packetEncryptionKeyVersions: []int64{99500}},
+			ingestor2: {batchSigningKeyVersions: []int64{99000, 95000}, packetEncryptionKeyVersions: []int64{99500}},
+		})
+		return ks, ms
+	}
+	newCFG := func(ks *storagetest.Key, ms *storagetest.Manifest, revocation *keyRevocation) rotateKeysConfig {
+		return rotateKeysConfig{
+			keyStore:        ks,
+			manifestStore:   ms,
+			now:             time.Unix(100000, 0),
+			locality:        "asgard",
+			ingestors:       []string{"ingestor-1", "ingestor-2"},
+			prioEnvironment: "prio-env",
+			csrFQDN:         "some.fqdn",
+			batchCFG:        stableCFG,
+			packetCFG:       stableCFG,
+			revocation:      revocation,
+		}
 	}
-	return rslt
-}
 
-func li(locality, ingestor string) LI { return LI{Locality: locality, Ingestor: ingestor} }
+	t.Run("batch signing key", func(t *testing.T) {
+		t.Parallel()
+		ks, ms := newStores()
+		revocation := &keyRevocation{kind: revokeBatchSigningKey, creationTimestamp: 99000, ingestors: []string{"ingestor-1"}}
+		if err := rotateKeys(ctx, newCFG(ks, ms, revocation)); err != nil {
+			t.Fatalf("Unexpected error from rotateKeys: %v", err)
+		}
+
+		// The revoked version is replaced by a new version, which isn't yet
+		// old enough to be primary. Other ingestors' keys are rotated as
+		// usual, which creates no versions.
+		for _, test := range []struct {
+			li          LI
+			wantVersion []int64
+			wantPrimary int64
+		}{
+			{ingestor1, []int64{95000, 100000}, 95000},
+			{ingestor2, []int64{95000, 99000}, 99000},
+		} {
+			k := ks.BatchSigningKeys()[test.li]
+			if diff := cmp.Diff(int64sToSet(test.wantVersion), int64sToSet(k.TryOrder())); diff != "" {
+				t.Errorf("Unexpected batch signing key versions for %v (-want +got):\n%s", test.li, diff)
+			}
+			if got := k.Primary().CreationTimestamp; got != test.wantPrimary {
+				t.Errorf("Batch signing key for %v has primary version %d, want %d", test.li, got, test.wantPrimary)
+			}
+			m := ms.GetDataShareProcessorSpecificManifests()[liToDSP(test.li)]
+			for _, ts := range test.wantVersion {
+				if _, ok := m.BatchSigningPublicKeys[bskKID(test.li, ts)]; !ok {
+					t.Errorf("Manifest for %v missing batch signing key version %d", test.li, ts)
+				}
+			}
+			if got, want := len(m.BatchSigningPublicKeys), len(test.wantVersion); got != want {
+				t.Errorf("Manifest for %v has %d batch signing key versions, want %d", test.li, got, want)
+			}
+		}
+	})
+
+	t.Run("packet encryption key", func(t *testing.T) {
+		t.Parallel()
+		ks, ms := newStores()
+		revocation := &keyRevocation{kind: revokePacketEncryptionKey, creationTimestamp: 99500}
+		if err := rotateKeys(ctx, newCFG(ks, ms, revocation)); err != nil {
+			t.Fatalf("Unexpected error from rotateKeys: %v", err)
+		}
+
+		// The revoked version was the only version, so the new version is
+		// primary, and published in every manifest in its place.
+		k := ks.PacketEncryptionKeys()["asgard"]
+		if diff := cmp.Diff([]int64{100000}, k.TryOrder()); diff != "" {
+			t.Errorf("Unexpected packet encryption key versions (-want +got):\n%s", diff)
+		}
+		for _, li := range []LI{ingestor1, ingestor2} {
+			m := ms.GetDataShareProcessorSpecificManifests()[liToDSP(li)]
+			if _, ok := m.PacketEncryptionKeyCSRs[pekKID("asgard", 100000)]; !ok || len(m.PacketEncryptionKeyCSRs) != 1 {
+				t.Errorf("Manifest for %v has packet encryption key versions %v, want only version 100000", li, m.PacketEncryptionKeyCSRs)
+			}
+		}
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		t.Parallel()
+		ks, ms := newStores()
+		revocation := &keyRevocation{kind: revokePacketEncryptionKey, creationTimestamp: 12345}
+		if err := rotateKeys(ctx, newCFG(ks, ms, revocation)); err == nil {
+			t.Errorf("Wanted error from rotateKeys revoking unknown key version, got none")
+		}
+		if got := ms.GetDataShareProcessorSpecificManifestPutCount("asgard-ingestor-1"); got != 0 {
+			t.Errorf("Manifest written %d times despite error, want 0", got)
+		}
+	})
+}
+
+func TestNewKeyRevocation(t *testing.T) {
+	t.Parallel()
+
+	ingestors := []string{"ingestor-1", "ingestor-2"}
+	for _, test := range []struct {
+		name            string
+		kind            string
+		version         int64
+		revokeIngestors string
+		want            *keyRevocation
+	}{
+		{
+			name:    "packet encryption key",
+			kind:    revokePacketEncryptionKey,
+			version: 99500,
+			want:    &keyRevocation{kind: revokePacketEncryptionKey, creationTimestamp: 99500},
+		},
+		{
+			name:    "batch signing key for every ingestor",
+			kind:    revokeBatchSigningKey,
+			version: 99000,
+			want:    &keyRevocation{kind: revokeBatchSigningKey, creationTimestamp: 99000, ingestors: ingestors},
+		},
+		{
+			name:            "batch signing key for some ingestors",
+			kind:            revokeBatchSigningKey,
+			version:         99000,
+			revokeIngestors: "ingestor-2",
+			want:            &keyRevocation{kind: revokeBatchSigningKey, creationTimestamp: 99000, ingestors: []string{"ingestor-2"}},
+		},
+		{
+			name:            "unknown ingestor",
+			kind:            revokeBatchSigningKey,
+			version:         99000,
+			revokeIngestors: "ingestor-3",
+		},
+		{
+			name:            "ingestors for packet encryption key",
+			kind:            revokePacketEncryptionKey,
+			version:         99500,
+			revokeIngestors: "ingestor-1",
+		},
+		{
+			name: "missing version",
+			kind: revokePacketEncryptionKey,
+		},
+		{
+			name:    "unknown kind",
+			kind:    "task-signing",
+			version: 99000,
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := newKeyRevocation(test.kind, test.version, test.revokeIngestors, ingestors)
+			if (err != nil) != (test.want == nil) {
+				t.Fatalf("Unexpected error (want error = %t): %v", test.want == nil, err)
+			}
+			if diff := cmp.Diff(test.want, got, cmp.AllowUnexported(keyRevocation{})); diff != "" {
+				t.Errorf("Unexpected revocation (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRotateKeysRollback(t *testing.T) {
+	t.Parallel()
+
+	stableCFG := rotateKeyConfig{enableRotation: true, rotationCFG: key.RotationConfig{
+		CreateKeyFunc:     key.P256.New,
+		CreateMinAge:      10000 * time.Second,
+		PrimaryMinAge:     1000 * time.Second,
+		DeleteMinAge:      20000 * time.Second,
+		DeleteMinKeyCount: 2,
+	}}
+	ingestor1, ingestor2 := li("asgard", "ingestor-1"), li("asgard", "ingestor-2")
+	newStores := func() (*storagetest.Key, *storagetest.Manifest) {
+		ks := keyStore(map[LI][]int64{ingestor1: {99000, 95000}, ingestor2: {99000, 95000}}, map[string][]int64{"asgard": {99500}})
+		ms := manifestStore(map[LI]manifestInfo{
+			ingestor1: {batchSigningKeyVersions: []int64{99000, 95000}, packetEncryptionKeyVersions: []int64{99500}},
+			ingestor2: {batchSigningKeyVersions: []int64{99000, 95000}, packetEncryptionKeyVersions: []int64{99500}},
+		})
+		return ks, ms
+	}
+	newCFG := func(ks *storagetest.Key, ms *storagetest.Manifest, rollback *keyRollback) rotateKeysConfig {
+		return rotateKeysConfig{
+			keyStore:        ks,
+			manifestStore:   ms,
+			now:             time.Unix(100000, 0),
+			locality:        "asgard",
+			ingestors:       []string{"ingestor-1", "ingestor-2"},
+			prioEnvironment: "prio-env",
+			csrFQDN:         "some.fqdn",
+			batchCFG:        stableCFG,
+			packetCFG:       stableCFG,
+			rollback:        rollback,
+		}
+	}
+
+	t.Run("batch signing key", func(t *testing.T) {
+		t.Parallel()
+		ks, ms := newStores()
+		// The previous key lacks the latest version, and holds one since
+		// deleted.
+		rollback := &keyRollback{kind: rollbackBatchSigningKey, ingestor: "ingestor-1", steps: 1, key: bsk(ingestor1, 95000, 90000)}
+		if err := rotateKeys(ctx, newCFG(ks, ms, rollback)); err != nil {
+			t.Fatalf("Unexpected error from rotateKeys: %v", err)
+		}
+
+		// The rolled-back key is restored rather than rotated, & published
+		// in its ingestor's manifest. Other ingestors' keys are rotated as
+		// usual, which creates no versions.
+		for _, test := range []struct {
+			li          LI
+			wantVersion []int64
+			wantPrimary int64
+		}{
+			{ingestor1, []int64{95000, 90000}, 95000},
+			{ingestor2, []int64{95000, 99000}, 99000},
+		} {
+			k := ks.BatchSigningKeys()[test.li]
+			if diff := cmp.Diff(int64sToSet(test.wantVersion), int64sToSet(k.TryOrder())); diff != "" {
+				t.Errorf("Unexpected batch signing key versions for %v (-want +got):\n%s", test.li, diff)
+			}
+			if got := k.Primary().CreationTimestamp; got != test.wantPrimary {
+				t.Errorf("Batch signing key for %v has primary version %d, want %d", test.li, got, test.wantPrimary)
+			}
+			m := ms.GetDataShareProcessorSpecificManifests()[liToDSP(test.li)]
+			for _, ts := range test.wantVersion {
+				if _, ok := m.BatchSigningPublicKeys[bskKID(test.li, ts)]; !ok {
+					t.Errorf("Manifest for %v missing batch signing key version %d", test.li, ts)
+				}
+			}
+			if got, want := len(m.BatchSigningPublicKeys), len(test.wantVersion); got != want {
+				t.Errorf("Manifest for %v has %d batch signing key versions, want %d", test.li, got, want)
+			}
+		}
+	})
+
+	t.Run("packet encryption key", func(t *testing.T) {
+		t.Parallel()
+		ks, ms := newStores()
+		rollback := &keyRollback{kind: rollbackPacketEncryptionKey, steps: 1, key: pek("asgard", 90000)}
+		if err := rotateKeys(ctx, newCFG(ks, ms, rollback)); err != nil {
+			t.Fatalf("Unexpected error from rotateKeys: %v", err)
+		}
+
+		// The previous key's primary version is published in every manifest
+		// in place of the replaced key's.
+		k := ks.PacketEncryptionKeys()["asgard"]
+		if diff := cmp.Diff([]int64{90000}, k.TryOrder()); diff != "" {
+			t.Errorf("Unexpected packet encryption key versions (-want +got):\n%s", diff)
+		}
+		for _, li := range []LI{ingestor1, ingestor2} {
+			m := ms.GetDataShareProcessorSpecificManifests()[liToDSP(li)]
+			if _, ok := m.PacketEncryptionKeyCSRs[pekKID("asgard", 90000)]; !ok || len(m.PacketEncryptionKeyCSRs) != 1 {
+				t.Errorf("Manifest for %v has packet encryption key versions %v, want only version 90000", li, m.PacketEncryptionKeyCSRs)
+			}
+		}
+	})
+}
+
+func TestKeyRevocationRemoveFromHistory(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name       string
+		revocation keyRevocation
+		want       []string
+	}{
+		{
+			name:       "packet encryption key",
+			revocation: keyRevocation{kind: revokePacketEncryptionKey, creationTimestamp: 90000},
+			want:       []string{"packet-encryption//90000"},
+		},
+		{
+			name:       "batch signing key",
+			revocation: keyRevocation{kind: revokeBatchSigningKey, creationTimestamp: 90000, ingestors: []string{"ingestor-1", "ingestor-2"}},
+			want:       []string{"batch-signing/ingestor-1/90000", "batch-signing/ingestor-2/90000"},
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			var got []string
+			n, err := test.revocation.removeFromHistory(ctx, func(_ context.Context, kind, ingestor string, creationTimestamp int64) (int, error) {
+				got = append(got, fmt.Sprintf("%s/%s/%d", kind, ingestor, creationTimestamp))
+				return 1, nil
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error from removeFromHistory: %v", err)
+			}
+			if n != len(test.want) {
+				t.Errorf("removeFromHistory = %d, want %d", n, len(test.want))
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Unexpected previous keys changed (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestKeyRollback(t *testing.T) {
+	t.Parallel()
+
+	ingestors := []string{"ingestor-1", "ingestor-2"}
+	for _, test := range []struct {
+		name                 string
+		kind, ingestor       string
+		steps                int
+		manageTaskSigningKey bool
+		wantErr              bool
+	}{
+		{name: "packet encryption key", kind: rollbackPacketEncryptionKey, steps: 1},
+		{name: "batch signing key", kind: rollbackBatchSigningKey, ingestor: "ingestor-2", steps: 2},
+		{name: "task signing key", kind: rollbackTaskSigningKey, steps: 1, manageTaskSigningKey: true},
+		{name: "unmanaged task signing key", kind: rollbackTaskSigningKey, steps: 1, wantErr: true},
+		{name: "unknown ingestor", kind: rollbackBatchSigningKey, ingestor: "ingestor-3", steps: 1, wantErr: true},
+		{name: "missing ingestor", kind: rollbackBatchSigningKey, steps: 1, wantErr: true},
+		{name: "ingestor for packet encryption key", kind: rollbackPacketEncryptionKey, ingestor: "ingestor-1", steps: 1, wantErr: true},
+		{name: "no steps", kind: rollbackPacketEncryptionKey, wantErr: true},
+		{name: "unknown kind", kind: "packet-decryption", steps: 1, wantErr: true},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			_, err := newKeyRollback(test.kind, test.ingestor, test.steps, ingestors, test.manageTaskSigningKey)
+			if (err != nil) != test.wantErr {
+				t.Errorf("Unexpected error (want error = %t): %v", test.wantErr, err)
+			}
+		})
+	}
+
+	// The previous key is selected by the number of writes rolled back.
+	history := []key.Key{pek("asgard", 99000), pek("asgard", 98000)}
+	historyFunc := func(_ context.Context, kind, ingestor string) ([]key.Key, error) {
+		if kind != rollbackBatchSigningKey || ingestor != "ingestor-2" {
+			return nil, fmt.Errorf("unexpected key (%q, %q)", kind, ingestor)
+		}
+		return history, nil
+	}
+	for steps, want := range map[int]key.Key{1: history[0], 2: history[1], 3: {}} {
+		r, err := newKeyRollback(rollbackBatchSigningKey, "ingestor-2", steps, ingestors, false)
+		if err != nil {
+			t.Fatalf("Unexpected error from newKeyRollback: %v", err)
+		}
+		err = r.load(ctx, historyFunc)
+		if want.IsEmpty() {
+			if err == nil {
+				t.Errorf("Wanted error loading rollback by %d writes with %d previous keys, got none", steps, len(history))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error loading rollback by %d writes: %v", steps, err)
+		}
+		if !r.key.Equal(want) {
+			t.Errorf("Rollback by %d writes restores unexpected key: %s", steps, want.Diff(r.key))
+		}
+	}
+}
+
+func manifestDigest(m manifest.DataShareProcessorSpecificManifest) (string, error) {
+	manifestBytes, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(manifestBytes)), nil
+}
+
+func TestWatch(t *testing.T) {
+	t.Parallel()
+
+	const dsp = "asgard-ingestor-1"
+	manifestStore := storagetest.NewManifest()
+	secretChanges := make(chan string)
+	reconciled := make(chan struct{}, 100)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- watch(ctx, watchConfig{
+			secretChanges: secretChanges,
+			manifestStore: manifestStore,
+			dspNames:      []string{dsp},
+			pollInterval:  time.Millisecond,
+		}, func(context.Context) error {
+			reconciled <- struct{}{}
+			return nil
+		})
+	}()
+	waitForReconcile := func(reason string) {
+		select {
+		case <-reconciled:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for reconciliation after %s", reason)
+		}
+	}
+
+	// Reconciliation happens immediately on startup.
+	waitForReconcile("startup")
+
+	// A modified secret triggers reconciliation.
+	secretChanges <- "some-secret"
+	waitForReconcile("secret change")
+
+	// A modified manifest triggers reconciliation. The manifest is written
+	// repeatedly, since a write landing before watch records the manifest
+	// versions following the previous reconciliation is indistinguishable
+	// from a write made by that reconciliation.
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(10 * time.Second)
+	for done := false; !done; {
+		if err := manifestStore.PutDataShareProcessorSpecificManifest(ctx, dsp, manifest.DataShareProcessorSpecificManifest{}); err != nil {
+			t.Fatalf("Couldn't write manifest: %v", err)
+		}
+		select {
+		case <-reconciled:
+			done = true
+		case <-ticker.C:
+		case <-timeout:
+			t.Fatalf("Timed out waiting for reconciliation after manifest change")
+		}
+	}
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Errorf("Unexpected error from watch: %v", err)
+	}
+}
+
+func TestWatchOwnSecretWrites(t *testing.T) {
+	t.Parallel()
+
+	secrets := &watchedSecrets{watcher: k8swatch.NewFake()}
+	keyStore := storage.NewKubernetesKey(secrets, "prio-env")
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	secretChanges, err := storage.WatchKubernetesKeys(ctx, storage.KubernetesSecrets{Default: secrets}, "prio-env", "watched-locality", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from WatchKubernetesKeys: %v", err)
+	}
+
+	// Each reconciliation writes the packet encryption key, as with
+	// --packet-encryption-key-always-write.
+	reconciled := make(chan struct{}, 100)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- watch(ctx, watchConfig{
+			secretChanges: secretChanges,
+			manifestStore: storagetest.NewManifest(),
+			pollInterval:  time.Hour,
+		}, func(ctx context.Context) error {
+			defer func() { reconciled <- struct{}{} }()
+			return keyStore.PutPacketEncryptionKey(ctx, "watched-locality", pek("watched-locality", 100000))
+		})
+	}()
+	wantReconciles := func(reason string, want int) {
+		for i := 0; i < want; i++ {
+			select {
+			case <-reconciled:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("Timed out waiting for reconciliation after %s", reason)
+			}
+		}
+		select {
+		case <-reconciled:
+			t.Errorf("Unexpected reconciliation after %s: the reconciliation's own write was treated as drift", reason)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	wantReconciles("startup", 1)
+
+	// A modification by another writer is still drift.
+	secrets.modify(secrets.patchedName())
+	wantReconciles("secret change", 1)
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Errorf("Unexpected error from watch: %v", err)
+	}
+}
+
+// watchedSecrets is a fake Kubernetes secret interface whose single watch
+// reports a modification for each patch of a secret.
+type watchedSecrets struct {
+	k8s.SecretInterface
+	watcher *k8swatch.FakeWatcher
+
+	mu              sync.Mutex // protects resourceVersion, name
+	resourceVersion int
+	name            string // the name of the last secret patched
+}
+
+func (s *watchedSecrets) Watch(context.Context, metav1.ListOptions) (k8swatch.Interface, error) {
+	return s.watcher, nil
+}
+
+func (s *watchedSecrets) Patch(_ context.Context, name string, _ types.PatchType, _ []byte, _ metav1.PatchOptions, _ ...string) (*k8sapi.Secret, error) {
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+	return s.modify(name), nil
+}
+
+func (s *watchedSecrets) patchedName() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.name
+}
+
+// modify reports a modification of the named secret on the watch, returning
+// the secret as modified.
+func (s *watchedSecrets) modify(name string) *k8sapi.Secret {
+	s.mu.Lock()
+	s.resourceVersion++
+	secret := &k8sapi.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, ResourceVersion: strconv.Itoa(s.resourceVersion)}}
+	s.mu.Unlock()
+	s.watcher.Modify(secret)
+	return secret
+}
+
+func TestDaemon(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	health := newDaemonHealth(time.Hour)
+	rotations := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		daemon(ctx, daemonConfig{health: health, runInterval: time.Millisecond}, func() error {
+			rotations <- struct{}{}
+			<-release
+			return errors.New("rotation failed")
+		})
+	}()
+	waitForRotation := func(reason string) {
+		select {
+		case <-rotations:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for rotation %s", reason)
+		}
+	}
+
+	// Rotation happens immediately on startup, and is repeated after the run
+	// interval even if it fails.
+	waitForRotation("on startup")
+	release <- struct{}{}
+	waitForRotation("after run interval")
+
+	// A rotation in progress when the daemon is stopped is completed before
+	// the daemon returns.
+	cancel()
+	select {
+	case <-done:
+		t.Fatalf("Daemon returned while rotation in progress")
+	case <-time.After(10 * time.Millisecond):
+	}
+	release <- struct{}{}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for daemon to return")
+	}
+
+	// Failed rotations are reported by /healthz without failing it.
+	rec := httptest.NewRecorder()
+	daemonHandler(health, prometheus.NewRegistry()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "rotation failed") {
+		t.Errorf("Unexpected /healthz response %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestDaemonHealth(t *testing.T) {
+	t.Parallel()
+
+	start := time.Unix(100000, 0)
+	now := start
+	health := newDaemonHealth(time.Hour)
+	health.start = start
+	health.now = func() time.Time { return now }
+	handler := daemonHandler(health, prometheus.NewRegistry())
+	check := func(wantCode int) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if rec.Code != wantCode {
+			t.Errorf("Got /healthz status %d (%q), want %d", rec.Code, rec.Body.String(), wantCode)
+		}
+	}
+
+	// Before any rotation completes, the daemon is healthy until maxAge has
+	// passed since it started.
+	now = start.Add(30 * time.Minute)
+	health.started(now)
+	check(http.StatusOK)
+	now = start.Add(2 * time.Hour)
+	check(http.StatusServiceUnavailable)
+
+	// Once a rotation completes, the daemon is healthy until maxAge has
+	// passed since it completed.
+	health.completed(now, nil)
+	check(http.StatusOK)
+	now = now.Add(time.Hour + time.Second)
+	check(http.StatusServiceUnavailable)
+
+	// Metrics are served.
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Got /metrics status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestMigrateKeys(t *testing.T) {
+	t.Parallel()
+
+	migrateKeysCFG := migrateKeysConfig{
+		locality:             "asgard",
+		ingestors:            []string{"ingestor-1", "ingestor-2"},
+		readPrioEnvironment:  "prio-env",
+		writePrioEnvironment: "new-env",
+		csrFQDN:              "some.fqdn",
+	}
+
+	t.Run("success", func(t *testing.T) {
+		t.Parallel()
+		readKeyStore := keyStore(
+			map[LI][]int64{li("asgard", "ingestor-1"): {100, 200}, li("asgard", "ingestor-2"): {300}},
+			map[string][]int64{"asgard": {400}})
+		writeKeyStore := storagetest.NewKey()
+		manifestStore := manifestStore(map[LI]manifestInfo{
+			li("asgard", "ingestor-1"): {batchSigningKeyVersions: []int64{100, 200}, packetEncryptionKeyVersions: []int64{400}},
+			li("asgard", "ingestor-2"): {batchSigningKeyVersions: []int64{300}, packetEncryptionKeyVersions: []int64{400}},
+		})
+		cfg := migrateKeysCFG
+		cfg.readKeyStore, cfg.writeKeyStore, cfg.manifestStore = readKeyStore, writeKeyStore, manifestStore
+
+		if err := migrateKeys(ctx, cfg); err != nil {
+			t.Fatalf("Unexpected error from migrateKeys: %v", err)
+		}
+
+		// Verify keys were copied without modification.
+		for li, wantKey := range readKeyStore.BatchSigningKeys() {
+			if gotKey := writeKeyStore.BatchSigningKeys()[li]; !gotKey.Equal(wantKey) {
+				t.Errorf("Batch signing key for %v differs after migration: %s", li, gotKey.Diff(wantKey))
+			}
+		}
+		for loc, wantKey := range readKeyStore.PacketEncryptionKeys() {
+			if gotKey := writeKeyStore.PacketEncryptionKeys()[loc]; !gotKey.Equal(wantKey) {
+				t.Errorf("Packet encryption key for %q differs after migration: %s", loc, gotKey.Diff(wantKey))
+			}
+		}
+
+		// Verify manifests use key IDs for the new environment, with unchanged public keys.
+		for ingestor, bskVersions := range map[string][]int64{"ingestor-1": {100, 200}, "ingestor-2": {300}} {
+			m := manifestStore.GetDataShareProcessorSpecificManifests()[dspName("asgard", ingestor)]
+			for _, ts := range bskVersions {
+				wantKID := fmt.Sprintf("new-env-asgard-%s-batch-signing-key-%d", ingestor, ts)
+				if _, ok := m.BatchSigningPublicKeys[wantKID]; !ok {
+					t.Errorf("Manifest for %q missing batch signing key version %q", ingestor, wantKID)
+				}
+			}
+			if len(m.BatchSigningPublicKeys) != len(bskVersions) {
+				t.Errorf("Manifest for %q has unexpected batch signing key versions: %v", ingestor, m.BatchSigningPublicKeys)
+			}
+			wantPEKID := "new-env-asgard-ingestion-packet-decryption-key-400"
+			if _, ok := m.PacketEncryptionKeyCSRs[wantPEKID]; !ok || len(m.PacketEncryptionKeyCSRs) != 1 {
+				t.Errorf("Manifest for %q has unexpected packet encryption key versions: %v", ingestor, m.PacketEncryptionKeyCSRs)
+			}
+		}
+	})
+
+	t.Run("empty key", func(t *testing.T) {
+		t.Parallel()
+		readKeyStore := keyStore(
+			map[LI][]int64{li("asgard", "ingestor-1"): {100}, li("asgard", "ingestor-2"): {}},
+			map[string][]int64{"asgard": {400}})
+		writeKeyStore := storagetest.NewKey()
+		cfg := migrateKeysCFG
+		cfg.readKeyStore, cfg.writeKeyStore = readKeyStore, writeKeyStore
+		cfg.manifestStore = manifestStore(map[LI]manifestInfo{
+			li("asgard", "ingestor-1"): {batchSigningKeyVersions: []int64{100}, packetEncryptionKeyVersions: []int64{400}},
+			li("asgard", "ingestor-2"): {},
+		})
+
+		if err := migrateKeys(ctx, cfg); err == nil {
+			t.Errorf("Expected error from migrateKeys with empty batch signing key")
+		}
+		if len(writeKeyStore.BatchSigningKeys()) != 0 || len(writeKeyStore.PacketEncryptionKeys()) != 0 {
+			t.Errorf("Unexpected keys written: %v, %v", writeKeyStore.BatchSigningKeys(), writeKeyStore.PacketEncryptionKeys())
+		}
+	})
+}
+
+// keyStore creates a keystore with the given batch signing/packet encryption
+// key versions, specified as a map from (locality, ingestor) or locality
+// (respectively) to versions identified by UNIX second timestamps.
+func keyStore(bskVersions map[LI][]int64, pekVersions map[string][]int64) *storagetest.Key {
+	ks := storagetest.NewKey()
+
+	bsks := ks.BatchSigningKeys()
+	for li, vers := range bskVersions {
+		bsks[li] = bsk(li, vers...)
+	}
+
+	peks := ks.PacketEncryptionKeys()
+	for loc, vers := range pekVersions {
+		peks[loc] = pek(loc, vers...)
+	}
+
+	return ks
+}
+
+// manifestStore creates a manifest store with the given manifests, specified
+// as a map from data-share processor (i.e. locality & ingestor) to
+// manifestInfo.
+func manifestStore(manifestInfos map[LI]manifestInfo) *storagetest.Manifest {
+	m := storagetest.NewManifest()
+	ms := m.GetDataShareProcessorSpecificManifests()
+	for li, info := range manifestInfos {
+		bsks := manifest.BatchSigningPublicKeys{}
+		for _, ts := range info.batchSigningKeyVersions {
+			kid := bskKID(li, ts)
+			pkix, err := keytest.Material(kid).PublicAsPKIX()
+			if err != nil {
+				panic(fmt.Sprintf("Couldn't serialize key material as PKIX: %v", err))
+			}
+			bsks[kid] = manifest.BatchSigningPublicKey{PublicKey: pkix}
+		}
+		peks := manifest.PacketEncryptionKeyCSRs{}
+		for _, ts := range info.packetEncryptionKeyVersions {
+			kid := pekKID(li.Locality, ts)
+			csr, err := keytest.Material(kid).PublicAsCSR("some.fqdn")
+			if err != nil {
+				panic(fmt.Sprintf("Couldn't serialize key material as CSR: %v", err))
+			}
+			peks[kid] = manifest.PacketEncryptionCertificate{CertificateSigningRequest: csr}
+		}
+		ms[liToDSP(li)] = manifest.DataShareProcessorSpecificManifest{
+			Format:                  1,
+			IngestionIdentity:       "ingestion-identity",
+			IngestionBucket:         "ingestion-bucket",
+			PeerValidationIdentity:  "peer-validation-identity",
+			PeerValidationBucket:    "peer-validation-bucket",
+			BatchSigningPublicKeys:  bsks,
+			PacketEncryptionKeyCSRs: peks,
+		}
+	}
+	return m
+}
+
+// bsk creates a batch signing key with the given timestamps. Key material is
+// arbitrary, but will match that of other batch signing keys at the same
+// timestamp, locality, & ingestor, and will very likely not match other
+// key materials. If timestamps are provided, the first timestamp is used as
+// the primary key version.
+func bsk(li LI, tss ...int64) key.Key {
+	if len(tss) == 0 {
+		return key.Key{}
+	}
+	var vs []key.Version
+	for _, ts := range tss {
+		vs = append(vs, key.Version{
+			KeyMaterial:       keytest.Material(bskKID(li, ts)),
+			CreationTimestamp: ts,
+		})
+	}
+	k, err := key.FromVersions(vs[0], vs[1:]...)
+	if err != nil {
+		panic(fmt.Sprintf("Couldn't create key: %v", err))
+	}
+	return k
+}
+
+// pek creates a packet encryption key with the given timestamps. Key material
+// is arbitrary, but will match that of other packet encryption keys at the
+// same timestamp & locality, and will very likely not match other key
+// materials. If timestamps are provided, the first timestamp is used as the
+// primary key version.
+func pek(locality string, tss ...int64) key.Key {
+	if len(tss) == 0 {
+		return key.Key{}
+	}
+	var vs []key.Version
+	for _, ts := range tss {
+		vs = append(vs, key.Version{
+			KeyMaterial:       keytest.Material(pekKID(locality, ts)),
+			CreationTimestamp: ts,
+		})
+	}
+	k, err := key.FromVersions(vs[0], vs[1:]...)
+	if err != nil {
+		panic(fmt.Sprintf("Couldn't create key: %v", err))
+	}
+	return k
+}
+
+func bskKID(li LI, ts int64) string {
+	if ts == 0 {
+		return fmt.Sprintf("prio-env-%s-%s-batch-signing-key", li.Locality, li.Ingestor)
+	}
+	return fmt.Sprintf("prio-env-%s-%s-batch-signing-key-%d", li.Locality, li.Ingestor, ts)
+}
+
+func pekKID(locality string, ts int64) string {
+	if ts == 0 {
+		return fmt.Sprintf("prio-env-%s-ingestion-packet-decryption-key", locality)
+	}
+	return fmt.Sprintf("prio-env-%s-ingestion-packet-decryption-key-%d", locality, ts)
+}
+
+func liToDSP(li LI) string { return fmt.Sprintf("%s-%s", li.Locality, li.Ingestor) }
+
+// int64sToSet converts a slice of int64 to an equivalent set.
+func int64sToSet(vals []int64) map[int64]struct{} {
+	rslt := map[int64]struct{}{}
+	for _, i := range vals {
+		rslt[i] = struct{}{}
+	}
+	return rslt
+}
+
+// keyToVersionMap returns a map from UNIX second creation timestamps to key.
+// versions.
+func keyToVersionMap(k key.Key) map[int64]key.Version {
+	rslt := map[int64]key.Version{}
+	_ = k.Versions(func(v key.Version) error {
+		rslt[v.CreationTimestamp] = v
+		return nil
+	})
+	return rslt
+}
+
+// dupStrToKeyMap duplicates a map of strings to key.Keys.
+func dupStrToKeyMap(m map[string]key.Key) map[string]key.Key {
+	rslt := map[string]key.Key{}
+	for k, v := range m {
+		rslt[k] = v
+	}
+	return rslt
+}
+
+// dupLIToKeyMap duplicates a map of LIs to key.Keys.
+func dupLIToKeyMap(m map[LI]key.Key) map[LI]key.Key {
+	rslt := map[LI]key.Key{}
+	for k, v := range m {
+		rslt[k] = v
+	}
+	return rslt
+}
+
+// dupStrToManifestMap duplicates a map of strings to manifests.
+func dupStrToManifestMap(m map[string]manifest.DataShareProcessorSpecificManifest) map[string]manifest.DataShareProcessorSpecificManifest {
+	rslt := map[string]manifest.DataShareProcessorSpecificManifest{}
+	for k, v := range m {
+		rslt[k] = v
+	}
+	return rslt
+}
+
+func li(locality, ingestor string) LI { return LI{Locality: locality, Ingestor: ingestor} }
+
+func TestCompareKeys(t *testing.T) {
+	t.Parallel()
+
+	bskVersions := map[LI][]int64{li("asgard", "ingestor-1"): {100, 200}, li("asgard", "ingestor-2"): {300}}
+	pekVersions := map[string][]int64{"asgard": {400}}
+	manifestInfos := map[LI]manifestInfo{
+		li("asgard", "ingestor-1"): {batchSigningKeyVersions: []int64{100, 200}, packetEncryptionKeyVersions: []int64{400}},
+		li("asgard", "ingestor-2"): {batchSigningKeyVersions: []int64{300}, packetEncryptionKeyVersions: []int64{400}},
+	}
+	env := func(name string, bskVersions map[LI][]int64, manifestInfos map[LI]manifestInfo) compareEnvironment {
+		return compareEnvironment{
+			keyStore:      keyStore(bskVersions, pekVersions),
+			manifestStore: manifestStore(manifestInfos),
+			name:          name,
+		}
+	}
+
+	for _, test := range []struct {
+		name            string
+		replica         compareEnvironment
+		wantDivergences int
+	}{
+		{
+			name:    "identical",
+			replica: env("replica", bskVersions, manifestInfos),
+		},
+		{
+			name: "missing key version",
+			replica: env("replica",
+				map[LI][]int64{li("asgard", "ingestor-1"): {100}, li("asgard", "ingestor-2"): {300}},
+				manifestInfos),
+			wantDivergences: 1,
+		},
+		{
+			name: "different primary & stale manifest",
+			replica: env("replica",
+				map[LI][]int64{li("asgard", "ingestor-1"): {200, 100}, li("asgard", "ingestor-2"): {300}},
+				map[LI]manifestInfo{
+					li("asgard", "ingestor-1"): {batchSigningKeyVersions: []int64{100, 200}, packetEncryptionKeyVersions: []int64{400}},
+					li("asgard", "ingestor-2"): {batchSigningKeyVersions: []int64{300}},
+				}),
+			wantDivergences: 2,
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			divergences, err := compareKeys(ctx, compareKeysConfig{
+				a:         env("prod", bskVersions, manifestInfos),
+				b:         test.replica,
+				locality:  "asgard",
+				ingestors: []string{"ingestor-1", "ingestor-2"},
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error from compareKeys: %v", err)
+			}
+			if len(divergences) != test.wantDivergences {
+				t.Errorf("Got %d divergences, want %d: %q", len(divergences), test.wantDivergences, divergences)
+			}
+		})
+	}
+}
+
+func TestVerifyBackups(t *testing.T) {
+	t.Parallel()
+
+	bskVersions := map[LI][]int64{li("asgard", "ingestor-1"): {100, 200}, li("asgard", "ingestor-2"): {300}}
+	pekVersions := map[string][]int64{"asgard": {400}}
+
+	for _, test := range []struct {
+		name            string
+		backup          *storagetest.Key
+		repair          bool
+		wantDivergences int
+		wantRepaired    int
+	}{
+		{
+			name:   "identical",
+			backup: keyStore(bskVersions, pekVersions),
+		},
+		{
+			name:            "missing key version & missing key",
+			backup:          keyStore(map[LI][]int64{li("asgard", "ingestor-1"): {100}}, pekVersions),
+			wantDivergences: 2,
+		},
+		{
+			name:            "different primary, repaired",
+			backup:          keyStore(map[LI][]int64{li("asgard", "ingestor-1"): {200, 100}, li("asgard", "ingestor-2"): {300}}, pekVersions),
+			repair:          true,
+			wantDivergences: 1,
+			wantRepaired:    1,
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			primary := keyStore(bskVersions, pekVersions)
+			// The second backup always matches.
+			backups := []verifyBackup{{keyStore: test.backup, name: "aws"}, {keyStore: keyStore(bskVersions, pekVersions), name: "vault"}}
+			cfg := verifyBackupsConfig{
+				keyStore:  primary,
+				backups:   backups,
+				locality:  "asgard",
+				ingestors: []string{"ingestor-1", "ingestor-2"},
+				repair:    test.repair,
+			}
+			divergences, err := verifyBackups(ctx, cfg)
+			if err != nil {
+				t.Fatalf("Unexpected error from verifyBackups: %v", err)
+			}
+			repaired := 0
+			for _, d := range divergences {
+				if d.repaired {
+					repaired++
+				}
+			}
+			if len(divergences) != test.wantDivergences || repaired != test.wantRepaired {
+				t.Errorf("Got %d divergences (%d repaired), want %d (%d repaired): %v",
+					len(divergences), repaired, test.wantDivergences, test.wantRepaired, divergences)
+			}
+
+			// Once repaired, backups match.
+			if test.repair {
+				cfg.repair = false
+				if divergences, err := verifyBackups(ctx, cfg); err != nil || len(divergences) != 0 {
+					t.Errorf("Got divergences %v, error %v after repair, want none", divergences, err)
+				}
+			}
+		})
+	}
+
+	t.Run("empty key not repaired", func(t *testing.T) {
+		t.Parallel()
+		primary := keyStore(map[LI][]int64{li("asgard", "ingestor-1"): {}}, pekVersions)
+		backup := keyStore(map[LI][]int64{li("asgard", "ingestor-1"): {100}}, pekVersions)
+		divergences, err := verifyBackups(ctx, verifyBackupsConfig{
+			keyStore:  primary,
+			backups:   []verifyBackup{{keyStore: backup, name: "aws"}},
+			locality:  "asgard",
+			ingestors: []string{"ingestor-1"},
+			repair:    true,
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error from verifyBackups: %v", err)
+		}
+		if len(divergences) != 1 || divergences[0].repaired {
+			t.Errorf("Got divergences %v, want one unrepaired divergence", divergences)
+		}
+		if backup.BatchSigningKeys()[li("asgard", "ingestor-1")].IsEmpty() {
+			t.Errorf("Backup overwritten with empty key")
+		}
+	})
+}
+
+func TestMigrateKeyStore(t *testing.T) {
+	t.Parallel()
+
+	// ingestor-1's key is already migrated, ingestor-2's is missing from the
+	// target, ingestor-3's is empty in the source, and the packet encryption
+	// key differs.
+	from := keyStore(map[LI][]int64{li("asgard", "ingestor-1"): {100, 200}, li("asgard", "ingestor-2"): {300}, li("asgard", "ingestor-3"): {}}, map[string][]int64{"asgard": {400, 500}})
+	to := keyStore(map[LI][]int64{li("asgard", "ingestor-1"): {100, 200}}, map[string][]int64{"asgard": {400}})
+	cfg := migrateKeyStoreConfig{
+		from:      from,
+		to:        to,
+		locality:  "asgard",
+		ingestors: []string{"ingestor-1", "ingestor-2", "ingestor-3"},
+	}
+
+	copied, err := migrateKeyStore(ctx, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error from migrateKeyStore: %v", err)
+	}
+	if copied != 2 {
+		t.Errorf("migrateKeyStore copied %d keys, want 2", copied)
+	}
+	if diff := cmp.Diff(from.PacketEncryptionKeys(), to.PacketEncryptionKeys()); diff != "" {
+		t.Errorf("Packet encryption keys differ after migration (-from +to):\n%s", diff)
+	}
+	wantBSKs := map[LI]key.Key{}
+	for li, k := range from.BatchSigningKeys() {
+		if !k.IsEmpty() {
+			wantBSKs[li] = k
+		}
+	}
+	if diff := cmp.Diff(wantBSKs, to.BatchSigningKeys()); diff != "" {
+		t.Errorf("Batch signing keys differ after migration (-from +to):\n%s", diff)
+	}
+
+	// Once migrated, no keys are copied.
+	if copied, err := migrateKeyStore(ctx, cfg); err != nil || copied != 0 {
+		t.Errorf("Second migrateKeyStore copied %d keys with error %v, want 0 keys copied", copied, err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	t.Parallel()
+
+	backupBSKs := map[LI][]int64{li("asgard", "ingestor-1"): {100, 200}, li("asgard", "ingestor-2"): {300}}
+	backupPEKs := map[string][]int64{"asgard": {400, 500}}
+	manifests := map[LI]manifestInfo{
+		li("asgard", "ingestor-1"): {batchSigningKeyVersions: []int64{100, 200}, packetEncryptionKeyVersions: []int64{400}},
+		li("asgard", "ingestor-2"): {batchSigningKeyVersions: []int64{300}, packetEncryptionKeyVersions: []int64{400}},
+	}
+	newConfig := func(backup, to storage.Key, manifests map[LI]manifestInfo, dryRun bool) restoreConfig {
+		return restoreConfig{
+			rotate: rotateKeysConfig{
+				keyStore:        backup,
+				manifestStore:   manifestStore(manifests),
+				locality:        "asgard",
+				ingestors:       []string{"ingestor-1", "ingestor-2"},
+				prioEnvironment: "prio-env",
+			},
+			to:     to,
+			from:   "aws",
+			dryRun: dryRun,
+		}
+	}
+
+	t.Run("restore", func(t *testing.T) {
+		t.Parallel()
+		// ingestor-1's key is intact, ingestor-2's is missing, and the packet
+		// encryption key has lost a version.
+		backup := keyStore(backupBSKs, backupPEKs)
+		to := keyStore(map[LI][]int64{li("asgard", "ingestor-1"): {100, 200}}, map[string][]int64{"asgard": {400}})
+
+		var buf bytes.Buffer
+		if err := restore(ctx, newConfig(backup, to, manifests, false), &buf); err != nil {
+			t.Fatalf("Unexpected error from restore: %v", err)
+		}
+		var report restoreReport
+		if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+			t.Fatalf("Couldn't parse report: %v", err)
+		}
+		var restored []string
+		for _, k := range report.Keys {
+			if k.Restored {
+				restored = append(restored, k.Name)
+			}
+		}
+		wantRestored := []string{`packet encryption key for "asgard"`, `batch signing key for ("asgard", "ingestor-2")`}
+		if diff := cmp.Diff(wantRestored, restored); diff != "" {
+			t.Errorf("Unexpected restored keys (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(backup.PacketEncryptionKeys(), to.PacketEncryptionKeys()); diff != "" {
+			t.Errorf("Packet encryption keys differ after restore (-backup +to):\n%s", diff)
+		}
+		if diff := cmp.Diff(backup.BatchSigningKeys(), to.BatchSigningKeys()); diff != "" {
+			t.Errorf("Batch signing keys differ after restore (-backup +to):\n%s", diff)
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		t.Parallel()
+		to := keyStore(nil, nil)
+		var buf bytes.Buffer
+		if err := restore(ctx, newConfig(keyStore(backupBSKs, backupPEKs), dryRunKeyStore{to}, manifests, true), &buf); err != nil {
+			t.Fatalf("Unexpected error from restore: %v", err)
+		}
+		var report restoreReport
+		if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+			t.Fatalf("Couldn't parse report: %v", err)
+		}
+		if !report.DryRun || len(report.Keys) != 3 {
+			t.Errorf("Unexpected report: %+v", report)
+		}
+		if len(to.PacketEncryptionKeys()) != 0 || len(to.BatchSigningKeys()) != 0 {
+			t.Errorf("Keys were written in dry-run mode")
+		}
+	})
+
+	t.Run("stale backup", func(t *testing.T) {
+		t.Parallel()
+		// The manifests publish a batch signing key version missing from
+		// the backup, so nothing is restored.
+		stale := map[LI]manifestInfo{
+			li("asgard", "ingestor-1"): {batchSigningKeyVersions: []int64{100, 200, 600}, packetEncryptionKeyVersions: []int64{400}},
+			li("asgard", "ingestor-2"): manifests[li("asgard", "ingestor-2")],
+		}
+		to := keyStore(nil, nil)
+		var buf bytes.Buffer
+		if err := restore(ctx, newConfig(keyStore(backupBSKs, backupPEKs), to, stale, false), &buf); err == nil {
+			t.Errorf("Wanted error from restore of stale backup")
+		}
+		if len(to.PacketEncryptionKeys()) != 0 || len(to.BatchSigningKeys()) != 0 || buf.Len() != 0 {
+			t.Errorf("Keys were restored from stale backup")
+		}
+	})
+}
+
+func TestIsKeyStoreKind(t *testing.T) {
+	t.Parallel()
+	for kind, want := range map[string]bool{
+		"kubernetes":     true,
+		"vault":          true,
+		"aws":            true,
+		"gcp:my-project": true,
+		"gcp:":           false,
+		"gcp":            false,
+		"azure":          false,
+		"":               false,
+	} {
+		if got := isKeyStoreKind(kind); got != want {
+			t.Errorf("isKeyStoreKind(%q) = %v, want %v", kind, got, want)
+		}
+	}
+}
+
+func TestExportPublic(t *testing.T) {
+	t.Parallel()
+
+	ks := keyStore(map[LI][]int64{li("asgard", "ingestor-1"): {200, 100}}, map[string][]int64{"asgard": {300}})
+	bskMaterial, pekMaterial := keytest.Material(bskKID(li("asgard", "ingestor-1"), 200)), keytest.Material(pekKID("asgard", 300))
+
+	for _, test := range []struct {
+		format key.PublicKeyFormat
+		encode func(key.Material) (string, error)
+	}{
+		{
+			format: key.PEM,
+			encode: func(m key.Material) (string, error) { return m.PublicAsPKIX() },
+		},
+		{
+			format: key.DER,
+			encode: func(m key.Material) (string, error) {
+				der, err := m.PublicAsPKIXDER()
+				return base64.StdEncoding.EncodeToString(der), err
+			},
+		},
+		{
+			format: key.Raw,
+			encode: func(m key.Material) (string, error) {
+				raw, err := m.PublicAsX962Compressed()
+				return base64.StdEncoding.EncodeToString(raw), err
+			},
+		},
+	} {
+		test := test
+		t.Run(string(test.format), func(t *testing.T) {
+			t.Parallel()
+			var buf bytes.Buffer
+			if err := exportPublic(ctx, exportPublicConfig{
+				keyStore:        ks,
+				prioEnvironment: "prio-env",
+				locality:        "asgard",
+				ingestors:       []string{"ingestor-1"},
+				format:          test.format,
+			}, &buf); err != nil {
+				t.Fatalf("Unexpected error from exportPublic: %v", err)
+			}
+			var got map[string]string
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatalf("Couldn't parse exported public keys: %v", err)
+			}
+
+			wantBSK, err := test.encode(bskMaterial)
+			if err != nil {
+				t.Fatalf("Couldn't encode batch signing key: %v", err)
+			}
+			wantPEK, err := test.encode(pekMaterial)
+			if err != nil {
+				t.Fatalf("Couldn't encode packet encryption key: %v", err)
+			}
+			want := map[string]string{
+				"asgard-ingestor-1.batch-signing-key-id":         bskKID(li("asgard", "ingestor-1"), 200),
+				"asgard-ingestor-1.batch-signing-public-key":     wantBSK,
+				"asgard-ingestor-1.packet-encryption-key-id":     pekKID("asgard", 300),
+				"asgard-ingestor-1.packet-encryption-public-key": wantPEK,
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("Unexpected exported public keys (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// A missing key is an error.
+	if err := exportPublic(ctx, exportPublicConfig{
+		keyStore:        ks,
+		prioEnvironment: "prio-env",
+		locality:        "asgard",
+		ingestors:       []string{"ingestor-2"},
+		format:          key.PEM,
+	}, io.Discard); err == nil {
+		t.Errorf("Wanted error from exportPublic with missing batch signing key, got none")
+	}
+}
+
+func TestInspect(t *testing.T) {
+	t.Parallel()
+
+	rotationCFG := key.RotationConfig{
+		CreateKeyFunc:     key.P256.New,
+		CreateMinAge:      10000 * time.Second,
+		PrimaryMinAge:     1000 * time.Second,
+		DeleteMinAge:      20000 * time.Second,
+		DeleteMinKeyCount: 2,
+	}
+	cfg := rotateKeysConfig{
+		keyStore: keyStore(
+			map[LI][]int64{li("asgard", "ingestor-1"): {20000, 10000}, li("asgard", "ingestor-2"): {30000}},
+			map[string][]int64{"asgard": {25000}}),
+		// The manifest for ingestor-2 is stale: it publishes neither its
+		// batch signing key nor the primary packet encryption key version.
+		manifestStore: manifestStore(map[LI]manifestInfo{
+			li("asgard", "ingestor-1"): {batchSigningKeyVersions: []int64{20000, 10000}, packetEncryptionKeyVersions: []int64{25000}},
+			li("asgard", "ingestor-2"): {batchSigningKeyVersions: []int64{100}, packetEncryptionKeyVersions: []int64{100}},
+		}),
+		now:             time.Unix(40000, 0),
+		locality:        "asgard",
+		ingestors:       []string{"ingestor-1", "ingestor-2"},
+		prioEnvironment: "prio-env",
+		batchCFG:        rotateKeyConfig{enableRotation: true, rotationCFG: rotationCFG},
+		packetCFG:       rotateKeyConfig{rotationCFG: rotationCFG},
+	}
+
+	var buf bytes.Buffer
+	if err := inspect(ctx, inspectConfig{rotate: cfg, json: true}, &buf); err != nil {
+		t.Fatalf("Unexpected error from inspect: %v", err)
+	}
+	var got inspectReport
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Couldn't parse report: %v", err)
+	}
+	want := inspectReport{
+		Locality: "asgard",
+		Time:     "1970-01-01T11:06:40Z",
+		PacketEncryptionKey: inspectKey{
+			NextCreation: "1970-01-01T09:43:20Z",
+			Versions: []inspectKeyVersion{{
+				KeyID:             pekKID("asgard", 25000),
+				Algorithm:         "P256",
+				CreationTimestamp: 25000,
+				AgeSeconds:        15000,
+				Primary:           true,
+				PrimaryEligible:   "1970-01-01T07:13:20Z",
+				DeletionEligible:  "1970-01-01T12:30:00Z",
+			}},
+		},
+		BatchSigningKeys: map[string]inspectKey{
+			"ingestor-1": {
+				RotationEnabled: true,
+				NextCreation:    "1970-01-01T08:20:00Z",
+				Versions: []inspectKeyVersion{
+					{
+						KeyID:             bskKID(li("asgard", "ingestor-1"), 20000),
+						Algorithm:         "P256",
+						CreationTimestamp: 20000,
+						AgeSeconds:        20000,
+						Primary:           true,
+						PrimaryEligible:   "1970-01-01T05:50:00Z",
+						DeletionEligible:  "1970-01-01T11:06:40Z",
+					},
+					{
+						KeyID:             bskKID(li("asgard", "ingestor-1"), 10000),
+						Algorithm:         "P256",
+						CreationTimestamp: 10000,
+						AgeSeconds:        30000,
+						PrimaryEligible:   "1970-01-01T03:03:20Z",
+						DeletionEligible:  "1970-01-01T08:20:00Z",
+					},
+				},
+			},
+			"ingestor-2": {
+				RotationEnabled: true,
+				NextCreation:    "1970-01-01T11:06:40Z",
+				Versions: []inspectKeyVersion{{
+					KeyID:             bskKID(li("asgard", "ingestor-2"), 30000),
+					Algorithm:         "P256",
+					CreationTimestamp: 30000,
+					AgeSeconds:        10000,
+					Primary:           true,
+					PrimaryEligible:   "1970-01-01T08:36:40Z",
+					DeletionEligible:  "1970-01-01T13:53:20Z",
+				}},
+			},
+		},
+		Mismatches: []string{
+			fmt.Sprintf(`manifest for ("asgard", "ingestor-2"): batch signing key version %q is not published in manifest`, bskKID(li("asgard", "ingestor-2"), 30000)),
+			fmt.Sprintf(`manifest for ("asgard", "ingestor-2"): manifest publishes batch signing key version %q, which is not a current key version`, bskKID(li("asgard", "ingestor-2"), 100)),
+			fmt.Sprintf(`manifest for ("asgard", "ingestor-2"): packet encryption key version %q is not published in manifest`, pekKID("asgard", 25000)),
+			fmt.Sprintf(`manifest for ("asgard", "ingestor-2"): manifest publishes packet encryption key version %q, which is not a current key version`, pekKID("asgard", 100)),
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected report (-want +got):\n%s", diff)
+	}
+
+	// The human-readable report includes every key version & mismatch.
+	buf.Reset()
+	if err := inspect(ctx, inspectConfig{rotate: cfg}, &buf); err != nil {
+		t.Fatalf("Unexpected error from inspect: %v", err)
+	}
+	for _, s := range append([]string{
+		bskKID(li("asgard", "ingestor-1"), 20000),
+		bskKID(li("asgard", "ingestor-1"), 10000),
+		bskKID(li("asgard", "ingestor-2"), 30000),
+		pekKID("asgard", 25000),
+		"4 mismatches between keys & manifests",
+	}, want.Mismatches...) {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("Report does not contain %q:\n%s", s, buf.String())
+		}
+	}
+}
+
+func TestDiscoverLocalities(t *testing.T) {
+	t.Parallel()
+
+	ms := manifestStore(map[LI]manifestInfo{
+		li("asgard", "ingestor-1"):                                       {},
+		li("asgard", "ingestor-2"):                                       {},
+		li("midgard", "ingestor-2"):                                      {},
+		li("jotunheim", "other-ingestor"):                                {},
+		li(smokeTestLocality("asgard", time.Unix(100, 0)), "ingestor-1"): {},
+	})
+	got, err := discoverLocalities(ctx, ms, []string{"ingestor-1", "ingestor-2"})
+	if err != nil {
+		t.Fatalf("Unexpected error from discoverLocalities: %v", err)
+	}
+	if diff := cmp.Diff([]string{"asgard", "midgard"}, got); diff != "" {
+		t.Errorf("Unexpected localities (-want +got):\n%s", diff)
+	}
+}
+
+func TestRotateLocalities(t *testing.T) {
+	t.Parallel()
+
+	const concurrency = 2
+	var mu sync.Mutex // protects running, maxRunning, rotated
+	var running, maxRunning int
+	var rotated []string
+	var releaseOnce sync.Once
+	release := make(chan struct{}) // closed once concurrency localities are being rotated at once
+	start := time.Now()
+	failed, err := rotateLocalities(ctx, rotateLocalitiesConfig{
+		rotate: func(_ context.Context, locality string) error {
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			if running == concurrency {
+				releaseOnce.Do(func() { close(release) })
+			}
+			mu.Unlock()
+			<-release
+
+			mu.Lock()
+			defer mu.Unlock()
+			running--
+			rotated = append(rotated, locality)
+			if strings.HasPrefix(locality, "bad-") {
+				return errors.New("rotation failed")
+			}
+			return nil
+		},
+		localities:  []string{"asgard", "bad-midgard", "jotunheim", "bad-vanaheim", "alfheim"},
+		concurrency: concurrency,
+	})
+	if err == nil {
+		t.Errorf("Wanted error from rotateLocalities, got none")
+	}
+	if diff := cmp.Diff([]string{"bad-midgard", "bad-vanaheim"}, failed); diff != "" {
+		t.Errorf("Unexpected failed localities (-want +got):\n%s", diff)
+	}
+	if len(rotated) != 5 {
+		t.Errorf("Rotated %d localities (%q), want 5: a failure should not prevent rotation of other localities", len(rotated), rotated)
+	}
+	if maxRunning > concurrency {
+		t.Errorf("Rotated %d localities concurrently, want at most %d", maxRunning, concurrency)
+	}
+
+	// Last success & last failure are recorded per locality.
+	for _, test := range []struct {
+		locality                 string
+		wantSuccess, wantFailure bool
+	}{
+		{locality: "jotunheim", wantSuccess: true},
+		{locality: "bad-midgard", wantFailure: true},
+	} {
+		if got := testutil.ToFloat64(lastSuccess.WithLabelValues(test.locality)) >= float64(start.Unix()); got != test.wantSuccess {
+			t.Errorf("Last success recorded for %q: %v, want %v", test.locality, got, test.wantSuccess)
+		}
+		if got := testutil.ToFloat64(lastFailure.WithLabelValues(test.locality)) >= float64(start.Unix()); got != test.wantFailure {
+			t.Errorf("Last failure recorded for %q: %v, want %v", test.locality, got, test.wantFailure)
+		}
+	}
+}
+
+func TestReadTargetsFile(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name        string
+		contents    string
+		wantTargets []rotationTarget
+		wantErr     bool
+	}{
+		{
+			name: "yaml",
+			contents: `
+targets:
+- prio-environment: prod-us
+  locality: us-ca
+  ingestors: [apple, g-enpa]
+  manifest-bucket-url: s3://us-west-1/prod-us-manifests
+  kubeconfig: /etc/kube/prod-us
+- name: intl
+  prio-environment: prod-intl
+  localities: [all]
+  flags:
+    aws-region: eu-west-1
+`,
+			wantTargets: []rotationTarget{
+				{
+					Name:              "prod-us/us-ca",
+					PrioEnvironment:   "prod-us",
+					Locality:          "us-ca",
+					Ingestors:         []string{"apple", "g-enpa"},
+					ManifestBucketURL: "s3://us-west-1/prod-us-manifests",
+					Kubeconfig:        "/etc/kube/prod-us",
+				},
+				{
+					Name:            "intl",
+					PrioEnvironment: "prod-intl",
+					Localities:      []string{"all"},
+					Flags:           map[string]string{"aws-region": "eu-west-1"},
+				},
+			},
+		},
+		{
+			name:        "json",
+			contents:    `{"targets": [{"prio-environment": "prod-us", "locality": "us-ca"}]}`,
+			wantTargets: []rotationTarget{{Name: "prod-us/us-ca", PrioEnvironment: "prod-us", Locality: "us-ca"}},
+		},
+		{name: "no targets", contents: `targets: []`, wantErr: true},
+		{name: "unknown field", contents: `targets: [{locality: us-ca, region: us-west-1}]`, wantErr: true},
+		{name: "no locality", contents: `targets: [{prio-environment: prod-us}]`, wantErr: true},
+		{name: "locality & localities", contents: `targets: [{locality: us-ca, localities: [us-wa]}]`, wantErr: true},
+		{name: "duplicate names", contents: `targets: [{locality: us-ca}, {locality: us-ca}]`, wantErr: true},
+		{name: "unknown flag", contents: `targets: [{locality: us-ca, flags: {no-such-flag: "1"}}]`, wantErr: true},
+		{name: "disallowed flag", contents: `targets: [{locality: us-ca, flags: {targets-file: other.yaml}}]`, wantErr: true},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "targets.yaml")
+			if err := os.WriteFile(path, []byte(test.contents), 0o600); err != nil {
+				t.Fatalf("Couldn't write targets file: %v", err)
+			}
+			targets, err := readTargetsFile(path)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("Wanted error from readTargetsFile, got targets %+v", targets)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error from readTargetsFile: %v", err)
+			}
+			if diff := cmp.Diff(test.wantTargets, targets); diff != "" {
+				t.Errorf("Unexpected targets (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRotateTargets(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex // protects argsByTarget
+	argsByTarget := map[string][]string{}
+	var results bytes.Buffer
+	failed, err := rotateTargets(ctx, rotateTargetsConfig{
+		run: func(_ context.Context, target string, args []string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			argsByTarget[target] = args
+			if strings.HasPrefix(target, "bad-") {
+				return errors.New("rotation failed")
+			}
+			return nil
+		},
+		targets: []rotationTarget{
+			{Name: "bad-prod-us", PrioEnvironment: "prod-us", Locality: "us-ca", Ingestors: []string{"apple", "g-enpa"}},
+			{Name: "prod-intl", PrioEnvironment: "prod-intl", Localities: []string{"all"}, Flags: map[string]string{"dry-run": "true", "aws-region": "eu-west-1"}},
+		},
+		sharedArgs:  []string{"--csr-fqdn=example.com", "--prio-environment=default"},
+		concurrency: 2,
+	}, &results)
+	if err == nil {
+		t.Errorf("Wanted error from rotateTargets, got none")
+	}
+	if diff := cmp.Diff([]string{"bad-prod-us"}, failed); diff != "" {
+		t.Errorf("Unexpected failed targets (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string][]string{
+		"bad-prod-us": {"--csr-fqdn=example.com", "--prio-environment=default", "--prio-environment=prod-us", "--locality=us-ca", "--ingestors=apple,g-enpa"},
+		"prod-intl":   {"--csr-fqdn=example.com", "--prio-environment=default", "--prio-environment=prod-intl", "--localities=all", "--aws-region=eu-west-1", "--dry-run=true"},
+	}, argsByTarget); diff != "" {
+		t.Errorf("Unexpected arguments (-want +got):\n%s", diff)
+	}
+
+	var gotResults []targetResult
+	dec := json.NewDecoder(&results)
+	for dec.More() {
+		var result targetResult
+		if err := dec.Decode(&result); err != nil {
+			t.Fatalf("Couldn't decode result: %v", err)
+		}
+		result.DurationSeconds = 0
+		gotResults = append(gotResults, result)
+	}
+	if diff := cmp.Diff([]targetResult{
+		{Target: "bad-prod-us", Error: "rotation failed"},
+		{Target: "prod-intl", OK: true},
+	}, gotResults); diff != "" {
+		t.Errorf("Unexpected results (-want +got):\n%s", diff)
+	}
+}
+
+func TestSmokeTest(t *testing.T) {
+	t.Parallel()
+
+	newCFG := func(keyStore storage.Key, backupKeyStores []storage.Key, manifestStore *storagetest.Manifest) smokeTestConfig {
+		stableCFG := rotateKeyConfig{enableRotation: true, rotationCFG: key.RotationConfig{
+			CreateKeyFunc:     key.P256.New,
+			CreateMinAge:      10000 * time.Second,
+			PrimaryMinAge:     1000 * time.Second,
+			DeleteMinAge:      20000 * time.Second,
+			DeleteMinKeyCount: 2,
+		}}
+		return smokeTestConfig{
+			backupKeyStores: backupKeyStores,
+			createKeys: func(ctx context.Context) error {
+				return createEmptyKeys(ctx, keyStore, smokeTestLocality("asgard", time.Unix(100000, 0)), []string{"ingestor-1", "ingestor-2"}, true)
+			},
+			rotate: rotateKeysConfig{
+				keyStore:             keyStore,
+				manifestStore:        manifestStore,
+				now:                  time.Unix(100000, 0),
+				locality:             smokeTestLocality("asgard", time.Unix(100000, 0)),
+				ingestors:            []string{"ingestor-1", "ingestor-2"},
+				prioEnvironment:      "prio-env",
+				csrFQDN:              "some.fqdn",
+				batchCFG:             stableCFG,
+				packetCFG:            stableCFG,
+				manageTaskSigningKey: true,
+				taskCFG:              stableCFG,
+			},
+		}
+	}
+	wantCleanedUp := func(t *testing.T, keyStores []*storagetest.Key, manifestStore *storagetest.Manifest) {
+		t.Helper()
+		for _, ks := range keyStores {
+			if len(ks.BatchSigningKeys()) > 0 || len(ks.PacketEncryptionKeys()) > 0 || len(ks.TaskSigningKeys()) > 0 {
+				t.Errorf("Keys remain after smoke test: %v, %v, %v", ks.BatchSigningKeys(), ks.PacketEncryptionKeys(), ks.TaskSigningKeys())
+			}
+		}
+		if got := manifestStore.GetDataShareProcessorSpecificManifests(); len(got) > 0 {
+			t.Errorf("Manifests remain after smoke test: %v", got)
+		}
+		if got := manifestStore.GetRotationStatuses(); len(got) > 0 {
+			t.Errorf("Rotation statuses remain after smoke test: %v", got)
+		}
+	}
+
+	t.Run("pass", func(t *testing.T) {
+		t.Parallel()
+		mainKeyStore, backupKeyStore, manifestStore := storagetest.NewKey(), storagetest.NewKey(), storagetest.NewManifest()
+		cfg := newCFG(storage.NewBackupKey(mainKeyStore, backupKeyStore), []storage.Key{backupKeyStore}, manifestStore)
+		if err := smokeTest(ctx, cfg); err != nil {
+			t.Errorf("Unexpected error from smokeTest: %v", err)
+		}
+		wantCleanedUp(t, []*storagetest.Key{mainKeyStore, backupKeyStore}, manifestStore)
+	})
+
+	t.Run("keys not backed up", func(t *testing.T) {
+		t.Parallel()
+		mainKeyStore, backupKeyStore, manifestStore := storagetest.NewKey(), storagetest.NewKey(), storagetest.NewManifest()
+		cfg := newCFG(mainKeyStore, []storage.Key{backupKeyStore}, manifestStore)
+		if err := smokeTest(ctx, cfg); err == nil {
+			t.Errorf("Wanted error from smokeTest with keys missing from backup, got none")
+		}
+		wantCleanedUp(t, []*storagetest.Key{mainKeyStore}, manifestStore)
+	})
+
+	t.Run("key creation failure", func(t *testing.T) {
+		t.Parallel()
+		keyStore, manifestStore := storagetest.NewKey(), storagetest.NewManifest()
+		cfg := newCFG(keyStore, nil, manifestStore)
+		cfg.createKeys = func(context.Context) error { return errors.New("secret already exists") }
+		if err := smokeTest(ctx, cfg); err == nil {
+			t.Errorf("Wanted error from smokeTest with key creation failure, got none")
+		}
+		if got := manifestStore.GetDataShareProcessorSpecificManifestPutCount(dspName(cfg.rotate.locality, "ingestor-1")); got != 0 {
+			t.Errorf("Manifest written %d times despite key creation failure, want 0", got)
+		}
+	})
+}
+
+func TestSPIFFEConfig(t *testing.T) {
+	t.Parallel()
+
+	t.Run("validate", func(t *testing.T) {
+		t.Parallel()
+		for _, test := range []struct {
+			name    string
+			cfg     spiffeConfig
+			wantErr bool
+		}{
+			{"empty", spiffeConfig{}, false},
+			{"aws", spiffeConfig{awsRoleARN: "arn", awsJWTSVIDPath: "/svid/aws"}, false},
+			{"aws missing path", spiffeConfig{awsRoleARN: "arn"}, true},
+			{"gcp", spiffeConfig{gcpWorkloadIdentityProvider: "provider", gcpJWTSVIDPath: "/svid/gcp", gcpServiceAccount: "sa@example.com"}, false},
+			{"gcp missing provider", spiffeConfig{gcpJWTSVIDPath: "/svid/gcp"}, true},
+			{"gcp service account without provider", spiffeConfig{gcpServiceAccount: "sa@example.com"}, true},
+		} {
+			test := test
+			t.Run(test.name, func(t *testing.T) {
+				t.Parallel()
+				if err := test.cfg.validate(); (err != nil) != test.wantErr {
+					t.Errorf("Unexpected error from validate (wantErr = %v): %v", test.wantErr, err)
+				}
+			})
+		}
+	})
+
+	t.Run("gcpExternalAccountJSON", func(t *testing.T) {
+		t.Parallel()
+		cfg := spiffeConfig{
+			gcpWorkloadIdentityProvider: "projects/1234/locations/global/workloadIdentityPools/pool/providers/provider",
+			gcpJWTSVIDPath:              "/svid/gcp",
+			gcpServiceAccount:           "sa@example.com",
+		}
+		credsJSON, err := cfg.gcpExternalAccountJSON()
+		if err != nil {
+			t.Fatalf("Unexpected error from gcpExternalAccountJSON: %v", err)
+		}
+		var got map[string]interface{}
+		if err := json.Unmarshal(credsJSON, &got); err != nil {
+			t.Fatalf("Couldn't unmarshal credentials JSON: %v", err)
+		}
+		for field, want := range map[string]string{
+			"type":                              "external_account",
+			"audience":                          "//iam.googleapis.com/projects/1234/locations/global/workloadIdentityPools/pool/providers/provider",
+			"subject_token_type":                "urn:ietf:params:oauth:token-type:jwt",
+			"service_account_impersonation_url": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/sa@example.com:generateAccessToken",
+		} {
+			if got[field] != want {
+				t.Errorf("Credentials field %q = %v, want %q", field, got[field], want)
+			}
+		}
+		if src, ok := got["credential_source"].(map[string]interface{}); !ok || src["file"] != "/svid/gcp" {
+			t.Errorf("Credentials field \"credential_source\" = %v, want file %q", got["credential_source"], "/svid/gcp")
+		}
+	})
+}
+
+func TestUpdateKeyRotationStatus(t *testing.T) {
+	t.Parallel()
+
+	firstRotation := time.Unix(100000, 0).UTC()
+	secondRotation := firstRotation.Add(time.Hour)
+
+	for _, test := range []struct {
+		name                 string
+		err                  error
+		wantLastRotation     time.Time
+		wantKeysHealthy      metav1.ConditionStatus
+		wantManifestsHealthy metav1.ConditionStatus
+	}{
+		{"success", nil, secondRotation, metav1.ConditionTrue, metav1.ConditionTrue},
+		{"manifest error", manifestError{errors.New("bad manifest")}, firstRotation, metav1.ConditionTrue, metav1.ConditionFalse},
+		{"wrapped manifest error", fmt.Errorf("couldn't rotate: %w", manifestError{errors.New("bad manifest")}), firstRotation, metav1.ConditionTrue, metav1.ConditionFalse},
+		{"key error", errors.New("bad key"), firstRotation, metav1.ConditionFalse, metav1.ConditionUnknown},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Start from the status recorded by a successful rotation.
+			var status keyRotationStatus
+			updateKeyRotationStatus(&status, 1, firstRotation, nil)
+			updateKeyRotationStatus(&status, 2, secondRotation, test.err)
+
+			if status.ObservedGeneration != 2 {
+				t.Errorf("Unexpected observed generation: got %d, want 2", status.ObservedGeneration)
+			}
+			if status.LastRotationTime == nil || !status.LastRotationTime.Time.Equal(test.wantLastRotation) {
+				t.Errorf("Unexpected last rotation time: got %v, want %v", status.LastRotationTime, test.wantLastRotation)
+			}
+			for condType, wantStatus := range map[string]metav1.ConditionStatus{
+				conditionKeysHealthy:      test.wantKeysHealthy,
+				conditionManifestsHealthy: test.wantManifestsHealthy,
+			} {
+				cond := meta.FindStatusCondition(status.Conditions, condType)
+				if cond == nil {
+					t.Errorf("Missing condition %q", condType)
+					continue
+				}
+				if cond.Status != wantStatus {
+					t.Errorf("Unexpected status for condition %q: got %q, want %q", condType, cond.Status, wantStatus)
+				}
+				if cond.ObservedGeneration != 2 {
+					t.Errorf("Unexpected observed generation for condition %q: got %d, want 2", condType, cond.ObservedGeneration)
+				}
+				wantTransition := firstRotation
+				if wantStatus != metav1.ConditionTrue {
+					wantTransition = secondRotation
+				}
+				if !cond.LastTransitionTime.Time.Equal(wantTransition) {
+					t.Errorf("Unexpected last transition time for condition %q: got %v, want %v", condType, cond.LastTransitionTime, wantTransition)
+				}
+			}
+		})
+	}
+}
+
+// recordingHook is a manifestHook which records the events it is invoked with,
+// failing if err is set.
+type recordingHook struct {
+	mu     sync.Mutex
+	events []manifestHookEvent
+	err    error
+}
+
+func (h *recordingHook) run(_ context.Context, event manifestHookEvent) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, event)
+	return h.err
+}
+
+func TestManifestHooks(t *testing.T) {
+	t.Parallel()
+
+	oldManifest := manifest.DataShareProcessorSpecificManifest{Format: 1}
+	newManifest := manifest.DataShareProcessorSpecificManifest{Format: 1, IngestionBucket: "new-bucket"}
+
+	t.Run("writeManifests", func(t *testing.T) {
+		t.Parallel()
+		for _, test := range []struct {
+			name       string
+			preErr     error
+			postErr    error
+			wantWrite  bool
+			wantErr    bool
+			wantEvents []string
+		}{
+			{"success", nil, nil, true, false, []string{preWritePhase, postWritePhase}},
+			{"pre-write rejected", errors.New("rejected"), nil, false, true, []string{preWritePhase}},
+			{"post-write failed", nil, errors.New("failed"), true, false, []string{preWritePhase, postWritePhase}},
+		} {
+			test := test
+			t.Run(test.name, func(t *testing.T) {
+				t.Parallel()
+				pre, post := &recordingHook{err: test.preErr}, &recordingHook{err: test.postErr}
+				manifestStore := storagetest.NewManifest()
+				cfg := rotateKeysConfig{
+					manifestStore: manifestStore,
+					locality:      "asgard",
+					manifestHooks: manifestHooks{preWrite: pre, postWrite: post},
+				}
+
+				err := writeManifests(ctx, cfg,
+					map[string]manifest.DataShareProcessorSpecificManifest{"ingestor": oldManifest},
+					map[string]manifest.DataShareProcessorSpecificManifest{"ingestor": newManifest})
+				if (err != nil) != test.wantErr {
+					t.Errorf("Unexpected error from writeManifests (wantErr = %v): %v", test.wantErr, err)
+				}
+				if gotWrite := manifestStore.GetDataShareProcessorSpecificManifestPutCount("asgard-ingestor") > 0; gotWrite != test.wantWrite {
+					t.Errorf("Unexpected manifest write: got %v, want %v", gotWrite, test.wantWrite)
+				}
+				var gotEvents []string
+				for _, e := range append(pre.events, post.events...) {
+					if e.ManifestName != "asgard-ingestor" || e.Ingestor != "ingestor" || e.Diff == "" {
+						t.Errorf("Unexpected hook event: %+v", e)
+					}
+					gotEvents = append(gotEvents, e.Phase)
+				}
+				if fmt.Sprint(gotEvents) != fmt.Sprint(test.wantEvents) {
+					t.Errorf("Unexpected hook phases: got %v, want %v", gotEvents, test.wantEvents)
+				}
+			})
+		}
+	})
+
+	t.Run("webhook", func(t *testing.T) {
+		t.Parallel()
+		var gotEvent manifestHookEvent
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := json.NewDecoder(r.Body).Decode(&gotEvent); err != nil {
+				t.Errorf("Couldn't decode hook event: %v", err)
+			}
+			if gotEvent.NewManifest.IngestionBucket == "forbidden-bucket" {
+				http.Error(w, "policy violation", http.StatusForbidden)
+			}
+		}))
+		defer srv.Close()
+
+		hook, err := newManifestHook(srv.URL, srv.Client())
+		if err != nil {
+			t.Fatalf("Unexpected error from newManifestHook: %v", err)
+		}
+		event := manifestHookEvent{Phase: preWritePhase, ManifestName: "asgard-ingestor", OldManifest: oldManifest, NewManifest: newManifest}
+		if err := hook.run(ctx, event); err != nil {
+			t.Errorf("Unexpected error from accepting webhook: %v", err)
+		}
+		if gotEvent.ManifestName != "asgard-ingestor" || !gotEvent.NewManifest.Equal(newManifest) {
+			t.Errorf("Unexpected event received by webhook: %+v", gotEvent)
+		}
+		event.NewManifest.IngestionBucket = "forbidden-bucket"
+		if err := hook.run(ctx, event); err == nil || !strings.Contains(err.Error(), "policy violation") {
+			t.Errorf("Unexpected error from rejecting webhook: %v", err)
+		}
+	})
+
+	t.Run("exec", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		script := filepath.Join(dir, "hook.sh")
+		if err := os.WriteFile(script, []byte("#!/bin/sh\ncat > \"$(dirname \"$0\")/$KEY_ROTATOR_HOOK_PHASE.json\"\n[ \"$KEY_ROTATOR_MANIFEST_NAME\" = asgard-ingestor ]\n"), 0o755); err != nil {
+			t.Fatalf("Couldn't write hook script: %v", err)
+		}
+
+		hook, err := newManifestHook("exec:"+script, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error from newManifestHook: %v", err)
+		}
+		if err := hook.run(ctx, manifestHookEvent{Phase: postWritePhase, ManifestName: "asgard-ingestor", NewManifest: newManifest}); err != nil {
+			t.Errorf("Unexpected error from succeeding exec hook: %v", err)
+		}
+		input, err := os.ReadFile(filepath.Join(dir, postWritePhase+".json"))
+		if err != nil {
+			t.Fatalf("Couldn't read hook input: %v", err)
+		}
+		var gotEvent manifestHookEvent
+		if err := json.Unmarshal(input, &gotEvent); err != nil {
+			t.Fatalf("Couldn't decode hook input: %v", err)
+		}
+		if !gotEvent.NewManifest.Equal(newManifest) {
+			t.Errorf("Unexpected event received by exec hook: %+v", gotEvent)
+		}
+		if err := hook.run(ctx, manifestHookEvent{Phase: preWritePhase, ManifestName: "other"}); err == nil {
+			t.Errorf("Expected error from failing exec hook")
+		}
+	})
+
+	t.Run("bad spec", func(t *testing.T) {
+		t.Parallel()
+		for _, spec := range []string{"exec:", "ftp://example.com", "/bin/true"} {
+			if _, err := newManifestHook(spec, nil); err == nil {
+				t.Errorf("Expected error from newManifestHook(%q)", spec)
+			}
+		}
+	})
+}
+
+func TestNotifications(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var gotEvents []rotationEvent
+	var gotSlackMessages []string
+	hookSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event rotationEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("Couldn't decode notification: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		gotEvents = append(gotEvents, event)
+	}))
+	defer hookSrv.Close()
+	slackSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg slackMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Errorf("Couldn't decode Slack message: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		gotSlackMessages = append(gotSlackMessages, msg.Text)
+	}))
+	defer slackSrv.Close()
+
+	n, err := newNotifier(hookSrv.URL, slackSrv.URL, http.DefaultClient, true)
+	if err != nil {
+		t.Fatalf("Unexpected error from newNotifier: %v", err)
+	}
+	liAsgard := li("asgard", "ingestor")
+	oldManifest := manifest.DataShareProcessorSpecificManifest{Format: 1}
+	newManifest := manifest.DataShareProcessorSpecificManifest{Format: 1, IngestionBucket: "new-bucket"}
+	cfg := rotateKeysConfig{
+		keyStore:      storagetest.NewKey(),
+		manifestStore: storagetest.NewManifest(),
+		locality:      "asgard",
+		notifier:      n,
+	}
+
+	// The batch signing key gains version 30000, which becomes primary, and
+	// loses version 10000; the unchanged packet encryption key produces no
+	// events.
+	if err := writeKeys(ctx, cfg,
+		pek("asgard", 10000), map[string]key.Key{"ingestor": bsk(liAsgard, 20000, 10000)},
+		pek("asgard", 10000), map[string]key.Key{"ingestor": bsk(liAsgard, 30000, 20000)}); err != nil {
+		t.Fatalf("Unexpected error from writeKeys: %v", err)
+	}
+	if err := writeManifests(ctx, cfg,
+		map[string]manifest.DataShareProcessorSpecificManifest{"ingestor": oldManifest},
+		map[string]manifest.DataShareProcessorSpecificManifest{"ingestor": newManifest}); err != nil {
+		t.Fatalf("Unexpected error from writeManifests: %v", err)
+	}
+
+	keyDiff := bsk(liAsgard, 30000, 20000).Diff(bsk(liAsgard, 20000, 10000))
+	wantEvents := []rotationEvent{
+		{Event: keyCreatedEvent, Locality: "asgard", Ingestor: "ingestor", KeyKind: batchSigningKeyKind, Version: 30000, Diff: keyDiff, DryRun: true},
+		{Event: keyPromotedEvent, Locality: "asgard", Ingestor: "ingestor", KeyKind: batchSigningKeyKind, Version: 30000, Diff: keyDiff, DryRun: true},
+		{Event: keyDeletedEvent, Locality: "asgard", Ingestor: "ingestor", KeyKind: batchSigningKeyKind, Version: 10000, Diff: keyDiff, DryRun: true},
+		{Event: manifestChangedEvent, Locality: "asgard", Ingestor: "ingestor", ManifestName: "asgard-ingestor", Diff: newManifest.Diff(oldManifest), DryRun: true},
+	}
+	if diff := cmp.Diff(wantEvents, gotEvents); diff != "" {
+		t.Errorf("Unexpected notifications (-want +got):\n%s", diff)
+	}
+	if len(gotSlackMessages) != len(wantEvents) {
+		t.Fatalf("Got %d Slack messages, want %d: %q", len(gotSlackMessages), len(wantEvents), gotSlackMessages)
+	}
+	if want := `[dry run] Promoted batch-signing-key version 30000 to primary for ("asgard", "ingestor"): `; !strings.HasPrefix(gotSlackMessages[1], want) {
+		t.Errorf("Unexpected Slack message %q, want prefix %q", gotSlackMessages[1], want)
+	}
+
+	t.Run("new key", func(t *testing.T) {
+		t.Parallel()
+		got := keyEvents(packetEncryptionKeyKind, "asgard", "", key.Key{}, pek("asgard", 10000))
+		var gotEvents []string
+		for _, e := range got {
+			gotEvents = append(gotEvents, fmt.Sprintf("%s/%d", e.Event, e.Version))
+		}
+		if want := []string{"key-created/10000", "key-promoted/10000"}; fmt.Sprint(gotEvents) != fmt.Sprint(want) {
+			t.Errorf("Unexpected events: got %v, want %v", gotEvents, want)
+		}
+	})
+
+	t.Run("bad URL", func(t *testing.T) {
+		t.Parallel()
+		for _, u := range []string{"ftp://example.com", "hooks.slack.com/services/x", "http://[::1"} {
+			if _, err := newNotifier("", u, http.DefaultClient, false); err == nil {
+				t.Errorf("Wanted error from newNotifier for URL %q", u)
+			}
+		}
+	})
+}
+
+func TestChangeReport(t *testing.T) {
+	t.Parallel()
+
+	liAsgard := li("asgard", "ingestor")
+	oldManifest := manifest.DataShareProcessorSpecificManifest{Format: 1}
+	newManifest := manifest.DataShareProcessorSpecificManifest{Format: 1, IngestionBucket: "new-bucket"}
+	cfg := rotateKeysConfig{
+		keyStore:      dryRunKeyStore{storagetest.NewKey()},
+		manifestStore: dryRunManifestStore{storagetest.NewManifest()},
+		locality:      "asgard",
+		report:        &changeReport{dryRun: true},
+	}
+
+	// The batch signing key gains version 30000, which becomes primary, and
+	// loses version 10000; the unchanged packet encryption key is not
+	// reported.
+	if err := writeKeys(ctx, cfg,
+		pek("asgard", 10000), map[string]key.Key{"ingestor": bsk(liAsgard, 20000, 10000)},
+		pek("asgard", 10000), map[string]key.Key{"ingestor": bsk(liAsgard, 30000, 20000)}); err != nil {
+		t.Fatalf("Unexpected error from writeKeys: %v", err)
+	}
+	if err := writeManifests(ctx, cfg,
+		map[string]manifest.DataShareProcessorSpecificManifest{"ingestor": oldManifest, "other": oldManifest},
+		map[string]manifest.DataShareProcessorSpecificManifest{"ingestor": newManifest, "other": oldManifest}); err != nil {
+		t.Fatalf("Unexpected error from writeManifests: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := cfg.report.write(&buf); err != nil {
+		t.Fatalf("Unexpected error from write: %v", err)
+	}
+	var got changeReportJSON
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Couldn't decode report %q: %v", buf.String(), err)
+	}
+	oldPrimary, newPrimary := int64(20000), int64(30000)
+	want := changeReportJSON{
+		DryRun: true,
+		Keys: []keyChange{{
+			Locality:        "asgard",
+			Ingestor:        "ingestor",
+			Kind:            batchSigningKeyKind,
+			Diff:            bsk(liAsgard, 30000, 20000).Diff(bsk(liAsgard, 20000, 10000)),
+			OldVersions:     []int64{20000, 10000},
+			NewVersions:     []int64{30000, 20000},
+			OldPrimary:      &oldPrimary,
+			NewPrimary:      &newPrimary,
+			CreatedVersions: []int64{30000},
+			DeletedVersions: []int64{10000},
+		}},
+		Manifests: []manifestChange{{
+			Locality:     "asgard",
+			Ingestor:     "ingestor",
+			ManifestName: "asgard-ingestor",
+			Diff:         newManifest.Diff(oldManifest),
+		}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected report (-want +got):\n%s", diff)
+	}
+
+	t.Run("new key", func(t *testing.T) {
+		t.Parallel()
+		report := &changeReport{}
+		report.addKey(packetEncryptionKeyKind, "asgard", "", key.Key{}, pek("asgard", 0))
+		var buf bytes.Buffer
+		if err := report.write(&buf); err != nil {
+			t.Fatalf("Unexpected error from write: %v", err)
+		}
+		// A primary version created at timestamp 0 is still reported.
+		for _, want := range []string{`"old-versions": []`, `"new-primary": 0`, `"created-versions": [`, `"manifests": []`} {
+			if !strings.Contains(buf.String(), want) {
+				t.Errorf("Report %s does not contain %s", buf.String(), want)
+			}
+		}
+		if strings.Contains(buf.String(), "old-primary") {
+			t.Errorf("Report %s contains old-primary for a new key", buf.String())
+		}
+	})
+
+	// The nil report records nothing.
+	var nilReport *changeReport
+	nilReport.addKey(packetEncryptionKeyKind, "asgard", "", key.Key{}, pek("asgard", 10000))
+	nilReport.addManifest("asgard", "ingestor", "asgard-ingestor", "diff")
+}
+
+func TestPhaseTimeouts(t *testing.T) {
+	t.Parallel()
+
+	t.Run("runPhase", func(t *testing.T) {
+		t.Parallel()
+		blockUntilDone := func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+
+		// The phase's own timeout is exceeded.
+		err := runPhase(ctx, "locality", readPhase, time.Millisecond, blockUntilDone)
+		if err == nil || !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "read phase exceeded its timeout") {
+			t.Errorf("Unexpected error from runPhase exceeding phase timeout: %v", err)
+		}
+
+		// The overall deadline is exceeded before the phase's own timeout.
+		overallCtx, cancel := context.WithTimeout(ctx, time.Millisecond)
+		defer cancel()
+		err = runPhase(overallCtx, "locality", readPhase, time.Hour, blockUntilDone)
+		if err == nil || strings.Contains(err.Error(), "phase exceeded its timeout") {
+			t.Errorf("Unexpected error from runPhase exceeding overall deadline: %v", err)
+		}
+
+		// The phase succeeds.
+		if err := runPhase(ctx, "locality", readPhase, time.Hour, func(context.Context) error { return nil }); err != nil {
+			t.Errorf("Unexpected error from successful runPhase: %v", err)
+		}
+	})
+
+	t.Run("checkWriteKeysBudget", func(t *testing.T) {
+		t.Parallel()
+		now := time.Unix(100000, 0)
+		deadlineCtx, cancel := context.WithDeadline(ctx, now.Add(2*time.Minute))
+		defer cancel()
+
+		for _, test := range []struct {
+			name      string
+			ctx       context.Context
+			writeKeys time.Duration
+			wantErr   bool
+		}{
+			{"no deadline", ctx, 3 * time.Minute, false},
+			{"no write-keys timeout", deadlineCtx, 0, false},
+			{"enough time", deadlineCtx, time.Minute, false},
+			{"not enough time", deadlineCtx, 3 * time.Minute, true},
+		} {
+			err := checkWriteKeysBudget(test.ctx, now, phaseTimeouts{writeKeys: test.writeKeys})
+			if (err != nil) != test.wantErr {
+				t.Errorf("%s: unexpected error from checkWriteKeysBudget (wantErr = %v): %v", test.name, test.wantErr, err)
+			}
+		}
+	})
+}
+
+type fakeConfigMaps map[string]*k8sapi.ConfigMap
+
+func (f fakeConfigMaps) Get(_ context.Context, name string, _ metav1.GetOptions) (*k8sapi.ConfigMap, error) {
+	cm, ok := f[name]
+	if !ok {
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, name)
+	}
+	return cm, nil
+}
+
+func TestIngestorExclusions(t *testing.T) {
+	t.Parallel()
+	ingestors := []string{"apple", "g-enpa", "other"}
+	configMaps := fakeConfigMaps{
+		"skip": &k8sapi.ConfigMap{Data: map[string]string{skipIngestorsConfigMapKey: " g-enpa, unknown "}},
+	}
+
+	for _, test := range []struct {
+		name          string
+		exclusions    ingestorExclusions
+		wantIngestors []string
+		wantErr       bool
+	}{
+		{
+			name:          "no exclusions",
+			exclusions:    ingestorExclusions{},
+			wantIngestors: ingestors,
+		},
+		{
+			name:          "flag",
+			exclusions:    ingestorExclusions{skipped: []string{"apple"}},
+			wantIngestors: []string{"g-enpa", "other"},
+		},
+		{
+			name:          "flag & ConfigMap",
+			exclusions:    ingestorExclusions{configMaps: configMaps, skipped: []string{"apple"}, configMapName: "skip"},
+			wantIngestors: []string{"other"},
+		},
+		{
+			name:          "missing ConfigMap",
+			exclusions:    ingestorExclusions{configMaps: configMaps, configMapName: "missing"},
+			wantIngestors: ingestors,
+		},
+		{
+			name:       "all excluded",
+			exclusions: ingestorExclusions{configMaps: configMaps, skipped: []string{"apple", "other"}, configMapName: "skip"},
+			wantErr:    true,
+		},
+	} {
+		gotIngestors, err := test.exclusions.apply(ctx, ingestors)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: unexpected error from apply (wantErr = %v): %v", test.name, test.wantErr, err)
+		}
+		if got, want := strings.Join(gotIngestors, ","), strings.Join(test.wantIngestors, ","); got != want {
+			t.Errorf("%s: apply returned ingestors %q, want %q", test.name, got, want)
+		}
+	}
+}
+
+func TestPacketEncryptionKeyTryOrder(t *testing.T) {
+	t.Parallel()
+	configMaps := fakeConfigMaps{
+		"usage":     &k8sapi.ConfigMap{Data: map[string]string{packetEncryptionKeyUsageConfigMapKey: `{"100000": "2020-10-01T00:00:00Z", "150000": "2020-09-01T00:00:00Z", "125000": "2020-10-01T00:00:00Z"}`}},
+		"empty":     &k8sapi.ConfigMap{},
+		"malformed": &k8sapi.ConfigMap{Data: map[string]string{packetEncryptionKeyUsageConfigMapKey: `{"version": "2020-10-01T00:00:00Z"}`}},
+	}
+
+	for _, test := range []struct {
+		name      string
+		tryOrder  packetEncryptionKeyTryOrder
+		wantOrder []int64
+		wantErr   bool
+	}{
+		{
+			name:     "youngest first",
+			tryOrder: packetEncryptionKeyTryOrder{configMaps: configMaps, policy: youngestFirst, configMapName: "usage"},
+		},
+		{
+			name:      "most recently used first",
+			tryOrder:  packetEncryptionKeyTryOrder{configMaps: configMaps, policy: mostRecentlyUsedFirst, configMapName: "usage"},
+			wantOrder: []int64{125000, 100000, 150000},
+		},
+		{
+			name:     "missing ConfigMap",
+			tryOrder: packetEncryptionKeyTryOrder{configMaps: configMaps, policy: mostRecentlyUsedFirst, configMapName: "missing"},
+		},
+		{
+			name:     "ConfigMap without usage",
+			tryOrder: packetEncryptionKeyTryOrder{configMaps: configMaps, policy: mostRecentlyUsedFirst, configMapName: "empty"},
+		},
+		{
+			name:     "malformed usage",
+			tryOrder: packetEncryptionKeyTryOrder{configMaps: configMaps, policy: mostRecentlyUsedFirst, configMapName: "malformed"},
+			wantErr:  true,
+		},
+	} {
+		gotOrder, err := test.tryOrder.order(ctx)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: unexpected error from order (wantErr = %v): %v", test.name, test.wantErr, err)
+		}
+		if got, want := fmt.Sprint(gotOrder), fmt.Sprint(test.wantOrder); got != want {
+			t.Errorf("%s: order returned %s, want %s", test.name, got, want)
+		}
+	}
+}
+
+func TestReadDefaultManifests(t *testing.T) {
+	t.Parallel()
+	ingestors := []string{"apple", "g-enpa"}
+	const maxBytes = 128
+
+	for _, test := range []struct {
+		name        string
+		input       string
+		wantBuckets map[string]string // ingestor -> ingestion bucket
+		wantErr     bool
+	}{
+		{
+			name:        "empty",
+			input:       `{}`,
+			wantBuckets: map[string]string{},
+		},
+		{
+			name:        "subset of ingestors",
+			input:       ` {"apple": {"format": 1, "ingestion-bucket": "gs://apple-bucket"}} `,
+			wantBuckets: map[string]string{"apple": "gs://apple-bucket"},
+		},
+		{
+			name:        "all ingestors",
+			input:       `{"apple": {"ingestion-bucket": "a"}, "g-enpa": {"ingestion-bucket": "g"}}`,
+			wantBuckets: map[string]string{"apple": "a", "g-enpa": "g"},
+		},
+		{
+			name:    "unknown ingestor",
+			input:   `{"apple": {}, "unknown": {}}`,
+			wantErr: true,
+		},
+		{
+			name:    "duplicate ingestor",
+			input:   `{"apple": {}, "apple": {}}`,
+			wantErr: true,
+		},
+		{
+			name:    "malformed manifest",
+			input:   `{"apple": []}`,
+			wantErr: true,
+		},
+		{
+			name:    "not a map",
+			input:   `[{"apple": {}}]`,
+			wantErr: true,
+		},
+		{
+			name:    "trailing data",
+			input:   `{"apple": {}} {}`,
+			wantErr: true,
+		},
+		{
+			name:    "truncated",
+			input:   `{"apple": {}`,
+			wantErr: true,
+		},
+		{
+			name:    "too large",
+			input:   fmt.Sprintf(`{"apple": {"ingestion-bucket": %q}}`, strings.Repeat("a", maxBytes)),
+			wantErr: true,
+		},
+	} {
+		got, err := readDefaultManifests(strings.NewReader(test.input), maxBytes, ingestors)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: unexpected error from readDefaultManifests (wantErr = %v): %v", test.name, test.wantErr, err)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		gotBuckets := map[string]string{}
+		for ingestor, m := range got {
+			gotBuckets[ingestor] = m.IngestionBucket
+		}
+		if got, want := fmt.Sprint(gotBuckets), fmt.Sprint(test.wantBuckets); got != want {
+			t.Errorf("%s: readDefaultManifests returned ingestion buckets %s, want %s", test.name, got, want)
+		}
+	}
+}
+
+func TestParseNamespaceByIngestor(t *testing.T) {
+	t.Parallel()
+
+	ingestors := []string{"apple", "g-enpa"}
+	for _, test := range []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:  "empty",
+			input: "",
+		},
+		{
+			name:  "valid",
+			input: `{"apple": "apple-keys", "g-enpa": "g-enpa-keys"}`,
+			want:  map[string]string{"apple": "apple-keys", "g-enpa": "g-enpa-keys"},
+		},
+		{
+			name:    "unknown ingestor",
+			input:   `{"microsoft": "microsoft-keys"}`,
+			wantErr: true,
+		},
+		{
+			name:    "empty namespace",
+			input:   `{"apple": ""}`,
+			wantErr: true,
+		},
+		{
+			name:    "not a map",
+			input:   `["apple-keys"]`,
+			wantErr: true,
+		},
+	} {
+		got, err := parseNamespaceByIngestor(test.input, ingestors)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: unexpected error from parseNamespaceByIngestor (wantErr = %v): %v", test.name, test.wantErr, err)
+			continue
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%s: parseNamespaceByIngestor differs from expected (-want +got):\n%s", test.name, diff)
+		}
+	}
+}
+
+// fakeNamespaceSecrets is a k8s.SecretInterface whose List fails with err, if
+// it is set. Its other methods are unimplemented.
+type fakeNamespaceSecrets struct {
+	k8s.SecretInterface
+	err error
+}
+
+func (f fakeNamespaceSecrets) List(context.Context, metav1.ListOptions) (*k8sapi.SecretList, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &k8sapi.SecretList{}, nil
+}
+
+func TestCheckNamespaces(t *testing.T) {
+	t.Parallel()
+
+	errs := map[string]error{
+		"forbidden": k8serrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "", errors.New("forbidden")),
+	}
+	var listed []string
+	secrets := func(namespace string) k8s.SecretInterface {
+		listed = append(listed, namespace)
+		return fakeNamespaceSecrets{err: errs[namespace]}
+	}
+
+	if err := checkNamespaces(ctx, secrets, []string{"default", "apple-keys", "", "apple-keys"}); err != nil {
+		t.Errorf("Unexpected error from checkNamespaces: %v", err)
+	}
+	if diff := cmp.Diff([]string{"default", "apple-keys"}, listed); diff != "" {
+		t.Errorf("checkNamespaces listed unexpected namespaces (-want +got):\n%s", diff)
+	}
+
+	err := checkNamespaces(ctx, secrets, []string{"default", "forbidden"})
+	if !k8serrors.IsForbidden(err) {
+		t.Errorf("Wanted forbidden error from checkNamespaces, got: %v", err)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	t.Parallel()
+
+	forbidden := k8serrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "", errors.New("forbidden"))
+	manifestStore := storagetest.NewManifest()
+	if err := manifestStore.PutDataShareProcessorSpecificManifest(ctx, dspName("asgard", "ingestor-1"), manifest.DataShareProcessorSpecificManifest{}); err != nil {
+		t.Fatalf("Couldn't write manifest: %v", err)
+	}
+	cfg := preflightConfig{
+		secrets: func(namespace string) k8s.SecretInterface {
+			if namespace == "ingestor-2-keys" {
+				return fakeNamespaceSecrets{err: forbidden}
+			}
+			return fakeNamespaceSecrets{}
+		},
+		checkKeySecret: func(_ context.Context, kind, ingestor string) (string, error, error) {
+			// Only the batch signing key of ingestor-2 can't be written.
+			if ingestor == "ingestor-2" {
+				return kind + "-" + ingestor, nil, forbidden
+			}
+			return kind + "-" + ingestor, nil, nil
+		},
+		keyStores: []verifyBackup{
+			// The backup is missing the batch signing key of ingestor-2.
+			{keyStore: keyStore(map[LI][]int64{li("asgard", "ingestor-1"): {100}}, map[string][]int64{"asgard": {400}}), name: "aws"},
+		},
+		manifestStore:      manifestStore,
+		checkManifestWrite: func(context.Context) error { return nil },
+		namespaces:         []string{"default", "ingestor-2-keys", "default"},
+		manifestBucket:     "gs://manifests",
+		locality:           "asgard",
+		ingestors:          []string{"ingestor-1", "ingestor-2"},
+	}
+
+	var out bytes.Buffer
+	failed, err := preflight(ctx, cfg, &out)
+	if err != nil {
+		t.Fatalf("Unexpected error from preflight: %v", err)
+	}
+	var got []preflightResult
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var result preflightResult
+		if err := dec.Decode(&result); err != nil {
+			t.Fatalf("Couldn't decode preflight result: %v", err)
+		}
+		// Errors are checked only for presence.
+		if result.Error != "" {
+			result.Error = "error"
+		}
+		got = append(got, result)
+	}
+	want := []preflightResult{
+		{Check: preflightListSecrets, Target: "default", OK: true},
+		{Check: preflightListSecrets, Target: "ingestor-2-keys", Error: "error"},
+		{Check: preflightReadSecret, Target: "packet-encryption-", OK: true},
+		{Check: preflightWriteSecret, Target: "packet-encryption-", OK: true},
+		{Check: preflightReadSecret, Target: "batch-signing-ingestor-1", OK: true},
+		{Check: preflightWriteSecret, Target: "batch-signing-ingestor-1", OK: true},
+		{Check: preflightReadSecret, Target: "batch-signing-ingestor-2", OK: true},
+		{Check: preflightWriteSecret, Target: "batch-signing-ingestor-2", Error: "error"},
+		{Check: preflightReadKey, Target: `aws: packet encryption key for "asgard"`, OK: true},
+		{Check: preflightReadKey, Target: `aws: batch signing key for ("asgard", "ingestor-1")`, OK: true},
+		{Check: preflightReadKey, Target: `aws: batch signing key for ("asgard", "ingestor-2")`, Error: "error"},
+		{Check: preflightListManifests, Target: "gs://manifests", OK: true},
+		{Check: preflightReadManifest, Target: "asgard-ingestor-1", OK: true},
+		{Check: preflightReadManifest, Target: "asgard-ingestor-2", Error: "error"},
+		{Check: preflightWriteManifest, Target: "gs://manifests", OK: true},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected preflight results (-want +got):\n%s", diff)
+	}
+	if failed != 4 {
+		t.Errorf("Got %d failed checks, want 4", failed)
+	}
+}
+
+func TestTracingEnabled(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name string
+		env  map[string]string
+		want bool
+	}{
+		{
+			name: "unconfigured",
+		},
+		{
+			name: "endpoint",
+			env:  map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4317"},
+			want: true,
+		},
+		{
+			name: "traces endpoint",
+			env:  map[string]string{"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://collector:4317"},
+			want: true,
+		},
+		{
+			name: "otlp exporter",
+			env:  map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4317", "OTEL_TRACES_EXPORTER": "otlp"},
+			want: true,
+		},
+		{
+			name: "no exporter",
+			env:  map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4317", "OTEL_TRACES_EXPORTER": "none"},
+		},
+		{
+			name: "sdk disabled",
+			env:  map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4317", "OTEL_SDK_DISABLED": "true"},
+		},
+	} {
+		getenv := func(k string) string { return test.env[k] }
+		if got := tracingEnabled(getenv); got != test.want {
+			t.Errorf("%s: tracingEnabled = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRecordKeyVersionChanges(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name                                   string
+		locality                               string
+		oldKey, newKey                         key.Key
+		wantCreated, wantPromoted, wantDeleted float64
+	}{
+		{
+			name:        "initial creation",
+			locality:    "record-initial",
+			newKey:      pek("record-initial", 100),
+			wantCreated: 1,
+		},
+		{
+			name:         "rotation",
+			locality:     "record-rotation",
+			oldKey:       pek("record-rotation", 100, 50),
+			newKey:       pek("record-rotation", 200, 100),
+			wantCreated:  1,
+			wantPromoted: 1,
+			wantDeleted:  1,
+		},
+		{
+			name:         "promotion only",
+			locality:     "record-promotion",
+			oldKey:       pek("record-promotion", 100, 200),
+			newKey:       pek("record-promotion", 200, 100),
+			wantPromoted: 1,
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			recordKeyVersionChanges(ctx, test.locality, packetEncryptionKeyKind, test.oldKey, test.newKey)
+			for change, want := range map[string]float64{"created": test.wantCreated, "promoted": test.wantPromoted, "deleted": test.wantDeleted} {
+				if got := testutil.ToFloat64(keyVersionChanges.WithLabelValues(test.locality, packetEncryptionKeyKind, change)); got != want {
+					t.Errorf("Got %v %s versions, want %v", got, change, want)
+				}
+			}
+		})
+	}
+
+	t.Run("exemplar", func(t *testing.T) {
+		t.Parallel()
+		if exemplar := traceExemplar(ctx); exemplar != nil {
+			t.Errorf("Got exemplar %v without a sampled span, want none", exemplar)
+		}
+		traceID := trace.TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+		sampledCtx := trace.ContextWithSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    traceID,
+			SpanID:     trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+			TraceFlags: trace.FlagsSampled,
+		}))
+		if diff := cmp.Diff(prometheus.Labels{"trace_id": traceID.String()}, traceExemplar(sampledCtx)); diff != "" {
+			t.Errorf("Unexpected exemplar (-want +got):\n%s", diff)
+		}
+	})
+}
@@ -0,0 +1,79 @@
+package manifest
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"encoding/base64"
+	"fmt"
+	"sort"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+)
+
+// JSONWebKeySet is an RFC 7517 JSON Web Key Set, as written alongside each
+// data share processor specific manifest so that peers may consume the batch
+// signing public keys with off-the-shelf JOSE libraries.
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JSONWebKey is an RFC 7517 JSON Web Key holding a public key. P-256 keys are
+// represented as "EC" keys (RFC 7518 section 6.2), and Ed25519 keys as "OKP"
+// keys (RFC 8037).
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y,omitempty"` // only for "EC" keys
+}
+
+// BatchSigningJWKS returns the batch signing public keys published in the
+// manifest as a JSON Web Key Set, ordered by key ID. An error is returned if
+// any of the public keys cannot be parsed.
+func (m DataShareProcessorSpecificManifest) BatchSigningJWKS() (JSONWebKeySet, error) {
+	var kids []string
+	for kid := range m.BatchSigningPublicKeys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	jwks := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, kid := range kids {
+		pub, err := m.BatchSigningPublicKeys[kid].toPublicKey()
+		if err != nil {
+			return JSONWebKeySet{}, fmt.Errorf("couldn't parse batch signing key %q: %w", kid, err)
+		}
+		jwk, err := newJSONWebKey(kid, pub)
+		if err != nil {
+			return JSONWebKeySet{}, fmt.Errorf("couldn't convert batch signing key %q to JWK: %w", kid, err)
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks, nil
+}
+
+// newJSONWebKey returns a JSON Web Key for verifying signatures with the given
+// public key.
+func newJSONWebKey(kid string, pub key.PublicKey) (JSONWebKey, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return JSONWebKey{}, fmt.Errorf("ECDSA key is on curve %s, want P-256", pub.Curve.Params().Name)
+		}
+		// Coordinates are padded to the size of the field (RFC 7518 section
+		// 6.2.1.2).
+		x, y := make([]byte, 32), make([]byte, 32)
+		pub.X.FillBytes(x)
+		pub.Y.FillBytes(y)
+		return JSONWebKey{KeyType: "EC", KeyID: kid, Use: "sig", Algorithm: "ES256", Curve: "P-256", X: encode(x), Y: encode(y)}, nil
+	case ed25519.PublicKey:
+		return JSONWebKey{KeyType: "OKP", KeyID: kid, Use: "sig", Algorithm: "EdDSA", Curve: "Ed25519", X: encode(pub)}, nil
+	default:
+		return JSONWebKey{}, fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
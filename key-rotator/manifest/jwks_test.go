@@ -0,0 +1,71 @@
+package manifest
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"encoding/base64"
+	"math/big"
+	"testing"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+	keytest "github.com/abetterinternet/prio-server/key-rotator/key/test"
+)
+
+func TestBatchSigningJWKS(t *testing.T) {
+	t.Parallel()
+
+	p256Material := keytest.Material(bskKID(10))
+	ed25519Material, err := key.Ed25519.New()
+	if err != nil {
+		t.Fatalf("Couldn't create Ed25519 key: %v", err)
+	}
+	m := DataShareProcessorSpecificManifest{
+		Format: 1,
+		BatchSigningPublicKeys: BatchSigningPublicKeys{
+			bskKID(20): batchSigningPublicKey(ed25519Material),
+			bskKID(10): batchSigningPublicKey(p256Material),
+		},
+	}
+
+	jwks, err := m.BatchSigningJWKS()
+	if err != nil {
+		t.Fatalf("Unexpected error from BatchSigningJWKS: %v", err)
+	}
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("Got %d keys, want 2", len(jwks.Keys))
+	}
+	decode := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatalf("Couldn't decode %q: %v", s, err)
+		}
+		return b
+	}
+
+	// Keys are ordered by key ID.
+	ec := jwks.Keys[0]
+	if ec.KeyID != bskKID(10) || ec.KeyType != "EC" || ec.Curve != "P-256" || ec.Algorithm != "ES256" || ec.Use != "sig" {
+		t.Errorf("Unexpected P-256 JWK: %+v", ec)
+	}
+	if x, y := decode(ec.X), decode(ec.Y); len(x) != 32 || len(y) != 32 {
+		t.Errorf("P-256 JWK coordinates are %d & %d bytes, want 32", len(x), len(y))
+	}
+	ecPub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(decode(ec.X)), Y: new(big.Int).SetBytes(decode(ec.Y))}
+	if !p256Material.Public().Equal(ecPub) {
+		t.Errorf("P-256 JWK doesn't match batch signing key")
+	}
+
+	okp := jwks.Keys[1]
+	if okp.KeyID != bskKID(20) || okp.KeyType != "OKP" || okp.Curve != "Ed25519" || okp.Algorithm != "EdDSA" || okp.Y != "" {
+		t.Errorf("Unexpected Ed25519 JWK: %+v", okp)
+	}
+	if !ed25519Material.Public().Equal(ed25519.PublicKey(decode(okp.X))) {
+		t.Errorf("Ed25519 JWK doesn't match batch signing key")
+	}
+
+	m.BatchSigningPublicKeys[bskKID(30)] = BatchSigningPublicKey{PublicKey: "not a key"}
+	if _, err := m.BatchSigningJWKS(); err == nil {
+		t.Errorf("Wanted error from BatchSigningJWKS with unparseable key")
+	}
+}
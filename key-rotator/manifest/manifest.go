@@ -1,11 +1,20 @@
 package manifest
 
 import (
+	"bytes"
+	"crypto/ecdh"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -38,16 +47,141 @@ type DataShareProcessorSpecificManifest struct {
 	// The values are PEM encoded PKCS#10 self signed certificate signing
 	// request, which contain the public key corresponding to the ECDSA P256
 	// private key that the data share processor which owns the manifest uses to
-	// decrypt ingestion share packets.
+	// decrypt ingestion share packets. X25519 keys, which cannot sign a CSR,
+	// are instead published as PEM encoded PKIX public keys.
 	PacketEncryptionKeyCSRs PacketEncryptionKeyCSRs `json:"packet-encryption-keys"`
+	// TaskSigningPublicKeys maps key identifiers to task signing public keys.
+	// These are the keys that facilitators use to verify that tasks were
+	// published by the data share processor's workflow-manager. Omitted if
+	// the data share processor does not sign tasks.
+	TaskSigningPublicKeys BatchSigningPublicKeys `json:"task-signing-public-keys,omitempty"`
+	// GCPWorkloadIdentityPoolProvider is the resource name of the GCP
+	// workload identity pool provider through which peers & ingestors with
+	// AWS identities obtain GCP credentials to write to this data share
+	// processor's GCS buckets, e.g.
+	// "projects/123456/locations/global/workloadIdentityPools/P/providers/Q".
+	// Format 2 only.
+	GCPWorkloadIdentityPoolProvider string `json:"gcp-workload-identity-pool-provider,omitempty"`
+	// AWSWebIdentityAudience is the audience of the OIDC identity tokens with
+	// which peers & ingestors without AWS accounts of their own assume the
+	// IngestionIdentity or PeerValidationIdentity role. Format 2 only.
+	AWSWebIdentityAudience string `json:"aws-web-identity-audience,omitempty"`
+	// AdditionalFields holds any fields present in the serialized manifest
+	// which are not otherwise represented in this struct, keyed by field
+	// name, e.g. optional fields added by peers. They are preserved (modulo
+	// insignificant whitespace) when the manifest is re-serialized.
+	AdditionalFields map[string]json.RawMessage `json:"-"`
 }
 
+// dataShareProcessorSpecificManifestJSON has the same fields as
+// DataShareProcessorSpecificManifest, but none of its methods, to allow
+// (un)marshaling the known fields without recursing into the custom
+// MarshalJSON & UnmarshalJSON methods.
+type dataShareProcessorSpecificManifestJSON DataShareProcessorSpecificManifest
+
+// MarshalJSON implements json.Marshaler. Additional fields are serialized
+// alongside known fields; if an additional field has the same name as a known
+// field, the known field takes precedence.
+func (m DataShareProcessorSpecificManifest) MarshalJSON() ([]byte, error) {
+	knownJSON, err := json.Marshal(dataShareProcessorSpecificManifestJSON(m))
+	if err != nil {
+		return nil, err
+	}
+	if len(m.AdditionalFields) == 0 {
+		return knownJSON, nil
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(knownJSON, &fields); err != nil {
+		return nil, err
+	}
+	for name, value := range m.AdditionalFields {
+		if _, ok := fields[name]; !ok {
+			fields[name] = value
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Any fields not otherwise
+// represented in DataShareProcessorSpecificManifest are stored in
+// AdditionalFields.
+func (m *DataShareProcessorSpecificManifest) UnmarshalJSON(data []byte) error {
+	var known dataShareProcessorSpecificManifestJSON
+	if err := json.Unmarshal(data, &known); err != nil {
+		return err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for _, name := range knownManifestFields {
+		delete(fields, name)
+	}
+	for name, value := range fields {
+		// Compact values so that they compare equal to their re-serialized
+		// form, which encoding/json always compacts.
+		var compacted bytes.Buffer
+		if err := json.Compact(&compacted, value); err != nil {
+			return err
+		}
+		fields[name] = compacted.Bytes()
+	}
+
+	*m = DataShareProcessorSpecificManifest(known)
+	m.AdditionalFields = nil
+	if len(fields) > 0 {
+		m.AdditionalFields = fields
+	}
+	return nil
+}
+
+// knownManifestFields are the JSON names of the fields represented in
+// DataShareProcessorSpecificManifest.
+var knownManifestFields = func() []string {
+	var names []string
+	t := reflect.TypeOf(DataShareProcessorSpecificManifest{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}()
+
 func (m DataShareProcessorSpecificManifest) equalModuloKeys(o DataShareProcessorSpecificManifest) bool {
 	return m.Format == o.Format &&
 		m.IngestionIdentity == o.IngestionIdentity &&
 		m.IngestionBucket == o.IngestionBucket &&
 		m.PeerValidationIdentity == o.PeerValidationIdentity &&
-		m.PeerValidationBucket == o.PeerValidationBucket
+		m.PeerValidationBucket == o.PeerValidationBucket &&
+		m.GCPWorkloadIdentityPoolProvider == o.GCPWorkloadIdentityPoolProvider &&
+		m.AWSWebIdentityAudience == o.AWSWebIdentityAudience &&
+		len(m.additionalFieldDiffs(o)) == 0
+}
+
+// additionalFieldDiffs returns human-readable descriptions of the differences
+// from the given `o`'s additional fields to this manifest's additional fields.
+// Values are compared byte-for-byte.
+func (m DataShareProcessorSpecificManifest) additionalFieldDiffs(o DataShareProcessorSpecificManifest) []string {
+	var diffs []string
+	for name, value := range m.AdditionalFields {
+		oldValue, ok := o.AdditionalFields[name]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("added field %q", name))
+		case !bytes.Equal(oldValue, value):
+			diffs = append(diffs, fmt.Sprintf("changed field %q", name))
+		}
+	}
+	for name := range o.AdditionalFields {
+		if _, ok := m.AdditionalFields[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("removed field %q", name))
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
 }
 
 // Equal returns true if and only if this manifest is equal to the given
@@ -55,7 +189,8 @@ func (m DataShareProcessorSpecificManifest) equalModuloKeys(o DataShareProcessor
 func (m DataShareProcessorSpecificManifest) Equal(o DataShareProcessorSpecificManifest) bool {
 	return m.equalModuloKeys(o) &&
 		m.BatchSigningPublicKeys.Equal(o.BatchSigningPublicKeys) &&
-		m.PacketEncryptionKeyCSRs.Equal(o.PacketEncryptionKeyCSRs)
+		m.PacketEncryptionKeyCSRs.Equal(o.PacketEncryptionKeyCSRs) &&
+		m.TaskSigningPublicKeys.Equal(o.TaskSigningPublicKeys)
 }
 
 // Diff returns a human-readable string describing the differences from the
@@ -63,20 +198,6 @@ func (m DataShareProcessorSpecificManifest) Equal(o DataShareProcessorSpecificMa
 // string if and only if the two keys are equal.
 func (m DataShareProcessorSpecificManifest) Diff(o DataShareProcessorSpecificManifest) string {
 	// Build up structures allowing easy generation of diffs.
-	bskInfos := map[string]struct{ old, new *BatchSigningPublicKey }{}
-	for kid, key := range m.BatchSigningPublicKeys {
-		key := key
-		info := bskInfos[kid]
-		info.new = &key
-		bskInfos[kid] = info
-	}
-	for kid, key := range o.BatchSigningPublicKeys {
-		key := key
-		info := bskInfos[kid]
-		info.old = &key
-		bskInfos[kid] = info
-	}
-
 	pekInfos := map[string]struct{ old, new *PacketEncryptionCertificate }{}
 	for kid, key := range m.PacketEncryptionKeyCSRs {
 		key := key
@@ -108,17 +229,15 @@ func (m DataShareProcessorSpecificManifest) Diff(o DataShareProcessorSpecificMan
 	if m.PeerValidationBucket != o.PeerValidationBucket {
 		diffs = append(diffs, fmt.Sprintf("changed peer validation bucket %q → %q", o.PeerValidationBucket, m.PeerValidationBucket))
 	}
-
-	for kid, info := range bskInfos {
-		switch {
-		case info.old == nil:
-			diffs = append(diffs, fmt.Sprintf("added batch signing key version %q", kid))
-		case info.new == nil:
-			diffs = append(diffs, fmt.Sprintf("removed batch signing key version %q", kid))
-		case (*info.old) != (*info.new):
-			diffs = append(diffs, fmt.Sprintf("modified key material for batch signing key version %q", kid))
-		}
+	if m.GCPWorkloadIdentityPoolProvider != o.GCPWorkloadIdentityPoolProvider {
+		diffs = append(diffs, fmt.Sprintf("changed GCP workload identity pool provider %q → %q", o.GCPWorkloadIdentityPoolProvider, m.GCPWorkloadIdentityPoolProvider))
+	}
+	if m.AWSWebIdentityAudience != o.AWSWebIdentityAudience {
+		diffs = append(diffs, fmt.Sprintf("changed AWS web identity audience %q → %q", o.AWSWebIdentityAudience, m.AWSWebIdentityAudience))
 	}
+	diffs = append(diffs, m.additionalFieldDiffs(o)...)
+
+	diffs = append(diffs, m.BatchSigningPublicKeys.diffs("batch signing", o.BatchSigningPublicKeys)...)
 	for kid, info := range pekInfos {
 		switch {
 		case info.old == nil:
@@ -130,6 +249,8 @@ func (m DataShareProcessorSpecificManifest) Diff(o DataShareProcessorSpecificMan
 		}
 	}
 
+	diffs = append(diffs, m.TaskSigningPublicKeys.diffs("task signing", o.TaskSigningPublicKeys)...)
+
 	return strings.Join(diffs, "; ")
 }
 
@@ -142,8 +263,18 @@ type UpdateKeysConfig struct {
 	PacketEncryptionKeyIDPrefix string  // the key ID prefix to use for packet encryption keys
 	PacketEncryptionKeyCSRFQDN  string  // the FQDN to specify for packet encryption key CSRs
 
+	TaskSigningKey         key.Key // the key used for task signing operations; if empty, task signing keys are left unchanged
+	TaskSigningKeyIDPrefix string  // the key ID prefix to use for task signing keys
+
+	Now                       time.Time     // the time of the update; if zero, the current time is used
+	ExpirationRenewalWindow   time.Duration // public keys expiring within this duration of Now have their expiration refreshed; if zero, expirations are never refreshed
+	MinimumExpirationValidity time.Duration // post-update, public keys must not expire within this duration of Now, e.g. the interval between rotations; if zero, public keys must only be unexpired
+	BatchSigningKeyExpiration time.Duration // the validity period of newly-advertised batch signing public keys, & those whose expiration is refreshed; if zero, 100 years is used
+
 	SkipPreUpdateValidations  bool // if set, do not perform pre-update validation checks
 	SkipPostUpdateValidations bool // if set, do not perform post-update validation checks
+
+	Rand io.Reader // the source of randomness for signing CSRs; if nil, crypto/rand.Reader is used
 }
 
 func (cfg UpdateKeysConfig) Validate() error {
@@ -156,6 +287,40 @@ func (cfg UpdateKeysConfig) Validate() error {
 	return nil
 }
 
+func (cfg UpdateKeysConfig) rand() io.Reader {
+	if cfg.Rand == nil {
+		return rand.Reader
+	}
+	return cfg.Rand
+}
+
+func (cfg UpdateKeysConfig) now() time.Time {
+	if cfg.Now.IsZero() {
+		return time.Now()
+	}
+	return cfg.Now
+}
+
+// needsRenewal returns true if the given public key's expiration should be
+// refreshed, i.e. it expires within the renewal window or its expiration is
+// unparseable.
+func (cfg UpdateKeysConfig) needsRenewal(pk BatchSigningPublicKey) bool {
+	if cfg.ExpirationRenewalWindow <= 0 {
+		return false
+	}
+	expiration, err := pk.expiration()
+	return err != nil || expiration.Before(cfg.now().Add(cfg.ExpirationRenewalWindow))
+}
+
+// batchSigningKeyExpiration returns the validity period of newly-advertised &
+// refreshed batch signing public keys.
+func (cfg UpdateKeysConfig) batchSigningKeyExpiration() time.Duration {
+	if cfg.BatchSigningKeyExpiration <= 0 {
+		return publicKeyValidityPeriod
+	}
+	return cfg.BatchSigningKeyExpiration
+}
+
 func (cfg UpdateKeysConfig) batchSigningKeyID(ts int64) string {
 	if ts != 0 {
 		return fmt.Sprintf("%s-%d", cfg.BatchSigningKeyIDPrefix, ts)
@@ -170,12 +335,22 @@ func (cfg UpdateKeysConfig) packetEncryptionKeyID(ts int64) string {
 	return cfg.PacketEncryptionKeyIDPrefix
 }
 
+func (cfg UpdateKeysConfig) taskSigningKeyID(ts int64) string {
+	if ts != 0 {
+		return fmt.Sprintf("%s-%d", cfg.TaskSigningKeyIDPrefix, ts)
+	}
+	return cfg.TaskSigningKeyIDPrefix
+}
+
 func (m DataShareProcessorSpecificManifest) UpdateKeys(cfg UpdateKeysConfig) (DataShareProcessorSpecificManifest, error) {
 	// Validate parameters.
 	if err := cfg.Validate(); err != nil {
 		return DataShareProcessorSpecificManifest{}, fmt.Errorf("invalid update config: %w", err)
 	}
 	if !cfg.SkipPreUpdateValidations {
+		if err := validateFormat(m); err != nil {
+			return DataShareProcessorSpecificManifest{}, fmt.Errorf("manifest pre-update validation error: %w", err)
+		}
 		if err := validatePreUpdateManifest(cfg, m); err != nil {
 			return DataShareProcessorSpecificManifest{}, fmt.Errorf("manifest pre-update validation error: %w", err)
 		}
@@ -189,37 +364,20 @@ func (m DataShareProcessorSpecificManifest) UpdateKeys(cfg UpdateKeysConfig) (Da
 	newM.BatchSigningPublicKeys, newM.PacketEncryptionKeyCSRs = BatchSigningPublicKeys{}, PacketEncryptionKeyCSRs{}
 
 	// Update batch signing key.
-	if err := cfg.BatchSigningKey.Versions(func(v key.Version) error {
-		kid := cfg.batchSigningKeyID(v.CreationTimestamp)
-		var newBSPK *BatchSigningPublicKey
-		if bspk, ok := m.BatchSigningPublicKeys[kid]; ok {
-			// If the manifest has a key for this kid, and it matches, use it instead of generating a new PKIX encoding.
-			manifestPubkey, err := bspk.toPublicKey()
-			if err != nil {
-				return fmt.Errorf("couldn't parse batch signing key version %q from manifest: %w", kid, err)
-			}
-			if manifestPubkey.Equal(v.KeyMaterial.Public()) {
-				bspk := bspk
-				newBSPK = &bspk
-			}
-		}
-		if newBSPK == nil {
-			// Manifest either does not have this key version, or it doesn't match up. Generate it.
-			pkix, err := v.KeyMaterial.PublicAsPKIX()
-			if err != nil {
-				return fmt.Errorf("couldn't create PKIX-encoding for batch signing key version with creation timestamp %d: %w", v.CreationTimestamp, err)
-			}
-			const batchSigningPublicKeyValidityPeriod = 100 * 365 * 24 * time.Hour // 100 years
-			newBSPK = &BatchSigningPublicKey{
-				PublicKey:  pkix,
-				Expiration: time.Now().UTC().Add(batchSigningPublicKeyValidityPeriod).Format(time.RFC3339),
-			}
-		}
-		newM.BatchSigningPublicKeys[kid] = *newBSPK
-		return nil
-	}); err != nil {
+	bspks, err := updatePublicKeys(cfg, "batch signing", cfg.batchSigningKeyExpiration(), cfg.BatchSigningKey, cfg.batchSigningKeyID, m.BatchSigningPublicKeys)
+	if err != nil {
 		return DataShareProcessorSpecificManifest{}, err
 	}
+	newM.BatchSigningPublicKeys = bspks
+
+	// Update task signing key, if any.
+	if !cfg.TaskSigningKey.IsEmpty() {
+		tspks, err := updatePublicKeys(cfg, "task signing", publicKeyValidityPeriod, cfg.TaskSigningKey, cfg.taskSigningKeyID, m.TaskSigningPublicKeys)
+		if err != nil {
+			return DataShareProcessorSpecificManifest{}, err
+		}
+		newM.TaskSigningPublicKeys = tspks
+	}
 
 	// Update packet encryption key.
 	primaryPEKVersion := cfg.PacketEncryptionKey.Primary()
@@ -236,9 +394,18 @@ func (m DataShareProcessorSpecificManifest) UpdateKeys(cfg UpdateKeysConfig) (Da
 			newPEC = &pec
 		}
 	}
+	if newPEC == nil && primaryPEKVersion.KeyMaterial.Type() == key.X25519 {
+		// X25519 keys cannot sign a CSR, so their public key is published
+		// directly.
+		pkix, err := primaryPEKVersion.KeyMaterial.PublicAsPKIX()
+		if err != nil {
+			return DataShareProcessorSpecificManifest{}, fmt.Errorf("couldn't create PKIX-encoding for packet encryption key version with creation timestamp %d: %w", primaryPEKVersion.CreationTimestamp, err)
+		}
+		newPEC = &PacketEncryptionCertificate{PublicKey: pkix}
+	}
 	if newPEC == nil {
 		// Manifest either does not have this key version, or it doesn't match up. Generate it.
-		csr, err := primaryPEKVersion.KeyMaterial.PublicAsCSR(cfg.PacketEncryptionKeyCSRFQDN)
+		csr, err := primaryPEKVersion.KeyMaterial.PublicAsCSRFrom(cfg.rand(), cfg.PacketEncryptionKeyCSRFQDN)
 		if err != nil {
 			return DataShareProcessorSpecificManifest{}, fmt.Errorf("couldn't create CSR for packet encryption key version with creation timestamp %d: %w", primaryPEKVersion.CreationTimestamp, err)
 		}
@@ -254,10 +421,65 @@ func (m DataShareProcessorSpecificManifest) UpdateKeys(cfg UpdateKeysConfig) (Da
 		if err := validateKeyMaterialAgainstManifest(cfg, newM); err != nil {
 			return DataShareProcessorSpecificManifest{}, fmt.Errorf("manifest post-update validation error: %w", err)
 		}
+		if err := validateExpirations(cfg, newM); err != nil {
+			return DataShareProcessorSpecificManifest{}, fmt.Errorf("manifest post-update validation error: %w", err)
+		}
+		if err := validateFormat(newM); err != nil {
+			return DataShareProcessorSpecificManifest{}, fmt.Errorf("manifest post-update validation error: %w", err)
+		}
 	}
 	return newM, nil
 }
 
+// publicKeyValidityPeriod is the duration for which newly-advertised task
+// signing public keys, and those whose expiration is refreshed, remain valid.
+// It is also the default for batch signing public keys.
+const publicKeyValidityPeriod = 100 * 365 * 24 * time.Hour // 100 years
+
+// updatePublicKeys returns public keys for each version of k, identified by
+// key IDs generated by keyID. Public keys are taken from oldKeys where they
+// match the key material, so that their encoding is unchanged; their
+// expiration is also unchanged unless it falls within the renewal window, in
+// which case it is refreshed to validity from now, as is the expiration of new
+// public keys.
+func updatePublicKeys(cfg UpdateKeysConfig, kind string, validity time.Duration, k key.Key, keyID func(int64) string, oldKeys BatchSigningPublicKeys) (BatchSigningPublicKeys, error) {
+	newKeys := BatchSigningPublicKeys{}
+	if err := k.Versions(func(v key.Version) error {
+		kid := keyID(v.CreationTimestamp)
+		var newPK *BatchSigningPublicKey
+		if pk, ok := oldKeys[kid]; ok {
+			// If the manifest has a key for this kid, and it matches, use it instead of generating a new PKIX encoding.
+			manifestPubkey, err := pk.toPublicKey()
+			if err != nil {
+				return fmt.Errorf("couldn't parse %s key version %q from manifest: %w", kind, kid, err)
+			}
+			if manifestPubkey.Equal(v.KeyMaterial.Public()) {
+				pk := pk
+				if cfg.needsRenewal(pk) {
+					pk.Expiration = cfg.now().UTC().Add(validity).Format(time.RFC3339)
+				}
+				newPK = &pk
+			}
+		}
+		if newPK == nil {
+			// Manifest either does not have this key version, or it doesn't match up. Generate it.
+			pkix, err := v.KeyMaterial.PublicAsPKIX()
+			if err != nil {
+				return fmt.Errorf("couldn't create PKIX-encoding for %s key version with creation timestamp %d: %w", kind, v.CreationTimestamp, err)
+			}
+			newPK = &BatchSigningPublicKey{
+				PublicKey:  pkix,
+				Expiration: cfg.now().UTC().Add(validity).Format(time.RFC3339),
+			}
+		}
+		newKeys[kid] = *newPK
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return newKeys, nil
+}
+
 func validatePreUpdateManifest(cfg UpdateKeysConfig, m DataShareProcessorSpecificManifest) error {
 	// Pre-update, if the manifest includes any batch signing key versions, the
 	// update config's batch signing key's primary version is already included
@@ -269,6 +491,16 @@ func validatePreUpdateManifest(cfg UpdateKeysConfig, m DataShareProcessorSpecifi
 		}
 	}
 
+	// Pre-update, if the manifest includes any task signing key versions, the
+	// update config's task signing key's primary version is already included
+	// in the manifest.
+	if !cfg.TaskSigningKey.IsEmpty() && len(m.TaskSigningPublicKeys) > 0 {
+		kid := cfg.taskSigningKeyID(cfg.TaskSigningKey.Primary().CreationTimestamp)
+		if _, ok := m.TaskSigningPublicKeys[kid]; !ok {
+			return fmt.Errorf("update's task signing key primary version %q not included in manifest", kid)
+		}
+	}
+
 	// Pre-update, if the manifest includes any packet encryption key versions,
 	// they are included in the update config's packet encryption key.
 	if len(m.PacketEncryptionKeyCSRs) > 0 {
@@ -290,27 +522,27 @@ func validatePreUpdateManifest(cfg UpdateKeysConfig, m DataShareProcessorSpecifi
 }
 
 func validatePostUpdateManifest(cfg UpdateKeysConfig, m, oldM DataShareProcessorSpecificManifest) error {
-	// Post-update, manifests must have at least one batch signing key version.
-	if len(m.BatchSigningPublicKeys) == 0 {
-		return errors.New("no batch signing public keys")
+	if err := validatePostUpdateBatchSigningKeyVersions(cfg, m.BatchSigningPublicKeys); err != nil {
+		return err
 	}
 
-	// Post-update, the key versions in the manifest's batch signing key must
-	// match the key versions in the update config's batch signing key.
-	kids := map[string]struct{}{}
-	_ = cfg.BatchSigningKey.Versions(func(v key.Version) error {
-		kid := cfg.batchSigningKeyID(v.CreationTimestamp)
-		kids[kid] = struct{}{}
-		return nil
-	})
-	for kid := range m.BatchSigningPublicKeys {
-		if _, ok := kids[kid]; !ok {
-			return fmt.Errorf("manifest included unexpected batch signing key version %q", kid)
+	// Post-update, if the update config includes a task signing key, the key
+	// versions in the manifest's task signing key must match its versions.
+	if !cfg.TaskSigningKey.IsEmpty() {
+		kids := map[string]struct{}{}
+		_ = cfg.TaskSigningKey.Versions(func(v key.Version) error {
+			kids[cfg.taskSigningKeyID(v.CreationTimestamp)] = struct{}{}
+			return nil
+		})
+		for kid := range m.TaskSigningPublicKeys {
+			if _, ok := kids[kid]; !ok {
+				return fmt.Errorf("manifest included unexpected task signing key version %q", kid)
+			}
+			delete(kids, kid)
+		}
+		for kid := range kids {
+			return fmt.Errorf("manifest missing expected task signing key version %q", kid)
 		}
-		delete(kids, kid)
-	}
-	for kid := range kids {
-		return fmt.Errorf("manifest missing expected batch signing key version %q", kid)
 	}
 
 	// Post-update, manifests must have exactly one packet encryption key version.
@@ -338,40 +570,155 @@ func validatePostUpdateManifest(cfg UpdateKeysConfig, m, oldM DataShareProcessor
 	}
 
 	// Post-update, manifests' key data for key versions that exist both pre- &
-	// post-update must match exactly, if their key data matches.
-	for kid, key := range m.BatchSigningPublicKeys {
-		if oldKey, ok := oldM.BatchSigningPublicKeys[kid]; ok {
+	// post-update must match exactly, if their key data matches, except that
+	// expirations within the renewal window may be refreshed.
+	if err := validatePreExistingBatchSigningKeys(cfg, m.BatchSigningPublicKeys, oldM.BatchSigningPublicKeys); err != nil {
+		return err
+	}
+	for kid, key := range m.PacketEncryptionKeyCSRs {
+		if oldKey, ok := oldM.PacketEncryptionKeyCSRs[kid]; ok {
 			oldPubkey, err := oldKey.toPublicKey()
 			if err != nil {
-				return fmt.Errorf("couldn't parse batch signing key version %q from old manifest: %w", kid, err)
+				return fmt.Errorf("couldn't parse packet encryption key version %q from old manifest: %w", kid, err)
 			}
 			newPubkey, err := key.toPublicKey()
 			if err != nil {
-				return fmt.Errorf("couldn't parse batch signing key version %q from new manifest: %w", kid, err)
+				return fmt.Errorf("couldn't parse packet encryption key version %q from new manifest: %w", kid, err)
 			}
 
 			if oldPubkey.Equal(newPubkey) && key != oldKey {
-				return fmt.Errorf("pre-existing batch signing key %q modified", kid)
+				return fmt.Errorf("pre-existing packet encryption key %q modified", kid)
 			}
 		}
 	}
-	for kid, key := range m.PacketEncryptionKeyCSRs {
-		if oldKey, ok := oldM.PacketEncryptionKeyCSRs[kid]; ok {
+
+	return nil
+}
+
+// validatePostUpdateBatchSigningKeyVersions verifies that, post-update, the
+// given batch signing public keys are non-empty & are exactly the key versions
+// in the update config's batch signing key.
+func validatePostUpdateBatchSigningKeyVersions(cfg UpdateKeysConfig, pks BatchSigningPublicKeys) error {
+	// Post-update, manifests must have at least one batch signing key version.
+	if len(pks) == 0 {
+		return errors.New("no batch signing public keys")
+	}
+
+	// Post-update, the key versions in the manifest's batch signing key must
+	// match the key versions in the update config's batch signing key.
+	kids := map[string]struct{}{}
+	_ = cfg.BatchSigningKey.Versions(func(v key.Version) error {
+		kid := cfg.batchSigningKeyID(v.CreationTimestamp)
+		kids[kid] = struct{}{}
+		return nil
+	})
+	for kid := range pks {
+		if _, ok := kids[kid]; !ok {
+			return fmt.Errorf("manifest included unexpected batch signing key version %q", kid)
+		}
+		delete(kids, kid)
+	}
+	for kid := range kids {
+		return fmt.Errorf("manifest missing expected batch signing key version %q", kid)
+	}
+	return nil
+}
+
+// validatePreExistingBatchSigningKeys verifies that batch signing public keys
+// present both pre- & post-update are unmodified if their key material
+// matches, except that expirations within the renewal window may be refreshed.
+func validatePreExistingBatchSigningKeys(cfg UpdateKeysConfig, pks, oldPKs BatchSigningPublicKeys) error {
+	for kid, key := range pks {
+		if oldKey, ok := oldPKs[kid]; ok {
 			oldPubkey, err := oldKey.toPublicKey()
 			if err != nil {
-				return fmt.Errorf("couldn't parse packet encryption key version %q from old manifest: %w", kid, err)
+				return fmt.Errorf("couldn't parse batch signing key version %q from old manifest: %w", kid, err)
 			}
 			newPubkey, err := key.toPublicKey()
 			if err != nil {
-				return fmt.Errorf("couldn't parse packet encryption key version %q from new manifest: %w", kid, err)
+				return fmt.Errorf("couldn't parse batch signing key version %q from new manifest: %w", kid, err)
 			}
 
-			if oldPubkey.Equal(newPubkey) && key != oldKey {
-				return fmt.Errorf("pre-existing packet encryption key %q modified", kid)
+			if oldPubkey.Equal(newPubkey) && !key.Equal(oldKey) && !(key.PublicKey == oldKey.PublicKey && cfg.needsRenewal(oldKey)) {
+				return fmt.Errorf("pre-existing batch signing key %q modified", kid)
 			}
 		}
 	}
+	return nil
+}
 
+// validateExpirations verifies that no public key advertised in the manifest
+// has expired, or expires within the update config's minimum expiration
+// validity, so that no advertised key expires before the next rotation has a
+// chance to refresh it. Unparseable expirations are only rejected if a minimum
+// expiration validity is set.
+func validateExpirations(cfg UpdateKeysConfig, m DataShareProcessorSpecificManifest) error {
+	deadline := cfg.now().Add(cfg.MinimumExpirationValidity)
+	for _, keys := range []struct {
+		kind string
+		pks  BatchSigningPublicKeys
+	}{
+		{"batch signing", m.BatchSigningPublicKeys},
+		{"task signing", m.TaskSigningPublicKeys},
+	} {
+		for kid, pk := range keys.pks {
+			expiration, err := pk.expiration()
+			if err != nil {
+				if cfg.MinimumExpirationValidity <= 0 {
+					continue
+				}
+				return fmt.Errorf("couldn't parse expiration of %s key version %q: %w", keys.kind, kid, err)
+			}
+			if !expiration.After(cfg.now()) {
+				return fmt.Errorf("%s key version %q expired at %s", keys.kind, kid, pk.Expiration)
+			}
+			if expiration.Before(deadline) {
+				return fmt.Errorf("%s key version %q expires at %s, within %v", keys.kind, kid, pk.Expiration, cfg.MinimumExpirationValidity)
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	// gcpWorkloadIdentityPoolProviderRE matches the resource names of GCP
+	// workload identity pool providers.
+	gcpWorkloadIdentityPoolProviderRE = regexp.MustCompile(`^projects/[0-9]+/locations/global/workloadIdentityPools/[a-z0-9-]+/providers/[a-z0-9-]+$`)
+	// awsRoleARNRE matches the ARNs of AWS IAM roles.
+	awsRoleARNRE = regexp.MustCompile(`^arn:aws[a-z-]*:iam::[0-9]{12}:role/.+$`)
+)
+
+// validateFormat verifies that the manifest's fields are valid for its
+// format. Format 2 adds identity federation fields, which must be well-formed,
+// and requires any ingestion & peer validation identities to be AWS IAM role
+// ARNs, since they are assumed using the advertised web identity audience.
+// Identity federation fields may not be set in manifests of other formats,
+// which peers would not expect to contain them.
+func validateFormat(m DataShareProcessorSpecificManifest) error {
+	if m.Format != 2 {
+		switch {
+		case m.GCPWorkloadIdentityPoolProvider != "":
+			return fmt.Errorf("format %d manifest has GCP workload identity pool provider, which requires format 2", m.Format)
+		case m.AWSWebIdentityAudience != "":
+			return fmt.Errorf("format %d manifest has AWS web identity audience, which requires format 2", m.Format)
+		}
+		return nil
+	}
+
+	if m.GCPWorkloadIdentityPoolProvider != "" && !gcpWorkloadIdentityPoolProviderRE.MatchString(m.GCPWorkloadIdentityPoolProvider) {
+		return fmt.Errorf("malformed GCP workload identity pool provider %q", m.GCPWorkloadIdentityPoolProvider)
+	}
+	for _, identity := range []struct{ kind, arn string }{
+		{"ingestion", m.IngestionIdentity},
+		{"peer validation", m.PeerValidationIdentity},
+	} {
+		if identity.arn != "" && !awsRoleARNRE.MatchString(identity.arn) {
+			return fmt.Errorf("%s identity %q is not an AWS IAM role ARN", identity.kind, identity.arn)
+		}
+	}
+	if m.AWSWebIdentityAudience != "" && m.IngestionIdentity == "" && m.PeerValidationIdentity == "" {
+		return errors.New("AWS web identity audience specified without an ingestion or peer validation identity to assume")
+	}
 	return nil
 }
 
@@ -399,6 +746,25 @@ func validateKeyMaterialAgainstManifest(cfg UpdateKeysConfig, m DataShareProcess
 		return err
 	}
 
+	// Verify task signing keys.
+	if err := cfg.TaskSigningKey.Versions(func(v key.Version) error {
+		kid := cfg.taskSigningKeyID(v.CreationTimestamp)
+		tsk, ok := m.TaskSigningPublicKeys[kid]
+		if !ok {
+			return nil // key version does not exist in manifest
+		}
+		manifestPubkey, err := tsk.toPublicKey()
+		if err != nil {
+			return fmt.Errorf("couldn't parse task signing key version %q from manifest: %w", kid, err)
+		}
+		if !manifestPubkey.Equal(v.KeyMaterial.Public()) {
+			return fmt.Errorf("public key mismatch in task signing key version %q", kid)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
 	// Verify packet encryption keys.
 	if err := cfg.PacketEncryptionKey.Versions(func(v key.Version) error {
 		kid := cfg.packetEncryptionKeyID(v.CreationTimestamp)
@@ -434,6 +800,80 @@ type IngestorGlobalManifest struct {
 	BatchSigningPublicKeys BatchSigningPublicKeys `json:"batch-signing-public-keys"`
 }
 
+// UpdateKeys returns a copy of the ingestor global manifest with its batch
+// signing public keys updated to match the update config's batch signing key,
+// subject to the same validations as DataShareProcessorSpecificManifest's
+// UpdateKeys. Ingestor global manifests advertise no packet encryption or task
+// signing keys, so the update config's packet encryption & task signing keys
+// are ignored.
+func (m IngestorGlobalManifest) UpdateKeys(cfg UpdateKeysConfig) (IngestorGlobalManifest, error) {
+	// Validate parameters.
+	if cfg.BatchSigningKey.IsEmpty() {
+		return IngestorGlobalManifest{}, errors.New("invalid update config: batch signing key has no key versions")
+	}
+	cfg.PacketEncryptionKey, cfg.TaskSigningKey = key.Key{}, key.Key{}
+
+	// The batch signing key validations of data share processor specific
+	// manifests are reused, on a manifest holding only the batch signing keys.
+	bskManifest := func(m IngestorGlobalManifest) DataShareProcessorSpecificManifest {
+		return DataShareProcessorSpecificManifest{BatchSigningPublicKeys: m.BatchSigningPublicKeys}
+	}
+	if !cfg.SkipPreUpdateValidations {
+		if err := validatePreUpdateManifest(cfg, bskManifest(m)); err != nil {
+			return IngestorGlobalManifest{}, fmt.Errorf("manifest pre-update validation error: %w", err)
+		}
+		if err := validateKeyMaterialAgainstManifest(cfg, bskManifest(m)); err != nil {
+			return IngestorGlobalManifest{}, fmt.Errorf("manifest pre-update validation error: %w", err)
+		}
+	}
+
+	// Update batch signing key.
+	bspks, err := updatePublicKeys(cfg, "batch signing", cfg.batchSigningKeyExpiration(), cfg.BatchSigningKey, cfg.batchSigningKeyID, m.BatchSigningPublicKeys)
+	if err != nil {
+		return IngestorGlobalManifest{}, err
+	}
+	newM := m
+	newM.BatchSigningPublicKeys = bspks
+
+	// Validate results.
+	if !cfg.SkipPostUpdateValidations {
+		if err := validatePostUpdateBatchSigningKeyVersions(cfg, newM.BatchSigningPublicKeys); err != nil {
+			return IngestorGlobalManifest{}, fmt.Errorf("manifest post-update validation error: %w", err)
+		}
+		if err := validatePreExistingBatchSigningKeys(cfg, newM.BatchSigningPublicKeys, m.BatchSigningPublicKeys); err != nil {
+			return IngestorGlobalManifest{}, fmt.Errorf("manifest post-update validation error: %w", err)
+		}
+		if err := validateKeyMaterialAgainstManifest(cfg, bskManifest(newM)); err != nil {
+			return IngestorGlobalManifest{}, fmt.Errorf("manifest post-update validation error: %w", err)
+		}
+		if err := validateExpirations(cfg, bskManifest(newM)); err != nil {
+			return IngestorGlobalManifest{}, fmt.Errorf("manifest post-update validation error: %w", err)
+		}
+	}
+	return newM, nil
+}
+
+// Equal returns true if and only if this manifest is equal to the given
+// manifest.
+func (m IngestorGlobalManifest) Equal(o IngestorGlobalManifest) bool {
+	return m.Format == o.Format && m.ServerIdentity == o.ServerIdentity && m.BatchSigningPublicKeys.Equal(o.BatchSigningPublicKeys)
+}
+
+// Diff returns a human-readable string describing the differences from the
+// given `o` to this manifest, suitable for logging. Diff returns the empty
+// string if and only if the two manifests are equal.
+func (m IngestorGlobalManifest) Diff(o IngestorGlobalManifest) string {
+	var diffs []string
+	if m.Format != o.Format {
+		diffs = append(diffs, fmt.Sprintf("changed format %d → %d", o.Format, m.Format))
+	}
+	if m.ServerIdentity != o.ServerIdentity {
+		diffs = append(diffs, fmt.Sprintf("changed server identity %+v → %+v", o.ServerIdentity, m.ServerIdentity))
+	}
+	diffs = append(diffs, m.BatchSigningPublicKeys.diffs("batch signing", o.BatchSigningPublicKeys)...)
+	return strings.Join(diffs, "; ")
+}
+
 // ServerIdentity represents the server identity for the advertising party of
 // the manifest.
 type ServerIdentity struct {
@@ -453,13 +893,39 @@ func (b BatchSigningPublicKeys) Equal(o BatchSigningPublicKeys) bool {
 	}
 	for k, bv := range b {
 		ov, ok := o[k]
-		if !ok || bv != ov {
+		if !ok || !bv.Equal(ov) {
 			return false
 		}
 	}
 	return true
 }
 
+// diffs returns human-readable descriptions of the differences from the given
+// `o` to these public keys, which are of the given kind, e.g. "batch signing".
+func (b BatchSigningPublicKeys) diffs(kind string, o BatchSigningPublicKeys) []string {
+	var diffs []string
+	for kid, key := range b {
+		oldKey, ok := o[kid]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("added %s key version %q", kind, kid))
+		default:
+			if oldKey.PublicKey != key.PublicKey {
+				diffs = append(diffs, fmt.Sprintf("modified key material for %s key version %q", kind, kid))
+			}
+			if !oldKey.equalExpiration(key) {
+				diffs = append(diffs, fmt.Sprintf("changed expiration for %s key version %q: %q → %q", kind, kid, oldKey.Expiration, key.Expiration))
+			}
+		}
+	}
+	for kid := range o {
+		if _, ok := b[kid]; !ok {
+			diffs = append(diffs, fmt.Sprintf("removed %s key version %q", kind, kid))
+		}
+	}
+	return diffs
+}
+
 type PacketEncryptionKeyCSRs map[string]PacketEncryptionCertificate
 
 func (p PacketEncryptionKeyCSRs) Equal(o PacketEncryptionKeyCSRs) bool {
@@ -484,7 +950,46 @@ type BatchSigningPublicKey struct {
 	Expiration string `json:"expiration"`
 }
 
-func (k BatchSigningPublicKey) toPublicKey() (*ecdsa.PublicKey, error) {
+// Equal returns true if and only if this public key is equal to the given
+// public key. Expirations are equal if they denote the same instant, even if
+// they are encoded differently.
+func (k BatchSigningPublicKey) Equal(o BatchSigningPublicKey) bool {
+	return k.PublicKey == o.PublicKey && k.equalExpiration(o)
+}
+
+func (k BatchSigningPublicKey) equalExpiration(o BatchSigningPublicKey) bool {
+	kExp, kErr := k.expiration()
+	oExp, oErr := o.expiration()
+	if kErr != nil || oErr != nil {
+		return k.Expiration == o.Expiration
+	}
+	return kExp.Equal(oExp)
+}
+
+// expiration returns the parsed expiration of this public key.
+func (k BatchSigningPublicKey) expiration() (time.Time, error) {
+	return time.Parse(time.RFC3339, k.Expiration)
+}
+
+// PublicKeyEqual returns true if k & o hold the same public key. Unlike
+// comparing them with ==, this ignores differences between CSRs which are
+// signed separately for the same key, since ECDSA signatures are randomized.
+// Certificates whose public key can't be parsed are compared with ==.
+func (k PacketEncryptionCertificate) PublicKeyEqual(o PacketEncryptionCertificate) bool {
+	kPub, err := k.toPublicKey()
+	if err != nil {
+		return k == o
+	}
+	oPub, err := o.toPublicKey()
+	if err != nil {
+		return k == o
+	}
+	return kPub.Equal(oPub)
+}
+
+// toPublicKey parses the public key, which is an *ecdsa.PublicKey for P256
+// batch signing keys or an ed25519.PublicKey for Ed25519 batch signing keys.
+func (k BatchSigningPublicKey) toPublicKey() (key.PublicKey, error) {
 	pemPKIX, _ := pem.Decode([]byte(k.PublicKey))
 	if pemPKIX == nil {
 		return nil, errors.New("couldn't parse as PEM")
@@ -493,21 +998,48 @@ func (k BatchSigningPublicKey) toPublicKey() (*ecdsa.PublicKey, error) {
 	if err != nil {
 		return nil, fmt.Errorf("couldn't parse as PKIX: %w", err)
 	}
-	pub, ok := pkix.(*ecdsa.PublicKey)
-	if !ok {
-		return nil, fmt.Errorf("PKIX public key was a %T, want %T", pub, (*ecdsa.PublicKey)(nil))
+	switch pub := pkix.(type) {
+	case *ecdsa.PublicKey:
+		return pub, nil
+	case ed25519.PublicKey:
+		return pub, nil
+	default:
+		return nil, fmt.Errorf("PKIX public key was a %T, want %T or %T", pub, (*ecdsa.PublicKey)(nil), ed25519.PublicKey(nil))
 	}
-	return pub, nil
 }
 
 // PacketEncryptionCertificate represents a certificate containing a public key
-// used for packet encryption.
+// used for packet encryption. Exactly one of its fields is set.
 type PacketEncryptionCertificate struct {
-	// CertificateSigningRequest is the PEM armored PKCS#10 CSR
-	CertificateSigningRequest string `json:"certificate-signing-request"`
+	// CertificateSigningRequest is the PEM armored PKCS#10 CSR, for ECDSA
+	// P256 keys.
+	CertificateSigningRequest string `json:"certificate-signing-request,omitempty"`
+	// PublicKey is the PEM armored base64 encoding of the ASN.1 encoding of
+	// the PKIX SubjectPublicKeyInfo structure, for X25519 keys, which cannot
+	// sign a CSR.
+	PublicKey string `json:"public-key,omitempty"`
 }
 
-func (k PacketEncryptionCertificate) toPublicKey() (*ecdsa.PublicKey, error) {
+// toPublicKey parses the public key, which is an *ecdsa.PublicKey for P256
+// packet encryption keys or an *ecdh.PublicKey for X25519 packet encryption
+// keys.
+func (k PacketEncryptionCertificate) toPublicKey() (key.PublicKey, error) {
+	if k.CertificateSigningRequest == "" && k.PublicKey != "" {
+		pemPKIX, _ := pem.Decode([]byte(k.PublicKey))
+		if pemPKIX == nil {
+			return nil, errors.New("couldn't parse as PEM")
+		}
+		pkix, err := x509.ParsePKIXPublicKey(pemPKIX.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse as PKIX: %w", err)
+		}
+		pub, ok := pkix.(*ecdh.PublicKey)
+		if !ok || pub.Curve() != ecdh.X25519() {
+			return nil, fmt.Errorf("PKIX public key was a %T, want an X25519 %T", pkix, (*ecdh.PublicKey)(nil))
+		}
+		return pub, nil
+	}
+
 	pemCSR, _ := pem.Decode([]byte(k.CertificateSigningRequest))
 	if pemCSR == nil {
 		return nil, fmt.Errorf("couldn't parse as PEM")
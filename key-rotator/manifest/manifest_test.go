@@ -1,8 +1,13 @@
 package manifest
 
 import (
-	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -177,7 +182,7 @@ func TestUpdateKeys(t *testing.T) {
 			// have to do it this way because not all methods of serializing a
 			// public key are deterministic, i.e. repeatedly serializing a
 			// public key into a CSR will produce different bytes each time.)
-			wantBSKPubkeys, wantPEKPubkeys := map[string]*ecdsa.PublicKey{}, map[string]*ecdsa.PublicKey{}
+			wantBSKPubkeys, wantPEKPubkeys := map[string]key.PublicKey{}, map[string]key.PublicKey{}
 			for kid, bsk := range test.wantBSKs {
 				pub, err := bsk.toPublicKey()
 				if err != nil {
@@ -193,7 +198,7 @@ func TestUpdateKeys(t *testing.T) {
 				wantPEKPubkeys[kid] = pub
 			}
 
-			gotBSKPubkeys, gotPEKPubkeys := map[string]*ecdsa.PublicKey{}, map[string]*ecdsa.PublicKey{}
+			gotBSKPubkeys, gotPEKPubkeys := map[string]key.PublicKey{}, map[string]key.PublicKey{}
 			for kid, bsk := range gotBSKs {
 				pub, err := bsk.toPublicKey()
 				if err != nil {
@@ -329,6 +334,429 @@ func TestUpdateKeys(t *testing.T) {
 	}
 }
 
+func TestUpdateKeysTaskSigningKey(t *testing.T) {
+	t.Parallel()
+
+	// Key material is generated once & shared between keys & manifests, so
+	// that they match.
+	materials := map[int64]key.Material{10: keytest.Material("tsk-10"), 20: keytest.Material("tsk-20")}
+	bskMaterial, pekMaterial := keytest.Material(bskKID(10)), keytest.Material(pekKID(10))
+	newKey := func(materials map[int64]key.Material, primaryTS int64, tss ...int64) key.Key {
+		v := func(ts int64) key.Version {
+			return key.Version{KeyMaterial: materials[ts], CreationTimestamp: ts}
+		}
+		var others []key.Version
+		for _, ts := range tss {
+			others = append(others, v(ts))
+		}
+		k, err := key.FromVersions(v(primaryTS), others...)
+		if err != nil {
+			t.Fatalf("Couldn't create key: %v", err)
+		}
+		return k
+	}
+	tsk := func(primaryTS int64, tss ...int64) key.Key { return newKey(materials, primaryTS, tss...) }
+	cfg := UpdateKeysConfig{
+		BatchSigningKey:             newKey(map[int64]key.Material{10: bskMaterial}, 10),
+		BatchSigningKeyIDPrefix:     bskPrefix,
+		PacketEncryptionKey:         newKey(map[int64]key.Material{10: pekMaterial}, 10),
+		PacketEncryptionKeyIDPrefix: pekPrefix,
+		PacketEncryptionKeyCSRFQDN:  fqdn,
+		TaskSigningKeyIDPrefix:      "tsk",
+	}
+	m := DataShareProcessorSpecificManifest{
+		Format:                  1,
+		BatchSigningPublicKeys:  BatchSigningPublicKeys{bskKID(10): batchSigningPublicKey(bskMaterial)},
+		PacketEncryptionKeyCSRs: PacketEncryptionKeyCSRs{pekKID(10): packetEncryptionCertificate(pekMaterial)},
+	}
+
+	// Task signing keys are added to a manifest which has none.
+	cfg.TaskSigningKey = tsk(10, 20)
+	newM, err := m.UpdateKeys(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error from UpdateKeys: %v", err)
+	}
+	if len(newM.TaskSigningPublicKeys) != 2 {
+		t.Errorf("Wanted 2 task signing public keys, got: %v", newM.TaskSigningPublicKeys)
+	}
+	for _, ts := range []int64{10, 20} {
+		kid := fmt.Sprintf("tsk-%d", ts)
+		pubkey, err := newM.TaskSigningPublicKeys[kid].toPublicKey()
+		if err != nil {
+			t.Fatalf("Couldn't parse task signing key version %q: %v", kid, err)
+		}
+		if !pubkey.Equal(materials[ts].Public()) {
+			t.Errorf("Task signing key version %q has unexpected public key", kid)
+		}
+	}
+	if diff := newM.Diff(m); !strings.Contains(diff, `added task signing key version "tsk-20"`) {
+		t.Errorf("Diff does not describe added task signing key: %s", diff)
+	}
+
+	// Task signing keys are left unchanged if no task signing key is provided.
+	cfg.TaskSigningKey = key.Key{}
+	unchangedM, err := newM.UpdateKeys(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error from UpdateKeys: %v", err)
+	}
+	if !unchangedM.Equal(newM) {
+		t.Errorf("UpdateKeys without task signing key modified manifest: %s", unchangedM.Diff(newM))
+	}
+
+	// A primary task signing key version not yet published is rejected.
+	m.TaskSigningPublicKeys = BatchSigningPublicKeys{"tsk-10": newM.TaskSigningPublicKeys["tsk-10"]}
+	cfg.TaskSigningKey = tsk(20, 10)
+	if _, err := m.UpdateKeys(cfg); err == nil || !strings.Contains(err.Error(), "task signing key primary version") {
+		t.Errorf("Wanted error about unpublished task signing key primary version, got: %v", err)
+	}
+}
+
+func TestUpdateKeysX25519PacketEncryptionKey(t *testing.T) {
+	t.Parallel()
+
+	// Key material is generated once & shared between keys & manifests, so
+	// that they match. Version 10 is a legacy P256 version; version 20 is an
+	// X25519 version.
+	x25519Material, err := key.X25519.New()
+	if err != nil {
+		t.Fatalf("Couldn't create X25519 key: %v", err)
+	}
+	materials := map[int64]key.Material{10: keytest.Material(pekKID(10)), 20: x25519Material}
+	newPEK := func(primaryTS int64, tss ...int64) key.Key {
+		var others []key.Version
+		for _, ts := range tss {
+			others = append(others, key.Version{KeyMaterial: materials[ts], CreationTimestamp: ts})
+		}
+		k, err := key.FromVersions(key.Version{KeyMaterial: materials[primaryTS], CreationTimestamp: primaryTS}, others...)
+		if err != nil {
+			t.Fatalf("Couldn't create key: %v", err)
+		}
+		return k
+	}
+	cfg := UpdateKeysConfig{
+		BatchSigningKey:             bsk(10),
+		BatchSigningKeyIDPrefix:     bskPrefix,
+		PacketEncryptionKey:         newPEK(20, 10),
+		PacketEncryptionKeyIDPrefix: pekPrefix,
+		PacketEncryptionKeyCSRFQDN:  fqdn,
+	}
+	m := DataShareProcessorSpecificManifest{
+		Format:                  1,
+		BatchSigningPublicKeys:  manifestBSK(10),
+		PacketEncryptionKeyCSRs: manifestPEK(10),
+	}
+
+	// An X25519 primary version replaces a legacy P256 version, and is
+	// published as a PKIX public key rather than a CSR.
+	newM, err := m.UpdateKeys(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error from UpdateKeys: %v", err)
+	}
+	pec, ok := newM.PacketEncryptionKeyCSRs[pekKID(20)]
+	if !ok || len(newM.PacketEncryptionKeyCSRs) != 1 {
+		t.Fatalf("Wanted only packet encryption key version %q, got: %v", pekKID(20), newM.PacketEncryptionKeyCSRs)
+	}
+	if pec.CertificateSigningRequest != "" {
+		t.Errorf("X25519 packet encryption key version published with CSR %q", pec.CertificateSigningRequest)
+	}
+	pubkey, err := pec.toPublicKey()
+	if err != nil {
+		t.Fatalf("Couldn't parse packet encryption key version %q: %v", pekKID(20), err)
+	}
+	if !pubkey.Equal(x25519Material.Public()) {
+		t.Errorf("Packet encryption key version %q has unexpected public key", pekKID(20))
+	}
+	if mismatches := newM.Mismatches(cfg); len(mismatches) != 0 {
+		t.Errorf("Unexpected mismatches: %v", mismatches)
+	}
+
+	// The X25519 public key is serialized under "public-key" alone.
+	manifestBytes, err := json.Marshal(newM)
+	if err != nil {
+		t.Fatalf("Couldn't marshal manifest: %v", err)
+	}
+	var rawM struct {
+		PacketEncryptionKeys map[string]map[string]string `json:"packet-encryption-keys"`
+	}
+	if err := json.Unmarshal(manifestBytes, &rawM); err != nil {
+		t.Fatalf("Couldn't unmarshal manifest: %v", err)
+	}
+	if diff := cmp.Diff(map[string]string{"public-key": pec.PublicKey}, rawM.PacketEncryptionKeys[pekKID(20)]); diff != "" {
+		t.Errorf("Unexpected serialized packet encryption key (-want +got):\n%s", diff)
+	}
+
+	// Updating again leaves the manifest unchanged.
+	unchangedM, err := newM.UpdateKeys(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error from UpdateKeys: %v", err)
+	}
+	if !unchangedM.Equal(newM) {
+		t.Errorf("Repeated UpdateKeys modified manifest: %s", unchangedM.Diff(newM))
+	}
+
+	// The public key is reported in place of a CSR.
+	fields, err := newM.PublicKeys(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error from PublicKeys: %v", err)
+	}
+	if _, ok := fields[PacketEncryptionKeyCSRField]; ok || fields[PacketEncryptionKeyField] != pec.PublicKey {
+		t.Errorf("Unexpected packet encryption key fields from PublicKeys: %v", fields)
+	}
+
+	// Rolling back to the legacy P256 version publishes its CSR again.
+	cfg.PacketEncryptionKey = newPEK(10, 20)
+	rolledBackM, err := newM.UpdateKeys(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error from UpdateKeys: %v", err)
+	}
+	if pec := rolledBackM.PacketEncryptionKeyCSRs[pekKID(10)]; pec.CertificateSigningRequest == "" || pec.PublicKey != "" {
+		t.Errorf("Unexpected legacy packet encryption key version: %+v", pec)
+	}
+}
+
+func TestIngestorGlobalManifestUpdateKeys(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	identity := ServerIdentity{GCPServiceAccountEmail: "ingestor@example.com"}
+	m := IngestorGlobalManifest{
+		Format:                 1,
+		ServerIdentity:         identity,
+		BatchSigningPublicKeys: manifestBSKWithExpiration(now.Add(time.Hour), 10),
+	}
+	cfg := UpdateKeysConfig{
+		BatchSigningKey:         bsk(10, 20),
+		BatchSigningKeyIDPrefix: bskPrefix,
+		Now:                     now,
+	}
+
+	// A new batch signing key version is added; existing versions, & non-key
+	// data, are unchanged.
+	newM, err := m.UpdateKeys(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error from UpdateKeys: %v", err)
+	}
+	wantM := IngestorGlobalManifest{
+		Format:                 1,
+		ServerIdentity:         identity,
+		BatchSigningPublicKeys: manifestBSKWithExpiration(now.Add(publicKeyValidityPeriod), 10, 20),
+	}
+	wantM.BatchSigningPublicKeys[bskKID(10)] = m.BatchSigningPublicKeys[bskKID(10)]
+	if !newM.Equal(wantM) {
+		t.Errorf("Unexpected manifest from UpdateKeys: %s", newM.Diff(wantM))
+	}
+	if diff := newM.Diff(m); diff != `added batch signing key version "bsk-20"` {
+		t.Errorf("Unexpected diff: %s", diff)
+	}
+
+	// Versions removed from the key are removed from the manifest.
+	cfg.BatchSigningKey = bsk(20)
+	newM, err = newM.UpdateKeys(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error from UpdateKeys: %v", err)
+	}
+	if _, ok := newM.BatchSigningPublicKeys[bskKID(10)]; ok || len(newM.BatchSigningPublicKeys) != 1 {
+		t.Errorf("Wanted only batch signing key version %q, got: %v", bskKID(20), newM.BatchSigningPublicKeys)
+	}
+
+	// Packet encryption keys are ignored.
+	cfg.PacketEncryptionKey = pek(10)
+	if _, err := newM.UpdateKeys(cfg); err != nil {
+		t.Errorf("Unexpected error from UpdateKeys with packet encryption key: %v", err)
+	}
+
+	// A primary batch signing key version not yet published is rejected.
+	cfg.BatchSigningKey = bsk(20, 10)
+	if _, err := m.UpdateKeys(cfg); err == nil || !strings.Contains(err.Error(), "batch signing key primary version") {
+		t.Errorf("Wanted error about unpublished batch signing key primary version, got: %v", err)
+	}
+
+	// Published key material which doesn't match the key is rejected.
+	cfg.BatchSigningKey = bsk(10)
+	m.BatchSigningPublicKeys = BatchSigningPublicKeys{bskKID(10): manifestBSK(20)[bskKID(20)]}
+	if _, err := m.UpdateKeys(cfg); err == nil || !strings.Contains(err.Error(), "public key mismatch") {
+		t.Errorf("Wanted error about public key mismatch, got: %v", err)
+	}
+
+	// An empty batch signing key is rejected.
+	if _, err := m.UpdateKeys(UpdateKeysConfig{}); err == nil {
+		t.Errorf("Wanted error from UpdateKeys with empty batch signing key")
+	}
+}
+
+func TestUpdateKeysExpirations(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	renewedExpiration := now.Add(publicKeyValidityPeriod).Format(time.RFC3339)
+	for _, test := range []struct {
+		name            string
+		expiration      time.Time
+		renewalWindow   time.Duration
+		minimumValidity time.Duration
+		bskExpiration   time.Duration
+		wantExpiration  string // ignored if wantErrStr is set
+		wantErrStr      string
+		wantDiff        string
+	}{
+		{
+			name:           "renewal disabled",
+			expiration:     now.Add(time.Hour),
+			wantExpiration: now.Add(time.Hour).Format(time.RFC3339),
+		},
+		{
+			name:           "expiration outside renewal window",
+			expiration:     now.Add(48 * time.Hour),
+			renewalWindow:  24 * time.Hour,
+			wantExpiration: now.Add(48 * time.Hour).Format(time.RFC3339),
+		},
+		{
+			name:           "expiration within renewal window",
+			expiration:     now.Add(time.Hour),
+			renewalWindow:  24 * time.Hour,
+			wantExpiration: renewedExpiration,
+			wantDiff:       fmt.Sprintf(`changed expiration for batch signing key version %q: %q → %q`, bskKID(0), now.Add(time.Hour).Format(time.RFC3339), renewedExpiration),
+		},
+		{
+			name:           "expired",
+			expiration:     now.Add(-time.Hour),
+			renewalWindow:  24 * time.Hour,
+			wantExpiration: renewedExpiration,
+			wantDiff:       fmt.Sprintf(`changed expiration for batch signing key version %q: %q → %q`, bskKID(0), now.Add(-time.Hour).Format(time.RFC3339), renewedExpiration),
+		},
+		{
+			name:            "renewed expiration satisfies minimum validity",
+			expiration:      now.Add(time.Hour),
+			renewalWindow:   24 * time.Hour,
+			minimumValidity: 24 * time.Hour,
+			wantExpiration:  renewedExpiration,
+			wantDiff:        fmt.Sprintf(`changed expiration for batch signing key version %q: %q → %q`, bskKID(0), now.Add(time.Hour).Format(time.RFC3339), renewedExpiration),
+		},
+		{
+			name:            "expiration within minimum validity",
+			expiration:      now.Add(time.Hour),
+			minimumValidity: 24 * time.Hour,
+			wantErrStr:      "expires at",
+		},
+		{
+			name:            "renewal window shorter than minimum validity",
+			expiration:      now.Add(2 * time.Hour),
+			renewalWindow:   time.Hour,
+			minimumValidity: 24 * time.Hour,
+			wantErrStr:      "expires at",
+		},
+		{
+			name:       "expired without renewal",
+			expiration: now.Add(-time.Hour),
+			wantErrStr: "expired at",
+		},
+		{
+			name:           "renewal with configured expiration",
+			expiration:     now.Add(time.Hour),
+			renewalWindow:  24 * time.Hour,
+			bskExpiration:  30 * 24 * time.Hour,
+			wantExpiration: now.Add(30 * 24 * time.Hour).Format(time.RFC3339),
+			wantDiff:       fmt.Sprintf(`changed expiration for batch signing key version %q: %q → %q`, bskKID(0), now.Add(time.Hour).Format(time.RFC3339), now.Add(30*24*time.Hour).Format(time.RFC3339)),
+		},
+		{
+			name:           "configured expiration outside renewal window",
+			expiration:     now.Add(48 * time.Hour),
+			renewalWindow:  24 * time.Hour,
+			bskExpiration:  30 * 24 * time.Hour,
+			wantExpiration: now.Add(48 * time.Hour).Format(time.RFC3339),
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			cfg := UpdateKeysConfig{
+				BatchSigningKey:             bsk(0),
+				BatchSigningKeyIDPrefix:     bskPrefix,
+				PacketEncryptionKey:         pek(0),
+				PacketEncryptionKeyIDPrefix: pekPrefix,
+				PacketEncryptionKeyCSRFQDN:  fqdn,
+				Now:                         now,
+				ExpirationRenewalWindow:     test.renewalWindow,
+				MinimumExpirationValidity:   test.minimumValidity,
+				BatchSigningKeyExpiration:   test.bskExpiration,
+			}
+			m := DataShareProcessorSpecificManifest{
+				Format:                  1,
+				BatchSigningPublicKeys:  manifestBSKWithExpiration(test.expiration, 0),
+				PacketEncryptionKeyCSRs: manifestPEK(0),
+			}
+
+			newM, err := m.UpdateKeys(cfg)
+			if test.wantErrStr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErrStr) {
+					t.Errorf("Wanted error containing %q, got: %v", test.wantErrStr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error from UpdateKeys: %v", err)
+			}
+			if got := newM.BatchSigningPublicKeys[bskKID(0)].Expiration; got != test.wantExpiration {
+				t.Errorf("Wanted expiration %q, got %q", test.wantExpiration, got)
+			}
+			if diff := newM.Diff(m); diff != test.wantDiff {
+				t.Errorf("Wanted diff %q, got %q", test.wantDiff, diff)
+			}
+		})
+	}
+}
+
+func TestUpdateKeysBatchSigningKeyExpiration(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	cfg := UpdateKeysConfig{
+		BatchSigningKey:             bsk(0, 10),
+		BatchSigningKeyIDPrefix:     bskPrefix,
+		PacketEncryptionKey:         pek(0),
+		PacketEncryptionKeyIDPrefix: pekPrefix,
+		PacketEncryptionKeyCSRFQDN:  fqdn,
+		Now:                         now,
+		ExpirationRenewalWindow:     24 * time.Hour,
+		MinimumExpirationValidity:   time.Hour,
+		BatchSigningKeyExpiration:   365 * 24 * time.Hour,
+	}
+	m := DataShareProcessorSpecificManifest{
+		Format:                  1,
+		BatchSigningPublicKeys:  manifestBSKWithExpiration(now.Add(publicKeyValidityPeriod), 0),
+		PacketEncryptionKeyCSRs: manifestPEK(0),
+	}
+
+	// A new batch signing key version is advertised with the configured
+	// expiration, while the existing version's expiration, outside the renewal
+	// window, is unchanged even though it is later.
+	newM, err := m.UpdateKeys(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error from UpdateKeys: %v", err)
+	}
+	if got, want := newM.BatchSigningPublicKeys[bskKID(10)].Expiration, now.Add(365*24*time.Hour).Format(time.RFC3339); got != want {
+		t.Errorf("Wanted expiration %q for new key version, got %q", want, got)
+	}
+	if got, want := newM.BatchSigningPublicKeys[bskKID(0)].Expiration, m.BatchSigningPublicKeys[bskKID(0)].Expiration; got != want {
+		t.Errorf("Wanted expiration %q for existing key version, got %q", want, got)
+	}
+
+	// Once the new version's expiration falls within the renewal window, it is
+	// refreshed without changing its key material.
+	cfg.Now = now.Add(365*24*time.Hour - time.Hour)
+	renewedM, err := newM.UpdateKeys(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error from UpdateKeys: %v", err)
+	}
+	renewed := renewedM.BatchSigningPublicKeys[bskKID(10)]
+	if want := cfg.Now.Add(365 * 24 * time.Hour).Format(time.RFC3339); renewed.Expiration != want {
+		t.Errorf("Wanted renewed expiration %q, got %q", want, renewed.Expiration)
+	}
+	if renewed.PublicKey != newM.BatchSigningPublicKeys[bskKID(10)].PublicKey {
+		t.Errorf("Renewal changed public key: %q → %q", newM.BatchSigningPublicKeys[bskKID(10)].PublicKey, renewed.PublicKey)
+	}
+}
+
 func TestPostUpdateKeysValidations(t *testing.T) {
 	t.Parallel()
 
@@ -674,6 +1102,36 @@ func TestDiff(t *testing.T) {
 			after:    DataShareProcessorSpecificManifest{PeerValidationBucket: "bar"},
 			wantDiff: `changed peer validation bucket "foo" → "bar"`,
 		},
+		{
+			name:     "changed GCP workload identity pool provider",
+			before:   DataShareProcessorSpecificManifest{GCPWorkloadIdentityPoolProvider: "foo"},
+			after:    DataShareProcessorSpecificManifest{GCPWorkloadIdentityPoolProvider: "bar"},
+			wantDiff: `changed GCP workload identity pool provider "foo" → "bar"`,
+		},
+		{
+			name:     "changed AWS web identity audience",
+			before:   DataShareProcessorSpecificManifest{AWSWebIdentityAudience: "foo"},
+			after:    DataShareProcessorSpecificManifest{AWSWebIdentityAudience: "bar"},
+			wantDiff: `changed AWS web identity audience "foo" → "bar"`,
+		},
+		{
+			name:     "added additional field",
+			before:   DataShareProcessorSpecificManifest{},
+			after:    DataShareProcessorSpecificManifest{AdditionalFields: map[string]json.RawMessage{"foo": json.RawMessage(`1`)}},
+			wantDiff: `added field "foo"`,
+		},
+		{
+			name:     "removed additional field",
+			before:   DataShareProcessorSpecificManifest{AdditionalFields: map[string]json.RawMessage{"foo": json.RawMessage(`1`)}},
+			after:    DataShareProcessorSpecificManifest{},
+			wantDiff: `removed field "foo"`,
+		},
+		{
+			name:     "changed additional field",
+			before:   DataShareProcessorSpecificManifest{AdditionalFields: map[string]json.RawMessage{"foo": json.RawMessage(`1`)}},
+			after:    DataShareProcessorSpecificManifest{AdditionalFields: map[string]json.RawMessage{"foo": json.RawMessage(`2`)}},
+			wantDiff: `changed field "foo"`,
+		},
 		{
 			name:     "added batch signing key version",
 			before:   DataShareProcessorSpecificManifest{},
@@ -692,6 +1150,18 @@ func TestDiff(t *testing.T) {
 			after:    DataShareProcessorSpecificManifest{BatchSigningPublicKeys: BatchSigningPublicKeys{"kid": BatchSigningPublicKey{PublicKey: "bar"}}},
 			wantDiff: `modified key material for batch signing key version "kid"`,
 		},
+		{
+			name:     "changed batch signing key expiration",
+			before:   DataShareProcessorSpecificManifest{BatchSigningPublicKeys: BatchSigningPublicKeys{"kid": BatchSigningPublicKey{PublicKey: "foo", Expiration: "2021-06-01T00:00:00Z"}}},
+			after:    DataShareProcessorSpecificManifest{BatchSigningPublicKeys: BatchSigningPublicKeys{"kid": BatchSigningPublicKey{PublicKey: "foo", Expiration: "2121-06-01T00:00:00Z"}}},
+			wantDiff: `changed expiration for batch signing key version "kid": "2021-06-01T00:00:00Z" → "2121-06-01T00:00:00Z"`,
+		},
+		{
+			name:     "re-encoded batch signing key expiration",
+			before:   DataShareProcessorSpecificManifest{BatchSigningPublicKeys: BatchSigningPublicKeys{"kid": BatchSigningPublicKey{PublicKey: "foo", Expiration: "2021-06-01T00:00:00Z"}}},
+			after:    DataShareProcessorSpecificManifest{BatchSigningPublicKeys: BatchSigningPublicKeys{"kid": BatchSigningPublicKey{PublicKey: "foo", Expiration: "2021-06-01T02:00:00+02:00"}}},
+			wantDiff: ``,
+		},
 		{
 			name:     "added packet encryption key version",
 			before:   DataShareProcessorSpecificManifest{},
@@ -730,8 +1200,344 @@ func TestDiff(t *testing.T) {
 	}
 }
 
+func TestPacketEncryptionCertificatePublicKeyEqual(t *testing.T) {
+	t.Parallel()
+
+	m := keytest.Material("pek")
+	for _, test := range []struct {
+		name      string
+		a, b      PacketEncryptionCertificate
+		wantEqual bool
+	}{
+		{
+			name:      "separately signed CSRs for same key",
+			a:         packetEncryptionCertificate(m),
+			b:         packetEncryptionCertificate(m),
+			wantEqual: true,
+		},
+		{
+			name:      "CSRs for different keys",
+			a:         packetEncryptionCertificate(m),
+			b:         packetEncryptionCertificate(keytest.Material("other-pek")),
+			wantEqual: false,
+		},
+		{
+			name:      "identical unparseable CSRs",
+			a:         PacketEncryptionCertificate{CertificateSigningRequest: "foo"},
+			b:         PacketEncryptionCertificate{CertificateSigningRequest: "foo"},
+			wantEqual: true,
+		},
+		{
+			name:      "unparseable CSR",
+			a:         packetEncryptionCertificate(m),
+			b:         PacketEncryptionCertificate{CertificateSigningRequest: "foo"},
+			wantEqual: false,
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			if got := test.a.PublicKeyEqual(test.b); got != test.wantEqual {
+				t.Errorf("PublicKeyEqual = %v, want %v", got, test.wantEqual)
+			}
+		})
+	}
+}
+
+func TestAdditionalFields(t *testing.T) {
+	t.Parallel()
+
+	const manifestJSON = `{
+		"format": 1,
+		"ingestion-bucket": "ingestion-bucket",
+		"peer-validation-bucket": "peer-validation-bucket",
+		"batch-signing-public-keys": {},
+		"packet-encryption-keys": {},
+		"peer-contact": {"email": "ops@example.com"},
+		"region-hint": "us-west-2"
+	}`
+
+	var m DataShareProcessorSpecificManifest
+	if err := json.Unmarshal([]byte(manifestJSON), &m); err != nil {
+		t.Fatalf("Couldn't unmarshal manifest: %v", err)
+	}
+	wantAdditionalFields := map[string]json.RawMessage{
+		"peer-contact": json.RawMessage(`{"email":"ops@example.com"}`),
+		"region-hint":  json.RawMessage(`"us-west-2"`),
+	}
+	if diff := cmp.Diff(wantAdditionalFields, m.AdditionalFields); diff != "" {
+		t.Errorf("Unexpected additional fields (-want +got):\n%s", diff)
+	}
+	if m.IngestionBucket != "ingestion-bucket" {
+		t.Errorf("Unexpected ingestion bucket %q", m.IngestionBucket)
+	}
+
+	// Additional fields survive UpdateKeys.
+	updatedM, err := m.UpdateKeys(UpdateKeysConfig{
+		BatchSigningKey:             bsk(10),
+		BatchSigningKeyIDPrefix:     bskPrefix,
+		PacketEncryptionKey:         pek(10),
+		PacketEncryptionKeyIDPrefix: pekPrefix,
+		PacketEncryptionKeyCSRFQDN:  fqdn,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error from UpdateKeys: %v", err)
+	}
+	if diff := cmp.Diff(wantAdditionalFields, updatedM.AdditionalFields); diff != "" {
+		t.Errorf("UpdateKeys changed additional fields (-want +got):\n%s", diff)
+	}
+
+	// Additional fields survive a marshal/unmarshal round trip.
+	updatedJSON, err := json.Marshal(updatedM)
+	if err != nil {
+		t.Fatalf("Couldn't marshal manifest: %v", err)
+	}
+	var roundTrippedM DataShareProcessorSpecificManifest
+	if err := json.Unmarshal(updatedJSON, &roundTrippedM); err != nil {
+		t.Fatalf("Couldn't unmarshal manifest: %v", err)
+	}
+	if !roundTrippedM.Equal(updatedM) {
+		t.Errorf("Manifest changed by round trip: %s", roundTrippedM.Diff(updatedM))
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(updatedJSON, &fields); err != nil {
+		t.Fatalf("Couldn't unmarshal manifest as map: %v", err)
+	}
+	if got, want := fields["region-hint"], "us-west-2"; got != want {
+		t.Errorf("Unexpected region-hint %v, want %q", got, want)
+	}
+
+	// Manifests without additional fields serialize without them.
+	m.AdditionalFields = nil
+	plainJSON, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("Couldn't marshal manifest: %v", err)
+	}
+	if strings.Contains(string(plainJSON), "region-hint") {
+		t.Errorf("Unexpected additional field in %s", plainJSON)
+	}
+}
+
+func TestFormat2Manifest(t *testing.T) {
+	t.Parallel()
+
+	manifestJSON, err := os.ReadFile(filepath.Join("testdata", "format2_manifest.json"))
+	if err != nil {
+		t.Fatalf("Couldn't read manifest: %v", err)
+	}
+	var m DataShareProcessorSpecificManifest
+	if err := json.Unmarshal(manifestJSON, &m); err != nil {
+		t.Fatalf("Couldn't unmarshal manifest: %v", err)
+	}
+	if m.Format != 2 {
+		t.Errorf("Unexpected format %d", m.Format)
+	}
+	if want := "projects/123456789012/locations/global/workloadIdentityPools/prio-peers/providers/aws-prod"; m.GCPWorkloadIdentityPoolProvider != want {
+		t.Errorf("Unexpected GCP workload identity pool provider %q, want %q", m.GCPWorkloadIdentityPoolProvider, want)
+	}
+	if want := "sts.amazonaws.com/123456789012"; m.AWSWebIdentityAudience != want {
+		t.Errorf("Unexpected AWS web identity audience %q, want %q", m.AWSWebIdentityAudience, want)
+	}
+	if len(m.AdditionalFields) != 0 {
+		t.Errorf("Unexpected additional fields: %v", m.AdditionalFields)
+	}
+
+	// The manifest survives a marshal/unmarshal round trip unchanged.
+	gotJSON, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("Couldn't marshal manifest: %v", err)
+	}
+	var want, got interface{}
+	if err := json.Unmarshal(manifestJSON, &want); err != nil {
+		t.Fatalf("Couldn't unmarshal manifest: %v", err)
+	}
+	if err := json.Unmarshal(gotJSON, &got); err != nil {
+		t.Fatalf("Couldn't unmarshal re-serialized manifest: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Manifest changed by round trip (-want +got):\n%s", diff)
+	}
+
+	// Identity federation fields survive UpdateKeys, which adds only the new
+	// batch signing key version.
+	updatedM, err := m.UpdateKeys(UpdateKeysConfig{
+		BatchSigningKey:             bsk(20, 10, 30),
+		BatchSigningKeyIDPrefix:     bskPrefix,
+		PacketEncryptionKey:         pek(20),
+		PacketEncryptionKeyIDPrefix: pekPrefix,
+		PacketEncryptionKeyCSRFQDN:  fqdn,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error from UpdateKeys: %v", err)
+	}
+	if diff, want := updatedM.Diff(m), `added batch signing key version "bsk-30"`; diff != want {
+		t.Errorf("Unexpected diff from UpdateKeys: got %q, want %q", diff, want)
+	}
+}
+
+func TestValidateFormat(t *testing.T) {
+	t.Parallel()
+
+	const (
+		provider = "projects/123456789012/locations/global/workloadIdentityPools/pool/providers/provider"
+		roleARN  = "arn:aws:iam::123456789012:role/ingestion"
+	)
+	for _, test := range []struct {
+		name       string
+		manifest   DataShareProcessorSpecificManifest
+		wantErrStr string
+	}{
+		{
+			name:     "format 1",
+			manifest: DataShareProcessorSpecificManifest{Format: 1, IngestionIdentity: "not-an-arn"},
+		},
+		{
+			name:     "format 2",
+			manifest: DataShareProcessorSpecificManifest{Format: 2, IngestionIdentity: roleARN, GCPWorkloadIdentityPoolProvider: provider, AWSWebIdentityAudience: "audience"},
+		},
+		{
+			name:     "format 2 without identity federation",
+			manifest: DataShareProcessorSpecificManifest{Format: 2},
+		},
+		{
+			name:       "format 1 with GCP workload identity pool provider",
+			manifest:   DataShareProcessorSpecificManifest{Format: 1, GCPWorkloadIdentityPoolProvider: provider},
+			wantErrStr: "requires format 2",
+		},
+		{
+			name:       "format 1 with AWS web identity audience",
+			manifest:   DataShareProcessorSpecificManifest{Format: 1, IngestionIdentity: roleARN, AWSWebIdentityAudience: "audience"},
+			wantErrStr: "requires format 2",
+		},
+		{
+			name:       "malformed GCP workload identity pool provider",
+			manifest:   DataShareProcessorSpecificManifest{Format: 2, GCPWorkloadIdentityPoolProvider: "projects/my-project/workloadIdentityPools/pool"},
+			wantErrStr: "malformed GCP workload identity pool provider",
+		},
+		{
+			name:       "ingestion identity not a role ARN",
+			manifest:   DataShareProcessorSpecificManifest{Format: 2, IngestionIdentity: "arn:aws:iam::123456789012:user/ingestion"},
+			wantErrStr: "ingestion identity",
+		},
+		{
+			name:       "peer validation identity not a role ARN",
+			manifest:   DataShareProcessorSpecificManifest{Format: 2, PeerValidationIdentity: "peer-validation-identity"},
+			wantErrStr: "peer validation identity",
+		},
+		{
+			name:       "AWS web identity audience without identity",
+			manifest:   DataShareProcessorSpecificManifest{Format: 2, AWSWebIdentityAudience: "audience"},
+			wantErrStr: "without an ingestion or peer validation identity",
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			err := validateFormat(test.manifest)
+			switch {
+			case test.wantErrStr == "" && err != nil:
+				t.Errorf("Unexpected error: %v", err)
+			case test.wantErrStr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErrStr)):
+				t.Errorf("Wanted error containing %q, got: %v", test.wantErrStr, err)
+			}
+		})
+	}
+
+	t.Run("UpdateKeys", func(t *testing.T) {
+		t.Parallel()
+		m := DataShareProcessorSpecificManifest{Format: 1, GCPWorkloadIdentityPoolProvider: provider}
+		_, err := m.UpdateKeys(UpdateKeysConfig{
+			BatchSigningKey:             bsk(0),
+			BatchSigningKeyIDPrefix:     bskPrefix,
+			PacketEncryptionKey:         pek(0),
+			PacketEncryptionKeyIDPrefix: pekPrefix,
+			PacketEncryptionKeyCSRFQDN:  fqdn,
+		})
+		if err == nil || !strings.Contains(err.Error(), "pre-update validation error") {
+			t.Errorf("Wanted pre-update validation error from UpdateKeys, got: %v", err)
+		}
+	})
+}
+
 // batchSigningPublicKey creates a BatchSigningPublicKey containing the public
 // portion of the given key material.
+// update, if set, causes golden-file tests to rewrite their golden files
+// rather than comparing against them.
+var update = flag.Bool("update", false, "update golden files")
+
+func TestUpdateKeysGolden(t *testing.T) {
+	t.Parallel()
+
+	m := DataShareProcessorSpecificManifest{
+		Format:                  1,
+		IngestionBucket:         "gs://ingestion",
+		PeerValidationBucket:    "gs://peer-validation",
+		BatchSigningPublicKeys:  BatchSigningPublicKeys{},
+		PacketEncryptionKeyCSRs: PacketEncryptionKeyCSRs{},
+	}
+	newM, err := m.UpdateKeys(UpdateKeysConfig{
+		BatchSigningKey:             bsk(15, 10, 20),
+		BatchSigningKeyIDPrefix:     bskPrefix,
+		PacketEncryptionKey:         pek(20, 10),
+		PacketEncryptionKeyIDPrefix: pekPrefix,
+		PacketEncryptionKeyCSRFQDN:  fqdn,
+		TaskSigningKey:              bsk(30),
+		TaskSigningKeyIDPrefix:      "tsk",
+		Now:                         time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error from UpdateKeys: %v", err)
+	}
+
+	// ECDSA signatures are randomized, so CSRs are replaced with the PKIX
+	// encoding of their public key, after checking their signature.
+	for kid, pec := range newM.PacketEncryptionKeyCSRs {
+		pemCSR, _ := pem.Decode([]byte(pec.CertificateSigningRequest))
+		if pemCSR == nil {
+			t.Fatalf("Couldn't parse packet encryption key %q CSR as PEM", kid)
+		}
+		csr, err := x509.ParseCertificateRequest(pemCSR.Bytes)
+		if err != nil {
+			t.Fatalf("Couldn't parse packet encryption key %q CSR: %v", kid, err)
+		}
+		if err := csr.CheckSignature(); err != nil {
+			t.Errorf("Packet encryption key %q CSR not properly signed: %v", kid, err)
+		}
+		pkix, err := x509.MarshalPKIXPublicKey(csr.PublicKey)
+		if err != nil {
+			t.Fatalf("Couldn't encode packet encryption key %q as PKIX: %v", kid, err)
+		}
+		pec.CertificateSigningRequest = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix}))
+		newM.PacketEncryptionKeyCSRs[kid] = pec
+	}
+
+	got, err := json.MarshalIndent(newM, "", "  ")
+	if err != nil {
+		t.Fatalf("Couldn't marshal manifest: %v", err)
+	}
+	checkGolden(t, "update_keys.golden.json", got)
+}
+
+// checkGolden compares got against the contents of the named file in
+// testdata/, or overwrites the file with got if -update is set.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatalf("Couldn't write golden file: %v", err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Couldn't read golden file (run with -update to create it): %v", err)
+	}
+	if diff := cmp.Diff(string(want), string(got)); diff != "" {
+		t.Errorf("%s differs from golden file (-want +got), run with -update if the change is intended:\n%s", name, diff)
+	}
+}
+
 func batchSigningPublicKey(m key.Material) BatchSigningPublicKey {
 	pkix, err := m.PublicAsPKIX()
 	if err != nil {
@@ -796,11 +1602,12 @@ func pek(tss ...int64) key.Key {
 }
 
 // manifestBSK creates a manifest BatchSigningPublicKeys with the given
-// timestamps, expiring at the current time. Order does not matter. Key material
-// is arbitrary, but will match that of other batch signing keys at the same
-// timestamp, and will very likely not match other key materials.
+// timestamps, expiring a validity period after the current time. Order does not
+// matter. Key material is arbitrary, but will match that of other batch signing
+// keys at the same timestamp, and will very likely not match other key
+// materials.
 func manifestBSK(tss ...int64) BatchSigningPublicKeys {
-	return manifestBSKWithExpiration(time.Now(), tss...)
+	return manifestBSKWithExpiration(time.Now().Add(publicKeyValidityPeriod), tss...)
 }
 
 // manifestBSKWithExpiration creates a manifest BatchSigningPublicKeys with the
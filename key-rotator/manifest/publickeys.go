@@ -0,0 +1,155 @@
+package manifest
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+)
+
+// Names of the fields returned by PublicKeys.
+const (
+	BatchSigningKeyIDField      = "batch-signing-key-id"
+	BatchSigningPublicKeyField  = "batch-signing-public-key"
+	PacketEncryptionKeyIDField  = "packet-encryption-key-id"
+	PacketEncryptionKeyCSRField = "packet-encryption-key-csr"
+	PacketEncryptionKeyField    = "packet-encryption-public-key"
+	TaskSigningKeyIDField       = "task-signing-key-id"
+	TaskSigningPublicKeyField   = "task-signing-public-key"
+)
+
+// PublicKeys returns the key IDs & public keys (or, for a P256 packet
+// encryption key, CSR) of the primary versions of cfg's keys, as published in
+// the manifest, keyed by field name. Task signing key fields are included only if
+// cfg's task signing key is non-empty. An error is returned if the manifest
+// does not publish any of the primary versions.
+func (m DataShareProcessorSpecificManifest) PublicKeys(cfg UpdateKeysConfig) (map[string]string, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	fields := map[string]string{}
+
+	bskID := cfg.batchSigningKeyID(cfg.BatchSigningKey.Primary().CreationTimestamp)
+	bsk, ok := m.BatchSigningPublicKeys[bskID]
+	if !ok {
+		return nil, fmt.Errorf("manifest does not include batch signing key primary version %q", bskID)
+	}
+	fields[BatchSigningKeyIDField], fields[BatchSigningPublicKeyField] = bskID, bsk.PublicKey
+
+	pekID := cfg.packetEncryptionKeyID(cfg.PacketEncryptionKey.Primary().CreationTimestamp)
+	pek, ok := m.PacketEncryptionKeyCSRs[pekID]
+	if !ok {
+		return nil, fmt.Errorf("manifest does not include packet encryption key primary version %q", pekID)
+	}
+	fields[PacketEncryptionKeyIDField] = pekID
+	if pek.CertificateSigningRequest != "" {
+		fields[PacketEncryptionKeyCSRField] = pek.CertificateSigningRequest
+	} else {
+		fields[PacketEncryptionKeyField] = pek.PublicKey
+	}
+
+	if !cfg.TaskSigningKey.IsEmpty() {
+		tskID := cfg.taskSigningKeyID(cfg.TaskSigningKey.Primary().CreationTimestamp)
+		tsk, ok := m.TaskSigningPublicKeys[tskID]
+		if !ok {
+			return nil, fmt.Errorf("manifest does not include task signing key primary version %q", tskID)
+		}
+		fields[TaskSigningKeyIDField], fields[TaskSigningPublicKeyField] = tskID, tsk.PublicKey
+	}
+	return fields, nil
+}
+
+// PrimaryKeyIDs returns the key IDs under which the primary versions of cfg's
+// keys are published in manifests, keyed by ID field name (e.g.
+// BatchSigningKeyIDField). The task signing key ID is included only if cfg's
+// task signing key is non-empty.
+func (cfg UpdateKeysConfig) PrimaryKeyIDs() (map[string]string, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	ids := map[string]string{
+		BatchSigningKeyIDField:     cfg.batchSigningKeyID(cfg.BatchSigningKey.Primary().CreationTimestamp),
+		PacketEncryptionKeyIDField: cfg.packetEncryptionKeyID(cfg.PacketEncryptionKey.Primary().CreationTimestamp),
+	}
+	if !cfg.TaskSigningKey.IsEmpty() {
+		ids[TaskSigningKeyIDField] = cfg.taskSigningKeyID(cfg.TaskSigningKey.Primary().CreationTimestamp)
+	}
+	return ids, nil
+}
+
+// Mismatches returns a human-readable description of each mismatch between
+// cfg's keys & the public keys published in the manifest, as UpdateKeys would
+// publish them: key versions which are not published, published keys which
+// are not versions of cfg's keys, and published keys whose key material
+// differs from cfg's. Only the primary version of the packet encryption key is
+// published. Task signing keys are compared only if cfg's task signing key is
+// non-empty. No mismatches are returned if the manifest is up to date.
+func (m DataShareProcessorSpecificManifest) Mismatches(cfg UpdateKeysConfig) []string {
+	publishedKeys := func(pks BatchSigningPublicKeys) map[string]func() (key.PublicKey, error) {
+		published := map[string]func() (key.PublicKey, error){}
+		for kid, pk := range pks {
+			published[kid] = pk.toPublicKey
+		}
+		return published
+	}
+
+	versions := func(k key.Key) []key.Version {
+		var vs []key.Version
+		_ = k.Versions(func(v key.Version) error {
+			vs = append(vs, v)
+			return nil
+		})
+		return vs
+	}
+
+	mismatches := publicKeyMismatches("batch signing", versions(cfg.BatchSigningKey), cfg.batchSigningKeyID, publishedKeys(m.BatchSigningPublicKeys))
+	if !cfg.TaskSigningKey.IsEmpty() {
+		mismatches = append(mismatches, publicKeyMismatches("task signing", versions(cfg.TaskSigningKey), cfg.taskSigningKeyID, publishedKeys(m.TaskSigningPublicKeys))...)
+	}
+
+	var pekVersions []key.Version
+	if !cfg.PacketEncryptionKey.IsEmpty() {
+		pekVersions = []key.Version{cfg.PacketEncryptionKey.Primary()}
+	}
+	publishedPEKs := map[string]func() (key.PublicKey, error){}
+	for kid, pec := range m.PacketEncryptionKeyCSRs {
+		pec := pec
+		publishedPEKs[kid] = func() (key.PublicKey, error) { return pec.toPublicKey() }
+	}
+	return append(mismatches, publicKeyMismatches("packet encryption", pekVersions, cfg.packetEncryptionKeyID, publishedPEKs)...)
+}
+
+// publicKeyMismatches returns a description of each mismatch between the
+// given key versions & the published public keys, keyed by key ID.
+func publicKeyMismatches(kind string, versions []key.Version, keyID func(int64) string, published map[string]func() (key.PublicKey, error)) []string {
+	var mismatches []string
+	versionKIDs := map[string]bool{}
+	for _, v := range versions {
+		kid := keyID(v.CreationTimestamp)
+		versionKIDs[kid] = true
+		toPublicKey, ok := published[kid]
+		if !ok {
+			mismatches = append(mismatches, fmt.Sprintf("%s key version %q is not published in manifest", kind, kid))
+			continue
+		}
+		pub, err := toPublicKey()
+		switch {
+		case err != nil:
+			mismatches = append(mismatches, fmt.Sprintf("couldn't parse %s key version %q from manifest: %v", kind, kid, err))
+		case !pub.Equal(v.KeyMaterial.Public()):
+			mismatches = append(mismatches, fmt.Sprintf("public key mismatch in %s key version %q", kind, kid))
+		}
+	}
+
+	var unknownKIDs []string
+	for kid := range published {
+		if !versionKIDs[kid] {
+			unknownKIDs = append(unknownKIDs, kid)
+		}
+	}
+	sort.Strings(unknownKIDs)
+	for _, kid := range unknownKIDs {
+		mismatches = append(mismatches, fmt.Sprintf("manifest publishes %s key version %q, which is not a current key version", kind, kid))
+	}
+	return mismatches
+}
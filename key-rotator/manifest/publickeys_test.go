@@ -0,0 +1,157 @@
+package manifest
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+	keytest "github.com/abetterinternet/prio-server/key-rotator/key/test"
+)
+
+func TestPublicKeys(t *testing.T) {
+	t.Parallel()
+
+	mustKey := func(vs ...key.Version) key.Key {
+		k, err := key.FromVersions(vs[0], vs[1:]...)
+		if err != nil {
+			t.Fatalf("Couldn't create key: %v", err)
+		}
+		return k
+	}
+	bskMaterial, pekMaterial := keytest.Material(bskKID(10)), keytest.Material(pekKID(20))
+	cfg := UpdateKeysConfig{
+		BatchSigningKey:             mustKey(key.Version{KeyMaterial: bskMaterial, CreationTimestamp: 10}),
+		BatchSigningKeyIDPrefix:     bskPrefix,
+		PacketEncryptionKey:         mustKey(key.Version{KeyMaterial: pekMaterial, CreationTimestamp: 20}),
+		PacketEncryptionKeyIDPrefix: pekPrefix,
+		PacketEncryptionKeyCSRFQDN:  fqdn,
+	}
+	m := DataShareProcessorSpecificManifest{
+		Format:                  1,
+		BatchSigningPublicKeys:  BatchSigningPublicKeys{bskKID(10): batchSigningPublicKey(bskMaterial)},
+		PacketEncryptionKeyCSRs: PacketEncryptionKeyCSRs{pekKID(20): packetEncryptionCertificate(pekMaterial)},
+	}
+
+	got, err := m.PublicKeys(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error from PublicKeys: %v", err)
+	}
+	want := map[string]string{
+		BatchSigningKeyIDField:      bskKID(10),
+		BatchSigningPublicKeyField:  m.BatchSigningPublicKeys[bskKID(10)].PublicKey,
+		PacketEncryptionKeyIDField:  pekKID(20),
+		PacketEncryptionKeyCSRField: m.PacketEncryptionKeyCSRs[pekKID(20)].CertificateSigningRequest,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected public keys (-want +got):\n%s", diff)
+	}
+
+	// A primary version missing from the manifest is an error.
+	cfg.BatchSigningKey = mustKey(key.Version{KeyMaterial: bskMaterial, CreationTimestamp: 30})
+	if _, err := m.PublicKeys(cfg); err == nil {
+		t.Errorf("Wanted error from PublicKeys with unpublished primary version, got none")
+	}
+}
+
+func TestPrimaryKeyIDs(t *testing.T) {
+	t.Parallel()
+
+	mustKey := func(vs ...key.Version) key.Key {
+		k, err := key.FromVersions(vs[0], vs[1:]...)
+		if err != nil {
+			t.Fatalf("Couldn't create key: %v", err)
+		}
+		return k
+	}
+	cfg := UpdateKeysConfig{
+		BatchSigningKey: mustKey(
+			key.Version{KeyMaterial: keytest.Material(bskKID(10)), CreationTimestamp: 10},
+			key.Version{KeyMaterial: keytest.Material(bskKID(5)), CreationTimestamp: 5}),
+		BatchSigningKeyIDPrefix:     bskPrefix,
+		PacketEncryptionKey:         mustKey(key.Version{KeyMaterial: keytest.Material(pekKID(20)), CreationTimestamp: 20}),
+		PacketEncryptionKeyIDPrefix: pekPrefix,
+	}
+
+	got, err := cfg.PrimaryKeyIDs()
+	if err != nil {
+		t.Fatalf("Unexpected error from PrimaryKeyIDs: %v", err)
+	}
+	want := map[string]string{
+		BatchSigningKeyIDField:     bskKID(10),
+		PacketEncryptionKeyIDField: pekKID(20),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected key IDs (-want +got):\n%s", diff)
+	}
+
+	// An empty key is an error.
+	cfg.PacketEncryptionKey = key.Key{}
+	if _, err := cfg.PrimaryKeyIDs(); err == nil {
+		t.Errorf("Wanted error from PrimaryKeyIDs with empty packet encryption key, got none")
+	}
+}
+
+func TestMismatches(t *testing.T) {
+	t.Parallel()
+
+	mustKey := func(vs ...key.Version) key.Key {
+		k, err := key.FromVersions(vs[0], vs[1:]...)
+		if err != nil {
+			t.Fatalf("Couldn't create key: %v", err)
+		}
+		return k
+	}
+	cfg := UpdateKeysConfig{
+		BatchSigningKey: mustKey(
+			key.Version{KeyMaterial: keytest.Material(bskKID(10)), CreationTimestamp: 10},
+			key.Version{KeyMaterial: keytest.Material(bskKID(5)), CreationTimestamp: 5}),
+		BatchSigningKeyIDPrefix: bskPrefix,
+		PacketEncryptionKey: mustKey(
+			key.Version{KeyMaterial: keytest.Material(pekKID(20)), CreationTimestamp: 20},
+			key.Version{KeyMaterial: keytest.Material(pekKID(15)), CreationTimestamp: 15}),
+		PacketEncryptionKeyIDPrefix: pekPrefix,
+	}
+
+	for _, test := range []struct {
+		name string
+		m    DataShareProcessorSpecificManifest
+		want []string
+	}{
+		{
+			name: "up to date",
+			m: DataShareProcessorSpecificManifest{
+				BatchSigningPublicKeys: BatchSigningPublicKeys{
+					bskKID(10): batchSigningPublicKey(keytest.Material(bskKID(10))),
+					bskKID(5):  batchSigningPublicKey(keytest.Material(bskKID(5))),
+				},
+				PacketEncryptionKeyCSRs: PacketEncryptionKeyCSRs{pekKID(20): packetEncryptionCertificate(keytest.Material(pekKID(20)))},
+			},
+		},
+		{
+			name: "stale",
+			m: DataShareProcessorSpecificManifest{
+				BatchSigningPublicKeys: BatchSigningPublicKeys{
+					bskKID(10): batchSigningPublicKey(keytest.Material(bskKID(5))),
+					bskKID(1):  batchSigningPublicKey(keytest.Material(bskKID(1))),
+				},
+				PacketEncryptionKeyCSRs: PacketEncryptionKeyCSRs{pekKID(15): packetEncryptionCertificate(keytest.Material(pekKID(15)))},
+			},
+			want: []string{
+				`public key mismatch in batch signing key version "bsk-10"`,
+				`batch signing key version "bsk-5" is not published in manifest`,
+				`manifest publishes batch signing key version "bsk-1", which is not a current key version`,
+				`packet encryption key version "pek-20" is not published in manifest`,
+				`manifest publishes packet encryption key version "pek-15", which is not a current key version`,
+			},
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			if diff := cmp.Diff(test.want, test.m.Mismatches(cfg)); diff != "" {
+				t.Errorf("Unexpected mismatches (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package manifest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+)
+
+// Signature is a detached signature over a data share processor specific
+// manifest, as written alongside it so that peers may verify that the
+// manifest was not tampered with in the bucket. The signature is over the
+// manifest's JSON encoding, i.e. the contents of the manifest object: for
+// P-256 keys, an ASN.1 DER-encoded ECDSA signature over its SHA-256 digest,
+// and for Ed25519 keys, an Ed25519 signature over the encoding itself.
+type Signature struct {
+	KeyIdentifier string `json:"key-identifier"`
+	Signature     []byte `json:"signature"` // base64-encoded in JSON
+}
+
+// Sign signs the manifest with the given signer, which must hold a P-256 or
+// Ed25519 private key, returning a signature which identifies the key by
+// keyID.
+func (m DataShareProcessorSpecificManifest) Sign(keyID string, signer crypto.Signer) (Signature, error) {
+	manifestBytes, err := json.Marshal(m)
+	if err != nil {
+		return Signature{}, fmt.Errorf("couldn't marshal manifest as JSON: %w", err)
+	}
+	var sig []byte
+	switch signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(manifestBytes)
+		sig, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case ed25519.PublicKey:
+		sig, err = signer.Sign(nil, manifestBytes, crypto.Hash(0))
+	default:
+		return Signature{}, fmt.Errorf("unsupported signing key type %T", signer.Public())
+	}
+	if err != nil {
+		return Signature{}, fmt.Errorf("couldn't sign manifest: %w", err)
+	}
+	return Signature{KeyIdentifier: keyID, Signature: sig}, nil
+}
+
+// VerifySignature verifies that sig is a valid signature over the manifest by
+// the given public key, which must be a P-256 or Ed25519 public key.
+func (m DataShareProcessorSpecificManifest) VerifySignature(sig Signature, pub crypto.PublicKey) error {
+	manifestBytes, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("couldn't marshal manifest as JSON: %w", err)
+	}
+	var ok bool
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(manifestBytes)
+		ok = ecdsa.VerifyASN1(pub, digest[:], sig.Signature)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(pub, manifestBytes, sig.Signature)
+	default:
+		return fmt.Errorf("unsupported verification key type %T", pub)
+	}
+	if !ok {
+		return fmt.Errorf("signature by %q does not match manifest", sig.KeyIdentifier)
+	}
+	return nil
+}
+
+// BatchSigningPublicKey returns the batch signing public key published in the
+// manifest under the given key ID.
+func (m DataShareProcessorSpecificManifest) BatchSigningPublicKey(keyID string) (key.PublicKey, error) {
+	pk, ok := m.BatchSigningPublicKeys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("no batch signing key %q is published", keyID)
+	}
+	pub, err := pk.toPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse batch signing key %q: %w", keyID, err)
+	}
+	return pub, nil
+}
@@ -0,0 +1,57 @@
+package manifest
+
+import (
+	"testing"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+	keytest "github.com/abetterinternet/prio-server/key-rotator/key/test"
+)
+
+func TestSignature(t *testing.T) {
+	t.Parallel()
+
+	ed25519Material, err := key.Ed25519.New()
+	if err != nil {
+		t.Fatalf("Couldn't create Ed25519 key: %v", err)
+	}
+	for _, material := range []key.Material{keytest.Material(bskKID(10)), ed25519Material} {
+		material := material
+		t.Run(material.Type().String(), func(t *testing.T) {
+			t.Parallel()
+			m := DataShareProcessorSpecificManifest{
+				Format:                 1,
+				IngestionBucket:        "ingestion-bucket",
+				BatchSigningPublicKeys: BatchSigningPublicKeys{bskKID(10): batchSigningPublicKey(material)},
+			}
+			signer, err := material.Signer()
+			if err != nil {
+				t.Fatalf("Couldn't get signer: %v", err)
+			}
+			sig, err := m.Sign(bskKID(10), signer)
+			if err != nil {
+				t.Fatalf("Unexpected error from Sign: %v", err)
+			}
+			if sig.KeyIdentifier != bskKID(10) {
+				t.Errorf("Signature key identifier is %q, want %q", sig.KeyIdentifier, bskKID(10))
+			}
+
+			pub, err := m.BatchSigningPublicKey(sig.KeyIdentifier)
+			if err != nil {
+				t.Fatalf("Unexpected error from BatchSigningPublicKey: %v", err)
+			}
+			if err := m.VerifySignature(sig, pub); err != nil {
+				t.Errorf("Unexpected error verifying signature: %v", err)
+			}
+
+			tampered := m
+			tampered.IngestionBucket = "attacker-bucket"
+			if err := tampered.VerifySignature(sig, pub); err == nil {
+				t.Errorf("Wanted error verifying signature of tampered manifest")
+			}
+		})
+	}
+
+	if _, err := (DataShareProcessorSpecificManifest{}).BatchSigningPublicKey(bskKID(10)); err == nil {
+		t.Errorf("Wanted error from BatchSigningPublicKey for unpublished key")
+	}
+}
@@ -0,0 +1,101 @@
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+)
+
+// RotationStatus is a small, non-sensitive summary of the most recent
+// successful key rotation for a locality. It is published alongside the
+// manifests so that peers & dashboards can verify that rotation is live
+// without needing access to our metrics.
+type RotationStatus struct {
+	// Format is the version of the rotation status.
+	Format int64 `json:"format"`
+	// LastSuccess is the time at which the last successful rotation began,
+	// formatted per RFC 3339.
+	LastSuccess string `json:"last-success"`
+	// PacketEncryptionKey describes the locality's packet encryption key.
+	PacketEncryptionKey KeyStatus `json:"packet-encryption-key"`
+	// BatchSigningKeys maps ingestor names to a description of the batch
+	// signing key used for that ingestor.
+	BatchSigningKeys map[string]KeyStatus `json:"batch-signing-keys"`
+	// ManifestDigests maps ingestor names to the hex-encoded SHA-256 digest of
+	// the JSON-serialized data share processor-specific manifest for that
+	// ingestor.
+	ManifestDigests map[string]string `json:"manifest-digests"`
+}
+
+// KeyStatus describes the age of a key, without including any key material.
+type KeyStatus struct {
+	// PrimaryCreationTimestamp is the creation timestamp of the key's primary
+	// version, in seconds since the Unix epoch.
+	PrimaryCreationTimestamp int64 `json:"primary-creation-timestamp"`
+	// PrimaryAgeSeconds is the age of the key's primary version, in seconds,
+	// as of the time the status was generated.
+	PrimaryAgeSeconds int64 `json:"primary-age-seconds"`
+	// NewestAgeSeconds is the age of the key's newest version, in seconds, as
+	// of the time the status was generated.
+	NewestAgeSeconds int64 `json:"newest-age-seconds"`
+	// VersionCount is the number of versions of the key.
+	VersionCount int `json:"version-count"`
+}
+
+// NewRotationStatus creates a RotationStatus describing the given keys &
+// manifests, as of the given time.
+func NewRotationStatus(now time.Time, packetEncryptionKey key.Key, batchSigningKeyByIngestor map[string]key.Key, manifestByIngestor map[string]DataShareProcessorSpecificManifest) (RotationStatus, error) {
+	pekStatus, err := newKeyStatus(now, packetEncryptionKey)
+	if err != nil {
+		return RotationStatus{}, fmt.Errorf("couldn't describe packet encryption key: %w", err)
+	}
+	bskStatuses := map[string]KeyStatus{}
+	for ingestor, k := range batchSigningKeyByIngestor {
+		s, err := newKeyStatus(now, k)
+		if err != nil {
+			return RotationStatus{}, fmt.Errorf("couldn't describe batch signing key for %q: %w", ingestor, err)
+		}
+		bskStatuses[ingestor] = s
+	}
+	digests := map[string]string{}
+	for ingestor, m := range manifestByIngestor {
+		manifestBytes, err := json.Marshal(m)
+		if err != nil {
+			return RotationStatus{}, fmt.Errorf("couldn't marshal manifest for %q as JSON: %w", ingestor, err)
+		}
+		digests[ingestor] = fmt.Sprintf("%x", sha256.Sum256(manifestBytes))
+	}
+	return RotationStatus{
+		Format:              1,
+		LastSuccess:         now.UTC().Format(time.RFC3339),
+		PacketEncryptionKey: pekStatus,
+		BatchSigningKeys:    bskStatuses,
+		ManifestDigests:     digests,
+	}, nil
+}
+
+func newKeyStatus(now time.Time, k key.Key) (KeyStatus, error) {
+	if k.IsEmpty() {
+		return KeyStatus{}, errors.New("key is empty")
+	}
+	nowTS, newestTS := now.Unix(), int64(0)
+	var versionCount int
+	k.Versions(func(v key.Version) error {
+		versionCount++
+		if v.CreationTimestamp > newestTS {
+			newestTS = v.CreationTimestamp
+		}
+		return nil
+	})
+	primaryTS := k.Primary().CreationTimestamp
+	return KeyStatus{
+		PrimaryCreationTimestamp: primaryTS,
+		PrimaryAgeSeconds:        nowTS - primaryTS,
+		NewestAgeSeconds:         nowTS - newestTS,
+		VersionCount:             versionCount,
+	}, nil
+}
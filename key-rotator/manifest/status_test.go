@@ -0,0 +1,64 @@
+package manifest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+	keytest "github.com/abetterinternet/prio-server/key-rotator/key/test"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewRotationStatus(t *testing.T) {
+	t.Parallel()
+
+	mustKey := func(vs ...key.Version) key.Key {
+		k, err := key.FromVersions(vs[0], vs[1:]...)
+		if err != nil {
+			t.Fatalf("Couldn't create key: %v", err)
+		}
+		return k
+	}
+	now := time.Unix(10000, 0)
+	pek := mustKey(
+		key.Version{KeyMaterial: keytest.Material("pek-8000"), CreationTimestamp: 8000},
+		key.Version{KeyMaterial: keytest.Material("pek-9000"), CreationTimestamp: 9000})
+	bsk := mustKey(key.Version{KeyMaterial: keytest.Material("bsk-7000"), CreationTimestamp: 7000})
+	m := DataShareProcessorSpecificManifest{Format: 1, IngestionBucket: "ingestion-bucket"}
+
+	gotStatus, err := NewRotationStatus(now, pek, map[string]key.Key{"ingestor": bsk}, map[string]DataShareProcessorSpecificManifest{"ingestor": m})
+	if err != nil {
+		t.Fatalf("Unexpected error from NewRotationStatus: %v", err)
+	}
+
+	// Digest is not verified exactly; check only that it is a hex-encoded SHA-256 digest.
+	if got := len(gotStatus.ManifestDigests["ingestor"]); got != 64 {
+		t.Errorf("Unexpected manifest digest length %d", got)
+	}
+	gotStatus.ManifestDigests = nil
+	wantStatus := RotationStatus{
+		Format:      1,
+		LastSuccess: "1970-01-01T02:46:40Z",
+		PacketEncryptionKey: KeyStatus{
+			PrimaryCreationTimestamp: 8000,
+			PrimaryAgeSeconds:        2000,
+			NewestAgeSeconds:         1000,
+			VersionCount:             2,
+		},
+		BatchSigningKeys: map[string]KeyStatus{
+			"ingestor": {
+				PrimaryCreationTimestamp: 7000,
+				PrimaryAgeSeconds:        3000,
+				NewestAgeSeconds:         3000,
+				VersionCount:             1,
+			},
+		},
+	}
+	if diff := cmp.Diff(wantStatus, gotStatus); diff != "" {
+		t.Errorf("Unexpected rotation status (-want +got):\n%s", diff)
+	}
+
+	if _, err := NewRotationStatus(now, key.Key{}, nil, nil); err == nil {
+		t.Errorf("Expected error from NewRotationStatus with empty packet encryption key")
+	}
+}
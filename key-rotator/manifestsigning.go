@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+	"github.com/abetterinternet/prio-server/key-rotator/manifest"
+	"github.com/abetterinternet/prio-server/key-rotator/storage"
+)
+
+// manifestSigningConfig configures the signing of data share processor
+// specific manifests, i.e. --manifest-signing-key.
+type manifestSigningConfig struct {
+	// If set, each manifest is signed by the primary version of the batch
+	// signing key published in it, identified by that version's key ID.
+	// Otherwise, manifests are signed by material, identified by keyID.
+	batchSigningKey bool
+	material        key.Material
+	keyID           string
+}
+
+// loadManifestSigningKey reads a PEM-encoded PKCS #8 P-256 or Ed25519 private
+// key from the file at path.
+func loadManifestSigningKey(path string) (key.Material, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return key.Material{}, fmt.Errorf("couldn't read %q: %w", path, err)
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return key.Material{}, fmt.Errorf("%q does not hold a PEM-encoded PKCS #8 private key", path)
+	}
+	privKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return key.Material{}, fmt.Errorf("couldn't parse private key from %q: %w", path, err)
+	}
+	switch privKey := privKey.(type) {
+	case *ecdsa.PrivateKey:
+		return key.P256MaterialFrom(privKey)
+	case ed25519.PrivateKey:
+		return key.Ed25519MaterialFrom(privKey)
+	default:
+		return key.Material{}, fmt.Errorf("private key in %q has unsupported type %T", path, privKey)
+	}
+}
+
+// writeManifestSignatures writes a detached signature over each ingestor's
+// manifest alongside the manifest. Signatures are written on every rotation,
+// whether or not the manifest changed, so that they are written for existing
+// manifests once cfg.manifestSigning is enabled.
+func writeManifestSignatures(ctx context.Context, cfg rotateKeysConfig,
+	packetEncryptionKey key.Key, batchSigningKeyByIngestor map[string]key.Key,
+	taskSigningKey key.Key, manifestByIngestor map[string]manifest.DataShareProcessorSpecificManifest) error {
+	for ingestor, m := range manifestByIngestor {
+		material, keyID := cfg.manifestSigning.material, cfg.manifestSigning.keyID
+		if cfg.manifestSigning.batchSigningKey {
+			ids, err := cfg.updateKeysConfig(ingestor, batchSigningKeyByIngestor[ingestor], packetEncryptionKey, taskSigningKey).PrimaryKeyIDs()
+			if err != nil {
+				return fmt.Errorf("couldn't get key IDs for (%q, %q): %w", cfg.locality, ingestor, err)
+			}
+			material, keyID = batchSigningKeyByIngestor[ingestor].Primary().KeyMaterial, ids[manifest.BatchSigningKeyIDField]
+		}
+		signer, err := material.Signer()
+		if err != nil {
+			return fmt.Errorf("couldn't get manifest signing key for (%q, %q): %w", cfg.locality, ingestor, err)
+		}
+		sig, err := m.Sign(keyID, signer)
+		if err != nil {
+			return fmt.Errorf("couldn't sign manifest for (%q, %q): %w", cfg.locality, ingestor, err)
+		}
+		if err := cfg.manifestStore.PutManifestSignature(ctx, dspName(cfg.locality, ingestor), sig); err != nil {
+			return fmt.Errorf("couldn't write manifest signature for (%q, %q): %w", cfg.locality, ingestor, err)
+		}
+	}
+	return nil
+}
+
+// verifyManifestSignatures verifies the signature written alongside each
+// ingestor's manifest. If manifests are signed by batch signing keys, each
+// signature must be by a batch signing key published in the manifest (whose
+// public keys are in turn checked against the key store when the manifest is
+// updated); otherwise, each must be by the configured key. Manifests without
+// a signature, e.g. those written before signing was enabled, or default
+// manifests, are accepted with a warning; they are signed once the rotation
+// writes manifests. A manifest whose signature doesn't verify fails the
+// rotation, as does one written by a rotation which failed before writing its
+// signature: once the manifest is known to be good, deleting its signature
+// allows the rotation to proceed, re-signing it.
+func verifyManifestSignatures(ctx context.Context, cfg rotateKeysConfig, manifestByIngestor map[string]manifest.DataShareProcessorSpecificManifest) error {
+	for ingestor, m := range manifestByIngestor {
+		sig, err := cfg.manifestStore.GetManifestSignature(ctx, dspName(cfg.locality, ingestor))
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			log.Warn().Msgf("Manifest for (%q, %q) has no signature; it will be signed once manifests are written", cfg.locality, ingestor)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't get manifest signature for (%q, %q): %w", cfg.locality, ingestor, err)
+		}
+
+		var pub key.PublicKey
+		if cfg.manifestSigning.batchSigningKey {
+			if pub, err = m.BatchSigningPublicKey(sig.KeyIdentifier); err != nil {
+				return fmt.Errorf("couldn't verify manifest signature for (%q, %q): %w", cfg.locality, ingestor, err)
+			}
+		} else {
+			if sig.KeyIdentifier != cfg.manifestSigning.keyID {
+				return fmt.Errorf("manifest for (%q, %q) is signed by %q, not --manifest-signing-key-id %q", cfg.locality, ingestor, sig.KeyIdentifier, cfg.manifestSigning.keyID)
+			}
+			pub = cfg.manifestSigning.material.Public()
+		}
+		if err := m.VerifySignature(sig, pub); err != nil {
+			return fmt.Errorf("couldn't verify manifest signature for (%q, %q): %w", cfg.locality, ingestor, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+)
+
+// Rotation durations & decisions, to track rotation health across
+// environments. Where a rotation's span is sampled, observations carry the ID
+// of its trace as an exemplar, which is exposed by /metrics in OpenMetrics
+// format, but not pushed to the push gateway.
+var (
+	rotationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "key_rotator_run_duration_seconds",
+		Help:    "Duration of each rotation of a locality's keys & manifests, by result ('success' or 'failure').",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 14), // 100 milliseconds to ~14 minutes
+	}, []string{"locality", "result"})
+	phaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "key_rotator_phase_duration_seconds",
+		Help:    "Duration of each phase ('read', 'rotate', 'write-keys' or 'write-manifests') of a rotation, successful or not.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 16), // 10 milliseconds to ~5.5 minutes
+	}, []string{"locality", "phase"})
+	keyVersionChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "key_rotator_key_version_changes_total",
+		Help: "Number of key versions created, promoted to primary or deleted by rotations whose keys were written, by key kind & change ('created', 'promoted' or 'deleted').",
+	}, []string{"locality", "kind", "change"})
+)
+
+// observeDuration records the time since start in obs, with ctx's trace as an
+// exemplar if its span is sampled.
+func observeDuration(ctx context.Context, obs prometheus.Observer, start time.Time) {
+	seconds := time.Since(start).Seconds()
+	if exemplar := traceExemplar(ctx); exemplar != nil {
+		if eo, ok := obs.(prometheus.ExemplarObserver); ok {
+			eo.ObserveWithExemplar(seconds, exemplar)
+			return
+		}
+	}
+	obs.Observe(seconds)
+}
+
+// recordKeyVersionChanges records the versions created, promoted & deleted by
+// the change of the key of the given kind from oldKey to newKey, with ctx's
+// trace as an exemplar if its span is sampled. A version becoming primary is
+// counted as a promotion unless oldKey was empty.
+func recordKeyVersionChanges(ctx context.Context, locality, kind string, oldKey, newKey key.Key) {
+	oldVersions, newVersions := versionTimestamps(oldKey), versionTimestamps(newKey)
+	promoted := 0
+	if !oldKey.IsEmpty() && !newKey.IsEmpty() && oldKey.Primary().CreationTimestamp != newKey.Primary().CreationTimestamp {
+		promoted = 1
+	}
+	exemplar := traceExemplar(ctx)
+	for _, c := range []struct {
+		change string
+		count  int
+	}{
+		{"created", len(timestampsNotIn(newVersions, oldVersions))},
+		{"promoted", promoted},
+		{"deleted", len(timestampsNotIn(oldVersions, newVersions))},
+	} {
+		if c.count == 0 {
+			continue
+		}
+		counter := keyVersionChanges.WithLabelValues(locality, kind, c.change)
+		if ea, ok := counter.(prometheus.ExemplarAdder); ok && exemplar != nil {
+			ea.AddWithExemplar(float64(c.count), exemplar)
+			continue
+		}
+		counter.Add(float64(c.count))
+	}
+}
+
+// traceExemplar returns exemplar labels identifying the trace of ctx's span,
+// or nil if the span is not sampled, e.g. because tracing is not enabled.
+func traceExemplar(ctx context.Context) prometheus.Labels {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsSampled() {
+		return nil
+	}
+	return prometheus.Labels{"trace_id": sc.TraceID().String()}
+}
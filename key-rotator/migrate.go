@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+	"github.com/abetterinternet/prio-server/key-rotator/manifest"
+	"github.com/abetterinternet/prio-server/key-rotator/storage"
+)
+
+// migrateKeysConfig configures a one-time migration of keys & manifests from
+// one Prio environment name to another, as is required to rename an
+// environment.
+type migrateKeysConfig struct {
+	// Dependencies.
+	readKeyStore  storage.Key // keys are read from this store, which uses the old environment name
+	writeKeyStore storage.Key // keys are written to this store, which uses the new environment name
+	manifestStore storage.Manifest
+
+	// Configuration.
+	locality             string
+	ingestors            []string
+	readPrioEnvironment  string
+	writePrioEnvironment string
+	csrFQDN              string
+	manifestHooks        manifestHooks
+	skipVerification     bool // if set, written keys are not read back for verification (e.g. in dry-run mode)
+}
+
+// migrateKeys copies keys from cfg.readKeyStore to cfg.writeKeyStore without
+// rotating them, verifies that the copied key material is identical, and
+// updates manifests to use key IDs based on the new environment name. Keys are
+// never created: it is an error for any key to be missing in the read store.
+func migrateKeys(ctx context.Context, cfg migrateKeysConfig) error {
+	// Retrieve keys & manifests.
+	log.Info().Msgf("Reading keys & manifests from environment %q", cfg.readPrioEnvironment)
+	packetEncryptionKey, batchSigningKeyByIngestor, oldManifestByIngestor, err :=
+		readKeysAndManifests(ctx, cfg.readKeyStore, cfg.manifestStore, cfg.locality, cfg.ingestors)
+	if err != nil {
+		return fmt.Errorf("couldn't get keys & manifests: %w", err)
+	}
+	if packetEncryptionKey.IsEmpty() {
+		return fmt.Errorf("packet encryption key for %q has no versions in environment %q", cfg.locality, cfg.readPrioEnvironment)
+	}
+	for ingestor, k := range batchSigningKeyByIngestor {
+		if k.IsEmpty() {
+			return fmt.Errorf("batch signing key for (%q, %q) has no versions in environment %q", cfg.locality, ingestor, cfg.readPrioEnvironment)
+		}
+	}
+
+	// Update manifests. Each manifest is first validated against the keys
+	// using the old environment's key IDs, then rewritten using the new
+	// environment's key IDs; pre-update validations are skipped for the
+	// latter since the key IDs are expected to change.
+	log.Info().Msgf("Updating manifests for environment %q", cfg.writePrioEnvironment)
+	newManifestByIngestor := map[string]manifest.DataShareProcessorSpecificManifest{}
+	for ingestor, oldManifest := range oldManifestByIngestor {
+		updateCFG := func(env string) manifest.UpdateKeysConfig {
+			return manifest.UpdateKeysConfig{
+				BatchSigningKey: batchSigningKeyByIngestor[ingestor],
+				BatchSigningKeyIDPrefix: fmt.Sprintf(
+					"%s-%s-%s-batch-signing-key", env, cfg.locality, ingestor),
+
+				PacketEncryptionKey: packetEncryptionKey,
+				PacketEncryptionKeyIDPrefix: fmt.Sprintf(
+					"%s-%s-ingestion-packet-decryption-key", env, cfg.locality),
+				PacketEncryptionKeyCSRFQDN: cfg.csrFQDN,
+			}
+		}
+		if _, err := oldManifest.UpdateKeys(updateCFG(cfg.readPrioEnvironment)); err != nil {
+			return fmt.Errorf("manifest for (%q, %q) does not match keys in environment %q: %w",
+				cfg.locality, ingestor, cfg.readPrioEnvironment, err)
+		}
+		writeCFG := updateCFG(cfg.writePrioEnvironment)
+		writeCFG.SkipPreUpdateValidations = true
+		newManifest, err := oldManifest.UpdateKeys(writeCFG)
+		if err != nil {
+			return fmt.Errorf("couldn't update manifest for (%q, %q): %w", cfg.locality, ingestor, err)
+		}
+		newManifestByIngestor[ingestor] = newManifest
+	}
+
+	// Write & verify keys, then write manifests. As with rotation, keys are
+	// written first so that manifests never refer to keys which have not
+	// been written.
+	log.Info().Msgf("Writing keys to environment %q", cfg.writePrioEnvironment)
+	if err := migrateWriteKeys(ctx, cfg, packetEncryptionKey, batchSigningKeyByIngestor); err != nil {
+		return fmt.Errorf("couldn't write keys: %w", err)
+	}
+	if cfg.skipVerification {
+		log.Info().Msgf("Skipping verification of keys written to environment %q", cfg.writePrioEnvironment)
+	} else {
+		log.Info().Msgf("Verifying keys written to environment %q", cfg.writePrioEnvironment)
+		if err := migrateVerifyKeys(ctx, cfg, packetEncryptionKey, batchSigningKeyByIngestor); err != nil {
+			return fmt.Errorf("couldn't verify keys: %w", err)
+		}
+	}
+	log.Info().Msgf("Writing manifests")
+	if err := writeManifests(
+		ctx, rotateKeysConfig{manifestStore: cfg.manifestStore, locality: cfg.locality, manifestHooks: cfg.manifestHooks},
+		oldManifestByIngestor, newManifestByIngestor); err != nil {
+		return fmt.Errorf("couldn't write manifests: %w", err)
+	}
+	return nil
+}
+
+func migrateWriteKeys(ctx context.Context, cfg migrateKeysConfig,
+	packetEncryptionKey key.Key, batchSigningKeyByIngestor map[string]key.Key) error {
+	eg, ctx := errgroup.WithContext(ctx)
+
+	eg.Go(func() error {
+		if err := cfg.writeKeyStore.PutPacketEncryptionKey(ctx, cfg.locality, packetEncryptionKey); err != nil {
+			return fmt.Errorf("couldn't write packet encryption key for %q: %w", cfg.locality, err)
+		}
+		keysWritten.WithLabelValues(cfg.locality, "", packetEncryptionKeyKind).Inc()
+		return nil
+	})
+
+	for ingestor, k := range batchSigningKeyByIngestor {
+		ingestor, k := ingestor, k
+		eg.Go(func() error {
+			if err := cfg.writeKeyStore.PutBatchSigningKey(ctx, cfg.locality, ingestor, k); err != nil {
+				return fmt.Errorf("couldn't write batch signing key for (%q, %q): %w", cfg.locality, ingestor, err)
+			}
+			keysWritten.WithLabelValues(cfg.locality, ingestor, batchSigningKeyKind).Inc()
+			return nil
+		})
+	}
+
+	return eg.Wait()
+}
+
+func migrateVerifyKeys(ctx context.Context, cfg migrateKeysConfig,
+	packetEncryptionKey key.Key, batchSigningKeyByIngestor map[string]key.Key) error {
+	eg, ctx := errgroup.WithContext(ctx)
+
+	eg.Go(func() error {
+		k, err := cfg.writeKeyStore.GetPacketEncryptionKey(ctx, cfg.locality)
+		if err != nil {
+			return fmt.Errorf("couldn't read back packet encryption key for %q: %w", cfg.locality, err)
+		}
+		if !k.Equal(packetEncryptionKey) {
+			return fmt.Errorf("packet encryption key for %q does not match after write: %s", cfg.locality, k.Diff(packetEncryptionKey))
+		}
+		return nil
+	})
+
+	for ingestor, wantKey := range batchSigningKeyByIngestor {
+		ingestor, wantKey := ingestor, wantKey
+		eg.Go(func() error {
+			k, err := cfg.writeKeyStore.GetBatchSigningKey(ctx, cfg.locality, ingestor)
+			if err != nil {
+				return fmt.Errorf("couldn't read back batch signing key for (%q, %q): %w", cfg.locality, ingestor, err)
+			}
+			if !k.Equal(wantKey) {
+				return fmt.Errorf("batch signing key for (%q, %q) does not match after write: %s", cfg.locality, ingestor, k.Diff(wantKey))
+			}
+			return nil
+		})
+	}
+
+	return eg.Wait()
+}
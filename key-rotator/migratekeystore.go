@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+	"github.com/abetterinternet/prio-server/key-rotator/storage"
+)
+
+// isKeyStoreKind returns true if kind is one of the kinds of key store
+// accepted by --key-store & --key-store-fallback: 'kubernetes', 'vault', 'aws'
+// or 'gcp:gcp-project-id'.
+func isKeyStoreKind(kind string) bool {
+	switch {
+	case kind == "kubernetes" || kind == "vault" || kind == "aws":
+		return true
+	case strings.HasPrefix(kind, "gcp:"):
+		return strings.TrimPrefix(kind, "gcp:") != ""
+	}
+	return false
+}
+
+// migrateKeyStoreConfig configures a one-time copy of the keys of a single
+// locality from the key store being migrated from, i.e. --key-store-fallback,
+// to the key store being migrated to, i.e. --key-store.
+type migrateKeyStoreConfig struct {
+	// Dependencies.
+	from storage.Key
+	to   storage.Key
+
+	// Configuration.
+	locality         string
+	ingestors        []string
+	taskSigningKey   bool // if set, the task signing key is also copied
+	skipVerification bool // if set, copied keys are not read back for verification (e.g. in dry-run mode)
+}
+
+// migrateKeyStore copies each of the locality's keys from cfg.from to cfg.to,
+// unless the key is empty in cfg.from or cfg.to already holds an identical
+// key, and returns the number of keys copied. Keys in cfg.to which differ from
+// those in cfg.from are overwritten: while migrating, keys are written to
+// cfg.from first, so it holds the most recently written keys.
+func migrateKeyStore(ctx context.Context, cfg migrateKeyStoreConfig) (int, error) {
+	type keyToMigrate struct {
+		name  string // e.g. `batch signing key for ("us-ca", "apple")`
+		get   func(storage.Key) (key.Key, error)
+		write func(storage.Key, key.Key) error
+	}
+	keys := []keyToMigrate{{
+		name:  fmt.Sprintf("packet encryption key for %q", cfg.locality),
+		get:   func(s storage.Key) (key.Key, error) { return s.GetPacketEncryptionKey(ctx, cfg.locality) },
+		write: func(s storage.Key, k key.Key) error { return s.PutPacketEncryptionKey(ctx, cfg.locality, k) },
+	}}
+	for _, ingestor := range cfg.ingestors {
+		ingestor := ingestor
+		keys = append(keys, keyToMigrate{
+			name:  fmt.Sprintf("batch signing key for (%q, %q)", cfg.locality, ingestor),
+			get:   func(s storage.Key) (key.Key, error) { return s.GetBatchSigningKey(ctx, cfg.locality, ingestor) },
+			write: func(s storage.Key, k key.Key) error { return s.PutBatchSigningKey(ctx, cfg.locality, ingestor, k) },
+		})
+	}
+	if cfg.taskSigningKey {
+		keys = append(keys, keyToMigrate{
+			name:  fmt.Sprintf("task signing key for %q", cfg.locality),
+			get:   func(s storage.Key) (key.Key, error) { return s.GetTaskSigningKey(ctx, cfg.locality) },
+			write: func(s storage.Key, k key.Key) error { return s.PutTaskSigningKey(ctx, cfg.locality, k) },
+		})
+	}
+
+	copied := 0
+	for _, k := range keys {
+		want, err := k.get(cfg.from)
+		if err != nil {
+			return copied, fmt.Errorf("couldn't get %s from --key-store-fallback: %w", k.name, err)
+		}
+		if want.IsEmpty() {
+			log.Info().Msgf("Not migrating %s: key is empty in --key-store-fallback", k.name)
+			continue
+		}
+		switch got, err := k.get(cfg.to); {
+		case err != nil:
+			log.Info().Msgf("Migrating %s: couldn't get key from --key-store: %v", k.name, err)
+		case got.Equal(want):
+			log.Info().Msgf("Not migrating %s: key already migrated", k.name)
+			continue
+		default:
+			log.Info().Msgf("Migrating %s: key in --key-store differs: %s", k.name, want.Diff(got))
+		}
+
+		if err := k.write(cfg.to, want); err != nil {
+			return copied, fmt.Errorf("couldn't write %s to --key-store: %w", k.name, err)
+		}
+		if !cfg.skipVerification {
+			got, err := k.get(cfg.to)
+			if err != nil {
+				return copied, fmt.Errorf("couldn't read back %s from --key-store: %w", k.name, err)
+			}
+			if !got.Equal(want) {
+				return copied, fmt.Errorf("%s read back from --key-store differs from that written: %s", k.name, want.Diff(got))
+			}
+		}
+		copied++
+	}
+	return copied, nil
+}
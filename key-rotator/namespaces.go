@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"github.com/abetterinternet/prio-server/key-rotator/storage"
+)
+
+// parseNamespaceByIngestor parses the value of --namespace-by-ingestor, a JSON
+// map from ingestor to the Kubernetes namespace in which the secrets holding
+// that ingestor's batch signing keys are stored. Each ingestor must be one of
+// ingestors, and each namespace must be non-empty. An empty value maps no
+// ingestors.
+func parseNamespaceByIngestor(namespaceByIngestorJSON string, ingestors []string) (map[string]string, error) {
+	if namespaceByIngestorJSON == "" {
+		return nil, nil
+	}
+	var namespaceByIngestor map[string]string
+	if err := json.Unmarshal([]byte(namespaceByIngestorJSON), &namespaceByIngestor); err != nil {
+		return nil, fmt.Errorf("couldn't parse as a JSON map from ingestor to namespace: %w", err)
+	}
+	knownIngestors := map[string]bool{}
+	for _, ingestor := range ingestors {
+		knownIngestors[ingestor] = true
+	}
+	for ingestor, namespace := range namespaceByIngestor {
+		if !knownIngestors[ingestor] {
+			return nil, fmt.Errorf("ingestor %q is not in --ingestors", ingestor)
+		}
+		if namespace == "" {
+			return nil, fmt.Errorf("empty namespace for ingestor %q", ingestor)
+		}
+	}
+	return namespaceByIngestor, nil
+}
+
+// kubernetesSecrets returns the secret interfaces in which keys are stored:
+// namespace holds the secrets of keys not stored in the namespace of an
+// ingestor in namespaceByIngestor. secrets returns the secret interface of a
+// namespace; it is implemented by the Kubernetes client's CoreV1Interface.
+func kubernetesSecrets(secrets func(namespace string) k8s.SecretInterface, namespace string, namespaceByIngestor map[string]string) storage.KubernetesSecrets {
+	s := storage.KubernetesSecrets{Default: secrets(namespace)}
+	if len(namespaceByIngestor) > 0 {
+		s.ByIngestor = map[string]k8s.SecretInterface{}
+		for ingestor, ns := range namespaceByIngestor {
+			s.ByIngestor[ingestor] = secrets(ns)
+		}
+	}
+	return s
+}
+
+// checkNamespaces verifies that secrets can be listed in each of the given
+// namespaces, so that a namespace which doesn't exist, or in which key-rotator
+// isn't permitted to access secrets, is reported before any keys are read or
+// written. Empty & repeated namespaces are ignored.
+func checkNamespaces(ctx context.Context, secrets func(namespace string) k8s.SecretInterface, namespaces []string) error {
+	seen := map[string]bool{}
+	for _, ns := range namespaces {
+		if ns == "" || seen[ns] {
+			continue
+		}
+		seen[ns] = true
+		if _, err := secrets(ns).List(ctx, metav1.ListOptions{Limit: 1}); err != nil {
+			return fmt.Errorf("couldn't list secrets in namespace %q: %w", ns, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+)
+
+// Kinds of rotation event reported by notifications.
+const (
+	keyCreatedEvent      = "key-created"
+	keyPromotedEvent     = "key-promoted"
+	keyDeletedEvent      = "key-deleted"
+	manifestChangedEvent = "manifest-changed"
+)
+
+// rotationEvent describes a single change made by a rotation. It is provided
+// to the notification webhook as JSON.
+type rotationEvent struct {
+	Event        string `json:"event"` // one of the *Event constants
+	Locality     string `json:"locality"`
+	Ingestor     string `json:"ingestor,omitempty"`      // empty for packet encryption & task signing keys
+	KeyKind      string `json:"key-kind,omitempty"`      // for key events, the kind of key changed
+	Version      int64  `json:"version,omitempty"`       // for key events, the creation timestamp of the key version
+	ManifestName string `json:"manifest-name,omitempty"` // for manifest events, the name of the data share processor whose manifest changed
+	Diff         string `json:"diff"`                    // a human-readable description of all changes to the key or manifest
+	DryRun       bool   `json:"dry-run"`                 // if set, the change was not actually written
+}
+
+// summary returns a one-line, human-readable description of the event.
+func (e rotationEvent) summary() string {
+	var prefix string
+	if e.DryRun {
+		prefix = "[dry run] "
+	}
+	subject := fmt.Sprintf("%q", e.Locality)
+	if e.Ingestor != "" {
+		subject = fmt.Sprintf("(%q, %q)", e.Locality, e.Ingestor)
+	}
+	switch e.Event {
+	case keyCreatedEvent:
+		return fmt.Sprintf("%sCreated %s version %d for %s: %s", prefix, e.KeyKind, e.Version, subject, e.Diff)
+	case keyPromotedEvent:
+		return fmt.Sprintf("%sPromoted %s version %d to primary for %s: %s", prefix, e.KeyKind, e.Version, subject, e.Diff)
+	case keyDeletedEvent:
+		return fmt.Sprintf("%sDeleted %s version %d for %s: %s", prefix, e.KeyKind, e.Version, subject, e.Diff)
+	case manifestChangedEvent:
+		return fmt.Sprintf("%sChanged manifest %q for %s: %s", prefix, e.ManifestName, subject, e.Diff)
+	default:
+		return fmt.Sprintf("%s%s for %s: %s", prefix, e.Event, subject, e.Diff)
+	}
+}
+
+// keyEvents returns the events describing the change of a key from oldKey to
+// newKey: a key-created event for each added version, a key-promoted event if
+// the primary version changed, and a key-deleted event for each removed
+// version.
+func keyEvents(kind, locality, ingestor string, oldKey, newKey key.Key) []rotationEvent {
+	diff := newKey.Diff(oldKey)
+	newEvent := func(event string, ts int64) rotationEvent {
+		return rotationEvent{Event: event, Locality: locality, Ingestor: ingestor, KeyKind: kind, Version: ts, Diff: diff}
+	}
+	oldTimestamps, newTimestamps := map[int64]bool{}, map[int64]bool{}
+	_ = oldKey.Versions(func(v key.Version) error { oldTimestamps[v.CreationTimestamp] = true; return nil })
+	_ = newKey.Versions(func(v key.Version) error { newTimestamps[v.CreationTimestamp] = true; return nil })
+
+	var events []rotationEvent
+	_ = newKey.Versions(func(v key.Version) error {
+		if !oldTimestamps[v.CreationTimestamp] {
+			events = append(events, newEvent(keyCreatedEvent, v.CreationTimestamp))
+		}
+		return nil
+	})
+	if !newKey.IsEmpty() && (oldKey.IsEmpty() || oldKey.Primary().CreationTimestamp != newKey.Primary().CreationTimestamp) {
+		events = append(events, newEvent(keyPromotedEvent, newKey.Primary().CreationTimestamp))
+	}
+	_ = oldKey.Versions(func(v key.Version) error {
+		if !newTimestamps[v.CreationTimestamp] {
+			events = append(events, newEvent(keyDeletedEvent, v.CreationTimestamp))
+		}
+		return nil
+	})
+	return events
+}
+
+// slackMessage is the body of a message posted to a Slack incoming webhook.
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// notifier delivers rotation events to operators once the corresponding
+// change has been written. Delivery failures are logged, but are not
+// otherwise treated as errors since the change has already been made. The
+// zero value delivers no events.
+type notifier struct {
+	webhookURL      string // if set, each event is POSTed here as JSON
+	slackWebhookURL string // if set, a summary of each event is posted to this Slack incoming webhook
+	client          *http.Client
+	dryRun          bool // reported in events
+}
+
+// newNotifier creates a notifier delivering events to the given webhook URLs,
+// either of which may be empty. Webhooks are called using client.
+func newNotifier(webhookURL, slackWebhookURL string, client *http.Client, dryRun bool) (notifier, error) {
+	for _, u := range []string{webhookURL, slackWebhookURL} {
+		if u == "" {
+			continue
+		}
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return notifier{}, fmt.Errorf("couldn't parse webhook URL %q: %w", u, err)
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return notifier{}, fmt.Errorf("webhook URL %q must be an http:// or https:// URL", u)
+		}
+	}
+	return notifier{webhookURL: webhookURL, slackWebhookURL: slackWebhookURL, client: client, dryRun: dryRun}, nil
+}
+
+// notify delivers the given events, logging any failure.
+func (n notifier) notify(ctx context.Context, events ...rotationEvent) {
+	for _, e := range events {
+		e.DryRun = n.dryRun
+		if n.webhookURL != "" {
+			if err := postJSON(ctx, n.client, n.webhookURL, e); err != nil {
+				log.Error().Err(err).Str("locality", e.Locality).Str("event", e.Event).Msgf("Couldn't deliver %s notification: %v", e.Event, err)
+			}
+		}
+		if n.slackWebhookURL != "" {
+			if err := postJSON(ctx, n.client, n.slackWebhookURL, slackMessage{Text: e.summary()}); err != nil {
+				log.Error().Err(err).Str("locality", e.Locality).Str("event", e.Event).Msgf("Couldn't deliver %s notification to Slack: %v", e.Event, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// keyRotationGVR identifies the KeyRotation custom resource, defined in
+// deploy/keyrotation-crd.yaml. Each KeyRotation represents the keys &
+// manifests of a single locality; key-rotator records the outcome of each
+// rotation in the resource's status subresource.
+var keyRotationGVR = schema.GroupVersionResource{
+	Group:    "prio.divviup.org",
+	Version:  "v1alpha1",
+	Resource: "keyrotations",
+}
+
+// Condition types & reasons recorded on KeyRotation resources.
+const (
+	conditionKeysHealthy      = "KeysHealthy"
+	conditionManifestsHealthy = "ManifestsHealthy"
+
+	reasonRotationSucceeded     = "RotationSucceeded"
+	reasonKeyRotationFailed     = "KeyRotationFailed"
+	reasonManifestUpdateFailed  = "ManifestUpdateFailed"
+	reasonKeyRotationIncomplete = "KeyRotationIncomplete"
+)
+
+var conditionStatus = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "key_rotator_condition",
+	Help: "Status of each KeyRotation condition as of the last rotation: 1 if true, 0 if false, -1 if unknown.",
+}, []string{"condition"})
+
+// keyRotationStatus is the status subresource of a KeyRotation.
+type keyRotationStatus struct {
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	LastRotationTime   *metav1.Time       `json:"lastRotationTime,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// manifestError wraps errors which occurred while updating or writing
+// manifests, after all keys were successfully rotated & written.
+type manifestError struct{ err error }
+
+func (e manifestError) Error() string { return e.err.Error() }
+func (e manifestError) Unwrap() error { return e.err }
+
+// keyRotationStatusReporter records the outcome of rotations on the status of
+// a KeyRotation resource.
+type keyRotationStatusReporter struct {
+	client dynamic.ResourceInterface // KeyRotation resources in the relevant namespace
+	name   string                    // the name of the KeyRotation resource to update
+}
+
+// report updates the KeyRotation resource's status to reflect a rotation
+// which completed at now, with the given error (nil if rotation succeeded).
+func (r keyRotationStatusReporter) report(ctx context.Context, now time.Time, rotationErr error) error {
+	obj, err := r.client.Get(ctx, r.name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("couldn't get KeyRotation %q: %w", r.name, err)
+	}
+
+	var status keyRotationStatus
+	if rawStatus, ok := obj.Object["status"].(map[string]interface{}); ok {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(rawStatus, &status); err != nil {
+			return fmt.Errorf("couldn't parse status of KeyRotation %q: %w", r.name, err)
+		}
+	}
+	updateKeyRotationStatus(&status, obj.GetGeneration(), now, rotationErr)
+
+	rawStatus, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+	if err != nil {
+		return fmt.Errorf("couldn't serialize status of KeyRotation %q: %w", r.name, err)
+	}
+	obj.Object["status"] = rawStatus
+	if _, err := r.client.UpdateStatus(ctx, obj, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("couldn't update status of KeyRotation %q: %w", r.name, err)
+	}
+	return nil
+}
+
+// updateKeyRotationStatus updates status to reflect a rotation of the given
+// generation of a KeyRotation which completed at now, with the given error
+// (nil if rotation succeeded), and records the resulting conditions as
+// metrics.
+func updateKeyRotationStatus(status *keyRotationStatus, generation int64, now time.Time, rotationErr error) {
+	status.ObservedGeneration = generation
+
+	keysHealthy := metav1.Condition{Type: conditionKeysHealthy, ObservedGeneration: generation}
+	manifestsHealthy := metav1.Condition{Type: conditionManifestsHealthy, ObservedGeneration: generation}
+	var mErr manifestError
+	switch {
+	case rotationErr == nil:
+		status.LastRotationTime = &metav1.Time{Time: now}
+		keysHealthy.Status, keysHealthy.Reason = metav1.ConditionTrue, reasonRotationSucceeded
+		manifestsHealthy.Status, manifestsHealthy.Reason = metav1.ConditionTrue, reasonRotationSucceeded
+
+	case errors.As(rotationErr, &mErr):
+		keysHealthy.Status, keysHealthy.Reason = metav1.ConditionTrue, reasonRotationSucceeded
+		manifestsHealthy.Status, manifestsHealthy.Reason = metav1.ConditionFalse, reasonManifestUpdateFailed
+		manifestsHealthy.Message = rotationErr.Error()
+
+	default:
+		keysHealthy.Status, keysHealthy.Reason = metav1.ConditionFalse, reasonKeyRotationFailed
+		keysHealthy.Message = rotationErr.Error()
+		manifestsHealthy.Status, manifestsHealthy.Reason = metav1.ConditionUnknown, reasonKeyRotationIncomplete
+		manifestsHealthy.Message = "manifests were not updated because key rotation failed"
+	}
+
+	// SetStatusCondition only updates LastTransitionTime if the condition's
+	// status changes.
+	keysHealthy.LastTransitionTime = metav1.Time{Time: now}
+	manifestsHealthy.LastTransitionTime = metav1.Time{Time: now}
+	meta.SetStatusCondition(&status.Conditions, keysHealthy)
+	meta.SetStatusCondition(&status.Conditions, manifestsHealthy)
+
+	for _, c := range []metav1.Condition{keysHealthy, manifestsHealthy} {
+		v := -1.0
+		switch c.Status {
+		case metav1.ConditionTrue:
+			v = 1
+		case metav1.ConditionFalse:
+			v = 0
+		}
+		conditionStatus.WithLabelValues(c.Type).Set(v)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/abetterinternet/prio-server/key-rotator/storage"
+)
+
+// Names of the phases of a rotation.
+const (
+	readPhase           = "read"
+	rotatePhase         = "rotate"
+	writeKeysPhase      = "write-keys"
+	writeManifestsPhase = "write-manifests"
+)
+
+// phaseTimeouts bounds the duration of each phase of a rotation, so that a
+// slow phase cannot consume the time budgeted for later phases. A zero timeout
+// bounds the phase only by the deadline of the rotation as a whole, if any.
+type phaseTimeouts struct {
+	read           time.Duration // reading keys & manifests
+	rotate         time.Duration // rotating keys & updating manifests in memory
+	writeKeys      time.Duration // writing keys
+	writeManifests time.Duration // writing manifests & rotation status
+}
+
+// runPhase runs f, in a span named for the phase, with a context bounded by the
+// given timeout (if non-zero) as well as by ctx, and records its duration for
+// the locality. If f fails because the phase's own deadline was exceeded, the
+// returned error says so. f is expected to return ctx.Err() if it cannot
+// otherwise observe cancellation of the context.
+func runPhase(ctx context.Context, locality, phase string, timeout time.Duration, f func(context.Context) error) (err error) {
+	ctx, span := startSpan(ctx, "phase."+phase)
+	defer func() { storage.EndSpan(span, err) }()
+	defer observeDuration(ctx, phaseDuration.WithLabelValues(locality, phase), time.Now())
+	phaseCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		phaseCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err = f(phaseCtx)
+	if err != nil && errors.Is(phaseCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		return fmt.Errorf("%s phase exceeded its timeout of %v: %w", phase, timeout, err)
+	}
+	return err
+}
+
+// checkWriteKeysBudget returns an error if ctx's deadline does not leave the
+// full writeKeys timeout for writing keys. Failing before writing any key is
+// preferable to running out of time partway through writing keys.
+func checkWriteKeysBudget(ctx context.Context, now time.Time, timeouts phaseTimeouts) error {
+	deadline, ok := ctx.Deadline()
+	if !ok || timeouts.writeKeys == 0 {
+		return nil
+	}
+	if remaining := deadline.Sub(now); remaining < timeouts.writeKeys {
+		return fmt.Errorf("only %v remains before the deadline, less than the %s phase's timeout of %v; not writing keys",
+			remaining.Round(time.Millisecond), writeKeysPhase, timeouts.writeKeys)
+	}
+	return nil
+}
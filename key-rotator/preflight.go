@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+	"github.com/abetterinternet/prio-server/key-rotator/storage"
+)
+
+// Preflight checks, as reported in preflightResult.Check.
+const (
+	preflightListSecrets   = "kubernetes-list-secrets"
+	preflightReadSecret    = "kubernetes-read-secret"
+	preflightWriteSecret   = "kubernetes-write-secret"
+	preflightReadKey       = "read-key"
+	preflightListManifests = "manifest-list"
+	preflightReadManifest  = "manifest-read"
+	preflightWriteManifest = "manifest-write"
+)
+
+// preflightConfig configures a check, without writing anything, that
+// key-rotator can access the storage it needs to rotate the keys of a single
+// locality.
+type preflightConfig struct {
+	// Dependencies.
+	// secrets & checkKeySecret are nil if keys aren't stored in Kubernetes.
+	// checkKeySecret checks the secret holding the key of the given kind, as
+	// storage.CheckKubernetesKeySecret does.
+	secrets            func(namespace string) k8s.SecretInterface
+	checkKeySecret     func(ctx context.Context, kind, ingestor string) (secretName string, readErr, writeErr error)
+	keyStores          []verifyBackup // key stores other than Kubernetes, e.g. backups, checked by reading keys
+	manifestStore      storage.Manifest
+	checkManifestWrite func(ctx context.Context) error
+
+	// Configuration.
+	namespaces     []string // the namespaces holding key secrets
+	manifestBucket string   // used only in reported results
+	locality       string
+	ingestors      []string
+	taskSigningKey bool // if set, the task signing key is also checked
+}
+
+// preflightResult is the result of a single preflight check, written to
+// standard output as a line of JSON.
+type preflightResult struct {
+	Check  string `json:"check"`  // one of the preflight* constants
+	Target string `json:"target"` // what was checked, e.g. a namespace, secret, key or bucket
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+}
+
+// preflight runs each preflight check in turn, writing the result of each to
+// w, and returns the number of checks which failed. A failed check doesn't
+// prevent the checks which follow it, so that every misconfiguration is
+// reported at once. Kubernetes secrets are checked for writing with
+// server-side dry-run patches, and the manifest bucket as described by
+// storage.CheckManifestWriteAccess; other key stores are only read.
+func preflight(ctx context.Context, cfg preflightConfig, w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	failed := 0
+	report := func(check, target string, err error) error {
+		result := preflightResult{Check: check, Target: target, OK: err == nil}
+		if err != nil {
+			result.Error = err.Error()
+			failed++
+		}
+		if err := enc.Encode(result); err != nil {
+			return fmt.Errorf("couldn't write result of %s check of %s: %w", check, target, err)
+		}
+		return nil
+	}
+
+	type keyToCheck struct {
+		kind     string // as accepted by storage.CheckKubernetesKeySecret
+		ingestor string
+		name     string // e.g. `batch signing key for ("us-ca", "apple")`
+		get      func(storage.Key) (key.Key, error)
+	}
+	keys := []keyToCheck{{
+		kind: "packet-encryption",
+		name: fmt.Sprintf("packet encryption key for %q", cfg.locality),
+		get:  func(s storage.Key) (key.Key, error) { return s.GetPacketEncryptionKey(ctx, cfg.locality) },
+	}}
+	for _, ingestor := range cfg.ingestors {
+		ingestor := ingestor
+		keys = append(keys, keyToCheck{
+			kind:     "batch-signing",
+			ingestor: ingestor,
+			name:     fmt.Sprintf("batch signing key for (%q, %q)", cfg.locality, ingestor),
+			get:      func(s storage.Key) (key.Key, error) { return s.GetBatchSigningKey(ctx, cfg.locality, ingestor) },
+		})
+	}
+	if cfg.taskSigningKey {
+		keys = append(keys, keyToCheck{
+			kind: "task-signing",
+			name: fmt.Sprintf("task signing key for %q", cfg.locality),
+			get:  func(s storage.Key) (key.Key, error) { return s.GetTaskSigningKey(ctx, cfg.locality) },
+		})
+	}
+
+	if cfg.secrets != nil {
+		seen := map[string]bool{}
+		for _, ns := range cfg.namespaces {
+			if ns == "" || seen[ns] {
+				continue
+			}
+			seen[ns] = true
+			_, err := cfg.secrets(ns).List(ctx, metav1.ListOptions{Limit: 1})
+			if err := report(preflightListSecrets, ns, err); err != nil {
+				return failed, err
+			}
+		}
+	}
+	if cfg.checkKeySecret != nil {
+		for _, k := range keys {
+			secretName, readErr, writeErr := cfg.checkKeySecret(ctx, k.kind, k.ingestor)
+			if err := report(preflightReadSecret, secretName, readErr); err != nil {
+				return failed, err
+			}
+			if err := report(preflightWriteSecret, secretName, writeErr); err != nil {
+				return failed, err
+			}
+		}
+	}
+	for _, keyStore := range cfg.keyStores {
+		for _, k := range keys {
+			_, err := k.get(keyStore.keyStore)
+			if err := report(preflightReadKey, fmt.Sprintf("%s: %s", keyStore.name, k.name), err); err != nil {
+				return failed, err
+			}
+		}
+	}
+
+	_, err := cfg.manifestStore.ListDataShareProcessorSpecificManifests(ctx)
+	if err := report(preflightListManifests, cfg.manifestBucket, err); err != nil {
+		return failed, err
+	}
+	for _, ingestor := range cfg.ingestors {
+		_, err := cfg.manifestStore.GetDataShareProcessorSpecificManifest(ctx, dspName(cfg.locality, ingestor))
+		if err := report(preflightReadManifest, dspName(cfg.locality, ingestor), err); err != nil {
+			return failed, err
+		}
+	}
+	if err := report(preflightWriteManifest, cfg.manifestBucket, cfg.checkManifestWrite(ctx)); err != nil {
+		return failed, err
+	}
+	return failed, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+)
+
+// changeReport records each key & manifest written by rotations, or in
+// --dry-run mode each which would have been written, so that they can be
+// reported as JSON with --output=json, e.g. for plan-style review in CI before
+// rotating with --dry-run=false. The nil *changeReport records nothing.
+type changeReport struct {
+	mu        sync.Mutex // protects keys & manifests
+	dryRun    bool
+	keys      []keyChange
+	manifests []manifestChange
+}
+
+// keyChange describes a key written, or which would have been written.
+type keyChange struct {
+	Locality        string  `json:"locality"`
+	Ingestor        string  `json:"ingestor,omitempty"` // empty for packet encryption & task signing keys
+	Kind            string  `json:"kind"`               // e.g. "batch-signing-key"
+	Diff            string  `json:"diff"`
+	OldVersions     []int64 `json:"old-versions"`               // creation timestamps, in try order, primary first
+	NewVersions     []int64 `json:"new-versions"`               // creation timestamps, in try order, primary first
+	OldPrimary      *int64  `json:"old-primary,omitempty"`      // creation timestamp; omitted if the old key had no versions
+	NewPrimary      *int64  `json:"new-primary,omitempty"`      // creation timestamp; omitted if the new key has no versions
+	CreatedVersions []int64 `json:"created-versions,omitempty"` // creation timestamps of versions in the new key but not the old
+	DeletedVersions []int64 `json:"deleted-versions,omitempty"` // creation timestamps of versions in the old key but not the new
+}
+
+// manifestChange describes a manifest written, or which would have been
+// written.
+type manifestChange struct {
+	Locality     string `json:"locality"`
+	Ingestor     string `json:"ingestor"`
+	ManifestName string `json:"manifest-name"`
+	Diff         string `json:"diff"`
+}
+
+// changeReportJSON is the format of the report written by changeReport.write.
+type changeReportJSON struct {
+	DryRun    bool             `json:"dry-run"`
+	Keys      []keyChange      `json:"keys"`
+	Manifests []manifestChange `json:"manifests"`
+}
+
+// addKey records that a key changed from oldKey to newKey.
+func (r *changeReport) addKey(kind, locality, ingestor string, oldKey, newKey key.Key) {
+	if r == nil {
+		return
+	}
+	change := keyChange{
+		Locality:    locality,
+		Ingestor:    ingestor,
+		Kind:        kind,
+		Diff:        newKey.Diff(oldKey),
+		OldVersions: versionTimestamps(oldKey),
+		NewVersions: versionTimestamps(newKey),
+	}
+	if !oldKey.IsEmpty() {
+		ts := oldKey.Primary().CreationTimestamp
+		change.OldPrimary = &ts
+	}
+	if !newKey.IsEmpty() {
+		ts := newKey.Primary().CreationTimestamp
+		change.NewPrimary = &ts
+	}
+	change.CreatedVersions = timestampsNotIn(change.NewVersions, change.OldVersions)
+	change.DeletedVersions = timestampsNotIn(change.OldVersions, change.NewVersions)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = append(r.keys, change)
+}
+
+// addManifest records that the named manifest changed, as described by diff.
+func (r *changeReport) addManifest(locality, ingestor, manifestName, diff string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.manifests = append(r.manifests, manifestChange{Locality: locality, Ingestor: ingestor, ManifestName: manifestName, Diff: diff})
+}
+
+// write writes the report to w as JSON. Keys & manifests are ordered by
+// locality, then ingestor, then kind or name, regardless of the order in which
+// they were written.
+func (r *changeReport) write(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := changeReportJSON{
+		DryRun:    r.dryRun,
+		Keys:      append([]keyChange{}, r.keys...),
+		Manifests: append([]manifestChange{}, r.manifests...),
+	}
+	sort.Slice(report.Keys, func(i, j int) bool {
+		a, b := report.Keys[i], report.Keys[j]
+		if a.Locality != b.Locality {
+			return a.Locality < b.Locality
+		}
+		if a.Ingestor != b.Ingestor {
+			return a.Ingestor < b.Ingestor
+		}
+		return a.Kind < b.Kind
+	})
+	sort.Slice(report.Manifests, func(i, j int) bool {
+		a, b := report.Manifests[i], report.Manifests[j]
+		if a.Locality != b.Locality {
+			return a.Locality < b.Locality
+		}
+		if a.Ingestor != b.Ingestor {
+			return a.Ingestor < b.Ingestor
+		}
+		return a.ManifestName < b.ManifestName
+	})
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return fmt.Errorf("couldn't write change report: %w", err)
+	}
+	return nil
+}
+
+// writeChangeReport writes report, if not nil, to standard output, logging any
+// error. It is written even if rotation failed, since changes may have been
+// written before the failure.
+func writeChangeReport(report *changeReport) {
+	if report == nil {
+		return
+	}
+	if err := report.write(os.Stdout); err != nil {
+		log.Error().Err(err).Msgf("%v", err)
+	}
+}
+
+// versionTimestamps returns the creation timestamps of k's versions, in try
+// order, primary first.
+func versionTimestamps(k key.Key) []int64 {
+	tss := []int64{}
+	_ = k.Versions(func(v key.Version) error {
+		tss = append(tss, v.CreationTimestamp)
+		return nil
+	})
+	return tss
+}
+
+// timestampsNotIn returns the timestamps in tss which are not in others.
+func timestampsNotIn(tss, others []int64) []int64 {
+	in := map[int64]bool{}
+	for _, ts := range others {
+		in[ts] = true
+	}
+	var rslt []int64
+	for _, ts := range tss {
+		if !in[ts] {
+			rslt = append(rslt, ts)
+		}
+	}
+	return rslt
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+	"github.com/abetterinternet/prio-server/key-rotator/storage"
+)
+
+// restoreConfig configures the restoration of a single locality's keys from
+// a backup key store, i.e. one of --backup, to the key store, i.e.
+// --key-store.
+type restoreConfig struct {
+	// Dependencies.
+	rotate rotateKeysConfig // keys are restored from rotate's key store, which is the backup, & checked against the manifests in rotate's manifest store
+	to     storage.Key
+
+	// Configuration.
+	from   string // the name of the backup, e.g. "aws"
+	dryRun bool   // if set, cfg.to doesn't persist writes: restored keys are not read back for verification
+}
+
+// restoreReport describes the keys restored from a backup, as written by
+// restore.
+type restoreReport struct {
+	Locality string        `json:"locality"`
+	From     string        `json:"from"`
+	DryRun   bool          `json:"dry-run"` // if set, keys listed as restored would have been restored
+	Keys     []restoredKey `json:"keys"`
+}
+
+// restoredKey describes the restoration of a single key.
+type restoredKey struct {
+	Name     string `json:"name"` // e.g. `batch signing key for ("us-ca", "apple")`
+	Restored bool   `json:"restored"`
+	Detail   string `json:"detail"` // why the key was or wasn't restored
+}
+
+// restore reads each of the locality's keys from the backup, checks them
+// against the public keys published in the locality's manifests, and writes
+// each to cfg.to, unless the key is empty in the backup or cfg.to already
+// holds an identical key, then writes a JSON report of the keys restored to
+// w. If any backed-up key mismatches the manifests, e.g. because the backup
+// is stale, no keys are restored: the manifests are what peers use to verify
+// signatures & encrypt packets, so keys which don't match them are of no use.
+func restore(ctx context.Context, cfg restoreConfig, w io.Writer) error {
+	rcfg := cfg.rotate
+	packetEncryptionKey, batchSigningKeyByIngestor, manifestByIngestor, err :=
+		readKeysAndManifests(ctx, rcfg.keyStore, rcfg.manifestStore, rcfg.locality, rcfg.ingestors)
+	if err != nil {
+		return fmt.Errorf("couldn't read keys from backup %q: %w", cfg.from, err)
+	}
+	var taskSigningKey key.Key
+	if rcfg.manageTaskSigningKey {
+		if taskSigningKey, err = rcfg.keyStore.GetTaskSigningKey(ctx, rcfg.locality); err != nil {
+			return fmt.Errorf("couldn't get task signing key for %q from backup %q: %w", rcfg.locality, cfg.from, err)
+		}
+	}
+
+	var mismatches []string
+	for _, ingestor := range rcfg.ingestors {
+		updateCFG := rcfg.updateKeysConfig(ingestor, batchSigningKeyByIngestor[ingestor], packetEncryptionKey, taskSigningKey)
+		for _, mismatch := range manifestByIngestor[ingestor].Mismatches(updateCFG) {
+			mismatches = append(mismatches, fmt.Sprintf("manifest for (%q, %q): %s", rcfg.locality, ingestor, mismatch))
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("keys in backup %q don't match manifests, so none were restored:\n  %s", cfg.from, strings.Join(mismatches, "\n  "))
+	}
+
+	type keyToRestore struct {
+		name  string
+		want  key.Key
+		get   func() (key.Key, error)
+		write func(key.Key) error
+	}
+	keys := []keyToRestore{{
+		name:  fmt.Sprintf("packet encryption key for %q", rcfg.locality),
+		want:  packetEncryptionKey,
+		get:   func() (key.Key, error) { return cfg.to.GetPacketEncryptionKey(ctx, rcfg.locality) },
+		write: func(k key.Key) error { return cfg.to.PutPacketEncryptionKey(ctx, rcfg.locality, k) },
+	}}
+	for _, ingestor := range rcfg.ingestors {
+		ingestor := ingestor
+		keys = append(keys, keyToRestore{
+			name:  fmt.Sprintf("batch signing key for (%q, %q)", rcfg.locality, ingestor),
+			want:  batchSigningKeyByIngestor[ingestor],
+			get:   func() (key.Key, error) { return cfg.to.GetBatchSigningKey(ctx, rcfg.locality, ingestor) },
+			write: func(k key.Key) error { return cfg.to.PutBatchSigningKey(ctx, rcfg.locality, ingestor, k) },
+		})
+	}
+	if rcfg.manageTaskSigningKey {
+		keys = append(keys, keyToRestore{
+			name:  fmt.Sprintf("task signing key for %q", rcfg.locality),
+			want:  taskSigningKey,
+			get:   func() (key.Key, error) { return cfg.to.GetTaskSigningKey(ctx, rcfg.locality) },
+			write: func(k key.Key) error { return cfg.to.PutTaskSigningKey(ctx, rcfg.locality, k) },
+		})
+	}
+
+	report := restoreReport{
+		Locality: rcfg.locality,
+		From:     cfg.from,
+		DryRun:   cfg.dryRun,
+		Keys:     []restoredKey{},
+	}
+	for _, k := range keys {
+		rk := restoredKey{Name: k.name}
+		switch got, err := k.get(); {
+		case k.want.IsEmpty():
+			rk.Detail = "key is empty in backup"
+		case err != nil:
+			rk.Restored, rk.Detail = true, fmt.Sprintf("couldn't get key from --key-store: %v", err)
+		case got.Equal(k.want):
+			rk.Detail = "key in --key-store matches backup"
+		default:
+			rk.Restored, rk.Detail = true, fmt.Sprintf("key in --key-store differs: %s", k.want.Diff(got))
+		}
+		if !rk.Restored {
+			log.Info().Msgf("Not restoring %s: %s", k.name, rk.Detail)
+			report.Keys = append(report.Keys, rk)
+			continue
+		}
+
+		log.Info().Msgf("Restoring %s: %s", k.name, rk.Detail)
+		if err := k.write(k.want); err != nil {
+			return fmt.Errorf("couldn't write %s to --key-store: %w", k.name, err)
+		}
+		if !cfg.dryRun {
+			got, err := k.get()
+			if err != nil {
+				return fmt.Errorf("couldn't read back %s from --key-store: %w", k.name, err)
+			}
+			if !got.Equal(k.want) {
+				return fmt.Errorf("%s read back from --key-store differs from that written: %s", k.name, k.want.Diff(got))
+			}
+		}
+		report.Keys = append(report.Keys, rk)
+	}
+
+	reportBytes, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't marshal report as JSON: %w", err)
+	}
+	if _, err := w.Write(append(reportBytes, '\n')); err != nil {
+		return fmt.Errorf("couldn't write report: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Kinds of key whose versions may be revoked.
+const (
+	revokeBatchSigningKey     = "batch-signing"
+	revokePacketEncryptionKey = "packet-encryption"
+)
+
+// keyRevocation identifies a key version, e.g. one whose key material may have
+// been compromised, to be removed from its key by a rotation. The rotation
+// also creates a new key version irrespective of the key's CreateMinAge; see
+// key.Key.Revoke.
+type keyRevocation struct {
+	kind              string   // revokeBatchSigningKey or revokePacketEncryptionKey
+	creationTimestamp int64    // the creation timestamp of the revoked version
+	ingestors         []string // for batch signing keys, the ingestors whose key's version is revoked
+}
+
+// newKeyRevocation validates & returns a revocation of the given version of
+// the given kind of key. For batch signing keys, the version is revoked from
+// the key of each of revokeIngestors, a comma-separated subset of ingestors,
+// or from every ingestor's key if revokeIngestors is empty.
+func newKeyRevocation(kind string, creationTimestamp int64, revokeIngestors string, ingestors []string) (*keyRevocation, error) {
+	if creationTimestamp <= 0 {
+		return nil, fmt.Errorf("--revoke-key-version must be the positive creation timestamp of a key version")
+	}
+	r := &keyRevocation{kind: kind, creationTimestamp: creationTimestamp}
+	switch kind {
+	case revokePacketEncryptionKey:
+		if revokeIngestors != "" {
+			return nil, fmt.Errorf("--revoke-ingestors applies only to --revoke-key=%s", revokeBatchSigningKey)
+		}
+	case revokeBatchSigningKey:
+		known := map[string]bool{}
+		for _, ingestor := range ingestors {
+			known[ingestor] = true
+		}
+		for _, v := range strings.Split(revokeIngestors, ",") {
+			if v = strings.TrimSpace(v); v == "" {
+				continue
+			}
+			if !known[v] {
+				return nil, fmt.Errorf("--revoke-ingestors includes %q, which is not in --ingestors", v)
+			}
+			r.ingestors = append(r.ingestors, v)
+		}
+		if len(r.ingestors) == 0 {
+			r.ingestors = ingestors
+		}
+	default:
+		return nil, fmt.Errorf("--revoke-key must be one of '%s' or '%s'", revokeBatchSigningKey, revokePacketEncryptionKey)
+	}
+	return r, nil
+}
+
+// appliesTo returns true if the revocation applies to the key of the given
+// kind, for the given ingestor (batch signing keys only). A nil revocation
+// applies to no key.
+func (r *keyRevocation) appliesTo(kind, ingestor string) bool {
+	if r == nil || r.kind != kind {
+		return false
+	}
+	if kind == revokePacketEncryptionKey {
+		return true
+	}
+	for _, v := range r.ingestors {
+		if v == ingestor {
+			return true
+		}
+	}
+	return false
+}
+
+// removeFromHistory removes the revoked version from the previous keys kept
+// for each key from which it is revoked, so that its key material is not left
+// in the key's secret, nor restored by a later rollback. remove removes the
+// version from the previous keys of the key of the given kind (& ingestor), &
+// returns the number of previous keys changed; removeFromHistory returns the
+// total.
+func (r *keyRevocation) removeFromHistory(ctx context.Context, remove func(ctx context.Context, kind, ingestor string, creationTimestamp int64) (int, error)) (int, error) {
+	ingestors := r.ingestors
+	if r.kind == revokePacketEncryptionKey {
+		ingestors = []string{""}
+	}
+	total := 0
+	for _, ingestor := range ingestors {
+		n, err := remove(ctx, r.kind, ingestor, r.creationTimestamp)
+		if err != nil {
+			return total, fmt.Errorf("couldn't remove %s from previous keys: %w", r, err)
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func (r *keyRevocation) String() string {
+	if r.kind == revokeBatchSigningKey {
+		return fmt.Sprintf("%s key version %d for ingestors %s", r.kind, r.creationTimestamp, strings.Join(r.ingestors, ", "))
+	}
+	return fmt.Sprintf("%s key version %d", r.kind, r.creationTimestamp)
+}
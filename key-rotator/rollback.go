@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+)
+
+// Kinds of key which may be rolled back.
+const (
+	rollbackBatchSigningKey     = "batch-signing"
+	rollbackPacketEncryptionKey = "packet-encryption"
+	rollbackTaskSigningKey      = "task-signing"
+)
+
+// keyRollback identifies a key to be restored, by a rotation, to a previous
+// key kept in its Kubernetes secret, e.g. because a bad rotation wrote it. The
+// rotation writes the previous key in place of rotating the key, and updates
+// manifests to match.
+type keyRollback struct {
+	kind     string  // one of the rollback*Key constants
+	ingestor string  // for batch signing keys, the ingestor whose key is rolled back
+	steps    int     // the number of writes rolled back: 1 restores the key replaced by the most recent write
+	key      key.Key // the previous key restored; set by load
+}
+
+// newKeyRollback validates & returns a rollback of the given kind of key, for
+// batch signing keys that of the given ingestor, by the given number of writes.
+// The previous key is not read until load is called.
+func newKeyRollback(kind, ingestor string, steps int, ingestors []string, manageTaskSigningKey bool) (*keyRollback, error) {
+	if steps < 1 {
+		return nil, fmt.Errorf("--rollback-steps must be at least 1")
+	}
+	r := &keyRollback{kind: kind, ingestor: ingestor, steps: steps}
+	switch kind {
+	case rollbackPacketEncryptionKey, rollbackTaskSigningKey:
+		if ingestor != "" {
+			return nil, fmt.Errorf("--rollback-ingestor applies only to --rollback-key=%s", rollbackBatchSigningKey)
+		}
+		if kind == rollbackTaskSigningKey && !manageTaskSigningKey {
+			return nil, fmt.Errorf("--rollback-key=%s requires --task-signing-key-enable", rollbackTaskSigningKey)
+		}
+	case rollbackBatchSigningKey:
+		known := false
+		for _, v := range ingestors {
+			known = known || v == ingestor
+		}
+		if !known {
+			return nil, fmt.Errorf("--rollback-ingestor must be one of --ingestors with --rollback-key=%s", rollbackBatchSigningKey)
+		}
+	default:
+		return nil, fmt.Errorf("--rollback-key must be one of '%s', '%s' or '%s'", rollbackBatchSigningKey, rollbackPacketEncryptionKey, rollbackTaskSigningKey)
+	}
+	return r, nil
+}
+
+// load reads the previous keys kept for the rolled-back key with history,
+// most recently replaced first, & selects the one restored.
+func (r *keyRollback) load(ctx context.Context, history func(ctx context.Context, kind, ingestor string) ([]key.Key, error)) error {
+	keys, err := history(ctx, r.kind, r.ingestor)
+	if err != nil {
+		return fmt.Errorf("couldn't read previous keys for %s: %w", r, err)
+	}
+	if len(keys) < r.steps {
+		return fmt.Errorf("can't roll back %s by %d writes: only %d previous keys are kept (see --kubernetes-key-history)", r, r.steps, len(keys))
+	}
+	if keys[r.steps-1].IsEmpty() {
+		return fmt.Errorf("can't roll back %s by %d writes: the previous key is empty", r, r.steps)
+	}
+	r.key = keys[r.steps-1]
+	return nil
+}
+
+// appliesTo returns true if the rollback applies to the key of the given kind,
+// for the given ingestor (batch signing keys only). A nil rollback applies to
+// no key.
+func (r *keyRollback) appliesTo(kind, ingestor string) bool {
+	return r != nil && r.kind == kind && (kind != rollbackBatchSigningKey || r.ingestor == ingestor)
+}
+
+func (r *keyRollback) String() string {
+	if r.kind == rollbackBatchSigningKey {
+		return fmt.Sprintf("%s key for ingestor %s", r.kind, r.ingestor)
+	}
+	return fmt.Sprintf("%s key", r.kind)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/abetterinternet/prio-server/key-rotator/storage"
+)
+
+// verifySchemaConfig configures verification, and optionally migration, of
+// the schema of the Kubernetes secrets holding a locality's keys.
+type verifySchemaConfig struct {
+	// Dependencies.
+	secrets storage.KubernetesSecrets
+
+	// Configuration.
+	prioEnvironment string
+	locality        string
+	ingestors       []string
+	taskSigningKey  bool // if set, the task signing key's secret is also verified
+	migrate         bool // if set, outdated secrets are rewritten in the current schema
+}
+
+// verifySchema verifies that each key secret is consistent & in the current
+// schema, logging the schema of each. If cfg.migrate is set, outdated secrets
+// are first rewritten in the current schema. Inconsistent secrets are never
+// migrated, and cause an error to be returned, as does any outdated secret
+// left unmigrated.
+func verifySchema(ctx context.Context, cfg verifySchemaConfig) error {
+	verify := func() (outdated, inconsistent int, _ error) {
+		reports, err := storage.VerifyKubernetesKeys(ctx, cfg.secrets, cfg.prioEnvironment, cfg.locality, cfg.ingestors, cfg.taskSigningKey)
+		if err != nil {
+			return 0, 0, fmt.Errorf("couldn't verify key secrets: %w", err)
+		}
+		for _, r := range reports {
+			log.Info().Str("secret", r.SecretName).Str("schema", r.Schema.String()).Msgf("Secret %q uses schema %q", r.SecretName, r.Schema)
+			for _, p := range r.Problems {
+				log.Warn().Str("secret", r.SecretName).Msgf("Secret %q is inconsistent: %s", r.SecretName, p)
+			}
+			switch {
+			case len(r.Problems) > 0:
+				inconsistent++
+			case r.Outdated():
+				outdated++
+			}
+		}
+		return outdated, inconsistent, nil
+	}
+
+	outdated, inconsistent, err := verify()
+	if err != nil {
+		return err
+	}
+	if outdated > 0 && cfg.migrate {
+		migrated, err := storage.MigrateKubernetesKeys(ctx, cfg.secrets, cfg.prioEnvironment, cfg.locality, cfg.ingestors, cfg.taskSigningKey)
+		for _, name := range migrated {
+			log.Info().Str("secret", name).Msgf("Migrated secret %q to schema %q", name, storage.CurrentKeySecretSchema)
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't migrate key secrets: %w", err)
+		}
+		if outdated, inconsistent, err = verify(); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case inconsistent > 0:
+		return fmt.Errorf("%d key secrets are inconsistent", inconsistent)
+	case outdated > 0:
+		return fmt.Errorf("%d key secrets use an outdated schema (current schema is %q)", outdated, storage.CurrentKeySecretSchema)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	k8sapi "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// skipIngestorsConfigMapKey is the key, within the ConfigMap named by
+// --skip-ingestors-configmap, whose value is a comma-separated list of
+// ingestors to exclude from rotation.
+const skipIngestorsConfigMapKey = "skip-ingestors"
+
+var ingestorExcluded = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "key_rotator_ingestor_excluded",
+	Help: "Set to 1 if the ingestor was excluded from the most recent rotation by --skip-ingestors or --skip-ingestors-configmap, 0 otherwise.",
+}, []string{"locality", "ingestor"})
+
+// configMapGetter retrieves ConfigMaps. It is implemented by the Kubernetes
+// client's ConfigMapInterface.
+type configMapGetter interface {
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (*k8sapi.ConfigMap, error)
+}
+
+// ingestorExclusions determines which ingestors are temporarily excluded from
+// rotation, e.g. because their integration is misbehaving. Exclusions are
+// read from a fixed list and, optionally, from a ConfigMap, which is re-read
+// on each rotation so that exclusions can be changed without redeploying.
+type ingestorExclusions struct {
+	// Dependencies.
+	configMaps configMapGetter // may be nil if configMapName is empty
+
+	// Configuration.
+	locality      string   // the locality being rotated, used to label metrics
+	skipped       []string // ingestors excluded regardless of the ConfigMap
+	configMapName string   // the name of the ConfigMap listing further excluded ingestors; if empty, no ConfigMap is read
+}
+
+// apply returns ingestors, less any excluded ingestors, in order. Each
+// exclusion is logged, and the key_rotator_ingestor_excluded metric is
+// updated for every ingestor. A missing ConfigMap excludes no ingestors. It
+// is an error for every ingestor to be excluded, since rotating keys without
+// updating any manifest would leave manifests out of date.
+func (e ingestorExclusions) apply(ctx context.Context, ingestors []string) ([]string, error) {
+	skip := map[string]string{} // ingestor -> source of exclusion
+	for _, ingestor := range e.skipped {
+		skip[ingestor] = "--skip-ingestors"
+	}
+	if e.configMapName != "" {
+		cm, err := e.configMaps.Get(ctx, e.configMapName, metav1.GetOptions{})
+		switch {
+		case k8serrors.IsNotFound(err):
+			log.Debug().Msgf("ConfigMap %q not found; excluding no further ingestors", e.configMapName)
+		case err != nil:
+			return nil, fmt.Errorf("couldn't get ConfigMap %q: %w", e.configMapName, err)
+		default:
+			for _, ingestor := range strings.Split(cm.Data[skipIngestorsConfigMapKey], ",") {
+				if ingestor = strings.TrimSpace(ingestor); ingestor != "" {
+					skip[ingestor] = fmt.Sprintf("ConfigMap %q", e.configMapName)
+				}
+			}
+		}
+	}
+
+	var included []string
+	for _, ingestor := range ingestors {
+		source, ok := skip[ingestor]
+		if !ok {
+			ingestorExcluded.WithLabelValues(e.locality, ingestor).Set(0)
+			included = append(included, ingestor)
+			continue
+		}
+		delete(skip, ingestor)
+		ingestorExcluded.WithLabelValues(e.locality, ingestor).Set(1)
+		log.Warn().Str("ingestor", ingestor).Msgf("Ingestor %q is excluded from rotation by %s; its batch signing key & manifest will not be updated", ingestor, source)
+	}
+	for ingestor, source := range skip {
+		log.Warn().Str("ingestor", ingestor).Msgf("Ingestor %q is excluded by %s, but is not in --ingestors; ignoring", ingestor, source)
+	}
+	if len(included) == 0 && len(ingestors) > 0 {
+		return nil, fmt.Errorf("all ingestors (%s) are excluded from rotation", strings.Join(ingestors, ", "))
+	}
+	return included, nil
+}
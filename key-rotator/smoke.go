@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+	"github.com/abetterinternet/prio-server/key-rotator/manifest"
+	"github.com/abetterinternet/prio-server/key-rotator/storage"
+)
+
+// smokeTestCleanupTimeout bounds the time spent deleting the smoke test's
+// keys & manifests. Cleanup uses its own deadline so that it is attempted even
+// if the smoke test itself ran out of time.
+const smokeTestCleanupTimeout = 2 * time.Minute
+
+// smokeTestConfig configures an end-to-end smoke test of key rotation against
+// a throwaway locality in real key & manifest storage, as a check that the
+// credentials & infrastructure used by key-rotator work.
+type smokeTestConfig struct {
+	// Dependencies.
+	backupKeyStores []storage.Key               // keys written to rotate.keyStore must also be present in each of these
+	createKeys      func(context.Context) error // creates empty keys for the throwaway locality, as Terraform does for new localities
+
+	// Configuration.
+	rotate rotateKeysConfig // rotate.locality is the throwaway locality
+}
+
+// smokeTestLocalityPrefix prefixes the names of all throwaway localities.
+const smokeTestLocalityPrefix = "smoke-"
+
+// smokeTestLocality returns the name of a throwaway locality for a smoke test
+// of the given locality. The name is unique to the second, so a smoke test
+// does not collide with keys or manifests left behind by an earlier one.
+func smokeTestLocality(locality string, now time.Time) string {
+	return fmt.Sprintf("%s%s-%d", smokeTestLocalityPrefix, locality, now.Unix())
+}
+
+// createEmptyKeys writes empty keys for the given locality to the key store,
+// as Terraform does for new localities, for key stores whose secrets need not
+// be created before they are written.
+func createEmptyKeys(ctx context.Context, keyStore storage.Key, locality string, ingestors []string, taskSigningKey bool) error {
+	if err := keyStore.PutPacketEncryptionKey(ctx, locality, key.Key{}); err != nil {
+		return fmt.Errorf("couldn't create packet encryption key: %w", err)
+	}
+	for _, ingestor := range ingestors {
+		if err := keyStore.PutBatchSigningKey(ctx, locality, ingestor, key.Key{}); err != nil {
+			return fmt.Errorf("couldn't create batch signing key for %q: %w", ingestor, err)
+		}
+	}
+	if taskSigningKey {
+		if err := keyStore.PutTaskSigningKey(ctx, locality, key.Key{}); err != nil {
+			return fmt.Errorf("couldn't create task signing key: %w", err)
+		}
+	}
+	return nil
+}
+
+// smokeTestState is the state of the throwaway locality after a rotation.
+type smokeTestState struct {
+	packetEncryptionKey       key.Key
+	batchSigningKeyByIngestor map[string]key.Key
+	taskSigningKey            key.Key
+	manifestByIngestor        map[string]manifest.DataShareProcessorSpecificManifest
+}
+
+// smokeTest creates keys & manifests for the throwaway locality, then rotates
+// them three times: once to create the first key versions, once more at the
+// same time (which must change nothing), and once after new key versions are
+// due (which must change every key whose rotation is enabled). After each
+// rotation, every key must be non-empty & backed up, and every manifest must
+// match the keys. The throwaway locality's keys, manifests & rotation status
+// are deleted before returning, whether or not the smoke test succeeds.
+func smokeTest(ctx context.Context, cfg smokeTestConfig) (retErr error) {
+	locality := cfg.rotate.locality
+	log.Info().Msgf("Creating keys for smoke test locality %q", locality)
+	if err := cfg.createKeys(ctx); err != nil {
+		return fmt.Errorf("couldn't create keys for %q: %w", locality, err)
+	}
+	defer func() {
+		log.Info().Msgf("Deleting keys & manifests for smoke test locality %q", locality)
+		if err := cleanUpSmokeTest(cfg); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	// Write initial manifests, as --default-manifest-by-ingestor would
+	// provide for a newly-provisioned locality.
+	for _, ingestor := range cfg.rotate.ingestors {
+		if err := cfg.rotate.manifestStore.PutDataShareProcessorSpecificManifest(ctx, dspName(locality, ingestor), manifest.DataShareProcessorSpecificManifest{
+			Format:               1,
+			IngestionBucket:      fmt.Sprintf("%s-ingestion", dspName(locality, ingestor)),
+			PeerValidationBucket: fmt.Sprintf("%s-peer-validation", dspName(locality, ingestor)),
+		}); err != nil {
+			return fmt.Errorf("couldn't write initial manifest for (%q, %q): %w", locality, ingestor, err)
+		}
+	}
+
+	rotate := func(now time.Time) (smokeTestState, error) {
+		rotateCFG := cfg.rotate
+		rotateCFG.now = now
+		if err := rotateKeys(ctx, rotateCFG); err != nil {
+			return smokeTestState{}, fmt.Errorf("couldn't rotate keys: %w", err)
+		}
+		return verifySmokeTest(ctx, cfg)
+	}
+
+	log.Info().Msgf("Rotating keys for smoke test locality %q: creating keys", locality)
+	created, err := rotate(cfg.rotate.now)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Rotating keys for smoke test locality %q: verifying rotation is idempotent", locality)
+	unchanged, err := rotate(cfg.rotate.now)
+	if err != nil {
+		return err
+	}
+	if diffs := created.diffs(unchanged, cfg.rotate); len(diffs) > 0 {
+		return fmt.Errorf("repeated rotation changed keys or manifests: %q", diffs)
+	}
+
+	// Rotate once every key is due a new version, i.e. once its youngest
+	// version is older than its create min age.
+	createMinAge := cfg.rotate.batchCFG.rotationCFG.CreateMinAge
+	if age := cfg.rotate.packetCFG.rotationCFG.CreateMinAge; age > createMinAge {
+		createMinAge = age
+	}
+	if age := cfg.rotate.taskCFG.rotationCFG.CreateMinAge; cfg.rotate.manageTaskSigningKey && age > createMinAge {
+		createMinAge = age
+	}
+	log.Info().Msgf("Rotating keys for smoke test locality %q: creating new key versions", locality)
+	rotated, err := rotate(cfg.rotate.now.Add(createMinAge + time.Second))
+	if err != nil {
+		return err
+	}
+	var unrotated []string
+	if cfg.rotate.packetCFG.enableRotation && rotated.packetEncryptionKey.Equal(created.packetEncryptionKey) {
+		unrotated = append(unrotated, "packet encryption key")
+	}
+	for _, ingestor := range cfg.rotate.ingestors {
+		if cfg.rotate.batchCFG.enableRotation && rotated.batchSigningKeyByIngestor[ingestor].Equal(created.batchSigningKeyByIngestor[ingestor]) {
+			unrotated = append(unrotated, fmt.Sprintf("batch signing key for %q", ingestor))
+		}
+	}
+	if cfg.rotate.manageTaskSigningKey && rotated.taskSigningKey.Equal(created.taskSigningKey) {
+		unrotated = append(unrotated, "task signing key")
+	}
+	if len(unrotated) > 0 {
+		return fmt.Errorf("keys not rotated after %v: %q", createMinAge, unrotated)
+	}
+	return nil
+}
+
+// verifySmokeTest reads the throwaway locality's keys & manifests, and checks
+// that every key is non-empty & matches its backup (if any), and that every
+// manifest matches the keys.
+func verifySmokeTest(ctx context.Context, cfg smokeTestConfig) (smokeTestState, error) {
+	locality := cfg.rotate.locality
+	var s smokeTestState
+	var err error
+	s.packetEncryptionKey, s.batchSigningKeyByIngestor, s.manifestByIngestor, err =
+		readKeysAndManifests(ctx, cfg.rotate.keyStore, cfg.rotate.manifestStore, locality, cfg.rotate.ingestors)
+	if err != nil {
+		return smokeTestState{}, fmt.Errorf("couldn't read keys & manifests: %w", err)
+	}
+	if cfg.rotate.manageTaskSigningKey {
+		if s.taskSigningKey, err = cfg.rotate.keyStore.GetTaskSigningKey(ctx, locality); err != nil {
+			return smokeTestState{}, fmt.Errorf("couldn't get task signing key for %q: %w", locality, err)
+		}
+		if s.taskSigningKey.IsEmpty() {
+			return smokeTestState{}, fmt.Errorf("task signing key for %q has no versions", locality)
+		}
+	}
+	if s.packetEncryptionKey.IsEmpty() {
+		return smokeTestState{}, fmt.Errorf("packet encryption key for %q has no versions", locality)
+	}
+	for _, ingestor := range cfg.rotate.ingestors {
+		if s.batchSigningKeyByIngestor[ingestor].IsEmpty() {
+			return smokeTestState{}, fmt.Errorf("batch signing key for (%q, %q) has no versions", locality, ingestor)
+		}
+	}
+
+	// Verify backups.
+	for i, backupKeyStore := range cfg.backupKeyStores {
+		backup := smokeTestState{batchSigningKeyByIngestor: map[string]key.Key{}}
+		if backup.packetEncryptionKey, err = backupKeyStore.GetPacketEncryptionKey(ctx, locality); err != nil {
+			return smokeTestState{}, fmt.Errorf("couldn't get backup %d of packet encryption key for %q: %w", i, locality, err)
+		}
+		for _, ingestor := range cfg.rotate.ingestors {
+			if backup.batchSigningKeyByIngestor[ingestor], err = backupKeyStore.GetBatchSigningKey(ctx, locality, ingestor); err != nil {
+				return smokeTestState{}, fmt.Errorf("couldn't get backup %d of batch signing key for (%q, %q): %w", i, locality, ingestor, err)
+			}
+		}
+		if cfg.rotate.manageTaskSigningKey {
+			if backup.taskSigningKey, err = backupKeyStore.GetTaskSigningKey(ctx, locality); err != nil {
+				return smokeTestState{}, fmt.Errorf("couldn't get backup %d of task signing key for %q: %w", i, locality, err)
+			}
+		}
+		backup.manifestByIngestor = s.manifestByIngestor
+		if diffs := backup.diffs(s, cfg.rotate); len(diffs) > 0 {
+			return smokeTestState{}, fmt.Errorf("keys in backup %d differ: %q", i, diffs)
+		}
+	}
+
+	// Verify manifests. Updating a manifest which matches the keys, with
+	// pre- & post-update validations, must succeed and change nothing.
+	for _, ingestor := range cfg.rotate.ingestors {
+		m := s.manifestByIngestor[ingestor]
+		updateCFG := cfg.rotate.updateKeysConfig(ingestor, s.batchSigningKeyByIngestor[ingestor], s.packetEncryptionKey, s.taskSigningKey)
+		updateCFG.SkipPreUpdateValidations, updateCFG.SkipPostUpdateValidations = false, false
+		newM, err := m.UpdateKeys(updateCFG)
+		if err != nil {
+			return smokeTestState{}, fmt.Errorf("manifest for (%q, %q) does not match keys: %w", locality, ingestor, err)
+		}
+		if !newM.Equal(m) {
+			return smokeTestState{}, fmt.Errorf("manifest for (%q, %q) does not match keys: %s", locality, ingestor, newM.Diff(m))
+		}
+	}
+	return s, nil
+}
+
+// diffs returns a human-readable description of each difference between s &
+// o, the keys & manifests for the given rotation's ingestors.
+func (s smokeTestState) diffs(o smokeTestState, cfg rotateKeysConfig) []string {
+	var diffs []string
+	if diff := o.packetEncryptionKey.Diff(s.packetEncryptionKey); diff != "" {
+		diffs = append(diffs, fmt.Sprintf("packet encryption key: %s", diff))
+	}
+	if diff := o.taskSigningKey.Diff(s.taskSigningKey); diff != "" {
+		diffs = append(diffs, fmt.Sprintf("task signing key: %s", diff))
+	}
+	for _, ingestor := range cfg.ingestors {
+		if diff := o.batchSigningKeyByIngestor[ingestor].Diff(s.batchSigningKeyByIngestor[ingestor]); diff != "" {
+			diffs = append(diffs, fmt.Sprintf("batch signing key for %q: %s", ingestor, diff))
+		}
+		if diff := o.manifestByIngestor[ingestor].Diff(s.manifestByIngestor[ingestor]); diff != "" {
+			diffs = append(diffs, fmt.Sprintf("manifest for %q: %s", ingestor, diff))
+		}
+	}
+	return diffs
+}
+
+// cleanUpSmokeTest deletes the throwaway locality's keys (including backups),
+// manifests & rotation status. Every deletion is attempted, even if an earlier
+// one fails; all failures are logged, and the first is returned.
+func cleanUpSmokeTest(cfg smokeTestConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), smokeTestCleanupTimeout)
+	defer cancel()
+	locality := cfg.rotate.locality
+
+	var errs []error
+	if err := cfg.rotate.keyStore.DeleteKeys(ctx, locality, cfg.rotate.ingestors); err != nil {
+		errs = append(errs, fmt.Errorf("couldn't delete keys for %q: %w", locality, err))
+	}
+	for _, ingestor := range cfg.rotate.ingestors {
+		if err := cfg.rotate.manifestStore.DeleteDataShareProcessorSpecificManifest(ctx, dspName(locality, ingestor)); err != nil {
+			errs = append(errs, fmt.Errorf("couldn't delete manifest for (%q, %q): %w", locality, ingestor, err))
+		}
+	}
+	if err := cfg.rotate.manifestStore.DeleteRotationStatus(ctx, locality); err != nil {
+		errs = append(errs, fmt.Errorf("couldn't delete rotation status for %q: %w", locality, err))
+	}
+	for _, err := range errs {
+		log.Error().Err(err).Msgf("Couldn't clean up smoke test locality %q: %v", locality, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("couldn't clean up smoke test locality %q (%d failures): %w", locality, len(errs), errs[0])
+	}
+	return nil
+}
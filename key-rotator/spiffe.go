@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"google.golang.org/api/option"
+)
+
+// spiffeConfig configures authentication to cloud providers using JWT-SVIDs
+// issued by a SPIRE agent. The SVIDs are read from files, which are expected
+// to be kept up-to-date (e.g. by spiffe-helper) for as long as key-rotator
+// runs; they are re-read whenever credentials are refreshed.
+type spiffeConfig struct {
+	awsRoleARN     string // the AWS IAM role to assume using the AWS JWT-SVID
+	awsJWTSVIDPath string // path to a JWT-SVID whose audience is accepted by AWS STS
+
+	gcpWorkloadIdentityProvider string // the full resource name of the GCP workload identity pool provider
+	gcpJWTSVIDPath              string // path to a JWT-SVID whose audience is accepted by the workload identity pool provider
+	gcpServiceAccount           string // if set, the email of a GCP service account to impersonate
+}
+
+func (c spiffeConfig) validate() error {
+	if (c.awsRoleARN == "") != (c.awsJWTSVIDPath == "") {
+		return errors.New("--spiffe-aws-role-arn and --spiffe-aws-jwt-svid-path must be specified together")
+	}
+	if (c.gcpWorkloadIdentityProvider == "") != (c.gcpJWTSVIDPath == "") {
+		return errors.New("--spiffe-gcp-workload-identity-provider and --spiffe-gcp-jwt-svid-path must be specified together")
+	}
+	if c.gcpServiceAccount != "" && c.gcpWorkloadIdentityProvider == "" {
+		return errors.New("--spiffe-gcp-service-account requires --spiffe-gcp-workload-identity-provider")
+	}
+	return nil
+}
+
+// awsCredentials returns AWS credentials obtained by assuming the configured
+// role with the AWS JWT-SVID as a web identity token, or nil if SPIFFE
+// authentication to AWS is not configured. cp is used to make requests to STS.
+func (c spiffeConfig) awsCredentials(cp client.ConfigProvider, sessionName string) *credentials.Credentials {
+	if c.awsRoleARN == "" {
+		return nil
+	}
+	return stscreds.NewWebIdentityCredentials(cp, c.awsRoleARN, sessionName, c.awsJWTSVIDPath)
+}
+
+// gcpClientOptions returns GCP client options which authenticate via workload
+// identity federation using the GCP JWT-SVID, or no options if SPIFFE
+// authentication to GCP is not configured.
+func (c spiffeConfig) gcpClientOptions() ([]option.ClientOption, error) {
+	if c.gcpWorkloadIdentityProvider == "" {
+		return nil, nil
+	}
+	credsJSON, err := c.gcpExternalAccountJSON()
+	if err != nil {
+		return nil, err
+	}
+	return []option.ClientOption{option.WithCredentialsJSON(credsJSON)}, nil
+}
+
+// gcpExternalAccountJSON returns an "external_account" credential
+// configuration, as would be generated by `gcloud iam workload-identity-pools
+// create-cred-config`, which reads the GCP JWT-SVID from its file.
+func (c spiffeConfig) gcpExternalAccountJSON() ([]byte, error) {
+	type credentialSource struct {
+		File string `json:"file"`
+	}
+	type externalAccount struct {
+		Type                           string           `json:"type"`
+		Audience                       string           `json:"audience"`
+		SubjectTokenType               string           `json:"subject_token_type"`
+		TokenURL                       string           `json:"token_url"`
+		CredentialSource               credentialSource `json:"credential_source"`
+		ServiceAccountImpersonationURL string           `json:"service_account_impersonation_url,omitempty"`
+	}
+
+	ea := externalAccount{
+		Type:             "external_account",
+		Audience:         fmt.Sprintf("//iam.googleapis.com/%s", c.gcpWorkloadIdentityProvider),
+		SubjectTokenType: "urn:ietf:params:oauth:token-type:jwt",
+		TokenURL:         "https://sts.googleapis.com/v1/token",
+		CredentialSource: credentialSource{File: c.gcpJWTSVIDPath},
+	}
+	if c.gcpServiceAccount != "" {
+		ea.ServiceAccountImpersonationURL = fmt.Sprintf(
+			"https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken", c.gcpServiceAccount)
+	}
+	credsJSON, err := json.Marshal(ea)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't marshal GCP external account credentials as JSON: %w", err)
+	}
+	return credsJSON, nil
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/rs/zerolog/log"
+
 	"github.com/abetterinternet/prio-server/key-rotator/key"
 )
 
@@ -25,6 +27,83 @@ type Key interface {
 	// GetPacketEncryptionKey gets the packet encryption key for the given
 	// locality, or returns an error on failure.
 	GetPacketEncryptionKey(ctx context.Context, locality string) (key.Key, error)
+
+	// PutTaskSigningKey writes the provided key as the task signing key for
+	// the given locality, or returns an error on failure.
+	PutTaskSigningKey(ctx context.Context, locality string, key key.Key) error
+
+	// GetTaskSigningKey gets the task signing key for the given locality, or
+	// returns an error on failure.
+	GetTaskSigningKey(ctx context.Context, locality string) (key.Key, error)
+
+	// DeleteKeys deletes the packet encryption & task signing keys for the
+	// given locality, and the batch signing keys for the given (locality,
+	// ingestor) pairs, or returns an error on failure. Keys which do not
+	// exist are ignored.
+	DeleteKeys(ctx context.Context, locality string, ingestors []string) error
+}
+
+// WriteMode determines which writes to the mirrors of a composite Key must
+// succeed for a write to the composite Key to succeed.
+type WriteMode int
+
+const (
+	// WriteAll requires every write to every mirror to succeed.
+	WriteAll WriteMode = iota
+	// WriteQuorum requires writes to a majority of the stores, counting the
+	// primary, to succeed.
+	WriteQuorum
+	// WriteBestEffort tolerates the failure of any write to a mirror; such
+	// failures are logged.
+	WriteBestEffort
+)
+
+// ParseWriteMode parses a WriteMode from one of "all", "quorum", or
+// "best-effort".
+func ParseWriteMode(s string) (WriteMode, error) {
+	switch s {
+	case "all":
+		return WriteAll, nil
+	case "quorum":
+		return WriteQuorum, nil
+	case "best-effort":
+		return WriteBestEffort, nil
+	}
+	return 0, fmt.Errorf("unknown write mode %q (must be one of 'all', 'quorum', or 'best-effort')", s)
+}
+
+func (m WriteMode) String() string {
+	switch m {
+	case WriteAll:
+		return "all"
+	case WriteQuorum:
+		return "quorum"
+	case WriteBestEffort:
+		return "best-effort"
+	}
+	return fmt.Sprintf("WriteMode(%d)", int(m))
+}
+
+// CompositeKeyConfig configures a composite Key.
+type CompositeKeyConfig struct {
+	// WriteMode determines which writes to mirrors must succeed.
+	WriteMode WriteMode
+	// ReadFallback, if set, causes a read which fails against the primary
+	// storage.Key to be retried against each mirror in turn, in the order the
+	// mirrors were given. Otherwise, mirrors are never used to fulfill a read.
+	ReadFallback bool
+}
+
+// NewCompositeKey returns a Key implementation that mirrors writes from a
+// "primary" storage.Key to each of the given "mirror" storage.Keys. To avoid
+// the possibility of writing a key to primary storage without mirroring it,
+// writes are performed by writing to the mirrors first, followed by writing to
+// the primary storage, which must always succeed. Writes to the primary are
+// not attempted unless the writes to the mirrors succeed as required by
+// cfg.WriteMode. Reads are performed via the primary storage, falling back to
+// the mirrors if cfg.ReadFallback is set.
+func NewCompositeKey(primary Key, mirrors []Key, cfg CompositeKeyConfig) Key {
+	return compositeKey{primary, mirrors, cfg}
 }
 
 // NewBackupKey returns a Key implementation that mirrors writes to a "backup"
@@ -33,38 +112,204 @@ type Key interface {
 // possiblity of writing a key to main storage without backing it up, writes
 // are performed by writing to the "backup" storage first, followed by writing
 // to the "main" storage.
-func NewBackupKey(main, backup Key) Key { return backupKey{main, backup} }
+func NewBackupKey(main, backup Key) Key {
+	return NewCompositeKey(main, []Key{backup}, CompositeKeyConfig{WriteMode: WriteAll})
+}
+
+type compositeKey struct {
+	primary Key
+	mirrors []Key
+	cfg     CompositeKeyConfig
+}
+
+var _ Key = compositeKey{} // verify compositeKey satisfies Key
+
+func (k compositeKey) PutBatchSigningKey(ctx context.Context, locality, ingestor string, key key.Key) error {
+	return k.write("write to", func(s Key) error { return s.PutBatchSigningKey(ctx, locality, ingestor, key) })
+}
+
+func (k compositeKey) PutPacketEncryptionKey(ctx context.Context, locality string, key key.Key) error {
+	return k.write("write to", func(s Key) error { return s.PutPacketEncryptionKey(ctx, locality, key) })
+}
+
+func (k compositeKey) PutTaskSigningKey(ctx context.Context, locality string, key key.Key) error {
+	return k.write("write to", func(s Key) error { return s.PutTaskSigningKey(ctx, locality, key) })
+}
+
+func (k compositeKey) GetBatchSigningKey(ctx context.Context, locality, ingestor string) (key.Key, error) {
+	return k.read(func(s Key) (key.Key, error) { return s.GetBatchSigningKey(ctx, locality, ingestor) })
+}
+
+func (k compositeKey) GetPacketEncryptionKey(ctx context.Context, locality string) (key.Key, error) {
+	return k.read(func(s Key) (key.Key, error) { return s.GetPacketEncryptionKey(ctx, locality) })
+}
+
+func (k compositeKey) GetTaskSigningKey(ctx context.Context, locality string) (key.Key, error) {
+	return k.read(func(s Key) (key.Key, error) { return s.GetTaskSigningKey(ctx, locality) })
+}
+
+// DeleteKeys deletes keys from primary storage first, so that a key is never
+// present in primary storage without also being present in the mirrors.
+// Deletions from the mirrors must succeed as required by the write mode.
+func (k compositeKey) DeleteKeys(ctx context.Context, locality string, ingestors []string) error {
+	if err := k.primary.DeleteKeys(ctx, locality, ingestors); err != nil {
+		return fmt.Errorf("couldn't delete from primary storage: %w", err)
+	}
+	return k.mirror("delete from", func(s Key) error { return s.DeleteKeys(ctx, locality, ingestors) })
+}
 
-type backupKey struct{ main, backup Key }
+// write performs the given write against the mirrors, then against primary
+// storage. op describes the write, for use in error messages.
+func (k compositeKey) write(op string, write func(Key) error) error {
+	if err := k.mirror(op, write); err != nil {
+		return err
+	}
+	if err := write(k.primary); err != nil {
+		return fmt.Errorf("couldn't %s primary storage: %w", op, err)
+	}
+	return nil
+}
+
+// mirror performs the given write against each mirror, returning an error if
+// the writes which fail are not tolerated by the write mode. op describes the
+// write, for use in error messages.
+func (k compositeKey) mirror(op string, write func(Key) error) error {
+	var firstErr error
+	failures := 0
+	for i, m := range k.mirrors {
+		err := write(m)
+		if err == nil {
+			continue
+		}
+		if k.cfg.WriteMode == WriteAll {
+			return fmt.Errorf("couldn't %s mirror storage %d: %w", op, i, err)
+		}
+		log.Warn().Err(err).Msgf("Couldn't %s mirror storage %d (write mode %q): %v", op, i, k.cfg.WriteMode, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+		failures++
+	}
+
+	// The quorum is a majority of all stores, counting the primary, whose
+	// write must succeed regardless.
+	stores := 1 + len(k.mirrors)
+	if k.cfg.WriteMode == WriteQuorum && stores-failures < stores/2+1 {
+		return fmt.Errorf("couldn't %s a quorum of storage: %d of %d mirrors failed, first with: %w", op, failures, len(k.mirrors), firstErr)
+	}
+	return nil
+}
+
+// read performs the given read against primary storage, then, if it fails and
+// read fallback is enabled, against each mirror in turn until one succeeds.
+func (k compositeKey) read(read func(Key) (key.Key, error)) (key.Key, error) {
+	got, err := read(k.primary)
+	if err == nil || !k.cfg.ReadFallback || len(k.mirrors) == 0 {
+		return got, err
+	}
+	log.Warn().Err(err).Msgf("Couldn't read from primary storage, falling back to mirror storage: %v", err)
+	for i, m := range k.mirrors {
+		got, mirrorErr := read(m)
+		if mirrorErr == nil {
+			return got, nil
+		}
+		log.Warn().Err(mirrorErr).Msgf("Couldn't read from mirror storage %d: %v", i, mirrorErr)
+	}
+	return key.Key{}, fmt.Errorf("couldn't read from primary or mirror storage: %w", err)
+}
+
+// NewMigratingKey returns a Key implementation for migrating keys from the
+// "from" storage.Key to the "to" storage.Key. Reads are performed via "to",
+// falling back to "from" if the read fails or finds an empty key, as it will
+// for keys not yet migrated. Writes are performed against both, first "from"
+// and then "to", both of which must succeed, so that "to" never holds a key
+// which "from" lacks & the migration may be abandoned at any point. Deletions
+// are performed against "to" first, for the same reason.
+func NewMigratingKey(to, from Key) Key {
+	return migratingKey{to, from}
+}
+
+type migratingKey struct {
+	to, from Key
+}
 
-var _ Key = backupKey{} // verify backupKey satisfies Key
+var _ Key = migratingKey{} // verify migratingKey satisfies Key
 
-func (k backupKey) PutBatchSigningKey(ctx context.Context, locality, ingestor string, key key.Key) error {
-	if err := k.backup.PutBatchSigningKey(ctx, locality, ingestor, key); err != nil {
-		return fmt.Errorf("couldn't write to backup storage: %w", err)
+func (k migratingKey) PutBatchSigningKey(ctx context.Context, locality, ingestor string, key key.Key) error {
+	return k.write("write to", func(s Key) error { return s.PutBatchSigningKey(ctx, locality, ingestor, key) })
+}
+
+func (k migratingKey) PutPacketEncryptionKey(ctx context.Context, locality string, key key.Key) error {
+	return k.write("write to", func(s Key) error { return s.PutPacketEncryptionKey(ctx, locality, key) })
+}
+
+func (k migratingKey) PutTaskSigningKey(ctx context.Context, locality string, key key.Key) error {
+	return k.write("write to", func(s Key) error { return s.PutTaskSigningKey(ctx, locality, key) })
+}
+
+func (k migratingKey) GetBatchSigningKey(ctx context.Context, locality, ingestor string) (key.Key, error) {
+	return k.read(func(s Key) (key.Key, error) { return s.GetBatchSigningKey(ctx, locality, ingestor) })
+}
+
+func (k migratingKey) GetPacketEncryptionKey(ctx context.Context, locality string) (key.Key, error) {
+	return k.read(func(s Key) (key.Key, error) { return s.GetPacketEncryptionKey(ctx, locality) })
+}
+
+func (k migratingKey) GetTaskSigningKey(ctx context.Context, locality string) (key.Key, error) {
+	return k.read(func(s Key) (key.Key, error) { return s.GetTaskSigningKey(ctx, locality) })
+}
+
+func (k migratingKey) DeleteKeys(ctx context.Context, locality string, ingestors []string) error {
+	if err := k.to.DeleteKeys(ctx, locality, ingestors); err != nil {
+		return fmt.Errorf("couldn't delete from migration target storage: %w", err)
 	}
-	if err := k.main.PutBatchSigningKey(ctx, locality, ingestor, key); err != nil {
-		return fmt.Errorf("couldn't write to main storage: %w", err)
+	if err := k.from.DeleteKeys(ctx, locality, ingestors); err != nil {
+		return fmt.Errorf("couldn't delete from migration source storage: %w", err)
 	}
 	return nil
 }
 
-func (k backupKey) PutPacketEncryptionKey(ctx context.Context, locality string, key key.Key) error {
-	if err := k.backup.PutPacketEncryptionKey(ctx, locality, key); err != nil {
-		return fmt.Errorf("couldn't write to backup storage: %w", err)
+// write performs the given write against the migration source, then against
+// the migration target. op describes the write, for use in error messages.
+func (k migratingKey) write(op string, write func(Key) error) error {
+	if err := write(k.from); err != nil {
+		return fmt.Errorf("couldn't %s migration source storage: %w", op, err)
 	}
-	if err := k.main.PutPacketEncryptionKey(ctx, locality, key); err != nil {
-		return fmt.Errorf("couldn't write to main storage: %w", err)
+	if err := write(k.to); err != nil {
+		return fmt.Errorf("couldn't %s migration target storage: %w", op, err)
 	}
 	return nil
 }
 
-func (k backupKey) GetBatchSigningKey(ctx context.Context, locality, ingestor string) (key.Key, error) {
-	return k.main.GetBatchSigningKey(ctx, locality, ingestor)
+// read performs the given read against the migration target, then, if it
+// fails or finds an empty key, against the migration source.
+func (k migratingKey) read(read func(Key) (key.Key, error)) (key.Key, error) {
+	got, err := read(k.to)
+	if err == nil && !got.IsEmpty() {
+		return got, nil
+	}
+	if err != nil {
+		log.Debug().Err(err).Msgf("Couldn't read from migration target storage, falling back to migration source storage: %v", err)
+	}
+	got, fromErr := read(k.from)
+	if fromErr != nil {
+		if err != nil {
+			return key.Key{}, fmt.Errorf("couldn't read from migration target storage (%v) or migration source storage: %w", err, fromErr)
+		}
+		return key.Key{}, fmt.Errorf("couldn't read from migration source storage: %w", fromErr)
+	}
+	return got, nil
 }
 
-func (k backupKey) GetPacketEncryptionKey(ctx context.Context, locality string) (key.Key, error) {
-	return k.main.GetPacketEncryptionKey(ctx, locality)
+// keyNames returns the names of the packet encryption & task signing keys for
+// the given locality, and of the batch signing keys for the given (locality,
+// ingestor) pairs.
+func keyNames(env, locality string, ingestors []string) []string {
+	names := []string{packetEncryptionKeyName(env, locality), taskSigningKeyName(env, locality)}
+	for _, ingestor := range ingestors {
+		names = append(names, batchSigningKeyName(env, locality, ingestor))
+	}
+	return names
 }
 
 func batchSigningKeyName(env, locality, ingestor string) string {
@@ -74,3 +319,7 @@ func batchSigningKeyName(env, locality, ingestor string) string {
 func packetEncryptionKeyName(env, locality string) string {
 	return fmt.Sprintf("%s-%s-ingestion-packet-decryption-key", env, locality)
 }
+
+func taskSigningKeyName(env, locality string) string {
+	return fmt.Sprintf("%s-%s-task-signing-key", env, locality)
+}
@@ -3,7 +3,9 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -17,12 +19,17 @@ import (
 // NewAWSKey returns a Key implementation using the AWS secret manager for
 // backing storage. This key store writes keys in a way that is suitable for
 // backup; keys written by this store cannot be read by other components of the
-// Prio system (e.g. the facilitator).
-func NewAWSKey(sm *secretsmanager.SecretsManager, prioEnv string) Key { return awsKey{sm, prioEnv} }
+// Prio system (e.g. the facilitator). If replicaRegions is non-empty, secrets
+// are replicated to each of the given regions, and each write fails unless
+// every replica exists & has not failed.
+func NewAWSKey(sm *secretsmanager.SecretsManager, prioEnv string, replicaRegions []string) Key {
+	return awsKey{sm, prioEnv, replicaRegions}
+}
 
 type awsKey struct {
-	sm  awsSecretManager
-	env string
+	sm             awsSecretManager
+	env            string
+	replicaRegions []string
 }
 
 var _ Key = awsKey{} // verify awsKey satisfies Key
@@ -32,8 +39,12 @@ var _ Key = awsKey{} // verify awsKey satisfies Key
 // exists to enable testability.
 type awsSecretManager interface {
 	CreateSecretWithContext(context.Context, *secretsmanager.CreateSecretInput, ...request.Option) (*secretsmanager.CreateSecretOutput, error)
+	DescribeSecretWithContext(context.Context, *secretsmanager.DescribeSecretInput, ...request.Option) (*secretsmanager.DescribeSecretOutput, error)
 	GetSecretValueWithContext(context.Context, *secretsmanager.GetSecretValueInput, ...request.Option) (*secretsmanager.GetSecretValueOutput, error)
+	DeleteSecretWithContext(context.Context, *secretsmanager.DeleteSecretInput, ...request.Option) (*secretsmanager.DeleteSecretOutput, error)
 	PutSecretValueWithContext(context.Context, *secretsmanager.PutSecretValueInput, ...request.Option) (*secretsmanager.PutSecretValueOutput, error)
+	RemoveRegionsFromReplicationWithContext(context.Context, *secretsmanager.RemoveRegionsFromReplicationInput, ...request.Option) (*secretsmanager.RemoveRegionsFromReplicationOutput, error)
+	ReplicateSecretToRegionsWithContext(context.Context, *secretsmanager.ReplicateSecretToRegionsInput, ...request.Option) (*secretsmanager.ReplicateSecretToRegionsOutput, error)
 }
 
 // verify awsSecretManager is satisfied by the expected production implementation
@@ -47,6 +58,10 @@ func (k awsKey) PutPacketEncryptionKey(ctx context.Context, locality string, key
 	return k.putKey(ctx, "packet-encryption", packetEncryptionKeyName(k.env, locality), key)
 }
 
+func (k awsKey) PutTaskSigningKey(ctx context.Context, locality string, key key.Key) error {
+	return k.putKey(ctx, "task-signing", taskSigningKeyName(k.env, locality), key)
+}
+
 func (k awsKey) putKey(ctx context.Context, secretKind, secretName string, key key.Key) error {
 	log.Info().
 		Str("storage", "aws").
@@ -62,7 +77,8 @@ func (k awsKey) putKey(ctx context.Context, secretKind, secretName string, key k
 
 	// Create the AWS secret, if it doesn't already exist.
 	if _, err := k.sm.CreateSecretWithContext(ctx, &secretsmanager.CreateSecretInput{
-		Name: aws.String(secretName),
+		Name:              aws.String(secretName),
+		AddReplicaRegions: replicaRegionTypes(k.replicaRegions),
 	}); err != nil {
 		// If the secret already exists, CreateSecret will return a ResourceExistsException.
 		// Treat this error case as acceptable, and fail out on any other errors.
@@ -78,9 +94,86 @@ func (k awsKey) putKey(ctx context.Context, secretKind, secretName string, key k
 	}); err != nil {
 		return fmt.Errorf("couldn't add AWS secret version: %w", err)
 	}
+
+	// Verify the secret is replicated to each replica region. Secrets created
+	// before replica regions were configured are replicated now.
+	if err := k.ensureReplicas(ctx, secretName); err != nil {
+		return fmt.Errorf("couldn't replicate AWS secret: %w", err)
+	}
+	return nil
+}
+
+// ensureReplicas replicates the secret to any replica regions it is not yet
+// replicated to, then verifies that a replica exists in each replica region,
+// and that replication to it has not failed. Replication is asynchronous, so
+// replicas which are still being brought in sync are accepted.
+func (k awsKey) ensureReplicas(ctx context.Context, secretName string) error {
+	if len(k.replicaRegions) == 0 {
+		return nil
+	}
+	statuses, err := k.replicationStatuses(ctx, secretName)
+	if err != nil {
+		return err
+	}
+	var missingRegions []string
+	for _, region := range k.replicaRegions {
+		if _, ok := statuses[region]; !ok {
+			missingRegions = append(missingRegions, region)
+		}
+	}
+	if len(missingRegions) > 0 {
+		log.Info().
+			Str("storage", "aws").
+			Str("secret", secretName).
+			Strs("regions", missingRegions).
+			Msgf("Replicating secret %q to regions %q", secretName, missingRegions)
+		if _, err := k.sm.ReplicateSecretToRegionsWithContext(ctx, &secretsmanager.ReplicateSecretToRegionsInput{
+			SecretId:          aws.String(secretName),
+			AddReplicaRegions: replicaRegionTypes(missingRegions),
+		}); err != nil {
+			return fmt.Errorf("couldn't replicate secret %q to regions %q: %w", secretName, missingRegions, err)
+		}
+		if statuses, err = k.replicationStatuses(ctx, secretName); err != nil {
+			return err
+		}
+	}
+
+	for _, region := range k.replicaRegions {
+		status, ok := statuses[region]
+		switch {
+		case !ok:
+			return fmt.Errorf("secret %q has no replica in region %q", secretName, region)
+		case aws.StringValue(status.Status) == secretsmanager.StatusTypeFailed:
+			return fmt.Errorf("replication of secret %q to region %q failed: %s", secretName, region, aws.StringValue(status.StatusMessage))
+		}
+	}
 	return nil
 }
 
+// replicationStatuses returns the replication status of the secret, keyed by
+// replica region.
+func (k awsKey) replicationStatuses(ctx context.Context, secretName string) (map[string]*secretsmanager.ReplicationStatusType, error) {
+	out, err := k.sm.DescribeSecretWithContext(ctx, &secretsmanager.DescribeSecretInput{
+		SecretId: aws.String(secretName),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't describe secret %q: %w", secretName, err)
+	}
+	statuses := map[string]*secretsmanager.ReplicationStatusType{}
+	for _, status := range out.ReplicationStatus {
+		statuses[aws.StringValue(status.Region)] = status
+	}
+	return statuses, nil
+}
+
+func replicaRegionTypes(regions []string) []*secretsmanager.ReplicaRegionType {
+	var rrts []*secretsmanager.ReplicaRegionType
+	for _, region := range regions {
+		rrts = append(rrts, &secretsmanager.ReplicaRegionType{Region: aws.String(region)})
+	}
+	return rrts
+}
+
 func (k awsKey) GetBatchSigningKey(ctx context.Context, locality, ingestor string) (key.Key, error) {
 	return k.getKey(ctx, batchSigningKeyName(k.env, locality, ingestor))
 }
@@ -89,6 +182,10 @@ func (k awsKey) GetPacketEncryptionKey(ctx context.Context, locality string) (ke
 	return k.getKey(ctx, packetEncryptionKeyName(k.env, locality))
 }
 
+func (k awsKey) GetTaskSigningKey(ctx context.Context, locality string) (key.Key, error) {
+	return k.getKey(ctx, taskSigningKeyName(k.env, locality))
+}
+
 func (k awsKey) getKey(ctx context.Context, secretName string) (key.Key, error) {
 	out, err := k.sm.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
 		SecretId: aws.String(secretName),
@@ -103,3 +200,55 @@ func (k awsKey) getKey(ctx context.Context, secretName string) (key.Key, error)
 	}
 	return secretKey, nil
 }
+
+func (k awsKey) DeleteKeys(ctx context.Context, locality string, ingestors []string) error {
+	for _, secretName := range keyNames(k.env, locality, ingestors) {
+		if err := k.deleteSecret(ctx, secretName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSecret deletes the secret immediately, without a recovery window. A
+// secret which does not exist is ignored.
+func (k awsKey) deleteSecret(ctx context.Context, secretName string) error {
+	statuses, err := k.replicationStatuses(ctx, secretName)
+	if err != nil {
+		if isAWSResourceNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	log.Info().
+		Str("storage", "aws").
+		Str("secret", secretName).
+		Msgf("Deleting secret %q", secretName)
+
+	// A secret can't be deleted while it has replicas, so remove them first.
+	if len(statuses) > 0 {
+		var regions []string
+		for region := range statuses {
+			regions = append(regions, region)
+		}
+		sort.Strings(regions)
+		if _, err := k.sm.RemoveRegionsFromReplicationWithContext(ctx, &secretsmanager.RemoveRegionsFromReplicationInput{
+			SecretId:             aws.String(secretName),
+			RemoveReplicaRegions: aws.StringSlice(regions),
+		}); err != nil {
+			return fmt.Errorf("couldn't remove replicas of secret %q from regions %q: %w", secretName, regions, err)
+		}
+	}
+	if _, err := k.sm.DeleteSecretWithContext(ctx, &secretsmanager.DeleteSecretInput{
+		SecretId:                   aws.String(secretName),
+		ForceDeleteWithoutRecovery: aws.Bool(true),
+	}); err != nil && !isAWSResourceNotFound(err) {
+		return fmt.Errorf("couldn't delete secret %q: %w", secretName, err)
+	}
+	return nil
+}
+
+func isAWSResourceNotFound(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == secretsmanager.ErrCodeResourceNotFoundException
+}
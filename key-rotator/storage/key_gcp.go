@@ -18,15 +18,20 @@ import (
 // NewGCPKey returns a Key implementation using the GCP secret manager for
 // backing storage. This key store writes keys in a way that is suitable for
 // backup; keys written by this store cannot be read by other components of the
-// Prio system (e.g. the facilitator).
-func NewGCPKey(sm *secretmanager.Client, prioEnv, gcpProjectID string) Key {
-	return gcpKey{sm, prioEnv, gcpProjectID}
+// Prio system (e.g. the facilitator). If replicaLocations is non-empty, secrets
+// are created with a user-managed replication policy replicating them to
+// exactly the given locations, and each write fails unless the secret's
+// replication policy includes every location; otherwise, secrets are created
+// with an automatic replication policy.
+func NewGCPKey(sm *secretmanager.Client, prioEnv, gcpProjectID string, replicaLocations []string) Key {
+	return gcpKey{sm, prioEnv, gcpProjectID, replicaLocations}
 }
 
 type gcpKey struct {
-	sm           gcpSecretManager
-	env          string
-	gcpProjectID string
+	sm               gcpSecretManager
+	env              string
+	gcpProjectID     string
+	replicaLocations []string
 }
 
 var _ Key = gcpKey{} // verify gcpKey satisfies Key
@@ -38,6 +43,8 @@ type gcpSecretManager interface {
 	AccessSecretVersion(context.Context, *smpb.AccessSecretVersionRequest, ...gax.CallOption) (*smpb.AccessSecretVersionResponse, error)
 	AddSecretVersion(context.Context, *smpb.AddSecretVersionRequest, ...gax.CallOption) (*smpb.SecretVersion, error)
 	CreateSecret(context.Context, *smpb.CreateSecretRequest, ...gax.CallOption) (*smpb.Secret, error)
+	DeleteSecret(context.Context, *smpb.DeleteSecretRequest, ...gax.CallOption) error
+	GetSecret(context.Context, *smpb.GetSecretRequest, ...gax.CallOption) (*smpb.Secret, error)
 }
 
 // verify gcpSecretManager is satisfied by the expected production implementation
@@ -51,6 +58,10 @@ func (k gcpKey) PutPacketEncryptionKey(ctx context.Context, locality string, key
 	return k.putKey(ctx, "packet-encryption", packetEncryptionKeyName(k.env, locality), key)
 }
 
+func (k gcpKey) PutTaskSigningKey(ctx context.Context, locality string, key key.Key) error {
+	return k.putKey(ctx, "task-signing", taskSigningKeyName(k.env, locality), key)
+}
+
 func (k gcpKey) putKey(ctx context.Context, secretKind, secretName string, key key.Key) error {
 	log.Info().
 		Str("storage", "gcp").
@@ -68,11 +79,7 @@ func (k gcpKey) putKey(ctx context.Context, secretKind, secretName string, key k
 	if _, err := k.sm.CreateSecret(ctx, &smpb.CreateSecretRequest{
 		Parent:   fmt.Sprintf("projects/%s", k.gcpProjectID),
 		SecretId: secretName,
-		Secret: &smpb.Secret{
-			Replication: &smpb.Replication{
-				Replication: &smpb.Replication_Automatic_{Automatic: &smpb.Replication_Automatic{}},
-			},
-		},
+		Secret:   &smpb.Secret{Replication: k.replication()},
 	}); err != nil {
 		if s, ok := status.FromError(err); !ok || s.Code() != codes.AlreadyExists {
 			return fmt.Errorf("couldn't create GCP secret: %w", err)
@@ -86,6 +93,54 @@ func (k gcpKey) putKey(ctx context.Context, secretKind, secretName string, key k
 	}); err != nil {
 		return fmt.Errorf("couldn't add GCP secret version: %w", err)
 	}
+
+	// Verify the secret is replicated to each replica location.
+	if err := k.verifyReplicas(ctx, secretName); err != nil {
+		return fmt.Errorf("couldn't verify GCP secret replication: %w", err)
+	}
+	return nil
+}
+
+// replication returns the replication policy with which new secrets are
+// created.
+func (k gcpKey) replication() *smpb.Replication {
+	if len(k.replicaLocations) == 0 {
+		return &smpb.Replication{
+			Replication: &smpb.Replication_Automatic_{Automatic: &smpb.Replication_Automatic{}},
+		}
+	}
+	var replicas []*smpb.Replication_UserManaged_Replica
+	for _, location := range k.replicaLocations {
+		replicas = append(replicas, &smpb.Replication_UserManaged_Replica{Location: location})
+	}
+	return &smpb.Replication{
+		Replication: &smpb.Replication_UserManaged_{UserManaged: &smpb.Replication_UserManaged{Replicas: replicas}},
+	}
+}
+
+// verifyReplicas verifies that the secret's replication policy replicates it
+// to each replica location. A secret's replication policy can't be changed
+// after creation, so secrets created with a different policy (e.g. before
+// replica locations were configured) must be recreated by an operator.
+func (k gcpKey) verifyReplicas(ctx context.Context, secretName string) error {
+	if len(k.replicaLocations) == 0 {
+		return nil
+	}
+	secret, err := k.sm.GetSecret(ctx, &smpb.GetSecretRequest{
+		Name: fmt.Sprintf("projects/%s/secrets/%s", k.gcpProjectID, secretName),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't get secret %q: %w", secretName, err)
+	}
+	locations := map[string]bool{}
+	for _, replica := range secret.GetReplication().GetUserManaged().GetReplicas() {
+		locations[replica.GetLocation()] = true
+	}
+	for _, location := range k.replicaLocations {
+		if !locations[location] {
+			return fmt.Errorf("secret %q is not replicated to location %q (replication policy: %v); its replication policy can't be changed, so it must be recreated", secretName, location, secret.GetReplication())
+		}
+	}
 	return nil
 }
 
@@ -97,6 +152,10 @@ func (k gcpKey) GetPacketEncryptionKey(ctx context.Context, locality string) (ke
 	return k.getKey(ctx, packetEncryptionKeyName(k.env, locality))
 }
 
+func (k gcpKey) GetTaskSigningKey(ctx context.Context, locality string) (key.Key, error) {
+	return k.getKey(ctx, taskSigningKeyName(k.env, locality))
+}
+
 func (k gcpKey) getKey(ctx context.Context, secretName string) (key.Key, error) {
 	sv, err := k.sm.AccessSecretVersion(ctx, &smpb.AccessSecretVersionRequest{
 		Name: fmt.Sprintf("projects/%s/secrets/%s/versions/latest", k.gcpProjectID, secretName),
@@ -111,3 +170,20 @@ func (k gcpKey) getKey(ctx context.Context, secretName string) (key.Key, error)
 	}
 	return secretKey, nil
 }
+
+func (k gcpKey) DeleteKeys(ctx context.Context, locality string, ingestors []string) error {
+	for _, secretName := range keyNames(k.env, locality, ingestors) {
+		log.Info().
+			Str("storage", "gcp").
+			Str("secret", secretName).
+			Msgf("Deleting secret %q", secretName)
+		if err := k.sm.DeleteSecret(ctx, &smpb.DeleteSecretRequest{
+			Name: fmt.Sprintf("projects/%s/secrets/%s", k.gcpProjectID, secretName),
+		}); err != nil {
+			if s, ok := status.FromError(err); !ok || s.Code() != codes.NotFound {
+				return fmt.Errorf("couldn't delete secret %q: %w", secretName, err)
+			}
+		}
+	}
+	return nil
+}
@@ -3,7 +3,9 @@ package storage
 import (
 	"bytes"
 	"context"
+	"crypto/ecdh"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/x509"
 	"encoding/base64"
@@ -11,9 +13,17 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
+	k8sapi "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
 	k8s "k8s.io/client-go/kubernetes/typed/core/v1"
 
 	"github.com/abetterinternet/prio-server/key-rotator/key"
@@ -23,33 +33,91 @@ import (
 // secret interface for backing storage. This key store writes keys in a way
 // that can be read by other components of the system (e.g. the facilitator).
 func NewKubernetesKey(k8s k8s.SecretInterface, prioEnv string) Key {
-	return k8sKey{k8s, prioEnv}
+	return NewKubernetesKeyWithSecrets(KubernetesSecrets{Default: k8s}, prioEnv)
+}
+
+// NewKubernetesKeyWithSecrets returns a Key implementation like
+// NewKubernetesKey, storing each key's secret in the secret interface selected
+// by secrets.
+func NewKubernetesKeyWithSecrets(secrets KubernetesSecrets, prioEnv string) Key {
+	return NewKubernetesKeyWithHistory(secrets, prioEnv, 0)
+}
+
+// NewKubernetesKeyWithHistory returns a Key implementation like
+// NewKubernetesKeyWithSecrets which also keeps up to history previous keys in
+// each key's secret, so that a bad write can be rolled back. Whenever a write
+// replaces a non-empty key with a different one, the key_versions of the
+// replaced key are kept as key_versions.1, and those of previously-kept keys
+// are shifted along to key_versions.2 and so on, dropping any beyond history.
+// Kept keys are read with GetKubernetesKeyHistory. If history is zero, no keys
+// are kept, and any kept previously are left untouched.
+func NewKubernetesKeyWithHistory(secrets KubernetesSecrets, prioEnv string, history int) Key {
+	return k8sKey{secrets: secrets, env: prioEnv, history: history}
+}
+
+// KubernetesSecrets selects the Kubernetes secret interface, i.e. the
+// namespace, in which each key's secret is stored.
+type KubernetesSecrets struct {
+	Default    k8s.SecretInterface            // packet encryption & task signing keys, and batch signing keys of ingestors not in ByIngestor
+	ByIngestor map[string]k8s.SecretInterface // batch signing keys, by ingestor
+}
+
+// forIngestor returns the secret interface in which the batch signing key of
+// the given ingestor is stored, or, if ingestor is empty, in which keys not
+// specific to an ingestor are stored.
+func (s KubernetesSecrets) forIngestor(ingestor string) k8s.SecretInterface {
+	if k8s, ok := s.ByIngestor[ingestor]; ok {
+		return k8s
+	}
+	return s.Default
 }
 
 type k8sKey struct {
-	k8s k8s.SecretInterface
-	env string // Prio environment name, e.g. "prod-us" or "prod-intl".
+	secrets KubernetesSecrets
+	env     string // Prio environment name, e.g. "prod-us" or "prod-intl".
+	history int    // the number of previous keys kept in each secret; see NewKubernetesKeyWithHistory
 }
 
 const (
-	liveVersionsSecretKey = "secret_key"
-	keyVersionsSecretKey  = "key_versions"
-	primaryKIDSecretKey   = "primary_kid"
+	liveVersionsSecretKey   = "secret_key"
+	keyVersionsSecretKey    = "key_versions"
+	primaryKIDSecretKey     = "primary_kid"
+	primaryVersionSecretKey = "primary_version"
+	kmsKeySecretKey         = "kms_key" // reference to the KMS key holding the primary version, if it is held in a KMS
 
 	secretKeyUnfilledValue = "not-a-real-key" // used in the secret_key secret key to denote no data
+
+	// fieldManager identifies key-rotator as the writer of the fields of the
+	// secrets it patches.
+	fieldManager = "key-rotator"
+
+	// Annotations recording the most recent write of a key to a secret.
+	lastUpdatedAnnotation    = "key-rotator.prio.divviup.org/last-updated"    // when the key was written, as an RFC 3339 timestamp
+	primaryVersionAnnotation = "key-rotator.prio.divviup.org/primary-version" // the creation timestamp of the primary version; empty if the key is empty
 )
 
+// keySecretKeys are the secret keys written by key-rotator. Any of these not
+// written for a given key are removed from its secret.
+var keySecretKeys = []string{liveVersionsSecretKey, keyVersionsSecretKey, primaryKIDSecretKey, primaryVersionSecretKey, kmsKeySecretKey}
+
 var _ Key = k8sKey{} // verify k8skey satisfies Key
 
 func (k k8sKey) PutBatchSigningKey(ctx context.Context, locality, ingestor string, key key.Key) error {
-	return k.putKey(ctx, "batch-signing", batchSigningKeyName(k.env, locality, ingestor), key, serializeBatchSigningSecretKey)
+	return k.putKey(ctx, k.secrets.forIngestor(ingestor), "batch-signing", batchSigningKeyName(k.env, locality, ingestor), key, serializeBatchSigningSecretKey)
 }
 
 func (k k8sKey) PutPacketEncryptionKey(ctx context.Context, locality string, key key.Key) error {
-	return k.putKey(ctx, "packet-encryption", packetEncryptionKeyName(k.env, locality), key, serializePacketEncryptionSecretKey)
+	return k.putKey(ctx, k.secrets.Default, "packet-encryption", packetEncryptionKeyName(k.env, locality), key, serializePacketEncryptionSecretKey)
+}
+
+// PutTaskSigningKey writes the task signing key. Like a batch signing key, its
+// primary version is additionally written to the secret as a PKCS#8 key, so
+// that it can be read by workflow-manager.
+func (k k8sKey) PutTaskSigningKey(ctx context.Context, locality string, key key.Key) error {
+	return k.putKey(ctx, k.secrets.Default, "task-signing", taskSigningKeyName(k.env, locality), key, serializeBatchSigningSecretKey)
 }
 
-func (k k8sKey) putKey(ctx context.Context, secretKind, secretName string, key key.Key, serializeLiveVersions func(key.Key) ([]byte, error)) error {
+func (k k8sKey) putKey(ctx context.Context, secrets k8s.SecretInterface, secretKind, secretName string, key key.Key, serializeLiveVersions func(key.Key) ([]byte, error)) error {
 	log.Info().
 		Str("storage", "kubernetes").
 		Str("kind", secretKind).
@@ -71,39 +139,98 @@ func (k k8sKey) putKey(ctx context.Context, secretKind, secretName string, key k
 		liveVersionsSecretKey: liveVersionsBytes,
 		primaryKIDSecretKey:   []byte(primaryKID),
 	}
+	if !key.IsEmpty() {
+		secretData[primaryVersionSecretKey] = []byte(strconv.FormatInt(key.Primary().CreationTimestamp, 10))
+		if ref, ok := key.Primary().KeyMaterial.KMSKeyRef(); ok {
+			secretData[kmsKeySecretKey] = []byte(ref)
+		}
+	}
 
-	// Write update back to Kubernetes secret store.
-	s, err := k.k8s.Get(ctx, secretName, k8smeta.GetOptions{})
+	// Write update back to Kubernetes secret store. The secret is patched,
+	// rather than read & updated, so that data, labels & annotations which
+	// key-rotator does not own are preserved. The secret keys & annotations it
+	// does own are last-writer-wins unless previous keys are kept, below.
+	// Secret keys written by key-rotator but not applicable to this key are
+	// removed.
+	patch := secretPatch{Data: map[string]*[]byte{}}
+	for _, sk := range keySecretKeys {
+		if v, ok := secretData[sk]; ok {
+			patch.Data[sk] = &v
+		} else {
+			patch.Data[sk] = nil
+		}
+	}
+	patch.Metadata.Annotations = map[string]string{
+		lastUpdatedAnnotation:    time.Now().UTC().Format(time.RFC3339),
+		primaryVersionAnnotation: string(secretData[primaryVersionSecretKey]),
+	}
+	// Keeping previous keys requires reading the secret, so the patch is
+	// then made conditional on the secret being unmodified since it was read.
+	if k.history > 0 {
+		s, err := secrets.Get(ctx, secretName, k8smeta.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("couldn't retrieve secret %q: %w", secretName, err)
+		}
+		for sk, v := range keyHistoryPatch(s.Data, keyVersionsBytes, k.history) {
+			patch.Data[sk] = v
+		}
+		patch.Metadata.ResourceVersion = s.ResourceVersion
+	}
+	patchBytes, err := json.Marshal(patch)
 	if err != nil {
-		return fmt.Errorf("couldn't get secret %q: %w", secretName, err)
+		return fmt.Errorf("couldn't serialize patch for secret %q: %w", secretName, err)
 	}
-	s.Data = secretData
-	if _, err := k.k8s.Update(ctx, s, k8smeta.UpdateOptions{}); err != nil {
-		return fmt.Errorf("couldn't update secret %q: %w", secretName, err)
+	written := ownSecretWrites.begin(secretName)
+	s, err := secrets.Patch(ctx, secretName, types.MergePatchType, patchBytes, k8smeta.PatchOptions{FieldManager: fieldManager})
+	if err != nil {
+		written(nil)
+		return fmt.Errorf("couldn't patch secret %q: %w", secretName, err)
 	}
+	written(s)
 	return nil
 }
 
+// secretPatch is a JSON merge patch (RFC 7386) to a Kubernetes secret. Data
+// values are base64-encoded, as in the Secret resource; a nil value removes
+// the corresponding secret key.
+type secretPatch struct {
+	Metadata struct {
+		Annotations     map[string]string `json:"annotations,omitempty"`
+		ResourceVersion string            `json:"resourceVersion,omitempty"` // if set, the patch fails with a conflict unless the secret has this resource version
+	} `json:"metadata"`
+	Data map[string]*[]byte `json:"data"`
+}
+
 func (k k8sKey) GetBatchSigningKey(ctx context.Context, locality, ingestor string) (key.Key, error) {
-	return k.getKey(ctx, batchSigningKeyName(k.env, locality, ingestor), parseBatchSigningSecretKey)
+	return k.getKey(ctx, k.secrets.forIngestor(ingestor), batchSigningKeyName(k.env, locality, ingestor), parseBatchSigningSecretKey)
 }
 
 func (k k8sKey) GetPacketEncryptionKey(ctx context.Context, locality string) (key.Key, error) {
-	return k.getKey(ctx, packetEncryptionKeyName(k.env, locality), parsePacketEncryptionSecretKey)
+	return k.getKey(ctx, k.secrets.Default, packetEncryptionKeyName(k.env, locality), parsePacketEncryptionSecretKey)
 }
 
-func (k k8sKey) getKey(ctx context.Context, secretName string, parseSecretKey func([]byte) (key.Material, error)) (key.Key, error) {
-	s, err := k.k8s.Get(ctx, secretName, k8smeta.GetOptions{})
+func (k k8sKey) GetTaskSigningKey(ctx context.Context, locality string) (key.Key, error) {
+	return k.getKey(ctx, k.secrets.Default, taskSigningKeyName(k.env, locality), parseBatchSigningSecretKey)
+}
+
+func (k k8sKey) getKey(ctx context.Context, secrets k8s.SecretInterface, secretName string, parseSecretKey func([]byte) (key.Material, error)) (key.Key, error) {
+	s, err := secrets.Get(ctx, secretName, k8smeta.GetOptions{})
 	if err != nil {
 		return key.Key{}, fmt.Errorf("couldn't retrieve secret %q: %w", secretName, err)
 	}
 
-	// Parse as a "new" key_versions-serialized key.
+	// Parse as a "new" key_versions-serialized key. If the primary version is
+	// also recorded explicitly, it must agree with the key versions.
 	if keyVersions, ok := s.Data[keyVersionsSecretKey]; ok {
 		var secretKey key.Key
 		if err := json.Unmarshal(keyVersions, &secretKey); err != nil {
 			return key.Key{}, fmt.Errorf("couldn't parse key versions from secret %q: %w", secretName, err)
 		}
+		if primaryVersion, ok := s.Data[primaryVersionSecretKey]; ok {
+			if err := checkPrimaryVersion(secretKey, primaryVersion); err != nil {
+				return key.Key{}, fmt.Errorf("secret %q: %w", secretName, err)
+			}
+		}
 		return secretKey, nil
 	}
 
@@ -128,6 +255,453 @@ func (k k8sKey) getKey(ctx context.Context, secretName string, parseSecretKey fu
 	return key.Key{}, nil
 }
 
+func (k k8sKey) DeleteKeys(ctx context.Context, locality string, ingestors []string) error {
+	for _, s := range kubernetesKeySecrets(k.env, locality, ingestors, true) {
+		log.Info().
+			Str("storage", "kubernetes").
+			Str("kind", s.kind).
+			Str("secret", s.name).
+			Msgf("Deleting secret %q", s.name)
+		if err := k.secrets.forIngestor(s.ingestor).Delete(ctx, s.name, k8smeta.DeleteOptions{}); err != nil && !k8serrors.IsNotFound(err) {
+			return fmt.Errorf("couldn't delete secret %q: %w", s.name, err)
+		}
+	}
+	return nil
+}
+
+// WatchKubernetesKeys watches the Kubernetes secrets used by NewKubernetesKey
+// to store the packet encryption key for the given locality & the batch
+// signing keys for the given (locality, ingestor) pairs. The name of each
+// secret is sent on the returned channel whenever that secret is modified or
+// deleted, other than by writes of keys made by this process, e.g. by a
+// reconciliation prompted by an earlier change. The channel holds at most one pending name: changes made while a
+// name is pending are dropped, so the receiver should treat a name as a
+// signal to re-check every watched secret. Watches which are closed by the
+// API server are transparently re-established; if the API server reports an
+// error such as an expired resource version, the watch is re-established
+// from the current state & a name is sent, since changes may have been
+// missed. The returned channel is closed once ctx is canceled.
+func WatchKubernetesKeys(ctx context.Context, secrets KubernetesSecrets, prioEnv, locality string, ingestors []string) (<-chan string, error) {
+	// Secrets are watched separately in each secret interface in which any
+	// are stored.
+	type watched struct {
+		k8s         k8s.SecretInterface
+		secretNames map[string]struct{}
+	}
+	watches := []watched{{secrets.Default, map[string]struct{}{packetEncryptionKeyName(prioEnv, locality): {}}}}
+	for _, ingestor := range ingestors {
+		name := batchSigningKeyName(prioEnv, locality, ingestor)
+		if k8s, ok := secrets.ByIngestor[ingestor]; ok {
+			watches = append(watches, watched{k8s, map[string]struct{}{name: {}}})
+			continue
+		}
+		watches[0].secretNames[name] = struct{}{}
+	}
+
+	var ws []watch.Interface
+	for _, w := range watches {
+		watcher, err := w.k8s.Watch(ctx, k8smeta.ListOptions{})
+		if err != nil {
+			for _, watcher := range ws {
+				watcher.Stop()
+			}
+			return nil, fmt.Errorf("couldn't watch secrets: %w", err)
+		}
+		ws = append(ws, watcher)
+	}
+
+	for _, w := range watches {
+		ownSecretWrites.startWatch(w.secretNames)
+	}
+	ch := make(chan string, 1)
+	var wg sync.WaitGroup
+	for i, w := range watches {
+		wg.Add(1)
+		go func(w watched, watcher watch.Interface) {
+			defer wg.Done()
+			watchKubernetesSecrets(ctx, w.k8s, watcher, w.secretNames, ch)
+		}(w, ws[i])
+	}
+	go func() {
+		wg.Wait()
+		for _, w := range watches {
+			ownSecretWrites.stopWatch(w.secretNames)
+		}
+		close(ch)
+	}()
+	return ch, nil
+}
+
+// ownSecretWrites records the writes of secrets watched by WatchKubernetesKeys
+// made by key-rotator itself, so that the watch ignores them: each would
+// otherwise prompt another reconciliation.
+var ownSecretWrites = newSecretWrites()
+
+// secretWrites records the resource version produced by the latest write of
+// each watched secret.
+type secretWrites struct {
+	mu       sync.Mutex
+	done     *sync.Cond        // broadcast whenever a write completes
+	watched  map[string]int    // the number of running watches of each secret, by name
+	inFlight map[string]int    // the number of incomplete writes of each watched secret, by name
+	written  map[string]string // the resource version produced by the latest write of each watched secret, by name
+}
+
+func newSecretWrites() *secretWrites {
+	w := &secretWrites{watched: map[string]int{}, inFlight: map[string]int{}, written: map[string]string{}}
+	w.done = sync.NewCond(&w.mu)
+	return w
+}
+
+func (w *secretWrites) startWatch(names map[string]struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for name := range names {
+		w.watched[name]++
+	}
+}
+
+func (w *secretWrites) stopWatch(names map[string]struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for name := range names {
+		if w.watched[name]--; w.watched[name] == 0 {
+			delete(w.watched, name)
+			delete(w.written, name)
+		}
+	}
+}
+
+// begin records the start of a write of the named secret, returning a
+// function which must be called when the write completes, with the secret
+// returned by the write, or nil if it failed.
+func (w *secretWrites) begin(name string) func(*k8sapi.Secret) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.watched[name] == 0 {
+		return func(*k8sapi.Secret) {}
+	}
+	w.inFlight[name]++
+	return func(s *k8sapi.Secret) {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.inFlight[name]--; w.inFlight[name] == 0 {
+			delete(w.inFlight, name)
+		}
+		if s != nil && w.watched[name] > 0 {
+			w.written[name] = s.ResourceVersion
+		}
+		w.done.Broadcast()
+	}
+}
+
+// take returns true if the given version of a secret was produced by its
+// latest recorded write, forgetting the write. Since a watch may report a
+// write before the writer receives its response, take first waits for any
+// incomplete writes of the secret.
+func (w *secretWrites) take(s *k8sapi.Secret) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.inFlight[s.Name] > 0 {
+		w.done.Wait()
+	}
+	if rv, ok := w.written[s.Name]; !ok || rv != s.ResourceVersion {
+		return false
+	}
+	delete(w.written, s.Name)
+	return true
+}
+
+// watchKubernetesSecrets sends the name of each of secretNames on ch whenever
+// that secret is modified or deleted, per the established watcher, until ctx
+// is canceled. Names are not sent if ch is full.
+func watchKubernetesSecrets(ctx context.Context, k8s k8s.SecretInterface, w watch.Interface, secretNames map[string]struct{}, ch chan<- string) {
+	notify := func(name string) {
+		select {
+		case ch <- name:
+		default: // a name is already pending
+		}
+	}
+
+	var resourceVersion string
+	for {
+		var missedChanges bool
+		for ev := range w.ResultChan() {
+			if ev.Type == watch.Error {
+				// e.g. 410 Gone, if the last-seen resource version is too
+				// old to resume from.
+				err := k8serrors.FromObject(ev.Object)
+				log.Warn().Err(err).Msgf("Watch on secrets failed, re-establishing from current state: %v", err)
+				resourceVersion, missedChanges = "", true
+				break
+			}
+			s, ok := ev.Object.(*k8sapi.Secret)
+			if !ok {
+				continue
+			}
+			resourceVersion = s.ResourceVersion
+			if _, ok := secretNames[s.Name]; !ok {
+				continue
+			}
+			// Added events are also sent for all pre-existing secrets
+			// when a watch is established, so they do not indicate drift.
+			if ev.Type != watch.Modified && ev.Type != watch.Deleted {
+				continue
+			}
+			// Modifications made by key-rotator itself are not drift.
+			if ev.Type == watch.Modified && ownSecretWrites.take(s) {
+				continue
+			}
+			notify(s.Name)
+		}
+		w.Stop()
+
+		// The watch has been closed, either because ctx was canceled or
+		// because the API server ended it. Re-establish it in the latter
+		// case, resuming from the last-seen resource version unless it was
+		// rejected, in which case changes may have been missed.
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			var err error
+			if w, err = k8s.Watch(ctx, k8smeta.ListOptions{ResourceVersion: resourceVersion}); err == nil {
+				break
+			}
+			log.Warn().Err(err).Msgf("Couldn't re-establish watch on secrets: %v", err)
+			resourceVersion, missedChanges = "", true
+		}
+		if missedChanges {
+			// Any name prompts a re-check of every secret, so one suffices.
+			for name := range secretNames {
+				notify(name)
+				break
+			}
+		}
+	}
+}
+
+// previousKeyVersionsSecretKey returns the secret key in which the key_versions
+// of the i'th most recently replaced key are kept, counting from 1.
+func previousKeyVersionsSecretKey(i int) string {
+	return fmt.Sprintf("%s.%d", keyVersionsSecretKey, i)
+}
+
+// parsePreviousKeyVersionsSecretKey returns i if sk is the secret key returned
+// by previousKeyVersionsSecretKey(i).
+func parsePreviousKeyVersionsSecretKey(sk string) (int, bool) {
+	prefix := keyVersionsSecretKey + "."
+	if !strings.HasPrefix(sk, prefix) {
+		return 0, false
+	}
+	suffix := strings.TrimPrefix(sk, prefix)
+	i, err := strconv.Atoi(suffix)
+	if err != nil || i < 1 || suffix != strconv.Itoa(i) {
+		return 0, false
+	}
+	return i, true
+}
+
+// keyHistoryPatch returns the secret data patch which keeps the key held in a
+// secret with the given data when it is replaced by a key with the given
+// key_versions, along with up to history-1 previously-kept keys. Kept keys
+// beyond history are removed. An empty or unchanged key is not kept.
+func keyHistoryPatch(data map[string][]byte, keyVersions []byte, history int) map[string]*[]byte {
+	patch := map[string]*[]byte{}
+	if current, ok := data[keyVersionsSecretKey]; ok && !bytes.Equal(current, keyVersions) {
+		var currentKey key.Key
+		if err := json.Unmarshal(current, &currentKey); err == nil && !currentKey.IsEmpty() {
+			kept := current
+			for i := 1; i <= history; i++ {
+				v := kept
+				patch[previousKeyVersionsSecretKey(i)] = &v
+				if kept, ok = data[previousKeyVersionsSecretKey(i)]; !ok {
+					break
+				}
+			}
+		}
+	}
+	for sk := range data {
+		if i, ok := parsePreviousKeyVersionsSecretKey(sk); ok && i > history {
+			patch[sk] = nil
+		}
+	}
+	return patch
+}
+
+// GetKubernetesKeyHistory returns the previous keys kept, per
+// NewKubernetesKeyWithHistory, in the secret in which the key of the given kind
+// ("batch-signing", "packet-encryption" or "task-signing") for the locality,
+// and for batch signing keys the ingestor, is stored, most recently replaced
+// first.
+func GetKubernetesKeyHistory(ctx context.Context, secrets KubernetesSecrets, prioEnv, kind, locality, ingestor string) ([]key.Key, error) {
+	secretName, ingestor, err := keySecretName(prioEnv, kind, locality, ingestor)
+	if err != nil {
+		return nil, err
+	}
+	s, err := secrets.forIngestor(ingestor).Get(ctx, secretName, k8smeta.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't retrieve secret %q: %w", secretName, err)
+	}
+	var history []key.Key
+	for i := 1; ; i++ {
+		keyVersions, ok := s.Data[previousKeyVersionsSecretKey(i)]
+		if !ok {
+			return history, nil
+		}
+		var k key.Key
+		if err := json.Unmarshal(keyVersions, &k); err != nil {
+			return nil, fmt.Errorf("couldn't parse previous key versions %q from secret %q: %w", previousKeyVersionsSecretKey(i), secretName, err)
+		}
+		history = append(history, k)
+	}
+}
+
+// RemoveKubernetesKeyHistoryVersion removes the key version with the given
+// creation timestamp, e.g. one that has been revoked, from the previous keys
+// kept, per NewKubernetesKeyWithHistory, in the secret in which the key of the
+// given kind is stored, as for GetKubernetesKeyHistory, so that its key
+// material is neither left in the secret nor restored by a rollback. A kept key
+// of which it is the primary version is discarded, & later kept keys take its
+// place. It returns the number of kept keys changed or discarded; a secret
+// which does not exist keeps no keys.
+func RemoveKubernetesKeyHistoryVersion(ctx context.Context, secrets KubernetesSecrets, prioEnv, kind, locality, ingestor string, creationTimestamp int64) (int, error) {
+	secretName, ingestor, err := keySecretName(prioEnv, kind, locality, ingestor)
+	if err != nil {
+		return 0, err
+	}
+	k8s := secrets.forIngestor(ingestor)
+	s, err := k8s.Get(ctx, secretName, k8smeta.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("couldn't retrieve secret %q: %w", secretName, err)
+	}
+
+	var kept [][]byte
+	n, changed := 0, 0
+	for i := 1; ; i++ {
+		keyVersions, ok := s.Data[previousKeyVersionsSecretKey(i)]
+		if !ok {
+			break
+		}
+		n = i
+		var k key.Key
+		if err := json.Unmarshal(keyVersions, &k); err != nil {
+			return 0, fmt.Errorf("couldn't parse previous key versions %q from secret %q: %w", previousKeyVersionsSecretKey(i), secretName, err)
+		}
+		var others []key.Version
+		found := false
+		_ = k.Versions(func(v key.Version) error {
+			switch {
+			case v.CreationTimestamp == creationTimestamp:
+				found = true
+			case v.CreationTimestamp != k.Primary().CreationTimestamp:
+				others = append(others, v)
+			}
+			return nil
+		})
+		if !found {
+			kept = append(kept, keyVersions)
+			continue
+		}
+		changed++
+		if k.Primary().CreationTimestamp == creationTimestamp {
+			continue
+		}
+		if k, err = key.FromVersions(k.Primary(), others...); err != nil {
+			return 0, fmt.Errorf("couldn't remove key version from previous key versions %q in secret %q: %w", previousKeyVersionsSecretKey(i), secretName, err)
+		}
+		if keyVersions, err = json.Marshal(k); err != nil {
+			return 0, fmt.Errorf("couldn't serialize key versions: %w", err)
+		}
+		kept = append(kept, keyVersions)
+	}
+	if changed == 0 {
+		return 0, nil
+	}
+
+	// The patch is conditional on the secret being unmodified since it was
+	// read, so that a concurrent rotation cannot reintroduce the version.
+	patch := secretPatch{Data: map[string]*[]byte{}}
+	for i := 1; i <= n; i++ {
+		if i <= len(kept) {
+			patch.Data[previousKeyVersionsSecretKey(i)] = &kept[i-1]
+		} else {
+			patch.Data[previousKeyVersionsSecretKey(i)] = nil
+		}
+	}
+	patch.Metadata.ResourceVersion = s.ResourceVersion
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't serialize patch for secret %q: %w", secretName, err)
+	}
+	if _, err := k8s.Patch(ctx, secretName, types.MergePatchType, patchBytes, k8smeta.PatchOptions{FieldManager: fieldManager}); err != nil {
+		return 0, fmt.Errorf("couldn't patch secret %q: %w", secretName, err)
+	}
+	return changed, nil
+}
+
+// keySecretName returns the name of the secret holding the key of the given
+// kind, i.e. "batch-signing", "packet-encryption" or "task-signing", and the
+// ingestor by which its secret interface is selected, which is empty for keys
+// other than batch signing keys.
+func keySecretName(prioEnv, kind, locality, ingestor string) (string, string, error) {
+	switch kind {
+	case "batch-signing":
+		return batchSigningKeyName(prioEnv, locality, ingestor), ingestor, nil
+	case "packet-encryption":
+		return packetEncryptionKeyName(prioEnv, locality), "", nil
+	case "task-signing":
+		return taskSigningKeyName(prioEnv, locality), "", nil
+	default:
+		return "", "", fmt.Errorf("unknown kind of key %q", kind)
+	}
+}
+
+// CheckKubernetesKeySecret verifies, without modifying it, that the secret
+// holding the key of the given kind, as for GetKubernetesKeyHistory, can be
+// read & written. It returns the name of the secret, and an error for each of
+// reading & writing it, nil if permitted. The secret is written by patching it
+// with an empty patch in server-side dry-run mode, which the API server
+// authorizes & admits as it would any other patch, but does not persist.
+func CheckKubernetesKeySecret(ctx context.Context, secrets KubernetesSecrets, prioEnv, kind, locality, ingestor string) (secretName string, readErr, writeErr error) {
+	secretName, ingestor, err := keySecretName(prioEnv, kind, locality, ingestor)
+	if err != nil {
+		return "", err, err
+	}
+	k8s := secrets.forIngestor(ingestor)
+	if _, err := k8s.Get(ctx, secretName, k8smeta.GetOptions{}); err != nil {
+		readErr = fmt.Errorf("couldn't retrieve secret %q: %w", secretName, err)
+	}
+	if _, err := k8s.Patch(ctx, secretName, types.MergePatchType, []byte("{}"), k8smeta.PatchOptions{
+		DryRun:       []string{k8smeta.DryRunAll},
+		FieldManager: fieldManager,
+	}); err != nil {
+		writeErr = fmt.Errorf("couldn't patch secret %q in dry-run mode: %w", secretName, err)
+	}
+	return secretName, readErr, writeErr
+}
+
+// checkPrimaryVersion verifies that the primary version recorded in a secret's
+// primary_version matches the primary version of the key.
+func checkPrimaryVersion(k key.Key, primaryVersion []byte) error {
+	ts, err := strconv.ParseInt(string(primaryVersion), 10, 64)
+	if err != nil {
+		return fmt.Errorf("couldn't parse primary version %q: %w", primaryVersion, err)
+	}
+	if k.IsEmpty() {
+		return fmt.Errorf("primary version %d recorded for empty key", ts)
+	}
+	if got := k.Primary().CreationTimestamp; got != ts {
+		return fmt.Errorf("primary version %d does not match primary version %d of key versions", ts, got)
+	}
+	return nil
+}
+
 func primaryKID(secretName string, key key.Key) string {
 	if key.IsEmpty() || key.Primary().CreationTimestamp == 0 {
 		return secretName
@@ -135,8 +709,14 @@ func primaryKID(secretName string, key key.Key) string {
 	return fmt.Sprintf("%s-%d", secretName, key.Primary().CreationTimestamp)
 }
 
+// serializeBatchSigningSecretKey serializes the primary version of the key as
+// a PKCS#8 key, unless it is held in a KMS, in which case only its reference
+// is written to the secret, as kms_key.
 func serializeBatchSigningSecretKey(k key.Key) ([]byte, error) {
 	primaryKeyMaterial := k.Primary().KeyMaterial
+	if _, ok := primaryKeyMaterial.KMSKeyRef(); ok {
+		return []byte(secretKeyUnfilledValue), nil
+	}
 	kmBytes, err := primaryKeyMaterial.AsPKCS8()
 	if err != nil {
 		return nil, err
@@ -149,24 +729,39 @@ func parseBatchSigningSecretKey(keyMaterialBytes []byte) (key.Material, error) {
 	if err != nil {
 		return key.Material{}, fmt.Errorf("couldn't interpret key material as PKCS#8: %w", err)
 	}
-	ecdsaPrivKey, ok := privKey.(*ecdsa.PrivateKey)
-	if !ok {
-		return key.Material{}, fmt.Errorf("couldn't interpret key material as ECDSA key (was %T)", privKey)
-	}
-	keyMaterial, err := key.P256MaterialFrom(ecdsaPrivKey)
-	if err != nil {
-		return key.Material{}, fmt.Errorf("couldn't interpret key material as P-256 ECDSA key: %w", err)
+	switch privKey := privKey.(type) {
+	case *ecdsa.PrivateKey:
+		keyMaterial, err := key.P256MaterialFrom(privKey)
+		if err != nil {
+			return key.Material{}, fmt.Errorf("couldn't interpret key material as P-256 ECDSA key: %w", err)
+		}
+		return keyMaterial, nil
+	case ed25519.PrivateKey:
+		keyMaterial, err := key.Ed25519MaterialFrom(privKey)
+		if err != nil {
+			return key.Material{}, fmt.Errorf("couldn't interpret key material as Ed25519 key: %w", err)
+		}
+		return keyMaterial, nil
+	default:
+		return key.Material{}, fmt.Errorf("couldn't interpret key material as ECDSA or Ed25519 key (was %T)", privKey)
 	}
-	return keyMaterial, nil
 }
 
+// serializePacketEncryptionSecretKey serializes each version of the key, in
+// try order, separated by commas: P256 versions as the base64-encoded X9.62
+// uncompressed public key concatenated with the private key, and X25519
+// versions, which have no X9.62 encoding, as base64-encoded PKCS#8 keys.
 func serializePacketEncryptionSecretKey(k key.Key) ([]byte, error) {
 	var buf bytes.Buffer
 	if err := k.Versions(func(v key.Version) error {
 		if buf.Len() > 0 {
 			buf.WriteRune(',')
 		}
-		kmBytes, err := v.KeyMaterial.AsX962Uncompressed()
+		serialize := v.KeyMaterial.AsX962Uncompressed
+		if v.KeyMaterial.Type() == key.X25519 {
+			serialize = v.KeyMaterial.AsPKCS8
+		}
+		kmBytes, err := serialize()
 		if err != nil {
 			return fmt.Errorf("couldn't serialize key version: %w", err)
 		}
@@ -186,7 +781,16 @@ func parsePacketEncryptionSecretKey(keyMaterialBytes []byte) (key.Material, erro
 	)
 
 	if len(keyMaterialBytes) != keyLen {
-		return key.Material{}, fmt.Errorf("key was wrong length (wanted %d, got %d)", keyLen, len(keyMaterialBytes))
+		// Anything else must be a PKCS#8 X25519 key.
+		privKey, err := x509.ParsePKCS8PrivateKey(keyMaterialBytes)
+		if err != nil {
+			return key.Material{}, fmt.Errorf("key was wrong length for X9.62 (wanted %d, got %d), and couldn't be interpreted as PKCS#8: %w", keyLen, len(keyMaterialBytes), err)
+		}
+		x25519Key, ok := privKey.(*ecdh.PrivateKey)
+		if !ok {
+			return key.Material{}, fmt.Errorf("couldn't interpret key material as X25519 key (was %T)", privKey)
+		}
+		return key.X25519MaterialFrom(x25519Key)
 	}
 	x, y := elliptic.Unmarshal(elliptic.P256(), keyMaterialBytes[:pubkeyLen])
 	if x == nil {
@@ -202,3 +806,203 @@ func parsePacketEncryptionSecretKey(keyMaterialBytes []byte) (key.Material, erro
 		D: d,
 	})
 }
+
+// KeySecretSchema identifies the format of a Kubernetes secret in which the
+// Key returned by NewKubernetesKey stores a key. Each schema extends the one
+// before it. Keys can be read from secrets in any schema, but are always
+// written in CurrentKeySecretSchema.
+type KeySecretSchema int
+
+const (
+	// KeySecretSchemaEmpty secrets hold no key, e.g. because they have not
+	// been written since they were created with a placeholder secret_key.
+	KeySecretSchemaEmpty KeySecretSchema = iota
+	// KeySecretSchemaSecretKey secrets hold a single key version, of unknown
+	// creation time, in secret_key.
+	KeySecretSchemaSecretKey
+	// KeySecretSchemaKeyVersions secrets additionally hold all key versions
+	// in key_versions, and the key ID of the primary version in primary_kid.
+	// The primary version is identified only within key_versions.
+	KeySecretSchemaKeyVersions
+	// KeySecretSchemaPrimaryVersion secrets additionally record the creation
+	// timestamp of the primary version in primary_version.
+	KeySecretSchemaPrimaryVersion
+
+	// CurrentKeySecretSchema is the schema in which keys are written.
+	CurrentKeySecretSchema = KeySecretSchemaPrimaryVersion
+)
+
+func (s KeySecretSchema) String() string {
+	switch s {
+	case KeySecretSchemaEmpty:
+		return "empty"
+	case KeySecretSchemaSecretKey:
+		return "secret_key"
+	case KeySecretSchemaKeyVersions:
+		return "key_versions"
+	case KeySecretSchemaPrimaryVersion:
+		return "primary_version"
+	default:
+		return fmt.Sprintf("unknown schema %d", int(s))
+	}
+}
+
+// KeySecretReport describes the result of verifying a single key secret.
+type KeySecretReport struct {
+	SecretName string
+	Schema     KeySecretSchema
+	Problems   []string // inconsistencies between the secret's fields; empty if the secret is consistent
+}
+
+// Outdated returns true if the secret holds a key in a schema other than
+// CurrentKeySecretSchema, i.e. if it would be migrated by rewriting its key.
+func (r KeySecretReport) Outdated() bool {
+	return r.Schema != KeySecretSchemaEmpty && r.Schema != CurrentKeySecretSchema
+}
+
+// keySecret describes a Kubernetes secret in which a key is stored.
+type keySecret struct {
+	kind      string
+	name      string
+	ingestor  string // for batch signing keys, the ingestor whose key is stored
+	serialize func(key.Key) ([]byte, error)
+	parse     func([]byte) (key.Material, error)
+}
+
+// kubernetesKeySecrets returns the secrets in which the packet encryption key
+// for the locality, the batch signing key for each ingestor, and, if
+// taskSigningKey is set, the task signing key for the locality are stored.
+func kubernetesKeySecrets(prioEnv, locality string, ingestors []string, taskSigningKey bool) []keySecret {
+	secrets := []keySecret{{"packet-encryption", packetEncryptionKeyName(prioEnv, locality), "", serializePacketEncryptionSecretKey, parsePacketEncryptionSecretKey}}
+	for _, ingestor := range ingestors {
+		secrets = append(secrets, keySecret{"batch-signing", batchSigningKeyName(prioEnv, locality, ingestor), ingestor, serializeBatchSigningSecretKey, parseBatchSigningSecretKey})
+	}
+	if taskSigningKey {
+		secrets = append(secrets, keySecret{"task-signing", taskSigningKeyName(prioEnv, locality), "", serializeBatchSigningSecretKey, parseBatchSigningSecretKey})
+	}
+	return secrets
+}
+
+// VerifyKubernetesKeys reads the secrets in which the Key returned by
+// NewKubernetesKey stores the packet encryption key for the locality, the
+// batch signing key for each ingestor, and, if taskSigningKey is set, the
+// task signing key for the locality. It reports the schema of each secret and
+// any inconsistencies between its fields.
+func VerifyKubernetesKeys(ctx context.Context, secrets KubernetesSecrets, prioEnv, locality string, ingestors []string, taskSigningKey bool) ([]KeySecretReport, error) {
+	var reports []KeySecretReport
+	for _, s := range kubernetesKeySecrets(prioEnv, locality, ingestors, taskSigningKey) {
+		report, err := verifyKeySecret(ctx, secrets.forIngestor(s.ingestor), s)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// MigrateKubernetesKeys rewrites, in CurrentKeySecretSchema, each secret
+// verified by VerifyKubernetesKeys which is outdated & consistent. The names
+// of the rewritten secrets are returned.
+func MigrateKubernetesKeys(ctx context.Context, secrets KubernetesSecrets, prioEnv, locality string, ingestors []string, taskSigningKey bool) ([]string, error) {
+	k := k8sKey{secrets: secrets, env: prioEnv}
+	var migrated []string
+	for _, s := range kubernetesKeySecrets(prioEnv, locality, ingestors, taskSigningKey) {
+		k8s := secrets.forIngestor(s.ingestor)
+		report, err := verifyKeySecret(ctx, k8s, s)
+		if err != nil {
+			return migrated, err
+		}
+		if !report.Outdated() || len(report.Problems) > 0 {
+			continue
+		}
+		secretKey, err := k.getKey(ctx, k8s, s.name, s.parse)
+		if err != nil {
+			return migrated, fmt.Errorf("couldn't read key from secret %q: %w", s.name, err)
+		}
+		if err := k.putKey(ctx, k8s, s.kind, s.name, secretKey, s.serialize); err != nil {
+			return migrated, fmt.Errorf("couldn't rewrite key to secret %q: %w", s.name, err)
+		}
+		migrated = append(migrated, s.name)
+	}
+	return migrated, nil
+}
+
+// CreateKubernetesKeys creates the secrets in which the Key returned by
+// NewKubernetesKey stores the packet encryption key for the locality, the
+// batch signing key for each ingestor, and, if taskSigningKey is set, the task
+// signing key for the locality. Each secret is created empty, as Terraform
+// creates them for newly-provisioned localities. It is an error for any of
+// the secrets to already exist; on error, any secrets created are deleted.
+func CreateKubernetesKeys(ctx context.Context, secrets KubernetesSecrets, prioEnv, locality string, ingestors []string, taskSigningKey bool) (retErr error) {
+	var created []keySecret
+	defer func() {
+		if retErr == nil {
+			return
+		}
+		for _, s := range created {
+			if err := secrets.forIngestor(s.ingestor).Delete(ctx, s.name, k8smeta.DeleteOptions{}); err != nil {
+				log.Error().Err(err).Str("secret", s.name).Msgf("Couldn't delete secret %q: %v", s.name, err)
+			}
+		}
+	}()
+
+	for _, s := range kubernetesKeySecrets(prioEnv, locality, ingestors, taskSigningKey) {
+		if _, err := secrets.forIngestor(s.ingestor).Create(ctx, &k8sapi.Secret{
+			ObjectMeta: k8smeta.ObjectMeta{Name: s.name},
+			Data:       map[string][]byte{liveVersionsSecretKey: []byte(secretKeyUnfilledValue)},
+		}, k8smeta.CreateOptions{}); err != nil {
+			return fmt.Errorf("couldn't create secret %q: %w", s.name, err)
+		}
+		created = append(created, s)
+	}
+	return nil
+}
+
+func verifyKeySecret(ctx context.Context, k8s k8s.SecretInterface, ks keySecret) (KeySecretReport, error) {
+	s, err := k8s.Get(ctx, ks.name, k8smeta.GetOptions{})
+	if err != nil {
+		return KeySecretReport{}, fmt.Errorf("couldn't retrieve secret %q: %w", ks.name, err)
+	}
+	report := KeySecretReport{SecretName: ks.name}
+
+	keyVersions, ok := s.Data[keyVersionsSecretKey]
+	if !ok {
+		if liveVersion, ok := s.Data[liveVersionsSecretKey]; ok && string(liveVersion) != secretKeyUnfilledValue {
+			report.Schema = KeySecretSchemaSecretKey
+		}
+		return report, nil
+	}
+	var secretKey key.Key
+	if err := json.Unmarshal(keyVersions, &secretKey); err != nil {
+		report.Schema = KeySecretSchemaKeyVersions
+		report.Problems = append(report.Problems, fmt.Sprintf("couldn't parse key versions: %v", err))
+		return report, nil
+	}
+	primaryVersion, ok := s.Data[primaryVersionSecretKey]
+	switch {
+	case ok:
+		report.Schema = KeySecretSchemaPrimaryVersion
+		if err := checkPrimaryVersion(secretKey, primaryVersion); err != nil {
+			report.Problems = append(report.Problems, err.Error())
+		}
+	case secretKey.IsEmpty():
+		report.Schema = KeySecretSchemaEmpty
+	default:
+		report.Schema = KeySecretSchemaKeyVersions
+	}
+	if secretKey.IsEmpty() {
+		return report, nil
+	}
+
+	if got, want := string(s.Data[primaryKIDSecretKey]), primaryKID(ks.name, secretKey); got != want {
+		report.Problems = append(report.Problems, fmt.Sprintf("primary key ID %q does not match primary version of key versions (want %q)", got, want))
+	}
+	liveVersions, err := ks.serialize(secretKey)
+	switch {
+	case err != nil:
+		report.Problems = append(report.Problems, fmt.Sprintf("couldn't serialize primary version of key versions: %v", err))
+	case !bytes.Equal(liveVersions, s.Data[liveVersionsSecretKey]):
+		report.Problems = append(report.Problems, "secret key does not match primary version of key versions")
+	}
+	return report, nil
+}
@@ -4,13 +4,25 @@ import (
 	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"math/big"
+	mathrand "math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	smpb "cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
@@ -19,7 +31,11 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	k8sapi "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
 	k8s "k8s.io/client-go/kubernetes/typed/core/v1"
 
 	"github.com/abetterinternet/prio-server/key-rotator/key"
@@ -60,7 +76,7 @@ func TestKubernetesKey(t *testing.T) {
 
 		t.Run("Put", func(t *testing.T) {
 			t.Parallel()
-			wantSD := map[string][]byte{"secret_key": []byte(wantBSKSecretKey), "key_versions": []byte(wantKeyVersions), "primary_kid": []byte(bskSecretName)}
+			wantSD := map[string][]byte{"secret_key": []byte(wantBSKSecretKey), "key_versions": []byte(wantKeyVersions), "primary_kid": []byte(bskSecretName), "primary_version": []byte("0")}
 			store, k8s := newK8sKey()
 			k8s.putEmpty(bskSecretName)
 			if err := store.PutBatchSigningKey(ctx, locality, ingestor, wantKey); err != nil {
@@ -72,6 +88,42 @@ func TestKubernetesKey(t *testing.T) {
 			}
 		})
 
+		t.Run("PutPreservesOtherFields", func(t *testing.T) {
+			t.Parallel()
+			store, k8s := newK8sKey()
+			k8s.sd[bskSecretName] = map[string][]byte{"secret_key": []byte("not-a-real-key"), "kms_key": []byte("$STALE_KMS_KEY"), "other": []byte("$OTHER")}
+			k8s.annotations[bskSecretName] = map[string]string{"other": "$OTHER"}
+			if err := store.PutBatchSigningKey(ctx, locality, ingestor, wantKey); err != nil {
+				t.Fatalf("Unexpected error from PutBatchSigningKey: %v", err)
+			}
+
+			// Data not written by key-rotator is preserved, while data
+			// written by key-rotator but not applicable to the key is removed.
+			wantSD := map[string][]byte{"secret_key": []byte(wantBSKSecretKey), "key_versions": []byte(wantKeyVersions), "primary_kid": []byte(bskSecretName), "primary_version": []byte("0"), "other": []byte("$OTHER")}
+			if diff := cmp.Diff(wantSD, k8s.sd[bskSecretName]); diff != "" {
+				t.Errorf("Batch signing key secret data differs from expected (-want +got):\n%s", diff)
+			}
+
+			annotations := k8s.annotations[bskSecretName]
+			if got := annotations["other"]; got != "$OTHER" {
+				t.Errorf("Unrelated annotation = %q, want %q", got, "$OTHER")
+			}
+			if got := annotations[primaryVersionAnnotation]; got != "0" {
+				t.Errorf("Primary version annotation = %q, want %q", got, "0")
+			}
+			if _, err := time.Parse(time.RFC3339, annotations[lastUpdatedAnnotation]); err != nil {
+				t.Errorf("Couldn't parse last-updated annotation %q: %v", annotations[lastUpdatedAnnotation], err)
+			}
+		})
+
+		t.Run("PutNonexistent", func(t *testing.T) {
+			t.Parallel()
+			store, _ := newK8sKey()
+			if err := store.PutBatchSigningKey(ctx, locality, ingestor, wantKey); !k8serrors.IsNotFound(err) {
+				t.Errorf("Wanted not found error from PutBatchSigningKey to nonexistent secret, got: %v", err)
+			}
+		})
+
 		t.Run("Get", func(t *testing.T) {
 			t.Parallel()
 			t.Run("FromSecretKey", func(t *testing.T) {
@@ -139,7 +191,7 @@ func TestKubernetesKey(t *testing.T) {
 
 		t.Run("Put", func(t *testing.T) {
 			t.Parallel()
-			wantSD := map[string][]byte{"secret_key": []byte(wantPEKSecretKey), "key_versions": []byte(wantKeyVersions), "primary_kid": []byte(pekSecretName)}
+			wantSD := map[string][]byte{"secret_key": []byte(wantPEKSecretKey), "key_versions": []byte(wantKeyVersions), "primary_kid": []byte(pekSecretName), "primary_version": []byte("0")}
 			store, k8s := newK8sKey()
 			k8s.putEmpty(pekSecretName)
 			if err := store.PutPacketEncryptionKey(ctx, locality, wantKey); err != nil {
@@ -224,6 +276,530 @@ func TestKubernetesKey(t *testing.T) {
 	})
 }
 
+// update, if set, causes golden-file tests to rewrite their golden files
+// rather than comparing against them.
+var update = flag.Bool("update", false, "update golden files")
+
+func TestKubernetesKeyGolden(t *testing.T) {
+	t.Parallel()
+
+	// Keys are created from deterministic sources of randomness, so that the
+	// serialized secrets are identical on every run.
+	newKey := func(typ key.Type, seed int64) key.Material {
+		m, err := typ.NewFrom(mathrand.New(mathrand.NewSource(seed))) // nolint:gosec // Use of non-cryptographic RNG is purposeful here.
+		if err != nil {
+			t.Fatalf("Couldn't create %v key: %v", typ, err)
+		}
+		return m
+	}
+	bsk := k(kv(20, newKey(key.Ed25519, 20)), kv(10, newKey(key.P256, 10)))
+	pek := k(kv(20, newKey(key.P256, 21)), kv(10, newKey(key.P256, 11)))
+
+	store, k8s := newK8sKey()
+	k8s.putEmpty(bskSecretName)
+	k8s.putEmpty(pekSecretName)
+	if err := store.PutBatchSigningKey(ctx, locality, ingestor, bsk); err != nil {
+		t.Fatalf("Unexpected error from PutBatchSigningKey: %v", err)
+	}
+	if err := store.PutPacketEncryptionKey(ctx, locality, pek); err != nil {
+		t.Fatalf("Unexpected error from PutPacketEncryptionKey: %v", err)
+	}
+
+	secrets := map[string]map[string]string{}
+	for name, sd := range k8s.sd {
+		secrets[name] = map[string]string{}
+		for k, v := range sd {
+			secrets[name][k] = string(v)
+		}
+	}
+	got, err := json.MarshalIndent(secrets, "", "  ")
+	if err != nil {
+		t.Fatalf("Couldn't marshal secret data: %v", err)
+	}
+
+	path := filepath.Join("testdata", "kubernetes_secrets.golden.json")
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatalf("Couldn't write golden file: %v", err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Couldn't read golden file (run with -update to create it): %v", err)
+	}
+	if diff := cmp.Diff(string(want), string(got)); diff != "" {
+		t.Errorf("Secret data differs from golden file (-want +got), run with -update if the change is intended:\n%s", diff)
+	}
+
+	// The golden secrets must also parse back into the original keys.
+	for _, test := range []struct {
+		name    string
+		get     func() (key.Key, error)
+		wantKey key.Key
+	}{
+		{"BatchSigning", func() (key.Key, error) { return store.GetBatchSigningKey(ctx, locality, ingestor) }, bsk},
+		{"PacketEncryption", func() (key.Key, error) { return store.GetPacketEncryptionKey(ctx, locality) }, pek},
+	} {
+		gotKey, err := test.get()
+		if err != nil {
+			t.Fatalf("Unexpected error getting %s key: %v", test.name, err)
+		}
+		if !test.wantKey.Equal(gotKey) {
+			t.Errorf("%s key differs from expected (-want +got):\n%s", test.name, cmp.Diff(test.wantKey, gotKey))
+		}
+	}
+}
+
+func TestKubernetesKeySchema(t *testing.T) {
+	t.Parallel()
+
+	const (
+		v1Ingestor           = "$V1_INGESTOR"
+		inconsistentIngestor = "$INCONSISTENT_INGESTOR"
+	)
+	v1SecretName := batchSigningKeyName(env, locality, v1Ingestor)
+	inconsistentSecretName := batchSigningKeyName(env, locality, inconsistentIngestor)
+	ingestors := []string{ingestor, v1Ingestor, inconsistentIngestor}
+
+	newStore := func(t *testing.T) (Key, fakeK8sSecret) {
+		store, k8s := newK8sKey()
+		k8s.putSecretKey(pekSecretName, []byte(wantPEKSecretKey))
+		k8s.putEmpty(bskSecretName)
+		if err := store.PutBatchSigningKey(ctx, locality, ingestor, wantKey); err != nil {
+			t.Fatalf("Unexpected error from PutBatchSigningKey: %v", err)
+		}
+		k8s.sd[v1SecretName] = map[string][]byte{"secret_key": []byte(wantBSKSecretKey), "key_versions": []byte(wantKeyVersions), "primary_kid": []byte(v1SecretName)}
+		k8s.sd[inconsistentSecretName] = map[string][]byte{"secret_key": []byte(wantBSKSecretKey), "key_versions": []byte(wantKeyVersions), "primary_kid": []byte(inconsistentSecretName), "primary_version": []byte("5")}
+		return store, k8s
+	}
+
+	t.Run("Verify", func(t *testing.T) {
+		t.Parallel()
+		_, k8s := newStore(t)
+		reports, err := VerifyKubernetesKeys(ctx, KubernetesSecrets{Default: k8s}, env, locality, ingestors, false)
+		if err != nil {
+			t.Fatalf("Unexpected error from VerifyKubernetesKeys: %v", err)
+		}
+		wantSchemas := map[string]KeySecretSchema{
+			pekSecretName:          KeySecretSchemaSecretKey,
+			bskSecretName:          KeySecretSchemaPrimaryVersion,
+			v1SecretName:           KeySecretSchemaKeyVersions,
+			inconsistentSecretName: KeySecretSchemaPrimaryVersion,
+		}
+		gotSchemas := map[string]KeySecretSchema{}
+		for _, r := range reports {
+			gotSchemas[r.SecretName] = r.Schema
+			if wantProblems := r.SecretName == inconsistentSecretName; (len(r.Problems) > 0) != wantProblems {
+				t.Errorf("Secret %q has problems %q (want problems = %v)", r.SecretName, r.Problems, wantProblems)
+			}
+		}
+		if diff := cmp.Diff(wantSchemas, gotSchemas); diff != "" {
+			t.Errorf("Secret schemas differ from expected (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("Migrate", func(t *testing.T) {
+		t.Parallel()
+		store, k8s := newStore(t)
+		migrated, err := MigrateKubernetesKeys(ctx, KubernetesSecrets{Default: k8s}, env, locality, ingestors, false)
+		if err != nil {
+			t.Fatalf("Unexpected error from MigrateKubernetesKeys: %v", err)
+		}
+		if diff := cmp.Diff([]string{pekSecretName, v1SecretName}, migrated); diff != "" {
+			t.Errorf("Migrated secrets differ from expected (-want +got):\n%s", diff)
+		}
+		reports, err := VerifyKubernetesKeys(ctx, KubernetesSecrets{Default: k8s}, env, locality, []string{ingestor, v1Ingestor}, false)
+		if err != nil {
+			t.Fatalf("Unexpected error from VerifyKubernetesKeys: %v", err)
+		}
+		for _, r := range reports {
+			if r.Schema != CurrentKeySecretSchema || len(r.Problems) > 0 {
+				t.Errorf("Secret %q has schema %v & problems %q after migration", r.SecretName, r.Schema, r.Problems)
+			}
+		}
+		gotKey, err := store.GetPacketEncryptionKey(ctx, locality)
+		if err != nil {
+			t.Fatalf("Unexpected error from GetPacketEncryptionKey: %v", err)
+		}
+		if !wantKey.Equal(gotKey) {
+			t.Errorf("Key differs from expected after migration (-want +got):\n%s", cmp.Diff(wantKey, gotKey))
+		}
+	})
+
+	t.Run("GetInconsistentPrimaryVersion", func(t *testing.T) {
+		t.Parallel()
+		store, _ := newStore(t)
+		if _, err := store.GetBatchSigningKey(ctx, locality, inconsistentIngestor); err == nil {
+			t.Errorf("Wanted error from GetBatchSigningKey with mismatched primary version, got none")
+		}
+	})
+}
+
+func TestKubernetesKeyCreateDelete(t *testing.T) {
+	t.Parallel()
+	tskSecretName := taskSigningKeyName(env, locality)
+
+	t.Run("CreateAndDelete", func(t *testing.T) {
+		t.Parallel()
+		store, k8s := newK8sKey()
+		if err := CreateKubernetesKeys(ctx, KubernetesSecrets{Default: k8s}, env, locality, []string{ingestor}, true); err != nil {
+			t.Fatalf("Unexpected error from CreateKubernetesKeys: %v", err)
+		}
+		for _, name := range []string{pekSecretName, bskSecretName, tskSecretName} {
+			if _, ok := k8s.sd[name]; !ok {
+				t.Errorf("Secret %q not created", name)
+			}
+		}
+		gotKey, err := store.GetBatchSigningKey(ctx, locality, ingestor)
+		if err != nil {
+			t.Fatalf("Unexpected error from GetBatchSigningKey: %v", err)
+		}
+		if !gotKey.IsEmpty() {
+			t.Errorf("Created secret holds non-empty key %v", gotKey)
+		}
+
+		if err := store.DeleteKeys(ctx, locality, []string{ingestor}); err != nil {
+			t.Fatalf("Unexpected error from DeleteKeys: %v", err)
+		}
+		if len(k8s.sd) > 0 {
+			t.Errorf("Secrets remain after DeleteKeys: %v", k8s.sd)
+		}
+		if err := store.DeleteKeys(ctx, locality, []string{ingestor}); err != nil {
+			t.Errorf("Unexpected error from DeleteKeys of deleted keys: %v", err)
+		}
+	})
+
+	t.Run("CreateExisting", func(t *testing.T) {
+		t.Parallel()
+		_, k8s := newK8sKey()
+		k8s.putSecretKey(bskSecretName, []byte(wantBSKSecretKey))
+		if err := CreateKubernetesKeys(ctx, KubernetesSecrets{Default: k8s}, env, locality, []string{ingestor}, true); err == nil {
+			t.Errorf("Wanted error from CreateKubernetesKeys with existing secret, got none")
+		}
+		if diff := cmp.Diff(map[string]map[string][]byte{bskSecretName: {"secret_key": []byte(wantBSKSecretKey)}}, k8s.sd); diff != "" {
+			t.Errorf("Secrets differ from expected after failed CreateKubernetesKeys (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestKubernetesKeyByIngestor(t *testing.T) {
+	t.Parallel()
+	const otherIngestor = "$OTHER_INGESTOR"
+	otherBSKSecretName := batchSigningKeyName(env, locality, otherIngestor)
+	tskSecretName := taskSigningKeyName(env, locality)
+	ingestors := []string{ingestor, otherIngestor}
+
+	localityK8s := newFakeK8sSecret()
+	ingestorK8s := newFakeK8sSecret()
+	secrets := KubernetesSecrets{Default: localityK8s, ByIngestor: map[string]k8s.SecretInterface{ingestor: ingestorK8s}}
+	store := NewKubernetesKeyWithSecrets(secrets, env)
+
+	// Secrets are created in the namespace selected for each key.
+	if err := CreateKubernetesKeys(ctx, secrets, env, locality, ingestors, true); err != nil {
+		t.Fatalf("Unexpected error from CreateKubernetesKeys: %v", err)
+	}
+	for _, test := range []struct {
+		k8s   fakeK8sSecret
+		names []string
+	}{
+		{localityK8s, []string{pekSecretName, otherBSKSecretName, tskSecretName}},
+		{ingestorK8s, []string{bskSecretName}},
+	} {
+		var gotNames []string
+		for name := range test.k8s.sd {
+			gotNames = append(gotNames, name)
+		}
+		sort.Strings(gotNames)
+		sort.Strings(test.names)
+		if diff := cmp.Diff(test.names, gotNames); diff != "" {
+			t.Errorf("Created secrets differ from expected (-want +got):\n%s", diff)
+		}
+	}
+
+	// Keys are read from & written to the same namespaces.
+	if err := store.PutBatchSigningKey(ctx, locality, ingestor, wantKey); err != nil {
+		t.Fatalf("Unexpected error from PutBatchSigningKey: %v", err)
+	}
+	if _, ok := ingestorK8s.sd[bskSecretName]["key_versions"]; !ok {
+		t.Errorf("Batch signing key not written to ingestor's namespace: %v", ingestorK8s.sd[bskSecretName])
+	}
+	gotKey, err := store.GetBatchSigningKey(ctx, locality, ingestor)
+	if err != nil {
+		t.Fatalf("Unexpected error from GetBatchSigningKey: %v", err)
+	}
+	if !wantKey.Equal(gotKey) {
+		t.Errorf("Key differs from expected (-want +got):\n%s", cmp.Diff(wantKey, gotKey))
+	}
+	if err := store.PutPacketEncryptionKey(ctx, locality, wantKey); err != nil {
+		t.Fatalf("Unexpected error from PutPacketEncryptionKey: %v", err)
+	}
+	if _, ok := localityK8s.sd[pekSecretName]["key_versions"]; !ok {
+		t.Errorf("Packet encryption key not written to default namespace: %v", localityK8s.sd[pekSecretName])
+	}
+
+	reports, err := VerifyKubernetesKeys(ctx, secrets, env, locality, ingestors, true)
+	if err != nil {
+		t.Fatalf("Unexpected error from VerifyKubernetesKeys: %v", err)
+	}
+	if len(reports) != 4 {
+		t.Errorf("Wanted 4 secret reports, got %v", reports)
+	}
+
+	if err := store.DeleteKeys(ctx, locality, ingestors); err != nil {
+		t.Fatalf("Unexpected error from DeleteKeys: %v", err)
+	}
+	if len(localityK8s.sd) > 0 || len(ingestorK8s.sd) > 0 {
+		t.Errorf("Secrets remain after DeleteKeys: %v, %v", localityK8s.sd, ingestorK8s.sd)
+	}
+}
+
+func TestKubernetesKeyKMS(t *testing.T) {
+	t.Parallel()
+	const ref = "projects/$PROJECT/locations/$LOCATION/keyRings/$KEY_RING/cryptoKeys/$KEY/cryptoKeyVersions/1"
+	kmsMaterial, err := key.KMSMaterialFrom(ref, wantKey.Primary().KeyMaterial.Public())
+	if err != nil {
+		t.Fatalf("Couldn't create KMS key material: %v", err)
+	}
+	kmsKey := k(kv(1, kmsMaterial))
+	store, k8s := newK8sKey()
+	k8s.putSecretKey(bskSecretName, []byte(secretKeyUnfilledValue))
+
+	// Only the reference to the KMS key is written, in place of the PKCS#8
+	// private key.
+	if err := store.PutBatchSigningKey(ctx, locality, ingestor, kmsKey); err != nil {
+		t.Fatalf("Unexpected error from PutBatchSigningKey: %v", err)
+	}
+	sd := k8s.sd[bskSecretName]
+	if got := string(sd["secret_key"]); got != secretKeyUnfilledValue {
+		t.Errorf("secret_key = %q, want %q", got, secretKeyUnfilledValue)
+	}
+	if got := string(sd["kms_key"]); got != ref {
+		t.Errorf("kms_key = %q, want %q", got, ref)
+	}
+	gotKey, err := store.GetBatchSigningKey(ctx, locality, ingestor)
+	if err != nil {
+		t.Fatalf("Unexpected error from GetBatchSigningKey: %v", err)
+	}
+	if !kmsKey.Equal(gotKey) {
+		t.Errorf("Key differs from expected (-want +got):\n%s", cmp.Diff(kmsKey, gotKey))
+	}
+
+	// Once the primary version is no longer held in a KMS, kms_key is
+	// removed.
+	if err := store.PutBatchSigningKey(ctx, locality, ingestor, wantKey); err != nil {
+		t.Fatalf("Unexpected error from PutBatchSigningKey: %v", err)
+	}
+	if got, ok := k8s.sd[bskSecretName]["kms_key"]; ok {
+		t.Errorf("kms_key = %q after writing key not held in KMS, want none", got)
+	}
+}
+
+func TestKubernetesKeyHistory(t *testing.T) {
+	t.Parallel()
+	newKey := func(ts int64) key.Key {
+		m, err := key.P256.NewFrom(mathrand.New(mathrand.NewSource(ts))) // nolint:gosec // Use of non-cryptographic RNG is purposeful here.
+		if err != nil {
+			t.Fatalf("Couldn't create key: %v", err)
+		}
+		return k(kv(ts, m))
+	}
+	keys := []key.Key{newKey(10), newKey(20), newKey(30), newKey(40), newKey(50)}
+
+	k8s := newFakeK8sSecret()
+	k8s.putEmpty(bskSecretName)
+	k8s.sd[bskSecretName]["other"] = []byte("$OTHER")
+	secrets := KubernetesSecrets{Default: k8s}
+	checkHistory := func(desc string, want ...key.Key) {
+		t.Helper()
+		got, err := GetKubernetesKeyHistory(ctx, secrets, env, "batch-signing", locality, ingestor)
+		if err != nil {
+			t.Fatalf("%s: unexpected error from GetKubernetesKeyHistory: %v", desc, err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("%s: got %d previous keys, want %d", desc, len(got), len(want))
+		}
+		for i := range want {
+			if !want[i].Equal(got[i]) {
+				t.Errorf("%s: previous key %d differs from expected: %s", desc, i+1, want[i].Diff(got[i]))
+			}
+		}
+	}
+
+	// Replacing an empty key, or rewriting an unchanged one, keeps nothing.
+	store := NewKubernetesKeyWithHistory(secrets, env, 2)
+	for _, kk := range []key.Key{keys[0], keys[0]} {
+		if err := store.PutBatchSigningKey(ctx, locality, ingestor, kk); err != nil {
+			t.Fatalf("Unexpected error from PutBatchSigningKey: %v", err)
+		}
+	}
+	checkHistory("after first write")
+
+	// Replaced keys are kept most recent first, up to the history limit.
+	for _, kk := range keys[1:4] {
+		if err := store.PutBatchSigningKey(ctx, locality, ingestor, kk); err != nil {
+			t.Fatalf("Unexpected error from PutBatchSigningKey: %v", err)
+		}
+	}
+	checkHistory("after rotations", keys[2], keys[1])
+	if got, err := store.GetBatchSigningKey(ctx, locality, ingestor); err != nil || !got.Equal(keys[3]) {
+		t.Errorf("GetBatchSigningKey = %v, %v, want current key", got, err)
+	}
+
+	// Reducing the history limit drops older keys on the next write.
+	store = NewKubernetesKeyWithHistory(secrets, env, 1)
+	if err := store.PutBatchSigningKey(ctx, locality, ingestor, keys[4]); err != nil {
+		t.Fatalf("Unexpected error from PutBatchSigningKey: %v", err)
+	}
+	checkHistory("after reducing history", keys[3])
+
+	// Without history, kept keys are left untouched.
+	store = NewKubernetesKeyWithSecrets(secrets, env)
+	if err := store.PutBatchSigningKey(ctx, locality, ingestor, keys[0]); err != nil {
+		t.Fatalf("Unexpected error from PutBatchSigningKey: %v", err)
+	}
+	checkHistory("without history", keys[3])
+	if got := string(k8s.sd[bskSecretName]["other"]); got != "$OTHER" {
+		t.Errorf("Unrelated secret data = %q, want %q", got, "$OTHER")
+	}
+
+	if _, err := GetKubernetesKeyHistory(ctx, secrets, env, "bogus", locality, ingestor); err == nil {
+		t.Errorf("Wanted error from GetKubernetesKeyHistory for unknown kind of key")
+	}
+}
+
+func TestRemoveKubernetesKeyHistoryVersion(t *testing.T) {
+	t.Parallel()
+	newVersion := func(ts int64) key.Version {
+		m, err := key.P256.NewFrom(mathrand.New(mathrand.NewSource(ts))) // nolint:gosec // Use of non-cryptographic RNG is purposeful here.
+		if err != nil {
+			t.Fatalf("Couldn't create key: %v", err)
+		}
+		return kv(ts, m)
+	}
+	v10, v20, v30, v40 := newVersion(10), newVersion(20), newVersion(30), newVersion(40)
+
+	k8s := newFakeK8sSecret()
+	k8s.putEmpty(bskSecretName)
+	secrets := KubernetesSecrets{Default: k8s}
+	store := NewKubernetesKeyWithHistory(secrets, env, 3)
+	for _, kk := range []key.Key{k(v10), k(v20, v10), k(v30, v20, v10), k(v40, v30)} {
+		if err := store.PutBatchSigningKey(ctx, locality, ingestor, kk); err != nil {
+			t.Fatalf("Unexpected error from PutBatchSigningKey: %v", err)
+		}
+	}
+
+	// Revoking version 10 changes the previous keys containing it, & discards
+	// the one of which it is the primary version.
+	n, err := RemoveKubernetesKeyHistoryVersion(ctx, secrets, env, "batch-signing", locality, ingestor, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error from RemoveKubernetesKeyHistoryVersion: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("RemoveKubernetesKeyHistoryVersion changed %d previous keys, want 3", n)
+	}
+	if _, ok := k8s.sd[bskSecretName][previousKeyVersionsSecretKey(3)]; ok {
+		t.Errorf("Secret still holds %q after its previous key was discarded", previousKeyVersionsSecretKey(3))
+	}
+
+	// A subsequent rollback cannot restore the revoked version.
+	history, err := GetKubernetesKeyHistory(ctx, secrets, env, "batch-signing", locality, ingestor)
+	if err != nil {
+		t.Fatalf("Unexpected error from GetKubernetesKeyHistory: %v", err)
+	}
+	want := []key.Key{k(v30, v20), k(v20)}
+	if len(history) != len(want) {
+		t.Fatalf("Got %d previous keys after revocation, want %d", len(history), len(want))
+	}
+	for i := range want {
+		if !want[i].Equal(history[i]) {
+			t.Errorf("Previous key %d differs from expected: %s", i+1, want[i].Diff(history[i]))
+		}
+	}
+	if got, err := store.GetBatchSigningKey(ctx, locality, ingestor); err != nil || !got.Equal(k(v40, v30)) {
+		t.Errorf("GetBatchSigningKey = %v, %v, want current key", got, err)
+	}
+
+	// Removing a version no previous key contains changes nothing, as does
+	// removing one from a secret which does not exist.
+	if n, err := RemoveKubernetesKeyHistoryVersion(ctx, secrets, env, "batch-signing", locality, ingestor, 10); err != nil || n != 0 {
+		t.Errorf("RemoveKubernetesKeyHistoryVersion of removed version = %d, %v, want 0, nil", n, err)
+	}
+	if n, err := RemoveKubernetesKeyHistoryVersion(ctx, secrets, env, "packet-encryption", locality, ingestor, 20); err != nil || n != 0 {
+		t.Errorf("RemoveKubernetesKeyHistoryVersion for missing secret = %d, %v, want 0, nil", n, err)
+	}
+}
+
+func TestPacketEncryptionSecretKeyX25519(t *testing.T) {
+	t.Parallel()
+
+	// During a transition to X25519, a packet encryption key holds both
+	// X25519 & legacy P256 versions; each is serialized in its own format.
+	x25519Material, err := key.X25519.New()
+	if err != nil {
+		t.Fatalf("Couldn't create X25519 key: %v", err)
+	}
+	p256Material, err := key.P256.New()
+	if err != nil {
+		t.Fatalf("Couldn't create P256 key: %v", err)
+	}
+	secretKey, err := serializePacketEncryptionSecretKey(k(kv(20, x25519Material), kv(10, p256Material)))
+	if err != nil {
+		t.Fatalf("Unexpected error from serializePacketEncryptionSecretKey: %v", err)
+	}
+
+	versions := strings.Split(string(secretKey), ",")
+	if len(versions) != 2 {
+		t.Fatalf("Secret key has %d versions, want 2: %q", len(versions), secretKey)
+	}
+	for i, want := range []key.Material{x25519Material, p256Material} {
+		keyMaterialBytes, err := base64.StdEncoding.DecodeString(versions[i])
+		if err != nil {
+			t.Fatalf("Couldn't base64-decode version %d: %v", i, err)
+		}
+		got, err := parsePacketEncryptionSecretKey(keyMaterialBytes)
+		if err != nil {
+			t.Fatalf("Unexpected error from parsePacketEncryptionSecretKey for %v version: %v", want.Type(), err)
+		}
+		if !got.Equal(want) {
+			t.Errorf("Parsed %v version does not match serialized version", want.Type())
+		}
+	}
+
+	if _, err := parsePacketEncryptionSecretKey([]byte("not a key")); err == nil {
+		t.Errorf("Wanted error from parsePacketEncryptionSecretKey for garbage input")
+	}
+}
+
+func TestCheckKubernetesKeySecret(t *testing.T) {
+	t.Parallel()
+	k8s := newFakeK8sSecret()
+	k8s.putEmpty(bskSecretName)
+	secrets := KubernetesSecrets{Default: k8s}
+	want := map[string][]byte{}
+	for k, v := range k8s.sd[bskSecretName] {
+		want[k] = v
+	}
+
+	secretName, readErr, writeErr := CheckKubernetesKeySecret(ctx, secrets, env, "batch-signing", locality, ingestor)
+	if secretName != bskSecretName || readErr != nil || writeErr != nil {
+		t.Errorf("Unexpected result from CheckKubernetesKeySecret: %q, %v, %v", secretName, readErr, writeErr)
+	}
+	if diff := cmp.Diff(want, k8s.sd[bskSecretName]); diff != "" {
+		t.Errorf("CheckKubernetesKeySecret modified secret (-want +got):\n%s", diff)
+	}
+
+	// A secret which doesn't exist can be neither read nor written.
+	secretName, readErr, writeErr = CheckKubernetesKeySecret(ctx, secrets, env, "packet-encryption", locality, "")
+	if secretName != pekSecretName || readErr == nil || writeErr == nil {
+		t.Errorf("Unexpected result from CheckKubernetesKeySecret for missing secret: %q, %v, %v", secretName, readErr, writeErr)
+	}
+
+	if _, readErr, writeErr := CheckKubernetesKeySecret(ctx, secrets, env, "kittens", locality, ""); readErr == nil || writeErr == nil {
+		t.Errorf("Wanted error from CheckKubernetesKeySecret for unknown kind of key")
+	}
+}
+
 func TestAWSKey(t *testing.T) {
 	t.Parallel()
 
@@ -356,6 +932,65 @@ func TestAWSKey(t *testing.T) {
 			}
 		})
 	})
+
+	t.Run("Replication", func(t *testing.T) {
+		t.Parallel()
+
+		t.Run("key does not already exist", func(t *testing.T) {
+			t.Parallel()
+			store, aws := newAWSKey("us-east-1", "us-west-2")
+			if err := store.PutBatchSigningKey(ctx, locality, ingestor, wantKey); err != nil {
+				t.Fatalf("Unexpected error from PutBatchSigningKey: %v", err)
+			}
+			wantReplicas := map[string]string{"us-east-1": secretsmanager.StatusTypeInProgress, "us-west-2": secretsmanager.StatusTypeInProgress}
+			if diff := cmp.Diff(wantReplicas, aws.replicas[bskSecretName]); diff != "" {
+				t.Errorf("Secret replicas differ from expected (-want +got):\n%s", diff)
+			}
+		})
+
+		t.Run("key exists without replicas", func(t *testing.T) {
+			t.Parallel()
+			store, aws := newAWSKey("us-east-1", "us-west-2")
+			aws.put(bskSecretName, []byte("arbitrary existing key material"))
+			aws.putReplica(bskSecretName, "us-east-1", secretsmanager.StatusTypeInSync)
+			if err := store.PutBatchSigningKey(ctx, locality, ingestor, wantKey); err != nil {
+				t.Fatalf("Unexpected error from PutBatchSigningKey: %v", err)
+			}
+			wantReplicas := map[string]string{"us-east-1": secretsmanager.StatusTypeInSync, "us-west-2": secretsmanager.StatusTypeInProgress}
+			if diff := cmp.Diff(wantReplicas, aws.replicas[bskSecretName]); diff != "" {
+				t.Errorf("Secret replicas differ from expected (-want +got):\n%s", diff)
+			}
+		})
+
+		t.Run("replication failed", func(t *testing.T) {
+			t.Parallel()
+			store, aws := newAWSKey("us-west-2")
+			aws.put(bskSecretName, []byte("arbitrary existing key material"))
+			aws.putReplica(bskSecretName, "us-west-2", secretsmanager.StatusTypeFailed)
+			if err := store.PutBatchSigningKey(ctx, locality, ingestor, wantKey); err == nil {
+				t.Errorf("Wanted error from PutBatchSigningKey with failed replica, got none")
+			}
+		})
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		t.Parallel()
+		store, aws := newAWSKey("us-west-2")
+		if err := store.PutBatchSigningKey(ctx, locality, ingestor, wantKey); err != nil {
+			t.Fatalf("Unexpected error from PutBatchSigningKey: %v", err)
+		}
+		if err := store.PutPacketEncryptionKey(ctx, locality, wantKey); err != nil {
+			t.Fatalf("Unexpected error from PutPacketEncryptionKey: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := store.DeleteKeys(ctx, locality, []string{ingestor}); err != nil {
+				t.Fatalf("Unexpected error from DeleteKeys (attempt %d): %v", i, err)
+			}
+			if len(aws.sd) > 0 {
+				t.Errorf("Secrets remain after DeleteKeys (attempt %d): %v", i, aws.sd)
+			}
+		}
+	})
 }
 
 func TestGCPKey(t *testing.T) {
@@ -490,6 +1125,50 @@ func TestGCPKey(t *testing.T) {
 			}
 		})
 	})
+
+	t.Run("Replication", func(t *testing.T) {
+		t.Parallel()
+
+		t.Run("key does not already exist", func(t *testing.T) {
+			t.Parallel()
+			store, gcp := newGCPKey("us-east1", "us-west1")
+			if err := store.PutBatchSigningKey(ctx, locality, ingestor, wantKey); err != nil {
+				t.Fatalf("Unexpected error from PutBatchSigningKey: %v", err)
+			}
+			var gotLocations []string
+			for _, replica := range gcp.replication[bskSecretName].GetUserManaged().GetReplicas() {
+				gotLocations = append(gotLocations, replica.GetLocation())
+			}
+			if diff := cmp.Diff([]string{"us-east1", "us-west1"}, gotLocations); diff != "" {
+				t.Errorf("Secret replica locations differ from expected (-want +got):\n%s", diff)
+			}
+		})
+
+		t.Run("key exists with automatic replication", func(t *testing.T) {
+			t.Parallel()
+			store, gcp := newGCPKey("us-east1", "us-west1")
+			gcp.put(bskSecretName, []byte("arbitrary existing key material"))
+			if err := store.PutBatchSigningKey(ctx, locality, ingestor, wantKey); err == nil {
+				t.Errorf("Wanted error from PutBatchSigningKey with automatically-replicated secret, got none")
+			}
+		})
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		t.Parallel()
+		store, gcp := newGCPKey()
+		if err := store.PutBatchSigningKey(ctx, locality, ingestor, wantKey); err != nil {
+			t.Fatalf("Unexpected error from PutBatchSigningKey: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := store.DeleteKeys(ctx, locality, []string{ingestor}); err != nil {
+				t.Fatalf("Unexpected error from DeleteKeys (attempt %d): %v", i, err)
+			}
+			if len(gcp.sd) > 0 {
+				t.Errorf("Secrets remain after DeleteKeys (attempt %d): %v", i, gcp.sd)
+			}
+		}
+	})
 }
 
 func mustP256From(privKey *ecdsa.PrivateKey) key.Material {
@@ -518,6 +1197,396 @@ func kv(ts int64, k key.Material) key.Version {
 	}
 }
 
+func TestVaultKey(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Put", func(t *testing.T) {
+		t.Parallel()
+		store, vault := newVaultKey(t)
+		if err := store.PutBatchSigningKey(ctx, locality, ingestor, wantKey); err != nil {
+			t.Fatalf("Unexpected error from PutBatchSigningKey: %v", err)
+		}
+		wantSD := map[string]string{"key_versions": wantKeyVersions}
+		if diff := cmp.Diff(wantSD, vault.get(bskSecretName)); diff != "" {
+			t.Errorf("Batch signing key secret data differs from expected (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("Get", func(t *testing.T) {
+		t.Parallel()
+		store, vault := newVaultKey(t)
+		vault.put(pekSecretName, map[string]string{"key_versions": wantKeyVersions})
+		gotKey, err := store.GetPacketEncryptionKey(ctx, locality)
+		if err != nil {
+			t.Fatalf("Unexpected error from GetPacketEncryptionKey: %v", err)
+		}
+		if !wantKey.Equal(gotKey) {
+			diff := cmp.Diff(wantKey, gotKey)
+			t.Errorf("Key differs from expected (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("Get, no such secret", func(t *testing.T) {
+		t.Parallel()
+		store, _ := newVaultKey(t)
+		if _, err := store.GetPacketEncryptionKey(ctx, locality); err == nil {
+			t.Errorf("Wanted error from GetPacketEncryptionKey, got none")
+		}
+	})
+
+	t.Run("Bad token", func(t *testing.T) {
+		t.Parallel()
+		_, vault := newVaultKey(t)
+		store := NewVaultKey(vault.srv.Client(), VaultConfig{Address: vault.srv.URL, Token: "$OTHER_VAULT_TOKEN", Mount: "secret"}, env)
+		if err := store.PutPacketEncryptionKey(ctx, locality, wantKey); err == nil {
+			t.Errorf("Wanted error from PutPacketEncryptionKey, got none")
+		}
+	})
+
+	t.Run("DeleteKeys", func(t *testing.T) {
+		t.Parallel()
+		store, vault := newVaultKey(t)
+		vault.put(pekSecretName, map[string]string{"key_versions": wantKeyVersions})
+		vault.put(bskSecretName, map[string]string{"key_versions": wantKeyVersions})
+		if err := store.DeleteKeys(ctx, locality, []string{ingestor}); err != nil {
+			t.Fatalf("Unexpected error from DeleteKeys: %v", err)
+		}
+		for _, name := range []string{pekSecretName, bskSecretName} {
+			if sd := vault.get(name); sd != nil {
+				t.Errorf("Secret %q remains after DeleteKeys: %v", name, sd)
+			}
+		}
+	})
+
+	t.Run("Expired token", func(t *testing.T) {
+		t.Parallel()
+		_, vault := newVaultKey(t)
+		var logins int
+		cfg := VaultConfig{Address: vault.srv.URL, Token: "$EXPIRED_VAULT_TOKEN", Mount: "secret"}
+		cfg.Login = func(ctx context.Context) (string, error) {
+			logins++
+			return VaultKubernetesLogin(ctx, vault.srv.Client(), cfg, "kubernetes", "key-rotator", "$SERVICE_ACCOUNT_TOKEN")
+		}
+		store := NewVaultKey(vault.srv.Client(), cfg, env)
+		for i := 0; i < 2; i++ {
+			if err := store.PutPacketEncryptionKey(ctx, locality, wantKey); err != nil {
+				t.Fatalf("Unexpected error from PutPacketEncryptionKey: %v", err)
+			}
+		}
+		if logins != 1 {
+			t.Errorf("Logged in %d times, want 1", logins)
+		}
+
+		cfg.Login = func(context.Context) (string, error) { return "", errors.New("login failed") }
+		store = NewVaultKey(vault.srv.Client(), cfg, env)
+		if err := store.PutPacketEncryptionKey(ctx, locality, wantKey); err == nil {
+			t.Errorf("Wanted error from PutPacketEncryptionKey with failed login, got none")
+		}
+	})
+
+	t.Run("KubernetesLogin", func(t *testing.T) {
+		t.Parallel()
+		_, vault := newVaultKey(t)
+		cfg := VaultConfig{Address: vault.srv.URL, Mount: "secret"}
+		token, err := VaultKubernetesLogin(ctx, vault.srv.Client(), cfg, "kubernetes", "key-rotator", "$SERVICE_ACCOUNT_TOKEN")
+		if err != nil {
+			t.Fatalf("Unexpected error from VaultKubernetesLogin: %v", err)
+		}
+		if token != vault.token {
+			t.Errorf("VaultKubernetesLogin = %q, want %q", token, vault.token)
+		}
+		if _, err := VaultKubernetesLogin(ctx, vault.srv.Client(), cfg, "kubernetes", "key-rotator", "$OTHER_TOKEN"); err == nil {
+			t.Errorf("Wanted error from VaultKubernetesLogin with bad service account token, got none")
+		}
+	})
+}
+
+func TestCompositeKey(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Put", func(t *testing.T) {
+		t.Parallel()
+		for _, test := range []struct {
+			name          string
+			writeMode     WriteMode
+			failingMirror []bool
+			wantErr       bool
+		}{
+			{"all, no failures", WriteAll, []bool{false, false}, false},
+			{"all, one failure", WriteAll, []bool{false, true}, true},
+			{"quorum, no failures", WriteQuorum, []bool{false, false}, false},
+			{"quorum, one failure", WriteQuorum, []bool{false, true}, false},
+			{"quorum, two failures", WriteQuorum, []bool{true, true}, true},
+			{"quorum, one failure of one mirror", WriteQuorum, []bool{true}, true},
+			{"best-effort, two failures", WriteBestEffort, []bool{true, true}, false},
+		} {
+			test := test
+			t.Run(test.name, func(t *testing.T) {
+				t.Parallel()
+				primary, primaryK8s := newK8sKey()
+				primaryK8s.putEmpty(pekSecretName)
+				var mirrors []Key
+				var mirrorK8s []fakeK8sSecret
+				for _, failing := range test.failingMirror {
+					mirror, k8s := newK8sKey()
+					k8s.putEmpty(pekSecretName)
+					if failing {
+						mirror = failingKey{}
+					}
+					mirrors = append(mirrors, mirror)
+					mirrorK8s = append(mirrorK8s, k8s)
+				}
+				store := NewCompositeKey(primary, mirrors, CompositeKeyConfig{WriteMode: test.writeMode})
+
+				err := store.PutPacketEncryptionKey(ctx, locality, wantKey)
+				if test.wantErr {
+					if err == nil {
+						t.Fatalf("Wanted error from PutPacketEncryptionKey, got none")
+					}
+					if _, ok := primaryK8s.sd[pekSecretName]["key_versions"]; ok {
+						t.Errorf("Key written to primary storage despite failed mirror writes")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("Unexpected error from PutPacketEncryptionKey: %v", err)
+				}
+				for i, k8s := range append([]fakeK8sSecret{primaryK8s}, mirrorK8s...) {
+					if i > 0 && test.failingMirror[i-1] {
+						continue
+					}
+					if _, ok := k8s.sd[pekSecretName]["key_versions"]; !ok {
+						t.Errorf("Key not written to store %d", i)
+					}
+				}
+			})
+		}
+	})
+
+	t.Run("Put, primary failure", func(t *testing.T) {
+		t.Parallel()
+		mirror, _ := newK8sKey()
+		store := NewCompositeKey(failingKey{}, []Key{mirror}, CompositeKeyConfig{WriteMode: WriteBestEffort})
+		if err := store.PutPacketEncryptionKey(ctx, locality, wantKey); err == nil {
+			t.Errorf("Wanted error from PutPacketEncryptionKey, got none")
+		}
+	})
+
+	t.Run("Get", func(t *testing.T) {
+		t.Parallel()
+		for _, test := range []struct {
+			name         string
+			readFallback bool
+			wantErr      bool
+		}{
+			{"no fallback", false, true},
+			{"fallback", true, false},
+		} {
+			test := test
+			t.Run(test.name, func(t *testing.T) {
+				t.Parallel()
+				emptyMirror, _ := newK8sKey()
+				mirror, k8s := newK8sKey()
+				k8s.putKeyVersions(pekSecretName, []byte(wantKeyVersions))
+				store := NewCompositeKey(failingKey{}, []Key{emptyMirror, mirror}, CompositeKeyConfig{ReadFallback: test.readFallback})
+
+				gotKey, err := store.GetPacketEncryptionKey(ctx, locality)
+				if test.wantErr {
+					if err == nil {
+						t.Errorf("Wanted error from GetPacketEncryptionKey, got none")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("Unexpected error from GetPacketEncryptionKey: %v", err)
+				}
+				if !wantKey.Equal(gotKey) {
+					t.Errorf("GetPacketEncryptionKey = %v, want %v", gotKey, wantKey)
+				}
+			})
+		}
+	})
+
+	t.Run("DeleteKeys", func(t *testing.T) {
+		t.Parallel()
+		primary, primaryK8s := newK8sKey()
+		mirror, mirrorK8s := newK8sKey()
+		for _, k8s := range []fakeK8sSecret{primaryK8s, mirrorK8s} {
+			k8s.putEmpty(pekSecretName)
+			k8s.putEmpty(bskSecretName)
+		}
+		store := NewCompositeKey(primary, []Key{mirror, failingKey{}}, CompositeKeyConfig{WriteMode: WriteQuorum})
+		if err := store.DeleteKeys(ctx, locality, []string{ingestor}); err != nil {
+			t.Fatalf("Unexpected error from DeleteKeys: %v", err)
+		}
+		for i, k8s := range []fakeK8sSecret{primaryK8s, mirrorK8s} {
+			if len(k8s.sd) > 0 {
+				t.Errorf("Keys remain in store %d: %v", i, k8s.sd)
+			}
+		}
+	})
+}
+
+func TestMigratingKey(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Put", func(t *testing.T) {
+		t.Parallel()
+		to, toK8s := newK8sKey()
+		from, fromK8s := newK8sKey()
+		for _, k8s := range []fakeK8sSecret{toK8s, fromK8s} {
+			k8s.putEmpty(pekSecretName)
+		}
+		if err := NewMigratingKey(to, from).PutPacketEncryptionKey(ctx, locality, wantKey); err != nil {
+			t.Fatalf("Unexpected error from PutPacketEncryptionKey: %v", err)
+		}
+		for name, k8s := range map[string]fakeK8sSecret{"to": toK8s, "from": fromK8s} {
+			if _, ok := k8s.sd[pekSecretName]["key_versions"]; !ok {
+				t.Errorf("Key not written to %q store", name)
+			}
+		}
+	})
+
+	t.Run("Put, source failure", func(t *testing.T) {
+		t.Parallel()
+		to, toK8s := newK8sKey()
+		toK8s.putEmpty(pekSecretName)
+		if err := NewMigratingKey(to, failingKey{}).PutPacketEncryptionKey(ctx, locality, wantKey); err == nil {
+			t.Fatalf("Wanted error from PutPacketEncryptionKey, got none")
+		}
+		if _, ok := toK8s.sd[pekSecretName]["key_versions"]; ok {
+			t.Errorf("Key written to migration target despite failed write to migration source")
+		}
+	})
+
+	t.Run("Get", func(t *testing.T) {
+		t.Parallel()
+		populated := func() Key {
+			k, k8s := newK8sKey()
+			k8s.putKeyVersions(pekSecretName, []byte(wantKeyVersions))
+			return k
+		}
+		empty := func() Key { k, k8s := newK8sKey(); k8s.putEmpty(pekSecretName); return k }
+		missing := func() Key { k, _ := newK8sKey(); return k }
+		failing := func() Key { return failingKey{} }
+
+		for _, test := range []struct {
+			name     string
+			to, from func() Key
+			wantErr  bool
+		}{
+			{"migrated", populated, failing, false},
+			{"empty in target", empty, populated, false},
+			{"missing in target", missing, populated, false},
+			{"missing in both", missing, failing, true},
+		} {
+			test := test
+			t.Run(test.name, func(t *testing.T) {
+				t.Parallel()
+				gotKey, err := NewMigratingKey(test.to(), test.from()).GetPacketEncryptionKey(ctx, locality)
+				if test.wantErr {
+					if err == nil {
+						t.Errorf("Wanted error from GetPacketEncryptionKey, got none")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("Unexpected error from GetPacketEncryptionKey: %v", err)
+				}
+				if !wantKey.Equal(gotKey) {
+					t.Errorf("GetPacketEncryptionKey = %v, want %v", gotKey, wantKey)
+				}
+			})
+		}
+	})
+
+	t.Run("DeleteKeys", func(t *testing.T) {
+		t.Parallel()
+		to, toK8s := newK8sKey()
+		from, fromK8s := newK8sKey()
+		for _, k8s := range []fakeK8sSecret{toK8s, fromK8s} {
+			k8s.putEmpty(pekSecretName)
+			k8s.putEmpty(bskSecretName)
+		}
+		if err := NewMigratingKey(to, from).DeleteKeys(ctx, locality, []string{ingestor}); err != nil {
+			t.Fatalf("Unexpected error from DeleteKeys: %v", err)
+		}
+		for name, k8s := range map[string]fakeK8sSecret{"to": toK8s, "from": fromK8s} {
+			if len(k8s.sd) > 0 {
+				t.Errorf("Keys remain in %q store: %v", name, k8s.sd)
+			}
+		}
+	})
+}
+
+func TestWatchKubernetesKeys(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	firstWatch, secondWatch := watch.NewFake(), watch.NewFake()
+	secrets := &watchingK8sSecret{watchers: []*watch.FakeWatcher{firstWatch, secondWatch}}
+	ch, err := WatchKubernetesKeys(ctx, KubernetesSecrets{Default: secrets}, env, "asgard", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from WatchKubernetesKeys: %v", err)
+	}
+	pekName := packetEncryptionKeyName(env, "asgard")
+	secret := func(name, resourceVersion string) *k8sapi.Secret {
+		return &k8sapi.Secret{ObjectMeta: k8smeta.ObjectMeta{Name: name, ResourceVersion: resourceVersion}}
+	}
+	receive := func() string {
+		select {
+		case name := <-ch:
+			return name
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for secret change")
+			return ""
+		}
+	}
+
+	// Added events don't indicate drift, and changes made while a name is
+	// pending are coalesced.
+	firstWatch.Add(secret(pekName, "1"))
+	firstWatch.Modify(secret(pekName, "2"))
+	firstWatch.Delete(secret(pekName, "3"))
+	firstWatch.Modify(secret("unwatched-secret", "4"))
+	if got := receive(); got != pekName {
+		t.Errorf("Got change to secret %q, want %q", got, pekName)
+	}
+	select {
+	case name := <-ch:
+		t.Errorf("Got unexpected change to secret %q", name)
+	default:
+	}
+
+	// An expired resource version re-establishes the watch from the current
+	// state, reporting a change since changes may have been missed.
+	firstWatch.Error(&k8smeta.Status{Status: k8smeta.StatusFailure, Code: http.StatusGone, Reason: k8smeta.StatusReasonExpired})
+	if got := receive(); got != pekName {
+		t.Errorf("Got change to secret %q, want %q", got, pekName)
+	}
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	if diff := cmp.Diff([]string{"", ""}, secrets.resourceVersions); diff != "" {
+		t.Errorf("Unexpected watch resource versions (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseWriteMode(t *testing.T) {
+	t.Parallel()
+	for _, mode := range []WriteMode{WriteAll, WriteQuorum, WriteBestEffort} {
+		got, err := ParseWriteMode(mode.String())
+		if err != nil {
+			t.Errorf("Unexpected error from ParseWriteMode(%q): %v", mode, err)
+		} else if got != mode {
+			t.Errorf("ParseWriteMode(%q) = %v, want %v", mode, got, mode)
+		}
+	}
+	if _, err := ParseWriteMode("most"); err == nil {
+		t.Errorf("Wanted error from ParseWriteMode(%q), got none", "most")
+	}
+}
+
 func mustInt(digits string) *big.Int {
 	var z big.Int
 	if _, ok := z.SetString(digits, 10); !ok {
@@ -526,22 +1595,155 @@ func mustInt(digits string) *big.Int {
 	return &z
 }
 
+// newVaultKey creates a new Vault-based key implementation, based on a fake
+// Vault server that reads & writes secrets data to memory.
+func newVaultKey(t *testing.T) (Key, *fakeVault) {
+	vault := &fakeVault{sd: map[string]map[string]string{}, token: "$VAULT_TOKEN"}
+	vault.srv = httptest.NewServer(vault)
+	t.Cleanup(vault.srv.Close)
+	return NewVaultKey(vault.srv.Client(), VaultConfig{Address: vault.srv.URL, Token: vault.token, Mount: "secret"}, env), vault
+}
+
+type fakeVault struct {
+	srv   *httptest.Server
+	token string
+
+	mu sync.Mutex // protects sd
+	sd map[string]map[string]string
+}
+
+func (v *fakeVault) get(name string) map[string]string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.sd[name]
+}
+
+func (v *fakeVault) put(name string, sd map[string]string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.sd[name] = sd
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if r.Method == http.MethodPost && r.URL.Path == "/v1/auth/kubernetes/login" {
+		var req struct{ Role, JWT string }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Role != "key-rotator" || req.JWT != "$SERVICE_ACCOUNT_TOKEN" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, `{"auth":{"client_token":%q}}`, v.token)
+		return
+	}
+
+	if r.Header.Get("X-Vault-Token") != v.token {
+		http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/v1/secret/data/"):
+		var req struct{ Data map[string]string }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"errors":["bad request"]}`, http.StatusBadRequest)
+			return
+		}
+		v.sd[strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")] = req.Data
+		fmt.Fprint(w, `{"data":{"version":1}}`)
+
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/secret/data/"):
+		sd, ok := v.sd[strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")]
+		if !ok {
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"data": sd}})
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/v1/secret/metadata/"):
+		name := strings.TrimPrefix(r.URL.Path, "/v1/secret/metadata/")
+		if _, ok := v.sd[name]; !ok {
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+			return
+		}
+		delete(v.sd, name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, `{"errors":["unsupported path"]}`, http.StatusMethodNotAllowed)
+	}
+}
+
+// failingKey is a Key whose every operation fails.
+type failingKey struct{}
+
+var errFailingKey = errors.New("failingKey always fails")
+
+func (failingKey) PutBatchSigningKey(context.Context, string, string, key.Key) error {
+	return errFailingKey
+}
+
+func (failingKey) PutPacketEncryptionKey(context.Context, string, key.Key) error {
+	return errFailingKey
+}
+
+func (failingKey) PutTaskSigningKey(context.Context, string, key.Key) error { return errFailingKey }
+
+func (failingKey) GetBatchSigningKey(context.Context, string, string) (key.Key, error) {
+	return key.Key{}, errFailingKey
+}
+
+func (failingKey) GetPacketEncryptionKey(context.Context, string) (key.Key, error) {
+	return key.Key{}, errFailingKey
+}
+
+func (failingKey) GetTaskSigningKey(context.Context, string) (key.Key, error) {
+	return key.Key{}, errFailingKey
+}
+
+func (failingKey) DeleteKeys(context.Context, string, []string) error { return errFailingKey }
+
 // newK8sKey creates a new Kubernetes-based key implementation, based on a
 // Kubernetes fake that reads & writes secrets data to memory.
 func newK8sKey() (Key, fakeK8sSecret) {
-	k8s := fakeK8sSecret{sd: map[string]map[string][]byte{}}
-	return k8sKey{k8s, env}, k8s
+	k8s := newFakeK8sSecret()
+	return k8sKey{secrets: KubernetesSecrets{Default: k8s}, env: env}, k8s
+}
+
+func newFakeK8sSecret() fakeK8sSecret {
+	return fakeK8sSecret{sd: map[string]map[string][]byte{}, annotations: map[string]map[string]string{}}
+}
+
+// watchingK8sSecret is a Kubernetes fake whose watches are served by the
+// given fake watchers, in order.
+type watchingK8sSecret struct {
+	k8s.SecretInterface
+	watchers []*watch.FakeWatcher
+
+	mu               sync.Mutex // protects resourceVersions
+	resourceVersions []string   // the resource version requested by each watch
+}
+
+func (s *watchingK8sSecret) Watch(_ context.Context, opts k8smeta.ListOptions) (watch.Interface, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.resourceVersions) == len(s.watchers) {
+		return nil, errors.New("no more watchers")
+	}
+	s.resourceVersions = append(s.resourceVersions, opts.ResourceVersion)
+	return s.watchers[len(s.resourceVersions)-1], nil
 }
 
 type fakeK8sSecret struct {
 	k8s.SecretInterface
-	sd map[string]map[string][]byte
+	sd          map[string]map[string][]byte
+	annotations map[string]map[string]string // secret name -> annotations; written only by Patch
 }
 
 func (s fakeK8sSecret) Get(_ context.Context, name string, _ k8smeta.GetOptions) (*k8sapi.Secret, error) {
 	sd, ok := s.sd[name]
 	if !ok {
-		return nil, fmt.Errorf("no such key %q", name)
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, name)
 	}
 	secret := &k8sapi.Secret{
 		ObjectMeta: k8smeta.ObjectMeta{Name: name},
@@ -570,6 +1772,69 @@ func (s fakeK8sSecret) Update(_ context.Context, secret *k8sapi.Secret, _ k8smet
 	return secret, nil
 }
 
+// Patch applies a JSON merge patch to the data & annotations of a secret.
+func (s fakeK8sSecret) Patch(_ context.Context, name string, pt types.PatchType, data []byte, opts k8smeta.PatchOptions, subresources ...string) (*k8sapi.Secret, error) {
+	switch {
+	case pt != types.MergePatchType:
+		return nil, fmt.Errorf("unsupported patch type %q", pt)
+	case opts.FieldManager == "":
+		return nil, errors.New("missing field manager")
+	case len(subresources) > 0:
+		return nil, fmt.Errorf("unsupported subresources %q", subresources)
+	}
+	sd, ok := s.sd[name]
+	if !ok {
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, name)
+	}
+	var patch struct {
+		Metadata struct {
+			Annotations map[string]*string `json:"annotations"`
+		} `json:"metadata"`
+		Data map[string]*[]byte `json:"data"`
+	}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, fmt.Errorf("couldn't parse patch: %w", err)
+	}
+	if len(opts.DryRun) > 0 {
+		// Dry-run patches are validated, but not applied.
+		return s.Get(ctx, name, k8smeta.GetOptions{})
+	}
+	for k, v := range patch.Data {
+		if v == nil {
+			delete(sd, k)
+			continue
+		}
+		sd[k] = *v
+	}
+	if s.annotations[name] == nil {
+		s.annotations[name] = map[string]string{}
+	}
+	for k, v := range patch.Metadata.Annotations {
+		if v == nil {
+			delete(s.annotations[name], k)
+			continue
+		}
+		s.annotations[name][k] = *v
+	}
+	return s.Get(ctx, name, k8smeta.GetOptions{})
+}
+
+func (s fakeK8sSecret) Create(_ context.Context, secret *k8sapi.Secret, _ k8smeta.CreateOptions) (*k8sapi.Secret, error) {
+	name := secret.ObjectMeta.Name
+	if _, ok := s.sd[name]; ok {
+		return nil, k8serrors.NewAlreadyExists(schema.GroupResource{Resource: "secrets"}, name)
+	}
+	return s.Update(ctx, secret, k8smeta.UpdateOptions{})
+}
+
+func (s fakeK8sSecret) Delete(_ context.Context, name string, _ k8smeta.DeleteOptions) error {
+	if _, ok := s.sd[name]; !ok {
+		return k8serrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, name)
+	}
+	delete(s.sd, name)
+	return nil
+}
+
 func (s fakeK8sSecret) putEmpty(name string) {
 	s.sd[name] = map[string][]byte{"secret_key": []byte("not-a-real-key")}
 }
@@ -582,12 +1847,15 @@ func (s fakeK8sSecret) putKeyVersions(name string, value []byte) {
 	s.sd[name] = map[string][]byte{"key_versions": value}
 }
 
-func newAWSKey() (Key, fakeAWSSecretManager) {
-	aws := fakeAWSSecretManager{sd: map[string][]byte{}}
-	return awsKey{aws, env}, aws
+func newAWSKey(replicaRegions ...string) (Key, fakeAWSSecretManager) {
+	aws := fakeAWSSecretManager{sd: map[string][]byte{}, replicas: map[string]map[string]string{}}
+	return awsKey{aws, env, replicaRegions}, aws
 }
 
-type fakeAWSSecretManager struct{ sd map[string][]byte }
+type fakeAWSSecretManager struct {
+	sd       map[string][]byte
+	replicas map[string]map[string]string // secret name -> region -> replication status
+}
 
 func (m fakeAWSSecretManager) CreateSecretWithContext(_ context.Context, req *secretsmanager.CreateSecretInput, _ ...request.Option) (*secretsmanager.CreateSecretOutput, error) {
 	if req.Name == nil {
@@ -598,6 +1866,40 @@ func (m fakeAWSSecretManager) CreateSecretWithContext(_ context.Context, req *se
 		return nil, awserr.New(secretsmanager.ErrCodeResourceExistsException, fmt.Sprintf("secret %q already exists", secretName), nil)
 	}
 	m.sd[secretName] = nil
+	m.addReplicas(secretName, req.AddReplicaRegions)
+	return nil, nil
+}
+
+func (m fakeAWSSecretManager) DescribeSecretWithContext(_ context.Context, req *secretsmanager.DescribeSecretInput, _ ...request.Option) (*secretsmanager.DescribeSecretOutput, error) {
+	if req.SecretId == nil {
+		return nil, errors.New("SecretId is nil")
+	}
+	secretName := *req.SecretId
+	if _, ok := m.sd[secretName]; !ok {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceNotFoundException, fmt.Sprintf("no such secret %q", secretName), nil)
+	}
+	var statuses []*secretsmanager.ReplicationStatusType
+	for region, status := range m.replicas[secretName] {
+		statuses = append(statuses, &secretsmanager.ReplicationStatusType{Region: aws.String(region), Status: aws.String(status)})
+	}
+	return &secretsmanager.DescribeSecretOutput{ReplicationStatus: statuses}, nil
+}
+
+func (m fakeAWSSecretManager) DeleteSecretWithContext(_ context.Context, req *secretsmanager.DeleteSecretInput, _ ...request.Option) (*secretsmanager.DeleteSecretOutput, error) {
+	if req.SecretId == nil {
+		return nil, errors.New("SecretId is nil")
+	}
+	secretName := *req.SecretId
+	switch {
+	case !aws.BoolValue(req.ForceDeleteWithoutRecovery):
+		return nil, errors.New("ForceDeleteWithoutRecovery is not set")
+	case len(m.replicas[secretName]) > 0:
+		return nil, fmt.Errorf("secret %q has replicas", secretName)
+	}
+	if _, ok := m.sd[secretName]; !ok {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceNotFoundException, fmt.Sprintf("no such secret %q", secretName), nil)
+	}
+	delete(m.sd, secretName)
 	return nil, nil
 }
 
@@ -631,14 +1933,59 @@ func (m fakeAWSSecretManager) PutSecretValueWithContext(_ context.Context, req *
 	return nil, nil
 }
 
+func (m fakeAWSSecretManager) RemoveRegionsFromReplicationWithContext(_ context.Context, req *secretsmanager.RemoveRegionsFromReplicationInput, _ ...request.Option) (*secretsmanager.RemoveRegionsFromReplicationOutput, error) {
+	if req.SecretId == nil {
+		return nil, errors.New("SecretId is nil")
+	}
+	secretName := *req.SecretId
+	if _, ok := m.sd[secretName]; !ok {
+		return nil, fmt.Errorf("no such secret %q", secretName)
+	}
+	for _, region := range req.RemoveReplicaRegions {
+		delete(m.replicas[secretName], *region)
+	}
+	return nil, nil
+}
+
+func (m fakeAWSSecretManager) ReplicateSecretToRegionsWithContext(_ context.Context, req *secretsmanager.ReplicateSecretToRegionsInput, _ ...request.Option) (*secretsmanager.ReplicateSecretToRegionsOutput, error) {
+	if req.SecretId == nil {
+		return nil, errors.New("SecretId is nil")
+	}
+	secretName := *req.SecretId
+	if _, ok := m.sd[secretName]; !ok {
+		return nil, fmt.Errorf("no such secret %q", secretName)
+	}
+	m.addReplicas(secretName, req.AddReplicaRegions)
+	return nil, nil
+}
+
+func (m fakeAWSSecretManager) addReplicas(secretName string, regions []*secretsmanager.ReplicaRegionType) {
+	for _, region := range regions {
+		if m.replicas[secretName] == nil {
+			m.replicas[secretName] = map[string]string{}
+		}
+		m.replicas[secretName][*region.Region] = secretsmanager.StatusTypeInProgress
+	}
+}
+
 func (m fakeAWSSecretManager) put(name string, value []byte) { m.sd[name] = value }
 
-func newGCPKey() (Key, fakeGCPSecretManager) {
-	gcp := fakeGCPSecretManager{sd: map[string][]byte{}}
-	return gcpKey{gcp, env, gcpProjectID}, gcp
+func (m fakeAWSSecretManager) putReplica(name, region, status string) {
+	if m.replicas[name] == nil {
+		m.replicas[name] = map[string]string{}
+	}
+	m.replicas[name][region] = status
+}
+
+func newGCPKey(replicaLocations ...string) (Key, fakeGCPSecretManager) {
+	gcp := fakeGCPSecretManager{sd: map[string][]byte{}, replication: map[string]*smpb.Replication{}}
+	return gcpKey{gcp, env, gcpProjectID, replicaLocations}, gcp
 }
 
-type fakeGCPSecretManager struct{ sd map[string][]byte }
+type fakeGCPSecretManager struct {
+	sd          map[string][]byte
+	replication map[string]*smpb.Replication // secret name -> replication policy
+}
 
 func (m fakeGCPSecretManager) AccessSecretVersion(_ context.Context, req *smpb.AccessSecretVersionRequest, _ ...gax.CallOption) (*smpb.AccessSecretVersionResponse, error) {
 	const (
@@ -684,7 +2031,40 @@ func (m fakeGCPSecretManager) CreateSecret(_ context.Context, req *smpb.CreateSe
 		return nil, status.Newf(codes.AlreadyExists, "secret %q already exists", req.SecretId).Err()
 	}
 	m.sd[req.SecretId] = nil
+	m.replication[req.SecretId] = req.GetSecret().GetReplication()
 	return nil, nil
 }
 
-func (m fakeGCPSecretManager) put(name string, value []byte) { m.sd[name] = value }
+func (m fakeGCPSecretManager) DeleteSecret(_ context.Context, req *smpb.DeleteSecretRequest, _ ...gax.CallOption) error {
+	const wantPrefix = "projects/" + gcpProjectID + "/secrets/"
+	if !strings.HasPrefix(req.Name, wantPrefix) {
+		return fmt.Errorf("unexpected Name (got %q, want something prefixed with %q)", req.Name, wantPrefix)
+	}
+	secretName := strings.TrimPrefix(req.Name, wantPrefix)
+	if _, ok := m.sd[secretName]; !ok {
+		return status.Newf(codes.NotFound, "no such secret %q", secretName).Err()
+	}
+	delete(m.sd, secretName)
+	delete(m.replication, secretName)
+	return nil
+}
+
+func (m fakeGCPSecretManager) GetSecret(_ context.Context, req *smpb.GetSecretRequest, _ ...gax.CallOption) (*smpb.Secret, error) {
+	const wantPrefix = "projects/" + gcpProjectID + "/secrets/"
+	if !strings.HasPrefix(req.Name, wantPrefix) {
+		return nil, fmt.Errorf("unexpected Name (got %q, want something prefixed with %q)", req.Name, wantPrefix)
+	}
+	secretName := strings.TrimPrefix(req.Name, wantPrefix)
+	if _, ok := m.sd[secretName]; !ok {
+		return nil, fmt.Errorf("no such secret %q", secretName)
+	}
+	return &smpb.Secret{Name: req.Name, Replication: m.replication[secretName]}, nil
+}
+
+// put stores a secret as if created with an automatic replication policy.
+func (m fakeGCPSecretManager) put(name string, value []byte) {
+	m.sd[name] = value
+	m.replication[name] = &smpb.Replication{
+		Replication: &smpb.Replication_Automatic_{Automatic: &smpb.Replication_Automatic{}},
+	}
+}
@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+)
+
+// vaultMaxResponseBytes bounds the size of responses read from Vault. Keys are
+// small, so any larger response indicates a misconfiguration.
+const vaultMaxResponseBytes = 1 << 20 // 1 MiB
+
+// errVaultNotFound is returned by vaultClient.do if Vault responds with 404 Not
+// Found.
+var errVaultNotFound = errors.New("not found")
+
+// errVaultForbidden is wrapped by the error returned by vaultClient.do if
+// Vault responds with 403 Forbidden, e.g. because the token has expired.
+var errVaultForbidden = errors.New("permission denied")
+
+// VaultConfig configures access to a HashiCorp Vault server.
+type VaultConfig struct {
+	Address   string // the URL of the Vault server, e.g. "https://vault.example.com:8200"
+	Namespace string // if non-empty, the Vault Enterprise namespace in which requests are made
+	Token     string // the Vault token with which requests are authenticated
+	Mount     string // the path at which the KV v2 secrets engine is mounted, e.g. "secret"
+
+	// Login, if non-nil, obtains a new Vault token, e.g. with
+	// VaultKubernetesLogin. It is invoked when Vault rejects the current
+	// token, e.g. because its TTL has passed, after which the rejected request
+	// is retried once with the new token.
+	Login func(context.Context) (string, error)
+}
+
+// NewVaultKey returns a Key implementation using a HashiCorp Vault KV version 2
+// secrets engine for backing storage. Each key is stored as the latest version
+// of a secret named as the corresponding Kubernetes secret, with a single
+// "key_versions" field holding the serialized key. Keys written by this store
+// cannot be read by other components of the Prio system (e.g. the
+// facilitator), unless they are configured to read keys from Vault.
+func NewVaultKey(client *http.Client, cfg VaultConfig, prioEnv string) Key {
+	return vaultKey{newVaultClient(client, cfg), prioEnv}
+}
+
+type vaultKey struct {
+	vault vaultClient
+	env   string
+}
+
+var _ Key = vaultKey{} // verify vaultKey satisfies Key
+
+func (k vaultKey) PutBatchSigningKey(ctx context.Context, locality, ingestor string, key key.Key) error {
+	return k.putKey(ctx, "batch-signing", batchSigningKeyName(k.env, locality, ingestor), key)
+}
+
+func (k vaultKey) PutPacketEncryptionKey(ctx context.Context, locality string, key key.Key) error {
+	return k.putKey(ctx, "packet-encryption", packetEncryptionKeyName(k.env, locality), key)
+}
+
+func (k vaultKey) PutTaskSigningKey(ctx context.Context, locality string, key key.Key) error {
+	return k.putKey(ctx, "task-signing", taskSigningKeyName(k.env, locality), key)
+}
+
+func (k vaultKey) putKey(ctx context.Context, secretKind, secretName string, key key.Key) error {
+	log.Info().
+		Str("storage", "vault").
+		Str("kind", secretKind).
+		Str("secret", secretName).
+		Msgf("Writing key to secret %q", secretName)
+
+	keyBytes, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Errorf("couldn't serialize key: %w", err)
+	}
+	req := struct {
+		Data map[string]string `json:"data"`
+	}{Data: map[string]string{keyVersionsSecretKey: string(keyBytes)}}
+	if err := k.vault.do(ctx, http.MethodPost, k.vault.secretPath("data", secretName), req, nil); err != nil {
+		return fmt.Errorf("couldn't write Vault secret %q: %w", secretName, err)
+	}
+	return nil
+}
+
+func (k vaultKey) GetBatchSigningKey(ctx context.Context, locality, ingestor string) (key.Key, error) {
+	return k.getKey(ctx, batchSigningKeyName(k.env, locality, ingestor))
+}
+
+func (k vaultKey) GetPacketEncryptionKey(ctx context.Context, locality string) (key.Key, error) {
+	return k.getKey(ctx, packetEncryptionKeyName(k.env, locality))
+}
+
+func (k vaultKey) GetTaskSigningKey(ctx context.Context, locality string) (key.Key, error) {
+	return k.getKey(ctx, taskSigningKeyName(k.env, locality))
+}
+
+func (k vaultKey) getKey(ctx context.Context, secretName string) (key.Key, error) {
+	var resp struct {
+		Data struct {
+			Data map[string]string `json:"data"` // nil if the latest version has been deleted
+		} `json:"data"`
+	}
+	if err := k.vault.do(ctx, http.MethodGet, k.vault.secretPath("data", secretName), nil, &resp); err != nil {
+		return key.Key{}, fmt.Errorf("couldn't retrieve Vault secret %q: %w", secretName, err)
+	}
+	keyVersions, ok := resp.Data.Data[keyVersionsSecretKey]
+	if !ok {
+		return key.Key{}, fmt.Errorf("secret %q in Vault has no %q field", secretName, keyVersionsSecretKey)
+	}
+
+	var secretKey key.Key
+	if err := json.Unmarshal([]byte(keyVersions), &secretKey); err != nil {
+		return key.Key{}, fmt.Errorf("couldn't parse key from Vault secret %q: %w", secretName, err)
+	}
+	return secretKey, nil
+}
+
+// DeleteKeys deletes the metadata, and therefore every version, of each
+// secret.
+func (k vaultKey) DeleteKeys(ctx context.Context, locality string, ingestors []string) error {
+	for _, secretName := range keyNames(k.env, locality, ingestors) {
+		log.Info().
+			Str("storage", "vault").
+			Str("secret", secretName).
+			Msgf("Deleting secret %q", secretName)
+		if err := k.vault.do(ctx, http.MethodDelete, k.vault.secretPath("metadata", secretName), nil, nil); err != nil && !errors.Is(err, errVaultNotFound) {
+			return fmt.Errorf("couldn't delete Vault secret %q: %w", secretName, err)
+		}
+	}
+	return nil
+}
+
+// VaultKubernetesLogin authenticates to Vault with the Kubernetes auth method
+// mounted at authMount, as the given role, using the given Kubernetes service
+// account token, and returns the resulting Vault token. cfg.Token & cfg.Login
+// are ignored.
+func VaultKubernetesLogin(ctx context.Context, client *http.Client, cfg VaultConfig, authMount, role, serviceAccountToken string) (string, error) {
+	req := struct {
+		Role string `json:"role"`
+		JWT  string `json:"jwt"`
+	}{role, serviceAccountToken}
+	var resp struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	cfg.Token, cfg.Login = "", nil
+	path := fmt.Sprintf("auth/%s/login", strings.Trim(authMount, "/"))
+	if err := newVaultClient(client, cfg).do(ctx, http.MethodPost, path, req, &resp); err != nil {
+		return "", fmt.Errorf("couldn't log in to Vault as role %q: %w", role, err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return "", fmt.Errorf("couldn't log in to Vault as role %q: no token in response", role)
+	}
+	return resp.Auth.ClientToken, nil
+}
+
+// vaultClient makes requests to the Vault HTTP API.
+type vaultClient struct {
+	client *http.Client
+	cfg    VaultConfig
+	token  *vaultToken // initially cfg.Token; replaced via cfg.Login
+}
+
+func newVaultClient(client *http.Client, cfg VaultConfig) vaultClient {
+	return vaultClient{client, cfg, &vaultToken{token: cfg.Token}}
+}
+
+// vaultToken holds the current Vault token of a vaultClient, which is shared
+// by copies of the client.
+type vaultToken struct {
+	mu    sync.Mutex // protects token
+	token string
+}
+
+func (t *vaultToken) get() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.token
+}
+
+// renew replaces the token with one obtained from login, unless the token is
+// no longer rejected, i.e. it has already been replaced by a concurrent
+// request.
+func (t *vaultToken) renew(ctx context.Context, rejected string, login func(context.Context) (string, error)) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != rejected {
+		return nil
+	}
+	token, err := login(ctx)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("storage", "vault").Msg("Renewed Vault token")
+	t.token = token
+	return nil
+}
+
+// secretPath returns the API path of the given kind ("data" or "metadata") for
+// the named secret in the KV v2 secrets engine.
+func (c vaultClient) secretPath(kind, secretName string) string {
+	return fmt.Sprintf("%s/%s/%s", strings.Trim(c.cfg.Mount, "/"), kind, url.PathEscape(secretName))
+}
+
+// do makes a request to the given API path, relative to "/v1/". If reqBody is
+// non-nil, it is serialized as the JSON request body; if respBody is non-nil,
+// the JSON response body is parsed into it. If the token is rejected and
+// c.cfg.Login is non-nil, the request is retried once with a new token.
+func (c vaultClient) do(ctx context.Context, method, path string, reqBody, respBody interface{}) error {
+	token := c.token.get()
+	err := c.doWithToken(ctx, token, method, path, reqBody, respBody)
+	if !errors.Is(err, errVaultForbidden) || c.cfg.Login == nil {
+		return err
+	}
+	if err := c.token.renew(ctx, token, c.cfg.Login); err != nil {
+		return fmt.Errorf("couldn't renew Vault token: %w", err)
+	}
+	return c.doWithToken(ctx, c.token.get(), method, path, reqBody, respBody)
+}
+
+func (c vaultClient) doWithToken(ctx context.Context, token, method, path string, reqBody, respBody interface{}) error {
+	var body io.Reader
+	if reqBody != nil {
+		reqBytes, err := json.Marshal(reqBody)
+		if err != nil {
+			return fmt.Errorf("couldn't serialize request: %w", err)
+		}
+		body = bytes.NewReader(reqBytes)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s/v1/%s", strings.TrimSuffix(c.cfg.Address, "/"), path), body)
+	if err != nil {
+		return fmt.Errorf("couldn't create request: %w", err)
+	}
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if c.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.cfg.Namespace)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBytes, err := io.ReadAll(io.LimitReader(resp.Body, vaultMaxResponseBytes))
+	if err != nil {
+		return fmt.Errorf("couldn't read response: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return errVaultNotFound
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("%w: unexpected status %q: %s", errVaultForbidden, resp.Status, bytes.TrimSpace(respBytes))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// Vault's error responses describe the errors, but never include
+		// secret material.
+		return fmt.Errorf("unexpected status %q: %s", resp.Status, bytes.TrimSpace(respBytes))
+	}
+	if respBody != nil {
+		if err := json.Unmarshal(respBytes, respBody); err != nil {
+			return fmt.Errorf("couldn't parse response: %w", err)
+		}
+	}
+	return nil
+}
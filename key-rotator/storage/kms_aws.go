@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/rs/zerolog/log"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+)
+
+// NewAWSKMS returns a key.KMS implementation which creates keys as new AWS KMS
+// keys with key spec ECC_NIST_P256 & key usage SIGN_VERIFY, described by the
+// given description. Keys are referred to by their ARNs.
+func NewAWSKMS(kms *kms.KMS, description string) key.KMS {
+	return awsKMS{kms, description}
+}
+
+type awsKMS struct {
+	kms         awsKMSClient
+	description string
+}
+
+var _ key.KMS = awsKMS{} // verify awsKMS satisfies key.KMS
+
+// awsKMSClient is an internal interface, intended to be satisfied by the
+// "real" AWS KMS client API (*kms.KMS). It exists to enable testability.
+type awsKMSClient interface {
+	CreateKeyWithContext(context.Context, *kms.CreateKeyInput, ...request.Option) (*kms.CreateKeyOutput, error)
+	GetPublicKeyWithContext(context.Context, *kms.GetPublicKeyInput, ...request.Option) (*kms.GetPublicKeyOutput, error)
+}
+
+// verify awsKMSClient is satisfied by the expected production implementation
+var _ awsKMSClient = (*kms.KMS)(nil)
+
+func (k awsKMS) CreateKey(ctx context.Context) (string, error) {
+	log.Info().
+		Str("kms", "aws").
+		Msgf("Creating KMS key %q", k.description)
+	out, err := k.kms.CreateKeyWithContext(ctx, &kms.CreateKeyInput{
+		Description: aws.String(k.description),
+		KeySpec:     aws.String(kms.KeySpecEccNistP256),
+		KeyUsage:    aws.String(kms.KeyUsageTypeSignVerify),
+	})
+	if err != nil {
+		return "", fmt.Errorf("couldn't create KMS key: %w", err)
+	}
+	return aws.StringValue(out.KeyMetadata.Arn), nil
+}
+
+func (k awsKMS) PublicKey(ctx context.Context, ref string) (crypto.PublicKey, error) {
+	out, err := k.kms.GetPublicKeyWithContext(ctx, &kms.GetPublicKeyInput{KeyId: aws.String(ref)})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get public key of KMS key %q: %w", ref, err)
+	}
+	if spec := aws.StringValue(out.KeySpec); spec != kms.KeySpecEccNistP256 {
+		return nil, fmt.Errorf("KMS key %q has key spec %q, want %q", ref, spec, kms.KeySpecEccNistP256)
+	}
+	pub, err := x509.ParsePKIXPublicKey(out.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse public key of KMS key %q as PKIX: %w", ref, err)
+	}
+	return pub, nil
+}
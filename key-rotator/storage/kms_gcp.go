@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/api/cloudkms/v1"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+)
+
+// gcpKMSAlgorithm is the algorithm of the GCP KMS crypto keys in which batch
+// signing keys are created.
+const gcpKMSAlgorithm = "EC_SIGN_P256_SHA256"
+
+// gcpKMSPollInterval is how often the state of a newly-created GCP KMS crypto
+// key version is checked while waiting for it to be generated.
+var gcpKMSPollInterval = time.Second
+
+// NewGCPKMS returns a key.KMS implementation which creates keys as new
+// versions of the given GCP KMS crypto key, which must have purpose
+// ASYMMETRIC_SIGN and algorithm EC_SIGN_P256_SHA256. cryptoKey is the crypto
+// key's resource name, i.e.
+// "projects/P/locations/L/keyRings/R/cryptoKeys/K", and keys are referred to
+// by the resource names of the crypto key versions.
+func NewGCPKMS(kms *cloudkms.Service, cryptoKey string) key.KMS {
+	return gcpKMS{kms.Projects.Locations.KeyRings.CryptoKeys.CryptoKeyVersions, cryptoKey}
+}
+
+type gcpKMS struct {
+	versions  *cloudkms.ProjectsLocationsKeyRingsCryptoKeysCryptoKeyVersionsService
+	cryptoKey string
+}
+
+var _ key.KMS = gcpKMS{} // verify gcpKMS satisfies key.KMS
+
+func (k gcpKMS) CreateKey(ctx context.Context) (string, error) {
+	log.Info().
+		Str("kms", "gcp").
+		Str("crypto key", k.cryptoKey).
+		Msgf("Creating version of crypto key %q", k.cryptoKey)
+	v, err := k.versions.Create(k.cryptoKey, &cloudkms.CryptoKeyVersion{}).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("couldn't create version of crypto key %q: %w", k.cryptoKey, err)
+	}
+	if v.Algorithm != gcpKMSAlgorithm {
+		return "", fmt.Errorf("crypto key %q has algorithm %q, want %q", k.cryptoKey, v.Algorithm, gcpKMSAlgorithm)
+	}
+
+	// Keys with an HSM protection level are generated asynchronously, and
+	// cannot be used until they are enabled.
+	name := v.Name
+	for v.State == "PENDING_GENERATION" {
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("crypto key version %q still pending generation: %w", name, ctx.Err())
+		case <-time.After(gcpKMSPollInterval):
+		}
+		if v, err = k.versions.Get(name).Context(ctx).Do(); err != nil {
+			return "", fmt.Errorf("couldn't get crypto key version %q: %w", name, err)
+		}
+	}
+	if v.State != "ENABLED" {
+		return "", fmt.Errorf("crypto key version %q is %s rather than ENABLED", name, v.State)
+	}
+	return name, nil
+}
+
+func (k gcpKMS) PublicKey(ctx context.Context, ref string) (crypto.PublicKey, error) {
+	pk, err := k.versions.GetPublicKey(ref).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get public key of crypto key version %q: %w", ref, err)
+	}
+	return parsePKIXPublicKeyPEM(pk.Pem)
+}
+
+// parsePKIXPublicKeyPEM parses a PEM-encoded PKIX public key.
+func parsePKIXPublicKeyPEM(pemStr string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pemStr))
+	if block == nil {
+		return nil, errors.New("couldn't parse public key as PEM")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse public key as PKIX: %w", err)
+	}
+	return pub, nil
+}
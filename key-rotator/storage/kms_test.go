@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+)
+
+func TestAWSKMS(t *testing.T) {
+	t.Parallel()
+	fake := &fakeAWSKMS{keys: map[string]fakeAWSKMSKey{}}
+	k := awsKMS{fake, "$DESCRIPTION"}
+
+	m, err := key.NewKMSMaterial(ctx, k)
+	if err != nil {
+		t.Fatalf("Unexpected error from NewKMSMaterial: %v", err)
+	}
+	ref, ok := m.KMSKeyRef()
+	if !ok {
+		t.Fatalf("New key material is not held in KMS")
+	}
+	created, ok := fake.keys[ref]
+	if !ok {
+		t.Fatalf("No KMS key created with ARN %q", ref)
+	}
+	if created.description != "$DESCRIPTION" {
+		t.Errorf("KMS key created with description %q, want %q", created.description, "$DESCRIPTION")
+	}
+	if !m.Public().Equal(created.pub) {
+		t.Errorf("Key material's public key does not match KMS key's")
+	}
+
+	t.Run("wrong key spec", func(t *testing.T) {
+		t.Parallel()
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("Couldn't create Ed25519 key: %v", err)
+		}
+		const ref = "arn:aws:kms:$REGION:$ACCOUNT:key/ed25519"
+		fake := &fakeAWSKMS{keys: map[string]fakeAWSKMSKey{ref: {spec: "ECC_NIST_P384", pub: pub}}}
+		if _, err := (awsKMS{fake, ""}).PublicKey(ctx, ref); err == nil {
+			t.Errorf("Wanted error from PublicKey for KMS key with wrong key spec")
+		}
+	})
+
+	t.Run("no such key", func(t *testing.T) {
+		t.Parallel()
+		if _, err := k.PublicKey(ctx, "arn:aws:kms:$REGION:$ACCOUNT:key/nonexistent"); err == nil {
+			t.Errorf("Wanted error from PublicKey for nonexistent KMS key")
+		}
+	})
+}
+
+type fakeAWSKMSKey struct {
+	description string
+	spec        string
+	pub         interface{}
+}
+
+// fakeAWSKMS creates KMS keys in memory, with private keys that are discarded.
+type fakeAWSKMS struct{ keys map[string]fakeAWSKMSKey }
+
+var _ awsKMSClient = &fakeAWSKMS{} // verify fakeAWSKMS satisfies awsKMSClient
+
+func (f *fakeAWSKMS) CreateKeyWithContext(_ context.Context, input *kms.CreateKeyInput, _ ...request.Option) (*kms.CreateKeyOutput, error) {
+	if spec := aws.StringValue(input.KeySpec); spec != kms.KeySpecEccNistP256 {
+		return nil, fmt.Errorf("unsupported key spec %q", spec)
+	}
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	arn := fmt.Sprintf("arn:aws:kms:$REGION:$ACCOUNT:key/%d", len(f.keys))
+	f.keys[arn] = fakeAWSKMSKey{aws.StringValue(input.Description), kms.KeySpecEccNistP256, privKey.Public()}
+	return &kms.CreateKeyOutput{KeyMetadata: &kms.KeyMetadata{Arn: aws.String(arn)}}, nil
+}
+
+func (f *fakeAWSKMS) GetPublicKeyWithContext(_ context.Context, input *kms.GetPublicKeyInput, _ ...request.Option) (*kms.GetPublicKeyOutput, error) {
+	k, ok := f.keys[aws.StringValue(input.KeyId)]
+	if !ok {
+		return nil, errors.New("NotFoundException")
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(k.pub)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.GetPublicKeyOutput{KeyId: input.KeyId, KeySpec: aws.String(k.spec), PublicKey: pubBytes}, nil
+}
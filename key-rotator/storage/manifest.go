@@ -7,16 +7,24 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
 
 	"cloud.google.com/go/storage"
 	"github.com/abetterinternet/prio-server/key-rotator/manifest"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
 )
 
 // ErrObjectNotExist is an error representing that an object did not exist.
@@ -30,6 +38,18 @@ type Manifest interface {
 	// returns an error on failure.
 	PutDataShareProcessorSpecificManifest(ctx context.Context, dataShareProcessorName string, manifest manifest.DataShareProcessorSpecificManifest) error
 
+	// PutJWKS writes the provided JSON Web Key Set, holding the batch signing
+	// public keys published in the specific manifest for the provided share
+	// processor name, alongside that manifest in the writer's backing
+	// storage, or returns an error on failure.
+	PutJWKS(ctx context.Context, dataShareProcessorName string, jwks manifest.JSONWebKeySet) error
+
+	// PutManifestSignature writes the provided detached signature over the
+	// specific manifest for the provided share processor name alongside that
+	// manifest in the writer's backing storage, or returns an error on
+	// failure.
+	PutManifestSignature(ctx context.Context, dataShareProcessorName string, sig manifest.Signature) error
+
 	// PutIngestorGlobalManifest writes the provided manifest to the writer's
 	// backing storage, or returns an error on failure.
 	PutIngestorGlobalManifest(ctx context.Context, manifest manifest.IngestorGlobalManifest) error
@@ -44,6 +64,41 @@ type Manifest interface {
 	// exists and is well-formed. If the manifest does not exist, an error
 	// wrapping ErrObjectNotExist will be returned.
 	GetIngestorGlobalManifest(ctx context.Context) (manifest.IngestorGlobalManifest, error)
+
+	// GetManifestSignature gets the detached signature written alongside the
+	// specific manifest for the specified data share processor, if it exists
+	// and is well-formed. If the signature does not exist, an error wrapping
+	// ErrObjectNotExist will be returned.
+	GetManifestSignature(ctx context.Context, dataShareProcessorName string) (manifest.Signature, error)
+
+	// GetDataShareProcessorSpecificManifestVersion gets an opaque version
+	// identifier for the specific manifest for the specified data share
+	// processor, without retrieving the manifest itself. The version changes
+	// whenever the manifest is written. If the manifest does not exist, an
+	// error wrapping ErrObjectNotExist will be returned.
+	GetDataShareProcessorSpecificManifestVersion(ctx context.Context, dataShareProcessorName string) (string, error)
+
+	// ListDataShareProcessorSpecificManifests returns the names of the data
+	// share processors for which specific manifests exist, in lexicographic
+	// order. Default manifests are not included.
+	ListDataShareProcessorSpecificManifests(ctx context.Context) ([]string, error)
+
+	// PutRotationStatus writes the provided rotation status for the provided
+	// locality in the writer's backing storage, or returns an error on
+	// failure.
+	PutRotationStatus(ctx context.Context, locality string, status manifest.RotationStatus) error
+
+	// DeleteDataShareProcessorSpecificManifest deletes the specific manifest
+	// for the specified data share processor, and the JSON Web Key Set &
+	// signature written alongside it, from the writer's backing storage, or
+	// returns an error on failure. A manifest, JSON Web Key Set, or signature
+	// which does not exist is ignored.
+	DeleteDataShareProcessorSpecificManifest(ctx context.Context, dataShareProcessorName string) error
+
+	// DeleteRotationStatus deletes the rotation status for the provided
+	// locality from the writer's backing storage, or returns an error on
+	// failure. A rotation status which does not exist is ignored.
+	DeleteRotationStatus(ctx context.Context, locality string) error
 }
 
 // NewManifest creates a new Manifest based on the given bucket parameters. It
@@ -55,15 +110,87 @@ func NewManifest(ctx context.Context, bucket string, opts ...ManifestOption) (Ma
 		o(&os)
 	}
 
-	var kv kvStore
+	kv, err := newKVStore(ctx, bucket, os)
+	if err != nil {
+		return nil, err
+	}
+	return kvStoreManifest{kv, os.keyPrefix, os.defaultManifestByDSP}, nil
+}
+
+// OpenObject opens the object at the given URL, which should be in the format
+// "gs://bucket_name/key" or "s3://bucket_name/key", for streaming reads. The
+// same options as NewManifest are accepted, though only those configuring the
+// storage client are respected. If the object does not exist, an error
+// wrapping ErrObjectNotExist will be returned.
+func OpenObject(ctx context.Context, objectURL string, opts ...ManifestOption) (io.ReadCloser, error) {
+	var os manifestOpts
+	for _, o := range opts {
+		o(&os)
+	}
+
+	var scheme string
+	for _, s := range []string{"gs://", "s3://"} {
+		if strings.HasPrefix(objectURL, s) {
+			scheme = s
+		}
+	}
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(objectURL, scheme), "/")
+	if scheme == "" || !ok || bucket == "" || key == "" {
+		return nil, fmt.Errorf("bad object URL %q", objectURL)
+	}
+	kv, err := newKVStore(ctx, scheme+bucket, os)
+	if err != nil {
+		return nil, err
+	}
+	return kv.open(ctx, key)
+}
+
+// CheckManifestWriteAccess verifies, without writing any object, that the
+// caller is permitted to write manifests to the given bucket, which should be
+// in the same format as for NewManifest. The same options as NewManifest are
+// accepted. A nil error means writes are permitted.
+func CheckManifestWriteAccess(ctx context.Context, bucket string, opts ...ManifestOption) error {
+	var os manifestOpts
+	for _, o := range opts {
+		o(&os)
+	}
+
+	kv, err := newKVStore(ctx, bucket, os)
+	if err != nil {
+		return err
+	}
+	return kv.checkWrite(ctx, path.Join(os.keyPrefix, preflightKey))
+}
+
+// preflightKey is the key used to check write access to a bucket. No object is
+// ever written to it.
+const preflightKey = "key-rotator-preflight.json"
+
+// newKVStore creates a streamingKVStore for the given bucket, which should be
+// in the format "gs://bucket_name" or "s3://bucket_name".
+func newKVStore(ctx context.Context, bucket string, os manifestOpts) (streamingKVStore, error) {
 	switch {
 	case strings.HasPrefix(bucket, "gs://"):
 		bucket = strings.TrimPrefix(bucket, "gs://")
-		gcs, err := storage.NewClient(ctx)
+		gcsOpts := append([]option.ClientOption{}, os.gcpClientOpts...)
+		if os.gcsEndpoint != "" {
+			gcsOpts = append(gcsOpts, option.WithEndpoint(os.gcsEndpoint))
+		}
+		if os.minTLSVersion != 0 {
+			// Clients given an HTTP client don't add authentication of
+			// their own, so wrap our transport in an authenticating one.
+			trans, err := htransport.NewTransport(ctx, NewHTTPTransport(os.minTLSVersion),
+				append(gcsOpts, option.WithScopes(storage.ScopeReadWrite))...)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't create GCS transport: %w", err)
+			}
+			gcsOpts = append(gcsOpts, option.WithHTTPClient(&http.Client{Transport: trans}))
+		}
+		gcs, err := storage.NewClient(ctx, gcsOpts...)
 		if err != nil {
 			return nil, fmt.Errorf("couldn't create GCS storage client: %w", err)
 		}
-		kv = gcsKVStore{gcs, bucket}
+		return gcsKVStore{gcs, bucket}, nil
 
 	case strings.HasPrefix(bucket, "s3://"):
 		bucket = strings.TrimPrefix(bucket, "s3://")
@@ -72,17 +199,40 @@ func NewManifest(ctx context.Context, bucket string, opts ...ManifestOption) (Ma
 			return nil, fmt.Errorf("couldn't create AWS session: %w", err)
 		}
 		config := aws.NewConfig().WithRegion(os.awsRegion)
+		if os.awsCredentials != nil {
+			config = config.WithCredentials(os.awsCredentials)
+		}
+		if os.minTLSVersion != 0 {
+			config = config.WithHTTPClient(&http.Client{Transport: NewHTTPTransport(os.minTLSVersion)})
+		}
+		if os.awsRoleARN != "" {
+			// The role is assumed with the credentials configured so far,
+			// through AWS STS rather than any S3 endpoint.
+			config = config.WithCredentials(stscreds.NewCredentials(sess.Copy(config), os.awsRoleARN))
+		}
+		if os.s3Endpoint != "" {
+			config = config.WithEndpoint(os.s3Endpoint)
+		}
+		if os.s3ForcePathStyle {
+			config = config.WithS3ForcePathStyle(true)
+		}
 		s3 := s3.New(sess, config)
-		kv = s3KVStore{s3, bucket}
+		return s3KVStore{s3, bucket}, nil
 
 	default:
 		return nil, fmt.Errorf("bad bucket URL %q", bucket)
 	}
-	return kvStoreManifest{kv, os.keyPrefix, os.defaultManifestByDSP}, nil
 }
 
 type manifestOpts struct {
 	keyPrefix, awsRegion string
+	awsCredentials       *credentials.Credentials
+	gcpClientOpts        []option.ClientOption
+	awsRoleARN           string
+	s3Endpoint           string
+	s3ForcePathStyle     bool
+	gcsEndpoint          string
+	minTLSVersion        uint16
 	defaultManifestByDSP map[string]manifest.DataShareProcessorSpecificManifest
 }
 
@@ -101,6 +251,66 @@ func WithAWSRegion(awsRegion string) ManifestOption {
 	return func(opts *manifestOpts) { opts.awsRegion = awsRegion }
 }
 
+// WithAWSCredentials returns a manifest option that sets the AWS credentials
+// to use, in place of the default credential chain. Applies only to Manifests
+// backed by S3.
+func WithAWSCredentials(creds *credentials.Credentials) ManifestOption {
+	return func(opts *manifestOpts) { opts.awsCredentials = creds }
+}
+
+// WithAWSStaticCredentials returns a manifest option that sets static AWS
+// credentials to use, e.g. the access key of a MinIO user, in place of the
+// default credential chain. Applies only to Manifests backed by S3.
+func WithAWSStaticCredentials(accessKeyID, secretAccessKey string) ManifestOption {
+	return WithAWSCredentials(credentials.NewStaticCredentials(accessKeyID, secretAccessKey, ""))
+}
+
+// WithAWSAssumeRole returns a manifest option that sets an AWS IAM role to
+// assume to access the bucket, e.g. a role in the account owning a
+// cross-account bucket. The role is assumed through AWS STS using the
+// credentials set by WithAWSCredentials, or otherwise the default credential
+// chain, which includes web identities provided by IAM Roles for Service
+// Accounts. Applies only to Manifests backed by S3.
+func WithAWSAssumeRole(roleARN string) ManifestOption {
+	return func(opts *manifestOpts) { opts.awsRoleARN = roleARN }
+}
+
+// WithGCPClientOptions returns a manifest option that sets additional options
+// used to create the GCS client, e.g. to configure credentials. Applies only
+// to Manifests backed by GCS.
+func WithGCPClientOptions(clientOpts ...option.ClientOption) ManifestOption {
+	return func(opts *manifestOpts) { opts.gcpClientOpts = append(opts.gcpClientOpts, clientOpts...) }
+}
+
+// WithS3Endpoint returns a manifest option that overrides the endpoint used
+// to reach S3, e.g. to use a VPC endpoint. Applies only to Manifests backed by
+// S3.
+func WithS3Endpoint(endpoint string) ManifestOption {
+	return func(opts *manifestOpts) { opts.s3Endpoint = endpoint }
+}
+
+// WithS3ForcePathStyle returns a manifest option that addresses buckets by
+// path ("${endpoint}/${bucket}") rather than by host name, as MinIO & most
+// other S3-compatible services set by WithS3Endpoint require. Applies only to
+// Manifests backed by S3.
+func WithS3ForcePathStyle(forcePathStyle bool) ManifestOption {
+	return func(opts *manifestOpts) { opts.s3ForcePathStyle = forcePathStyle }
+}
+
+// WithGCSEndpoint returns a manifest option that overrides the endpoint used
+// to reach GCS, e.g. to use Private Service Connect. Applies only to Manifests
+// backed by GCS.
+func WithGCSEndpoint(endpoint string) ManifestOption {
+	return func(opts *manifestOpts) { opts.gcsEndpoint = endpoint }
+}
+
+// WithMinTLSVersion returns a manifest option that sets the minimum TLS
+// version (e.g. tls.VersionTLS13) that will be negotiated with the backing
+// storage service.
+func WithMinTLSVersion(minTLSVersion uint16) ManifestOption {
+	return func(opts *manifestOpts) { opts.minTLSVersion = minTLSVersion }
+}
+
 // WithDefaultDataShareProcessorManifests returns a manifest option that
 // defines the "default" data share processor-specific manifests that will be
 // returned if the underlying storage bucket does not contain a manifest for
@@ -138,6 +348,30 @@ func (m kvStoreManifest) PutDataShareProcessorSpecificManifest(ctx context.Conte
 	return nil
 }
 
+func (m kvStoreManifest) PutJWKS(ctx context.Context, dataShareProcessorName string, jwks manifest.JSONWebKeySet) error {
+	jwksBytes, err := json.Marshal(jwks)
+	if err != nil {
+		return fmt.Errorf("couldn't marshal JWKS as JSON: %w", err)
+	}
+	key := m.jwksKeyFor(dataShareProcessorName)
+	if err := m.kv.put(ctx, key, jwksBytes); err != nil {
+		return fmt.Errorf("couldn't put JWKS to %q: %w", key, err)
+	}
+	return nil
+}
+
+func (m kvStoreManifest) PutManifestSignature(ctx context.Context, dataShareProcessorName string, sig manifest.Signature) error {
+	sigBytes, err := json.Marshal(sig)
+	if err != nil {
+		return fmt.Errorf("couldn't marshal manifest signature as JSON: %w", err)
+	}
+	key := m.signatureKeyFor(dataShareProcessorName)
+	if err := m.kv.put(ctx, key, sigBytes); err != nil {
+		return fmt.Errorf("couldn't put manifest signature to %q: %w", key, err)
+	}
+	return nil
+}
+
 func (m kvStoreManifest) PutIngestorGlobalManifest(ctx context.Context, manifest manifest.IngestorGlobalManifest) error {
 	manifestBytes, err := json.Marshal(manifest)
 	if err != nil {
@@ -181,8 +415,108 @@ func (m kvStoreManifest) GetIngestorGlobalManifest(ctx context.Context) (manifes
 	return igm, nil
 }
 
+func (m kvStoreManifest) GetManifestSignature(ctx context.Context, dataShareProcessorName string) (manifest.Signature, error) {
+	key := m.signatureKeyFor(dataShareProcessorName)
+	sigBytes, err := m.kv.get(ctx, key)
+	if err != nil {
+		return manifest.Signature{}, fmt.Errorf("couldn't get manifest signature from %q: %w", key, err)
+	}
+	var sig manifest.Signature
+	if err := json.Unmarshal(sigBytes, &sig); err != nil {
+		return manifest.Signature{}, fmt.Errorf("couldn't unmarshal manifest signature from JSON: %w", err)
+	}
+	return sig, nil
+}
+
+func (m kvStoreManifest) GetDataShareProcessorSpecificManifestVersion(ctx context.Context, dataShareProcessorName string) (string, error) {
+	key := m.keyFor(dataShareProcessorName)
+	version, err := m.kv.version(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("couldn't get manifest version from %q: %w", key, err)
+	}
+	return version, nil
+}
+
+func (m kvStoreManifest) ListDataShareProcessorSpecificManifests(ctx context.Context) ([]string, error) {
+	prefix := m.keyPrefix
+	if prefix = path.Clean(prefix); prefix == "." {
+		prefix = ""
+	} else {
+		prefix += "/"
+	}
+	keys, err := m.kv.list(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list manifests: %w", err)
+	}
+	var dspNames []string
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, prefix)
+		if strings.Contains(name, "/") || !strings.HasSuffix(name, manifestKeySuffix) {
+			continue
+		}
+		if name = strings.TrimSuffix(name, manifestKeySuffix); name == ingestorGlobalManifestDataShareProcessorName {
+			continue
+		}
+		dspNames = append(dspNames, name)
+	}
+	sort.Strings(dspNames)
+	return dspNames, nil
+}
+
+func (m kvStoreManifest) PutRotationStatus(ctx context.Context, locality string, status manifest.RotationStatus) error {
+	statusBytes, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("couldn't marshal rotation status as JSON: %w", err)
+	}
+	key := m.rotationStatusKeyFor(locality)
+	if err := m.kv.put(ctx, key, statusBytes); err != nil {
+		return fmt.Errorf("couldn't put rotation status to %q: %w", key, err)
+	}
+	return nil
+}
+
+func (m kvStoreManifest) DeleteDataShareProcessorSpecificManifest(ctx context.Context, dataShareProcessorName string) error {
+	key := m.keyFor(dataShareProcessorName)
+	if err := m.kv.delete(ctx, key); err != nil {
+		return fmt.Errorf("couldn't delete manifest %q: %w", key, err)
+	}
+	key = m.jwksKeyFor(dataShareProcessorName)
+	if err := m.kv.delete(ctx, key); err != nil {
+		return fmt.Errorf("couldn't delete JWKS %q: %w", key, err)
+	}
+	key = m.signatureKeyFor(dataShareProcessorName)
+	if err := m.kv.delete(ctx, key); err != nil {
+		return fmt.Errorf("couldn't delete manifest signature %q: %w", key, err)
+	}
+	return nil
+}
+
+func (m kvStoreManifest) DeleteRotationStatus(ctx context.Context, locality string) error {
+	key := m.rotationStatusKeyFor(locality)
+	if err := m.kv.delete(ctx, key); err != nil {
+		return fmt.Errorf("couldn't delete rotation status %q: %w", key, err)
+	}
+	return nil
+}
+
 func (m kvStoreManifest) keyFor(dataShareProcessorName string) string {
-	return path.Join(m.keyPrefix, fmt.Sprintf("%s-manifest.json", dataShareProcessorName))
+	return path.Join(m.keyPrefix, dataShareProcessorName+manifestKeySuffix)
+}
+
+// manifestKeySuffix is the suffix of the keys of all manifests, following the
+// data share processor name.
+const manifestKeySuffix = "-manifest.json"
+
+func (m kvStoreManifest) jwksKeyFor(dataShareProcessorName string) string {
+	return path.Join(m.keyPrefix, fmt.Sprintf("%s-jwks.json", dataShareProcessorName))
+}
+
+func (m kvStoreManifest) signatureKeyFor(dataShareProcessorName string) string {
+	return m.keyFor(dataShareProcessorName) + ".sig"
+}
+
+func (m kvStoreManifest) rotationStatusKeyFor(locality string) string {
+	return path.Join(m.keyPrefix, fmt.Sprintf("%s-rotation-status.json", locality))
 }
 
 // kvStore represents a given key/value object store backing a kvStoreManifest.
@@ -197,6 +531,34 @@ type kvStore interface {
 	// put puts the given content to the given key, or returns an error if it
 	// can't.
 	put(ctx context.Context, key string, data []byte) error
+
+	// version gets an opaque identifier for the current content of a given
+	// key without retrieving the content, or returns an error if it can't. If
+	// the key does not exist, an error wrapping ErrObjectNotExist is returned.
+	version(ctx context.Context, key string) (string, error)
+
+	// delete deletes a given key, or returns an error if it can't. A key
+	// which does not exist is ignored.
+	delete(ctx context.Context, key string) error
+
+	// list returns every key beginning with the given prefix, or returns an
+	// error if it can't.
+	list(ctx context.Context, prefix string) ([]string, error)
+}
+
+// streamingKVStore is a kvStore which can additionally stream the content of
+// objects too large to comfortably hold in memory.
+type streamingKVStore interface {
+	kvStore
+
+	// open opens the content of a given key for reading, or returns an error
+	// if it can't. The caller must close the returned reader. If the key
+	// does not exist, an error wrapping ErrObjectNotExist is returned.
+	open(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// checkWrite returns an error if the caller isn't permitted to put the
+	// given key, without putting it.
+	checkWrite(ctx context.Context, key string) error
 }
 
 type gcsKVStore struct {
@@ -204,9 +566,9 @@ type gcsKVStore struct {
 	bucket string
 }
 
-var _ kvStore = gcsKVStore{} // verify gcsDatastore satisfies kvStore.
+var _ streamingKVStore = gcsKVStore{} // verify gcsDatastore satisfies streamingKVStore.
 
-func (kv gcsKVStore) get(ctx context.Context, key string) (_ []byte, retErr error) {
+func (kv gcsKVStore) open(ctx context.Context, key string) (io.ReadCloser, error) {
 	r, err := kv.gcs.Bucket(kv.bucket).Object(key).NewReader(ctx)
 	if err != nil {
 		if err == storage.ErrObjectNotExist {
@@ -214,6 +576,14 @@ func (kv gcsKVStore) get(ctx context.Context, key string) (_ []byte, retErr erro
 		}
 		return nil, fmt.Errorf("couldn't retrieve gs://%s/%s: %w", kv.bucket, key, err)
 	}
+	return r, nil
+}
+
+func (kv gcsKVStore) get(ctx context.Context, key string) (_ []byte, retErr error) {
+	r, err := kv.open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
 	defer func() {
 		if err := r.Close(); err != nil {
 			if retErr == nil {
@@ -255,14 +625,78 @@ func (kv gcsKVStore) put(ctx context.Context, key string, data []byte) error {
 	return nil
 }
 
+func (kv gcsKVStore) version(ctx context.Context, key string) (string, error) {
+	attrs, err := kv.gcs.Bucket(kv.bucket).Object(key).Attrs(ctx)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			err = ErrObjectNotExist
+		}
+		return "", fmt.Errorf("couldn't retrieve attributes of gs://%s/%s: %w", kv.bucket, key, err)
+	}
+	return strconv.FormatInt(attrs.Generation, 10), nil
+}
+
+func (kv gcsKVStore) list(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	it := kv.gcs.Bucket(kv.bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("couldn't list gs://%s/%s: %w", kv.bucket, prefix, err)
+		}
+		keys = append(keys, attrs.Name)
+	}
+	return keys, nil
+}
+
+func (kv gcsKVStore) delete(ctx context.Context, key string) error {
+	log.Info().
+		Str("storage", "GCS").
+		Str("bucket", kv.bucket).
+		Str("key", key).
+		Msgf("Deleting gs://%s/%s", kv.bucket, key)
+	if err := kv.gcs.Bucket(kv.bucket).Object(key).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+		return fmt.Errorf("couldn't delete gs://%s/%s: %w", kv.bucket, key, err)
+	}
+	return nil
+}
+
+// gcsWritePermissions are the IAM permissions required to put & delete
+// objects.
+var gcsWritePermissions = []string{"storage.objects.create", "storage.objects.delete"}
+
+func (kv gcsKVStore) checkWrite(ctx context.Context, key string) error {
+	granted, err := kv.gcs.Bucket(kv.bucket).IAM().TestPermissions(ctx, gcsWritePermissions)
+	if err != nil {
+		return fmt.Errorf("couldn't test permissions on gs://%s: %w", kv.bucket, err)
+	}
+	var missing []string
+	for _, p := range gcsWritePermissions {
+		found := false
+		for _, g := range granted {
+			found = found || g == p
+		}
+		if !found {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing permissions %q on gs://%s", missing, kv.bucket)
+	}
+	return nil
+}
+
 type s3KVStore struct {
 	s3     *s3.S3
 	bucket string
 }
 
-var _ kvStore = s3KVStore{} // verify s3KVStore satisfies kvStore.
+var _ streamingKVStore = s3KVStore{} // verify s3KVStore satisfies streamingKVStore.
 
-func (kv s3KVStore) get(ctx context.Context, key string) (_ []byte, retErr error) {
+func (kv s3KVStore) open(ctx context.Context, key string) (io.ReadCloser, error) {
 	objOut, err := kv.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(kv.bucket),
 		Key:    aws.String(key),
@@ -273,7 +707,14 @@ func (kv s3KVStore) get(ctx context.Context, key string) (_ []byte, retErr error
 		}
 		return nil, fmt.Errorf("couldn't retrieve s3://%s/%s: %w", kv.bucket, key, err)
 	}
-	r := objOut.Body
+	return objOut.Body, nil
+}
+
+func (kv s3KVStore) get(ctx context.Context, key string) (_ []byte, retErr error) {
+	r, err := kv.open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
 	defer func() {
 		if err := r.Close(); err != nil {
 			if retErr == nil {
@@ -308,3 +749,78 @@ func (kv s3KVStore) put(ctx context.Context, key string, data []byte) error {
 	}
 	return nil
 }
+
+func (kv s3KVStore) version(ctx context.Context, key string) (string, error) {
+	headOut, err := kv.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(kv.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		// HEAD responses have no body, so S3 reports a missing object with
+		// the generic "NotFound" code rather than ErrCodeNoSuchKey.
+		if awsErr, ok := err.(awserr.Error); ok && (awsErr.Code() == "NotFound" || awsErr.Code() == s3.ErrCodeNoSuchKey) {
+			err = ErrObjectNotExist
+		}
+		return "", fmt.Errorf("couldn't retrieve attributes of s3://%s/%s: %w", kv.bucket, key, err)
+	}
+	return aws.StringValue(headOut.ETag), nil
+}
+
+func (kv s3KVStore) list(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	if err := kv.s3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(kv.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.StringValue(obj.Key))
+		}
+		return true
+	}); err != nil {
+		return nil, fmt.Errorf("couldn't list s3://%s/%s: %w", kv.bucket, prefix, err)
+	}
+	return keys, nil
+}
+
+func (kv s3KVStore) delete(ctx context.Context, key string) error {
+	log.Info().
+		Str("storage", "S3").
+		Str("bucket", kv.bucket).
+		Str("key", key).
+		Msgf("Deleting s3://%s/%s", kv.bucket, key)
+	// S3 reports success when deleting an object which does not exist.
+	if _, err := kv.s3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(kv.bucket),
+		Key:    aws.String(key),
+	}); err != nil {
+		return fmt.Errorf("couldn't delete s3://%s/%s: %w", kv.bucket, key, err)
+	}
+	return nil
+}
+
+// emptyContentMD5 is the base64-encoded MD5 digest of empty content.
+const emptyContentMD5 = "1B2M2Y8AsgTpgAmY7PhCfg=="
+
+// checkWrite attempts to put the key as put does, but with a Content-MD5
+// header which doesn't match the content. S3 authorizes a request before
+// checking its content's digest, so the put fails with BadDigest, writing
+// nothing, if & only if it would otherwise have been permitted.
+func (kv s3KVStore) checkWrite(ctx context.Context, key string) error {
+	_, err := kv.s3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		ACL:         aws.String(s3.BucketCannedACLPublicRead),
+		Body:        bytes.NewReader([]byte("{}")),
+		Bucket:      aws.String(kv.bucket),
+		Key:         aws.String(key),
+		ContentMD5:  aws.String(emptyContentMD5),
+		ContentType: aws.String("application/json; charset=UTF-8"),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "BadDigest" {
+		return nil
+	}
+	if err == nil {
+		// Should be impossible, but if S3 accepted the object, don't leave
+		// it behind.
+		return kv.delete(ctx, key)
+	}
+	return fmt.Errorf("couldn't check write access to s3://%s/%s: %w", kv.bucket, key, err)
+}
@@ -2,8 +2,12 @@ package storage
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"path"
 	"strings"
 	"testing"
@@ -62,6 +66,36 @@ func TestManifest(t *testing.T) {
 				}
 			})
 
+			t.Run("PutJWKS", func(t *testing.T) {
+				t.Parallel()
+				m, kvs := newKVStoreManifest(test.keyPrefix)
+				jwks := manifest.JSONWebKeySet{Keys: []manifest.JSONWebKey{{
+					KeyType: "OKP", KeyID: "key-id", Use: "sig", Algorithm: "EdDSA", Curve: "Ed25519", X: "x",
+				}}}
+				wantKVs := map[string][]byte{path.Join(test.keyPrefix, "dsp-jwks.json"): []byte(
+					`{"keys":[{"kty":"OKP","kid":"key-id","use":"sig","alg":"EdDSA","crv":"Ed25519","x":"x"}]}`)}
+				if err := m.PutJWKS(ctx, dspName, jwks); err != nil {
+					t.Fatalf("Unexpected error from PutJWKS: %v", err)
+				}
+				if diff := cmp.Diff(wantKVs, kvs); diff != "" {
+					t.Errorf("Unexpected datastore content (-want +got):\n%s", diff)
+				}
+			})
+
+			t.Run("PutManifestSignature", func(t *testing.T) {
+				t.Parallel()
+				m, kvs := newKVStoreManifest(test.keyPrefix)
+				sig := manifest.Signature{KeyIdentifier: "key-id", Signature: []byte("sig")}
+				wantKVs := map[string][]byte{path.Join(test.keyPrefix, "dsp-manifest.json.sig"): []byte(
+					`{"key-identifier":"key-id","signature":"c2ln"}`)}
+				if err := m.PutManifestSignature(ctx, dspName, sig); err != nil {
+					t.Fatalf("Unexpected error from PutManifestSignature: %v", err)
+				}
+				if diff := cmp.Diff(wantKVs, kvs); diff != "" {
+					t.Errorf("Unexpected datastore content (-want +got):\n%s", diff)
+				}
+			})
+
 			t.Run("PutIngestorGlobalManifest", func(t *testing.T) {
 				t.Parallel()
 				m, kvs := newKVStoreManifest(test.keyPrefix)
@@ -74,6 +108,71 @@ func TestManifest(t *testing.T) {
 				}
 			})
 
+			t.Run("PutRotationStatus", func(t *testing.T) {
+				t.Parallel()
+				m, kvs := newKVStoreManifest(test.keyPrefix)
+				status := manifest.RotationStatus{
+					Format:          1,
+					LastSuccess:     "2021-06-01T00:00:00Z",
+					ManifestDigests: map[string]string{"ingestor": "digest"},
+				}
+				statusBytes, err := json.Marshal(status)
+				if err != nil {
+					t.Fatalf("Couldn't marshal rotation status to JSON: %v", err)
+				}
+				wantKVs := map[string][]byte{path.Join(test.keyPrefix, "locality-rotation-status.json"): statusBytes}
+				if err := m.PutRotationStatus(ctx, "locality", status); err != nil {
+					t.Fatalf("Unexpected error from PutRotationStatus: %v", err)
+				}
+				if diff := cmp.Diff(wantKVs, kvs); diff != "" {
+					t.Errorf("Unexpected datastore content (-want +got):\n%s", diff)
+				}
+			})
+
+			t.Run("Delete", func(t *testing.T) {
+				t.Parallel()
+				m, kvs := newKVStoreManifest(test.keyPrefix)
+				otherKey := path.Join(test.keyPrefix, "other-dsp-manifest.json")
+				kvs[path.Join(test.keyPrefix, "dsp-manifest.json")] = dspManifestBytes
+				kvs[path.Join(test.keyPrefix, "dsp-jwks.json")] = []byte("{}")
+				kvs[path.Join(test.keyPrefix, "dsp-manifest.json.sig")] = []byte("{}")
+				kvs[path.Join(test.keyPrefix, "locality-rotation-status.json")] = []byte("{}")
+				kvs[otherKey] = dspManifestBytes
+				wantKVs := map[string][]byte{otherKey: dspManifestBytes}
+				for i := 0; i < 2; i++ {
+					if err := m.DeleteDataShareProcessorSpecificManifest(ctx, dspName); err != nil {
+						t.Fatalf("Unexpected error from DeleteDataShareProcessorSpecificManifest (attempt %d): %v", i, err)
+					}
+					if err := m.DeleteRotationStatus(ctx, "locality"); err != nil {
+						t.Fatalf("Unexpected error from DeleteRotationStatus (attempt %d): %v", i, err)
+					}
+					if diff := cmp.Diff(wantKVs, kvs); diff != "" {
+						t.Errorf("Unexpected datastore content (attempt %d) (-want +got):\n%s", i, diff)
+					}
+				}
+			})
+
+			t.Run("ListDataShareProcessorSpecificManifests", func(t *testing.T) {
+				t.Parallel()
+				m, kvs := newKVStoreManifest(test.keyPrefix)
+				m.defaultManifestByDSP = map[string]manifest.DataShareProcessorSpecificManifest{"default-dsp": dspManifest}
+				kvs[path.Join(test.keyPrefix, "dsp-manifest.json")] = dspManifestBytes
+				kvs[path.Join(test.keyPrefix, "a-dsp-manifest.json")] = dspManifestBytes
+				kvs[path.Join(test.keyPrefix, "global-manifest.json")] = globalManifestBytes
+				kvs[path.Join(test.keyPrefix, "dsp-jwks.json")] = []byte("{}")
+				kvs[path.Join(test.keyPrefix, "dsp-manifest.json.sig")] = []byte("{}")
+				kvs[path.Join(test.keyPrefix, "locality-rotation-status.json")] = []byte("{}")
+				kvs[path.Join(test.keyPrefix, "nested/other-dsp-manifest.json")] = dspManifestBytes
+				kvs["unrelated/prefix/other-dsp-manifest.json"] = dspManifestBytes
+				got, err := m.ListDataShareProcessorSpecificManifests(ctx)
+				if err != nil {
+					t.Fatalf("Unexpected error from ListDataShareProcessorSpecificManifests: %v", err)
+				}
+				if diff := cmp.Diff([]string{"a-dsp", dspName}, got); diff != "" {
+					t.Errorf("Unexpected data share processor names (-want +got):\n%s", diff)
+				}
+			})
+
 			t.Run("GetDataShareProcessorSpecificManifest", func(t *testing.T) {
 				t.Parallel()
 				t.Run("valid manifest", func(t *testing.T) {
@@ -141,6 +240,78 @@ func TestManifest(t *testing.T) {
 				})
 			})
 
+			t.Run("GetDataShareProcessorSpecificManifestVersion", func(t *testing.T) {
+				t.Parallel()
+				t.Run("version changes on write", func(t *testing.T) {
+					t.Parallel()
+					m, _ := newKVStoreManifest(test.keyPrefix)
+					if err := m.PutDataShareProcessorSpecificManifest(ctx, dspName, dspManifest); err != nil {
+						t.Fatalf("Unexpected error from PutDataShareProcessorSpecificManifest: %v", err)
+					}
+					oldVersion, err := m.GetDataShareProcessorSpecificManifestVersion(ctx, dspName)
+					if err != nil {
+						t.Fatalf("Unexpected error from GetDataShareProcessorSpecificManifestVersion: %v", err)
+					}
+					newManifest := dspManifest
+					newManifest.IngestionBucket = "other_ingestion_bucket"
+					if err := m.PutDataShareProcessorSpecificManifest(ctx, dspName, newManifest); err != nil {
+						t.Fatalf("Unexpected error from PutDataShareProcessorSpecificManifest: %v", err)
+					}
+					newVersion, err := m.GetDataShareProcessorSpecificManifestVersion(ctx, dspName)
+					if err != nil {
+						t.Fatalf("Unexpected error from GetDataShareProcessorSpecificManifestVersion: %v", err)
+					}
+					if oldVersion == newVersion {
+						t.Errorf("Manifest version unchanged (%q) after write", newVersion)
+					}
+				})
+
+				t.Run("no manifest", func(t *testing.T) {
+					t.Parallel()
+					m, _ := newKVStoreManifest(test.keyPrefix)
+					if _, err := m.GetDataShareProcessorSpecificManifestVersion(ctx, dspName); !errors.Is(err, ErrObjectNotExist) {
+						t.Errorf("Unexpected error from GetDataShareProcessorSpecificManifestVersion: %v", err)
+					}
+				})
+			})
+
+			t.Run("GetManifestSignature", func(t *testing.T) {
+				t.Parallel()
+				t.Run("valid signature", func(t *testing.T) {
+					t.Parallel()
+					m, kvs := newKVStoreManifest(test.keyPrefix)
+					kvs[path.Join(test.keyPrefix, "dsp-manifest.json.sig")] = []byte(`{"key-identifier":"key-id","signature":"c2ln"}`)
+					wantSig := manifest.Signature{KeyIdentifier: "key-id", Signature: []byte("sig")}
+					gotSig, err := m.GetManifestSignature(ctx, dspName)
+					if err != nil {
+						t.Fatalf("Unexpected error from GetManifestSignature: %v", err)
+					}
+					if diff := cmp.Diff(wantSig, gotSig); diff != "" {
+						t.Errorf("Unexpected signature (-want +got):\n%s", diff)
+					}
+				})
+
+				t.Run("no signature", func(t *testing.T) {
+					t.Parallel()
+					m, kvs := newKVStoreManifest(test.keyPrefix)
+					kvs[path.Join(test.keyPrefix, "dsp-manifest.json")] = dspManifestBytes
+					if _, err := m.GetManifestSignature(ctx, dspName); !errors.Is(err, ErrObjectNotExist) {
+						t.Errorf("Unexpected error from GetManifestSignature: %v", err)
+					}
+				})
+
+				t.Run("invalid signature", func(t *testing.T) {
+					t.Parallel()
+					m, kvs := newKVStoreManifest(test.keyPrefix)
+					kvs[path.Join(test.keyPrefix, "dsp-manifest.json.sig")] = []byte("bogus non-json data")
+					_, err := m.GetManifestSignature(ctx, dspName)
+					const wantErrStr = "couldn't unmarshal"
+					if err == nil || !strings.Contains(err.Error(), wantErrStr) {
+						t.Errorf("Unexpected error from GetManifestSignature: %v", err)
+					}
+				})
+			})
+
 			t.Run("GetIngestorGlobalManifest", func(t *testing.T) {
 				t.Parallel()
 				t.Run("valid manifest", func(t *testing.T) {
@@ -211,3 +382,61 @@ func (kv memKV) get(_ context.Context, key string) ([]byte, error) {
 	copy(data, v)
 	return data, nil
 }
+
+func (kv memKV) delete(_ context.Context, key string) error {
+	delete(kv.kvs, key)
+	return nil
+}
+
+func (kv memKV) list(_ context.Context, prefix string) ([]string, error) {
+	var keys []string
+	for key := range kv.kvs {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (kv memKV) version(_ context.Context, key string) (string, error) {
+	v, ok := kv.kvs[key]
+	if !ok {
+		return "", ErrObjectNotExist
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(v)), nil
+}
+
+func TestS3CompatibleManifest(t *testing.T) {
+	t.Parallel()
+
+	// Serve a manifest from a fake S3-compatible service, recording the path
+	// & credentials of each request.
+	var gotPath, gotAuthorization string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotAuthorization = r.URL.Path, r.Header.Get("Authorization")
+		fmt.Fprint(w, `{"format": 1, "ingestion-bucket": "ingestion_bucket"}`)
+	}))
+	defer srv.Close()
+
+	m, err := NewManifest(ctx, "s3://manifests",
+		WithAWSRegion("us-east-1"),
+		WithS3Endpoint(srv.URL),
+		WithS3ForcePathStyle(true),
+		WithAWSStaticCredentials("minio-user", "minio-secret"))
+	if err != nil {
+		t.Fatalf("Unexpected error from NewManifest: %v", err)
+	}
+	got, err := m.GetDataShareProcessorSpecificManifest(ctx, "dsp")
+	if err != nil {
+		t.Fatalf("Unexpected error from GetDataShareProcessorSpecificManifest: %v", err)
+	}
+	if want := (manifest.DataShareProcessorSpecificManifest{Format: 1, IngestionBucket: "ingestion_bucket"}); !cmp.Equal(want, got) {
+		t.Errorf("Unexpected manifest (-want +got):\n%s", cmp.Diff(want, got))
+	}
+	if want := "/manifests/dsp-manifest.json"; gotPath != want {
+		t.Errorf("Manifest read from path %q, want %q", gotPath, want)
+	}
+	if !strings.Contains(gotAuthorization, "Credential=minio-user/") {
+		t.Errorf("Manifest read without static credentials: Authorization %q", gotAuthorization)
+	}
+}
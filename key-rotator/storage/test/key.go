@@ -14,6 +14,7 @@ func NewKey() *Key {
 	return &Key{
 		batchSigningKeys:     map[LocalityIngestor]key.Key{},
 		packetEncryptionKeys: map[string]key.Key{},
+		taskSigningKeys:      map[string]key.Key{},
 	}
 }
 
@@ -21,6 +22,7 @@ type Key struct {
 	mu                   sync.Mutex // protects all fields
 	batchSigningKeys     map[LocalityIngestor]key.Key
 	packetEncryptionKeys map[string]key.Key // locality -> key
+	taskSigningKeys      map[string]key.Key // locality -> key
 }
 
 // LocalityIngestor represents a (locality, ingestor) tuple.
@@ -43,6 +45,13 @@ func (k *Key) PutPacketEncryptionKey(ctx context.Context, locality string, key k
 	return nil
 }
 
+func (k *Key) PutTaskSigningKey(ctx context.Context, locality string, key key.Key) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.taskSigningKeys[locality] = key
+	return nil
+}
+
 func (k *Key) GetBatchSigningKey(ctx context.Context, locality, ingestor string) (key.Key, error) {
 	k.mu.Lock()
 	defer k.mu.Unlock()
@@ -63,7 +72,30 @@ func (k *Key) GetPacketEncryptionKey(ctx context.Context, locality string) (key.
 	return pek, nil
 }
 
+func (k *Key) GetTaskSigningKey(ctx context.Context, locality string) (key.Key, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	tsk, ok := k.taskSigningKeys[locality]
+	if !ok {
+		return key.Key{}, fmt.Errorf("no task signing key stored for %q", locality)
+	}
+	return tsk, nil
+}
+
+func (k *Key) DeleteKeys(ctx context.Context, locality string, ingestors []string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.packetEncryptionKeys, locality)
+	delete(k.taskSigningKeys, locality)
+	for _, ingestor := range ingestors {
+		delete(k.batchSigningKeys, LocalityIngestor{locality, ingestor})
+	}
+	return nil
+}
+
 // Test-only functions. Not goroutine-safe.
 func (k *Key) BatchSigningKeys() map[LocalityIngestor]key.Key { return k.batchSigningKeys }
 
 func (k *Key) PacketEncryptionKeys() map[string]key.Key { return k.packetEncryptionKeys }
+
+func (k *Key) TaskSigningKeys() map[string]key.Key { return k.taskSigningKeys }
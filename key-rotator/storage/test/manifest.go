@@ -4,6 +4,8 @@ package test
 
 import (
 	"context"
+	"sort"
+	"strconv"
 	"sync"
 
 	"github.com/abetterinternet/prio-server/key-rotator/manifest"
@@ -16,6 +18,9 @@ func NewManifest() *Manifest {
 	return &Manifest{
 		dspManifests: map[string]manifest.DataShareProcessorSpecificManifest{},
 		dspPutCount:  map[string]int{},
+		jwks:         map[string]manifest.JSONWebKeySet{},
+		signatures:   map[string]manifest.Signature{},
+		statuses:     map[string]manifest.RotationStatus{},
 	}
 }
 
@@ -25,8 +30,13 @@ type Manifest struct {
 	dspManifests map[string]manifest.DataShareProcessorSpecificManifest
 	dspPutCount  map[string]int
 
+	jwks       map[string]manifest.JSONWebKeySet
+	signatures map[string]manifest.Signature
+
 	ingestorManifest *manifest.IngestorGlobalManifest
 	ingestorPutCount int
+
+	statuses map[string]manifest.RotationStatus
 }
 
 var _ storage.Manifest = &Manifest{} // verify *Manifest satisfies storage.Manifest
@@ -40,6 +50,20 @@ func (m *Manifest) PutDataShareProcessorSpecificManifest(_ context.Context, dspN
 	return nil
 }
 
+func (m *Manifest) PutJWKS(_ context.Context, dspName string, jwks manifest.JSONWebKeySet) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jwks[dspName] = jwks
+	return nil
+}
+
+func (m *Manifest) PutManifestSignature(_ context.Context, dspName string, sig manifest.Signature) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.signatures[dspName] = sig
+	return nil
+}
+
 func (m *Manifest) PutIngestorGlobalManifest(_ context.Context, manifest manifest.IngestorGlobalManifest) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -66,6 +90,58 @@ func (m *Manifest) GetIngestorGlobalManifest(ctx context.Context) (manifest.Inge
 	return manifest.IngestorGlobalManifest{}, storage.ErrObjectNotExist
 }
 
+func (m *Manifest) GetManifestSignature(_ context.Context, dspName string) (manifest.Signature, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sig, ok := m.signatures[dspName]; ok {
+		return sig, nil
+	}
+	return manifest.Signature{}, storage.ErrObjectNotExist
+}
+
+func (m *Manifest) GetDataShareProcessorSpecificManifestVersion(_ context.Context, dspName string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.dspManifests[dspName]; ok {
+		return strconv.Itoa(m.dspPutCount[dspName]), nil
+	}
+	return "", storage.ErrObjectNotExist
+}
+
+func (m *Manifest) ListDataShareProcessorSpecificManifests(context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var dspNames []string
+	for dspName := range m.dspManifests {
+		dspNames = append(dspNames, dspName)
+	}
+	sort.Strings(dspNames)
+	return dspNames, nil
+}
+
+func (m *Manifest) PutRotationStatus(_ context.Context, locality string, status manifest.RotationStatus) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.statuses[locality] = status
+	return nil
+}
+
+func (m *Manifest) DeleteDataShareProcessorSpecificManifest(_ context.Context, dspName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.dspManifests, dspName)
+	delete(m.jwks, dspName)
+	delete(m.signatures, dspName)
+	return nil
+}
+
+func (m *Manifest) DeleteRotationStatus(_ context.Context, locality string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.statuses, locality)
+	return nil
+}
+
 // Test-only functions. NOT goroutine-safe.
 func (m *Manifest) GetDataShareProcessorSpecificManifests() map[string]manifest.DataShareProcessorSpecificManifest {
 	return m.dspManifests
@@ -75,4 +151,10 @@ func (m *Manifest) GetDataShareProcessorSpecificManifestPutCount(dspName string)
 	return m.dspPutCount[dspName]
 }
 
+func (m *Manifest) GetJWKS() map[string]manifest.JSONWebKeySet { return m.jwks }
+
+func (m *Manifest) GetManifestSignatures() map[string]manifest.Signature { return m.signatures }
+
 func (m *Manifest) GetIngestorGlobalManifestPutCount() int { return m.ingestorPutCount }
+
+func (m *Manifest) GetRotationStatuses() map[string]manifest.RotationStatus { return m.statuses }
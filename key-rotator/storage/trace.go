@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+	"github.com/abetterinternet/prio-server/key-rotator/manifest"
+)
+
+// tracerName names the OpenTelemetry tracer which records storage operations.
+const tracerName = "github.com/abetterinternet/prio-server/key-rotator/storage"
+
+// NewTracedKey returns a Key implementation which records an OpenTelemetry
+// span around each operation on k, attributed to the given backend, e.g.
+// "kubernetes" or "aws". Spans are recorded with the global tracer provider,
+// so are discarded unless the program configures one.
+func NewTracedKey(k Key, backend string) Key {
+	return tracedKey{k, backend, otel.Tracer(tracerName)}
+}
+
+type tracedKey struct {
+	k       Key
+	backend string
+	tracer  trace.Tracer
+}
+
+var _ Key = tracedKey{} // verify tracedKey satisfies Key
+
+func (k tracedKey) PutBatchSigningKey(ctx context.Context, locality, ingestor string, key key.Key) error {
+	ctx, span := startSpan(ctx, k.tracer, "PutBatchSigningKey", k.backend, attribute.String("locality", locality), attribute.String("ingestor", ingestor))
+	err := k.k.PutBatchSigningKey(ctx, locality, ingestor, key)
+	EndSpan(span, err)
+	return err
+}
+
+func (k tracedKey) PutPacketEncryptionKey(ctx context.Context, locality string, key key.Key) error {
+	ctx, span := startSpan(ctx, k.tracer, "PutPacketEncryptionKey", k.backend, attribute.String("locality", locality))
+	err := k.k.PutPacketEncryptionKey(ctx, locality, key)
+	EndSpan(span, err)
+	return err
+}
+
+func (k tracedKey) PutTaskSigningKey(ctx context.Context, locality string, key key.Key) error {
+	ctx, span := startSpan(ctx, k.tracer, "PutTaskSigningKey", k.backend, attribute.String("locality", locality))
+	err := k.k.PutTaskSigningKey(ctx, locality, key)
+	EndSpan(span, err)
+	return err
+}
+
+func (k tracedKey) GetBatchSigningKey(ctx context.Context, locality, ingestor string) (key.Key, error) {
+	ctx, span := startSpan(ctx, k.tracer, "GetBatchSigningKey", k.backend, attribute.String("locality", locality), attribute.String("ingestor", ingestor))
+	key, err := k.k.GetBatchSigningKey(ctx, locality, ingestor)
+	EndSpan(span, err)
+	return key, err
+}
+
+func (k tracedKey) GetPacketEncryptionKey(ctx context.Context, locality string) (key.Key, error) {
+	ctx, span := startSpan(ctx, k.tracer, "GetPacketEncryptionKey", k.backend, attribute.String("locality", locality))
+	key, err := k.k.GetPacketEncryptionKey(ctx, locality)
+	EndSpan(span, err)
+	return key, err
+}
+
+func (k tracedKey) GetTaskSigningKey(ctx context.Context, locality string) (key.Key, error) {
+	ctx, span := startSpan(ctx, k.tracer, "GetTaskSigningKey", k.backend, attribute.String("locality", locality))
+	key, err := k.k.GetTaskSigningKey(ctx, locality)
+	EndSpan(span, err)
+	return key, err
+}
+
+func (k tracedKey) DeleteKeys(ctx context.Context, locality string, ingestors []string) error {
+	ctx, span := startSpan(ctx, k.tracer, "DeleteKeys", k.backend, attribute.String("locality", locality), attribute.StringSlice("ingestors", ingestors))
+	err := k.k.DeleteKeys(ctx, locality, ingestors)
+	EndSpan(span, err)
+	return err
+}
+
+// NewTracedManifest returns a Manifest implementation which records an
+// OpenTelemetry span around each operation on m, attributed to the given
+// backend, e.g. the manifest bucket URL. Spans are recorded with the global
+// tracer provider, so are discarded unless the program configures one.
+func NewTracedManifest(m Manifest, backend string) Manifest {
+	return tracedManifest{m, backend, otel.Tracer(tracerName)}
+}
+
+type tracedManifest struct {
+	m       Manifest
+	backend string
+	tracer  trace.Tracer
+}
+
+var _ Manifest = tracedManifest{} // verify tracedManifest satisfies Manifest
+
+func (m tracedManifest) PutDataShareProcessorSpecificManifest(ctx context.Context, dataShareProcessorName string, manifest manifest.DataShareProcessorSpecificManifest) error {
+	ctx, span := startSpan(ctx, m.tracer, "PutDataShareProcessorSpecificManifest", m.backend, attribute.String("data-share-processor", dataShareProcessorName))
+	err := m.m.PutDataShareProcessorSpecificManifest(ctx, dataShareProcessorName, manifest)
+	EndSpan(span, err)
+	return err
+}
+
+func (m tracedManifest) PutJWKS(ctx context.Context, dataShareProcessorName string, jwks manifest.JSONWebKeySet) error {
+	ctx, span := startSpan(ctx, m.tracer, "PutJWKS", m.backend, attribute.String("data-share-processor", dataShareProcessorName))
+	err := m.m.PutJWKS(ctx, dataShareProcessorName, jwks)
+	EndSpan(span, err)
+	return err
+}
+
+func (m tracedManifest) PutManifestSignature(ctx context.Context, dataShareProcessorName string, sig manifest.Signature) error {
+	ctx, span := startSpan(ctx, m.tracer, "PutManifestSignature", m.backend, attribute.String("data-share-processor", dataShareProcessorName))
+	err := m.m.PutManifestSignature(ctx, dataShareProcessorName, sig)
+	EndSpan(span, err)
+	return err
+}
+
+func (m tracedManifest) PutIngestorGlobalManifest(ctx context.Context, manifest manifest.IngestorGlobalManifest) error {
+	ctx, span := startSpan(ctx, m.tracer, "PutIngestorGlobalManifest", m.backend)
+	err := m.m.PutIngestorGlobalManifest(ctx, manifest)
+	EndSpan(span, err)
+	return err
+}
+
+func (m tracedManifest) GetDataShareProcessorSpecificManifest(ctx context.Context, dataShareProcessorName string) (manifest.DataShareProcessorSpecificManifest, error) {
+	ctx, span := startSpan(ctx, m.tracer, "GetDataShareProcessorSpecificManifest", m.backend, attribute.String("data-share-processor", dataShareProcessorName))
+	manifest, err := m.m.GetDataShareProcessorSpecificManifest(ctx, dataShareProcessorName)
+	EndSpan(span, err)
+	return manifest, err
+}
+
+func (m tracedManifest) GetIngestorGlobalManifest(ctx context.Context) (manifest.IngestorGlobalManifest, error) {
+	ctx, span := startSpan(ctx, m.tracer, "GetIngestorGlobalManifest", m.backend)
+	manifest, err := m.m.GetIngestorGlobalManifest(ctx)
+	EndSpan(span, err)
+	return manifest, err
+}
+
+func (m tracedManifest) GetManifestSignature(ctx context.Context, dataShareProcessorName string) (manifest.Signature, error) {
+	ctx, span := startSpan(ctx, m.tracer, "GetManifestSignature", m.backend, attribute.String("data-share-processor", dataShareProcessorName))
+	sig, err := m.m.GetManifestSignature(ctx, dataShareProcessorName)
+	EndSpan(span, err)
+	return sig, err
+}
+
+func (m tracedManifest) GetDataShareProcessorSpecificManifestVersion(ctx context.Context, dataShareProcessorName string) (string, error) {
+	ctx, span := startSpan(ctx, m.tracer, "GetDataShareProcessorSpecificManifestVersion", m.backend, attribute.String("data-share-processor", dataShareProcessorName))
+	version, err := m.m.GetDataShareProcessorSpecificManifestVersion(ctx, dataShareProcessorName)
+	EndSpan(span, err)
+	return version, err
+}
+
+func (m tracedManifest) ListDataShareProcessorSpecificManifests(ctx context.Context) ([]string, error) {
+	ctx, span := startSpan(ctx, m.tracer, "ListDataShareProcessorSpecificManifests", m.backend)
+	names, err := m.m.ListDataShareProcessorSpecificManifests(ctx)
+	EndSpan(span, err)
+	return names, err
+}
+
+func (m tracedManifest) PutRotationStatus(ctx context.Context, locality string, status manifest.RotationStatus) error {
+	ctx, span := startSpan(ctx, m.tracer, "PutRotationStatus", m.backend, attribute.String("locality", locality))
+	err := m.m.PutRotationStatus(ctx, locality, status)
+	EndSpan(span, err)
+	return err
+}
+
+func (m tracedManifest) DeleteDataShareProcessorSpecificManifest(ctx context.Context, dataShareProcessorName string) error {
+	ctx, span := startSpan(ctx, m.tracer, "DeleteDataShareProcessorSpecificManifest", m.backend, attribute.String("data-share-processor", dataShareProcessorName))
+	err := m.m.DeleteDataShareProcessorSpecificManifest(ctx, dataShareProcessorName)
+	EndSpan(span, err)
+	return err
+}
+
+func (m tracedManifest) DeleteRotationStatus(ctx context.Context, locality string) error {
+	ctx, span := startSpan(ctx, m.tracer, "DeleteRotationStatus", m.backend, attribute.String("locality", locality))
+	err := m.m.DeleteRotationStatus(ctx, locality)
+	EndSpan(span, err)
+	return err
+}
+
+// startSpan starts a span, named for the storage operation op, recording the
+// backend on which it is performed along with the given attributes.
+func startSpan(ctx context.Context, tracer trace.Tracer, op, backend string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append([]attribute.KeyValue{attribute.String("storage.backend", backend)}, attrs...)
+	return tracer.Start(ctx, "storage."+op, trace.WithAttributes(attrs...), trace.WithSpanKind(trace.SpanKindClient))
+}
+
+// EndSpan ends the given span, recording err, if non-nil, as its outcome.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
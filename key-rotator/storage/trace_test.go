@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracedKey(t *testing.T) {
+	t.Parallel()
+	rec := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)).Tracer("test")
+
+	store, k8s := newK8sKey()
+	k8s.putEmpty(bskSecretName)
+	if err := (tracedKey{store, "kubernetes", tracer}).PutBatchSigningKey(ctx, locality, ingestor, wantKey); err != nil {
+		t.Fatalf("Unexpected error from PutBatchSigningKey: %v", err)
+	}
+	if _, err := (tracedKey{failingKey{}, "vault", tracer}).GetPacketEncryptionKey(ctx, locality); !errors.Is(err, errFailingKey) {
+		t.Fatalf("Wanted error from GetPacketEncryptionKey, got: %v", err)
+	}
+
+	type span struct {
+		Name       string
+		Attributes map[attribute.Key]string
+		Status     codes.Code
+	}
+	wantSpans := []span{
+		{
+			Name:       "storage.PutBatchSigningKey",
+			Attributes: map[attribute.Key]string{"storage.backend": "kubernetes", "locality": locality, "ingestor": ingestor},
+			Status:     codes.Unset,
+		},
+		{
+			Name:       "storage.GetPacketEncryptionKey",
+			Attributes: map[attribute.Key]string{"storage.backend": "vault", "locality": locality},
+			Status:     codes.Error,
+		},
+	}
+	var gotSpans []span
+	for _, s := range rec.Ended() {
+		attrs := map[attribute.Key]string{}
+		for _, kv := range s.Attributes() {
+			attrs[kv.Key] = kv.Value.Emit()
+		}
+		gotSpans = append(gotSpans, span{s.Name(), attrs, s.Status().Code})
+	}
+	if diff := cmp.Diff(wantSpans, gotSpans); diff != "" {
+		t.Errorf("Spans differ from expected (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,19 @@
+package storage
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// NewHTTPTransport returns a new HTTP transport, configured identically to
+// http.DefaultTransport except that it refuses to negotiate any TLS version
+// older than minTLSVersion (e.g. tls.VersionTLS13). It is suitable for use by
+// cloud clients which must enforce a minimum TLS version.
+func NewHTTPTransport(minTLSVersion uint16) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	t.TLSClientConfig.MinVersion = minTLSVersion
+	return t
+}
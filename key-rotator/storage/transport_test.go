@@ -0,0 +1,18 @@
+package storage
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+)
+
+func TestNewHTTPTransport(t *testing.T) {
+	t.Parallel()
+	trans := NewHTTPTransport(tls.VersionTLS13)
+	if got := trans.TLSClientConfig.MinVersion; got != tls.VersionTLS13 {
+		t.Errorf("Unexpected minimum TLS version %#x, want %#x", got, tls.VersionTLS13)
+	}
+	if dt := http.DefaultTransport.(*http.Transport); dt.TLSClientConfig != nil && dt.TLSClientConfig.MinVersion == tls.VersionTLS13 {
+		t.Errorf("NewHTTPTransport modified http.DefaultTransport")
+	}
+}
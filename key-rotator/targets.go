@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"sigs.k8s.io/yaml"
+)
+
+// targetEnvVar is the environment variable through which a run of key-rotator
+// for a single target of --targets-file learns the target's name, so that the
+// metrics it pushes are grouped by target.
+const targetEnvVar = "KEY_ROTATOR_TARGET"
+
+// targetsFileContents is the format of the file given by --targets-file, in YAML or
+// JSON.
+type targetsFileContents struct {
+	Targets []rotationTarget `json:"targets"`
+}
+
+// rotationTarget describes a set of keys rotated by a run of key-rotator with
+// --targets-file. Fields which are unset take the value of the corresponding
+// flag given alongside --targets-file, if any.
+type rotationTarget struct {
+	// Name identifies the target in results & metrics. Defaults to
+	// "${prio-environment}/${locality}", or with localities,
+	// "${prio-environment}/${localities}".
+	Name                string   `json:"name,omitempty"`
+	PrioEnvironment     string   `json:"prio-environment,omitempty"`
+	Locality            string   `json:"locality,omitempty"`
+	Localities          []string `json:"localities,omitempty"` // as --localities, e.g. ["us-ca", "us-wa"] or ["all"]
+	Ingestors           []string `json:"ingestors,omitempty"`
+	ManifestBucketURL   string   `json:"manifest-bucket-url,omitempty"`
+	Kubeconfig          string   `json:"kubeconfig,omitempty"`
+	KubernetesNamespace string   `json:"kubernetes-namespace,omitempty"`
+	// Flags are any other flags to set for the target, e.g.
+	// {"aws-region": "us-west-2"}, without their leading dashes.
+	Flags map[string]string `json:"flags,omitempty"`
+}
+
+// readTargetsFile reads & validates the targets in the file at path.
+func readTargetsFile(path string) ([]rotationTarget, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read targets file: %w", err)
+	}
+	var file targetsFileContents
+	if err := yaml.UnmarshalStrict(contents, &file); err != nil {
+		return nil, fmt.Errorf("couldn't parse targets file: %w", err)
+	}
+	if len(file.Targets) == 0 {
+		return nil, errors.New("targets file has no targets")
+	}
+
+	names := map[string]bool{}
+	for i := range file.Targets {
+		t := &file.Targets[i]
+		if t.Locality == "" && len(t.Localities) == 0 {
+			return nil, fmt.Errorf("target %d: locality or localities is required", i)
+		}
+		if t.Locality != "" && len(t.Localities) > 0 {
+			return nil, fmt.Errorf("target %d: locality and localities are mutually exclusive", i)
+		}
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("%s/%s", t.PrioEnvironment, t.Locality+strings.Join(t.Localities, ","))
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("target %d: duplicate target name %q", i, t.Name)
+		}
+		names[t.Name] = true
+		for name := range t.Flags {
+			if !targetFlagAllowed(name) {
+				return nil, fmt.Errorf("target %q: flag %q can't be set for a target", t.Name, name)
+			}
+		}
+	}
+	return file.Targets, nil
+}
+
+// targetFlagAllowed returns true if the named flag may be set for a target,
+// i.e. it exists, and doesn't configure --targets-file itself or a mode which
+// can't be used with it.
+func targetFlagAllowed(name string) bool {
+	switch name {
+	case "targets-file", "target-concurrency", "read-prio-environment", "write-prio-environment", "watch", "migrate-keys":
+		return false
+	}
+	return flag.Lookup(name) != nil
+}
+
+// args returns the arguments of the run of key-rotator for the target:
+// sharedArgs, followed by the flags set by the target, which override any
+// set by sharedArgs.
+func (t rotationTarget) args(sharedArgs []string) []string {
+	args := append([]string{}, sharedArgs...)
+	for _, f := range []struct{ name, value string }{
+		{"prio-environment", t.PrioEnvironment},
+		{"locality", t.Locality},
+		{"localities", strings.Join(t.Localities, ",")},
+		{"ingestors", strings.Join(t.Ingestors, ",")},
+		{"manifest-bucket-url", t.ManifestBucketURL},
+		{"kubeconfig", t.Kubeconfig},
+		{"kubernetes-namespace", t.KubernetesNamespace},
+	} {
+		if f.value != "" {
+			args = append(args, fmt.Sprintf("--%s=%s", f.name, f.value))
+		}
+	}
+	var names []string
+	for name := range t.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, fmt.Sprintf("--%s=%s", name, t.Flags[name]))
+	}
+	return args
+}
+
+// sharedTargetArgs returns the flags set on the command line, other than
+// --targets-file & --target-concurrency, as arguments shared by the run for
+// each target.
+func sharedTargetArgs(flags *flag.FlagSet) []string {
+	var args []string
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "targets-file" || f.Name == "target-concurrency" {
+			return
+		}
+		args = append(args, fmt.Sprintf("--%s=%s", f.Name, f.Value.String()))
+	})
+	return args
+}
+
+// rotateTargetsConfig configures rotation of the keys of several targets,
+// e.g. environments, in a single run.
+type rotateTargetsConfig struct {
+	// Dependencies.
+	// run runs key-rotator for the named target with args, and returns an
+	// error if it fails.
+	run func(ctx context.Context, target string, args []string) error
+
+	// Configuration.
+	targets     []rotationTarget
+	sharedArgs  []string
+	concurrency int // the maximum number of targets rotated concurrently
+}
+
+// targetResult is the result of the rotation of a single target, written to
+// standard output as a line of JSON.
+type targetResult struct {
+	Target          string  `json:"target"`
+	OK              bool    `json:"ok"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// rotateTargets rotates the keys of each target, at most cfg.concurrency at a
+// time, writing the result of each to w in the order the targets are listed.
+// As with rotateLocalities, a failure to rotate one target's keys does not
+// prevent the rotation of the others' keys, and the targets which failed are
+// returned, in order, along with an error describing each failure.
+func rotateTargets(ctx context.Context, cfg rotateTargetsConfig, w io.Writer) (failed []string, _ error) {
+	results := make([]targetResult, len(cfg.targets))
+	sem := make(chan struct{}, cfg.concurrency)
+	var wg sync.WaitGroup
+	for i, target := range cfg.targets {
+		i, target := i, target
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			log.Info().Str("target", target.Name).Msgf("Rotating keys for target %q", target.Name)
+			start := time.Now()
+			err := cfg.run(ctx, target.Name, target.args(cfg.sharedArgs))
+			results[i] = targetResult{Target: target.Name, OK: err == nil, DurationSeconds: time.Since(start).Seconds()}
+			if err != nil {
+				log.Error().Str("target", target.Name).Err(err).Msgf("Couldn't rotate keys for target %q: %v", target.Name, err)
+				results[i].Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+
+	enc := json.NewEncoder(w)
+	var errStrs []string
+	for _, result := range results {
+		if err := enc.Encode(result); err != nil {
+			return nil, fmt.Errorf("couldn't write result of target %q: %w", result.Target, err)
+		}
+		if !result.OK {
+			failed = append(failed, result.Target)
+			errStrs = append(errStrs, fmt.Sprintf("%q: %s", result.Target, result.Error))
+		}
+	}
+	if len(failed) > 0 {
+		return failed, fmt.Errorf("couldn't rotate keys for %d of %d targets: %s", len(failed), len(cfg.targets), strings.Join(errStrs, "; "))
+	}
+	return nil, nil
+}
+
+// runTargetSubprocess runs the key-rotator executable for the named target
+// with args. Its output is written to standard error, leaving standard output
+// to the results of rotateTargets. If ctx is canceled, the run is sent
+// SIGTERM rather than killed, so that it may finish a rotation in progress, as
+// it would if it had been terminated itself.
+func runTargetSubprocess(ctx context.Context, target string, args []string) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("not started: %w", err)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("couldn't find key-rotator executable: %w", err)
+	}
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(cmd.Environ(), targetEnvVar+"="+target)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("couldn't start key-rotator: %w", err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+				log.Error().Str("target", target).Err(err).Msg("Couldn't terminate key-rotator")
+			}
+		case <-done:
+		}
+	}()
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("key-rotator failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer records spans for the phases of each rotation. Spans are discarded
+// unless tracing is enabled by initTracing.
+var tracer = otel.Tracer("github.com/abetterinternet/prio-server/key-rotator")
+
+// tracerProvider exports spans recorded by tracer & by the storage package,
+// if tracing is enabled; otherwise it is nil.
+var tracerProvider *sdktrace.TracerProvider
+
+// tracingEnabled returns true if the standard OpenTelemetry environment
+// variables, as read by getenv, configure an OTLP endpoint to which spans
+// should be exported.
+func tracingEnabled(getenv func(string) string) bool {
+	if strings.EqualFold(getenv("OTEL_SDK_DISABLED"), "true") {
+		return false
+	}
+	if exporter := getenv("OTEL_TRACES_EXPORTER"); exporter != "" && exporter != "otlp" {
+		return false
+	}
+	return getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// initTracing configures the global tracer provider to export spans over
+// OTLP/gRPC. The exporter, sampler & resource are configured by the standard
+// OpenTelemetry environment variables (OTEL_EXPORTER_OTLP_*,
+// OTEL_TRACES_SAMPLER, OTEL_SERVICE_NAME, OTEL_RESOURCE_ATTRIBUTES); the
+// service name defaults to "key-rotator".
+func initTracing(ctx context.Context) error {
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't create OTLP trace exporter: %w", err)
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("key-rotator")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return fmt.Errorf("couldn't create trace resource: %w", err)
+	}
+	tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tracerProvider)
+	return nil
+}
+
+// tryFlushTraces exports any spans not yet exported, if tracing is enabled.
+func tryFlushTraces() error {
+	if tracerProvider == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return tracerProvider.ForceFlush(ctx)
+}
+
+// startSpan starts a span with the given name & attributes.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// youngestFirst is the try-order policy under which non-primary packet
+	// encryption key versions are attempted youngest to oldest.
+	youngestFirst = "youngest-first"
+	// mostRecentlyUsedFirst is the try-order policy under which non-primary
+	// packet encryption key versions are attempted in order of most recent
+	// successful decryption, as reported by facilitators.
+	mostRecentlyUsedFirst = "most-recently-used-first"
+
+	// packetEncryptionKeyUsageConfigMapKey is the key, within the ConfigMap
+	// named by --packet-encryption-key-usage-configmap, whose value is a JSON
+	// object mapping packet encryption key version creation timestamps to the
+	// RFC 3339 time at which each version last successfully decrypted a
+	// packet, e.g. {"1600000000": "2020-10-01T00:00:00Z"}.
+	packetEncryptionKeyUsageConfigMapKey = "packet-encryption-key-last-used"
+)
+
+// packetEncryptionKeyTryOrder determines the order in which facilitators
+// attempt the non-primary versions of a packet encryption key, which is
+// recorded in the key's secret. During long overlap windows, attempting the
+// version most likely to succeed first reduces the number of decryption
+// attempts. Usage is read from a ConfigMap, which is re-read on each rotation.
+type packetEncryptionKeyTryOrder struct {
+	// Dependencies.
+	configMaps configMapGetter // may be nil if configMapName is empty
+
+	// Configuration.
+	policy        string // one of youngestFirst or mostRecentlyUsedFirst
+	configMapName string // the name of the ConfigMap recording key version usage; used only with mostRecentlyUsedFirst
+}
+
+// order returns the creation timestamps of the non-primary packet encryption
+// key versions to be attempted first, in order, suitable for passing to
+// key.Key.WithTryOrder. Versions not in the returned order are attempted
+// afterward, youngest to oldest. A missing ConfigMap leaves the order
+// unchanged from youngest to oldest.
+func (o packetEncryptionKeyTryOrder) order(ctx context.Context) ([]int64, error) {
+	if o.policy != mostRecentlyUsedFirst {
+		return nil, nil
+	}
+	cm, err := o.configMaps.Get(ctx, o.configMapName, metav1.GetOptions{})
+	switch {
+	case k8serrors.IsNotFound(err):
+		log.Debug().Msgf("ConfigMap %q not found; attempting packet encryption key versions youngest to oldest", o.configMapName)
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("couldn't get ConfigMap %q: %w", o.configMapName, err)
+	}
+	usage, ok := cm.Data[packetEncryptionKeyUsageConfigMapKey]
+	if !ok {
+		return nil, nil
+	}
+	var lastUsedByVersion map[string]time.Time
+	if err := json.Unmarshal([]byte(usage), &lastUsedByVersion); err != nil {
+		return nil, fmt.Errorf("couldn't parse %q in ConfigMap %q: %w", packetEncryptionKeyUsageConfigMapKey, o.configMapName, err)
+	}
+
+	type versionUsage struct {
+		ts       int64
+		lastUsed time.Time
+	}
+	var usages []versionUsage
+	for version, lastUsed := range lastUsedByVersion {
+		ts, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse packet encryption key version %q in ConfigMap %q: %w", version, o.configMapName, err)
+		}
+		usages = append(usages, versionUsage{ts, lastUsed})
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if !usages[i].lastUsed.Equal(usages[j].lastUsed) {
+			return usages[i].lastUsed.After(usages[j].lastUsed)
+		}
+		return usages[i].ts > usages[j].ts
+	})
+	order := make([]int64, len(usages))
+	for i, u := range usages {
+		order[i] = u.ts
+	}
+	return order, nil
+}
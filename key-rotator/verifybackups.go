@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/abetterinternet/prio-server/key-rotator/key"
+	"github.com/abetterinternet/prio-server/key-rotator/storage"
+)
+
+// verifyBackup is one of the backup key stores checked by verifyBackups.
+type verifyBackup struct {
+	// Dependencies.
+	keyStore storage.Key
+
+	// Configuration.
+	name string // a human-readable name for the backup, used in reported divergences, e.g. "aws"
+}
+
+// verifyBackupsConfig configures a comparison of the keys of a single locality
+// in the key store against each of its backups.
+type verifyBackupsConfig struct {
+	// Dependencies.
+	keyStore storage.Key // the key store of record, i.e. --key-store without backups
+	backups  []verifyBackup
+
+	// Configuration.
+	locality       string
+	ingestors      []string
+	taskSigningKey bool // if set, the task signing key is also verified
+	repair         bool // if set, divergent backups are overwritten with the key from keyStore
+}
+
+// backupDivergence describes a key whose backup differs from the key store.
+type backupDivergence struct {
+	description string
+	repaired    bool
+}
+
+// verifyBackups reads each of the locality's keys from the key store & from
+// every backup, returning a description of each backup whose key versions,
+// primary version, try order or key material differ from the key store's, or
+// which can't be read. If cfg.repair is set, each divergent backup is
+// overwritten with the key store's key, except that an empty key is never
+// written over a backup. No divergences are returned if every backup matches.
+func verifyBackups(ctx context.Context, cfg verifyBackupsConfig) ([]backupDivergence, error) {
+	type keyToVerify struct {
+		name  string // e.g. `batch signing key for ("us-ca", "apple")`
+		get   func(storage.Key) (key.Key, error)
+		write func(storage.Key, key.Key) error
+	}
+	keys := []keyToVerify{{
+		name:  fmt.Sprintf("packet encryption key for %q", cfg.locality),
+		get:   func(s storage.Key) (key.Key, error) { return s.GetPacketEncryptionKey(ctx, cfg.locality) },
+		write: func(s storage.Key, k key.Key) error { return s.PutPacketEncryptionKey(ctx, cfg.locality, k) },
+	}}
+	for _, ingestor := range cfg.ingestors {
+		ingestor := ingestor
+		keys = append(keys, keyToVerify{
+			name:  fmt.Sprintf("batch signing key for (%q, %q)", cfg.locality, ingestor),
+			get:   func(s storage.Key) (key.Key, error) { return s.GetBatchSigningKey(ctx, cfg.locality, ingestor) },
+			write: func(s storage.Key, k key.Key) error { return s.PutBatchSigningKey(ctx, cfg.locality, ingestor, k) },
+		})
+	}
+	if cfg.taskSigningKey {
+		keys = append(keys, keyToVerify{
+			name:  fmt.Sprintf("task signing key for %q", cfg.locality),
+			get:   func(s storage.Key) (key.Key, error) { return s.GetTaskSigningKey(ctx, cfg.locality) },
+			write: func(s storage.Key, k key.Key) error { return s.PutTaskSigningKey(ctx, cfg.locality, k) },
+		})
+	}
+
+	var divergences []backupDivergence
+	for _, k := range keys {
+		want, err := k.get(cfg.keyStore)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get %s: %w", k.name, err)
+		}
+		for _, backup := range cfg.backups {
+			// Diffs describe the changes required to get from the backup to
+			// the key store.
+			var divergence backupDivergence
+			switch got, err := k.get(backup.keyStore); {
+			case err != nil:
+				divergence.description = fmt.Sprintf("couldn't get backup in %s of %s: %v", backup.name, k.name, err)
+			case !got.Equal(want):
+				divergence.description = fmt.Sprintf("backup in %s of %s differs: %s", backup.name, k.name, want.Diff(got))
+			default:
+				continue
+			}
+
+			if cfg.repair {
+				if want.IsEmpty() {
+					log.Warn().Msgf("Not repairing backup in %s of %s: key is empty in key store", backup.name, k.name)
+				} else {
+					log.Info().Msgf("Repairing backup in %s of %s", backup.name, k.name)
+					if err := k.write(backup.keyStore, want); err != nil {
+						return divergences, fmt.Errorf("couldn't repair backup in %s of %s: %w", backup.name, k.name, err)
+					}
+					divergence.repaired = true
+				}
+			}
+			divergences = append(divergences, divergence)
+		}
+	}
+	return divergences, nil
+}
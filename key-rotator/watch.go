@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/abetterinternet/prio-server/key-rotator/storage"
+)
+
+type watchConfig struct {
+	// Dependencies.
+	secretChanges <-chan string // receives the name of each managed secret which is modified
+	manifestStore storage.Manifest
+
+	// Configuration.
+	dspNames     []string      // the data share processors whose manifests are checked for drift
+	pollInterval time.Duration // how frequently manifests are checked for drift
+	minInterval  time.Duration // the minimum time between the start of consecutive reconciliations
+}
+
+// watch runs reconcile once, then re-runs it whenever drift is detected in the
+// managed secrets or manifests, until ctx is canceled. Errors from reconcile
+// are logged, but do not stop the watch. Reconciliations are rate-limited to
+// at most one per cfg.minInterval; drift detected while waiting is coalesced
+// into a single reconciliation.
+func watch(ctx context.Context, cfg watchConfig, reconcile func(context.Context) error) error {
+	var lastRun time.Time
+	var versions map[string]string // data share processor name -> manifest version, as of the end of the last reconciliation
+	runReconcile := func() {
+		if wait := cfg.minInterval - time.Since(lastRun); wait > 0 {
+			log.Info().Msgf("Waiting %v before reconciling due to rate limit", wait)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+		lastRun = time.Now()
+		if err := reconcile(ctx); err != nil {
+			log.Error().Err(err).Msgf("Couldn't reconcile keys: %v", err)
+		}
+		v, err := manifestVersions(ctx, cfg.manifestStore, cfg.dspNames)
+		if err != nil {
+			log.Error().Err(err).Msgf("Couldn't get manifest versions: %v", err)
+			return
+		}
+		versions = v
+	}
+
+	runReconcile()
+	ticker := time.NewTicker(cfg.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case secretName, ok := <-cfg.secretChanges:
+			if !ok {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return errors.New("secret watch unexpectedly closed")
+			}
+			log.Info().Str("secret", secretName).Msgf("Detected change to secret %q, reconciling", secretName)
+			runReconcile()
+
+		case <-ticker.C:
+			v, err := manifestVersions(ctx, cfg.manifestStore, cfg.dspNames)
+			if err != nil {
+				log.Error().Err(err).Msgf("Couldn't get manifest versions: %v", err)
+				continue
+			}
+			for dspName, version := range v {
+				if oldVersion, ok := versions[dspName]; !ok || oldVersion != version {
+					log.Info().Str("dsp", dspName).Msgf("Detected change to manifest for %q, reconciling", dspName)
+					runReconcile()
+					break
+				}
+			}
+		}
+	}
+}
+
+// manifestVersions returns a map from data share processor name to the
+// version of that data share processor's manifest. Manifests which do not
+// exist are given the empty version.
+func manifestVersions(ctx context.Context, manifestStore storage.Manifest, dspNames []string) (map[string]string, error) {
+	versions := map[string]string{}
+	for _, dspName := range dspNames {
+		version, err := manifestStore.GetDataShareProcessorSpecificManifestVersion(ctx, dspName)
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, fmt.Errorf("couldn't get manifest version for %q: %w", dspName, err)
+		}
+		versions[dspName] = version
+	}
+	return versions, nil
+}
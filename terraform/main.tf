@@ -251,6 +251,20 @@ variable "enable_key_rotation_localities" {
   default = []
 }
 
+# Regions (AWS) or locations (GCP) to which key-rotator replicates its backups
+# of key secrets. On GCP, backups are stored in exactly these locations.
+variable "key_backup_replica_regions" {
+  type    = list(string)
+  default = []
+}
+
+# If set, key-rotator manages a task signing key for each locality, and
+# workflow-manager signs the tasks it enqueues with it.
+variable "enable_task_signing" {
+  type    = bool
+  default = false
+}
+
 variable "prometheus_helm_chart_version" {
   type = string
   # The default is the empty string, which uses the latest available version at
@@ -528,6 +542,28 @@ resource "kubernetes_secret" "ingestion_packet_decryption_keys" {
   }
 }
 
+# key-rotator writes the task signing key for each locality into this secret,
+# from which workflow-manager reads it to sign tasks.
+resource "kubernetes_secret" "task_signing_keys" {
+  for_each = var.enable_task_signing ? toset(var.localities) : toset([])
+  metadata {
+    name      = "${var.environment}-${each.key}-task-signing-key"
+    namespace = kubernetes_namespace.namespaces[each.key].metadata[0].name
+  }
+
+  data = {
+    # See comment on batch_signing_key, in modules/kubernetes/kubernetes.tf,
+    # about the initial value and the lifecycle block here.
+    secret_key = "not-a-real-key"
+  }
+
+  lifecycle {
+    ignore_changes = [
+      data
+    ]
+  }
+}
+
 # We will receive ingestion batches from multiple ingestion servers for each
 # locality. We create a distinct data share processor for each (locality,
 # ingestor) pair. e.g., "us-pa-apple" processes data for Pennsylvanians received
@@ -543,6 +579,7 @@ locals {
       locality                                = pair[0]
       kubernetes_namespace                    = kubernetes_namespace.namespaces[pair[0]].metadata[0].name
       packet_decryption_key_kubernetes_secret = kubernetes_secret.ingestion_packet_decryption_keys[pair[0]].metadata[0].name
+      task_signing_key_kubernetes_secret      = var.enable_task_signing ? kubernetes_secret.task_signing_keys[pair[0]].metadata[0].name : ""
       ingestor_manifest_base_url              = var.ingestors[pair[1]].manifest_base_url
       min_intake_worker_count = coalesce(
         var.ingestors[pair[1]].localities[pair[0]].min_intake_worker_count,
@@ -646,6 +683,7 @@ resource "google_project_iam_custom_role" "gcp_secret_writer" {
   description = "Allowed to write secrets & secret versions."
   permissions = [
     "secretmanager.secrets.create",
+    "secretmanager.secrets.get",
     "secretmanager.versions.add",
   ]
 }
@@ -671,6 +709,8 @@ module "kubernetes_locality" {
   batch_signing_key_rotation_policy     = var.batch_signing_key_rotation_policy
   packet_encryption_key_rotation_policy = var.packet_encryption_key_rotation_policy
   enable_key_rotator_localities         = toset(var.enable_key_rotation_localities)
+  enable_task_signing                   = var.enable_task_signing
+  key_backup_replica_regions            = var.key_backup_replica_regions
   key_rotator_schedule                  = var.key_rotator_schedule
   specific_manifest_templates           = { for v in module.data_share_processors : v.data_share_processor_name => v.specific_manifest }
   enable_heap_profiles                  = var.enable_heap_profiles
@@ -692,6 +732,7 @@ module "data_share_processors" {
   certificate_domain                             = "${var.environment}.certificates.${var.manifest_domain}"
   ingestor_manifest_base_url                     = each.value.ingestor_manifest_base_url
   packet_decryption_key_kubernetes_secret        = each.value.packet_decryption_key_kubernetes_secret
+  task_signing_key_kubernetes_secret             = each.value.task_signing_key_kubernetes_secret
   peer_share_processor_manifest_base_url         = each.value.peer_share_processor_manifest_base_url
   remote_bucket_writer_gcp_service_account_email = google_service_account.sum_part_bucket_writer.email
   portal_server_manifest_base_url                = each.value.portal_server_manifest_base_url
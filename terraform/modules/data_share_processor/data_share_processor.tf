@@ -38,6 +38,13 @@ variable "packet_decryption_key_kubernetes_secret" {
   type = string
 }
 
+# The name of the secret holding the task signing key, or the empty string if
+# tasks should not be signed.
+variable "task_signing_key_kubernetes_secret" {
+  type    = string
+  default = ""
+}
+
 variable "certificate_domain" {
   type = string
 }
@@ -405,6 +412,7 @@ module "kubernetes" {
   ingestion_bucket                          = local.ingestion_bucket_url
   ingestor_manifest_base_url                = var.ingestor_manifest_base_url
   packet_decryption_key_kubernetes_secret   = var.packet_decryption_key_kubernetes_secret
+  task_signing_key_kubernetes_secret        = var.task_signing_key_kubernetes_secret
   peer_manifest_base_url                    = var.peer_share_processor_manifest_base_url
   remote_peer_validation_bucket_identity    = local.remote_validation_bucket_writer
   peer_validation_bucket                    = local.peer_validation_bucket_url
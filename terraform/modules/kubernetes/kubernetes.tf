@@ -75,6 +75,10 @@ variable "packet_decryption_key_kubernetes_secret" {
   type = string
 }
 
+variable "task_signing_key_kubernetes_secret" {
+  type = string
+}
+
 variable "portal_server_manifest_base_url" {
   type = string
 }
@@ -313,6 +317,7 @@ resource "kubernetes_cron_job" "workflow_manager" {
                 "--aggregate-tasks-topic", var.aggregate_queue.topic,
                 "--gcp-project-id", var.use_aws ? "" : data.google_project.project.project_id,
                 "--aws-sns-region", var.use_aws ? var.aws_region : "",
+                "--task-signing-key-dir", var.task_signing_key_kubernetes_secret != "" ? "/task-signing-key" : "",
                 "--memprofile", var.enable_heap_profiles ? "/profiles/mem-$(NAMESPACE)-$(POD).pb.gz" : "",
               ]
               env {
@@ -338,6 +343,14 @@ resource "kubernetes_cron_job" "workflow_manager" {
                   name       = "profiles"
                 }
               }
+              dynamic "volume_mount" {
+                for_each = var.task_signing_key_kubernetes_secret != "" ? [0] : []
+                content {
+                  mount_path = "/task-signing-key"
+                  name       = "task-signing-key"
+                  read_only  = true
+                }
+              }
             }
             # If we use any other restart policy, then when the job is finally
             # deemed to be a failure, Kubernetes will destroy the job, pod and
@@ -360,6 +373,15 @@ resource "kubernetes_cron_job" "workflow_manager" {
                 }
               }
             }
+            dynamic "volume" {
+              for_each = var.task_signing_key_kubernetes_secret != "" ? [0] : []
+              content {
+                name = "task-signing-key"
+                secret {
+                  secret_name = var.task_signing_key_kubernetes_secret
+                }
+              }
+            }
           }
         }
       }
@@ -92,6 +92,16 @@ A set of localities where the key rotator is allowed to run. The special value
 DESCRIPTION
 }
 
+variable "key_backup_replica_regions" {
+  type    = list(string)
+  default = []
+}
+
+variable "enable_task_signing" {
+  type    = bool
+  default = false
+}
+
 variable "specific_manifest_templates" {
   type = map(any)
 }
@@ -142,6 +152,29 @@ resource "kubernetes_role" "key_rotator_role" {
       "get",
       "delete",
       "update",
+      "patch",
+    ]
+  }
+
+  # Allows key-rotator to record rotation status on KeyRotation resources, if
+  # configured with --keyrotation-resource.
+  rule {
+    api_groups = ["prio.divviup.org"]
+    resources  = ["keyrotations", "keyrotations/status"]
+    verbs = [
+      "get",
+      "update",
+    ]
+  }
+
+  # Allows key-rotator to read the ConfigMap listing ingestors temporarily
+  # excluded from rotation.
+  rule {
+    api_groups     = [""]
+    resources      = ["configmaps"]
+    resource_names = ["key-rotator-skip-ingestors"]
+    verbs = [
+      "get",
     ]
   }
 }
@@ -202,6 +235,8 @@ resource "aws_iam_role_policy" "key_rotator_secret_writer" {
         Action = [
           "secretsmanager:CreateSecret",
           "secretsmanager:PutSecretValue",
+          "secretsmanager:DescribeSecret",
+          "secretsmanager:ReplicateSecretToRegions",
         ]
         Resource = "*",
       }
@@ -225,6 +260,19 @@ resource "google_project_iam_member" "key_rotator_in_secret_writer" {
   member  = "serviceAccount:${module.key_rotator_account.gcp_service_account_email}"
 }
 
+# The default manifest templates are passed to key-rotator as a file, since
+# with many ingestors they exceed the practical length of a command line.
+resource "kubernetes_config_map" "key_rotator_default_manifests" {
+  metadata {
+    name      = "key-rotator-default-manifests"
+    namespace = var.kubernetes_namespace
+  }
+
+  data = {
+    "default-manifests.json" = jsonencode(local.relevant_keyless_manifest_templates)
+  }
+}
+
 resource "kubernetes_cron_job" "key_rotator" {
   metadata {
     name      = "${var.environment}-key-rotator-${var.locality}"
@@ -271,11 +319,13 @@ resource "kubernetes_cron_job" "key_rotator" {
                 "--manifest-bucket-url=${var.manifest_bucket.bucket_url}",
                 "--locality=${var.locality}",
                 "--ingestors=${join(",", var.ingestors)}",
+                "--skip-ingestors-configmap=key-rotator-skip-ingestors",
                 "--csr-fqdn=${var.certificate_fqdn}",
                 "--aws-region=${var.manifest_bucket.aws_region}",
                 "--push-gateway=${var.pushgateway}",
                 "--backup=${var.use_aws ? "aws" : "gcp:${var.gcp_project}"}",
-                "--default-manifest-by-ingestor=${jsonencode(local.relevant_keyless_manifest_templates)}",
+                "--backup-replica-regions=${join(",", var.key_backup_replica_regions)}",
+                "--default-manifest-by-ingestor-file=/default-manifests/default-manifests.json",
                 "--dry-run=${!(contains(var.enable_key_rotator_localities, "*") || contains(var.enable_key_rotator_localities, var.locality))}",
 
                 "--batch-signing-key-enable-rotation=false",
@@ -289,6 +339,8 @@ resource "kubernetes_cron_job" "key_rotator" {
                 "--packet-encryption-key-primary-min-age=${var.packet_encryption_key_rotation_policy.primary_min_age}",
                 "--packet-encryption-key-delete-min-age=${var.packet_encryption_key_rotation_policy.delete_min_age}",
                 "--packet-encryption-key-delete-min-count=${var.packet_encryption_key_rotation_policy.delete_min_count}",
+
+                "--task-signing-key-enable=${var.enable_task_signing}",
                 "--memprofile", var.enable_heap_profiles ? "/profiles/mem-$(NAMESPACE)-$(POD).pb.gz" : "",
               ]
               env {
@@ -307,6 +359,11 @@ resource "kubernetes_cron_job" "key_rotator" {
                   }
                 }
               }
+              volume_mount {
+                mount_path = "/default-manifests"
+                name       = "default-manifests"
+                read_only  = true
+              }
               dynamic "volume_mount" {
                 for_each = var.profile_nfs_server != null ? [0] : []
                 content {
@@ -327,6 +384,12 @@ resource "kubernetes_cron_job" "key_rotator" {
             restart_policy                  = "Never"
             service_account_name            = module.key_rotator_account.kubernetes_service_account_name
             automount_service_account_token = true
+            volume {
+              name = "default-manifests"
+              config_map {
+                name = kubernetes_config_map.key_rotator_default_manifests.metadata[0].name
+              }
+            }
             dynamic "volume" {
               for_each = var.profile_nfs_server != null ? [0] : []
               content {
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// aggregationIDFilter selects the aggregation IDs for which tasks are
+// scheduled, as configured by --aggregation-id-allowlist &
+// --aggregation-id-denylist. The zero value selects every aggregation ID.
+type aggregationIDFilter struct {
+	allow []string // glob patterns; if empty, every aggregation ID not denied is selected
+	deny  []string // glob patterns, which take precedence over allow
+}
+
+// parseAggregationIDFilter parses comma-separated lists of glob patterns, as
+// accepted by path.Match, e.g. "kittens-*,dogs-seen", into a filter.
+func parseAggregationIDFilter(allowlist, denylist string) (aggregationIDFilter, error) {
+	allow, err := parseGlobList(allowlist)
+	if err != nil {
+		return aggregationIDFilter{}, fmt.Errorf("--aggregation-id-allowlist: %w", err)
+	}
+	deny, err := parseGlobList(denylist)
+	if err != nil {
+		return aggregationIDFilter{}, fmt.Errorf("--aggregation-id-denylist: %w", err)
+	}
+	return aggregationIDFilter{allow: allow, deny: deny}, nil
+}
+
+// parseGlobList parses a comma-separated list of glob patterns, ignoring
+// empty entries.
+func parseGlobList(s string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(s, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// isSet returns true if the filter excludes any aggregation IDs.
+func (f aggregationIDFilter) isSet() bool {
+	return len(f.allow) > 0 || len(f.deny) > 0
+}
+
+// includes returns true if tasks should be scheduled for the aggregation ID:
+// if it matches no pattern of the denylist and, unless the allowlist is
+// empty, some pattern of the allowlist.
+func (f aggregationIDFilter) includes(aggregationID string) bool {
+	if matchesAny(f.deny, aggregationID) {
+		return false
+	}
+	return len(f.allow) == 0 || matchesAny(f.allow, aggregationID)
+}
+
+// apply returns the aggregation IDs which the filter includes, in order,
+// logging those it excludes.
+func (f aggregationIDFilter) apply(aggregationIDs []string) []string {
+	if !f.isSet() {
+		return aggregationIDs
+	}
+	included := []string{}
+	for _, aggregationID := range aggregationIDs {
+		if !f.includes(aggregationID) {
+			log.Info().Str("aggregation ID", aggregationID).Msg("skipping aggregation ID excluded by --aggregation-id-allowlist or --aggregation-id-denylist")
+			continue
+		}
+		included = append(included, aggregationID)
+	}
+	if len(included) == 0 && len(aggregationIDs) > 0 {
+		log.Warn().Strs("aggregation IDs", aggregationIDs).Msg("every aggregation ID discovered was excluded by --aggregation-id-allowlist or --aggregation-id-denylist")
+	}
+	return included
+}
+
+// matchesAny returns true if s matches any of the glob patterns, which are
+// known to be valid.
+func matchesAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, s); matched {
+			return true
+		}
+	}
+	return false
+}
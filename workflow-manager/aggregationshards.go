@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/letsencrypt/prio-server/workflow-manager/batchpath"
+	wftime "github.com/letsencrypt/prio-server/workflow-manager/time"
+)
+
+// aggregationShard is a sub-window of an aggregation window, and the batches
+// within it, for which a single aggregation task is scheduled.
+type aggregationShard struct {
+	interval wftime.Interval
+	batches  batchpath.List
+}
+
+// splitAggregationBatches splits the batches in the aggregation window into
+// shards of at most maxBatches batches each, ordered by batch time then ID,
+// each covering a contiguous sub-window of the window. Sub-windows begin at
+// the time of their first batch (the first begins at the start of the window)
+// and end where the next begins (the last ends at the end of the window), so
+// each shard's aggregation task has a distinct aggregation window, & thus a
+// distinct task marker & distinct sum part names. Since sub-windows can't
+// divide batches with the same timestamp, a shard may exceed maxBatches if
+// more than maxBatches batches share a timestamp. The split depends only on
+// the batches, so both data share processors split the window identically if
+// they aggregate the same batches with the same maxBatches. If maxBatches is
+// zero or the window has no more than maxBatches batches, a single shard
+// covering the whole window is returned.
+func splitAggregationBatches(batches batchpath.List, window wftime.Interval, maxBatches int) []aggregationShard {
+	sorted := append(batchpath.List{}, batches...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if !sorted[i].Time.Equal(sorted[j].Time) {
+			return sorted[i].Time.Before(sorted[j].Time)
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	if maxBatches <= 0 || len(sorted) <= maxBatches {
+		return []aggregationShard{{interval: window, batches: sorted}}
+	}
+
+	shards := []aggregationShard{}
+	begin := window.Begin
+	for start := 0; start < len(sorted); {
+		end := start + maxBatches
+		if end < len(sorted) {
+			// Move the split back to the nearest change of timestamp, or if
+			// the shard's batches all share a timestamp, forward past them.
+			for end > start && sorted[end].Time.Equal(sorted[end-1].Time) {
+				end--
+			}
+			if end == start {
+				end = start + maxBatches
+				for end < len(sorted) && sorted[end].Time.Equal(sorted[end-1].Time) {
+					end++
+				}
+			}
+		}
+		if end >= len(sorted) {
+			shards = append(shards, aggregationShard{
+				interval: wftime.Interval{Begin: begin, End: window.End},
+				batches:  sorted[start:],
+			})
+			break
+		}
+		shards = append(shards, aggregationShard{
+			interval: wftime.Interval{Begin: begin, End: sorted[end].Time},
+			batches:  sorted[start:end],
+		})
+		begin, start = sorted[end].Time, end
+	}
+	return shards
+}
+
+// aggregationWindowScheduled returns true if an aggregation task marker exists
+// for the aggregation window or any sub-window of it, i.e. if an aggregation
+// task has been scheduled for any of the window's shards. Once any has been,
+// batches arriving late could move the boundaries of the window's
+// sub-windows, so the window is never split again, lest batches be aggregated
+// twice.
+func aggregationWindowScheduled(aggregationID string, window wftime.Interval, aggregationTaskMarkers map[string]struct{}) bool {
+	prefix := "aggregate-" + aggregationID + "-"
+	for marker := range aggregationTaskMarkers {
+		if !strings.HasPrefix(marker, prefix) {
+			continue
+		}
+		interval, err := wftime.ParseMarkerInterval(strings.TrimPrefix(marker, prefix))
+		if err != nil {
+			continue
+		}
+		if !interval.Begin.Before(window.Begin) && !interval.End.After(window.End) {
+			return true
+		}
+	}
+	return false
+}
@@ -3,6 +3,7 @@ package aws
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/letsencrypt/prio-server/workflow-manager/tokenfetcher"
 
@@ -11,15 +12,30 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 )
 
+// credentialsExpiryWindow is how long before assumed role credentials expire
+// that they are refreshed. Runs which outlive the STS session, such as large
+// backfills, thus never sign requests with credentials about to expire.
+const credentialsExpiryWindow = 5 * time.Minute
+
 func webIDP(sess *session.Session, identity string) (*credentials.Credentials, error) {
-	stsSTS := sts.New(sess)
+	return webIdentityCredentials(sts.New(sess), identity,
+		tokenfetcher.NewTokenFetcher("sts.amazonaws.com/gke-identity-federation")), nil
+}
+
+// webIdentityCredentials returns credentials for the role identity, assumed
+// via stsAPI using tokens from tokenFetcher. The credentials are refreshed
+// shortly before they expire, and whenever a request made with them fails
+// with an expired token error, after which the SDK retries the request.
+func webIdentityCredentials(stsAPI stsiface.STSAPI, identity string, tokenFetcher stscreds.TokenFetcher) *credentials.Credentials {
 	roleSessionName := ""
 	roleProvider := stscreds.NewWebIdentityRoleProviderWithOptions(
-		stsSTS, identity, roleSessionName, tokenfetcher.NewTokenFetcher("sts.amazonaws.com/gke-identity-federation"))
+		stsAPI, identity, roleSessionName, tokenFetcher,
+		func(p *stscreds.WebIdentityRoleProvider) { p.ExpiryWindow = credentialsExpiryWindow })
 
-	return credentials.NewCredentials(roleProvider), nil
+	return credentials.NewCredentials(roleProvider)
 }
 
 // ClientConfig returns a (Session, Config) pair suitable for passing to the
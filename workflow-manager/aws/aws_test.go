@@ -0,0 +1,146 @@
+package aws
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// fakeSTS serves AssumeRoleWithWebIdentity, issuing credentials with access
+// key IDs "AKID1", "AKID2", ... which expire after lifetime.
+type fakeSTS struct {
+	lifetime time.Duration
+
+	mu     sync.Mutex
+	issued int
+}
+
+func (f *fakeSTS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.issued++
+	issued := f.issued
+	f.mu.Unlock()
+
+	fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>AKID%d</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>token</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`, issued, time.Now().Add(f.lifetime).UTC().Format(time.RFC3339))
+}
+
+// fakeS3 serves GetObject, recording the access key ID each request was
+// signed with. Requests signed with an access key ID in expired fail with an
+// ExpiredToken error.
+type fakeS3 struct {
+	expired map[string]bool
+
+	mu         sync.Mutex
+	accessKeys []string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Authorization: AWS4-HMAC-SHA256 Credential=AKID1/20060102/region/s3/aws4_request, ...
+	accessKey := strings.SplitN(strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="), "/", 2)[0]
+	f.mu.Lock()
+	f.accessKeys = append(f.accessKeys, accessKey)
+	f.mu.Unlock()
+
+	if f.expired[accessKey] {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `<Error><Code>ExpiredToken</Code><Message>The provided token has expired.</Message></Error>`)
+		return
+	}
+	io.WriteString(w, "content")
+}
+
+type fakeTokenFetcher struct{}
+
+func (fakeTokenFetcher) FetchToken(credentials.Context) ([]byte, error) {
+	return []byte("web-identity-token"), nil
+}
+
+func TestWebIdentityCredentialsRefresh(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		lifetime       time.Duration
+		expired        map[string]bool
+		requests       int
+		wantAccessKeys []string
+	}{
+		{
+			name:           "valid credentials are reused",
+			lifetime:       time.Hour,
+			requests:       2,
+			wantAccessKeys: []string{"AKID1", "AKID1"},
+		},
+		{
+			name:           "credentials within expiry window are refreshed",
+			lifetime:       credentialsExpiryWindow - time.Minute,
+			requests:       2,
+			wantAccessKeys: []string{"AKID1", "AKID2"},
+		},
+		{
+			name:     "expired token is refreshed & retried",
+			lifetime: time.Hour,
+			expired:  map[string]bool{"AKID1": true},
+			requests: 2,
+			// The first request is retried with fresh credentials, which are
+			// then reused by the second request.
+			wantAccessKeys: []string{"AKID1", "AKID2", "AKID2"},
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			stsServer := httptest.NewServer(&fakeSTS{lifetime: test.lifetime})
+			defer stsServer.Close()
+			s3Handler := &fakeS3{expired: test.expired}
+			s3Server := httptest.NewServer(s3Handler)
+			defer s3Server.Close()
+
+			sess, err := session.NewSession()
+			if err != nil {
+				t.Fatalf("Couldn't create session: %v", err)
+			}
+			stsAPI := sts.New(sess, aws.NewConfig().
+				WithRegion("us-west-2").
+				WithEndpoint(stsServer.URL).
+				WithCredentials(credentials.AnonymousCredentials))
+			creds := webIdentityCredentials(stsAPI, "arn:aws:iam::123456789012:role/role", fakeTokenFetcher{})
+			s3API := s3.New(sess, aws.NewConfig().
+				WithRegion("us-west-2").
+				WithEndpoint(s3Server.URL).
+				WithS3ForcePathStyle(true).
+				WithCredentials(creds))
+
+			for i := 0; i < test.requests; i++ {
+				if _, err := s3API.GetObject(&s3.GetObjectInput{
+					Bucket: aws.String("bucket"),
+					Key:    aws.String("key"),
+				}); err != nil {
+					t.Fatalf("Request %d failed: %v", i, err)
+				}
+			}
+
+			if got, want := strings.Join(s3Handler.accessKeys, ","), strings.Join(test.wantAccessKeys, ","); got != want {
+				t.Errorf("S3 requests signed with access keys %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+// Package azure contains utilities related to Azure
+package azure
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServiceBusConnectionString holds the parts of an Azure Service Bus
+// connection string, e.g.
+// "Endpoint=sb://prio.servicebus.windows.net/;SharedAccessKeyName=workflow-manager;SharedAccessKey=...",
+// used to authorize requests with shared access signatures.
+type ServiceBusConnectionString struct {
+	// Namespace is the fully-qualified namespace from the connection string's
+	// endpoint, e.g. "prio.servicebus.windows.net". Empty if the connection
+	// string has no endpoint.
+	Namespace string
+	// KeyName is the name of the shared access authorization policy.
+	KeyName string
+	// Key is the policy's shared access key.
+	Key string
+}
+
+// ParseServiceBusConnectionString parses an Azure Service Bus connection
+// string. Unrecognized fields, such as EntityPath, are ignored.
+func ParseServiceBusConnectionString(connectionString string) (ServiceBusConnectionString, error) {
+	var cs ServiceBusConnectionString
+	for _, field := range strings.Split(strings.TrimSpace(connectionString), ";") {
+		if field == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return ServiceBusConnectionString{}, fmt.Errorf("malformed connection string field %q", field)
+		}
+		switch name {
+		case "Endpoint":
+			endpoint, err := url.Parse(value)
+			if err != nil {
+				return ServiceBusConnectionString{}, fmt.Errorf("parsing connection string endpoint: %w", err)
+			}
+			cs.Namespace = endpoint.Host
+		case "SharedAccessKeyName":
+			cs.KeyName = value
+		case "SharedAccessKey":
+			cs.Key = value
+		}
+	}
+	if cs.KeyName == "" || cs.Key == "" {
+		return ServiceBusConnectionString{}, fmt.Errorf("connection string must include SharedAccessKeyName and SharedAccessKey")
+	}
+	return cs, nil
+}
+
+// ReadServiceBusConnectionString reads and parses an Azure Service Bus
+// connection string from the file at path, e.g. a mounted Kubernetes secret.
+func ReadServiceBusConnectionString(path string) (ServiceBusConnectionString, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return ServiceBusConnectionString{}, fmt.Errorf("reading connection string: %w", err)
+	}
+	return ParseServiceBusConnectionString(string(contents))
+}
+
+// SharedAccessSignature returns a shared access signature token, suitable for
+// use as the value of an Authorization header, which authorizes requests to
+// resourceURI (and any URI beneath it) until expiry.
+func (cs ServiceBusConnectionString) SharedAccessSignature(resourceURI string, expiry time.Time) string {
+	encodedURI := url.QueryEscape(resourceURI)
+	se := strconv.FormatInt(expiry.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(cs.Key))
+	mac.Write([]byte(encodedURI + "\n" + se))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	return fmt.Sprintf("SharedAccessSignature sr=%s&sig=%s&se=%s&skn=%s",
+		encodedURI, url.QueryEscape(sig), se, url.QueryEscape(cs.KeyName))
+}
@@ -0,0 +1,94 @@
+package azure
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseServiceBusConnectionString(t *testing.T) {
+	for _, test := range []struct {
+		name             string
+		connectionString string
+		want             ServiceBusConnectionString
+		wantErr          bool
+	}{
+		{
+			name:             "full",
+			connectionString: "Endpoint=sb://prio.servicebus.windows.net/;SharedAccessKeyName=workflow-manager;SharedAccessKey=c2VjcmV0=\n",
+			want: ServiceBusConnectionString{
+				Namespace: "prio.servicebus.windows.net",
+				KeyName:   "workflow-manager",
+				Key:       "c2VjcmV0=",
+			},
+		},
+		{
+			name:             "no endpoint",
+			connectionString: "SharedAccessKeyName=workflow-manager;SharedAccessKey=secret;EntityPath=intake",
+			want: ServiceBusConnectionString{
+				KeyName: "workflow-manager",
+				Key:     "secret",
+			},
+		},
+		{
+			name:             "missing key",
+			connectionString: "Endpoint=sb://prio.servicebus.windows.net/;SharedAccessKeyName=workflow-manager",
+			wantErr:          true,
+		},
+		{
+			name:             "malformed field",
+			connectionString: "Endpoint",
+			wantErr:          true,
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseServiceBusConnectionString(test.connectionString)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("Expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("Got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSharedAccessSignature(t *testing.T) {
+	cs := ServiceBusConnectionString{KeyName: "workflow-manager", Key: "secret"}
+	resourceURI := "https://prio.servicebus.windows.net/intake-tasks"
+	token := cs.SharedAccessSignature(resourceURI, time.Unix(1600000000, 0))
+
+	if !strings.HasPrefix(token, "SharedAccessSignature ") {
+		t.Fatalf("Token %q lacks SharedAccessSignature prefix", token)
+	}
+	values, err := url.ParseQuery(strings.TrimPrefix(token, "SharedAccessSignature "))
+	if err != nil {
+		t.Fatalf("Couldn't parse token %q: %v", token, err)
+	}
+	if got := values.Get("sr"); got != resourceURI {
+		t.Errorf("sr = %q, want %q", got, resourceURI)
+	}
+	if got := values.Get("se"); got != "1600000000" {
+		t.Errorf("se = %q, want %q", got, "1600000000")
+	}
+	if got := values.Get("skn"); got != "workflow-manager" {
+		t.Errorf("skn = %q, want %q", got, "workflow-manager")
+	}
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(url.QueryEscape(resourceURI) + "\n1600000000"))
+	if got, want := values.Get("sig"), base64.StdEncoding.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("sig = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,264 @@
+package batchheader
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// This file implements just enough of the Avro object container file format
+// (https://avro.apache.org/docs/1.11.1/specification/#object-container-files)
+// to read the records of batch headers, which are records of primitive or
+// union-of-primitive fields, and to check the framing of packet files.
+
+// avroMagic begins every Avro object container file.
+var avroMagic = []byte{'O', 'b', 'j', 1}
+
+// avroSyncLength is the length of the sync marker which follows the file
+// header and every block.
+const avroSyncLength = 16
+
+// containerFile is a parsed Avro object container file.
+type containerFile struct {
+	schema []byte
+	// records is the (decompressed) serialized records of each block, which
+	// are decoded according to schema.
+	records [][]byte
+	// count is the total number of records in the file's blocks.
+	count int64
+}
+
+// avroReader decodes Avro's binary encoding from a buffer.
+type avroReader struct {
+	buf []byte
+}
+
+func (r *avroReader) long() (int64, error) {
+	// Longs (and ints) are zig-zag encoded variable-length integers.
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		return 0, errors.New("truncated or invalid varint")
+	}
+	r.buf = r.buf[n:]
+	return int64(v>>1) ^ -int64(v&1), nil
+}
+
+func (r *avroReader) bytes() ([]byte, error) {
+	length, err := r.long()
+	if err != nil {
+		return nil, err
+	}
+	return r.fixed(length)
+}
+
+func (r *avroReader) fixed(length int64) ([]byte, error) {
+	if length < 0 || length > int64(len(r.buf)) {
+		return nil, fmt.Errorf("length %d exceeds remaining %d bytes", length, len(r.buf))
+	}
+	v := r.buf[:length]
+	r.buf = r.buf[length:]
+	return v, nil
+}
+
+// readContainerFile parses an Avro object container file, checking that every
+// block is followed by the file's sync marker, so that truncated or corrupted
+// files are detected.
+func readContainerFile(contents []byte) (*containerFile, error) {
+	if !bytes.HasPrefix(contents, avroMagic) {
+		return nil, errors.New("not an Avro object container file")
+	}
+	r := &avroReader{buf: contents[len(avroMagic):]}
+
+	// The file metadata is a map from string to bytes, encoded as a series of
+	// blocks, terminated by an empty block.
+	metadata := map[string][]byte{}
+	for {
+		count, err := r.long()
+		if err != nil {
+			return nil, fmt.Errorf("reading metadata: %w", err)
+		}
+		if count == 0 {
+			break
+		}
+		if count < 0 {
+			// A negative count is followed by the block's size in bytes.
+			count = -count
+			if _, err := r.long(); err != nil {
+				return nil, fmt.Errorf("reading metadata: %w", err)
+			}
+		}
+		for i := int64(0); i < count; i++ {
+			key, err := r.bytes()
+			if err != nil {
+				return nil, fmt.Errorf("reading metadata: %w", err)
+			}
+			value, err := r.bytes()
+			if err != nil {
+				return nil, fmt.Errorf("reading metadata: %w", err)
+			}
+			metadata[string(key)] = value
+		}
+	}
+	sync, err := r.fixed(avroSyncLength)
+	if err != nil {
+		return nil, fmt.Errorf("reading sync marker: %w", err)
+	}
+
+	codec := string(metadata["avro.codec"])
+	if codec != "" && codec != "null" && codec != "deflate" {
+		return nil, fmt.Errorf("unsupported codec %q", codec)
+	}
+	file := &containerFile{schema: metadata["avro.schema"]}
+	for block := 0; len(r.buf) > 0; block++ {
+		count, err := r.long()
+		if err != nil {
+			return nil, fmt.Errorf("reading block %d: %w", block, err)
+		}
+		size, err := r.long()
+		if err != nil {
+			return nil, fmt.Errorf("reading block %d: %w", block, err)
+		}
+		data, err := r.fixed(size)
+		if err != nil {
+			return nil, fmt.Errorf("reading block %d: %w", block, err)
+		}
+		blockSync, err := r.fixed(avroSyncLength)
+		if err != nil {
+			return nil, fmt.Errorf("reading block %d: %w", block, err)
+		}
+		if count < 0 || !bytes.Equal(blockSync, sync) {
+			return nil, fmt.Errorf("block %d is corrupt", block)
+		}
+		if codec == "deflate" {
+			if data, err = io.ReadAll(flate.NewReader(bytes.NewReader(data))); err != nil {
+				return nil, fmt.Errorf("decompressing block %d: %w", block, err)
+			}
+		}
+		file.records = append(file.records, data)
+		file.count += count
+	}
+	return file, nil
+}
+
+// avroField is a field of a record schema, whose type is either the name of a
+// primitive type or a union of them.
+type avroField struct {
+	name  string
+	types []string // more than one for a union
+}
+
+// parseRecordSchema parses the JSON of a record schema whose fields are of
+// primitive types or unions of primitive types.
+func parseRecordSchema(schema []byte) ([]avroField, error) {
+	var record struct {
+		Type   string `json:"type"`
+		Fields []struct {
+			Name string          `json:"name"`
+			Type json.RawMessage `json:"type"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal(schema, &record); err != nil {
+		return nil, fmt.Errorf("parsing schema: %w", err)
+	}
+	if record.Type != "record" {
+		return nil, fmt.Errorf("schema is of type %q, not a record", record.Type)
+	}
+
+	// primitive returns the name of a primitive type, which may also be
+	// written as an object with a "type" member, e.g. to add a logical type.
+	primitive := func(t json.RawMessage) (string, error) {
+		var name string
+		if err := json.Unmarshal(t, &name); err == nil {
+			return name, nil
+		}
+		var object struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(t, &object); err != nil {
+			return "", fmt.Errorf("unsupported type %s", t)
+		}
+		return object.Type, nil
+	}
+
+	var fields []avroField
+	for _, f := range record.Fields {
+		field := avroField{name: f.Name}
+		var union []json.RawMessage
+		if err := json.Unmarshal(f.Type, &union); err != nil {
+			union = []json.RawMessage{f.Type}
+		}
+		for _, t := range union {
+			name, err := primitive(t)
+			if err != nil {
+				return nil, fmt.Errorf("field %q: %w", f.Name, err)
+			}
+			field.types = append(field.types, name)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// decodeRecord decodes a record with the given fields from r, returning its
+// values by field name. Values are int64 (for ints & longs), float64, string,
+// []byte, bool or nil.
+func decodeRecord(r *avroReader, fields []avroField) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	for _, field := range fields {
+		typ := field.types[0]
+		if len(field.types) > 1 {
+			index, err := r.long()
+			if err != nil {
+				return nil, fmt.Errorf("field %q: %w", field.name, err)
+			}
+			if index < 0 || index >= int64(len(field.types)) {
+				return nil, fmt.Errorf("field %q: union index %d out of range", field.name, index)
+			}
+			typ = field.types[index]
+		}
+
+		var (
+			value interface{}
+			err   error
+		)
+		switch typ {
+		case "null":
+		case "boolean":
+			var b []byte
+			if b, err = r.fixed(1); err == nil {
+				value = b[0] != 0
+			}
+		case "int", "long":
+			value, err = r.long()
+		case "float":
+			var b []byte
+			if b, err = r.fixed(4); err == nil {
+				value = float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+			}
+		case "double":
+			var b []byte
+			if b, err = r.fixed(8); err == nil {
+				value = math.Float64frombits(binary.LittleEndian.Uint64(b))
+			}
+		case "string":
+			var b []byte
+			if b, err = r.bytes(); err == nil {
+				value = string(b)
+			}
+		case "bytes":
+			value, err = r.bytes()
+		default:
+			err = fmt.Errorf("unsupported type %q", typ)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %w", field.name, err)
+		}
+		values[field.name] = value
+	}
+	return values, nil
+}
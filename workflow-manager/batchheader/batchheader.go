@@ -0,0 +1,161 @@
+// package batchheader parses the headers of ingestion batches and checks them
+// against the batches' packet files, so that corrupt or truncated uploads can
+// be detected before intake tasks are scheduled for them.
+package batchheader
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"fmt"
+)
+
+// IngestionHeader is the header of an ingestion batch, as described by
+// avro-schema/ingestion-header.avsc. Only the fields needed to check a batch
+// are decoded.
+type IngestionHeader struct {
+	// BatchUUID is the batch's ID, which should match the ID in its object
+	// names.
+	BatchUUID string
+	// Name is the aggregation ID.
+	Name string
+	// PacketFileDigest is the SHA-256 digest of the batch's packet file.
+	PacketFileDigest []byte
+}
+
+// ParseIngestionHeader parses the contents of an ingestion batch's header
+// object, an Avro object container file holding a single header record.
+func ParseIngestionHeader(contents []byte) (*IngestionHeader, error) {
+	file, err := readContainerFile(contents)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read batch header: %w", err)
+	}
+	if file.count != 1 || len(file.records) != 1 {
+		return nil, fmt.Errorf("batch header has %d records, not 1", file.count)
+	}
+	fields, err := parseRecordSchema(file.schema)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read batch header schema: %w", err)
+	}
+	r := &avroReader{buf: file.records[0]}
+	values, err := decodeRecord(r, fields)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode batch header: %w", err)
+	}
+	if len(r.buf) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after batch header record", len(r.buf))
+	}
+
+	header := &IngestionHeader{}
+	for name, dst := range map[string]interface{}{
+		"batch_uuid":         &header.BatchUUID,
+		"name":               &header.Name,
+		"packet_file_digest": &header.PacketFileDigest,
+	} {
+		ok := false
+		switch dst := dst.(type) {
+		case *string:
+			*dst, ok = values[name].(string)
+		case *[]byte:
+			*dst, ok = values[name].([]byte)
+		}
+		if !ok {
+			return nil, fmt.Errorf("batch header has no field %q of the expected type", name)
+		}
+	}
+	return header, nil
+}
+
+// Check verifies that the header and packet file of an ingestion batch are
+// consistent with each other and with the batch's object names: that the
+// header parses and names the expected batch ID & aggregation ID, that the
+// packet file's digest is the one recorded in the header, and that the packet
+// file is a complete Avro object container file. It returns the number of
+// packets in the packet file.
+func Check(aggregationID, batchID string, header, packets []byte) (int64, error) {
+	h, err := ParseIngestionHeader(header)
+	if err != nil {
+		return 0, err
+	}
+	if h.BatchUUID != batchID {
+		return 0, fmt.Errorf("batch header has batch UUID %q, not %q", h.BatchUUID, batchID)
+	}
+	if h.Name != aggregationID {
+		return 0, fmt.Errorf("batch header has name %q, not %q", h.Name, aggregationID)
+	}
+	if digest := sha256.Sum256(packets); !bytes.Equal(digest[:], h.PacketFileDigest) {
+		return 0, fmt.Errorf("packet file digest %x does not match digest %x in batch header", digest, h.PacketFileDigest)
+	}
+	file, err := readContainerFile(packets)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't read packet file: %w", err)
+	}
+	return file.count, nil
+}
+
+// BatchSignature is the signature of an ingestion batch, as described by
+// avro-schema/batch-signature.avsc. Only the fields needed to verify the
+// signature of a batch whose header is stored separately are decoded.
+type BatchSignature struct {
+	// BatchHeaderSignature is the ASN.1 DER encoded ECDSA signature of the
+	// batch's header object.
+	BatchHeaderSignature []byte
+	// KeyIdentifier identifies the key which made the signature, in the
+	// batch signing public keys of the ingestor's manifest.
+	KeyIdentifier string
+}
+
+// ParseBatchSignature parses the contents of an ingestion batch's signature
+// object, an Avro object container file holding a single signature record.
+func ParseBatchSignature(contents []byte) (*BatchSignature, error) {
+	file, err := readContainerFile(contents)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read batch signature: %w", err)
+	}
+	if file.count != 1 || len(file.records) != 1 {
+		return nil, fmt.Errorf("batch signature has %d records, not 1", file.count)
+	}
+	fields, err := parseRecordSchema(file.schema)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read batch signature schema: %w", err)
+	}
+	r := &avroReader{buf: file.records[0]}
+	values, err := decodeRecord(r, fields)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode batch signature: %w", err)
+	}
+	if len(r.buf) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after batch signature record", len(r.buf))
+	}
+
+	signature := &BatchSignature{}
+	var ok bool
+	if signature.BatchHeaderSignature, ok = values["batch_header_signature"].([]byte); !ok {
+		return nil, fmt.Errorf("batch signature has no field %q of the expected type", "batch_header_signature")
+	}
+	if signature.KeyIdentifier, ok = values["key_identifier"].(string); !ok {
+		return nil, fmt.Errorf("batch signature has no field %q of the expected type", "key_identifier")
+	}
+	return signature, nil
+}
+
+// VerifySignature verifies that signature, the contents of an ingestion
+// batch's signature object, is a valid signature of header, the contents of
+// its header object, made with the key returned by publicKey for the key
+// identifier in the signature. It returns that key identifier, which is empty
+// if the signature doesn't parse.
+func VerifySignature(header, signature []byte, publicKey func(keyIdentifier string) (*ecdsa.PublicKey, error)) (string, error) {
+	s, err := ParseBatchSignature(signature)
+	if err != nil {
+		return "", err
+	}
+	key, err := publicKey(s.KeyIdentifier)
+	if err != nil {
+		return s.KeyIdentifier, err
+	}
+	digest := sha256.Sum256(header)
+	if !ecdsa.VerifyASN1(key, digest[:], s.BatchHeaderSignature) {
+		return s.KeyIdentifier, fmt.Errorf("invalid batch header signature with key %q", s.KeyIdentifier)
+	}
+	return s.KeyIdentifier, nil
+}
@@ -0,0 +1,301 @@
+package batchheader
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+const ingestionHeaderSchema = `{"type":"record","name":"PrioIngestionHeader","namespace":"org.abetterinternet.prio.v1","fields":[` +
+	`{"name":"batch_uuid","type":"string","logicalType":"uuid"},{"name":"name","type":"string"},{"name":"bins","type":"int"},` +
+	`{"name":"epsilon","type":"double"},{"name":"prime","type":"long","default":4293918721},{"name":"number_of_servers","type":"int","default":2},` +
+	`{"name":"hamming_weight","type":["int","null"]},{"name":"batch_start_time","type":{"type":"long","logicalType":"timestamp-millis"}},` +
+	`{"name":"batch_end_time","type":{"type":"long","logicalType":"timestamp-millis"}},{"name":"packet_file_digest","type":"bytes"}]}`
+
+const packetSchema = `{"type":"record","name":"PrioDataSharePacket","fields":[{"name":"uuid","type":"string"},{"name":"encrypted_payload","type":"bytes"}]}`
+
+const signatureSchema = `{"type":"record","name":"PrioBatchSignature","namespace":"org.abetterinternet.prio.v1","fields":[` +
+	`{"name":"batch_header_signature","type":"bytes"},{"name":"key_identifier","type":"string"},` +
+	`{"name":"batch_header","type":["null","bytes"],"default":null},{"name":"packets","type":["null","bytes"],"default":null}]}`
+
+var testSync = []byte("0123456789abcdef")
+
+// avroWriter encodes values in Avro's binary encoding.
+type avroWriter struct {
+	bytes.Buffer
+}
+
+func (w *avroWriter) long(v int64) {
+	w.Write(binary.AppendUvarint(nil, uint64((v<<1)^(v>>63))))
+}
+
+func (w *avroWriter) bytes(v []byte) {
+	w.long(int64(len(v)))
+	w.Write(v)
+}
+
+func (w *avroWriter) double(v float64) {
+	w.Write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(v)))
+}
+
+// containerFileBytes returns an Avro object container file with the given
+// schema & codec, with a block holding count records for each element of
+// blocks.
+func containerFileBytes(t *testing.T, schema, codec string, count int64, blocks ...[]byte) []byte {
+	w := &avroWriter{}
+	w.Write(avroMagic)
+	w.long(2)
+	w.bytes([]byte("avro.schema"))
+	w.bytes([]byte(schema))
+	w.bytes([]byte("avro.codec"))
+	w.bytes([]byte(codec))
+	w.long(0)
+	w.Write(testSync)
+	for _, block := range blocks {
+		if codec == "deflate" {
+			var compressed bytes.Buffer
+			fw, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+			if err != nil {
+				t.Fatalf("Couldn't create deflate writer: %v", err)
+			}
+			fw.Write(block)
+			fw.Close()
+			block = compressed.Bytes()
+		}
+		w.long(count)
+		w.bytes(block)
+		w.Write(testSync)
+	}
+	return w.Bytes()
+}
+
+func headerRecord(batchUUID, name string, digest []byte) []byte {
+	w := &avroWriter{}
+	w.bytes([]byte(batchUUID))
+	w.bytes([]byte(name))
+	w.long(100)        // bins
+	w.double(0.1)      // epsilon
+	w.long(4293918721) // prime
+	w.long(2)          // number_of_servers
+	w.long(1)          // hamming_weight: null
+	w.long(1604175600000)
+	w.long(1604179200000)
+	w.bytes(digest)
+	return w.Bytes()
+}
+
+func packetsRecords(n int) []byte {
+	w := &avroWriter{}
+	for i := 0; i < n; i++ {
+		w.bytes([]byte("2a8a5cf4-7e4b-4ad8-9b0c-5e5d4e5b8b68"))
+		w.bytes([]byte("ciphertext"))
+	}
+	return w.Bytes()
+}
+
+func TestCheck(t *testing.T) {
+	const (
+		aggregationID = "kittens-seen"
+		batchID       = "b8a5579a-f984-460a-a42d-2813cbf57771"
+	)
+	packets := containerFileBytes(t, packetSchema, "null", 3, packetsRecords(3))
+	digest := sha256.Sum256(packets)
+	deflatedPackets := containerFileBytes(t, packetSchema, "deflate", 2, packetsRecords(2), packetsRecords(2))
+	deflatedDigest := sha256.Sum256(deflatedPackets)
+	truncated := packets[:len(packets)-4]
+	truncatedDigest := sha256.Sum256(truncated)
+
+	for _, testCase := range []struct {
+		name          string
+		header        []byte
+		packets       []byte
+		expectedCount int64
+		expectedError string
+	}{
+		{
+			name:          "valid",
+			header:        containerFileBytes(t, ingestionHeaderSchema, "null", 1, headerRecord(batchID, aggregationID, digest[:])),
+			packets:       packets,
+			expectedCount: 3,
+		},
+		{
+			name:          "valid-deflate",
+			header:        containerFileBytes(t, ingestionHeaderSchema, "deflate", 1, headerRecord(batchID, aggregationID, deflatedDigest[:])),
+			packets:       deflatedPackets,
+			expectedCount: 4,
+		},
+		{
+			name:          "digest-mismatch",
+			header:        containerFileBytes(t, ingestionHeaderSchema, "null", 1, headerRecord(batchID, aggregationID, digest[:])),
+			packets:       deflatedPackets,
+			expectedError: "does not match digest",
+		},
+		{
+			name:          "truncated-packets",
+			header:        containerFileBytes(t, ingestionHeaderSchema, "null", 1, headerRecord(batchID, aggregationID, truncatedDigest[:])),
+			packets:       truncated,
+			expectedError: "couldn't read packet file",
+		},
+		{
+			name:          "truncated-header",
+			header:        containerFileBytes(t, ingestionHeaderSchema, "null", 1, headerRecord(batchID, aggregationID, digest[:]))[:100],
+			packets:       packets,
+			expectedError: "couldn't read batch header",
+		},
+		{
+			name:          "wrong-batch-uuid",
+			header:        containerFileBytes(t, ingestionHeaderSchema, "null", 1, headerRecord("0f0317b2-c612-48c2-b08d-d98529d6eae4", aggregationID, digest[:])),
+			packets:       packets,
+			expectedError: "batch UUID",
+		},
+		{
+			name:          "wrong-name",
+			header:        containerFileBytes(t, ingestionHeaderSchema, "null", 1, headerRecord(batchID, "dogs-seen", digest[:])),
+			packets:       packets,
+			expectedError: "name",
+		},
+		{
+			name:          "not-avro",
+			header:        []byte("{}"),
+			packets:       packets,
+			expectedError: "not an Avro object container file",
+		},
+		{
+			name:          "two-records",
+			header:        containerFileBytes(t, ingestionHeaderSchema, "null", 2, append(headerRecord(batchID, aggregationID, digest[:]), headerRecord(batchID, aggregationID, digest[:])...)),
+			packets:       packets,
+			expectedError: "2 records",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			count, err := Check(aggregationID, batchID, testCase.header, testCase.packets)
+			if testCase.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), testCase.expectedError) {
+					t.Fatalf("Expected error containing %q, got: %v", testCase.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if count != testCase.expectedCount {
+				t.Errorf("Expected %d packets, got %d", testCase.expectedCount, count)
+			}
+		})
+	}
+}
+
+func signatureRecord(signature []byte, keyIdentifier string) []byte {
+	w := &avroWriter{}
+	w.bytes(signature)
+	w.bytes([]byte(keyIdentifier))
+	w.long(0) // batch_header: null
+	w.long(0) // packets: null
+	return w.Bytes()
+}
+
+func TestVerifySignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Couldn't generate key: %v", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Couldn't generate key: %v", err)
+	}
+	publicKey := func(keyIdentifier string) (*ecdsa.PublicKey, error) {
+		switch keyIdentifier {
+		case "key":
+			return &key.PublicKey, nil
+		case "other-key":
+			return &otherKey.PublicKey, nil
+		default:
+			return nil, errors.New("unknown key")
+		}
+	}
+
+	header := containerFileBytes(t, ingestionHeaderSchema, "null", 1, headerRecord("b8a5579a-f984-460a-a42d-2813cbf57771", "kittens-seen", []byte("digest")))
+	digest := sha256.Sum256(header)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("Couldn't sign header: %v", err)
+	}
+
+	for _, testCase := range []struct {
+		name          string
+		header        []byte
+		signature     []byte
+		expectedKeyID string
+		expectedError string
+	}{
+		{
+			name:          "valid",
+			header:        header,
+			signature:     containerFileBytes(t, signatureSchema, "null", 1, signatureRecord(signature, "key")),
+			expectedKeyID: "key",
+		},
+		{
+			name:          "valid-deflate",
+			header:        header,
+			signature:     containerFileBytes(t, signatureSchema, "deflate", 1, signatureRecord(signature, "key")),
+			expectedKeyID: "key",
+		},
+		{
+			name:          "wrong-key",
+			header:        header,
+			signature:     containerFileBytes(t, signatureSchema, "null", 1, signatureRecord(signature, "other-key")),
+			expectedKeyID: "other-key",
+			expectedError: "invalid batch header signature",
+		},
+		{
+			name:          "unknown-key",
+			header:        header,
+			signature:     containerFileBytes(t, signatureSchema, "null", 1, signatureRecord(signature, "missing-key")),
+			expectedKeyID: "missing-key",
+			expectedError: "unknown key",
+		},
+		{
+			name:          "modified-header",
+			header:        append(append([]byte{}, header...), 0),
+			signature:     containerFileBytes(t, signatureSchema, "null", 1, signatureRecord(signature, "key")),
+			expectedKeyID: "key",
+			expectedError: "invalid batch header signature",
+		},
+		{
+			name:          "truncated-signature",
+			header:        header,
+			signature:     containerFileBytes(t, signatureSchema, "null", 1, signatureRecord(signature, "key"))[:100],
+			expectedError: "couldn't read batch signature",
+		},
+		{
+			name:          "not-a-signature",
+			header:        header,
+			signature:     header,
+			expectedError: "batch_header_signature",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			keyID, err := VerifySignature(testCase.header, testCase.signature, publicKey)
+			if keyID != testCase.expectedKeyID {
+				t.Errorf("Expected key identifier %q, got %q", testCase.expectedKeyID, keyID)
+			}
+			if testCase.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), testCase.expectedError) {
+					t.Fatalf("Expected error containing %q, got: %v", testCase.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+
+	"github.com/letsencrypt/prio-server/workflow-manager/batchheader"
+	"github.com/letsencrypt/prio-server/workflow-manager/batchpath"
+	"github.com/letsencrypt/prio-server/workflow-manager/task"
+	wftime "github.com/letsencrypt/prio-server/workflow-manager/time"
+)
+
+var invalidIngestionBatchesFound = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "workflow_manager_invalid_ingestion_batches",
+		Help: "The number of ingestion batches whose header didn't match their packet file or object names, for which no intake tasks were scheduled, when --validate-batch-headers is set",
+	},
+	[]string{"aggregation_id"},
+)
+
+var unverifiedIngestionBatchesFound = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "workflow_manager_unverified_ingestion_batches",
+		Help: "The number of ingestion batches whose header signature couldn't be verified with the ingestor's batch signing public keys, for which no intake tasks were scheduled, when --verify-batch-signatures is set",
+	},
+	[]string{"aggregation_id"},
+)
+
+// checkBatchHeaders downloads the header & packet file of each of the ready
+// ingestion batches for which an intake task would be scheduled, i.e. which
+// has neither a task marker nor an own validation, and checks them with
+// batchheader.Check. If config.ingestorManifest is set, it also downloads
+// each batch's signature and verifies it with the ingestor's batch signing
+// public keys. It returns the batches without those which fail either check,
+// which are logged, and the number removed. Once maxTasks batches
+// (if non-zero) have passed, the remaining batches would be deferred by
+// enqueueIntakeTasks, so they are returned unchecked.
+func checkBatchHeaders(
+	config scheduleTasksConfig,
+	readyBatches batchpath.List,
+	taskMarkers map[string]struct{},
+	ownValidations map[string]struct{},
+	maxTasks int,
+) (batchpath.List, int, error) {
+	checked := batchpath.List{}
+	invalid := 0
+	unverified := 0 // also counted in invalid
+	passed := 0
+	for i, batch := range readyBatches {
+		if maxTasks > 0 && passed >= maxTasks {
+			checked = append(checked, readyBatches[i:]...)
+			break
+		}
+
+		marker := task.IntakeBatch{
+			AggregationID: batch.AggregationID,
+			BatchID:       batch.ID,
+			Date:          wftime.Timestamp(batch.Time),
+		}.Marker()
+		_, hasMarker := taskMarkers[marker]
+		_, hasOwnValidation := ownValidations[batch.ID]
+		if hasMarker || hasOwnValidation {
+			checked = append(checked, batch)
+			continue
+		}
+
+		header, err := config.intakeBucket.ReadBatchFile(batch.ObjectName(".batch"))
+		if err != nil {
+			return nil, 0, fmt.Errorf("couldn't read header of batch %s: %w", batch, err)
+		}
+		packets, err := config.intakeBucket.ReadBatchFile(batch.ObjectName(".batch.avro"))
+		if err != nil {
+			return nil, 0, fmt.Errorf("couldn't read packet file of batch %s: %w", batch, err)
+		}
+		packetCount, err := batchheader.Check(config.aggregationID, batch.ID, header, packets)
+		if err != nil {
+			log.Warn().Err(err).
+				Str("aggregation ID", config.aggregationID).
+				Str("batch", batch.String()).
+				Msgf("not scheduling intake task for batch with invalid header: %s", err)
+			invalid++
+			continue
+		}
+		if config.ingestorManifest != nil {
+			ingestorManifest, err := config.ingestorManifest()
+			if err != nil {
+				return nil, 0, fmt.Errorf("couldn't fetch ingestor global manifest: %w", err)
+			}
+			signature, err := config.intakeBucket.ReadBatchFile(batch.ObjectName(".batch.sig"))
+			if err != nil {
+				return nil, 0, fmt.Errorf("couldn't read signature of batch %s: %w", batch, err)
+			}
+			keyIdentifier, err := batchheader.VerifySignature(header, signature, ingestorManifest.BatchSigningPublicKey)
+			if err != nil {
+				log.Warn().Err(err).
+					Str("aggregation ID", config.aggregationID).
+					Str("batch", batch.String()).
+					Str("key identifier", keyIdentifier).
+					Msgf("not scheduling intake task for batch whose signature can't be verified: %s", err)
+				invalid++
+				unverified++
+				continue
+			}
+		}
+		log.Debug().
+			Str("aggregation ID", config.aggregationID).
+			Str("batch", batch.String()).
+			Int64("packets", packetCount).
+			Msg("batch header is valid")
+		checked = append(checked, batch)
+		passed++
+	}
+
+	invalidIngestionBatchesFound.WithLabelValues(config.aggregationID).Set(float64(invalid))
+	if config.ingestorManifest != nil {
+		unverifiedIngestionBatchesFound.WithLabelValues(config.aggregationID).Set(float64(unverified))
+	}
+	return checked, invalid, nil
+}
@@ -71,6 +71,23 @@ func (bpl List) WithinInterval(interval wftime.Interval) []string {
 	return output
 }
 
+// Without returns the batches in the receiver whose IDs are not the ID of any
+// batch in other, in the receiver's order.
+func (bpl List) Without(other List) List {
+	otherIDs := map[string]struct{}{}
+	for _, bp := range other {
+		otherIDs[bp.ID] = struct{}{}
+	}
+	output := List{}
+	for _, bp := range bpl {
+		if _, ok := otherIDs[bp.ID]; !ok {
+			output = append(output, bp)
+		}
+	}
+
+	return output
+}
+
 // New creates a new BatchPath from a batchName
 func New(batchName string) (*BatchPath, error) {
 	// batchName is like "kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771"
@@ -122,6 +139,29 @@ func (b *BatchPath) path() string {
 	return strings.Join([]string{b.AggregationID, b.DateString(), b.ID}, "/")
 }
 
+// ObjectName returns the name of the batch's object with the given suffix,
+// e.g. ".batch.avro" for an ingestion batch's packet file
+func (b *BatchPath) ObjectName(suffix string) string {
+	return b.path() + suffix
+}
+
+// ObjectNames returns the names of those of the batch's header, packet file &
+// signature objects, whose type suffixes are determined by infix as in
+// ReadyBatches, that were found by ReadyBatches.
+func (b *BatchPath) ObjectNames(infix string) []string {
+	var names []string
+	if b.headerObjectExists {
+		names = append(names, b.ObjectName("."+infix))
+	}
+	if b.packetObjectExists {
+		names = append(names, b.ObjectName("."+infix+".avro"))
+	}
+	if b.signatureObjectExists {
+		names = append(names, b.ObjectName("."+infix+".sig"))
+	}
+	return names
+}
+
 // DateString returns the string date representation of BatchPath
 func (b *BatchPath) DateString() string {
 	return strings.Join(b.dateComponents, "/")
@@ -130,13 +170,22 @@ func (b *BatchPath) DateString() string {
 type ReadyBatchesResult struct {
 	Batches              List
 	IncompleteBatchCount int
+	// IncompleteBatches are the batches ignored because they were
+	// incomplete.
+	IncompleteBatches List
+	// MalformedNames are the names of objects which don't parse as batch
+	// paths, if ReadyBatches was asked to skip them.
+	MalformedNames []string
 }
 
 // ReadyBatches scans the provided list of files looking for batches made up of
 // a header, packet file and a signature, corresponding to the given infix. On
 // success, returns the list of discovered batches and a count of batches
-// ignored because they were incomplete. Returns an error on failure.
-func ReadyBatches(files []string, infix string, acceptSignatureOnly bool) (*ReadyBatchesResult, error) {
+// ignored because they were incomplete. Returns an error on failure, including
+// if any object name doesn't parse as a batch path, unless skipMalformed is
+// set, in which case such names are returned in the result's MalformedNames.
+func ReadyBatches(files []string, infix string, acceptSignatureOnly bool, skipMalformed bool) (*ReadyBatchesResult, error) {
+	var malformedNames []string
 	batches := make(map[string]*BatchPath)
 	for _, name := range files {
 		// Ignore task marker objects
@@ -149,6 +198,10 @@ func ReadyBatches(files []string, infix string, acceptSignatureOnly bool) (*Read
 		if b == nil {
 			b, err = New(basename)
 			if err != nil {
+				if skipMalformed {
+					malformedNames = append(malformedNames, name)
+					continue
+				}
 				return nil, err
 			}
 			batches[basename] = b
@@ -164,8 +217,7 @@ func ReadyBatches(files []string, infix string, acceptSignatureOnly bool) (*Read
 		}
 	}
 
-	var output []*BatchPath
-	incompleteBatchCount := 0
+	var output, incomplete []*BatchPath
 	for _, v := range batches {
 		// A validation or ingestion batch is not ready unless all three files
 		// are present. This isn't true for sum parts, but workflow-manager
@@ -174,12 +226,18 @@ func ReadyBatches(files []string, infix string, acceptSignatureOnly bool) (*Read
 			output = append(output, v)
 		} else {
 			log.Info().Msgf("ignoring incomplete batch %s", v)
-			incompleteBatchCount++
+			incomplete = append(incomplete, v)
 		}
 	}
 	sort.Sort(List(output))
+	sort.Sort(List(incomplete))
 
-	return &ReadyBatchesResult{Batches: output, IncompleteBatchCount: incompleteBatchCount}, nil
+	return &ReadyBatchesResult{
+		Batches:              output,
+		IncompleteBatchCount: len(incomplete),
+		IncompleteBatches:    incomplete,
+		MalformedNames:       malformedNames,
+	}, nil
 }
 
 // basename returns s, with any type suffixes stripped off. The type suffixes are determined by
@@ -44,3 +44,79 @@ func TestWithinInterval(t *testing.T) {
 		t.Errorf("unexpected result %q", within)
 	}
 }
+
+func TestWithout(t *testing.T) {
+	bpl, err := NewList([]string{
+		"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771",
+		"kittens-seen/2020/10/31/20/35/0f0317b2-c612-48c2-b08d-d98529d6eae4",
+		"kittens-seen/2020/10/31/21/29/7a1c0fbc-2b7f-4307-8185-9ea88961bb64",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	other, err := NewList([]string{
+		"kittens-seen/2020/10/31/20/35/0f0317b2-c612-48c2-b08d-d98529d6eae4",
+		"kittens-seen/2020/10/31/22/35/79f0a477-b65c-47c9-a2bf-a3b56c33824a",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	without := bpl.Without(other)
+	if !reflect.DeepEqual(without, List{bpl[0], bpl[2]}) {
+		t.Errorf("unexpected result %v", without)
+	}
+}
+
+func TestReadyBatchesMalformedNames(t *testing.T) {
+	files := []string{
+		"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch",
+		"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.avro",
+		"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.sig",
+		"kittens-seen/2020/10/31/20/b8a5579a-f984-460a-a42d-2813cbf57771.batch",
+		"kittens-seen/2020/10/31/20/xx/0f0317b2-c612-48c2-b08d-d98529d6eae4.batch.sig",
+	}
+
+	if _, err := ReadyBatches(files, "batch", false, false); err == nil {
+		t.Errorf("expected error for malformed names")
+	}
+
+	result, err := ReadyBatches(files, "batch", false, true)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if result.Batches.Len() != 1 || result.Batches[0].ID != "b8a5579a-f984-460a-a42d-2813cbf57771" {
+		t.Errorf("unexpected batches %v", result.Batches)
+	}
+	if !reflect.DeepEqual(result.MalformedNames, files[3:]) {
+		t.Errorf("unexpected malformed names %q", result.MalformedNames)
+	}
+}
+
+func TestReadyBatchesIncompleteBatches(t *testing.T) {
+	files := []string{
+		"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch",
+		"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.avro",
+		"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.sig",
+		"kittens-seen/2020/10/31/20/35/0f0317b2-c612-48c2-b08d-d98529d6eae4.batch",
+		"kittens-seen/2020/10/31/20/35/0f0317b2-c612-48c2-b08d-d98529d6eae4.batch.avro",
+		"kittens-seen/2020/10/31/21/29/7a1c0fbc-2b7f-4307-8185-9ea88961bb64.batch.sig",
+	}
+
+	result, err := ReadyBatches(files, "batch", false, false)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if result.Batches.Len() != 1 || result.IncompleteBatchCount != 2 || result.IncompleteBatches.Len() != 2 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if !reflect.DeepEqual(result.IncompleteBatches[0].ObjectNames("batch"), files[3:5]) {
+		t.Errorf("unexpected object names %q", result.IncompleteBatches[0].ObjectNames("batch"))
+	}
+	if !reflect.DeepEqual(result.IncompleteBatches[1].ObjectNames("batch"), files[5:]) {
+		t.Errorf("unexpected object names %q", result.IncompleteBatches[1].ObjectNames("batch"))
+	}
+	if !reflect.DeepEqual(result.Batches[0].ObjectNames("batch"), files[:3]) {
+		t.Errorf("unexpected object names %q", result.Batches[0].ObjectNames("batch"))
+	}
+}
@@ -0,0 +1,145 @@
+// Package cgroup reads the CPU and memory limits imposed on the current
+// process by Linux control groups, e.g. by a Kubernetes container's resource
+// limits.
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultRoot is where the cgroup filesystem is mounted. Inside a container,
+// this is the container's own cgroup.
+const defaultRoot = "/sys/fs/cgroup"
+
+// cgroup v1 reports "no memory limit" as a very large number, rounded down to
+// a multiple of the page size, rather than as a sentinel value. Anything at
+// least this large is treated as unlimited.
+const v1UnlimitedMemoryThreshold = int64(1) << 62
+
+// Limits are the resource limits imposed on the process.
+type Limits struct {
+	// CPUs is the number of CPUs the process may use, which may be
+	// fractional, or 0 if CPU usage is not limited.
+	CPUs float64
+	// MemoryBytes is the maximum amount of memory the process may use, in
+	// bytes, or 0 if memory usage is not limited.
+	MemoryBytes int64
+}
+
+// Read returns the limits imposed on the current process. Limits which are not
+// configured, or which cannot be discovered because cgroups are unavailable
+// (e.g. on a developer's workstation), are reported as unlimited.
+func Read() (Limits, error) {
+	return readLimits(defaultRoot)
+}
+
+func readLimits(root string) (Limits, error) {
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err == nil {
+		return readV2Limits(root)
+	}
+	return readV1Limits(root)
+}
+
+// readV2Limits reads limits from a cgroup v2 (unified) hierarchy.
+func readV2Limits(root string) (Limits, error) {
+	var limits Limits
+
+	// cpu.max is "$MAX $PERIOD", where $MAX may be "max".
+	cpuMax, err := readFile(filepath.Join(root, "cpu.max"))
+	if err != nil {
+		return Limits{}, err
+	}
+	if fields := strings.Fields(cpuMax); len(fields) == 2 && fields[0] != "max" {
+		quota, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return Limits{}, fmt.Errorf("couldn't parse CPU quota %q: %w", cpuMax, err)
+		}
+		period, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return Limits{}, fmt.Errorf("couldn't parse CPU period %q: %w", cpuMax, err)
+		}
+		limits.CPUs = cpus(quota, period)
+	}
+
+	memoryMax, err := readFile(filepath.Join(root, "memory.max"))
+	if err != nil {
+		return Limits{}, err
+	}
+	if memoryMax != "" && memoryMax != "max" {
+		memory, err := strconv.ParseInt(memoryMax, 10, 64)
+		if err != nil {
+			return Limits{}, fmt.Errorf("couldn't parse memory limit %q: %w", memoryMax, err)
+		}
+		limits.MemoryBytes = memory
+	}
+
+	return limits, nil
+}
+
+// readV1Limits reads limits from a cgroup v1 hierarchy, in which each
+// controller is mounted separately.
+func readV1Limits(root string) (Limits, error) {
+	var limits Limits
+
+	quotaString, err := readFile(filepath.Join(root, "cpu", "cpu.cfs_quota_us"))
+	if err != nil {
+		return Limits{}, err
+	}
+	periodString, err := readFile(filepath.Join(root, "cpu", "cpu.cfs_period_us"))
+	if err != nil {
+		return Limits{}, err
+	}
+	if quotaString != "" && periodString != "" {
+		quota, err := strconv.ParseInt(quotaString, 10, 64)
+		if err != nil {
+			return Limits{}, fmt.Errorf("couldn't parse CPU quota %q: %w", quotaString, err)
+		}
+		period, err := strconv.ParseInt(periodString, 10, 64)
+		if err != nil {
+			return Limits{}, fmt.Errorf("couldn't parse CPU period %q: %w", periodString, err)
+		}
+		limits.CPUs = cpus(quota, period)
+	}
+
+	memoryString, err := readFile(filepath.Join(root, "memory", "memory.limit_in_bytes"))
+	if err != nil {
+		return Limits{}, err
+	}
+	if memoryString != "" {
+		memory, err := strconv.ParseInt(memoryString, 10, 64)
+		if err != nil {
+			return Limits{}, fmt.Errorf("couldn't parse memory limit %q: %w", memoryString, err)
+		}
+		if memory < v1UnlimitedMemoryThreshold {
+			limits.MemoryBytes = memory
+		}
+	}
+
+	return limits, nil
+}
+
+// cpus converts a CFS quota and period into a number of CPUs. A non-positive
+// quota (cgroup v1 uses -1) means CPU usage is unlimited.
+func cpus(quota, period int64) float64 {
+	if quota <= 0 || period <= 0 {
+		return 0
+	}
+	return float64(quota) / float64(period)
+}
+
+// readFile returns the whitespace-trimmed contents of the file at path, or an
+// empty string if it does not exist.
+func readFile(path string) (string, error) {
+	contents, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("couldn't read %s: %w", path, err)
+	}
+	return strings.TrimSpace(string(contents)), nil
+}
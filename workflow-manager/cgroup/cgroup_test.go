@@ -0,0 +1,93 @@
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadLimits(t *testing.T) {
+	for _, testCase := range []struct {
+		name           string
+		files          map[string]string
+		expectedLimits Limits
+		expectError    bool
+	}{
+		{
+			name:           "no-cgroups",
+			files:          map[string]string{},
+			expectedLimits: Limits{},
+		},
+		{
+			name: "v2-limited",
+			files: map[string]string{
+				"cgroup.controllers": "cpu memory\n",
+				"cpu.max":            "150000 100000\n",
+				"memory.max":         "536870912\n",
+			},
+			expectedLimits: Limits{CPUs: 1.5, MemoryBytes: 512 << 20},
+		},
+		{
+			name: "v2-unlimited",
+			files: map[string]string{
+				"cgroup.controllers": "cpu memory\n",
+				"cpu.max":            "max 100000\n",
+				"memory.max":         "max\n",
+			},
+			expectedLimits: Limits{},
+		},
+		{
+			name: "v2-malformed",
+			files: map[string]string{
+				"cgroup.controllers": "cpu memory\n",
+				"cpu.max":            "lots 100000\n",
+			},
+			expectError: true,
+		},
+		{
+			name: "v1-limited",
+			files: map[string]string{
+				"cpu/cpu.cfs_quota_us":         "50000\n",
+				"cpu/cpu.cfs_period_us":        "100000\n",
+				"memory/memory.limit_in_bytes": "268435456\n",
+			},
+			expectedLimits: Limits{CPUs: 0.5, MemoryBytes: 256 << 20},
+		},
+		{
+			name: "v1-unlimited",
+			files: map[string]string{
+				"cpu/cpu.cfs_quota_us":         "-1\n",
+				"cpu/cpu.cfs_period_us":        "100000\n",
+				"memory/memory.limit_in_bytes": "9223372036854771712\n",
+			},
+			expectedLimits: Limits{},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			root := t.TempDir()
+			for name, contents := range testCase.files {
+				path := filepath.Join(root, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatalf("couldn't create directory: %s", err)
+				}
+				if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+					t.Fatalf("couldn't write file: %s", err)
+				}
+			}
+
+			limits, err := readLimits(root)
+			if testCase.expectError {
+				if err == nil {
+					t.Errorf("expected error, got limits %+v", limits)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %q", err)
+			}
+			if limits != testCase.expectedLimits {
+				t.Errorf("got limits %+v, expected %+v", limits, testCase.expectedLimits)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// metricsRunID, if not empty, is the unique identifier of this run, and task
+// counts are exported as counters rather than as gauges. It is set by
+// --metrics-mode=counters.
+var metricsRunID string
+
+// runCountersRegistry holds the counters exported by taskCountVec. They are
+// pushed separately from other metrics, to a group identified by the run ID,
+// which replaces the group of the previous run once pushed; see
+// deleteEarlierRunGroups.
+var runCountersRegistry = prometheus.NewRegistry()
+
+// taskCountVec counts tasks, labelled by aggregation ID. By default, counts
+// are exported as a gauge, which is reset to the count of the most recent run
+// whenever a run pushes its metrics. If metricsRunID is set, counts are
+// instead exported as a counter named with a "_total" suffix in
+// runCountersRegistry.
+type taskCountVec struct {
+	gauge   *prometheus.GaugeVec
+	counter *prometheus.CounterVec
+}
+
+func newTaskCountVec(name, help string) taskCountVec {
+	return taskCountVec{
+		gauge: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{Name: name, Help: help},
+			[]string{"aggregation_id"},
+		),
+		counter: promauto.With(runCountersRegistry).NewCounterVec(
+			prometheus.CounterOpts{Name: name + "_total", Help: help + ", in a single run"},
+			[]string{"aggregation_id"},
+		),
+	}
+}
+
+// inc increments the count for the aggregation ID.
+func (v taskCountVec) inc(aggregationID string) {
+	if metricsRunID != "" {
+		v.counter.WithLabelValues(aggregationID).Inc()
+		return
+	}
+	v.gauge.WithLabelValues(aggregationID).Inc()
+}
+
+// deleteEarlierRunGroups deletes the groups pushed to the pushgateway by runs
+// earlier than runID, i.e. those of the job with the given grouping labels
+// whose run_id label is a smaller run ID, so that the pushgateway keeps the
+// group of only the latest run rather than accumulating a group per run.
+// Groups of later runs, which may have overlapped this one, are kept.
+func deleteEarlierRunGroups(gateway, job string, grouping map[string]string, runID string) error {
+	current, err := strconv.ParseInt(runID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("couldn't parse run ID %q: %w", runID, err)
+	}
+	if !strings.Contains(gateway, "://") {
+		gateway = "http://" + gateway
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(gateway, "/") + "/api/v1/metrics")
+	if err != nil {
+		return fmt.Errorf("couldn't list pushgateway groups: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("couldn't list pushgateway groups: unexpected status %q", resp.Status)
+	}
+	var groups struct {
+		Data []struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+		return fmt.Errorf("couldn't parse pushgateway groups: %w", err)
+	}
+
+groups:
+	for _, group := range groups.Data {
+		if group.Labels["job"] != job {
+			continue
+		}
+		for name, value := range grouping {
+			if group.Labels[name] != value {
+				continue groups
+			}
+		}
+		earlier, err := strconv.ParseInt(group.Labels["run_id"], 10, 64)
+		if err != nil || earlier >= current {
+			continue
+		}
+		pusher := push.New(gateway, job)
+		for name, value := range grouping {
+			pusher = pusher.Grouping(name, value)
+		}
+		if err := pusher.Grouping("run_id", group.Labels["run_id"]).Delete(); err != nil {
+			return fmt.Errorf("couldn't delete pushgateway group of run %q: %w", group.Labels["run_id"], err)
+		}
+	}
+	return nil
+}
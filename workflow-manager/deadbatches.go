@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+
+	"github.com/letsencrypt/prio-server/workflow-manager/batchpath"
+)
+
+var deadIngestionBatchesFound = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "workflow_manager_dead_ingestion_batches",
+		Help: "The number of ingestion batches which have been seen incomplete for longer than --incomplete-batch-alert-age, including those since aged out of the intake window",
+	},
+	[]string{"aggregation_id"},
+)
+
+// incompleteBatch records an ingestion batch found incomplete by one or more
+// runs.
+type incompleteBatch struct {
+	Time      time.Time `json:"time"` // the batch's timestamp
+	FirstSeen time.Time `json:"first-seen"`
+	LastSeen  time.Time `json:"last-seen"`
+	Objects   []string  `json:"objects"` // names of the batch's objects which were found
+}
+
+// incompleteBatchesState is the record of incomplete ingestion batches for an
+// aggregation ID, by batch name, persisted in the own validation bucket
+// between runs so that batches are tracked after they age out of the intake
+// window.
+type incompleteBatchesState struct {
+	Batches map[string]incompleteBatch `json:"batches"`
+}
+
+// incompleteBatchesStateName returns the name of the state object holding the
+// incomplete batches state for the aggregation ID.
+func incompleteBatchesStateName(aggregationID string) string {
+	return fmt.Sprintf("incomplete-batches-%s.json", aggregationID)
+}
+
+// update records the incomplete batches found at now. Recorded batches which
+// are within the intake window beginning at intakeBegin but weren't found
+// incomplete have since been completed (or deleted) and are discarded, as are
+// batches outside the intake window which were last seen more than retention
+// before now.
+func (s *incompleteBatchesState) update(incomplete batchpath.List, now, intakeBegin time.Time, retention time.Duration) {
+	if s.Batches == nil {
+		s.Batches = map[string]incompleteBatch{}
+	}
+	found := map[string]struct{}{}
+	for _, batch := range incomplete {
+		name := batch.ObjectName("")
+		found[name] = struct{}{}
+		record, ok := s.Batches[name]
+		if !ok {
+			record = incompleteBatch{Time: batch.Time, FirstSeen: now}
+		}
+		record.LastSeen = now
+		record.Objects = batch.ObjectNames("batch")
+		s.Batches[name] = record
+	}
+	for name, record := range s.Batches {
+		if _, ok := found[name]; ok {
+			continue
+		}
+		if !record.Time.Before(intakeBegin) || now.Sub(record.LastSeen) > retention {
+			delete(s.Batches, name)
+		}
+	}
+}
+
+// deadBatch is an ingestion batch which has been seen incomplete for longer
+// than the alert age.
+type deadBatch struct {
+	Name string `json:"name"`
+	incompleteBatch
+}
+
+// dead returns the recorded batches first seen incomplete more than alertAge
+// before now, sorted by name.
+func (s incompleteBatchesState) dead(now time.Time, alertAge time.Duration) []deadBatch {
+	dead := []deadBatch{}
+	for name, record := range s.Batches {
+		if now.Sub(record.FirstSeen) > alertAge {
+			dead = append(dead, deadBatch{Name: name, incompleteBatch: record})
+		}
+	}
+	sort.Slice(dead, func(i, j int) bool { return dead[i].Name < dead[j].Name })
+	return dead
+}
+
+// deadBatchesReport lists the ingestion batches for an aggregation ID which
+// have been seen incomplete for longer than the alert age, so that operators
+// can chase the ingestor.
+type deadBatchesReport struct {
+	AggregationID string      `json:"aggregation-id"`
+	Time          time.Time   `json:"time"`
+	AlertAge      string      `json:"alert-age"`
+	Batches       []deadBatch `json:"batches"`
+}
+
+// updateIncompleteBatches records the incomplete ingestion batches found by
+// this run in the incomplete batches state for config.aggregationID stored in
+// the own validation bucket, discarding those since completed or no longer
+// retained per config.incompleteBatchRetention, and updates the dead batch
+// metric with the number first seen more than config.incompleteBatchAlertAge
+// ago. If config.incompleteBatchReport is set, those batches are also listed
+// in a deadBatchesReport written to
+// "reports/dead-batches/${aggregation-id}.json", which is rewritten by every
+// run, even if it finds no dead batches. Unreadable state is logged and
+// replaced.
+func updateIncompleteBatches(config scheduleTasksConfig, incomplete batchpath.List, intakeBegin time.Time) error {
+	name := incompleteBatchesStateName(config.aggregationID)
+	contents, err := config.ownValidationBucket.ReadState(name)
+	if err != nil {
+		return fmt.Errorf("couldn't read incomplete batches state: %w", err)
+	}
+
+	var state incompleteBatchesState
+	if contents != nil {
+		if err := json.Unmarshal(contents, &state); err != nil {
+			log.Warn().Err(err).
+				Str("aggregation ID", config.aggregationID).
+				Msgf("discarding malformed incomplete batches state: %s", err)
+			state = incompleteBatchesState{}
+		}
+	}
+
+	now := config.clock.Now().UTC()
+	state.update(incomplete, now, intakeBegin, config.incompleteBatchRetention)
+	contents, err = json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("couldn't marshal incomplete batches state: %w", err)
+	}
+	if err := config.ownValidationBucket.WriteState(name, contents); err != nil {
+		return fmt.Errorf("couldn't write incomplete batches state: %w", err)
+	}
+
+	dead := state.dead(now, config.incompleteBatchAlertAge)
+	deadIngestionBatchesFound.WithLabelValues(config.aggregationID).Set(float64(len(dead)))
+	for _, batch := range dead {
+		log.Warn().
+			Str("aggregation ID", config.aggregationID).
+			Str("batch", batch.Name).
+			Time("first seen", batch.FirstSeen).
+			Strs("objects", batch.Objects).
+			Msg("ingestion batch has been incomplete for longer than the alert age")
+	}
+	if !config.incompleteBatchReport {
+		return nil
+	}
+
+	report := deadBatchesReport{
+		AggregationID: config.aggregationID,
+		Time:          now,
+		AlertAge:      config.incompleteBatchAlertAge.String(),
+		Batches:       dead,
+	}
+	reportJSON, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't marshal dead batches report as JSON: %w", err)
+	}
+	if err := config.ownValidationBucket.WriteReport(fmt.Sprintf("dead-batches/%s.json", config.aggregationID), reportJSON); err != nil {
+		return fmt.Errorf("couldn't write dead batches report: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/letsencrypt/prio-server/workflow-manager/batchpath"
+)
+
+var (
+	peerValidationLagMax = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "workflow_manager_peer_validation_lag_max_seconds",
+			Help: "The greatest age of the ingestion batches in the current aggregation interval for which no peer validation batch has been found, or 0 if there are none",
+		},
+		[]string{"aggregation_id"},
+	)
+	peerValidationLagMedian = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "workflow_manager_peer_validation_lag_median_seconds",
+			Help: "The median age of the ingestion batches in the current aggregation interval for which no peer validation batch has been found, or 0 if there are none",
+		},
+		[]string{"aggregation_id"},
+	)
+	peerValidationsPending = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "workflow_manager_peer_validations_pending",
+			Help: "The number of ingestion batches in the current aggregation interval for which no peer validation batch has been found",
+		},
+		[]string{"aggregation_id"},
+	)
+)
+
+// peerValidationLag describes how far the peer data share processor's
+// validation of the ingestion batches in an aggregation window lags behind
+// ingestion.
+type peerValidationLag struct {
+	pending int           // ingestion batches with no peer validation batch
+	max     time.Duration // greatest age of the pending batches
+	median  time.Duration // median age of the pending batches
+}
+
+// computePeerValidationLag returns the lag of peer validations behind the
+// ingestion batches at now. Listings don't include the times objects were
+// written, so the lag of an ingestion batch is the time since its timestamp
+// for as long as its peer validation batch hasn't been found, and stops
+// counting once it has. A peer that falls behind therefore shows as a growing
+// maximum lag well before aggregations omit its batches.
+func computePeerValidationLag(ingestionBatches, peerValidationBatches batchpath.List, now time.Time) peerValidationLag {
+	peerValidationBatchIDs := map[string]struct{}{}
+	for _, batch := range peerValidationBatches {
+		peerValidationBatchIDs[batch.ID] = struct{}{}
+	}
+
+	ages := []time.Duration{}
+	for _, batch := range ingestionBatches {
+		if _, ok := peerValidationBatchIDs[batch.ID]; ok {
+			continue
+		}
+		age := now.Sub(batch.Time)
+		if age < 0 {
+			age = 0
+		}
+		ages = append(ages, age)
+	}
+	if len(ages) == 0 {
+		return peerValidationLag{}
+	}
+
+	sort.Slice(ages, func(i, j int) bool { return ages[i] < ages[j] })
+	median := ages[len(ages)/2]
+	if len(ages)%2 == 0 {
+		median = (ages[len(ages)/2-1] + ages[len(ages)/2]) / 2
+	}
+	return peerValidationLag{
+		pending: len(ages),
+		max:     ages[len(ages)-1],
+		median:  median,
+	}
+}
+
+// record exports the lag as metrics for the aggregation ID.
+func (l peerValidationLag) record(aggregationID string) {
+	peerValidationLagMax.WithLabelValues(aggregationID).Set(l.max.Seconds())
+	peerValidationLagMedian.WithLabelValues(aggregationID).Set(l.median.Seconds())
+	peerValidationsPending.WithLabelValues(aggregationID).Set(float64(l.pending))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// schedulerHealth tracks the progress of scheduling passes, i.e. a one-shot
+// run's scan of the buckets or a --watch reconciliation, for the /healthz &
+// /readyz endpoints served with --http-listen. workflow-manager is ready once
+// a pass has completed, and is live as long as a pass has completed
+// (successfully or not) within maxAge. A failing pass is reported through
+// metrics rather than by failing probes, since restarting workflow-manager is
+// unlikely to fix it. Methods on a nil *schedulerHealth do nothing, so that
+// callers need not check whether --http-listen was passed.
+type schedulerHealth struct {
+	maxAge time.Duration    // if zero, liveness does not depend on passes completing
+	now    func() time.Time // time.Now, except in tests
+
+	mu            sync.Mutex
+	start         time.Time // when workflow-manager started
+	lastStarted   time.Time // when the most recent pass started
+	lastCompleted time.Time // when the most recent pass completed; zero if none has
+	lastErr       error     // the error from the most recent completed pass
+}
+
+func newSchedulerHealth(maxAge time.Duration) *schedulerHealth {
+	return &schedulerHealth{maxAge: maxAge, now: time.Now, start: time.Now()}
+}
+
+// started records that a scheduling pass started.
+func (h *schedulerHealth) started() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastStarted = h.now()
+}
+
+// completed records that a scheduling pass completed with the given error.
+func (h *schedulerHealth) completed(err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastCompleted, h.lastErr = h.now(), err
+}
+
+// live returns an error if no pass has completed within maxAge, counting from
+// workflow-manager's start if no pass has yet completed.
+func (h *schedulerHealth) live() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.maxAge <= 0 {
+		return nil
+	}
+	since := h.lastCompleted
+	if since.IsZero() {
+		since = h.start
+	}
+	if age := h.now().Sub(since); age > h.maxAge {
+		return fmt.Errorf("no scheduling pass completed in %v (last pass started at %s)", age.Round(time.Second), h.lastStarted.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// ready returns an error if no pass has yet completed.
+func (h *schedulerHealth) ready() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.lastCompleted.IsZero() {
+		return errors.New("no scheduling pass has completed yet")
+	}
+	return nil
+}
+
+// serveCheck responds to a probe with the result of check, noting the error
+// from the most recent pass, if any.
+func (h *schedulerHealth) serveCheck(w http.ResponseWriter, check func() error) {
+	if err := check(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	h.mu.Lock()
+	lastErr := h.lastErr
+	h.mu.Unlock()
+	if lastErr != nil {
+		fmt.Fprintf(w, "ok (last scheduling pass failed: %v)\n", lastErr)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// healthHandler returns a handler serving /healthz & /readyz from health and
+// /metrics from gatherer.
+func healthHandler(health *schedulerHealth, gatherer prometheus.Gatherer) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { health.serveCheck(w, health.live) })
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) { health.serveCheck(w, health.ready) })
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	return mux
+}
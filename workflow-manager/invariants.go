@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+
+	"github.com/letsencrypt/prio-server/workflow-manager/storage"
+)
+
+var invariantViolations = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "workflow_manager_invariant_violations",
+		Help: "The number of consistency checks between the batches discovered, tasks enqueued & task markers written which failed in the most recent scheduling of tasks, by aggregation ID",
+	},
+	[]string{"aggregation_id"},
+)
+
+// countingBucket implements storage.Bucket by wrapping another Bucket, and
+// counting the task markers & dead-letter tasks written in stats.
+type countingBucket struct {
+	storage.Bucket
+	stats *runStats
+}
+
+func (b countingBucket) WriteTaskMarker(marker string) error {
+	atomic.AddInt64(&b.stats.taskMarkerWrites, 1)
+	return b.Bucket.WriteTaskMarker(marker)
+}
+
+func (b countingBucket) WriteDeadLetterTask(marker string, task []byte) error {
+	atomic.AddInt64(&b.stats.deadLetterWrites, 1)
+	return b.Bucket.WriteDeadLetterTask(marker, task)
+}
+
+// invariantViolations checks that the counts in s, taken once every task has
+// been enqueued & every completion function has returned, are consistent with
+// one another, returning a description of each inconsistency. Historically,
+// inconsistencies have indicated that completion functions were lost or
+// invoked more than once by an Enqueuer.
+func (s *runStats) invariantViolations() []string {
+	var violations []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			violations = append(violations, fmt.Sprintf(format, args...))
+		}
+	}
+
+	submitted := atomic.LoadInt64(&s.tasksSubmitted)
+	completions := atomic.LoadInt64(&s.taskCompletions)
+	succeeded := atomic.LoadInt64(&s.intakeTasks) + atomic.LoadInt64(&s.aggregationTasks)
+	markers := atomic.LoadInt64(&s.taskMarkerWrites)
+	markersDue := atomic.LoadInt64(&s.taskMarkersDue)
+	deadLetters := atomic.LoadInt64(&s.deadLetterWrites)
+
+	check(completions == submitted,
+		"%d tasks were enqueued, but completion functions were invoked %d times", submitted, completions)
+	check(markers == markersDue+int64(s.intakeMarkersBackfilled),
+		"%d task markers were written, but %d tasks were enqueued successfully, due %d markers, and %d intake task markers were backfilled",
+		markers, succeeded, markersDue, s.intakeMarkersBackfilled)
+	check(deadLetters == completions-succeeded,
+		"%d dead-letter tasks were written, but %d tasks failed to be enqueued", deadLetters, completions-succeeded)
+	check(s.intakeTasksSubmitted+s.intakeTasksSkipped+s.intakeTasksDeferred+s.invalidIngestionBatches == s.ingestionBatches,
+		"%d ingestion batches were discovered, but %d intake tasks were enqueued, %d skipped and %d deferred, and %d batches were invalid",
+		s.ingestionBatches, s.intakeTasksSubmitted, s.intakeTasksSkipped, s.intakeTasksDeferred, s.invalidIngestionBatches)
+	return violations
+}
+
+// checkInvariants checks the invariants of the statistics describing the
+// scheduling of tasks for the aggregation ID, logging & returning an error
+// if any are violated. A nil runStats is not checked.
+func checkInvariants(aggregationID string, stats *runStats) error {
+	if stats == nil {
+		return nil
+	}
+	violations := stats.invariantViolations()
+	invariantViolations.WithLabelValues(aggregationID).Set(float64(len(violations)))
+	for _, violation := range violations {
+		log.Error().
+			Str("aggregation ID", aggregationID).
+			Msgf("INVARIANT VIOLATION: %s", violation)
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("%d scheduling invariants violated, which may indicate lost task completions: %s", len(violations), violations[0])
+	}
+	return nil
+}
@@ -7,20 +7,37 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"math"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"runtime/debug"
 	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
+	leazure "github.com/letsencrypt/prio-server/workflow-manager/azure"
 	"github.com/letsencrypt/prio-server/workflow-manager/batchpath"
+	"github.com/letsencrypt/prio-server/workflow-manager/cgroup"
+	"github.com/letsencrypt/prio-server/workflow-manager/manifest"
+	"github.com/letsencrypt/prio-server/workflow-manager/notification"
 	"github.com/letsencrypt/prio-server/workflow-manager/storage"
 	"github.com/letsencrypt/prio-server/workflow-manager/task"
+	"github.com/letsencrypt/prio-server/workflow-manager/taskevent"
 	wftime "github.com/letsencrypt/prio-server/workflow-manager/time"
 	"github.com/letsencrypt/prio-server/workflow-manager/utils"
 
@@ -28,6 +45,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/push"
+	"golang.org/x/sync/errgroup"
 )
 
 // BuildInfo is generated at build time - see the Dockerfile.
@@ -35,42 +53,128 @@ var BuildInfo string
 
 // Flags.
 var (
-	k8sNS                  = flag.String("k8s-namespace", "", "Kubernetes namespace")
-	ingestorLabel          = flag.String("ingestor-label", "", "Label of ingestion server")
-	isFirst                = flag.Bool("is-first", false, "Whether this set of servers is \"first\", aka PHA servers")
-	maxAge                 = flag.Duration("intake-max-age", time.Hour, "Max age (in Go duration format) for intake batches to be worth processing.")
-	ingestorInput          = flag.String("ingestor-input", "", "Bucket for input from ingestor (s3:// or gs://) (Required)")
-	ingestorIdentity       = flag.String("ingestor-identity", "", "Identity to use with ingestor bucket (Required for S3)")
-	ownValidationInput     = flag.String("own-validation-input", "", "Bucket for input of validation batches from self (s3:// or gs://) (required)")
-	ownValidationIdentity  = flag.String("own-validation-identity", "", "Identity to use with own validation bucket (Required for S3)")
-	peerValidationInput    = flag.String("peer-validation-input", "", "Bucket for input of validation batches from peer (s3:// or gs://) (required)")
-	peerValidationIdentity = flag.String("peer-validation-identity", "", "Identity to use with peer validation bucket (Required for S3)")
-	pushGateway            = flag.String("push-gateway", "", "Set this to the gateway to use with prometheus. If left empty, workflow-manager will not use prometheus.")
-	dryRun                 = flag.Bool("dry-run", false, "If set, no operations with side effects will be done.")
-	taskQueueKind          = flag.String("task-queue-kind", "", "Which task queue kind to use.")
-	intakeTasksTopic       = flag.String("intake-tasks-topic", "", "Name of the topic to which intake-batch tasks should be published")
-	aggregateTasksTopic    = flag.String("aggregate-tasks-topic", "", "Name of the topic to which aggregate tasks should be published")
-	maxEnqueueWorkers      = flag.Int("max-enqueue-workers", 100, "Max number of workers that can be used to enqueue jobs")
-	cpuProfile             = flag.String("cpuprofile", "", "Write a CPU profile to `file`")
-	memProfile             = flag.String("memprofile", "", "Write a memory profile to `file`")
+	k8sNS                        = flag.String("k8s-namespace", "", "Kubernetes namespace")
+	ingestorLabel                = flag.String("ingestor-label", "", "Label of ingestion server")
+	isFirst                      = flag.Bool("is-first", false, "Whether this set of servers is \"first\", aka PHA servers. If --portal-manifest-base-url is set, this is instead derived from the portal server global manifest; if this flag is also set, it must agree")
+	portalManifestBaseURL        = flag.String("portal-manifest-base-url", "", "If specified, the https:// base URL of the portal server's global manifest, used with --sum-part-bucket to determine whether this set of servers is \"first\"")
+	sumPartBucket                = flag.String("sum-part-bucket", "", "The URL of the portal server bucket to which this set of servers writes sum parts, as it appears in the portal server global manifest. Required with --portal-manifest-base-url")
+	maxAge                       = flag.Duration("intake-max-age", time.Hour, "Max age (in Go duration format) for intake batches to be worth processing.")
+	ingestorInput                = flag.String("ingestor-input", "", "Bucket for input from ingestor (s3:// or gs://) (Required)")
+	ingestorIdentity             = flag.String("ingestor-identity", "", "Identity to use with ingestor bucket (Required for S3)")
+	ownValidationInput           = flag.String("own-validation-input", "", "Bucket for input of validation batches from self (s3:// or gs://) (required)")
+	ownValidationIdentity        = flag.String("own-validation-identity", "", "Identity to use with own validation bucket (Required for S3)")
+	peerValidationInput          = flag.String("peer-validation-input", "", "Bucket for input of validation batches from peer (s3:// or gs://) (required)")
+	peerValidationIdentity       = flag.String("peer-validation-identity", "", "Identity to use with peer validation bucket (Required for S3)")
+	ingestorRequesterPays        = flag.Bool("ingestor-requester-pays", false, "If set, the ingestor bucket is a requester-pays S3 bucket")
+	ownValidationRequesterPays   = flag.Bool("own-validation-requester-pays", false, "If set, the own validation bucket is a requester-pays S3 bucket")
+	peerValidationRequesterPays  = flag.Bool("peer-validation-requester-pays", false, "If set, the peer validation bucket is a requester-pays S3 bucket")
+	s3Endpoint                   = flag.String("s3-endpoint", "", "If specified, the URL of an S3-compatible API, e.g. 'http://minio:9000', used for every s3:// bucket in place of AWS S3. May be overridden for a single bucket by an 'endpoint' parameter in its URL, e.g. 's3://region/bucket?endpoint=http://minio:9000'")
+	s3ForcePathStyle             = flag.Bool("s3-force-path-style", false, "If set, s3:// buckets are addressed by path ('${endpoint}/${bucket}') rather than by host name, as MinIO & most other S3-compatible services require. May be overridden for a single bucket by a 'path_style' parameter in its URL")
+	s3AccessKeyID                = flag.String("s3-access-key-id", "", "If specified with --s3-secret-access-key-file, the access key ID of static credentials used for s3:// buckets without an identity. May be overridden for a single bucket by 'access_key_id' & 'secret_access_key' parameters in its URL")
+	s3SecretAccessKeyFile        = flag.String("s3-secret-access-key-file", "", "With --s3-access-key-id, the path to a file holding the secret access key of static credentials used for s3:// buckets")
+	ingestorInventory            = flag.String("ingestor-inventory", "", "If specified, the location of inventory reports of the ingestor bucket, from which batch files older than --inventory-live-listing-period are listed: 's3://region/destination-bucket/destination-prefix/source-bucket/config-ID' for S3 Inventory (CSV format), read as --ingestor-identity, or 'gs://destination-bucket/destination-path' for GCS Storage Insights inventory reports")
+	ownValidationInventory       = flag.String("own-validation-inventory", "", "As --ingestor-inventory, but for the own validation bucket, read as --own-validation-identity")
+	peerValidationInventory      = flag.String("peer-validation-inventory", "", "As --ingestor-inventory, but for the peer validation bucket, read as --peer-validation-identity")
+	inventoryLiveListingPeriod   = flag.Duration("inventory-live-listing-period", 6*time.Hour, "With --ingestor-inventory, --own-validation-inventory or --peer-validation-inventory, batch files whose timestamps are within this `duration` of the most recent inventory report (rounded down to the hour) are listed by the bucket rather than from the report, since they may not have been written when it was taken")
+	pushGateway                  = flag.String("push-gateway", "", "Set this to the gateway to use with prometheus. If left empty, workflow-manager will not use prometheus.")
+	metricsMode                  = flag.String("metrics-mode", "gauges", "How task counts are exported: 'gauges' exports the counts of the most recent run as gauges; 'counters' exports each run's counts as counters with a '_total' suffix, pushed to a group labelled with a unique run_id which replaces the groups of earlier runs. Since each run's counters are distinct series, queries must aggregate them with 'sum without(run_id)', and rate() & increase() are not meaningful on them")
+	dryRun                       = flag.Bool("dry-run", false, "If set, no operations with side effects will be done.")
+	taskQueueKind                = flag.String("task-queue-kind", "", "Which task queue kind to use: 'gcp-pubsub', 'aws-sns', 'azure-servicebus' or 'http-webhook'")
+	intakeTasksTopic             = flag.String("intake-tasks-topic", "", "Name of the topic to which intake-batch tasks should be published")
+	aggregateTasksTopic          = flag.String("aggregate-tasks-topic", "", "Name of the topic to which aggregate tasks should be published")
+	maxEnqueueWorkers            = flag.Int("max-enqueue-workers", 0, "Max number of workers that can be used to enqueue jobs. If 0, chosen based on the process' cgroup CPU and memory limits, up to 100")
+	enqueueMaxAttempts           = flag.Int("enqueue-max-attempts", 3, "Max number of attempts to enqueue each task. Tasks which cannot be enqueued are written to the dead-letter-tasks/ prefix of the own validation bucket")
+	enqueueInitialBackoff        = flag.Duration("enqueue-initial-backoff", time.Second, "How long to wait before retrying a failed attempt to enqueue a task. Doubles with each subsequent attempt")
+	enqueueMaxBackoff            = flag.Duration("enqueue-max-backoff", 30*time.Second, "Max time to wait between attempts to enqueue a task")
+	storageMaxAttempts           = flag.Int("storage-max-attempts", 3, "Max number of attempts at each storage bucket operation which fails with a transient error, such as an HTTP 5xx or 429 response or a network timeout")
+	storageInitialBackoff        = flag.Duration("storage-initial-backoff", time.Second, "How long to wait before retrying a storage bucket operation which failed with a transient error. Doubles with each subsequent attempt, and is randomized by up to half to spread out retries")
+	storageMaxBackoff            = flag.Duration("storage-max-backoff", 10*time.Second, "Max time to wait between attempts at a storage bucket operation")
+	taskMarkerStore              = flag.String("task-marker-store", "", "If set, task markers are listed and written in a DynamoDB table ('dynamodb://${region}/${table}') or a Firestore collection in the default database ('firestore://${project}/${collection}') rather than the task-markers/ prefix of the own validation bucket")
+	taskMarkerStoreIdentity      = flag.String("task-marker-store-identity", "", "Identity to use with a DynamoDB task marker store")
+	taskMarkerTTL                = flag.Duration("task-marker-ttl", 0, "If non-zero, each task marker written to --task-marker-store records an expiry time this long after it is written, for use by the table or collection's TTL policy")
+	taskMarkerRetention          = flag.Duration("task-marker-retention", 0, "If non-zero, after scheduling tasks for each aggregation ID, task markers in the task-markers/ prefix of the own validation bucket are deleted once their batch timestamp, or the end of their aggregation window, is older than this. Must exceed both --intake-max-age and --aggregation-lookback-windows times --aggregation-period, plus --grace-period")
+	batchRetention               = flag.Duration("batch-retention", 0, "If non-zero, after scheduling tasks for each aggregation ID, the objects of batches in the ingestion bucket and the own validation bucket are deleted once their batch timestamp is older than this. Must exceed both --intake-max-age and --aggregation-lookback-windows times --aggregation-period, plus --grace-period")
+	batchRetentionOverrides      = flag.String("batch-retention-overrides", "", "Comma-separated aggregation-id=duration pairs, e.g. 'kittens-seen=720h,dogs-seen=0', overriding --batch-retention for those aggregation IDs. A duration of 0 disables deletion of the aggregation ID's batches")
+	batchRetentionPeerValidation = flag.Bool("batch-retention-peer-validation", false, "If set, batches are also deleted from the peer validation bucket by --batch-retention, for deployments in which that bucket belongs to this data share processor")
+	backfillIntakeMarkers        = flag.Bool("backfill-intake-markers", false, "If set, intake tasks are not scheduled for batches which already have a validation batch in the own validation bucket; a task marker is written instead. Useful after task markers are lost, e.g. after a bucket restore")
+	allowInitialBackfill         = flag.Bool("allow-initial-backfill", false, "If set, schedule intake tasks for every ingestion batch in the intake window even if no task markers exist for the aggregation ID, as on the first run against an existing ingestion bucket")
+	initialBackfillMaxTasks      = flag.Int("initial-backfill-max-tasks", 100, "If no task markers exist for an aggregation ID, fail rather than schedule more than this many intake tasks for it, unless --allow-initial-backfill is set")
+	coalesceIntakeWindow         = flag.Duration("coalesce-intake-window", 0, "If non-zero, the intake tasks for the batches of an aggregation ID whose timestamps fall in the same window of this length, e.g. 1h, are coalesced into a single task, of at most --coalesce-intake-max-batches batches. The intake task marker of each batch is written as usual. Requires facilitators which support coalesced intake tasks")
+	coalesceIntakeMaxBatches     = flag.Int("coalesce-intake-max-batches", 100, "With --coalesce-intake-window, the max `number` of batches in a single coalesced intake task")
+	maxTasksPerRun               = flag.Int("max-tasks-per-run", 0, "If non-zero, the max number of intake tasks scheduled for each aggregation ID in a run. Batches beyond the limit, newest first, are deferred to the next run, so the limit should be set high enough that batches aren't deferred beyond --intake-max-age")
+	validateBatchHeaders         = flag.Bool("validate-batch-headers", false, "If set, download the header & packet file of each ingestion batch before scheduling an intake task for it, and skip batches whose header doesn't parse, doesn't match the batch's object names, or doesn't match the digest of the packet file, as with corrupt or truncated uploads. Skipped batches are checked again by the next run")
+	verifyBatchSignatures        = flag.Bool("verify-batch-signatures", false, "With --validate-batch-headers, also download the signature of each ingestion batch, and skip batches whose header signature can't be verified with the batch signing public keys in the ingestor's global manifest, fetched from --ingestor-manifest-base-url once per run")
+	ingestorManifestBaseURL      = flag.String("ingestor-manifest-base-url", "", "The https:// base URL of the ingestor's global manifest, from which batch signing public keys are fetched. Required with --verify-batch-signatures")
+	aggregationIDAllowlist       = flag.String("aggregation-id-allowlist", "", "If specified, a comma-separated list of glob patterns (e.g. 'kittens-*,dogs-seen'); tasks are only scheduled for the aggregation IDs discovered in the ingestor bucket which match one of them, e.g. to restrict a backfill to a single aggregation ID")
+	aggregationIDDenylist        = flag.String("aggregation-id-denylist", "", "If specified, a comma-separated list of glob patterns (e.g. 'test-*'); no tasks are scheduled for the aggregation IDs discovered in the ingestor bucket which match one of them, even if they match --aggregation-id-allowlist")
+	maxConcurrentAggregations    = flag.Int("max-concurrent-aggregations", 1, "Max number of aggregation IDs for which tasks are scheduled concurrently. Tasks for all aggregation IDs share the --max-enqueue-workers enqueue workers")
+	maxTaskRate                  = flag.Float64("max-task-rate", 0, "If non-zero, the max number of tasks per second enqueued for each aggregation ID")
+	missingIntakePolicy          = flag.String("missing-intake-policy", missingIntakeInclude, "What to do when aggregating a window in which some peer-validated batches have neither an intake task marker nor an own validation: 'include' them in the aggregation anyway, 'drop' them from it, 'defer' the aggregation to a later run, or 'force-intake': schedule intake tasks for them and defer the aggregation")
+	missingPeerValidationReports = flag.Bool("missing-peer-validation-reports", false, "If set, when aggregating a window in which some ingestion batches lack peer validations, write a JSON report listing those batches to the reports/ prefix of the own validation bucket")
+	probeOwnValidationBucket     = flag.Bool("probe-own-validation-bucket", true, "If set, at startup, write a probe object to the probes/ prefix of the own validation bucket, then immediately read it back and delete it, to check permissions and read-after-write consistency. Ignored in --dry-run mode")
+	batchListFile                = flag.String("batch-list-file", "", "If specified, rather than discovering batches and scheduling aggregations, schedule intake tasks only for the batches listed in `file`, one batch name (e.g. 'kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771') per line. Batches with intake task markers are skipped unless --ignore-markers is set")
+	ignoreMarkers                = flag.Bool("ignore-markers", false, "If set with --batch-list-file, schedule intake tasks for the listed batches even if they have intake task markers")
+	dryRunReport                 = flag.String("dry-run-report", "", "In --dry-run mode, write a JSON report of all tasks that would have been enqueued, with a deterministic hash of those tasks, to `file`")
+	diffAgainst                  = flag.String("diff-against", "", "In --dry-run mode, log the differences between the tasks that would have been enqueued and those in the report previously written to `file` by --dry-run-report")
+	trendStateRetention          = flag.Duration("trend-state-retention", 15*24*time.Hour, "How long to retain per-run statistics (batch & task counts, scheduling durations) in the state/ prefix of the own validation bucket, from which week-over-week growth metrics are computed. Must be at least two weeks for growth to be computed. If 0, no statistics are recorded")
+	runSummaryPrefix             = flag.String("run-summary-prefix", "", "If set, at the end of each run, write a JSON summary of the aggregation IDs discovered, batches found and tasks scheduled or skipped, with the trace IDs of scheduled tasks and the time taken by each phase of scheduling, to standard output and to reports/`prefix`/run-summary-${run ID}.json in the own validation bucket")
+	malformedObjectNames         = flag.String("malformed-object-names", malformedNamesFail, "What to do when listing batches finds objects whose names don't parse as batch paths: 'fail' scheduling for the aggregation ID, 'skip' the objects, counting & logging them, or 'report': skip them, and also list their names in the reports/quarantine-names/ prefix of the own validation bucket")
+	seenBatchesFalsePositive     = flag.Float64("seen-batches-false-positive-rate", 0.001, "The false positive rate of the filter of ingestion batches found by each run, stored in the state/ prefix of the own validation bucket, against which the next run counts newly discovered & relisted ingestion batches. Must be less than 1. If 0, batches are not tracked")
+	incompleteBatchAlertAge      = flag.Duration("incomplete-batch-alert-age", 0, "If non-zero, ingestion batches found incomplete (e.g. lacking a signature) are tracked in the state/ prefix of the own validation bucket, even after they age out of --intake-max-age, and those seen incomplete for longer than this are counted by the workflow_manager_dead_ingestion_batches metric and logged")
+	incompleteBatchRetention     = flag.Duration("incomplete-batch-retention", 7*24*time.Hour, "With --incomplete-batch-alert-age, how long ingestion batches are tracked after they were last seen incomplete, once they are outside --intake-max-age")
+	incompleteBatchReport        = flag.Bool("incomplete-batch-report", false, "With --incomplete-batch-alert-age, also list the ingestion batches seen incomplete for longer than it, with the names of the objects found for each, in reports/dead-batches/${aggregation ID}.json in the own validation bucket")
+	cacheListings                = flag.Bool("cache-listings", false, "If set, for each aggregation ID, the batches & intake task markers in the ingestor & own validation buckets are listed once per run over both the intake window and the aggregation window, and the listings of each window are served from memory, rather than listing each window separately. Saves API calls when the windows overlap or are close together, as with the default --intake-max-age & --grace-period")
+	watchMode                    = flag.Bool("watch", false, "If set, run continuously until SIGTERM: schedule intake tasks as soon as ingestion batches are complete, as revealed by notifications configured by the --batch-notifications-* flags, and scan buckets to schedule all other tasks every --reconciliation-interval")
+	reconciliationInterval       = flag.Duration("reconciliation-interval", 10*time.Minute, "With --watch, how often buckets are scanned to schedule aggregation tasks, and any intake tasks missed by notifications")
+	httpListen                   = flag.String("http-listen", "", "If specified, the `address` (e.g. ':8080') on which /healthz, /readyz and /metrics are served until workflow-manager exits. /readyz fails until the first scan of the buckets completes; with --watch, /healthz fails if no reconciliation has completed within three times --reconciliation-interval")
+	cpuProfile                   = flag.String("cpuprofile", "", "Write a CPU profile to `file`")
+	memProfile                   = flag.String("memprofile", "", "Write a memory profile to `file`")
 
 	// Aggregation window flags, which determine which aggregation window will
 	// be aggregated (if not already aggregated). Normally, aggregation occurs
 	// for the most recent window that ended at least grace-period in the past.
 	// If aggregation-override-timestamp is specified, the aggregation window
 	// containing the override point will be aggregated instead of the most
-	// recent aggregation window.
+	// recent aggregation window. Likewise, if aggregation-window-offset is
+	// specified, the window that many windows before the current one will be
+	// aggregated.
 	aggregationPeriod            = flag.Duration("aggregation-period", 3*time.Hour, "How much time each aggregation covers")
 	gracePeriod                  = flag.Duration("grace-period", time.Hour, "Wait this amount of time after the end of an aggregation timeslice to run the aggregation. Relevant only if --aggregation-override-point is unset")
 	aggregationOverrideTimestamp = flag.String("aggregation-override-timestamp", "", "If specified, a point inside the aggregation window to be aggregated, in the format YYYYMMDDHHmm")
+	aggregationWindowOffset      = flag.Int("aggregation-window-offset", 0, "If specified, the aggregation window to be aggregated, relative to the window containing the current time, e.g. -1 for the most recently ended window or -2 for the window before it. Must be negative. Cannot be combined with --aggregation-override-timestamp")
+	maxBatchesPerAggregation     = flag.Int("max-batches-per-aggregation-task", 0, "If non-zero, aggregation windows with more than this `number` of batches to aggregate are split into sub-windows, each with its own aggregation task of at most this many batches (more only if more batches share a timestamp), keeping task messages under queue message size limits. The split depends only on the batches, so both data share processors must use the same value. Once a task is scheduled for any sub-window, the window is not split or aggregated again except by a reaggregation trigger")
+	aggregationLookbackWindows   = flag.Int("aggregation-lookback-windows", 1, "The `number` of aggregation windows, ending with the standard aggregation window, to evaluate on each run. Windows before the standard window are skipped if their aggregation task marker exists, so values above 1 aggregate windows missed while workflow-manager wasn't running. Cannot be combined with --aggregation-override-timestamp or --aggregation-window-offset")
 
 	// Arguments for gcp-pubsub task queue
 	gcpPubSubCreatePubSubTopics = flag.Bool("gcp-pubsub-create-topics", false, "Whether to create the GCP PubSub topics used for intake and aggregation tasks.")
 	gcpProjectID                = flag.String("gcp-project-id", "", "Name of the GCP project ID being used for PubSub.")
 
 	// Arguments for aws-sns task queue
-	awsSNSRegion   = flag.String("aws-sns-region", "", "AWS region in which to publish to SNS topic")
-	awsSNSIdentity = flag.String("aws-sns-identity", "", "AWS IAM ARN of the role to be assumed to publish to SNS topics")
+	awsSNSRegion       = flag.String("aws-sns-region", "", "AWS region in which to publish to SNS topic")
+	awsSNSIdentity     = flag.String("aws-sns-identity", "", "AWS IAM ARN of the role to be assumed to publish to SNS topics")
+	awsSNSCreateTopics = flag.Bool("aws-sns-create-topics", false, "Whether to create the AWS SNS topics used for intake and aggregation tasks, if they do not already exist. Existing topics are left unmodified")
+	awsSNSTopicTags    = flag.String("aws-sns-topic-tags", "", "With --aws-sns-create-topics, comma-separated `key=value` tags applied to created topics")
+	awsSNSKMSKeyID     = flag.String("aws-sns-kms-key-id", "", "With --aws-sns-create-topics, the ID or alias of the AWS KMS `key` with which created topics are encrypted. If unset, created topics are not encrypted")
+
+	// Arguments for task events
+	taskEventsTarget = flag.String("task-events-target", "", "If set, a CloudEvents 1.0 event is published for every intake & aggregation task scheduled or skipped, giving its aggregation ID, batch count, interval and trace ID, to this `target`: an http:// or https:// URL, to which events are POSTed; 'gcp-pubsub:projects/${project}/topics/${topic}'; or 'aws-sns:${topic ARN}', published to as --aws-sns-identity. Failures to publish events are logged and counted, but do not fail the run")
+	taskEventsSource = flag.String("task-events-source", "workflow-manager", "The CloudEvents source attribute of events published to --task-events-target")
+
+	// Arguments for azure-servicebus task queue
+	azureServiceBusNamespace            = flag.String("azure-servicebus-namespace", "", "Fully-qualified Azure Service Bus `namespace` containing the queues or topics named by --intake-tasks-topic and --aggregate-tasks-topic, e.g. 'prio.servicebus.windows.net'. If unset, the namespace of the connection string's endpoint is used")
+	azureServiceBusConnectionStringFile = flag.String("azure-servicebus-connection-string-file", "", "`Path` to a file, e.g. a mounted Kubernetes secret, containing an Azure Service Bus connection string whose shared access policy grants Send rights on the queues or topics")
+
+	// Arguments for http-webhook task queue
+	httpWebhookURL     = flag.String("http-webhook-url", "", "HTTPS `URL` beneath which tasks are POSTed as JSON, at the path named by --intake-tasks-topic or --aggregate-tasks-topic, e.g. 'https://facilitator.example.com/tasks' to POST intake tasks to https://facilitator.example.com/tasks/intake-tasks. Failed requests are retried as set by --enqueue-max-attempts")
+	httpWebhookKeyFile = flag.String("http-webhook-key-file", "", "`Path` to a file, e.g. a mounted Kubernetes secret, containing the key with which each request to --http-webhook-url is authenticated by an HMAC-SHA256 in its X-Prio-Signature header")
+
+	// Arguments for --watch batch notifications
+	batchNotificationsKind         = flag.String("batch-notifications-kind", "", "With --watch, how notifications of objects written to --ingestor-input are received: 'gcp-pubsub', for GCS Pub/Sub notifications, or 'aws-sqs', for S3 event notifications delivered to SQS directly, via SNS, or via EventBridge")
+	batchNotificationsSubscription = flag.String("batch-notifications-subscription", "", "With --batch-notifications-kind=gcp-pubsub, the `name` of the Pub/Sub subscription receiving notifications, e.g. 'projects/prio/subscriptions/ingestion-notifications'")
+	batchNotificationsSQSQueueURL  = flag.String("batch-notifications-sqs-queue-url", "", "With --batch-notifications-kind=aws-sqs, the `URL` of the SQS queue receiving notifications")
+	batchNotificationsIdentity     = flag.String("batch-notifications-identity", "", "With --batch-notifications-kind=aws-sqs, AWS IAM ARN of the role to be assumed to receive from the SQS queue")
+
+	taskSigningKeyDir = flag.String("task-signing-key-dir", "", "Directory into which the Kubernetes secret holding the task signing key written by key-rotator is mounted. If set, tasks are signed with the key's primary version; otherwise, tasks are not signed")
 
 	// Define flags and arguments for other task queue implementations here.
 	// Argument names should be prefixed with the corresponding value of
@@ -79,7 +183,8 @@ var (
 
 // Metrics gauges. We must use gauges because workflow-manager runs as a
 // cronjob, and so if we used counters, they would be reset to zero with each
-// run.
+// run. Task counts may alternatively be exported as per-run counters; see
+// taskCountVec.
 var (
 	ingestionBatchesFound = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -126,35 +231,101 @@ var (
 		[]string{"aggregation_id"},
 	)
 
-	intakesStarted = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "workflow_manager_intake_tasks_scheduled",
-			Help: "The number of intake-batch tasks successfully scheduled",
+	intakesStarted = newTaskCountVec(
+		"workflow_manager_intake_tasks_scheduled",
+		"The number of intake-batch tasks successfully scheduled",
+	)
+	intakesSkippedDueToMarker = newTaskCountVec(
+		"workflow_manager_intake_tasks_skipped_due_to_marker",
+		"The number of intake-batch tasks not scheduled because a task marker was found",
+	)
+	intakesSkippedDueToOwnValidation = newTaskCountVec(
+		"workflow_manager_intake_tasks_skipped_due_to_own_validation",
+		"The number of intake-batch tasks not scheduled (and task markers backfilled) because an own validation batch was found",
+	)
+
+	intakesDeferred = newTaskCountVec(
+		"workflow_manager_intake_tasks_deferred",
+		"The number of intake-batch tasks not scheduled, and deferred to the next run, because --max-tasks-per-run was reached",
+	)
+	coalescedIntakesStarted = newTaskCountVec(
+		"workflow_manager_coalesced_intake_tasks_scheduled",
+		"The number of intake tasks coalesced from several batches by --coalesce-intake-window successfully scheduled. Their batches are also counted by workflow_manager_intake_tasks_scheduled",
+	)
+	intakesDeadLettered = newTaskCountVec(
+		"workflow_manager_intake_tasks_dead_lettered",
+		"The number of intake-batch tasks written to the dead-letter prefix because they could not be enqueued",
+	)
+
+	// Scheduling latency histograms, used to define & monitor scheduling SLOs.
+	// Like the gauges, these only reflect the tasks scheduled by the most
+	// recent run.
+	intakeSchedulingLatency = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "workflow_manager_intake_scheduling_latency_seconds",
+			Help:    "Time from an ingestion batch's timestamp to successful scheduling of its intake-batch task",
+			Buckets: prometheus.ExponentialBuckets(60, 2, 10), // 1 minute to ~8.5 hours
 		},
 		[]string{"aggregation_id"},
 	)
-	intakesSkippedDueToMarker = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "workflow_manager_intake_tasks_skipped_due_to_marker",
-			Help: "The number of intake-batch tasks not scheduled because a task marker was found",
+	aggregationSchedulingLatency = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "workflow_manager_aggregation_scheduling_latency_seconds",
+			Help:    "Time from the end of an aggregation window to successful scheduling of its aggregate task",
+			Buckets: prometheus.ExponentialBuckets(300, 2, 10), // 5 minutes to ~42 hours
 		},
 		[]string{"aggregation_id"},
 	)
 
-	aggregationsStarted = promauto.NewGaugeVec(
+	aggregationsStarted = newTaskCountVec(
+		"workflow_manager_aggregation_tasks_scheduled",
+		"The number of aggregate tasks successfully scheduled",
+	)
+	aggregationsSkippedDueToMarker = newTaskCountVec(
+		"workflow_manager_aggregation_tasks_skipped_due_to_marker",
+		"The number of aggregate tasks not scheduled because a task marker was found",
+	)
+	aggregationsDeadLettered = newTaskCountVec(
+		"workflow_manager_aggregation_tasks_dead_lettered",
+		"The number of aggregate tasks written to the dead-letter prefix because they could not be enqueued",
+	)
+
+	bucketProbeLatency = promauto.NewGauge(
 		prometheus.GaugeOpts{
-			Name: "workflow_manager_aggregation_tasks_scheduled",
-			Help: "The number of aggregate tasks successfully scheduled",
+			Name: "workflow_manager_bucket_probe_latency_seconds",
+			Help: "Time taken to write a probe object to the own validation bucket and read it back",
+		},
+	)
+
+	chosenMaxEnqueueWorkers = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "workflow_manager_max_enqueue_workers",
+			Help: "The max number of workers used to enqueue tasks, either from --max-enqueue-workers or chosen based on cgroup limits",
+		},
+	)
+
+	chosenGOMAXPROCS = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "workflow_manager_gomaxprocs",
+			Help: "The value of GOMAXPROCS, either from the environment or chosen based on the cgroup CPU limit",
+		},
+	)
+
+	chosenMemoryLimit = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "workflow_manager_memory_limit_bytes",
+			Help: "The Go runtime's soft memory limit, either from the environment or chosen based on the cgroup memory limit",
 		},
-		[]string{"aggregation_id"},
 	)
-	aggregationsSkippedDueToMarker = promauto.NewGaugeVec(
+
+	aggregationBatchesMissingIntake = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: "workflow_manager_aggregation_tasks_skipped_due_to_marker",
-			Help: "The number of aggregate tasks not scheduled because a task marker was found",
+			Name: "workflow_manager_aggregation_batches_missing_intake",
+			Help: "The number of peer-validated batches in the current aggregation interval with neither an intake task marker nor an own validation",
 		},
 		[]string{"aggregation_id"},
 	)
+
 	numberOfBatchesInAggregation = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "workflow_manager_number_of_batches_in_aggregation",
@@ -162,6 +333,29 @@ var (
 		},
 		[]string{"aggregation_id"},
 	)
+
+	taskMarkersDeleted = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "workflow_manager_task_markers_deleted",
+			Help: "The number of task markers deleted from the own validation bucket for being older than --task-marker-retention",
+		},
+		[]string{"aggregation_id"},
+	)
+
+	batchObjectsDeleted = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "workflow_manager_batch_objects_deleted",
+			Help: "The number of batch objects deleted for being older than --batch-retention, or its override for the aggregation ID",
+		},
+		[]string{"aggregation_id", "bucket"},
+	)
+	batchBytesDeleted = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "workflow_manager_batch_bytes_deleted",
+			Help: "The total size of the batch objects deleted for being older than --batch-retention, or its override for the aggregation ID",
+		},
+		[]string{"aggregation_id", "bucket"},
+	)
 )
 
 func prepareLogger() {
@@ -190,10 +384,15 @@ func main() {
 		Msgf("starting %s version %s. Args: %s", os.Args[0], BuildInfo, os.Args[1:])
 	flag.Parse()
 
-	var pusher *push.Pusher
+	runID := strconv.FormatInt(startTime.Unix(), 10)
+	if *metricsMode == "counters" {
+		metricsRunID = runID
+	}
+
+	var pushers []*push.Pusher
 	// Closure that sends metrics to prometheus-pushgateway, if configured.
 	var pushMetrics = func() {
-		if pusher != nil {
+		for _, pusher := range pushers {
 			err := pusher.Push()
 			if err != nil {
 				log.Err(err).Msg("error occurred with pushing to prometheus")
@@ -201,10 +400,31 @@ func main() {
 		}
 	}
 	if *pushGateway != "" {
-		pusher = push.New(*pushGateway, "workflow-manager").
+		pushers = append(pushers, push.New(*pushGateway, "workflow-manager").
 			Gatherer(prometheus.DefaultGatherer).
 			Grouping("locality", *k8sNS).
-			Grouping("ingestor", *ingestorLabel)
+			Grouping("ingestor", *ingestorLabel))
+		if metricsRunID != "" {
+			// Each run's counters are pushed to their own group, which then
+			// replaces the groups of earlier runs.
+			runPusher := push.New(*pushGateway, "workflow-manager").
+				Gatherer(runCountersRegistry).
+				Grouping("locality", *k8sNS).
+				Grouping("ingestor", *ingestorLabel).
+				Grouping("run_id", metricsRunID)
+			pushOthers := pushMetrics
+			pushMetrics = func() {
+				pushOthers()
+				if err := runPusher.Push(); err != nil {
+					log.Err(err).Msg("error occurred with pushing to prometheus")
+					return
+				}
+				grouping := map[string]string{"locality": *k8sNS, "ingestor": *ingestorLabel}
+				if err := deleteEarlierRunGroups(*pushGateway, "workflow-manager", grouping, metricsRunID); err != nil {
+					log.Err(err).Msg("error occurred with deleting earlier runs' metrics from prometheus")
+				}
+			}
+		}
 		defer pushMetrics()
 	}
 
@@ -216,6 +436,40 @@ func main() {
 		log.Fatal().Msgf(format, args...)
 	}
 
+	if *metricsMode != "gauges" && *metricsMode != "counters" {
+		fail("--metrics-mode must be one of 'gauges' or 'counters'")
+	}
+
+	// health is nil unless --http-listen is specified, in which case probes
+	// and metrics are served for as long as workflow-manager runs.
+	var health *schedulerHealth
+	if *httpListen != "" {
+		// Reconciliations are expected every --reconciliation-interval, but
+		// may take a while on a large ingestion bucket.
+		var healthMaxAge time.Duration
+		if *watchMode {
+			healthMaxAge = 3 * *reconciliationInterval
+		}
+		health = newSchedulerHealth(healthMaxAge)
+		server := &http.Server{
+			Addr:    *httpListen,
+			Handler: healthHandler(health, prometheus.Gatherers{prometheus.DefaultGatherer, runCountersRegistry}),
+		}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fail("couldn't serve HTTP on %q: %s", *httpListen, err)
+			}
+		}()
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Err(err).Msg("error shutting down HTTP server")
+			}
+		}()
+		log.Info().Str("address", *httpListen).Msg("serving /healthz, /readyz and /metrics")
+	}
+
 	if *cpuProfile != "" {
 		f, err := os.Create(*cpuProfile)
 		if err != nil {
@@ -232,26 +486,245 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	ownValidationBucket, err := storage.NewBucket(*ownValidationInput, *ownValidationIdentity, *dryRun)
+	if *maxEnqueueWorkers < 0 {
+		fail("--max-enqueue-workers must be non-negative")
+		return
+	}
+	limits, err := cgroup.Read()
+	if err != nil {
+		// Not fatal: proceed as though the process were unlimited.
+		log.Err(err).Msgf("couldn't read cgroup limits: %s", err)
+	}
+	enqueueWorkers := adaptToLimits(limits, *maxEnqueueWorkers)
+
+	// Determine whether we are first from the portal server global manifest
+	// if possible, since a misconfigured --is-first makes every peer
+	// validation be read from, and written to, the wrong place.
+	first := *isFirst
+	if *portalManifestBaseURL != "" {
+		if *sumPartBucket == "" {
+			fail("--sum-part-bucket is required with --portal-manifest-base-url")
+			return
+		}
+		globalManifest, err := manifest.FetchPortalServerGlobalManifest(
+			&http.Client{Timeout: 30 * time.Second}, *portalManifestBaseURL)
+		if err != nil {
+			fail("--portal-manifest-base-url: %s", err)
+			return
+		}
+		if first, err = globalManifest.IsFirst(*sumPartBucket); err != nil {
+			fail("--sum-part-bucket: %s", err)
+			return
+		}
+		isFirstSet := false
+		flag.Visit(func(f *flag.Flag) { isFirstSet = isFirstSet || f.Name == "is-first" })
+		if isFirstSet && first != *isFirst {
+			fail("--is-first=%t, but the portal server global manifest says this set of servers is first=%t", *isFirst, first)
+			return
+		}
+		log.Info().Bool("is_first", first).Msg("determined first-ness from portal server global manifest")
+	} else if *sumPartBucket != "" {
+		fail("--sum-part-bucket requires --portal-manifest-base-url")
+		return
+	}
+
+	if *verifyBatchSignatures {
+		if !*validateBatchHeaders {
+			fail("--verify-batch-signatures requires --validate-batch-headers")
+			return
+		}
+		if *ingestorManifestBaseURL == "" {
+			fail("--ingestor-manifest-base-url is required with --verify-batch-signatures")
+			return
+		}
+		if !strings.HasPrefix(*ingestorManifestBaseURL, "https://") {
+			fail("--ingestor-manifest-base-url must be an https:// URL")
+			return
+		}
+	} else if *ingestorManifestBaseURL != "" {
+		fail("--ingestor-manifest-base-url requires --verify-batch-signatures")
+		return
+	}
+
+	s3Options := storage.S3Options{Endpoint: *s3Endpoint, ForcePathStyle: *s3ForcePathStyle}
+	if (*s3AccessKeyID == "") != (*s3SecretAccessKeyFile == "") {
+		fail("--s3-access-key-id and --s3-secret-access-key-file must be specified together")
+		return
+	}
+	if *s3SecretAccessKeyFile != "" {
+		secretAccessKey, err := os.ReadFile(*s3SecretAccessKeyFile)
+		if err != nil {
+			fail("couldn't read --s3-secret-access-key-file: %s", err)
+			return
+		}
+		s3Options.AccessKeyID = *s3AccessKeyID
+		s3Options.SecretAccessKey = strings.TrimSpace(string(secretAccessKey))
+	}
+	// Static credentials given by flags apply only to buckets without an
+	// identity.
+	s3OptionsFor := func(identity string) storage.S3Options {
+		if identity == "" {
+			return s3Options
+		}
+		return storage.S3Options{Endpoint: s3Options.Endpoint, ForcePathStyle: s3Options.ForcePathStyle}
+	}
+
+	ownValidationBucket, err := storage.NewBucket(*ownValidationInput, *ownValidationIdentity, *ownValidationRequesterPays, s3OptionsFor(*ownValidationIdentity), *dryRun)
 	if err != nil {
 		fail("--own-validation-input: %s", err)
 		return
 	}
-	peerValidationBucket, err := storage.NewBucket(*peerValidationInput, *peerValidationIdentity, *dryRun)
+	peerValidationBucket, err := storage.NewBucket(*peerValidationInput, *peerValidationIdentity, *peerValidationRequesterPays, s3OptionsFor(*peerValidationIdentity), *dryRun)
 	if err != nil {
 		fail("--peer-validation-input: %s", err)
 		return
 	}
-	intakeBucket, err := storage.NewBucket(*ingestorInput, *ingestorIdentity, *dryRun)
+	intakeBucket, err := storage.NewBucket(*ingestorInput, *ingestorIdentity, *ingestorRequesterPays, s3OptionsFor(*ingestorIdentity), *dryRun)
 	if err != nil {
 		fail("--ingestor-input: %s", err)
 		return
 	}
+	// The buckets are instrumented innermost, so that every attempt at an
+	// operation is recorded, but operations on task markers kept in a
+	// --task-marker-store are not.
+	ownValidationBucket = storage.NewInstrumentedBucket(ownValidationBucket, ownValidationBucketLabel)
+	peerValidationBucket = storage.NewInstrumentedBucket(peerValidationBucket, peerValidationBucketLabel)
+	intakeBucket = storage.NewInstrumentedBucket(intakeBucket, ingestorBucketLabel)
+
+	if *storageMaxAttempts < 1 {
+		fail("--storage-max-attempts must be at least 1")
+		return
+	}
+	retrying := func(bucket storage.Bucket, label string) storage.Bucket {
+		return storage.NewRetryingBucket(bucket, label, *storageMaxAttempts,
+			*storageInitialBackoff, *storageMaxBackoff, storage.IsTransient)
+	}
+	// Deleting markers still within the intake or aggregation windows would
+	// cause their tasks to be scheduled again.
+	if *taskMarkerRetention < 0 {
+		fail("--task-marker-retention must be non-negative")
+		return
+	}
+	if *aggregationLookbackWindows < 1 {
+		fail("--aggregation-lookback-windows must be at least 1")
+		return
+	}
+	if *taskMarkerRetention > 0 && (*taskMarkerRetention <= *maxAge ||
+		*taskMarkerRetention <= time.Duration(*aggregationLookbackWindows)*(*aggregationPeriod)+*gracePeriod) {
+		fail("--task-marker-retention must exceed both --intake-max-age and --aggregation-lookback-windows times --aggregation-period, plus --grace-period")
+		return
+	}
+	// Likewise, deleting batches still within either window would fail the
+	// tasks which read them.
+	aggregationFilter, err := parseAggregationIDFilter(*aggregationIDAllowlist, *aggregationIDDenylist)
+	if err != nil {
+		fail("%s", err)
+		return
+	}
+	if aggregationFilter.isSet() && *batchListFile != "" {
+		fail("--aggregation-id-allowlist and --aggregation-id-denylist cannot be used with --batch-list-file")
+		return
+	}
+	batchRetentionByAggregationID, err := parseBatchRetentionOverrides(*batchRetentionOverrides)
+	if err != nil {
+		fail("--batch-retention-overrides: %v", err)
+		return
+	}
+	if *batchRetention < 0 {
+		fail("--batch-retention must be non-negative")
+		return
+	}
+	batchRetentions := []time.Duration{*batchRetention}
+	for _, retention := range batchRetentionByAggregationID {
+		batchRetentions = append(batchRetentions, retention)
+	}
+	for _, retention := range batchRetentions {
+		if retention > 0 && (retention <= *maxAge ||
+			retention <= time.Duration(*aggregationLookbackWindows)*(*aggregationPeriod)+*gracePeriod) {
+			fail("--batch-retention and --batch-retention-overrides must exceed both --intake-max-age and --aggregation-lookback-windows times --aggregation-period, plus --grace-period")
+			return
+		}
+	}
+
+	if *taskMarkerStore != "" {
+		markers, err := storage.NewTaskMarkerStore(*taskMarkerStore, *taskMarkerStoreIdentity, *taskMarkerTTL, *dryRun)
+		if err != nil {
+			fail("--task-marker-store: %s", err)
+			return
+		}
+		ownValidationBucket = storage.WithTaskMarkerStore(ownValidationBucket, markers)
+	} else if *taskMarkerStoreIdentity != "" || *taskMarkerTTL != 0 {
+		fail("--task-marker-store-identity and --task-marker-ttl require --task-marker-store")
+		return
+	}
+	ownValidationBucket = retrying(ownValidationBucket, ownValidationBucketLabel)
+	peerValidationBucket = retrying(peerValidationBucket, peerValidationBucketLabel)
+	intakeBucket = retrying(intakeBucket, ingestorBucketLabel)
+
+	if *inventoryLiveListingPeriod < 0 {
+		fail("--inventory-live-listing-period must be non-negative")
+		return
+	}
+	for _, inventory := range []struct {
+		bucket           *storage.Bucket
+		label, flag, url string
+		identity         string
+	}{
+		{&intakeBucket, ingestorBucketLabel, "--ingestor-inventory", *ingestorInventory, *ingestorIdentity},
+		{&ownValidationBucket, ownValidationBucketLabel, "--own-validation-inventory", *ownValidationInventory, *ownValidationIdentity},
+		{&peerValidationBucket, peerValidationBucketLabel, "--peer-validation-inventory", *peerValidationInventory, *peerValidationIdentity},
+	} {
+		if inventory.url == "" {
+			continue
+		}
+		bucket, err := storage.NewInventoryBucket(*inventory.bucket, inventory.label, inventory.url, inventory.identity, *inventoryLiveListingPeriod)
+		if err != nil {
+			fail("%s: %s", inventory.flag, err)
+			return
+		}
+		*inventory.bucket = bucket
+	}
+	batchRetentionBuckets := []retentionBucket{
+		{ingestorBucketLabel, intakeBucket},
+		{ownValidationBucketLabel, ownValidationBucket},
+	}
+	if *batchRetentionPeerValidation {
+		batchRetentionBuckets = append(batchRetentionBuckets, retentionBucket{peerValidationBucketLabel, peerValidationBucket})
+	}
+
+	if *probeOwnValidationBucket && !*dryRun {
+		latency, err := probeBucket(ownValidationBucket, wftime.DefaultClock())
+		if err != nil {
+			fail("--own-validation-input: probe failed: %s", err)
+			return
+		}
+		bucketProbeLatency.Set(latency.Seconds())
+		log.Info().Dur("latency", latency).Msg("own validation bucket probe succeeded")
+	}
 
 	var aggregationInterval wftime.AggregationIntervalFunc
-	if *aggregationOverrideTimestamp == "" {
+	switch {
+	case *aggregationWindowOffset > 0:
+		fail("--aggregation-window-offset must be negative: the current window has not yet ended")
+		return
+	case *aggregationWindowOffset < 0 && *aggregationOverrideTimestamp != "":
+		fail("--aggregation-window-offset and --aggregation-override-timestamp cannot be combined")
+		return
+	case *aggregationLookbackWindows > 1 && (*aggregationWindowOffset < 0 || *aggregationOverrideTimestamp != ""):
+		fail("--aggregation-lookback-windows cannot be combined with --aggregation-window-offset or --aggregation-override-timestamp")
+		return
+	case *aggregationWindowOffset < 0:
+		// Resolve the window once, so that every aggregation ID uses the same
+		// window even if this run crosses a window boundary.
+		window := wftime.OffsetAggregationWindow(*aggregationWindowOffset, *aggregationPeriod)(startTime)
+		aggregationInterval = wftime.OverrideAggregationWindow(window.Begin, *aggregationPeriod)
+		log.Info().
+			Int("offset", *aggregationWindowOffset).
+			Str("window", window.String()).
+			Msg("aggregating window selected by --aggregation-window-offset")
+	case *aggregationOverrideTimestamp == "":
 		aggregationInterval = wftime.StandardAggregationWindow(*aggregationPeriod, *gracePeriod)
-	} else {
+	default:
 		const timeLayout = "200601021504" // YYYYMMDDHHmm, e.g. 202110041600
 		when, err := time.Parse(timeLayout, *aggregationOverrideTimestamp)
 		if err != nil {
@@ -266,6 +739,14 @@ func main() {
 		return
 	}
 
+	var signer *task.Signer
+	if *taskSigningKeyDir != "" {
+		if signer, err = task.NewSignerFromDirectory(*taskSigningKeyDir); err != nil {
+			fail("%s", err)
+			return
+		}
+	}
+
 	var intakeTaskEnqueuer task.Enqueuer
 	var aggregationTaskEnqueuer task.Enqueuer
 
@@ -297,7 +778,8 @@ func main() {
 			*gcpProjectID,
 			*intakeTasksTopic,
 			*dryRun,
-			int32(*maxEnqueueWorkers),
+			int32(enqueueWorkers),
+			signer,
 		)
 		if err != nil {
 			fail("%s", err)
@@ -308,7 +790,8 @@ func main() {
 			*gcpProjectID,
 			*aggregateTasksTopic,
 			*dryRun,
-			int32(*maxEnqueueWorkers),
+			int32(enqueueWorkers),
+			signer,
 		)
 		if err != nil {
 			fail("%s", err)
@@ -320,11 +803,35 @@ func main() {
 			return
 		}
 
+		if *awsSNSCreateTopics {
+			tags, err := parseTags(*awsSNSTopicTags)
+			if err != nil {
+				fail("--aws-sns-topic-tags: %s", err)
+				return
+			}
+			for _, topic := range []string{*intakeTasksTopic, *aggregateTasksTopic} {
+				if err := task.CreateSNSTopic(
+					*awsSNSRegion,
+					*awsSNSIdentity,
+					topic,
+					tags,
+					*awsSNSKMSKeyID,
+				); err != nil {
+					fail("creating SNS topic: %s", err)
+					return
+				}
+			}
+		} else if *awsSNSTopicTags != "" || *awsSNSKMSKeyID != "" {
+			fail("--aws-sns-topic-tags and --aws-sns-kms-key-id require --aws-sns-create-topics")
+			return
+		}
+
 		intakeTaskEnqueuer, err = task.NewAWSSNSEnqueuer(
 			*awsSNSRegion,
 			*awsSNSIdentity,
 			*intakeTasksTopic,
 			*dryRun,
+			signer,
 		)
 		if err != nil {
 			fail("%s", err)
@@ -336,6 +843,75 @@ func main() {
 			*awsSNSIdentity,
 			*aggregateTasksTopic,
 			*dryRun,
+			signer,
+		)
+		if err != nil {
+			fail("%s", err)
+			return
+		}
+	case "azure-servicebus":
+		if *azureServiceBusConnectionStringFile == "" {
+			fail("--azure-servicebus-connection-string-file is required for task-queue-kind=azure-servicebus")
+			return
+		}
+		credentials, err := leazure.ReadServiceBusConnectionString(*azureServiceBusConnectionStringFile)
+		if err != nil {
+			fail("%s", err)
+			return
+		}
+
+		intakeTaskEnqueuer, err = task.NewAzureServiceBusEnqueuer(
+			*azureServiceBusNamespace,
+			credentials,
+			*intakeTasksTopic,
+			*dryRun,
+			signer,
+		)
+		if err != nil {
+			fail("%s", err)
+			return
+		}
+
+		aggregationTaskEnqueuer, err = task.NewAzureServiceBusEnqueuer(
+			*azureServiceBusNamespace,
+			credentials,
+			*aggregateTasksTopic,
+			*dryRun,
+			signer,
+		)
+		if err != nil {
+			fail("%s", err)
+			return
+		}
+	case "http-webhook":
+		if *httpWebhookURL == "" || *httpWebhookKeyFile == "" {
+			fail("--http-webhook-url and --http-webhook-key-file are required for task-queue-kind=http-webhook")
+			return
+		}
+		key, err := task.ReadHTTPWebhookKey(*httpWebhookKeyFile)
+		if err != nil {
+			fail("%s", err)
+			return
+		}
+
+		intakeTaskEnqueuer, err = task.NewHTTPWebhookEnqueuer(
+			*httpWebhookURL,
+			*intakeTasksTopic,
+			key,
+			*dryRun,
+			signer,
+		)
+		if err != nil {
+			fail("%s", err)
+			return
+		}
+
+		aggregationTaskEnqueuer, err = task.NewHTTPWebhookEnqueuer(
+			*httpWebhookURL,
+			*aggregateTasksTopic,
+			key,
+			*dryRun,
+			signer,
 		)
 		if err != nil {
 			fail("%s", err)
@@ -348,101 +924,844 @@ func main() {
 		return
 	}
 
-	aggregationIDs, err := intakeBucket.ListAggregationIDs()
-	if err != nil {
-		fail("unable to discover aggregation IDs from ingestion bucket: %q", err)
-		return
-	}
-
-	for _, aggregationID := range aggregationIDs {
-		err = scheduleTasks(scheduleTasksConfig{
-			aggregationID:           aggregationID,
-			isFirst:                 *isFirst,
-			clock:                   wftime.DefaultClock(),
-			intakeBucket:            intakeBucket,
-			ownValidationBucket:     ownValidationBucket,
-			peerValidationBucket:    peerValidationBucket,
-			intakeTaskEnqueuer:      intakeTaskEnqueuer,
-			aggregationTaskEnqueuer: aggregationTaskEnqueuer,
-			maxAge:                  *maxAge,
-			aggregationInterval:     aggregationInterval,
-		})
+	if *enqueueMaxAttempts < 1 {
+		fail("--enqueue-max-attempts must be at least 1")
+		return
+	}
+	intakeTaskEnqueuer = task.NewRetryingEnqueuer(
+		intakeTaskEnqueuer, *enqueueMaxAttempts, *enqueueInitialBackoff, *enqueueMaxBackoff)
+	aggregationTaskEnqueuer = task.NewRetryingEnqueuer(
+		aggregationTaskEnqueuer, *enqueueMaxAttempts, *enqueueInitialBackoff, *enqueueMaxBackoff)
+
+	// In dry-run mode, record the tasks that would have been enqueued so
+	// they can be reported once scheduling completes.
+	var dryRunRecorder *task.DryRunRecorder
+	if *dryRun {
+		dryRunRecorder = task.NewDryRunRecorder()
+		intakeTaskEnqueuer = dryRunRecorder.Wrap("intake", intakeTaskEnqueuer)
+		aggregationTaskEnqueuer = dryRunRecorder.Wrap("aggregate", aggregationTaskEnqueuer)
+	} else if *dryRunReport != "" || *diffAgainst != "" {
+		fail("--dry-run-report and --diff-against require --dry-run")
+		return
+	}
 
+	var taskEvents *taskevent.Publisher
+	if *taskEventsTarget != "" {
+		if *taskEventsSource == "" {
+			fail("--task-events-source must not be empty")
+			return
+		}
+		taskEvents, err = taskevent.NewPublisher(*taskEventsTarget, *taskEventsSource, *awsSNSIdentity, *dryRun, int32(enqueueWorkers))
 		if err != nil {
-			log.Err(err).Str("aggregation ID", aggregationID).Msgf("Failed to schedule aggregation tasks: %s", err)
-			recordFailureMetric()
+			fail("--task-events-target: %s", err)
 			return
 		}
 	}
 
-	// Create and register these gauges only upon success, to avoid
-	// clobbering them in case of failure.
-	var workflowManagerLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "workflow_manager_last_success_seconds",
-		Help: "Time of last successful run of workflow-manager in seconds since UNIX epoch",
-	})
-	var workflowManagerRuntime = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "workflow_manager_runtime_seconds",
-		Help: "How long successful workflow-manager runs take",
-	})
+	if *ignoreMarkers && *batchListFile == "" {
+		fail("--ignore-markers requires --batch-list-file")
+		return
+	}
 
-	workflowManagerLastSuccess.SetToCurrentTime()
+	if *maxTasksPerRun < 0 || *maxTaskRate < 0 {
+		fail("--max-tasks-per-run and --max-task-rate must be non-negative")
+		return
+	}
 
-	endTime := time.Now()
-	workflowManagerRuntime.Set(endTime.Sub(startTime).Seconds())
+	if *coalesceIntakeWindow < 0 || *coalesceIntakeMaxBatches < 1 {
+		fail("--coalesce-intake-window must be non-negative and --coalesce-intake-max-batches must be positive")
+		return
+	}
 
-	if *memProfile != "" {
-		f, err := os.Create(*memProfile)
-		if err != nil {
-			fail("Could not create memory profile: %v", err)
-		}
-		runtime.GC()
-		if err := pprof.WriteHeapProfile(f); err != nil {
-			fail("Could not write memory profile: %v", err)
-		}
-		if err := f.Close(); err != nil {
-			log.Err(err).Msg("Could not close memory profile")
-		}
+	if *maxBatchesPerAggregation < 0 {
+		fail("--max-batches-per-aggregation-task must be non-negative")
+		return
 	}
 
-	log.Info().Msg("done")
-}
+	if *maxConcurrentAggregations < 1 {
+		fail("--max-concurrent-aggregations must be at least 1")
+		return
+	}
 
-type scheduleTasksConfig struct {
-	aggregationID                                           string
-	isFirst                                                 bool
-	clock                                                   wftime.Clock
-	intakeBucket, ownValidationBucket, peerValidationBucket storage.Bucket
-	intakeTaskEnqueuer, aggregationTaskEnqueuer             task.Enqueuer
-	maxAge                                                  time.Duration
-	aggregationInterval                                     wftime.AggregationIntervalFunc
-}
+	switch *malformedObjectNames {
+	case malformedNamesFail, malformedNamesSkip, malformedNamesReport:
+	default:
+		fail("--malformed-object-names must be one of 'fail', 'skip' or 'report'")
+		return
+	}
 
-// scheduleTasks evaluates bucket contents and Kubernetes cluster state to
+	if *seenBatchesFalsePositive < 0 || *seenBatchesFalsePositive >= 1 {
+		fail("--seen-batches-false-positive-rate must be at least 0 and less than 1")
+		return
+	}
+
+	if *incompleteBatchAlertAge < 0 || *incompleteBatchRetention < 0 {
+		fail("--incomplete-batch-alert-age and --incomplete-batch-retention must be non-negative")
+		return
+	}
+
+	if *incompleteBatchReport && *incompleteBatchAlertAge == 0 {
+		fail("--incomplete-batch-report requires --incomplete-batch-alert-age")
+		return
+	}
+
+	switch *missingIntakePolicy {
+	case missingIntakeInclude, missingIntakeDrop, missingIntakeDefer, missingIntakeForceIntake:
+	default:
+		fail("--missing-intake-policy must be one of 'include', 'drop', 'defer' or 'force-intake'")
+		return
+	}
+
+	if *initialBackfillMaxTasks < 1 {
+		fail("--initial-backfill-max-tasks must be at least 1")
+		return
+	}
+	initialBackfillLimit := *initialBackfillMaxTasks
+	if *allowInitialBackfill {
+		initialBackfillLimit = 0
+	}
+
+	var batchNotifications notification.Source
+	if *watchMode {
+		switch {
+		case *batchListFile != "":
+			fail("--watch cannot be used with --batch-list-file")
+			return
+		case *dryRunReport != "" || *diffAgainst != "":
+			fail("--watch cannot be used with --dry-run-report or --diff-against")
+			return
+		case *aggregationWindowOffset != 0:
+			fail("--watch cannot be used with --aggregation-window-offset")
+			return
+		case *runSummaryPrefix != "":
+			fail("--watch cannot be used with --run-summary-prefix")
+			return
+		case *reconciliationInterval <= 0:
+			fail("--reconciliation-interval must be positive")
+			return
+		}
+		batchNotifications, err = newBatchNotificationSource(
+			*batchNotificationsKind, *ingestorInput, *batchNotificationsSubscription,
+			*batchNotificationsSQSQueueURL, *batchNotificationsIdentity)
+		if err != nil {
+			fail("%s", err)
+			return
+		}
+	} else if *batchNotificationsKind != "" {
+		fail("--batch-notifications-kind requires --watch")
+		return
+	}
+
+	// Record the configuration of this run alongside its task markers before
+	// scheduling any tasks, so that every scheduled task can be attributed to
+	// a recorded configuration.
+	runCFG := newRunConfig(runID, startTime, flag.CommandLine, map[string]string{
+		"enqueue-workers":        strconv.Itoa(enqueueWorkers),
+		"is-first":               strconv.FormatBool(first),
+		"task-signing":           strconv.FormatBool(signer != nil),
+		"initial-backfill-limit": strconv.Itoa(initialBackfillLimit),
+		"intake-interval":        wftime.Interval{Begin: startTime.Add(-*maxAge), End: startTime.Add(24 * time.Hour)}.String(),
+		"aggregation-window":     aggregationInterval(startTime).String(),
+	})
+	if err := writeRunConfig(ownValidationBucket, runCFG); err != nil {
+		fail("%s", err)
+		return
+	}
+	log.Info().Str("run ID", runID).Msgf("recorded run configuration as %s", runConfigName(runID))
+
+	// summary records the scheduling decisions made for each aggregation ID,
+	// whether or not scheduling succeeds.
+	summary := runSummary{RunID: runID, StartTime: startTime.UTC(), AggregationIDs: []aggregationIDSummary{}}
+	writeSummary := func(runErr error) {
+		if *runSummaryPrefix == "" {
+			return
+		}
+		summary.EndTime = time.Now().UTC()
+		summary.DurationSeconds = summary.EndTime.Sub(startTime).Seconds()
+		if runErr != nil {
+			summary.Error = runErr.Error()
+		}
+		// The summary is a record of tasks already scheduled, so failure to
+		// write it is logged rather than failing the run.
+		if err := writeRunSummary(ownValidationBucket, *runSummaryPrefix, summary, os.Stdout); err != nil {
+			log.Err(err).Str("run ID", runID).Msgf("Failed to write run summary: %s", err)
+		}
+	}
+
+	// scheduleAll schedules tasks for each of the provided aggregation IDs,
+	// up to --max-concurrent-aggregations at a time, returning a record of
+	// the tasks scheduled for each. Once scheduling fails for any aggregation
+	// ID, no more are started.
+	scheduleAll := func(aggregationIDs []string) (map[string]runRecord, error) {
+		var mu sync.Mutex // protects runRecords
+		runRecords := map[string]runRecord{}
+		// Summaries are collected by index so that they are reported in the
+		// order of aggregationIDs, whatever order scheduling completes in.
+		summaries := make([]*aggregationIDSummary, len(aggregationIDs))
+		// The ingestor's manifest is fetched at most once per run, and
+		// shared by every aggregation ID, but is fetched again by each run
+		// so that rotated batch signing keys are picked up.
+		var ingestorManifest func() (*manifest.IngestionServerGlobalManifest, error)
+		if *verifyBatchSignatures {
+			ingestorManifest = manifest.NewBatchSigningKeyCache(
+				&http.Client{Timeout: 30 * time.Second}, *ingestorManifestBaseURL).Manifest
+		}
+		eg, ctx := errgroup.WithContext(context.Background())
+		eg.SetLimit(*maxConcurrentAggregations)
+		for i, aggregationID := range aggregationIDs {
+			i, aggregationID := i, aggregationID
+			eg.Go(func() error {
+				if ctx.Err() != nil {
+					return nil
+				}
+				stats := &runStats{}
+				scheduleStart := time.Now()
+				// Each aggregation ID waits only for its own tasks, since the
+				// enqueuers are shared with those scheduled concurrently.
+				err := scheduleTasks(scheduleTasksConfig{
+					aggregationID:                aggregationID,
+					isFirst:                      first,
+					clock:                        wftime.DefaultClock(),
+					intakeBucket:                 intakeBucket,
+					ownValidationBucket:          ownValidationBucket,
+					peerValidationBucket:         peerValidationBucket,
+					intakeTaskEnqueuer:           task.NewScopedEnqueuer(intakeTaskEnqueuer),
+					aggregationTaskEnqueuer:      task.NewScopedEnqueuer(aggregationTaskEnqueuer),
+					maxAge:                       *maxAge,
+					aggregationInterval:          aggregationInterval,
+					aggregationLookbackWindows:   *aggregationLookbackWindows,
+					backfillIntakeMarkers:        *backfillIntakeMarkers,
+					missingPeerValidationReports: *missingPeerValidationReports,
+					missingIntakePolicy:          *missingIntakePolicy,
+					initialBackfillLimit:         initialBackfillLimit,
+					maxIntakeTasks:               *maxTasksPerRun,
+					coalesceIntakeWindow:         *coalesceIntakeWindow,
+					coalesceIntakeMaxBatches:     *coalesceIntakeMaxBatches,
+					maxTaskRate:                  *maxTaskRate,
+					validateBatchHeaders:         *validateBatchHeaders,
+					ingestorManifest:             ingestorManifest,
+					stats:                        stats,
+					malformedNamePolicy:          *malformedObjectNames,
+					incompleteBatchAlertAge:      *incompleteBatchAlertAge,
+					incompleteBatchRetention:     *incompleteBatchRetention,
+					incompleteBatchReport:        *incompleteBatchReport,
+					cacheListings:                *cacheListings,
+					maxBatchesPerAggregation:     *maxBatchesPerAggregation,
+					taskEvents:                   taskEvents,
+				})
+				if *runSummaryPrefix != "" {
+					aggregationIDSummary := newAggregationIDSummary(aggregationID, stats, err)
+					summaries[i] = &aggregationIDSummary
+				}
+
+				if err != nil {
+					log.Err(err).Str("aggregation ID", aggregationID).Msgf("Failed to schedule aggregation tasks: %s", err)
+					return err
+				}
+				if *seenBatchesFalsePositive > 0 {
+					if _, err := updateSeenBatches(ownValidationBucket, aggregationID, stats.ingestionBatchIDs, *seenBatchesFalsePositive); err != nil {
+						log.Err(err).Str("aggregation ID", aggregationID).Msgf("Failed to update seen batches state: %s", err)
+					}
+				}
+				// Like the seen batches state, failure to delete expired
+				// task markers doesn't affect scheduled tasks, so it is
+				// logged rather than failing the run.
+				if *taskMarkerRetention > 0 {
+					deleted, err := ownValidationBucket.DeleteTaskMarkers(aggregationID, scheduleStart.Add(-*taskMarkerRetention))
+					taskMarkersDeleted.WithLabelValues(aggregationID).Add(float64(deleted))
+					if err != nil {
+						log.Err(err).Str("aggregation ID", aggregationID).Msgf("Failed to delete expired task markers: %s", err)
+					}
+				}
+				retention, ok := batchRetentionByAggregationID[aggregationID]
+				if !ok {
+					retention = *batchRetention
+				}
+				if retention > 0 {
+					deleteExpiredBatchFiles(aggregationID, scheduleStart.Add(-retention), batchRetentionBuckets)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				runRecords[aggregationID] = runRecord{
+					Time:             scheduleStart.UTC(),
+					RunID:            runID,
+					IngestionBatches: stats.ingestionBatches,
+					IntakeTasks:      stats.intakeTasks,
+					AggregationTasks: stats.aggregationTasks,
+					DurationSeconds:  time.Since(scheduleStart).Seconds(),
+				}
+				return nil
+			})
+		}
+		err := eg.Wait()
+		for _, aggregationIDSummary := range summaries {
+			if aggregationIDSummary != nil {
+				summary.AggregationIDs = append(summary.AggregationIDs, *aggregationIDSummary)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Failure to update trend state doesn't affect scheduled tasks, so it
+		// is logged rather than failing the run.
+		if *trendStateRetention > 0 {
+			for aggregationID, record := range runRecords {
+				if err := updateTrendState(ownValidationBucket, aggregationID, record, *trendStateRetention); err != nil {
+					log.Err(err).Str("aggregation ID", aggregationID).Msgf("Failed to update trend state: %s", err)
+				}
+			}
+		}
+		return runRecords, nil
+	}
+
+	// In watch mode, each reconciliation scans buckets as a single run
+	// would, while notified batches are scheduled in between.
+	if *watchMode {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		log.Info().
+			Str("batch notifications", *batchNotificationsKind).
+			Dur("reconciliation interval", *reconciliationInterval).
+			Msg("--watch is specified: scheduling intake tasks as batch notifications arrive")
+		if err := watch(ctx, watchConfig{
+			source:                 batchNotifications,
+			ownValidationBucket:    ownValidationBucket,
+			intakeTaskEnqueuer:     intakeTaskEnqueuer,
+			taskEvents:             taskEvents,
+			clock:                  wftime.DefaultClock(),
+			pushMetrics:            pushMetrics,
+			maxAge:                 *maxAge,
+			reconciliationInterval: *reconciliationInterval,
+			aggregationIDs:         aggregationFilter,
+		}, func() (err error) {
+			health.started()
+			defer func() { health.completed(err) }()
+			aggregationIDs, err := intakeBucket.ListAggregationIDs()
+			if err != nil {
+				return fmt.Errorf("unable to discover aggregation IDs from ingestion bucket: %w", err)
+			}
+			_, err = scheduleAll(aggregationFilter.apply(aggregationIDs))
+			return err
+		}); err != nil {
+			fail("%s", err)
+			return
+		}
+		taskEvents.Stop()
+		log.Info().Str("run ID", runID).Msg("shutting down")
+		return
+	}
+
+	// In replay mode, intake tasks are scheduled for the listed batches only;
+	// no aggregation IDs are discovered, so no further tasks are scheduled.
+	var aggregationIDs []string
+	if *batchListFile != "" {
+		batches, err := readBatchListFile(*batchListFile)
+		if err != nil {
+			fail("%s", err)
+			return
+		}
+		if err := replayIntakeTasks(batches, *ignoreMarkers, ownValidationBucket, intakeTaskEnqueuer, taskEvents, wftime.DefaultClock()); err != nil {
+			log.Err(err).Msgf("Failed to replay intake tasks: %s", err)
+			writeSummary(err)
+			recordFailureMetric()
+			return
+		}
+	} else {
+		aggregationIDs, err = intakeBucket.ListAggregationIDs()
+		if err != nil {
+			fail("unable to discover aggregation IDs from ingestion bucket: %q", err)
+			return
+		}
+		aggregationIDs = aggregationFilter.apply(aggregationIDs)
+	}
+
+	health.started()
+	runRecords, err := scheduleAll(aggregationIDs)
+	health.completed(err)
+	// Ensure task events have been published before the process exits.
+	taskEvents.Stop()
+	writeSummary(err)
+	if err != nil {
+		recordFailureMetric()
+		return
+	}
+
+	if dryRunRecorder != nil {
+		if err := reportDryRun(dryRunRecorder.Report(), *dryRunReport, *diffAgainst); err != nil {
+			fail("%s", err)
+			return
+		}
+	}
+
+	// Create and register these gauges only upon success, to avoid
+	// clobbering them in case of failure.
+	var workflowManagerLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "workflow_manager_last_success_seconds",
+		Help: "Time of last successful run of workflow-manager in seconds since UNIX epoch",
+	})
+	var workflowManagerRuntime = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "workflow_manager_runtime_seconds",
+		Help: "How long successful workflow-manager runs take",
+	})
+
+	workflowManagerLastSuccess.SetToCurrentTime()
+
+	endTime := time.Now()
+	workflowManagerRuntime.Set(endTime.Sub(startTime).Seconds())
+
+	if *memProfile != "" {
+		f, err := os.Create(*memProfile)
+		if err != nil {
+			fail("Could not create memory profile: %v", err)
+		}
+		runtime.GC()
+		if err := pprof.WriteHeapProfile(f); err != nil {
+			fail("Could not write memory profile: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			log.Err(err).Msg("Could not close memory profile")
+		}
+	}
+
+	// Summarize the run, including its configuration, so that the summary
+	// alone describes how its tasks were scheduled.
+	log.Info().
+		Str("run ID", runID).
+		Int("aggregation IDs", len(runRecords)).
+		Dur("runtime", endTime.Sub(startTime)).
+		Interface("config", runCFG).
+		Msg("done")
+}
+
+// reportDryRun logs the hash of the tasks that a dry run would have enqueued.
+// If reportPath is not empty, the report is written to that path as JSON. If
+// diffAgainstPath is not empty, a report previously written by an earlier dry
+// run is read from that path, and tasks added or removed since that run are
+// logged.
+func reportDryRun(report task.DryRunReport, reportPath, diffAgainstPath string) error {
+	log.Info().
+		Str("hash", report.Hash).
+		Int("task count", len(report.Tasks)).
+		Msg("dry run complete")
+
+	if reportPath != "" {
+		jsonReport, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("couldn't marshal dry run report: %w", err)
+		}
+		if err := os.WriteFile(reportPath, jsonReport, 0o644); err != nil {
+			return fmt.Errorf("couldn't write dry run report: %w", err)
+		}
+	}
+
+	if diffAgainstPath != "" {
+		jsonPrevious, err := os.ReadFile(diffAgainstPath)
+		if err != nil {
+			return fmt.Errorf("couldn't read previous dry run report: %w", err)
+		}
+		var previous task.DryRunReport
+		if err := json.Unmarshal(jsonPrevious, &previous); err != nil {
+			return fmt.Errorf("couldn't unmarshal previous dry run report: %w", err)
+		}
+
+		added, removed := report.Diff(previous)
+		for _, t := range added {
+			log.Info().Str("queue", t.Queue).Str("task", t.Marker).RawJSON("task body", t.Task).Msg("dry run: task added")
+		}
+		for _, t := range removed {
+			log.Info().Str("queue", t.Queue).Str("task", t.Marker).RawJSON("task body", t.Task).Msg("dry run: task removed")
+		}
+		log.Info().
+			Str("hash", report.Hash).
+			Str("previous hash", previous.Hash).
+			Int("added", len(added)).
+			Int("removed", len(removed)).
+			Msg("dry run compared to previous report")
+	}
+
+	return nil
+}
+
+// probeBucket writes a uniquely-named probe object to the bucket, then
+// immediately reads it back, checking that the bucket is writable and readable
+// and that writes are visible to subsequent reads without delay, which
+// workflow-manager relies on for task markers. It returns the time taken to
+// write and read back the probe. The probe object is then deleted; failure to
+// delete it is logged but is not an error.
+func probeBucket(bucket storage.Bucket, clock wftime.Clock) (time.Duration, error) {
+	name := uuid.New().String()
+	contents := []byte(fmt.Sprintf("workflow-manager probe %s", name))
+
+	start := clock.Now()
+	if err := bucket.WriteProbe(name, contents); err != nil {
+		return 0, fmt.Errorf("couldn't write probe: %w", err)
+	}
+	readContents, err := bucket.ReadProbe(name)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't read probe immediately after writing it: %w", err)
+	}
+	latency := clock.Now().Sub(start)
+	if !bytes.Equal(readContents, contents) {
+		return 0, fmt.Errorf("probe read immediately after writing it had unexpected contents %q", readContents)
+	}
+
+	if err := bucket.DeleteProbe(name); err != nil {
+		log.Err(err).Str("probe", name).Msgf("failed to delete probe: %s", err)
+	}
+	return latency, nil
+}
+
+const (
+	// defaultMaxEnqueueWorkers is the number of enqueue workers used if
+	// --max-enqueue-workers is not specified and the process has no cgroup
+	// limits.
+	defaultMaxEnqueueWorkers = 100
+	// enqueueWorkersPerCPU is the number of enqueue workers used per CPU
+	// available to the process. Enqueue workers spend most of their time
+	// waiting on the network, so this may be much greater than one.
+	enqueueWorkersPerCPU = 50
+	// enqueueWorkerMemoryBytes is the memory budgeted for each enqueue worker.
+	enqueueWorkerMemoryBytes = 4 << 20 // 4 MiB
+	// memoryLimitFraction is the fraction of the cgroup memory limit used as
+	// the Go runtime's soft memory limit, leaving headroom for non-heap memory.
+	memoryLimitFraction = 0.9
+)
+
+// adaptToLimits configures GOMAXPROCS and the Go runtime's soft memory limit
+// according to the provided cgroup limits, unless the GOMAXPROCS or GOMEMLIMIT
+// environment variables are set, and returns the number of enqueue workers to
+// use, which is maxEnqueueWorkers if it is non-zero. The chosen values are
+// logged and recorded as metrics.
+func adaptToLimits(limits cgroup.Limits, maxEnqueueWorkers int) int {
+	if limits.CPUs > 0 && os.Getenv("GOMAXPROCS") == "" {
+		procs := int(math.Ceil(limits.CPUs))
+		if procs < runtime.NumCPU() {
+			runtime.GOMAXPROCS(procs)
+		}
+	}
+	if limits.MemoryBytes > 0 && os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(int64(float64(limits.MemoryBytes) * memoryLimitFraction))
+	}
+
+	enqueueWorkers := maxEnqueueWorkers
+	if enqueueWorkers == 0 {
+		enqueueWorkers = enqueueWorkersForLimits(limits)
+	}
+
+	// Passing a negative value to GOMAXPROCS or SetMemoryLimit reads the
+	// current value without changing it.
+	gomaxprocs := runtime.GOMAXPROCS(-1)
+	memoryLimit := debug.SetMemoryLimit(-1)
+	log.Info().
+		Float64("cgroup CPU limit", limits.CPUs).
+		Int64("cgroup memory limit", limits.MemoryBytes).
+		Int("GOMAXPROCS", gomaxprocs).
+		Int64("memory limit", memoryLimit).
+		Int("enqueue workers", enqueueWorkers).
+		Msg("adapted to resource limits")
+	chosenGOMAXPROCS.Set(float64(gomaxprocs))
+	chosenMemoryLimit.Set(float64(memoryLimit))
+	chosenMaxEnqueueWorkers.Set(float64(enqueueWorkers))
+
+	return enqueueWorkers
+}
+
+// enqueueWorkersForLimits returns the number of enqueue workers to use given
+// the provided cgroup limits: defaultMaxEnqueueWorkers, reduced if the CPU or
+// memory limits could not support that many workers.
+func enqueueWorkersForLimits(limits cgroup.Limits) int {
+	workers := defaultMaxEnqueueWorkers
+	if limits.CPUs > 0 {
+		if cpuWorkers := int(math.Ceil(limits.CPUs * enqueueWorkersPerCPU)); cpuWorkers < workers {
+			workers = cpuWorkers
+		}
+	}
+	if limits.MemoryBytes > 0 {
+		if memoryWorkers := int(limits.MemoryBytes / enqueueWorkerMemoryBytes); memoryWorkers < workers {
+			workers = memoryWorkers
+		}
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
+}
+
+// parseTags parses comma-separated key=value pairs, e.g.
+// "environment=prod-us,locality=us-ca", into a map from key to value.
+func parseTags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("malformed tag %q, want key=value", pair)
+		}
+		if _, ok := tags[key]; ok {
+			return nil, fmt.Errorf("duplicate tag %q", key)
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+// parseBatchRetentionOverrides parses comma-separated aggregation-id=duration
+// pairs, e.g. "kittens-seen=720h,dogs-seen=0", into a map from aggregation ID
+// to batch retention.
+func parseBatchRetentionOverrides(s string) (map[string]time.Duration, error) {
+	pairs, err := parseTags(s)
+	if err != nil {
+		return nil, err
+	}
+	overrides := map[string]time.Duration{}
+	for aggregationID, value := range pairs {
+		retention, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse retention for aggregation ID %q: %w", aggregationID, err)
+		}
+		if retention < 0 {
+			return nil, fmt.Errorf("retention for aggregation ID %q must be non-negative", aggregationID)
+		}
+		overrides[aggregationID] = retention
+	}
+	return overrides, nil
+}
+
+// retentionBucket is a bucket from which expired batches are deleted, with
+// the label identifying it in metrics.
+type retentionBucket struct {
+	label  string
+	bucket storage.Bucket
+}
+
+// deleteExpiredBatchFiles deletes the objects of batches for the aggregation
+// ID whose timestamp is before cutoff from each of the buckets, and records
+// the objects & bytes deleted. Like the deletion of task markers, failure
+// doesn't affect scheduled tasks, so it is logged rather than returned, and
+// doesn't prevent deletion from the other buckets.
+func deleteExpiredBatchFiles(aggregationID string, cutoff time.Time, buckets []retentionBucket) {
+	for _, b := range buckets {
+		deleted, err := b.bucket.DeleteBatchFiles(aggregationID, cutoff)
+		batchObjectsDeleted.WithLabelValues(aggregationID, b.label).Add(float64(deleted.Objects))
+		batchBytesDeleted.WithLabelValues(aggregationID, b.label).Add(float64(deleted.Bytes))
+		if err != nil {
+			log.Err(err).Str("aggregation ID", aggregationID).Str("bucket", b.label).
+				Msgf("Failed to delete expired batch files: %s", err)
+		}
+	}
+}
+
+// readBatchListFile reads the list of batches to replay from the file at path,
+// which contains one batch name per line. Blank lines, and lines beginning
+// with '#', are ignored.
+func readBatchListFile(path string) (batchpath.List, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read batch list file: %w", err)
+	}
+	var batchNames []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		batchNames = append(batchNames, line)
+	}
+	batches, err := batchpath.NewList(batchNames)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse batch list file: %w", err)
+	}
+	return batches, nil
+}
+
+// replayIntakeTasks schedules intake tasks for exactly the provided batches,
+// without checking that they exist in the intake bucket. Batches for which an
+// intake task marker exists are skipped, unless ignoreMarkers is set.
+func replayIntakeTasks(
+	batches batchpath.List,
+	ignoreMarkers bool,
+	ownValidationBucket storage.Bucket,
+	enqueuer task.Enqueuer,
+	events *taskevent.Publisher,
+	clock wftime.Clock,
+) error {
+	taskMarkersSet := map[string]struct{}{}
+	if !ignoreMarkers {
+		// Intake task markers are listed by the hour, so list the markers
+		// for each hour in which any listed batch falls.
+		listed := map[string]struct{}{}
+		for _, batch := range batches {
+			hour := batch.Time.Truncate(time.Hour)
+			key := fmt.Sprintf("%s/%s", batch.AggregationID, hour)
+			if _, ok := listed[key]; ok {
+				continue
+			}
+			listed[key] = struct{}{}
+
+			markers, err := ownValidationBucket.ListIntakeTaskMarkers(
+				batch.AggregationID, wftime.Interval{Begin: hour, End: hour.Add(time.Hour)})
+			if err != nil {
+				return fmt.Errorf("couldn't list intake task markers: %w", err)
+			}
+			for _, marker := range markers {
+				taskMarkersSet[marker] = struct{}{}
+			}
+		}
+	} else {
+		log.Warn().
+			Int("batch count", batches.Len()).
+			Msg("AUDIT: --ignore-markers is set, replaying intake tasks regardless of task markers")
+	}
+
+	if _, err := enqueueIntakeTasks(batches, taskMarkersSet, nil, 0, time.Time{}, intakeCoalescing{}, ownValidationBucket, enqueuer, events, clock); err != nil {
+		return err
+	}
+
+	// Ensure the enqueuer has completed its asynchronous work before allowing
+	// the process to exit
+	enqueuer.Stop()
+
+	return nil
+}
+
+type scheduleTasksConfig struct {
+	aggregationID                                           string
+	isFirst                                                 bool
+	clock                                                   wftime.Clock
+	intakeBucket, ownValidationBucket, peerValidationBucket storage.Bucket
+	intakeTaskEnqueuer, aggregationTaskEnqueuer             task.Enqueuer
+	maxAge                                                  time.Duration
+	aggregationInterval                                     wftime.AggregationIntervalFunc
+	backfillIntakeMarkers                                   bool
+	missingPeerValidationReports                            bool
+	// aggregationLookbackWindows is the number of aggregation windows,
+	// ending with the window chosen by aggregationInterval, which are
+	// evaluated. If zero, only the window chosen by aggregationInterval is.
+	aggregationLookbackWindows int
+	// missingIntakePolicy determines what is done with peer-validated batches
+	// in an aggregation window that we have not intake'd: one of the
+	// missingIntake* constants. If empty, missingIntakeInclude.
+	missingIntakePolicy string
+	// initialBackfillLimit is the most intake tasks that may be scheduled if
+	// no task markers exist for the aggregation ID, which suggests this is the
+	// first run against the ingestion bucket. If zero, there is no limit.
+	initialBackfillLimit int
+	// maxIntakeTasks, if non-zero, is the most intake tasks that are
+	// scheduled. Intake tasks for the newest batches beyond the limit are
+	// deferred to the next run.
+	maxIntakeTasks int
+	// coalesceIntakeWindow, if non-zero, is the length of the windows within
+	// which the intake tasks of batches are coalesced into a single task, of
+	// at most coalesceIntakeMaxBatches batches.
+	coalesceIntakeWindow     time.Duration
+	coalesceIntakeMaxBatches int
+	// maxTaskRate, if non-zero, is the most tasks per second that are
+	// enqueued.
+	maxTaskRate float64
+	// validateBatchHeaders determines whether the headers of ingestion
+	// batches are checked against their packet files before intake tasks
+	// are scheduled for them.
+	validateBatchHeaders bool
+	// ingestorManifest, if not nil, returns the ingestor's global
+	// manifest, with whose batch signing public keys the signatures of
+	// ingestion batches are verified when validateBatchHeaders is set.
+	ingestorManifest func() (*manifest.IngestionServerGlobalManifest, error)
+	// stats, if non-nil, is populated with statistics describing the tasks
+	// scheduled.
+	stats *runStats
+	// malformedNamePolicy determines what is done with listed objects whose
+	// names don't parse as batch paths: one of the malformedNames* constants.
+	// If empty, malformedNamesFail.
+	malformedNamePolicy string
+	// malformedNames collects the malformed object names found during
+	// scheduling. It is populated by scheduleTasks.
+	malformedNames malformedNames
+	// incompleteBatchAlertAge, if non-zero, enables tracking of incomplete
+	// ingestion batches across runs, and is how long a batch may be seen
+	// incomplete before it is counted as dead. See updateIncompleteBatches.
+	incompleteBatchAlertAge time.Duration
+	// incompleteBatchRetention is how long incomplete batches outside the
+	// intake window are tracked after they were last seen.
+	incompleteBatchRetention time.Duration
+	// incompleteBatchReport determines whether dead batches are listed in a
+	// report in the own validation bucket.
+	incompleteBatchReport bool
+	// cacheListings determines whether the ingestor & own validation buckets
+	// are listed once over the intake & aggregation windows, rather than once
+	// for each window. See cachedListingInterval.
+	cacheListings bool
+	// maxBatchesPerAggregation, if non-zero, is the most batches in an
+	// aggregation task. Windows with more batches are split into
+	// sub-windows. See splitAggregationBatches.
+	maxBatchesPerAggregation int
+	// taskEvents, if non-nil, publishes an event for each intake &
+	// aggregation task scheduled or skipped.
+	taskEvents *taskevent.Publisher
+}
+
+// scheduleTasks evaluates bucket contents and Kubernetes cluster state to
 // schedule new tasks
 func scheduleTasks(config scheduleTasksConfig) error {
+	config.malformedNames = malformedNames{}
+	defer reportMalformedNames(config)
+	if config.stats != nil {
+		config.intakeTaskEnqueuer = countingEnqueuer{enqueuer: config.intakeTaskEnqueuer, count: &config.stats.intakeTasks, stats: config.stats, queue: "intake"}
+		config.aggregationTaskEnqueuer = countingEnqueuer{enqueuer: config.aggregationTaskEnqueuer, count: &config.stats.aggregationTasks, stats: config.stats, queue: "aggregate"}
+		config.ownValidationBucket = countingBucket{Bucket: config.ownValidationBucket, stats: config.stats}
+	}
+	if config.maxTaskRate > 0 {
+		rateLimiter := task.NewRateLimiter(config.maxTaskRate)
+		config.intakeTaskEnqueuer = rateLimiter.Wrap(config.intakeTaskEnqueuer)
+		config.aggregationTaskEnqueuer = rateLimiter.Wrap(config.aggregationTaskEnqueuer)
+	}
+
+	phaseStart := time.Now()
 	intakeInterval := wftime.Interval{
 		Begin: config.clock.Now().Add(-config.maxAge),
 		End:   config.clock.Now().Add(24 * time.Hour),
 	}
+	aggInterval := config.aggregationInterval(config.clock.Now())
+	if config.cacheListings {
+		interval := cachedListingInterval(intakeInterval, aggInterval)
+		config.intakeBucket = storage.NewCachingBucket(config.intakeBucket, ingestorBucketLabel, config.aggregationID, interval)
+		config.ownValidationBucket = storage.NewCachingBucket(config.ownValidationBucket, ownValidationBucketLabel, config.aggregationID, interval)
+	}
 
 	intakeFiles, err := config.intakeBucket.ListBatchFiles(config.aggregationID, intakeInterval)
 	if err != nil {
 		return err
 	}
 
-	intakeBatches, err := batchpath.ReadyBatches(intakeFiles, "batch", false /* acceptSignatureOnly */)
+	intakeBatches, err := readyBatches(config, ingestorBucketLabel, intakeFiles, "batch", false /* acceptSignatureOnly */)
 	if err != nil {
 		return err
 	}
 
 	ingestionBatchesFound.WithLabelValues(config.aggregationID).Set(float64(intakeBatches.Batches.Len()))
+	if config.stats != nil {
+		config.stats.ingestionBatches = intakeBatches.Batches.Len()
+		for _, batch := range intakeBatches.Batches {
+			config.stats.ingestionBatchIDs = append(config.stats.ingestionBatchIDs, batch.ID)
+		}
+		config.stats.incompleteIngestionBatches = intakeBatches.IncompleteBatchCount
+	}
 	incompleteIngestionBatchesFound.WithLabelValues(config.aggregationID).Set(float64(intakeBatches.IncompleteBatchCount))
 	log.Info().
 		Str("aggregation ID", config.aggregationID).
 		Int("ingestion batches", intakeBatches.Batches.Len()).
 		Int("incomplete ingestion batches", intakeBatches.IncompleteBatchCount).
 		Msg("discovered ingestion batches in intake window")
+	// Like the seen batches state, failure to track incomplete batches
+	// doesn't affect scheduled tasks, so it is logged rather than failing.
+	if config.incompleteBatchAlertAge > 0 {
+		if err := updateIncompleteBatches(config, intakeBatches.IncompleteBatches, intakeInterval.Begin); err != nil {
+			log.Err(err).Str("aggregation ID", config.aggregationID).Msgf("Failed to update incomplete batches state: %s", err)
+		}
+	}
+	phaseStart = config.stats.recordPhase(phaseListIngestionBatches, phaseStart)
 
 	// Make a set of the tasks for which we have marker objects for efficient
 	// lookup later.
@@ -456,35 +1775,250 @@ func scheduleTasks(config scheduleTasksConfig) error {
 		intakeTaskMarkersSet[marker] = struct{}{}
 	}
 
-	err = enqueueIntakeTasks(
-		intakeBatches.Batches,
+	// If backfilling intake markers, make a set of the batches for which we
+	// have already written our own validation batches.
+	var ownValidationsSet map[string]struct{}
+	if config.backfillIntakeMarkers {
+		ownValidationFiles, err := config.ownValidationBucket.ListBatchFiles(config.aggregationID, intakeInterval)
+		if err != nil {
+			return fmt.Errorf("couldn't list own validation batches for intake marker backfill: %w", err)
+		}
+
+		ownValidityInfix := fmt.Sprintf("validity_%d", utils.Index(config.isFirst))
+		ownValidationBatches, err := readyBatches(config, ownValidationBucketLabel, ownValidationFiles, ownValidityInfix, false /* acceptSignatureOnly */)
+		if err != nil {
+			return fmt.Errorf("couldn't determine ready own validation batches for intake marker backfill: %w", err)
+		}
+
+		ownValidationsSet = map[string]struct{}{}
+		for _, batch := range ownValidationBatches.Batches {
+			ownValidationsSet[batch.ID] = struct{}{}
+		}
+	}
+
+	aggregationTaskMarkers, err := config.ownValidationBucket.ListAggregateTaskMarkers(config.aggregationID)
+	if err != nil {
+		return err
+	}
+
+	// With no task markers, intake tasks are scheduled by an initial
+	// backfill. Those of batches in aggregation windows already due for
+	// aggregation are marked low priority, so that facilitators shared with
+	// other aggregation IDs process fresh batches first.
+	initialBackfill := len(intakeTaskMarkers) == 0 && len(aggregationTaskMarkers) == 0
+	var lowPriorityBefore time.Time
+	if initialBackfill {
+		lowPriorityBefore = aggInterval.End
+	}
+	if config.initialBackfillLimit > 0 && initialBackfill {
+		initialIntakeTasks := 0
+		for _, batch := range intakeBatches.Batches {
+			if _, ok := ownValidationsSet[batch.ID]; !ok {
+				initialIntakeTasks++
+			}
+		}
+		if config.maxIntakeTasks > 0 && initialIntakeTasks > config.maxIntakeTasks {
+			initialIntakeTasks = config.maxIntakeTasks
+		}
+		if initialIntakeTasks > config.initialBackfillLimit {
+			return fmt.Errorf("no task markers exist for aggregation ID %q, but %d intake tasks would be scheduled, more than the limit of %d: pass --allow-initial-backfill to schedule them",
+				config.aggregationID, initialIntakeTasks, config.initialBackfillLimit)
+		}
+	}
+
+	batchesToIntake := intakeBatches.Batches
+	if config.validateBatchHeaders {
+		var invalid int
+		batchesToIntake, invalid, err = checkBatchHeaders(config, batchesToIntake, intakeTaskMarkersSet, ownValidationsSet, config.maxIntakeTasks)
+		if err != nil {
+			return err
+		}
+		if config.stats != nil {
+			config.stats.invalidIngestionBatches = invalid
+		}
+	}
+
+	intakeCounts, err := enqueueIntakeTasks(
+		batchesToIntake,
 		intakeTaskMarkersSet,
+		ownValidationsSet,
+		config.maxIntakeTasks,
+		lowPriorityBefore,
+		intakeCoalescing{config.coalesceIntakeWindow, config.coalesceIntakeMaxBatches},
 		config.ownValidationBucket,
 		config.intakeTaskEnqueuer,
+		config.taskEvents,
+		config.clock,
 	)
 	if err != nil {
 		return err
 	}
+	if config.stats != nil {
+		config.stats.intakeTasksSkipped = intakeCounts.skippedDueToMarker + intakeCounts.skippedDueToOwnValidation
+		config.stats.intakeTasksDeferred = intakeCounts.deferred
+		config.stats.intakeTasksSubmitted = intakeCounts.scheduled
+		config.stats.intakeMarkersBackfilled = intakeCounts.skippedDueToOwnValidation
+	}
+	phaseStart = config.stats.recordPhase(phaseScheduleIntakeTasks, phaseStart)
 
-	aggInterval := config.aggregationInterval(config.clock.Now())
+	aggregationTaskMarkersSet := map[string]struct{}{}
+	for _, marker := range aggregationTaskMarkers {
+		aggregationTaskMarkersSet[marker] = struct{}{}
+	}
+
+	// Determine which aggregation windows to schedule: the window chosen by
+	// config.aggregationInterval and the config.aggregationLookbackWindows-1
+	// windows before it, plus any windows for which an operator has dropped a
+	// reaggregation trigger into the own validation bucket.
+	windows := []aggregationWindow{{interval: aggInterval, recordMetrics: true}}
+	for i := 1; i < config.aggregationLookbackWindows; i++ {
+		offset := time.Duration(i) * aggInterval.Length()
+		windows = append(windows, aggregationWindow{
+			interval: wftime.Interval{Begin: aggInterval.Begin.Add(-offset), End: aggInterval.End.Add(-offset)},
+			lookback: true,
+		})
+	}
+	triggers, err := config.ownValidationBucket.ListReaggregationTriggers(config.aggregationID)
+	if err != nil {
+		return fmt.Errorf("couldn't list reaggregation triggers: %w", err)
+	}
+	for _, trigger := range triggers {
+		interval, err := wftime.ParseMarkerInterval(trigger)
+		if err != nil {
+			log.Warn().Err(err).
+				Str("aggregation ID", config.aggregationID).
+				Str("reaggregation trigger", trigger).
+				Msgf("ignoring malformed reaggregation trigger: %s", err)
+			continue
+		}
+		if i := windowIndex(windows, trigger); i >= 0 {
+			windows[i].trigger = trigger
+			continue
+		}
+		windows = append(windows, aggregationWindow{interval: interval, trigger: trigger})
+	}
+
+	for _, window := range windows {
+		if err := scheduleAggregationTask(config, window, aggregationTaskMarkersSet); err != nil {
+			return err
+		}
+	}
+	phaseStart = config.stats.recordPhase(phaseScheduleAggregationTasks, phaseStart)
+
+	// Ensure both task enqueuers have completed their asynchronous work before
+	// allowing the process to exit
+	config.intakeTaskEnqueuer.Stop()
+	config.aggregationTaskEnqueuer.Stop()
+	config.stats.recordPhase(phaseDrainEnqueuers, phaseStart)
+
+	// Once the enqueuers have drained, the counts of tasks & task markers
+	// must agree.
+	return checkInvariants(config.aggregationID, config.stats)
+}
+
+// cachedListingInterval returns the interval over which buckets are listed
+// once, with --cache-listings, to serve the listings of both the intake
+// window and the aggregation window chosen by config.aggregationInterval.
+// That is the smallest interval covering both windows, unless they are
+// further apart than the aggregation window is long, in which case listing
+// the gap between them would cost more than the listing saved, and it is the
+// intake window alone. Lookback windows, which are usually skipped without
+// being listed, and reaggregated windows aren't covered.
+func cachedListingInterval(intakeInterval, aggInterval wftime.Interval) wftime.Interval {
+	if aggInterval.End.Before(intakeInterval.Begin.Add(-aggInterval.Length())) ||
+		aggInterval.Begin.After(intakeInterval.End.Add(aggInterval.Length())) {
+		return intakeInterval
+	}
+	interval := intakeInterval
+	if aggInterval.Begin.Before(interval.Begin) {
+		interval.Begin = aggInterval.Begin
+	}
+	if aggInterval.End.After(interval.End) {
+		interval.End = aggInterval.End
+	}
+	return interval
+}
+
+// aggregationWindow is an aggregation window for which an aggregation task
+// may be scheduled.
+type aggregationWindow struct {
+	interval wftime.Interval
+	// recordMetrics is true if metrics describing the batches found in this
+	// window should be recorded.
+	recordMetrics bool
+	// trigger, if non-empty, is the name of the reaggregation trigger which
+	// requested aggregation of this window. An aggregation task is scheduled
+	// even if a task marker exists, and the trigger is deleted once the task
+	// is scheduled.
+	trigger string
+	// lookback is true if this window precedes the window chosen by
+	// config.aggregationInterval, and is evaluated only because of
+	// config.aggregationLookbackWindows. It is skipped without listing its
+	// batches if its aggregation task marker exists.
+	lookback bool
+}
+
+// windowIndex returns the index of the window in windows whose interval has
+// the given marker string, or -1 if there is none.
+func windowIndex(windows []aggregationWindow, markerString string) int {
+	for i, window := range windows {
+		if window.interval.MarkerString() == markerString {
+			return i
+		}
+	}
+	return -1
+}
+
+// scheduleAggregationTask schedules an aggregation task for the batches in
+// the given aggregation window which have been intake'd & validated by our
+// peer.
+func scheduleAggregationTask(config scheduleTasksConfig, window aggregationWindow, aggregationTaskMarkers map[string]struct{}) error {
+	aggInterval := window.interval
+	if window.lookback && window.trigger == "" {
+		marker := task.Aggregation{
+			AggregationID:    config.aggregationID,
+			AggregationStart: wftime.Timestamp(aggInterval.Begin),
+			AggregationEnd:   wftime.Timestamp(aggInterval.End),
+		}.Marker()
+		_, ok := aggregationTaskMarkers[marker]
+		if config.maxBatchesPerAggregation > 0 {
+			ok = aggregationWindowScheduled(config.aggregationID, aggInterval, aggregationTaskMarkers)
+		}
+		if ok {
+			log.Debug().
+				Str("aggregation interval", aggInterval.String()).
+				Str("aggregation ID", config.aggregationID).
+				Msg("skipping lookback aggregation window: aggregation task already scheduled")
+			return nil
+		}
+	}
+	if window.trigger != "" {
+		log.Warn().
+			Str("aggregation interval", aggInterval.String()).
+			Str("aggregation ID", config.aggregationID).
+			Str("reaggregation trigger", window.trigger).
+			Msg("AUDIT: reaggregation trigger found, scheduling aggregation task regardless of task marker")
+	}
 
 	log.Info().
 		Str("aggregation interval", aggInterval.String()).
 		Str("aggregation ID", config.aggregationID).
 		Msg("looking for batches to aggregate")
 
-	intakeFiles, err = config.intakeBucket.ListBatchFiles(config.aggregationID, aggInterval)
+	intakeFiles, err := config.intakeBucket.ListBatchFiles(config.aggregationID, aggInterval)
 	if err != nil {
 		return fmt.Errorf("couldn't list intake batches for aggregation task generation: %w", err)
 	}
 
-	intakeBatches, err = batchpath.ReadyBatches(intakeFiles, "batch", false /* acceptSignatureOnly */)
+	intakeBatches, err := readyBatches(config, ingestorBucketLabel, intakeFiles, "batch", false /* acceptSignatureOnly */)
 	if err != nil {
 		return fmt.Errorf("couldn't determine ready intake batches for aggregation task generation: %w", err)
 	}
 
-	aggregateIngestionBatchesFound.WithLabelValues(config.aggregationID).Set(float64(intakeBatches.Batches.Len()))
-	aggregateIncompleteIngestionBatchesFound.WithLabelValues(config.aggregationID).Set(float64(intakeBatches.IncompleteBatchCount))
+	if window.recordMetrics {
+		aggregateIngestionBatchesFound.WithLabelValues(config.aggregationID).Set(float64(intakeBatches.Batches.Len()))
+		aggregateIncompleteIngestionBatchesFound.WithLabelValues(config.aggregationID).Set(float64(intakeBatches.IncompleteBatchCount))
+	}
 	log.Info().
 		Str("aggregation interval", aggInterval.String()).
 		Str("aggregation ID", config.aggregationID).
@@ -498,18 +2032,27 @@ func scheduleTasks(config scheduleTasksConfig) error {
 	}
 
 	peerValidityInfix := fmt.Sprintf("validity_%d", utils.Index(!config.isFirst))
-	peerValidationBatches, err := batchpath.ReadyBatches(peerValidationFiles, peerValidityInfix, true /* acceptSignatureOnly */)
+	peerValidationBatches, err := readyBatches(config, peerValidationBucketLabel, peerValidationFiles, peerValidityInfix, true /* acceptSignatureOnly */)
 	if err != nil {
 		return err
 	}
 
-	peerValidationsFound.WithLabelValues(config.aggregationID).Set(float64(peerValidationBatches.Batches.Len()))
-	incompletePeerValidationsFound.WithLabelValues(config.aggregationID).Set(float64(peerValidationBatches.IncompleteBatchCount))
+	if window.recordMetrics {
+		peerValidationsFound.WithLabelValues(config.aggregationID).Set(float64(peerValidationBatches.Batches.Len()))
+		incompletePeerValidationsFound.WithLabelValues(config.aggregationID).Set(float64(peerValidationBatches.IncompleteBatchCount))
+	}
+	lag := computePeerValidationLag(intakeBatches.Batches, peerValidationBatches.Batches, config.clock.Now())
+	if window.recordMetrics {
+		lag.record(config.aggregationID)
+	}
 	log.Info().
 		Str("aggregation interval", aggInterval.String()).
 		Str("aggregation ID", config.aggregationID).
 		Int("peer validations", peerValidationBatches.Batches.Len()).
 		Int("incomplete peer validations", peerValidationBatches.IncompleteBatchCount).
+		Int("pending peer validations", lag.pending).
+		Dur("max peer validation lag", lag.max).
+		Dur("median peer validation lag", lag.median).
 		Msg("discovered peer validations")
 
 	// Take the intersection of the sets of ingestion batches and peer validations
@@ -525,46 +2068,247 @@ func scheduleTasks(config scheduleTasksConfig) error {
 		}
 	}
 
-	aggregationTaskMarkers, err := config.ownValidationBucket.ListAggregateTaskMarkers(config.aggregationID)
+	missingIntakes, err := batchesMissingIntake(config, aggInterval, aggregationBatches)
 	if err != nil {
 		return err
 	}
-	aggregationTaskMarkersSet := map[string]struct{}{}
-	for _, marker := range aggregationTaskMarkers {
-		aggregationTaskMarkersSet[marker] = struct{}{}
+	if window.recordMetrics {
+		aggregationBatchesMissingIntake.WithLabelValues(config.aggregationID).Set(float64(len(missingIntakes)))
+	}
+	if len(missingIntakes) > 0 {
+		logger := log.Warn().
+			Str("aggregation interval", aggInterval.String()).
+			Str("aggregation ID", config.aggregationID).
+			Int("batches missing intake", len(missingIntakes)).
+			Str("missing intake policy", config.missingIntakePolicy)
+		switch config.missingIntakePolicy {
+		case missingIntakeDrop:
+			logger.Msg("dropping peer-validated batches with no intake from aggregation")
+			aggregationBatches = aggregationBatches.Without(missingIntakes)
+		case missingIntakeDefer:
+			logger.Msg("deferring aggregation of window with peer-validated batches with no intake")
+			return nil
+		case missingIntakeForceIntake:
+			logger.Msg("scheduling intake tasks for peer-validated batches with no intake, and deferring aggregation")
+			_, err := enqueueIntakeTasks(missingIntakes, nil, nil, 0, time.Time{},
+				intakeCoalescing{config.coalesceIntakeWindow, config.coalesceIntakeMaxBatches}, config.ownValidationBucket, config.intakeTaskEnqueuer, config.taskEvents, config.clock)
+			return err
+		default:
+			logger.Msg("aggregating peer-validated batches with no intake")
+		}
 	}
 
-	err = enqueueAggregationTask(
-		config.aggregationID,
-		aggregationBatches,
-		aggInterval,
-		aggregationTaskMarkersSet,
-		config.ownValidationBucket,
-		config.aggregationTaskEnqueuer,
-	)
+	if config.missingPeerValidationReports {
+		peerValidationBatchIDs := map[string]struct{}{}
+		for _, peerValidationBatch := range peerValidationBatches.Batches {
+			peerValidationBatchIDs[peerValidationBatch.ID] = struct{}{}
+		}
+		missingPeerValidations := batchpath.List{}
+		for _, ingestionBatch := range intakeBatches.Batches {
+			if _, ok := peerValidationBatchIDs[ingestionBatch.ID]; !ok {
+				missingPeerValidations = append(missingPeerValidations, ingestionBatch)
+			}
+		}
+		if len(missingPeerValidations) > 0 {
+			// Failing to write the report should not prevent aggregation.
+			if err := writeMissingPeerValidationReport(config, aggInterval, intakeBatches.Batches.Len(), missingPeerValidations); err != nil {
+				log.Err(err).
+					Str("aggregation interval", aggInterval.String()).
+					Str("aggregation ID", config.aggregationID).
+					Msgf("failed to write missing peer validation report: %s", err)
+			}
+		}
+	}
+
+	if config.maxBatchesPerAggregation > 0 && window.trigger == "" &&
+		len(aggregationBatches) > 0 && aggregationWindowScheduled(config.aggregationID, aggInterval, aggregationTaskMarkers) {
+		log.Info().
+			Str("aggregation interval", aggInterval.String()).
+			Str("aggregation ID", config.aggregationID).
+			Msg("skipped aggregation window due to marker for window or sub-window")
+		aggregationsSkippedDueToMarker.inc(config.aggregationID)
+		if config.taskEvents != nil {
+			windowTask := task.Aggregation{
+				AggregationID:    config.aggregationID,
+				AggregationStart: wftime.Timestamp(aggInterval.Begin),
+				AggregationEnd:   wftime.Timestamp(aggInterval.End),
+			}
+			for _, batch := range aggregationBatches {
+				windowTask.Batches = append(windowTask.Batches, task.Batch{ID: batch.ID, Time: wftime.Timestamp(batch.Time)})
+			}
+			config.taskEvents.Skipped(windowTask, taskevent.ReasonWindowScheduled)
+		}
+		if config.stats != nil {
+			config.stats.aggregationTasksSkipped++
+		}
+		return nil
+	}
+
+	shards := splitAggregationBatches(aggregationBatches, aggInterval, config.maxBatchesPerAggregation)
+	if len(shards) > 1 {
+		log.Info().
+			Str("aggregation interval", aggInterval.String()).
+			Str("aggregation ID", config.aggregationID).
+			Int("batches", len(aggregationBatches)).
+			Int("sub-windows", len(shards)).
+			Msg("splitting aggregation window into sub-windows")
+	}
+	for i, shard := range shards {
+		taskMarkers, trigger := aggregationTaskMarkers, window.trigger
+		if len(shards) > 1 {
+			// Markers were checked for the whole window above, and a
+			// reaggregation trigger is deleted only once the last
+			// sub-window's task is enqueued.
+			taskMarkers = nil
+			if i < len(shards)-1 {
+				trigger = ""
+			}
+		}
+		skipped, err := enqueueAggregationTask(
+			config.aggregationID,
+			shard.batches,
+			shard.interval,
+			taskMarkers,
+			trigger,
+			config.ownValidationBucket,
+			config.aggregationTaskEnqueuer,
+			config.taskEvents,
+			config.clock,
+		)
+		if err != nil {
+			return err
+		}
+		if skipped && config.stats != nil {
+			config.stats.aggregationTasksSkipped++
+		}
+	}
+	return nil
+}
+
+const (
+	// missingIntakeInclude aggregates peer-validated batches we have not
+	// intake'd, as if we had.
+	missingIntakeInclude = "include"
+	// missingIntakeDrop excludes peer-validated batches we have not intake'd
+	// from aggregations.
+	missingIntakeDrop = "drop"
+	// missingIntakeDefer schedules no aggregation task for a window with
+	// peer-validated batches we have not intake'd, so that it is evaluated
+	// again by the next run.
+	missingIntakeDefer = "defer"
+	// missingIntakeForceIntake schedules intake tasks for peer-validated
+	// batches we have not intake'd, regardless of --intake-max-age or
+	// --max-tasks-per-run, and defers aggregation as missingIntakeDefer does.
+	missingIntakeForceIntake = "force-intake"
+)
+
+// batchesMissingIntake returns those of the batches to be aggregated in the
+// given window which have neither an intake task marker nor an own validation
+// batch. Own validations are only listed if some batches lack task markers.
+func batchesMissingIntake(config scheduleTasksConfig, aggregationWindow wftime.Interval, batches batchpath.List) (batchpath.List, error) {
+	intakeTaskMarkers, err := config.ownValidationBucket.ListIntakeTaskMarkers(config.aggregationID, aggregationWindow)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("couldn't list intake task markers for aggregation window: %w", err)
+	}
+	intakeTaskMarkersSet := map[string]struct{}{}
+	for _, marker := range intakeTaskMarkers {
+		intakeTaskMarkersSet[marker] = struct{}{}
 	}
 
-	// Ensure both task enqueuers have completed their asynchronous work before
-	// allowing the process to exit
-	config.intakeTaskEnqueuer.Stop()
-	config.aggregationTaskEnqueuer.Stop()
+	unmarked := batchpath.List{}
+	for _, batch := range batches {
+		intakeTask := task.IntakeBatch{
+			AggregationID: batch.AggregationID,
+			BatchID:       batch.ID,
+			Date:          wftime.Timestamp(batch.Time),
+		}
+		if _, ok := intakeTaskMarkersSet[intakeTask.Marker()]; !ok {
+			unmarked = append(unmarked, batch)
+		}
+	}
+	if len(unmarked) == 0 {
+		return nil, nil
+	}
 
+	ownValidationFiles, err := config.ownValidationBucket.ListBatchFiles(config.aggregationID, aggregationWindow)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list own validation batches for aggregation window: %w", err)
+	}
+	ownValidityInfix := fmt.Sprintf("validity_%d", utils.Index(config.isFirst))
+	ownValidationBatches, err := readyBatches(config, ownValidationBucketLabel, ownValidationFiles, ownValidityInfix, false /* acceptSignatureOnly */)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't determine ready own validation batches for aggregation window: %w", err)
+	}
+
+	return unmarked.Without(ownValidationBatches.Batches), nil
+}
+
+// missingPeerValidationReport lists the ingestion batches in an aggregation
+// window for which no peer validation was found. It is intended to be attached
+// to support tickets with the peer data share processor's operator.
+type missingPeerValidationReport struct {
+	AggregationID          string           `json:"aggregation-id"`
+	AggregationStart       wftime.Timestamp `json:"aggregation-start"`
+	AggregationEnd         wftime.Timestamp `json:"aggregation-end"`
+	IngestionBatchCount    int              `json:"ingestion-batch-count"`
+	MissingPeerValidations []task.Batch     `json:"missing-peer-validations"`
+}
+
+// writeMissingPeerValidationReport writes a missingPeerValidationReport to
+// "reports/missing-peer-validations/${aggregation-id}/${window}.json" in the
+// own validation bucket. The report is rewritten each time the window is
+// evaluated, so it reflects the peer validations present as of the most recent
+// run.
+func writeMissingPeerValidationReport(
+	config scheduleTasksConfig,
+	aggregationWindow wftime.Interval,
+	ingestionBatchCount int,
+	missingPeerValidations batchpath.List,
+) error {
+	report := missingPeerValidationReport{
+		AggregationID:          config.aggregationID,
+		AggregationStart:       wftime.Timestamp(aggregationWindow.Begin),
+		AggregationEnd:         wftime.Timestamp(aggregationWindow.End),
+		IngestionBatchCount:    ingestionBatchCount,
+		MissingPeerValidations: []task.Batch{},
+	}
+	for _, batchPath := range missingPeerValidations {
+		report.MissingPeerValidations = append(report.MissingPeerValidations, task.Batch{
+			ID:   batchPath.ID,
+			Time: wftime.Timestamp(batchPath.Time),
+		})
+	}
+
+	reportJSON, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't marshal missing peer validation report as JSON: %w", err)
+	}
+
+	name := fmt.Sprintf("missing-peer-validations/%s/%s.json", config.aggregationID, aggregationWindow.MarkerString())
+	if err := config.ownValidationBucket.WriteReport(name, reportJSON); err != nil {
+		return fmt.Errorf("couldn't write missing peer validation report: %w", err)
+	}
 	return nil
 }
 
+// enqueueAggregationTask enqueues an aggregation task for the ready batches,
+// unless a task marker exists for it, in which case skipped is true. If
+// reaggregationTrigger is non-empty, the task is enqueued regardless of task
+// markers, and the trigger is deleted once the task is enqueued.
 func enqueueAggregationTask(
 	aggregationID string,
 	readyBatches batchpath.List,
 	aggregationWindow wftime.Interval,
 	taskMarkers map[string]struct{},
+	reaggregationTrigger string,
 	ownValidationBucket storage.Bucket,
 	enqueuer task.Enqueuer,
-) error {
+	events *taskevent.Publisher,
+	clock wftime.Clock,
+) (skipped bool, err error) {
 	if len(readyBatches) == 0 {
 		log.Info().Str("aggregation ID", aggregationID).Msg("no batches to aggregate")
-		return nil
+		return false, nil
 	}
 
 	batches := []task.Batch{}
@@ -576,7 +2320,7 @@ func enqueueAggregationTask(
 
 		// All batches should have the same aggregation ID?
 		if aggregationID != batchPath.AggregationID {
-			return fmt.Errorf("found batch with aggregation ID %s, wanted %s", batchPath.AggregationID, aggregationID)
+			return false, fmt.Errorf("found batch with aggregation ID %s, wanted %s", batchPath.AggregationID, aggregationID)
 		}
 	}
 
@@ -588,11 +2332,12 @@ func enqueueAggregationTask(
 		Batches:          batches,
 	}
 
-	if _, ok := taskMarkers[aggregationTask.Marker()]; ok {
+	if _, ok := taskMarkers[aggregationTask.Marker()]; ok && reaggregationTrigger == "" {
 		aggregationTask.PrepareLog(log.Info()).
 			Msg("skipped aggregation task due to marker")
-		aggregationsSkippedDueToMarker.WithLabelValues(aggregationID).Inc()
-		return nil
+		aggregationsSkippedDueToMarker.inc(aggregationID)
+		events.Skipped(aggregationTask, taskevent.ReasonMarker)
+		return true, nil
 	}
 
 	aggregationTask.PrepareLog(log.Info()).
@@ -603,8 +2348,15 @@ func enqueueAggregationTask(
 		if err != nil {
 			aggregationTask.PrepareLog(log.Err(err)).
 				Msgf("failed to enqueue aggregation task: %s", err)
+			if err := writeDeadLetterTask(ownValidationBucket, aggregationTask); err != nil {
+				aggregationTask.PrepareLog(log.Err(err)).
+					Msgf("failed to write dead-letter aggregation task: %s", err)
+				return
+			}
+			aggregationsDeadLettered.inc(aggregationID)
 			return
 		}
+		events.Scheduled(aggregationTask)
 
 		// Write a marker to cloud storage to ensure we don't schedule redundant
 		// tasks
@@ -613,21 +2365,47 @@ func enqueueAggregationTask(
 				Msgf("failed to write aggregation task marker: %s", err)
 		}
 
-		aggregationsStarted.WithLabelValues(aggregationID).Inc()
+		if reaggregationTrigger != "" {
+			aggregationTask.PrepareLog(log.Warn()).
+				Str("reaggregation trigger", reaggregationTrigger).
+				Msg("AUDIT: scheduled aggregation task for reaggregation trigger, deleting trigger")
+			if err := ownValidationBucket.DeleteReaggregationTrigger(aggregationID, reaggregationTrigger); err != nil {
+				aggregationTask.PrepareLog(log.Err(err)).
+					Msgf("failed to delete reaggregation trigger: %s", err)
+			}
+		}
+
+		aggregationsStarted.inc(aggregationID)
+		aggregationSchedulingLatency.WithLabelValues(aggregationID).
+			Observe(clock.Now().Sub(aggregationWindow.End).Seconds())
 		numberOfBatchesInAggregation.WithLabelValues(aggregationID).Set(float64(len(batches)))
 	})
 
-	return nil
+	return false, nil
 }
 
+// enqueueIntakeTasks enqueues intake tasks for each of the ready batches that
+// has no task marker. If ownValidations is non-nil, batches whose IDs are in
+// ownValidations have already been intake'd, so instead of enqueueing a task
+// the missing task marker is written. Tasks for batches whose timestamps are
+// before lowPriorityBefore, if not zero, are scheduled with low priority.
+// Tasks are coalesced as configured by coalescing, in which case maxTasks
+// limits the batches scheduled rather than the tasks. Returns counts of the
+// batches for which tasks were scheduled, skipped or deferred.
 func enqueueIntakeTasks(
 	readyBatches batchpath.List,
 	taskMarkers map[string]struct{},
+	ownValidations map[string]struct{},
+	maxTasks int,
+	lowPriorityBefore time.Time,
+	coalescing intakeCoalescing,
 	ownValidationBucket storage.Bucket,
 	enqueuer task.Enqueuer,
-) error {
-	skippedDueToMarker := 0
-	scheduled := 0
+	events *taskevent.Publisher,
+	clock wftime.Clock,
+) (intakeTaskCounts, error) {
+	var counts intakeTaskCounts
+	var toCoalesce batchpath.List
 
 	for _, batch := range readyBatches {
 		intakeTask := task.IntakeBatch{
@@ -635,11 +2413,41 @@ func enqueueIntakeTasks(
 			BatchID:       batch.ID,
 			Date:          wftime.Timestamp(batch.Time),
 			TraceID:       uuid.New(),
+			Delivery:      task.DeliveryAttributes{Priority: intakePriority(batch, lowPriorityBefore)},
 		}
 
 		if _, ok := taskMarkers[intakeTask.Marker()]; ok {
-			skippedDueToMarker++
-			intakesSkippedDueToMarker.WithLabelValues(batch.AggregationID).Inc()
+			counts.skippedDueToMarker++
+			intakesSkippedDueToMarker.inc(batch.AggregationID)
+			events.Skipped(intakeTask, taskevent.ReasonMarker)
+			continue
+		}
+
+		if _, ok := ownValidations[batch.ID]; ok {
+			intakeTask.PrepareLog(log.Info()).
+				Str("batch", batch.String()).
+				Msg("found own validation for batch with no task marker, backfilling intake task marker")
+			if err := ownValidationBucket.WriteTaskMarker(intakeTask.Marker()); err != nil {
+				return counts, fmt.Errorf("couldn't backfill intake task marker: %w", err)
+			}
+			counts.skippedDueToOwnValidation++
+			intakesSkippedDueToOwnValidation.inc(batch.AggregationID)
+			events.Skipped(intakeTask, taskevent.ReasonOwnValidation)
+			continue
+		}
+
+		// Batches are sorted oldest first, so the newest batches are
+		// deferred. With no task marker, they will be found again next run.
+		if maxTasks > 0 && counts.scheduled >= maxTasks {
+			counts.deferred++
+			intakesDeferred.inc(batch.AggregationID)
+			events.Skipped(intakeTask, taskevent.ReasonDeferred)
+			continue
+		}
+
+		counts.scheduled++
+		if coalescing.window > 0 {
+			toCoalesce = append(toCoalesce, batch)
 			continue
 		}
 
@@ -647,13 +2455,19 @@ func enqueueIntakeTasks(
 			Str("batch", batch.String()).
 			Msg("scheduling intake task for batch")
 
-		scheduled++
 		enqueuer.Enqueue(intakeTask, func(err error) {
 			if err != nil {
 				intakeTask.PrepareLog(log.Err(err)).
 					Msg("failed to enqueue intake task")
+				if err := writeDeadLetterTask(ownValidationBucket, intakeTask); err != nil {
+					intakeTask.PrepareLog(log.Err(err)).
+						Msg("failed to write dead-letter intake task")
+					return
+				}
+				intakesDeadLettered.inc(batch.AggregationID)
 				return
 			}
+			events.Scheduled(intakeTask)
 			// Write a marker to cloud storage to ensure we don't schedule
 			// redundant tasks
 			if err := ownValidationBucket.WriteTaskMarker(intakeTask.Marker()); err != nil {
@@ -662,14 +2476,144 @@ func enqueueIntakeTasks(
 				return
 			}
 
-			intakesStarted.WithLabelValues(batch.AggregationID).Inc()
+			intakesStarted.inc(batch.AggregationID)
+			intakeSchedulingLatency.WithLabelValues(batch.AggregationID).
+				Observe(clock.Now().Sub(batch.Time).Seconds())
 		})
 	}
+	for _, batches := range coalescing.coalesce(toCoalesce) {
+		// Batches are coalesced oldest first, so the task is low priority
+		// only if its newest batch is.
+		priority := intakePriority(batches[len(batches)-1], lowPriorityBefore)
+		enqueueCoalescedIntakeTask(batches, priority, ownValidationBucket, enqueuer, events, clock)
+	}
 
 	log.Info().
-		Int("skipped batches", skippedDueToMarker).
-		Int("scheduled batches", scheduled).
+		Int("skipped batches", counts.skippedDueToMarker).
+		Int("skipped batches with own validations", counts.skippedDueToOwnValidation).
+		Int("deferred batches", counts.deferred).
+		Int("scheduled batches", counts.scheduled).
 		Msg("skipped and scheduled intake tasks")
 
+	return counts, nil
+}
+
+// intakePriority returns the priority of the intake task of batch: low if its
+// timestamp is before lowPriorityBefore, and the default otherwise, or if
+// lowPriorityBefore is zero.
+func intakePriority(batch *batchpath.BatchPath, lowPriorityBefore time.Time) task.Priority {
+	if !lowPriorityBefore.IsZero() && batch.Time.Before(lowPriorityBefore) {
+		return task.PriorityLow
+	}
+	return task.PriorityDefault
+}
+
+// intakeCoalescing configures the coalescing of the intake tasks of several
+// batches into a single task. The zero value coalesces no tasks.
+type intakeCoalescing struct {
+	// window, if non-zero, is the length of the windows, aligned to UTC,
+	// within which the intake tasks of batches are coalesced.
+	window time.Duration
+	// maxBatches is the most batches in a coalesced task.
+	maxBatches int
+}
+
+// coalesce groups batches into the batches of coalesced intake tasks: those
+// whose timestamps fall in the same window, oldest first, at most
+// c.maxBatches at a time.
+func (c intakeCoalescing) coalesce(batches batchpath.List) []batchpath.List {
+	sorted := append(batchpath.List{}, batches...)
+	sort.Stable(sorted)
+
+	groups := []batchpath.List{}
+	var group batchpath.List
+	for _, batch := range sorted {
+		if len(group) > 0 && (len(group) >= c.maxBatches || !batch.Time.Truncate(c.window).Equal(group[0].Time.Truncate(c.window))) {
+			groups = append(groups, group)
+			group = nil
+		}
+		group = append(group, batch)
+	}
+	if len(group) > 0 {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// enqueueCoalescedIntakeTask enqueues a single intake task for the batches,
+// and once it is enqueued, writes the intake task marker of each batch, as
+// enqueueIntakeTasks does for the intake task of a single batch.
+func enqueueCoalescedIntakeTask(
+	batches batchpath.List,
+	priority task.Priority,
+	ownValidationBucket storage.Bucket,
+	enqueuer task.Enqueuer,
+	events *taskevent.Publisher,
+	clock wftime.Clock,
+) {
+	aggregationID := batches[0].AggregationID
+	intakeTask := task.IntakeBatches{
+		AggregationID: aggregationID,
+		TraceID:       uuid.New(),
+		Delivery:      task.DeliveryAttributes{Priority: priority},
+	}
+	for _, batch := range batches {
+		intakeTask.Batches = append(intakeTask.Batches, task.Batch{ID: batch.ID, Time: wftime.Timestamp(batch.Time)})
+	}
+
+	intakeTask.PrepareLog(log.Info()).
+		Str("first batch", batches[0].String()).
+		Msg("scheduling coalesced intake task for batches")
+
+	enqueuer.Enqueue(intakeTask, func(err error) {
+		if err != nil {
+			intakeTask.PrepareLog(log.Err(err)).
+				Msg("failed to enqueue coalesced intake task")
+			if err := writeDeadLetterTask(ownValidationBucket, intakeTask); err != nil {
+				intakeTask.PrepareLog(log.Err(err)).
+					Msg("failed to write dead-letter coalesced intake task")
+				return
+			}
+			for range batches {
+				intakesDeadLettered.inc(aggregationID)
+			}
+			return
+		}
+		events.Scheduled(intakeTask)
+		coalescedIntakesStarted.inc(aggregationID)
+		// A marker is written for each batch, so that its batches are
+		// treated like those with their own intake tasks.
+		for i, marker := range intakeTask.BatchMarkers() {
+			if err := ownValidationBucket.WriteTaskMarker(marker); err != nil {
+				intakeTask.PrepareLog(log.Err(err)).
+					Str("marker", marker).
+					Msg("failed to write intake task marker")
+				continue
+			}
+			intakesStarted.inc(aggregationID)
+			intakeSchedulingLatency.WithLabelValues(aggregationID).
+				Observe(clock.Now().Sub(batches[i].Time).Seconds())
+		}
+	})
+}
+
+// intakeTaskCounts counts the batches considered by enqueueIntakeTasks.
+type intakeTaskCounts struct {
+	scheduled                 int
+	skippedDueToMarker        int
+	skippedDueToOwnValidation int
+	deferred                  int
+}
+
+// writeDeadLetterTask writes the serialized form of a task which could not be
+// enqueued to the bucket, so that it can be replayed later.
+func writeDeadLetterTask(bucket storage.Bucket, t task.Task) error {
+	jsonTask, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("marshaling task to JSON: %w", err)
+	}
+	if err := bucket.WriteDeadLetterTask(t.Marker(), jsonTask); err != nil {
+		return fmt.Errorf("couldn't write dead-letter task: %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+
+	"github.com/letsencrypt/prio-server/workflow-manager/batchpath"
+)
+
+// Policies for object names which don't parse as batch paths, per
+// --malformed-object-names.
+const (
+	// malformedNamesFail fails scheduling for the aggregation ID.
+	malformedNamesFail = "fail"
+	// malformedNamesSkip ignores the objects, counting & logging them.
+	malformedNamesSkip = "skip"
+	// malformedNamesReport ignores the objects as malformedNamesSkip does,
+	// and also lists their names in a report.
+	malformedNamesReport = "report"
+)
+
+// Labels identifying buckets in logs, metrics & reports.
+const (
+	ingestorBucketLabel       = "ingestor"
+	ownValidationBucketLabel  = "own-validation"
+	peerValidationBucketLabel = "peer-validation"
+)
+
+var malformedObjectNamesFound = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "workflow_manager_malformed_object_names",
+		Help: "The number of distinct object names which don't parse as batch paths found when listing batches, by aggregation ID & bucket ('ingestor', 'own-validation' or 'peer-validation')",
+	},
+	[]string{"aggregation_id", "bucket"},
+)
+
+// malformedNames collects the names of objects which don't parse as batch
+// paths, found by every listing of each bucket for an aggregation ID during a
+// run, by bucket label.
+type malformedNames map[string]map[string]struct{}
+
+// quarantineNamesReport lists the names of objects in a bucket which don't
+// parse as batch paths, and which were therefore ignored.
+type quarantineNamesReport struct {
+	AggregationID string    `json:"aggregation-id"`
+	Bucket        string    `json:"bucket"`
+	Time          time.Time `json:"time"`
+	Names         []string  `json:"names"`
+}
+
+// readyBatches calls batchpath.ReadyBatches on files listed from the bucket
+// with the given label, handling object names which don't parse as batch paths
+// according to config.malformedNamePolicy. Unless the policy is
+// malformedNamesFail, such names are logged & collected in
+// config.malformedNames rather than causing an error.
+func readyBatches(config scheduleTasksConfig, bucket string, files []string, infix string, acceptSignatureOnly bool) (*batchpath.ReadyBatchesResult, error) {
+	skipMalformed := config.malformedNamePolicy != "" && config.malformedNamePolicy != malformedNamesFail
+	result, err := batchpath.ReadyBatches(files, infix, acceptSignatureOnly, skipMalformed)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range result.MalformedNames {
+		log.Warn().
+			Str("aggregation ID", config.aggregationID).
+			Str("bucket", bucket).
+			Str("object", name).
+			Msg("ignoring object whose name doesn't parse as a batch path")
+		if config.malformedNames != nil {
+			if config.malformedNames[bucket] == nil {
+				config.malformedNames[bucket] = map[string]struct{}{}
+			}
+			config.malformedNames[bucket][name] = struct{}{}
+		}
+	}
+	return result, nil
+}
+
+// reportMalformedNames updates the malformed object name metrics with the
+// names collected in config.malformedNames and, if config.malformedNamePolicy
+// is malformedNamesReport, writes a quarantineNamesReport for each bucket in
+// which any were found to
+// "reports/quarantine-names/${aggregation-id}/${bucket}.json" in the own
+// validation bucket. Reports are rewritten by each run which finds malformed
+// names in the bucket. Failure to write a report is logged.
+func reportMalformedNames(config scheduleTasksConfig) {
+	for _, bucket := range []string{ingestorBucketLabel, ownValidationBucketLabel, peerValidationBucketLabel} {
+		malformedObjectNamesFound.WithLabelValues(config.aggregationID, bucket).Set(float64(len(config.malformedNames[bucket])))
+		if config.malformedNamePolicy != malformedNamesReport || len(config.malformedNames[bucket]) == 0 {
+			continue
+		}
+
+		report := quarantineNamesReport{
+			AggregationID: config.aggregationID,
+			Bucket:        bucket,
+			Time:          config.clock.Now().UTC(),
+		}
+		for name := range config.malformedNames[bucket] {
+			report.Names = append(report.Names, name)
+		}
+		sort.Strings(report.Names)
+		if err := writeQuarantineNamesReport(config, report); err != nil {
+			log.Err(err).
+				Str("aggregation ID", config.aggregationID).
+				Str("bucket", bucket).
+				Msgf("failed to write quarantined object names report: %s", err)
+		}
+	}
+}
+
+func writeQuarantineNamesReport(config scheduleTasksConfig, report quarantineNamesReport) error {
+	reportJSON, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't marshal quarantined object names report as JSON: %w", err)
+	}
+	name := fmt.Sprintf("quarantine-names/%s/%s.json", report.AggregationID, report.Bucket)
+	if err := config.ownValidationBucket.WriteReport(name, reportJSON); err != nil {
+		return fmt.Errorf("couldn't write quarantined object names report: %w", err)
+	}
+	return nil
+}
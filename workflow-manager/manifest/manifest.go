@@ -0,0 +1,180 @@
+// Package manifest fetches the manifests published by other servers in a
+// Prio deployment.
+package manifest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// maxManifestSize bounds the size of a fetched manifest. Manifests are a few
+// hundred bytes; anything much larger is not a manifest.
+const maxManifestSize = 1 << 20
+
+// PortalServerGlobalManifest is the global manifest published by a portal
+// server, naming the buckets to which the PHA and facilitator servers write
+// sum parts.
+type PortalServerGlobalManifest struct {
+	// Format is the version of the manifest.
+	Format int `json:"format"`
+	// FacilitatorSumPartBucket is the URL of the bucket to which facilitator
+	// servers write sum parts, e.g. "s3://{region}/{name}" or "gs://{name}".
+	FacilitatorSumPartBucket string `json:"facilitator-sum-part-bucket"`
+	// PHASumPartBucket is the URL of the bucket to which PHA servers write
+	// sum parts.
+	PHASumPartBucket string `json:"pha-sum-part-bucket"`
+}
+
+// FetchPortalServerGlobalManifest fetches the global manifest published by the
+// portal server at baseURL, e.g. "https://portal.example.com".
+func FetchPortalServerGlobalManifest(client *http.Client, baseURL string) (*PortalServerGlobalManifest, error) {
+	var manifest PortalServerGlobalManifest
+	url, err := fetchGlobalManifest(client, baseURL, "portal server", &manifest)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Format != 1 {
+		return nil, fmt.Errorf("unsupported portal server global manifest format %d", manifest.Format)
+	}
+	if manifest.FacilitatorSumPartBucket == "" || manifest.PHASumPartBucket == "" {
+		return nil, fmt.Errorf("portal server global manifest from %s is missing a sum part bucket", url)
+	}
+	return &manifest, nil
+}
+
+// fetchGlobalManifest fetches the global manifest published by the server of
+// the given kind at baseURL, and decodes it into manifest. It returns the URL
+// fetched.
+func fetchGlobalManifest(client *http.Client, baseURL, kind string, manifest interface{}) (string, error) {
+	url := fmt.Sprintf("%s/global-manifest.json", strings.TrimSuffix(baseURL, "/"))
+	if !strings.HasPrefix(url, "https://") {
+		return "", fmt.Errorf("%s manifest URL %q is not https", kind, url)
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("fetching %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return "", fmt.Errorf("reading body of %s: %w", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status code %d from %s: %s", resp.StatusCode, url, string(body))
+	}
+	if err := json.Unmarshal(body, manifest); err != nil {
+		return "", fmt.Errorf("decoding %s global manifest from %s: %w", kind, url, err)
+	}
+	return url, nil
+}
+
+// IsFirst returns true if sumPartBucket is the PHA sum part bucket, i.e. if the
+// data share processor writing sum parts to it is "first", or false if it is
+// the facilitator sum part bucket. An error is returned if it is neither.
+func (m *PortalServerGlobalManifest) IsFirst(sumPartBucket string) (bool, error) {
+	switch strings.TrimSuffix(sumPartBucket, "/") {
+	case strings.TrimSuffix(m.PHASumPartBucket, "/"):
+		return true, nil
+	case strings.TrimSuffix(m.FacilitatorSumPartBucket, "/"):
+		return false, nil
+	default:
+		return false, fmt.Errorf("sum part bucket %q is neither the PHA (%q) nor the facilitator (%q) sum part bucket in the portal server global manifest",
+			sumPartBucket, m.PHASumPartBucket, m.FacilitatorSumPartBucket)
+	}
+}
+
+// IngestionServerGlobalManifest is the global manifest published by an
+// ingestion server, holding the public keys with which it signs ingestion
+// batches. Only the fields needed to verify batch signatures are decoded.
+type IngestionServerGlobalManifest struct {
+	// Format is the version of the manifest.
+	Format int `json:"format"`
+	// BatchSigningPublicKeys maps the key identifiers found in batch
+	// signatures to the public keys which verify them.
+	BatchSigningPublicKeys map[string]BatchSigningPublicKey `json:"batch-signing-public-keys"`
+}
+
+// BatchSigningPublicKey is a public key in an ingestion server's manifest.
+type BatchSigningPublicKey struct {
+	// PublicKey is the PEM encoding of the key's PKIX SubjectPublicKeyInfo
+	// structure. It must be an ECDSA P-256 key.
+	PublicKey string `json:"public-key"`
+	// Expiration is the ISO 8601 encoded UTC date at which the key expires.
+	Expiration string `json:"expiration,omitempty"`
+}
+
+// FetchIngestionServerGlobalManifest fetches the global manifest published by
+// the ingestion server at baseURL, e.g. "https://ingestor.example.com".
+func FetchIngestionServerGlobalManifest(client *http.Client, baseURL string) (*IngestionServerGlobalManifest, error) {
+	var manifest IngestionServerGlobalManifest
+	url, err := fetchGlobalManifest(client, baseURL, "ingestion server", &manifest)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Format != 1 {
+		return nil, fmt.Errorf("unsupported ingestion server global manifest format %d", manifest.Format)
+	}
+	if len(manifest.BatchSigningPublicKeys) == 0 {
+		return nil, fmt.Errorf("ingestion server global manifest from %s has no batch signing public keys", url)
+	}
+	return &manifest, nil
+}
+
+// BatchSigningPublicKey returns the parsed batch signing public key with the
+// given identifier.
+func (m *IngestionServerGlobalManifest) BatchSigningPublicKey(keyIdentifier string) (*ecdsa.PublicKey, error) {
+	key, ok := m.BatchSigningPublicKeys[keyIdentifier]
+	if !ok {
+		return nil, fmt.Errorf("no batch signing public key %q in ingestion server global manifest", keyIdentifier)
+	}
+	block, _ := pem.Decode([]byte(key.PublicKey))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("batch signing public key %q is not a PEM encoded public key", keyIdentifier)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse batch signing public key %q: %w", keyIdentifier, err)
+	}
+	ecdsaPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok || ecdsaPub.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("batch signing public key %q is not an ECDSA P-256 key", keyIdentifier)
+	}
+	return ecdsaPub, nil
+}
+
+// BatchSigningKeyCache fetches the global manifest of an ingestion server at
+// most once, the first time a key is requested, and serves batch signing
+// public keys from it thereafter. A failure to fetch the manifest is also
+// remembered. A BatchSigningKeyCache is safe for concurrent use; a new one
+// should be created for each run, so that rotated keys are picked up.
+type BatchSigningKeyCache struct {
+	client  *http.Client
+	baseURL string
+
+	once     sync.Once
+	manifest *IngestionServerGlobalManifest
+	err      error
+}
+
+// NewBatchSigningKeyCache returns a BatchSigningKeyCache for the ingestion
+// server whose global manifest is published at baseURL.
+func NewBatchSigningKeyCache(client *http.Client, baseURL string) *BatchSigningKeyCache {
+	return &BatchSigningKeyCache{client: client, baseURL: baseURL}
+}
+
+// Manifest returns the ingestion server's global manifest, fetching it if
+// this is the first call.
+func (c *BatchSigningKeyCache) Manifest() (*IngestionServerGlobalManifest, error) {
+	c.once.Do(func() {
+		c.manifest, c.err = FetchIngestionServerGlobalManifest(c.client, c.baseURL)
+	})
+	return c.manifest, c.err
+}
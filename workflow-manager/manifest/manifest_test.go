@@ -0,0 +1,225 @@
+package manifest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const globalManifest = `{
+	"format": 1,
+	"facilitator-sum-part-bucket": "gs://facilitator-bucket",
+	"pha-sum-part-bucket": "s3://us-west-1/pha-bucket"
+}`
+
+func TestFetchPortalServerGlobalManifest(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		status  int
+		body    string
+		wantErr bool
+	}{
+		{name: "valid", status: http.StatusOK, body: globalManifest},
+		{name: "not found", status: http.StatusNotFound, body: "not found", wantErr: true},
+		{name: "not JSON", status: http.StatusOK, body: "<html></html>", wantErr: true},
+		{name: "bad format", status: http.StatusOK, body: `{"format": 2, "facilitator-sum-part-bucket": "gs://f", "pha-sum-part-bucket": "gs://p"}`, wantErr: true},
+		{name: "missing bucket", status: http.StatusOK, body: `{"format": 1, "facilitator-sum-part-bucket": "gs://f"}`, wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/global-manifest.json" {
+					http.NotFound(w, r)
+					return
+				}
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+
+			manifest, err := FetchPortalServerGlobalManifest(server.Client(), server.URL+"/")
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got manifest %+v", manifest)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			want := PortalServerGlobalManifest{
+				Format:                   1,
+				FacilitatorSumPartBucket: "gs://facilitator-bucket",
+				PHASumPartBucket:         "s3://us-west-1/pha-bucket",
+			}
+			if *manifest != want {
+				t.Errorf("manifest = %+v, want %+v", *manifest, want)
+			}
+		})
+	}
+}
+
+func TestFetchPortalServerGlobalManifestNotHTTPS(t *testing.T) {
+	if _, err := FetchPortalServerGlobalManifest(http.DefaultClient, "http://portal.example.com"); err == nil {
+		t.Error("expected error for non-https URL")
+	}
+}
+
+func TestIsFirst(t *testing.T) {
+	manifest := PortalServerGlobalManifest{
+		Format:                   1,
+		FacilitatorSumPartBucket: "gs://facilitator-bucket",
+		PHASumPartBucket:         "s3://us-west-1/pha-bucket",
+	}
+	for _, test := range []struct {
+		bucket    string
+		wantFirst bool
+		wantErr   bool
+	}{
+		{bucket: "s3://us-west-1/pha-bucket", wantFirst: true},
+		{bucket: "gs://facilitator-bucket/", wantFirst: false},
+		{bucket: "gs://other-bucket", wantErr: true},
+	} {
+		first, err := manifest.IsFirst(test.bucket)
+		if (err != nil) != test.wantErr {
+			t.Errorf("IsFirst(%q) error = %v, wantErr %t", test.bucket, err, test.wantErr)
+			continue
+		}
+		if first != test.wantFirst {
+			t.Errorf("IsFirst(%q) = %t, want %t", test.bucket, first, test.wantFirst)
+		}
+	}
+}
+
+func publicKeyPEM(t *testing.T, pub interface{}) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("couldn't marshal public key: %s", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func ingestionServerManifest(t *testing.T, keys map[string]string) string {
+	t.Helper()
+	manifest := map[string]interface{}{
+		"format": 1,
+		"server-identity": map[string]string{
+			"gcp-service-account-email": "ingestor@example.iam.gserviceaccount.com",
+		},
+	}
+	batchSigningPublicKeys := map[string]BatchSigningPublicKey{}
+	for id, keyPEM := range keys {
+		batchSigningPublicKeys[id] = BatchSigningPublicKey{PublicKey: keyPEM, Expiration: "2120-01-01T00:00:00Z"}
+	}
+	manifest["batch-signing-public-keys"] = batchSigningPublicKeys
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("couldn't marshal manifest: %s", err)
+	}
+	return string(body)
+}
+
+func TestIngestionServerGlobalManifest(t *testing.T) {
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate key: %s", err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate key: %s", err)
+	}
+	body := ingestionServerManifest(t, map[string]string{
+		"p256-key": publicKeyPEM(t, &p256Key.PublicKey),
+		"p384-key": publicKeyPEM(t, &p384Key.PublicKey),
+		"bad-key":  "not a key",
+	})
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/global-manifest.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	manifest, err := FetchIngestionServerGlobalManifest(server.Client(), server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	key, err := manifest.BatchSigningPublicKey("p256-key")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !key.Equal(&p256Key.PublicKey) {
+		t.Errorf("BatchSigningPublicKey(p256-key) = %v, want %v", key, p256Key.PublicKey)
+	}
+	for id, wantErr := range map[string]string{
+		"p384-key":    "not an ECDSA P-256 key",
+		"bad-key":     "not a PEM encoded public key",
+		"missing-key": "no batch signing public key",
+	} {
+		if _, err := manifest.BatchSigningPublicKey(id); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("BatchSigningPublicKey(%s) error = %v, want error containing %q", id, err, wantErr)
+		}
+	}
+}
+
+func TestFetchIngestionServerGlobalManifestInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		body string
+	}{
+		{name: "bad format", body: `{"format": 2, "batch-signing-public-keys": {"key": {"public-key": "pem"}}}`},
+		{name: "no keys", body: `{"format": 1, "batch-signing-public-keys": {}}`},
+		{name: "not JSON", body: "<html></html>"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+
+			if manifest, err := FetchIngestionServerGlobalManifest(server.Client(), server.URL); err == nil {
+				t.Errorf("expected error, got manifest %+v", manifest)
+			}
+		})
+	}
+}
+
+func TestBatchSigningKeyCache(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate key: %s", err)
+	}
+	body := ingestionServerManifest(t, map[string]string{"key": publicKeyPEM(t, &key.PublicKey)})
+
+	var fetches int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	cache := NewBatchSigningKeyCache(server.Client(), server.URL)
+	for i := 0; i < 3; i++ {
+		manifest, err := cache.Manifest()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := manifest.BatchSigningPublicKey("key"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("manifest fetched %d times, want 1", fetches)
+	}
+}
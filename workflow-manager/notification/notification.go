@@ -0,0 +1,244 @@
+// Package notification receives notifications of objects written to cloud
+// storage buckets, so that batches can be discovered as they are written
+// rather than by listing buckets.
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/rs/zerolog/log"
+
+	leaws "github.com/letsencrypt/prio-server/workflow-manager/aws"
+)
+
+// Source is a source of notifications of objects written to a bucket.
+type Source interface {
+	// Receive invokes handle with the name of each object whose creation is
+	// notified, until ctx is canceled, at which point Receive returns nil.
+	// Notifications are acknowledged once handle returns, so each object is
+	// handled at least once, but may be handled more than once.
+	Receive(ctx context.Context, handle func(object string)) error
+}
+
+// GCPPubSubSource implements Source using Google Cloud Storage Pub/Sub
+// notifications, delivered to a Pub/Sub subscription.
+//
+// https://cloud.google.com/storage/docs/pubsub-notifications
+type GCPPubSubSource struct {
+	subscription *pubsub.Subscription
+	bucket       string
+}
+
+// NewGCPPubSubSource creates a Source receiving notifications for objects in
+// the GCS bucket with the provided name from the Pub/Sub subscription with
+// the provided resource name, e.g. "projects/prio/subscriptions/ingestion".
+// Notifications for other buckets are ignored.
+func NewGCPPubSubSource(subscriptionName, bucket string) (*GCPPubSubSource, error) {
+	parts := strings.Split(subscriptionName, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[2] != "subscriptions" || parts[1] == "" || parts[3] == "" {
+		return nil, fmt.Errorf("malformed subscription name %q, want projects/{project}/subscriptions/{subscription}", subscriptionName)
+	}
+
+	// Google documentation advises against timeouts on client creation
+	// https://godoc.org/cloud.google.com/go#hdr-Timeouts_and_Cancellation
+	client, err := pubsub.NewClient(context.Background(), parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("pubsub.NewClient: %w", err)
+	}
+
+	return &GCPPubSubSource{subscription: client.Subscription(parts[3]), bucket: bucket}, nil
+}
+
+func (s *GCPPubSubSource) Receive(ctx context.Context, handle func(object string)) error {
+	if err := s.subscription.Receive(ctx, func(_ context.Context, message *pubsub.Message) {
+		if object, ok := ParseGCSNotification(message.Attributes, s.bucket); ok {
+			handle(object)
+		}
+		message.Ack()
+	}); err != nil {
+		return fmt.Errorf("receiving from subscription %s: %w", s.subscription, err)
+	}
+	return nil
+}
+
+// ParseGCSNotification returns the name of the object whose creation is
+// notified by a GCS Pub/Sub notification with the provided attributes, if the
+// notification is for the creation of an object in bucket.
+func ParseGCSNotification(attributes map[string]string, bucket string) (string, bool) {
+	if attributes["eventType"] != "OBJECT_FINALIZE" || attributes["bucketId"] != bucket {
+		return "", false
+	}
+	object := attributes["objectId"]
+	return object, object != ""
+}
+
+// sqsWaitTime is how long each request to receive messages from SQS waits for
+// a message to arrive before returning empty, in seconds. This is the longest
+// wait SQS allows.
+const sqsWaitTime = 20
+
+// AWSSQSSource implements Source using Amazon S3 event notifications,
+// delivered to an SQS queue either directly, via an SNS topic, or via Amazon
+// EventBridge.
+//
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/EventNotifications.html
+type AWSSQSSource struct {
+	service  sqsiface.SQSAPI
+	queueURL string
+	bucket   string
+}
+
+// NewAWSSQSSource creates a Source receiving notifications for objects in the
+// S3 bucket with the provided name from the SQS queue with the provided URL,
+// e.g. "https://sqs.us-west-2.amazonaws.com/123456789012/ingestion".
+// Notifications for other buckets are ignored. If identity is not empty, it is
+// the ARN of the role assumed to receive messages from the queue.
+func NewAWSSQSSource(queueURL, identity, bucket string) (*AWSSQSSource, error) {
+	region, err := sqsQueueRegion(queueURL)
+	if err != nil {
+		return nil, err
+	}
+	session, config, err := leaws.ClientConfig(region, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AWSSQSSource{
+		service:  sqs.New(session, config),
+		queueURL: queueURL,
+		bucket:   bucket,
+	}, nil
+}
+
+// sqsQueueRegion returns the AWS region of the SQS queue with the provided
+// URL, e.g. "us-west-2" for
+// "https://sqs.us-west-2.amazonaws.com/123456789012/ingestion".
+func sqsQueueRegion(queueURL string) (string, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return "", fmt.Errorf("parsing SQS queue URL: %w", err)
+	}
+	hostParts := strings.Split(u.Hostname(), ".")
+	if u.Scheme != "https" || len(hostParts) < 3 || hostParts[0] != "sqs" || hostParts[1] == "" {
+		return "", fmt.Errorf("malformed SQS queue URL %q, want https://sqs.{region}.amazonaws.com/{account}/{queue}", queueURL)
+	}
+	return hostParts[1], nil
+}
+
+func (s *AWSSQSSource) Receive(ctx context.Context, handle func(object string)) error {
+	for {
+		output, err := s.service.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(s.queueURL),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(sqsWaitTime),
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("receiving from SQS queue %s: %w", s.queueURL, err)
+		}
+
+		for _, message := range output.Messages {
+			objects, err := ParseS3Notification(aws.StringValue(message.Body), s.bucket)
+			if err != nil {
+				// A malformed message will never become well-formed, so it is
+				// deleted rather than redelivered.
+				log.Err(err).Str("message ID", aws.StringValue(message.MessageId)).
+					Msgf("ignoring malformed S3 event notification: %s", err)
+			}
+			for _, object := range objects {
+				handle(object)
+			}
+			if _, err := s.service.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(s.queueURL),
+				ReceiptHandle: message.ReceiptHandle,
+			}); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return fmt.Errorf("deleting message from SQS queue %s: %w", s.queueURL, err)
+			}
+		}
+	}
+}
+
+// s3Notification is the subset of an S3 event notification, an SNS
+// notification wrapping one, or an EventBridge event, needed to determine
+// which objects were created.
+type s3Notification struct {
+	// S3 event notifications.
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+
+	// SNS notifications.
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+
+	// EventBridge events.
+	DetailType string `json:"detail-type"`
+	Detail     struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key string `json:"key"`
+		} `json:"object"`
+	} `json:"detail"`
+}
+
+// ParseS3Notification returns the names of the objects in bucket whose
+// creation is notified by body, which is an S3 event notification, an SNS
+// notification wrapping one, or an EventBridge "Object Created" event. Other
+// notifications, such as the test event S3 sends when notifications are
+// configured, notify no objects.
+func ParseS3Notification(body, bucket string) ([]string, error) {
+	var notification s3Notification
+	if err := json.Unmarshal([]byte(body), &notification); err != nil {
+		return nil, fmt.Errorf("unmarshaling notification: %w", err)
+	}
+
+	if notification.Type == "Notification" {
+		return ParseS3Notification(notification.Message, bucket)
+	}
+
+	if notification.DetailType != "" {
+		// EventBridge object keys are not URL-encoded.
+		if notification.DetailType != "Object Created" || notification.Detail.Bucket.Name != bucket || notification.Detail.Object.Key == "" {
+			return nil, nil
+		}
+		return []string{notification.Detail.Object.Key}, nil
+	}
+
+	var objects []string
+	for _, record := range notification.Records {
+		if !strings.HasPrefix(record.EventName, "ObjectCreated:") || record.S3.Bucket.Name != bucket {
+			continue
+		}
+		// S3 event notification object keys are URL-encoded, with spaces
+		// encoded as '+'.
+		object, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			return nil, fmt.Errorf("decoding object key %q: %w", record.S3.Object.Key, err)
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
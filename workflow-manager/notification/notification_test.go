@@ -0,0 +1,168 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+func TestParseGCSNotification(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		attributes map[string]string
+		wantObject string
+		wantOK     bool
+	}{
+		{
+			name:       "object created",
+			attributes: map[string]string{"eventType": "OBJECT_FINALIZE", "bucketId": "ingestion", "objectId": "kittens-seen/2020/10/31/20/29/b8a5579a.batch"},
+			wantObject: "kittens-seen/2020/10/31/20/29/b8a5579a.batch",
+			wantOK:     true,
+		},
+		{
+			name:       "object deleted",
+			attributes: map[string]string{"eventType": "OBJECT_DELETE", "bucketId": "ingestion", "objectId": "kittens-seen/2020/10/31/20/29/b8a5579a.batch"},
+		},
+		{
+			name:       "other bucket",
+			attributes: map[string]string{"eventType": "OBJECT_FINALIZE", "bucketId": "other", "objectId": "kittens-seen/2020/10/31/20/29/b8a5579a.batch"},
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			object, ok := ParseGCSNotification(test.attributes, "ingestion")
+			if object != test.wantObject || ok != test.wantOK {
+				t.Errorf("Got (%q, %t), want (%q, %t)", object, ok, test.wantObject, test.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseS3Notification(t *testing.T) {
+	const s3Notification = `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"ingestion"},"object":{"key":"kittens-seen/2020/10/31/20/29/b8a5579a.batch%2Bsig"}}},{"eventName":"ObjectRemoved:Delete","s3":{"bucket":{"name":"ingestion"},"object":{"key":"deleted"}}},{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"other"},"object":{"key":"other"}}}]}`
+
+	snsMessage, err := json.Marshal(s3Notification)
+	if err != nil {
+		t.Fatalf("Couldn't marshal SNS message: %v", err)
+	}
+
+	for _, test := range []struct {
+		name        string
+		body        string
+		wantObjects []string
+		wantErr     bool
+	}{
+		{
+			name:        "S3 event notification",
+			body:        s3Notification,
+			wantObjects: []string{"kittens-seen/2020/10/31/20/29/b8a5579a.batch+sig"},
+		},
+		{
+			name:        "SNS notification",
+			body:        `{"Type":"Notification","Message":` + string(snsMessage) + `}`,
+			wantObjects: []string{"kittens-seen/2020/10/31/20/29/b8a5579a.batch+sig"},
+		},
+		{
+			name:        "EventBridge event",
+			body:        `{"detail-type":"Object Created","detail":{"bucket":{"name":"ingestion"},"object":{"key":"kittens-seen/2020/10/31/20/29/b8a5579a.batch.avro"}}}`,
+			wantObjects: []string{"kittens-seen/2020/10/31/20/29/b8a5579a.batch.avro"},
+		},
+		{
+			name: "EventBridge event for other bucket",
+			body: `{"detail-type":"Object Created","detail":{"bucket":{"name":"other"},"object":{"key":"kittens-seen/2020/10/31/20/29/b8a5579a.batch.avro"}}}`,
+		},
+		{
+			name: "test event",
+			body: `{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"ingestion"}`,
+		},
+		{
+			name:    "malformed",
+			body:    `Records`,
+			wantErr: true,
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			objects, err := ParseS3Notification(test.body, "ingestion")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Unexpected error (wantErr = %t): %v", test.wantErr, err)
+			}
+			if got, want := strings.Join(objects, ","), strings.Join(test.wantObjects, ","); got != want {
+				t.Errorf("Got objects %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSQSQueueRegion(t *testing.T) {
+	region, err := sqsQueueRegion("https://sqs.us-west-2.amazonaws.com/123456789012/ingestion")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if region != "us-west-2" {
+		t.Errorf("Got region %q, want %q", region, "us-west-2")
+	}
+
+	for _, queueURL := range []string{"", "http://sqs.us-west-2.amazonaws.com/123456789012/ingestion", "https://example.com/ingestion"} {
+		if _, err := sqsQueueRegion(queueURL); err == nil {
+			t.Errorf("Expected error for queue URL %q", queueURL)
+		}
+	}
+}
+
+// fakeSQS implements the parts of sqsiface.SQSAPI used to receive
+// notifications, delivering each of messages once, then canceling the
+// receiving context.
+type fakeSQS struct {
+	sqsiface.SQSAPI
+	messages []string
+	cancel   context.CancelFunc
+	deleted  []string
+}
+
+func (f *fakeSQS) ReceiveMessageWithContext(ctx aws.Context, _ *sqs.ReceiveMessageInput, _ ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	if len(f.messages) == 0 {
+		f.cancel()
+		return nil, ctx.Err()
+	}
+	body := f.messages[0]
+	f.messages = f.messages[1:]
+	return &sqs.ReceiveMessageOutput{Messages: []*sqs.Message{{Body: aws.String(body), ReceiptHandle: aws.String(body)}}}, nil
+}
+
+func (f *fakeSQS) DeleteMessageWithContext(_ aws.Context, input *sqs.DeleteMessageInput, _ ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	f.deleted = append(f.deleted, aws.StringValue(input.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func TestAWSSQSSourceReceive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	service := &fakeSQS{
+		messages: []string{
+			`{"detail-type":"Object Created","detail":{"bucket":{"name":"ingestion"},"object":{"key":"a"}}}`,
+			`malformed`,
+			`{"detail-type":"Object Created","detail":{"bucket":{"name":"ingestion"},"object":{"key":"b"}}}`,
+		},
+		cancel: cancel,
+	}
+	source := &AWSSQSSource{service: service, queueURL: "https://sqs.us-west-2.amazonaws.com/123456789012/ingestion", bucket: "ingestion"}
+
+	var objects []string
+	if err := source.Receive(ctx, func(object string) { objects = append(objects, object) }); err != nil {
+		t.Fatalf("Unexpected error from Receive: %v", err)
+	}
+	if got, want := strings.Join(objects, ","), "a,b"; got != want {
+		t.Errorf("Got objects %q, want %q", got, want)
+	}
+	// Malformed messages are deleted along with the others.
+	if got, want := len(service.deleted), 3; got != want {
+		t.Errorf("Got %d messages deleted, want %d", got, want)
+	}
+}
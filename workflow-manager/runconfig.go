@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/letsencrypt/prio-server/workflow-manager/storage"
+)
+
+// redacted replaces the values of flags which are redacted from run
+// configurations.
+const redacted = "REDACTED"
+
+// runConfig is a snapshot of the configuration with which a single run
+// scheduled tasks: the value of every flag, including defaults, and values
+// derived from them. It is recorded alongside task markers so that
+// post-incident analysis can determine which configuration was live when
+// tasks were scheduled.
+type runConfig struct {
+	RunID     string            `json:"run-id"`
+	Version   string            `json:"version"`
+	StartTime time.Time         `json:"start-time"`
+	Flags     map[string]string `json:"flags"`
+	Derived   map[string]string `json:"derived"`
+}
+
+// newRunConfig snapshots the value of every flag in flags. Identities (i.e.
+// flags whose names end in "-identity") are redacted, as are any credentials
+// in URLs. derived holds values derived from the flags, e.g. resolved
+// intervals, keyed by a name resembling a flag name.
+func newRunConfig(runID string, startTime time.Time, flags *flag.FlagSet, derived map[string]string) runConfig {
+	config := runConfig{
+		RunID:     runID,
+		Version:   BuildInfo,
+		StartTime: startTime.UTC(),
+		Flags:     map[string]string{},
+		Derived:   derived,
+	}
+	flags.VisitAll(func(f *flag.Flag) {
+		config.Flags[f.Name] = redactFlagValue(f.Name, f.Value.String())
+	})
+	return config
+}
+
+// redactFlagValue returns value, the value of the named flag, with any
+// identity or URL credentials, including S3 secret access keys given as
+// bucket URL parameters, redacted.
+func redactFlagValue(name, value string) string {
+	if value == "" {
+		return value
+	}
+	if strings.HasSuffix(name, "-identity") {
+		return redacted
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return value
+	}
+	query := u.Query()
+	if u.User == nil && !query.Has("secret_access_key") {
+		return value
+	}
+	if u.User != nil {
+		u.User = url.User(redacted)
+	}
+	if query.Has("secret_access_key") {
+		query.Set("secret_access_key", redacted)
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// runConfigName returns the name of the object recording the configuration
+// of the run with the given ID.
+func runConfigName(runID string) string {
+	return fmt.Sprintf("run-config-%s.json", runID)
+}
+
+// writeRunConfig records config in bucket.
+func writeRunConfig(bucket storage.Bucket, config runConfig) error {
+	contents, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't marshal run configuration: %w", err)
+	}
+	if err := bucket.WriteRunConfig(runConfigName(config.RunID), contents); err != nil {
+		return fmt.Errorf("couldn't write run configuration: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+
+	"github.com/letsencrypt/prio-server/workflow-manager/storage"
+)
+
+var (
+	newIngestionBatchesFound = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "workflow_manager_new_ingestion_batches",
+			Help: "The number of ingestion batches found in the intake window which were not found by the previous run",
+		},
+		[]string{"aggregation_id"},
+	)
+	relistedIngestionBatchesFound = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "workflow_manager_relisted_ingestion_batches",
+			Help: "The number of ingestion batches found in the intake window which were also found by the previous run",
+		},
+		[]string{"aggregation_id"},
+	)
+)
+
+// seenBatchesState is a Bloom filter of the IDs of the ingestion batches found
+// in the intake window by the previous run for an aggregation ID, persisted in
+// the own validation bucket between runs. Batches aren't removed from the
+// ingestion bucket while they're in the intake window, so the filter need only
+// hold the batches found by a single run: any batch older than that run's
+// intake window won't be found again.
+type seenBatchesState struct {
+	Bits   []byte `json:"bits"`
+	Hashes int    `json:"hashes"`
+}
+
+// seenBatchesStateName returns the name of the state object holding the seen
+// batches state for the aggregation ID.
+func seenBatchesStateName(aggregationID string) string {
+	return fmt.Sprintf("seen-batches-%s.json", aggregationID)
+}
+
+// newSeenBatchesState returns a filter holding batchIDs, sized such that the
+// probability that it falsely claims to hold any other batch ID is around
+// falsePositiveRate.
+func newSeenBatchesState(batchIDs []string, falsePositiveRate float64) seenBatchesState {
+	n := math.Max(float64(len(batchIDs)), 1)
+	bits := math.Ceil(-n * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	state := seenBatchesState{
+		Bits:   make([]byte, int(math.Ceil(bits/8))),
+		Hashes: int(math.Max(math.Round(bits/n*math.Ln2), 1)),
+	}
+	for _, batchID := range batchIDs {
+		state.add(batchID)
+	}
+	return state
+}
+
+// indices returns the positions of the bits set for the batch ID, derived
+// from two halves of its SHA-256 hash by double hashing.
+func (s seenBatchesState) indices(batchID string) []uint64 {
+	sum := sha256.Sum256([]byte(batchID))
+	h1, h2 := binary.BigEndian.Uint64(sum[0:8]), binary.BigEndian.Uint64(sum[8:16])
+	m := uint64(len(s.Bits)) * 8
+	indices := make([]uint64, s.Hashes)
+	for i := range indices {
+		indices[i] = (h1 + uint64(i)*h2) % m
+	}
+	return indices
+}
+
+func (s seenBatchesState) add(batchID string) {
+	for _, i := range s.indices(batchID) {
+		s.Bits[i/8] |= 1 << (i % 8)
+	}
+}
+
+// contains returns true if the batch ID is probably in the filter, and false
+// if it is certainly not. An empty filter contains nothing.
+func (s seenBatchesState) contains(batchID string) bool {
+	if len(s.Bits) == 0 || s.Hashes < 1 {
+		return false
+	}
+	for _, i := range s.indices(batchID) {
+		if s.Bits[i/8]&(1<<(i%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// updateSeenBatches counts how many of batchIDs, the ingestion batches found
+// by this run for the aggregation ID, were not found by the previous run per
+// the seen batches state stored in bucket, and updates the new & relisted
+// ingestion batch metrics, then replaces the state with a filter of batchIDs.
+// Unreadable state is logged and replaced, in which case every batch is
+// counted as new. The count of new batches may be an underestimate by around
+// falsePositiveRate times the number of new batches.
+func updateSeenBatches(bucket storage.Bucket, aggregationID string, batchIDs []string, falsePositiveRate float64) (newBatches int, err error) {
+	name := seenBatchesStateName(aggregationID)
+	contents, err := bucket.ReadState(name)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't read seen batches state: %w", err)
+	}
+
+	var previous seenBatchesState
+	if contents != nil {
+		if err := json.Unmarshal(contents, &previous); err != nil {
+			log.Warn().Err(err).
+				Str("aggregation ID", aggregationID).
+				Msgf("discarding malformed seen batches state: %s", err)
+			previous = seenBatchesState{}
+		}
+	}
+
+	for _, batchID := range batchIDs {
+		if !previous.contains(batchID) {
+			newBatches++
+		}
+	}
+
+	contents, err = json.Marshal(newSeenBatchesState(batchIDs, falsePositiveRate))
+	if err != nil {
+		return 0, fmt.Errorf("couldn't marshal seen batches state: %w", err)
+	}
+	if err := bucket.WriteState(name, contents); err != nil {
+		return 0, fmt.Errorf("couldn't write seen batches state: %w", err)
+	}
+
+	newIngestionBatchesFound.WithLabelValues(aggregationID).Set(float64(newBatches))
+	relistedIngestionBatchesFound.WithLabelValues(aggregationID).Set(float64(len(batchIDs) - newBatches))
+	log.Info().
+		Str("aggregation ID", aggregationID).
+		Int("new ingestion batches", newBatches).
+		Int("relisted ingestion batches", len(batchIDs)-newBatches).
+		Msg("compared ingestion batches to previous run")
+	return newBatches, nil
+}
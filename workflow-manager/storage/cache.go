@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	wftime "github.com/letsencrypt/prio-server/workflow-manager/time"
+)
+
+var (
+	cachedListingObjects = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "workflow_manager_cached_listing_objects_total",
+			Help: "The number of objects listed by storage bucket listings whose results were cached for the rest of the run, by bucket & operation",
+		},
+		[]string{"bucket", "operation"},
+	)
+	listingsSaved = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "workflow_manager_storage_listings_saved_total",
+			Help: "The number of storage bucket listings served from a listing cached earlier in the run rather than by the bucket, by bucket & operation",
+		},
+		[]string{"bucket", "operation"},
+	)
+)
+
+// CachingBucket implements Bucket by wrapping another Bucket, and serving
+// ListBatchFiles & ListIntakeTaskMarkers for a single aggregation ID, over any
+// interval within the one given to NewCachingBucket, from a single listing of
+// that interval, made the first time each is called. Listings for other
+// aggregation IDs or intervals, and all other operations, are passed to the
+// wrapped Bucket. Task markers successfully written through the CachingBucket
+// are added to the cached listing, so it reflects writes made during the run,
+// but objects written by anything else after the listing are not seen, so a
+// CachingBucket should be used for no longer than a single run.
+type CachingBucket struct {
+	Bucket
+	label         string
+	aggregationID string
+	interval      wftime.Interval
+
+	mu                sync.Mutex
+	batchFiles        []string
+	intakeTaskMarkers []string
+	listed            map[string]bool // by operation
+}
+
+// NewCachingBucket creates a bucket that caches listings of bucket's batch
+// files & intake task markers for aggregationID over interval. label
+// identifies the bucket in metrics, e.g. "own-validation".
+func NewCachingBucket(bucket Bucket, label, aggregationID string, interval wftime.Interval) *CachingBucket {
+	return &CachingBucket{
+		Bucket:        bucket,
+		label:         label,
+		aggregationID: aggregationID,
+		interval:      interval,
+		listed:        map[string]bool{},
+	}
+}
+
+// covers returns true if listings for aggregationID over interval may be
+// served from the cache.
+func (b *CachingBucket) covers(aggregationID string, interval wftime.Interval) bool {
+	return aggregationID == b.aggregationID &&
+		!interval.Begin.Before(b.interval.Begin) && !interval.End.After(b.interval.End)
+}
+
+// cached returns the cached listing for operation, populating it with list
+// if it has not yet been listed. b.mu must be held.
+func (b *CachingBucket) cached(operation string, cache *[]string, list func() ([]string, error)) ([]string, error) {
+	if b.listed[operation] {
+		listingsSaved.WithLabelValues(b.label, operation).Inc()
+		return *cache, nil
+	}
+	objects, err := list()
+	if err != nil {
+		return nil, err
+	}
+	cachedListingObjects.WithLabelValues(b.label, operation).Add(float64(len(objects)))
+	*cache = objects
+	b.listed[operation] = true
+	return objects, nil
+}
+
+func (b *CachingBucket) ListBatchFiles(aggregationID string, interval wftime.Interval) ([]string, error) {
+	if !b.covers(aggregationID, interval) {
+		return b.Bucket.ListBatchFiles(aggregationID, interval)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	files, err := b.cached("ListBatchFiles", &b.batchFiles, func() ([]string, error) {
+		return b.Bucket.ListBatchFiles(b.aggregationID, b.interval)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return withinInterval(files, aggregationID+"/", "2006/01/02/15/04", interval), nil
+}
+
+func (b *CachingBucket) ListIntakeTaskMarkers(aggregationID string, interval wftime.Interval) ([]string, error) {
+	if !b.covers(aggregationID, interval) {
+		return b.Bucket.ListIntakeTaskMarkers(aggregationID, interval)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	markers, err := b.cached("ListIntakeTaskMarkers", &b.intakeTaskMarkers, func() ([]string, error) {
+		return b.Bucket.ListIntakeTaskMarkers(b.aggregationID, b.interval)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return withinInterval(markers, "intake-"+aggregationID+"-", "2006-01-02-15-04", interval), nil
+}
+
+func (b *CachingBucket) WriteTaskMarker(marker string) error {
+	if err := b.Bucket.WriteTaskMarker(marker); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.listed["ListIntakeTaskMarkers"] && strings.HasPrefix(marker, "intake-"+b.aggregationID+"-") {
+		b.intakeTaskMarkers = append(b.intakeTaskMarkers, marker)
+	}
+	return nil
+}
+
+// withinInterval returns the names which consist of prefix, followed by a
+// timestamp in the given layout within interval. Names whose timestamp can't
+// be parsed are also returned, so that callers handle them as they would if
+// the listing had not been cached.
+func withinInterval(names []string, prefix, layout string, interval wftime.Interval) []string {
+	output := []string{}
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) && len(name) >= len(prefix)+len(layout) {
+			timestamp, err := time.Parse(layout, name[len(prefix):len(prefix)+len(layout)])
+			if err == nil && !interval.Includes(timestamp) {
+				continue
+			}
+		}
+		output = append(output, name)
+	}
+	return output
+}
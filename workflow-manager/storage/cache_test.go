@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	wftime "github.com/letsencrypt/prio-server/workflow-manager/time"
+)
+
+// listingBucket implements the parts of Bucket used in tests, returning fixed
+// listings and counting the listings made.
+type listingBucket struct {
+	Bucket
+	batchFiles        []string
+	intakeTaskMarkers []string
+	listErr           error
+	listings          int
+	writtenMarkers    []string
+}
+
+func (b *listingBucket) ListBatchFiles(string, wftime.Interval) ([]string, error) {
+	b.listings++
+	if b.listErr != nil {
+		return nil, b.listErr
+	}
+	return b.batchFiles, nil
+}
+
+func (b *listingBucket) ListIntakeTaskMarkers(string, wftime.Interval) ([]string, error) {
+	b.listings++
+	return b.intakeTaskMarkers, nil
+}
+
+func (b *listingBucket) WriteTaskMarker(marker string) error {
+	b.writtenMarkers = append(b.writtenMarkers, marker)
+	return nil
+}
+
+func mustInterval(t *testing.T, begin, end string) wftime.Interval {
+	t.Helper()
+	beginTime, err := time.Parse("2006/01/02/15/04", begin)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	endTime, err := time.Parse("2006/01/02/15/04", end)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	return wftime.Interval{Begin: beginTime, End: endTime}
+}
+
+func TestCachingBucketListBatchFiles(t *testing.T) {
+	files := []string{
+		"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch",
+		"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.sig",
+		"kittens-seen/2020/10/31/21/35/af97ffdd-00fc-4d6a-9790-e5c0de82e7b0.batch",
+		"kittens-seen/2020/10/31/22/35/79f0a477-b65c-47c9-a2bf-a3b56c33824a.batch",
+		"kittens-seen/2020/10/31/xx/79f0a477-b65c-47c9-a2bf-a3b56c33824a.batch",
+	}
+	wrapped := &listingBucket{batchFiles: files, listErr: errors.New("oops")}
+	bucket := NewCachingBucket(wrapped, "test", "kittens-seen", mustInterval(t, "2020/10/31/20/00", "2020/10/31/23/00"))
+
+	// Failed listings aren't cached.
+	if _, err := bucket.ListBatchFiles("kittens-seen", mustInterval(t, "2020/10/31/20/00", "2020/10/31/21/00")); err == nil {
+		t.Errorf("expected error")
+	}
+	wrapped.listErr = nil
+
+	for _, testCase := range []struct {
+		name          string
+		aggregationID string
+		interval      wftime.Interval
+		wantFiles     []string
+		wantListings  int
+	}{
+		{
+			name:          "first listing",
+			aggregationID: "kittens-seen",
+			interval:      mustInterval(t, "2020/10/31/20/00", "2020/10/31/21/00"),
+			// Malformed names are returned by every cached listing.
+			wantFiles:    []string{files[0], files[1], files[4]},
+			wantListings: 2,
+		},
+		{
+			name:          "cached listing",
+			aggregationID: "kittens-seen",
+			interval:      mustInterval(t, "2020/10/31/21/30", "2020/10/31/23/00"),
+			wantFiles:     files[2:],
+			wantListings:  2,
+		},
+		{
+			name:          "interval not covered",
+			aggregationID: "kittens-seen",
+			interval:      mustInterval(t, "2020/10/31/19/00", "2020/10/31/21/00"),
+			wantFiles:     files,
+			wantListings:  3,
+		},
+		{
+			name:          "other aggregation ID",
+			aggregationID: "puppies-seen",
+			interval:      mustInterval(t, "2020/10/31/20/00", "2020/10/31/21/00"),
+			wantFiles:     files,
+			wantListings:  4,
+		},
+	} {
+		got, err := bucket.ListBatchFiles(testCase.aggregationID, testCase.interval)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %q", testCase.name, err)
+		}
+		if !reflect.DeepEqual(got, testCase.wantFiles) {
+			t.Errorf("%s: got batch files %q, want %q", testCase.name, got, testCase.wantFiles)
+		}
+		if wrapped.listings != testCase.wantListings {
+			t.Errorf("%s: got %d listings, want %d", testCase.name, wrapped.listings, testCase.wantListings)
+		}
+	}
+}
+
+func TestCachingBucketListIntakeTaskMarkers(t *testing.T) {
+	wrapped := &listingBucket{intakeTaskMarkers: []string{
+		"intake-kittens-seen-2020-10-31-20-29-b8a5579a-f984-460a-a42d-2813cbf57771",
+		"intake-kittens-seen-2020-10-31-22-35-79f0a477-b65c-47c9-a2bf-a3b56c33824a",
+	}}
+	bucket := NewCachingBucket(wrapped, "test", "kittens-seen", mustInterval(t, "2020/10/31/20/00", "2020/10/31/23/00"))
+
+	markers, err := bucket.ListIntakeTaskMarkers("kittens-seen", mustInterval(t, "2020/10/31/20/00", "2020/10/31/21/00"))
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if !reflect.DeepEqual(markers, wrapped.intakeTaskMarkers[:1]) {
+		t.Errorf("unexpected markers %q", markers)
+	}
+
+	// Markers written through the bucket are added to the cached listing.
+	written := "intake-kittens-seen-2020-10-31-22-40-0f0317b2-c612-48c2-b08d-d98529d6eae4"
+	if err := bucket.WriteTaskMarker(written); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if err := bucket.WriteTaskMarker("aggregate-kittens-seen-2020-10-31-20-00-2020-10-31-23-00"); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if len(wrapped.writtenMarkers) != 2 {
+		t.Errorf("unexpected written markers %q", wrapped.writtenMarkers)
+	}
+
+	markers, err = bucket.ListIntakeTaskMarkers("kittens-seen", mustInterval(t, "2020/10/31/22/00", "2020/10/31/23/00"))
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if !reflect.DeepEqual(markers, []string{wrapped.intakeTaskMarkers[1], written}) {
+		t.Errorf("unexpected markers %q", markers)
+	}
+	if wrapped.listings != 1 {
+		t.Errorf("unexpected number of listings %d", wrapped.listings)
+	}
+}
@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/rs/zerolog/log"
+
+	leaws "github.com/letsencrypt/prio-server/workflow-manager/aws"
+	wftime "github.com/letsencrypt/prio-server/workflow-manager/time"
+)
+
+// Attributes of the items in a DynamoDB task marker table. The table's
+// partition key is "partition" and its sort key is "marker", both strings.
+const (
+	dynamoDBPartitionAttribute = "partition"
+	dynamoDBMarkerAttribute    = "marker"
+	dynamoDBCreatedAttribute   = "created"
+	// dynamoDBExpiryAttribute is the time after which the item may be deleted,
+	// in seconds since the epoch, as required by DynamoDB's TTL feature.
+	dynamoDBExpiryAttribute = "expiry"
+)
+
+// DynamoDBTaskMarkerStore is a TaskMarkerStore backed by a DynamoDB table.
+// Markers are written with a condition that they don't already exist, and
+// listed with strongly consistent queries, so that a marker is listed by any
+// query made after it is written.
+type DynamoDBTaskMarkerStore struct {
+	region    string
+	tableName string
+	identity  string
+	ttl       time.Duration
+	dryRun    bool
+	clock     wftime.Clock
+	// dynamoDBService is an implementation of dynamodbiface.DynamoDBAPI that
+	// may be optionally provided. If unset, DynamoDBTaskMarkerStore will use
+	// the AWS SDK to create a client that uses the real DynamoDB.
+	dynamoDBService dynamodbiface.DynamoDBAPI
+	// mu protects dynamoDBService, which is created on first use.
+	mu sync.Mutex
+}
+
+func newDynamoDBTaskMarkerStore(region, tableName, identity string, ttl time.Duration, dryRun bool) *DynamoDBTaskMarkerStore {
+	return &DynamoDBTaskMarkerStore{
+		region:    region,
+		tableName: tableName,
+		identity:  identity,
+		ttl:       ttl,
+		dryRun:    dryRun,
+		clock:     wftime.DefaultClock(),
+	}
+}
+
+func (s *DynamoDBTaskMarkerStore) service() (dynamodbiface.DynamoDBAPI, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dynamoDBService != nil {
+		return s.dynamoDBService, nil
+	}
+
+	sess, config, err := leaws.ClientConfig(s.region, s.identity)
+	if err != nil {
+		return nil, err
+	}
+
+	s.dynamoDBService = dynamodb.New(sess, config)
+	return s.dynamoDBService, nil
+}
+
+func (s *DynamoDBTaskMarkerStore) ListIntakeTaskMarkers(aggregationID string, interval wftime.Interval) ([]string, error) {
+	markers := []string{}
+	for _, partition := range intakeTaskMarkerPartitions(aggregationID, interval) {
+		partitionMarkers, err := s.listPartition(partition)
+		if err != nil {
+			return nil, err
+		}
+		markers = append(markers, partitionMarkers...)
+	}
+
+	return markers, nil
+}
+
+func (s *DynamoDBTaskMarkerStore) ListAggregateTaskMarkers(aggregationID string) ([]string, error) {
+	return s.listPartition(aggregateTaskMarkerPartition(aggregationID))
+}
+
+func (s *DynamoDBTaskMarkerStore) listPartition(partition string) ([]string, error) {
+	svc, err := s.service()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug().Msgf("querying DynamoDB table %s/%s for task markers in partition %s as %q",
+		s.region, s.tableName, partition, s.identity)
+	markers := []string{}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(s.tableName),
+		ConsistentRead:         aws.Bool(true),
+		KeyConditionExpression: aws.String("#partition = :partition"),
+		ProjectionExpression:   aws.String("#marker"),
+		ExpressionAttributeNames: map[string]*string{
+			"#partition": aws.String(dynamoDBPartitionAttribute),
+			"#marker":    aws.String(dynamoDBMarkerAttribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":partition": {S: aws.String(partition)},
+		},
+	}
+	var itemErr error
+	err = svc.QueryPages(input, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			marker, ok := item[dynamoDBMarkerAttribute]
+			if !ok || marker.S == nil {
+				itemErr = fmt.Errorf("item in partition %s has no string %q attribute", partition, dynamoDBMarkerAttribute)
+				return false
+			}
+			markers = append(markers, *marker.S)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dynamodb.QueryPages: %w", err)
+	}
+	if itemErr != nil {
+		return nil, itemErr
+	}
+
+	return markers, nil
+}
+
+func (s *DynamoDBTaskMarkerStore) WriteTaskMarker(marker string) error {
+	partition, err := taskMarkerPartition(marker)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("writing task marker %s to DynamoDB table %s/%s as %q", marker, s.region, s.tableName, s.identity)
+
+	if s.dryRun {
+		log.Info().Msg("dry run, skipping task marker write")
+		return nil
+	}
+
+	svc, err := s.service()
+	if err != nil {
+		return err
+	}
+
+	now := s.clock.Now()
+	item := map[string]*dynamodb.AttributeValue{
+		dynamoDBPartitionAttribute: {S: aws.String(partition)},
+		dynamoDBMarkerAttribute:    {S: aws.String(marker)},
+		dynamoDBCreatedAttribute:   {S: aws.String(now.UTC().Format(time.RFC3339))},
+	}
+	if s.ttl > 0 {
+		item[dynamoDBExpiryAttribute] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(now.Add(s.ttl).Unix(), 10)),
+		}
+	}
+
+	_, err = svc.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(s.tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(#marker)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#marker": aws.String(dynamoDBMarkerAttribute),
+		},
+	})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		log.Warn().Msgf("task marker %s already exists in DynamoDB table %s/%s", marker, s.region, s.tableName)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("dynamodb.PutItem: %w", err)
+	}
+
+	return nil
+}
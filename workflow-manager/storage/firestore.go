@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+
+	wftime "github.com/letsencrypt/prio-server/workflow-manager/time"
+)
+
+// Fields of the documents in a Firestore task marker collection. Each marker
+// is a document whose ID is the marker, in a subcollection of a document in
+// the task marker collection whose ID is the marker's partition, i.e.
+// "${collection}/${partition}/markers/${marker}".
+const (
+	firestoreMarkersCollection = "markers"
+	firestoreMarkerField       = "marker"
+	firestoreCreatedField      = "created"
+	// firestoreExpiryField is the time after which the document may be
+	// deleted, for use by a Firestore TTL policy.
+	firestoreExpiryField = "expiry"
+)
+
+// FirestoreTaskMarkerStore is a TaskMarkerStore backed by a Firestore
+// collection in the project's default database. Markers are created with a
+// precondition that they don't already exist, and Firestore offers strong
+// consistency for reads, so a marker is listed by any query made after it is
+// written.
+type FirestoreTaskMarkerStore struct {
+	project    string
+	collection string
+	ttl        time.Duration
+	dryRun     bool
+	clock      wftime.Clock
+	// firestoreService may be optionally provided. If unset,
+	// FirestoreTaskMarkerStore will create a client that uses the real
+	// Firestore with the ambient service account.
+	firestoreService *firestore.Service
+	// mu protects firestoreService, which is created on first use.
+	mu sync.Mutex
+}
+
+func newFirestoreTaskMarkerStore(project, collection string, ttl time.Duration, dryRun bool) *FirestoreTaskMarkerStore {
+	return &FirestoreTaskMarkerStore{
+		project:    project,
+		collection: collection,
+		ttl:        ttl,
+		dryRun:     dryRun,
+		clock:      wftime.DefaultClock(),
+	}
+}
+
+func (s *FirestoreTaskMarkerStore) service() (*firestore.Service, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.firestoreService != nil {
+		return s.firestoreService, nil
+	}
+
+	// Google documentation advises against timeouts on client creation
+	// https://godoc.org/cloud.google.com/go#hdr-Timeouts_and_Cancellation
+	service, err := firestore.NewService(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("firestore.NewService: %w", err)
+	}
+
+	s.firestoreService = service
+	return s.firestoreService, nil
+}
+
+// partitionDocument returns the name of the document whose subcollection holds
+// the markers in the partition.
+func (s *FirestoreTaskMarkerStore) partitionDocument(partition string) string {
+	return fmt.Sprintf("projects/%s/databases/(default)/documents/%s/%s", s.project, s.collection, partition)
+}
+
+func (s *FirestoreTaskMarkerStore) ListIntakeTaskMarkers(aggregationID string, interval wftime.Interval) ([]string, error) {
+	markers := []string{}
+	for _, partition := range intakeTaskMarkerPartitions(aggregationID, interval) {
+		partitionMarkers, err := s.listPartition(partition)
+		if err != nil {
+			return nil, err
+		}
+		markers = append(markers, partitionMarkers...)
+	}
+
+	return markers, nil
+}
+
+func (s *FirestoreTaskMarkerStore) ListAggregateTaskMarkers(aggregationID string) ([]string, error) {
+	return s.listPartition(aggregateTaskMarkerPartition(aggregationID))
+}
+
+func (s *FirestoreTaskMarkerStore) listPartition(partition string) ([]string, error) {
+	// This timeout has to cover potentially numerous roundtrips to the
+	// paginated API for listing documents, so we use a longer timeout than
+	// usual.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	service, err := s.service()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug().Msgf("listing Firestore collection %s/%s for task markers in partition %s as (ambient service account)",
+		s.project, s.collection, partition)
+	markers := []string{}
+	err = service.Projects.Databases.Documents.
+		List(s.partitionDocument(partition), firestoreMarkersCollection).
+		MaskFieldPaths(firestoreMarkerField).
+		PageSize(1000).
+		Pages(ctx, func(page *firestore.ListDocumentsResponse) error {
+			for _, document := range page.Documents {
+				marker, ok := document.Fields[firestoreMarkerField]
+				if !ok || marker.StringValue == "" {
+					return fmt.Errorf("document %s has no string %q field", document.Name, firestoreMarkerField)
+				}
+				markers = append(markers, marker.StringValue)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("firestore.ListDocuments: %w", err)
+	}
+
+	return markers, nil
+}
+
+func (s *FirestoreTaskMarkerStore) WriteTaskMarker(marker string) error {
+	partition, err := taskMarkerPartition(marker)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("writing task marker %s to Firestore collection %s/%s as (ambient service account)",
+		marker, s.project, s.collection)
+
+	if s.dryRun {
+		log.Info().Msg("dry run, skipping task marker write")
+		return nil
+	}
+
+	service, err := s.service()
+	if err != nil {
+		return err
+	}
+
+	now := s.clock.Now()
+	document := &firestore.Document{
+		Fields: map[string]firestore.Value{
+			firestoreMarkerField:  {StringValue: marker},
+			firestoreCreatedField: {TimestampValue: now.UTC().Format(time.RFC3339Nano)},
+		},
+	}
+	if s.ttl > 0 {
+		document.Fields[firestoreExpiryField] = firestore.Value{
+			TimestampValue: now.Add(s.ttl).UTC().Format(time.RFC3339Nano),
+		}
+	}
+
+	ctx, cancel := wftime.ContextWithTimeout()
+	defer cancel()
+
+	// CreateDocument fails if a document with the ID already exists.
+	_, err = service.Projects.Databases.Documents.
+		CreateDocument(s.partitionDocument(partition), firestoreMarkersCollection, document).
+		DocumentId(marker).
+		Context(ctx).
+		Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+		log.Warn().Msgf("task marker %s already exists in Firestore collection %s/%s", marker, s.project, s.collection)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("firestore.CreateDocument: %w", err)
+	}
+
+	return nil
+}
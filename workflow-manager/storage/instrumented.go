@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	wftime "github.com/letsencrypt/prio-server/workflow-manager/time"
+)
+
+var (
+	storageCalls = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "workflow_manager_storage_calls_total",
+			Help: "The number of attempts at storage bucket operations, successful or not, by bucket & operation",
+		},
+		[]string{"bucket", "operation"},
+	)
+	storageCallDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "workflow_manager_storage_call_duration_seconds",
+			Help:    "The time taken by attempts at storage bucket operations, successful or not, by bucket & operation",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 14), // 10 milliseconds to ~82 seconds
+		},
+		[]string{"bucket", "operation"},
+	)
+	storageListPages = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "workflow_manager_storage_list_pages_total",
+			Help: "The number of pages of object listings fetched from storage buckets, by bucket & operation",
+		},
+		[]string{"bucket", "operation"},
+	)
+	storageListedObjects = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "workflow_manager_storage_listed_objects_total",
+			Help: "The number of objects & prefixes returned by pages of object listings fetched from storage buckets, by bucket & operation",
+		},
+		[]string{"bucket", "operation"},
+	)
+)
+
+// recordListPage records that a page of objectCount objects & prefixes was
+// fetched from the bucket with the provided label by operation. Nothing is
+// recorded for a bucket without a label.
+func recordListPage(label, operation string, objectCount int) {
+	if label == "" {
+		return
+	}
+	storageListPages.WithLabelValues(label, operation).Inc()
+	storageListedObjects.WithLabelValues(label, operation).Add(float64(objectCount))
+}
+
+// InstrumentedBucket implements Bucket by wrapping another Bucket, and
+// recording the number & duration of its operations. If the wrapped bucket is
+// an S3Bucket or GCSBucket, the pages & objects fetched by each listing are
+// recorded too. An InstrumentedBucket should wrap the bucket returned by
+// NewBucket directly, so that each attempt made by a RetryingBucket is
+// recorded, and listings served by a CachingBucket or InventoryBucket are not.
+type InstrumentedBucket struct {
+	bucket Bucket
+	label  string
+}
+
+// NewInstrumentedBucket creates a bucket that records the operations on the
+// provided bucket. label identifies the bucket in metrics, e.g.
+// "own-validation".
+func NewInstrumentedBucket(bucket Bucket, label string) *InstrumentedBucket {
+	switch b := bucket.(type) {
+	case *S3Bucket:
+		b.label = label
+	case *GCSBucket:
+		b.label = label
+	}
+	return &InstrumentedBucket{bucket: bucket, label: label}
+}
+
+// do invokes f, recording it as an attempt at operation.
+func (b *InstrumentedBucket) do(operation string, f func() error) error {
+	start := time.Now()
+	err := f()
+	storageCalls.WithLabelValues(b.label, operation).Inc()
+	storageCallDuration.WithLabelValues(b.label, operation).Observe(time.Since(start).Seconds())
+	return err
+}
+
+func (b *InstrumentedBucket) ListAggregationIDs() ([]string, error) {
+	var ids []string
+	err := b.do("ListAggregationIDs", func() (err error) {
+		ids, err = b.bucket.ListAggregationIDs()
+		return
+	})
+	return ids, err
+}
+
+func (b *InstrumentedBucket) ListBatchFiles(aggregationID string, interval wftime.Interval) ([]string, error) {
+	var files []string
+	err := b.do("ListBatchFiles", func() (err error) {
+		files, err = b.bucket.ListBatchFiles(aggregationID, interval)
+		return
+	})
+	return files, err
+}
+
+func (b *InstrumentedBucket) ReadBatchFile(name string) ([]byte, error) {
+	var contents []byte
+	err := b.do("ReadBatchFile", func() (err error) {
+		contents, err = b.bucket.ReadBatchFile(name)
+		return
+	})
+	return contents, err
+}
+
+func (b *InstrumentedBucket) ListIntakeTaskMarkers(aggregationID string, interval wftime.Interval) ([]string, error) {
+	var markers []string
+	err := b.do("ListIntakeTaskMarkers", func() (err error) {
+		markers, err = b.bucket.ListIntakeTaskMarkers(aggregationID, interval)
+		return
+	})
+	return markers, err
+}
+
+func (b *InstrumentedBucket) ListAggregateTaskMarkers(aggregationID string) ([]string, error) {
+	var markers []string
+	err := b.do("ListAggregateTaskMarkers", func() (err error) {
+		markers, err = b.bucket.ListAggregateTaskMarkers(aggregationID)
+		return
+	})
+	return markers, err
+}
+
+func (b *InstrumentedBucket) WriteTaskMarker(marker string) error {
+	return b.do("WriteTaskMarker", func() error { return b.bucket.WriteTaskMarker(marker) })
+}
+
+func (b *InstrumentedBucket) DeleteTaskMarkers(aggregationID string, cutoff time.Time) (int, error) {
+	var deleted int
+	err := b.do("DeleteTaskMarkers", func() (err error) {
+		deleted, err = b.bucket.DeleteTaskMarkers(aggregationID, cutoff)
+		return
+	})
+	return deleted, err
+}
+
+func (b *InstrumentedBucket) DeleteBatchFiles(aggregationID string, cutoff time.Time) (DeletedObjects, error) {
+	var deleted DeletedObjects
+	err := b.do("DeleteBatchFiles", func() (err error) {
+		deleted, err = b.bucket.DeleteBatchFiles(aggregationID, cutoff)
+		return
+	})
+	return deleted, err
+}
+
+func (b *InstrumentedBucket) WriteRunConfig(name string, contents []byte) error {
+	return b.do("WriteRunConfig", func() error { return b.bucket.WriteRunConfig(name, contents) })
+}
+
+func (b *InstrumentedBucket) WriteDeadLetterTask(marker string, task []byte) error {
+	return b.do("WriteDeadLetterTask", func() error { return b.bucket.WriteDeadLetterTask(marker, task) })
+}
+
+func (b *InstrumentedBucket) WriteReport(name string, report []byte) error {
+	return b.do("WriteReport", func() error { return b.bucket.WriteReport(name, report) })
+}
+
+func (b *InstrumentedBucket) ListReaggregationTriggers(aggregationID string) ([]string, error) {
+	var triggers []string
+	err := b.do("ListReaggregationTriggers", func() (err error) {
+		triggers, err = b.bucket.ListReaggregationTriggers(aggregationID)
+		return
+	})
+	return triggers, err
+}
+
+func (b *InstrumentedBucket) DeleteReaggregationTrigger(aggregationID, window string) error {
+	return b.do("DeleteReaggregationTrigger", func() error { return b.bucket.DeleteReaggregationTrigger(aggregationID, window) })
+}
+
+func (b *InstrumentedBucket) WriteProbe(name string, contents []byte) error {
+	return b.do("WriteProbe", func() error { return b.bucket.WriteProbe(name, contents) })
+}
+
+func (b *InstrumentedBucket) ReadProbe(name string) ([]byte, error) {
+	var contents []byte
+	err := b.do("ReadProbe", func() (err error) {
+		contents, err = b.bucket.ReadProbe(name)
+		return
+	})
+	return contents, err
+}
+
+func (b *InstrumentedBucket) DeleteProbe(name string) error {
+	return b.do("DeleteProbe", func() error { return b.bucket.DeleteProbe(name) })
+}
+
+func (b *InstrumentedBucket) WriteState(name string, contents []byte) error {
+	return b.do("WriteState", func() error { return b.bucket.WriteState(name, contents) })
+}
+
+func (b *InstrumentedBucket) ReadState(name string) ([]byte, error) {
+	var contents []byte
+	err := b.do("ReadState", func() (err error) {
+		contents, err = b.bucket.ReadState(name)
+		return
+	})
+	return contents, err
+}
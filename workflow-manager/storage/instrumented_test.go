@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumentedBucket(t *testing.T) {
+	flaky := &flakyBucket{errs: []error{errors.New("oops")}}
+	bucket := NewInstrumentedBucket(flaky, "instrumented")
+
+	if err := bucket.WriteTaskMarker("marker"); err == nil {
+		t.Error("Expected error writing task marker")
+	}
+	if err := bucket.WriteTaskMarker("marker"); err != nil {
+		t.Errorf("Unexpected error writing task marker: %v", err)
+	}
+	ids, err := bucket.ListAggregationIDs()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(ids, []string{"kittens-seen"}) {
+		t.Errorf("Got aggregation IDs %q, want %q", ids, []string{"kittens-seen"})
+	}
+
+	if got := testutil.ToFloat64(storageCalls.WithLabelValues("instrumented", "WriteTaskMarker")); got != 2 {
+		t.Errorf("Got %v WriteTaskMarker calls, want 2", got)
+	}
+	if got := testutil.ToFloat64(storageCalls.WithLabelValues("instrumented", "ListAggregationIDs")); got != 1 {
+		t.Errorf("Got %v ListAggregationIDs calls, want 1", got)
+	}
+	if got := testutil.CollectAndCount(storageCallDuration, "workflow_manager_storage_call_duration_seconds"); got < 2 {
+		t.Errorf("Got %d call duration series, want at least 2", got)
+	}
+}
+
+func TestInstrumentedBucketListPages(t *testing.T) {
+	mockS3Service := mockS3Service{
+		listOutputs: []s3.ListObjectsV2Output{
+			{
+				CommonPrefixes: []*s3.CommonPrefix{
+					{Prefix: aws.String("aggregation-id-1/")},
+					{Prefix: aws.String("task-markers/")},
+				},
+				IsTruncated:           aws.Bool(true),
+				NextContinuationToken: aws.String("token"),
+			},
+			{
+				CommonPrefixes: []*s3.CommonPrefix{
+					{Prefix: aws.String("aggregation-id-2/")},
+				},
+				IsTruncated: aws.Bool(false),
+			},
+		},
+	}
+	s3Bucket, err := newS3("region/bucketname", "", false)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	s3Bucket.s3Service = &mockS3Service
+	bucket := NewInstrumentedBucket(s3Bucket, "instrumented-s3")
+
+	aggregationIDs, err := bucket.ListAggregationIDs()
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if !reflect.DeepEqual(aggregationIDs, []string{"aggregation-id-1", "aggregation-id-2"}) {
+		t.Errorf("unexpected aggregation IDs %q", aggregationIDs)
+	}
+
+	if got := testutil.ToFloat64(storageCalls.WithLabelValues("instrumented-s3", "ListAggregationIDs")); got != 1 {
+		t.Errorf("Got %v calls, want 1", got)
+	}
+	if got := testutil.ToFloat64(storageListPages.WithLabelValues("instrumented-s3", "ListAggregationIDs")); got != 2 {
+		t.Errorf("Got %v pages, want 2", got)
+	}
+	if got := testutil.ToFloat64(storageListedObjects.WithLabelValues("instrumented-s3", "ListAggregationIDs")); got != 3 {
+		t.Errorf("Got %v listed objects, want 3", got)
+	}
+}
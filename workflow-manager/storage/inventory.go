@@ -0,0 +1,444 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+
+	wftime "github.com/letsencrypt/prio-server/workflow-manager/time"
+)
+
+var (
+	inventoryListedObjects = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "workflow_manager_inventory_listed_objects_total",
+			Help: "The number of batch files listed from inventory reports rather than by the bucket, by bucket",
+		},
+		[]string{"bucket"},
+	)
+	inventoryReportAge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "workflow_manager_inventory_report_age_seconds",
+			Help: "The age of the most recent inventory report read, by bucket",
+		},
+		[]string{"bucket"},
+	)
+	inventoryFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "workflow_manager_inventory_failures_total",
+			Help: "The number of times batch files were listed by the bucket because its inventory reports could not be read, by bucket",
+		},
+		[]string{"bucket"},
+	)
+)
+
+// inventoryRefreshInterval is how often an InventoryBucket checks for a newer
+// inventory report. Reports are produced daily, so hourly checks find each
+// soon after it is delivered without listing the reports on every run in
+// --watch mode.
+const inventoryRefreshInterval = time.Hour
+
+// inventoryReport is the list of objects in a bucket as of a point in time.
+type inventoryReport struct {
+	snapshot time.Time
+	objects  []string // sorted
+}
+
+// inventoryReports finds & reads the inventory reports of a bucket.
+type inventoryReports interface {
+	// latest reads the most recent inventory report.
+	latest() (*inventoryReport, error)
+}
+
+// InventoryBucket implements Bucket by wrapping another Bucket, and serving
+// ListBatchFiles from the bucket's most recent S3 Inventory or GCS Storage
+// Insights inventory report, for batches whose timestamps are at least the
+// live listing period older than the report, since they should have been
+// written by the time it was taken. Batch files with later timestamps are
+// listed by the wrapped Bucket, as are batch files in their entirety if no
+// report can be read. Since a report lists objects which may since have been
+// deleted, the live listing period should be long enough that aggregations
+// don't consider batches old enough to have expired. All other operations are
+// passed to the wrapped Bucket.
+type InventoryBucket struct {
+	Bucket
+	label             string
+	reports           inventoryReports
+	liveListingPeriod time.Duration
+	clock             wftime.Clock
+
+	mu       sync.Mutex
+	report   *inventoryReport
+	loadedAt time.Time
+}
+
+// NewInventoryBucket creates a bucket that lists batch files in bucket from
+// the inventory reports at inventoryURL: for S3 Inventory,
+// "s3://region/destination-bucket/destination-prefix/source-bucket/config-ID",
+// and for GCS Storage Insights, "gs://destination-bucket/destination-path",
+// where the reports are read as identity (S3 only). Batch files whose
+// timestamps are within liveListingPeriod of a report are listed by bucket.
+// label identifies the bucket in metrics, e.g. "ingestor".
+func NewInventoryBucket(bucket Bucket, label, inventoryURL, identity string, liveListingPeriod time.Duration) (*InventoryBucket, error) {
+	var reports inventoryReports
+	switch {
+	case strings.HasPrefix(inventoryURL, "s3://"):
+		// "region/bucket/prefix"
+		parts := strings.SplitN(strings.TrimPrefix(inventoryURL, "s3://"), "/", 3)
+		if len(parts) != 3 || parts[2] == "" {
+			return nil, fmt.Errorf("S3 inventory URL must be s3://region/bucket/prefix, not %q", inventoryURL)
+		}
+		reportBucket, err := newS3(parts[0]+"/"+parts[1], identity, true /* dryRun: reports are only read */)
+		if err != nil {
+			return nil, err
+		}
+		reports = s3InventoryReports{bucket: reportBucket, prefix: strings.TrimSuffix(parts[2], "/")}
+	case strings.HasPrefix(inventoryURL, "gs://"):
+		if identity != "" {
+			return nil, fmt.Errorf("workflow-manager doesn't support alternate identities (%s) for gs:// inventory reports (%q)",
+				identity, inventoryURL)
+		}
+		parts := strings.SplitN(strings.TrimPrefix(inventoryURL, "gs://"), "/", 2)
+		reportBucket, err := newGCS(parts[0], true /* dryRun: reports are only read */)
+		if err != nil {
+			return nil, err
+		}
+		prefix := ""
+		if len(parts) == 2 {
+			prefix = strings.TrimSuffix(parts[1], "/")
+		}
+		reports = gcsInventoryReports{bucket: reportBucket, prefix: prefix}
+	default:
+		return nil, fmt.Errorf("inventory URL has unrecognized scheme: %q", inventoryURL)
+	}
+	return newInventoryBucket(bucket, label, reports, liveListingPeriod, wftime.DefaultClock()), nil
+}
+
+func newInventoryBucket(bucket Bucket, label string, reports inventoryReports, liveListingPeriod time.Duration, clock wftime.Clock) *InventoryBucket {
+	return &InventoryBucket{
+		Bucket:            bucket,
+		label:             label,
+		reports:           reports,
+		liveListingPeriod: liveListingPeriod,
+		clock:             clock,
+	}
+}
+
+// latestReport returns the most recent inventory report, reading it if no
+// report has been read in the last inventoryRefreshInterval.
+func (b *InventoryBucket) latestReport() (*inventoryReport, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.clock.Now()
+	if b.report == nil || now.Sub(b.loadedAt) >= inventoryRefreshInterval {
+		report, err := b.reports.latest()
+		if err != nil {
+			return nil, err
+		}
+		log.Info().
+			Str("bucket", b.label).
+			Time("snapshot", report.snapshot).
+			Int("objects", len(report.objects)).
+			Msg("read inventory report")
+		b.report, b.loadedAt = report, now
+	}
+	inventoryReportAge.WithLabelValues(b.label).Set(now.Sub(b.report.snapshot).Seconds())
+	return b.report, nil
+}
+
+func (b *InventoryBucket) ListBatchFiles(aggregationID string, interval wftime.Interval) ([]string, error) {
+	report, err := b.latestReport()
+	if err != nil {
+		log.Warn().Err(err).Str("bucket", b.label).Msg("couldn't read inventory report, listing batch files")
+		inventoryFailures.WithLabelValues(b.label).Inc()
+		return b.Bucket.ListBatchFiles(aggregationID, interval)
+	}
+
+	// Batch files are listed live from the start of the hour in which the
+	// live listing period begins, since S3 lists them by the hour.
+	liveBegin := report.snapshot.Add(-b.liveListingPeriod).Truncate(time.Hour)
+	if !interval.Begin.Before(liveBegin) {
+		return b.Bucket.ListBatchFiles(aggregationID, interval)
+	}
+
+	inventoryInterval := wftime.Interval{Begin: interval.Begin, End: interval.End}
+	if liveBegin.Before(interval.End) {
+		inventoryInterval.End = liveBegin
+	}
+	files := report.batchFiles(aggregationID, inventoryInterval)
+	inventoryListedObjects.WithLabelValues(b.label).Add(float64(len(files)))
+	if inventoryInterval.End.Equal(interval.End) {
+		return files, nil
+	}
+
+	liveFiles, err := b.Bucket.ListBatchFiles(aggregationID, wftime.Interval{Begin: liveBegin, End: interval.End})
+	if err != nil {
+		return nil, err
+	}
+	return append(files, liveFiles...), nil
+}
+
+// batchFiles returns the objects in the report which are batch files for the
+// aggregation ID whose timestamps are within interval, in the manner of
+// GCSBucket.ListBatchFiles.
+func (r *inventoryReport) batchFiles(aggregationID string, interval wftime.Interval) []string {
+	startOffset := fmt.Sprintf("%s/%s", aggregationID, wftime.FmtTime(interval.Begin))
+	endOffset := fmt.Sprintf("%s/%s", aggregationID, wftime.FmtTime(interval.End))
+	start := sort.SearchStrings(r.objects, startOffset)
+	end := sort.SearchStrings(r.objects, endOffset)
+	if end < start {
+		end = start
+	}
+	return append([]string{}, r.objects[start:end]...)
+}
+
+// s3InventoryReports reads S3 Inventory reports, which are delivered to
+// "${prefix}/${delivery time}/manifest.json" (the prefix including the source
+// bucket & inventory configuration ID), each listing the report's
+// gzip-compressed CSV data files.
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/storage-inventory-location.html
+type s3InventoryReports struct {
+	bucket *S3Bucket
+	prefix string
+}
+
+// s3InventoryManifest is the subset of an S3 Inventory manifest.json used by
+// workflow-manager.
+type s3InventoryManifest struct {
+	CreationTimestamp string `json:"creationTimestamp"` // milliseconds since the epoch
+	FileFormat        string `json:"fileFormat"`
+	FileSchema        string `json:"fileSchema"` // e.g. "Bucket, Key, Size"
+	Files             []struct {
+		Key string `json:"key"`
+	} `json:"files"`
+}
+
+// s3InventoryDeliveryLayout is the layout of the delivery time in the keys of
+// S3 Inventory manifests.
+const s3InventoryDeliveryLayout = "2006-01-02T15-04Z"
+
+func (r s3InventoryReports) latest() (*inventoryReport, error) {
+	listResult, err := r.bucket.listObjects("InventoryReport", "", s3.ListObjectsV2Input{
+		Prefix:    aws.String(r.prefix + "/"),
+		Delimiter: aws.String("/"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	deliveries := latestS3InventoryDeliveries(r.prefix, listResult.prefixes)
+	if len(deliveries) == 0 {
+		return nil, fmt.Errorf("no S3 inventory reports in s3://%s/%s", r.bucket.bucketName, r.prefix)
+	}
+
+	// The most recent report may still be being delivered, in which case its
+	// manifest, which is written last, doesn't yet exist.
+	var manifestErr error
+	for _, delivery := range deliveries {
+		manifestBytes, err := r.bucket.readObject("inventory manifest", delivery+"manifest.json")
+		if err != nil {
+			manifestErr = err
+			continue
+		}
+		return r.read(manifestBytes)
+	}
+	return nil, manifestErr
+}
+
+// latestS3InventoryDeliveries returns the prefixes of the S3 Inventory
+// deliveries among prefixes, most recent first, ignoring other prefixes such
+// as "data/" and "hive/".
+func latestS3InventoryDeliveries(prefix string, prefixes []string) []string {
+	deliveries := []string{}
+	for _, p := range prefixes {
+		deliveryTime := strings.TrimSuffix(strings.TrimPrefix(p, prefix+"/"), "/")
+		if _, err := time.Parse(s3InventoryDeliveryLayout, deliveryTime); err == nil {
+			deliveries = append(deliveries, p)
+		}
+	}
+	// The delivery time layout sorts chronologically.
+	sort.Sort(sort.Reverse(sort.StringSlice(deliveries)))
+	return deliveries
+}
+
+func (r s3InventoryReports) read(manifestBytes []byte) (*inventoryReport, error) {
+	var manifest s3InventoryManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, fmt.Errorf("couldn't parse S3 inventory manifest: %w", err)
+	}
+	if manifest.FileFormat != "CSV" {
+		return nil, fmt.Errorf("S3 inventory report has format %q, but only CSV is supported", manifest.FileFormat)
+	}
+	millis, err := strconv.ParseInt(manifest.CreationTimestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse S3 inventory creation timestamp %q: %w", manifest.CreationTimestamp, err)
+	}
+	keyColumn := -1
+	for i, column := range strings.Split(manifest.FileSchema, ",") {
+		if strings.TrimSpace(column) == "Key" {
+			keyColumn = i
+		}
+	}
+	if keyColumn < 0 {
+		return nil, fmt.Errorf("S3 inventory schema %q has no Key column", manifest.FileSchema)
+	}
+
+	report := &inventoryReport{snapshot: time.UnixMilli(millis).UTC()}
+	for _, file := range manifest.Files {
+		contents, err := r.bucket.readObject("inventory report", file.Key)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := parseS3InventoryFile(contents, keyColumn)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse S3 inventory report %s: %w", file.Key, err)
+		}
+		report.objects = append(report.objects, keys...)
+	}
+	sort.Strings(report.objects)
+	return report, nil
+}
+
+// parseS3InventoryFile returns the object keys in a gzip-compressed S3
+// Inventory CSV data file, which has no header, and whose keys are URL-encoded.
+func parseS3InventoryFile(contents []byte, keyColumn int) ([]string, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(contents))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	records, err := readCSV(gz)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, record := range records {
+		if keyColumn >= len(record) {
+			return nil, fmt.Errorf("record has %d columns, want at least %d", len(record), keyColumn+1)
+		}
+		key, err := url.QueryUnescape(record[keyColumn])
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode key %q: %w", record[keyColumn], err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// gcsInventoryReports reads GCS Storage Insights inventory reports, which are
+// delivered to a destination path, each as a "*_manifest.json" manifest,
+// written once the report is complete, listing the report's CSV shards.
+// https://cloud.google.com/storage/docs/insights/inventory-reports
+type gcsInventoryReports struct {
+	bucket *GCSBucket
+	prefix string
+}
+
+// gcsInventoryManifest is the subset of a GCS Storage Insights inventory
+// report manifest used by workflow-manager.
+type gcsInventoryManifest struct {
+	SnapshotTime          time.Time `json:"snapshot_time"`
+	ReportShardsFileNames []string  `json:"report_shards_file_names"`
+}
+
+func (r gcsInventoryReports) latest() (*inventoryReport, error) {
+	prefix := ""
+	if r.prefix != "" {
+		prefix = r.prefix + "/"
+	}
+	listResult, err := r.bucket.listObjects("InventoryReport", "", storage.Query{Prefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+	var latestManifest string
+	var latest gcsInventoryManifest
+	for _, object := range listResult.objects {
+		if !strings.HasSuffix(object, "_manifest.json") {
+			continue
+		}
+		manifestBytes, err := r.bucket.readObject("inventory manifest", object)
+		if err != nil {
+			return nil, err
+		}
+		var manifest gcsInventoryManifest
+		if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+			return nil, fmt.Errorf("couldn't parse GCS inventory manifest %s: %w", object, err)
+		}
+		if latestManifest == "" || manifest.SnapshotTime.After(latest.SnapshotTime) {
+			latestManifest, latest = object, manifest
+		}
+	}
+	if latestManifest == "" {
+		return nil, fmt.Errorf("no GCS inventory reports in gs://%s/%s", r.bucket.bucketName, r.prefix)
+	}
+
+	report := &inventoryReport{snapshot: latest.SnapshotTime.UTC()}
+	for _, shard := range latest.ReportShardsFileNames {
+		// Shard names are relative to the manifest's directory.
+		shard = path.Join(path.Dir(latestManifest), shard)
+		contents, err := r.bucket.readObject("inventory report", shard)
+		if err != nil {
+			return nil, err
+		}
+		names, err := parseGCSInventoryShard(contents)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse GCS inventory report %s: %w", shard, err)
+		}
+		report.objects = append(report.objects, names...)
+	}
+	sort.Strings(report.objects)
+	return report, nil
+}
+
+// parseGCSInventoryShard returns the object names in a GCS Storage Insights
+// inventory report CSV shard, whose header row must include the "name"
+// column.
+func parseGCSInventoryShard(contents []byte) ([]string, error) {
+	records, err := readCSV(bytes.NewReader(contents))
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("report has no header row")
+	}
+	nameColumn := -1
+	for i, column := range records[0] {
+		if column == "name" {
+			nameColumn = i
+		}
+	}
+	if nameColumn < 0 {
+		return nil, fmt.Errorf("report columns %q don't include name", records[0])
+	}
+	names := []string{}
+	for _, record := range records[1:] {
+		if nameColumn >= len(record) {
+			return nil, fmt.Errorf("record has %d columns, want at least %d", len(record), nameColumn+1)
+		}
+		names = append(names, record[nameColumn])
+	}
+	return names, nil
+}
+
+func readCSV(r io.Reader) ([][]string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	return reader.ReadAll()
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	wftime "github.com/letsencrypt/prio-server/workflow-manager/time"
+)
+
+// fixedInventoryReports implements inventoryReports, returning a fixed report
+// and counting the reports read.
+type fixedInventoryReports struct {
+	report *inventoryReport
+	err    error
+	reads  int
+}
+
+func (r *fixedInventoryReports) latest() (*inventoryReport, error) {
+	r.reads++
+	return r.report, r.err
+}
+
+// intervalListingBucket implements the parts of Bucket used in tests,
+// recording the intervals listed.
+type intervalListingBucket struct {
+	Bucket
+	intervals []wftime.Interval
+}
+
+func (b *intervalListingBucket) ListBatchFiles(aggregationID string, interval wftime.Interval) ([]string, error) {
+	b.intervals = append(b.intervals, interval)
+	return []string{"live"}, nil
+}
+
+func TestInventoryBucketListBatchFiles(t *testing.T) {
+	reports := &fixedInventoryReports{report: &inventoryReport{
+		snapshot: mustInterval(t, "2020/10/31/23/30", "2020/10/31/23/30").Begin,
+		objects: []string{
+			"kittens-seen/2020/10/31/09/59/b8a5579a-f984-460a-a42d-2813cbf57771.batch",
+			"kittens-seen/2020/10/31/10/00/af97ffdd-00fc-4d6a-9790-e5c0de82e7b0.batch",
+			"kittens-seen/2020/10/31/10/00/af97ffdd-00fc-4d6a-9790-e5c0de82e7b0.batch.sig",
+			"kittens-seen/2020/10/31/16/59/79f0a477-b65c-47c9-a2bf-a3b56c33824a.batch",
+			"kittens-seen/2020/10/31/17/00/0f0317b2-c612-48c2-b08d-d98529d6eae4.batch",
+			"puppies-seen/2020/10/31/12/00/b8a5579a-f984-460a-a42d-2813cbf57771.batch",
+		},
+	}}
+	wrapped := &intervalListingBucket{}
+	clock := wftime.ClockWithFixedNow(mustInterval(t, "2020/11/01/00/00", "2020/11/01/00/00").Begin)
+	// Batch files from 2020/10/31/17/00 onwards are listed live.
+	bucket := newInventoryBucket(wrapped, "test", reports, 6*time.Hour+30*time.Minute, clock)
+
+	for _, testCase := range []struct {
+		name          string
+		interval      wftime.Interval
+		wantFiles     []string
+		wantIntervals []wftime.Interval
+	}{
+		{
+			name:      "inventory only",
+			interval:  mustInterval(t, "2020/10/31/10/00", "2020/10/31/17/00"),
+			wantFiles: reports.report.objects[1:4],
+		},
+		{
+			name:          "inventory & live",
+			interval:      mustInterval(t, "2020/10/31/16/00", "2020/10/31/18/00"),
+			wantFiles:     []string{reports.report.objects[3], "live"},
+			wantIntervals: []wftime.Interval{mustInterval(t, "2020/10/31/17/00", "2020/10/31/18/00")},
+		},
+		{
+			name:          "live only",
+			interval:      mustInterval(t, "2020/10/31/17/00", "2020/10/31/18/00"),
+			wantFiles:     []string{"live"},
+			wantIntervals: []wftime.Interval{mustInterval(t, "2020/10/31/17/00", "2020/10/31/18/00")},
+		},
+	} {
+		wrapped.intervals = nil
+		got, err := bucket.ListBatchFiles("kittens-seen", testCase.interval)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %q", testCase.name, err)
+		}
+		if !reflect.DeepEqual(got, testCase.wantFiles) {
+			t.Errorf("%s: got batch files %q, want %q", testCase.name, got, testCase.wantFiles)
+		}
+		if !reflect.DeepEqual(wrapped.intervals, testCase.wantIntervals) {
+			t.Errorf("%s: got live listings %v, want %v", testCase.name, wrapped.intervals, testCase.wantIntervals)
+		}
+	}
+	if reports.reads != 1 {
+		t.Errorf("got %d inventory report reads, want 1", reports.reads)
+	}
+
+	// The report is re-read once inventoryRefreshInterval has passed. If it
+	// can't be, batch files are listed live.
+	bucket.clock = wftime.ClockWithFixedNow(clock.Now().Add(inventoryRefreshInterval))
+	reports.err = errors.New("oops")
+	wrapped.intervals = nil
+	interval := mustInterval(t, "2020/10/31/10/00", "2020/10/31/17/00")
+	got, err := bucket.ListBatchFiles("kittens-seen", interval)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if !reflect.DeepEqual(got, []string{"live"}) || !reflect.DeepEqual(wrapped.intervals, []wftime.Interval{interval}) {
+		t.Errorf("got batch files %q from live listings %v, want live listing", got, wrapped.intervals)
+	}
+	if reports.reads != 2 {
+		t.Errorf("got %d inventory report reads, want 2", reports.reads)
+	}
+}
+
+func TestLatestS3InventoryDeliveries(t *testing.T) {
+	prefix := "inventory/source-bucket/config"
+	got := latestS3InventoryDeliveries(prefix, []string{
+		prefix + "/2020-10-30T01-00Z/",
+		prefix + "/data/",
+		prefix + "/2020-10-31T01-00Z/",
+		prefix + "/hive/",
+	})
+	want := []string{prefix + "/2020-10-31T01-00Z/", prefix + "/2020-10-30T01-00Z/"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got deliveries %q, want %q", got, want)
+	}
+}
+
+func TestParseS3InventoryFile(t *testing.T) {
+	var contents bytes.Buffer
+	gz := gzip.NewWriter(&contents)
+	if _, err := gz.Write([]byte(
+		"\"source-bucket\",\"kittens-seen/2020/10/31/20/29/b8a5579a.batch\",\"123\"\n" +
+			"\"source-bucket\",\"odd+names/with%2Bplus\",\"4\"\n")); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	keys, err := parseS3InventoryFile(contents.Bytes(), 1)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	want := []string{"kittens-seen/2020/10/31/20/29/b8a5579a.batch", "odd names/with+plus"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("got keys %q, want %q", keys, want)
+	}
+
+	if _, err := parseS3InventoryFile(contents.Bytes(), 3); err == nil {
+		t.Errorf("expected error for missing column")
+	}
+}
+
+func TestParseGCSInventoryShard(t *testing.T) {
+	names, err := parseGCSInventoryShard([]byte(
+		"bucket,name,size\n" +
+			"source-bucket,kittens-seen/2020/10/31/20/29/b8a5579a.batch,123\n" +
+			"source-bucket,\"with,comma\",4\n"))
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	want := []string{"kittens-seen/2020/10/31/20/29/b8a5579a.batch", "with,comma"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got names %q, want %q", names, want)
+	}
+
+	if _, err := parseGCSInventoryShard([]byte("bucket,size\nsource-bucket,4\n")); err == nil {
+		t.Errorf("expected error for missing name column")
+	}
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	wftime "github.com/letsencrypt/prio-server/workflow-manager/time"
+)
+
+// TaskMarkerStore stores the markers written for scheduled tasks, which guard
+// against scheduling redundant tasks. Every Bucket is a TaskMarkerStore, which
+// stores markers as objects under "task-markers/", but listing those objects
+// is slow in environments with many batches, so markers may instead be stored
+// in a DynamoDB table or Firestore collection created by NewTaskMarkerStore.
+type TaskMarkerStore interface {
+	// ListIntakeTaskMarkers returns the intake task markers for batches whose
+	// timestamp is within the provided interval. The list may also include
+	// markers for batches outside the interval.
+	ListIntakeTaskMarkers(aggregationID string, interval wftime.Interval) ([]string, error)
+	// ListAggregateTaskMarkers returns all markers for aggregation tasks for
+	// the specified aggregation ID.
+	ListAggregateTaskMarkers(aggregationID string) ([]string, error)
+	// WriteTaskMarker writes a marker for a scheduled task. Writing a marker
+	// which already exists succeeds, so that retries are safe.
+	WriteTaskMarker(marker string) error
+}
+
+// NewTaskMarkerStore creates a TaskMarkerStore from a URL, which must be of
+// the form "dynamodb://${region}/${table}" or
+// "firestore://${project}/${collection}". identity is the AWS role to assume
+// to access a DynamoDB table. If ttl is non-zero, each marker records an
+// expiry time ttl after it was written, which the table or collection's TTL
+// policy should use to delete it. If dryRun is true, markers are not written.
+func NewTaskMarkerStore(storeURL, identity string, ttl time.Duration, dryRun bool) (TaskMarkerStore, error) {
+	parts := strings.SplitN(storeURL, "://", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("task marker store URL has no scheme: %q", storeURL)
+	}
+	location := strings.SplitN(parts[1], "/", 2)
+	if len(location) != 2 || location[0] == "" || location[1] == "" {
+		return nil, fmt.Errorf("invalid task marker store URL %q", storeURL)
+	}
+
+	switch parts[0] {
+	case "dynamodb":
+		return newDynamoDBTaskMarkerStore(location[0], location[1], identity, ttl, dryRun), nil
+	case "firestore":
+		if identity != "" {
+			return nil, fmt.Errorf("workflow-manager doesn't support alternate identities (%s) for firestore:// task marker stores",
+				identity)
+		}
+		return newFirestoreTaskMarkerStore(location[0], location[1], ttl, dryRun), nil
+	default:
+		return nil, fmt.Errorf("task marker store URL has unrecognized scheme: %q", storeURL)
+	}
+}
+
+// WithTaskMarkerStore returns a Bucket which lists and writes task markers
+// using markers, and otherwise behaves like bucket.
+func WithTaskMarkerStore(bucket Bucket, markers TaskMarkerStore) Bucket {
+	return taskMarkerStoreBucket{Bucket: bucket, markers: markers}
+}
+
+type taskMarkerStoreBucket struct {
+	Bucket
+	markers TaskMarkerStore
+}
+
+func (b taskMarkerStoreBucket) ListIntakeTaskMarkers(aggregationID string, interval wftime.Interval) ([]string, error) {
+	return b.markers.ListIntakeTaskMarkers(aggregationID, interval)
+}
+
+func (b taskMarkerStoreBucket) ListAggregateTaskMarkers(aggregationID string) ([]string, error) {
+	return b.markers.ListAggregateTaskMarkers(aggregationID)
+}
+
+func (b taskMarkerStoreBucket) WriteTaskMarker(marker string) error {
+	return b.markers.WriteTaskMarker(marker)
+}
+
+// taskMarkerRegexp matches the start of an intake task marker
+// ("intake-${aggregationID}-${YYYY-MM-DD-HH-mm}-${batchID}") or an aggregation
+// task marker ("aggregate-${aggregationID}-${YYYY-MM-DD-HH-mm}-..."), capturing
+// the task kind, the aggregation ID and the first timestamp truncated to the
+// hour.
+var taskMarkerRegexp = regexp.MustCompile(`^(intake|aggregate)-(.+?)-(\d{4}-\d{2}-\d{2}-\d{2})-\d{2}-`)
+
+// taskMarkerPartition returns the partition in which a task marker is stored
+// by the DynamoDB and Firestore task marker stores: intake task markers are
+// partitioned by aggregation ID and hour, so that the markers for an interval
+// may be listed like the task marker objects in an S3 bucket, and aggregation
+// task markers by aggregation ID.
+func taskMarkerPartition(marker string) (string, error) {
+	match := taskMarkerRegexp.FindStringSubmatch(marker)
+	if match == nil {
+		return "", fmt.Errorf("malformed task marker %q", marker)
+	}
+	if match[1] == "aggregate" {
+		return aggregateTaskMarkerPartition(match[2]), nil
+	}
+	return fmt.Sprintf("intake-%s-%s", match[2], match[3]), nil
+}
+
+// intakeTaskMarkerPartitions returns the partitions holding the intake task
+// markers for batches whose timestamp is within interval.
+func intakeTaskMarkerPartitions(aggregationID string, interval wftime.Interval) []string {
+	partitions := []string{}
+	for _, timestampPrefix := range interval.TimestampPrefixes() {
+		partitions = append(partitions, fmt.Sprintf("intake-%s-%s",
+			aggregationID, strings.TrimSuffix(timestampPrefix.TruncatedMarkerString(), "-")))
+	}
+	return partitions
+}
+
+func aggregateTaskMarkerPartition(aggregationID string) string {
+	return fmt.Sprintf("aggregate-%s", aggregationID)
+}
+
+// taskMarkerPrefixes returns the prefixes of the objects holding the intake
+// and aggregation task markers for the specified aggregation ID. The prefixes
+// also match the markers of any aggregation ID of which aggregationID is a
+// prefix, which expiredTaskMarkers ignores.
+func taskMarkerPrefixes(aggregationID string) []string {
+	return []string{
+		fmt.Sprintf("%s/intake-%s-", taskMarkerDirectory, aggregationID),
+		fmt.Sprintf("%s/aggregate-%s-", taskMarkerDirectory, aggregationID),
+	}
+}
+
+// expiredTaskMarkers returns those of markers, the intake and aggregation
+// task markers listed for aggregationID, whose timestamp is before cutoff: the
+// timestamp of the batch for an intake task marker, or the end of the
+// aggregation window for an aggregation task marker. Markers which aren't for
+// exactly aggregationID, or whose timestamps can't be parsed, are never
+// expired.
+func expiredTaskMarkers(aggregationID string, markers []string, cutoff time.Time) []string {
+	const markerLayout = "2006-01-02-15-04"
+	intakePrefix := fmt.Sprintf("intake-%s-", aggregationID)
+	aggregatePrefix := fmt.Sprintf("aggregate-%s-", aggregationID)
+
+	expired := []string{}
+	for _, marker := range markers {
+		var timestamp time.Time
+		switch {
+		case strings.HasPrefix(marker, intakePrefix):
+			rest := strings.TrimPrefix(marker, intakePrefix)
+			if len(rest) <= len(markerLayout) || rest[len(markerLayout)] != '-' {
+				continue
+			}
+			t, err := time.Parse(markerLayout, rest[:len(markerLayout)])
+			if err != nil {
+				continue
+			}
+			timestamp = t
+		case strings.HasPrefix(marker, aggregatePrefix):
+			interval, err := wftime.ParseMarkerInterval(strings.TrimPrefix(marker, aggregatePrefix))
+			if err != nil {
+				continue
+			}
+			timestamp = interval.End
+		default:
+			continue
+		}
+		if timestamp.Before(cutoff) {
+			expired = append(expired, marker)
+		}
+	}
+	return expired
+}
@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+
+	wftime "github.com/letsencrypt/prio-server/workflow-manager/time"
+)
+
+func TestNewTaskMarkerStore(t *testing.T) {
+	for _, testCase := range []struct {
+		name          string
+		url           string
+		identity      string
+		expectedStore TaskMarkerStore
+	}{
+		{
+			name:          "dynamodb",
+			url:           "dynamodb://us-west-2/task-markers",
+			identity:      "arn:aws:iam::123456789012:role/workflow-manager",
+			expectedStore: newDynamoDBTaskMarkerStore("us-west-2", "task-markers", "arn:aws:iam::123456789012:role/workflow-manager", time.Hour, false),
+		},
+		{
+			name:          "firestore",
+			url:           "firestore://prio-project/task-markers",
+			expectedStore: newFirestoreTaskMarkerStore("prio-project", "task-markers", time.Hour, false),
+		},
+		{
+			name:     "firestore-identity",
+			url:      "firestore://prio-project/task-markers",
+			identity: "arn:aws:iam::123456789012:role/workflow-manager",
+		},
+		{
+			name: "no-scheme",
+			url:  "us-west-2/task-markers",
+		},
+		{
+			name: "no-table",
+			url:  "dynamodb://us-west-2",
+		},
+		{
+			name: "unknown-scheme",
+			url:  "s3://us-west-2/task-markers",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			store, err := NewTaskMarkerStore(testCase.url, testCase.identity, time.Hour, false)
+			if testCase.expectedStore == nil {
+				if err == nil {
+					t.Fatalf("expected error, got store %+v", store)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %q", err)
+			}
+			if !reflect.DeepEqual(store, testCase.expectedStore) {
+				t.Errorf("expected store %+v, got %+v", testCase.expectedStore, store)
+			}
+		})
+	}
+}
+
+func TestTaskMarkerPartition(t *testing.T) {
+	for _, testCase := range []struct {
+		marker            string
+		expectedPartition string
+	}{
+		{
+			marker:            "intake-kittens-seen-2020-10-31-20-15-b8a5579a-f984-460a-a42d-2813cbf57771",
+			expectedPartition: "intake-kittens-seen-2020-10-31-20",
+		},
+		{
+			marker:            "aggregate-kittens-seen-2020-10-31-16-00-2020-11-01-00-00",
+			expectedPartition: "aggregate-kittens-seen",
+		},
+		{
+			marker: "run-config-2020-10-31-20-15",
+		},
+		{
+			marker: "intake-kittens-seen",
+		},
+	} {
+		t.Run(testCase.marker, func(t *testing.T) {
+			partition, err := taskMarkerPartition(testCase.marker)
+			if testCase.expectedPartition == "" {
+				if err == nil {
+					t.Fatalf("expected error, got partition %q", partition)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %q", err)
+			}
+			if partition != testCase.expectedPartition {
+				t.Errorf("expected partition %q, got %q", testCase.expectedPartition, partition)
+			}
+		})
+	}
+}
+
+func TestExpiredTaskMarkers(t *testing.T) {
+	cutoff, _ := time.Parse("2006/01/02/15/04", "2020/11/01/00/00")
+	markers := []string{
+		"intake-kittens-seen-2020-10-31-20-15-b8a5579a-f984-460a-a42d-2813cbf57771",
+		"intake-kittens-seen-2020-11-01-00-00-0f0317b2-c612-48c2-b08d-d98529d6eae4",
+		"intake-kittens-seen-2020-11-01-00-15-7a1c0fbc-2b7f-4307-8185-9ea88961bb64",
+		"aggregate-kittens-seen-2020-10-31-16-00-2020-10-31-20-00",
+		"aggregate-kittens-seen-2020-10-31-20-00-2020-11-01-00-00",
+		"aggregate-kittens-seen-2020-10-31-23-00-2020-11-01-03-00",
+		// Markers for an aggregation ID of which kittens-seen is a prefix
+		"intake-kittens-seen-too-2020-10-31-20-15-af97ffdd-00fc-4d6a-9790-e5c0de82e7b0",
+		"aggregate-kittens-seen-too-2020-10-31-16-00-2020-10-31-20-00",
+		// Malformed markers
+		"intake-kittens-seen-2020-10-31",
+		"aggregate-kittens-seen-2020-10-31-16-00",
+	}
+
+	expired := expiredTaskMarkers("kittens-seen", markers, cutoff)
+	if !reflect.DeepEqual(expired, []string{markers[0], markers[3]}) {
+		t.Errorf("unexpected expired markers %q", expired)
+	}
+}
+
+// fakeDynamoDB stores items by partition & marker, and checks the conditions
+// on writes.
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	items   map[string]map[string]map[string]*dynamodb.AttributeValue
+	queries []string
+}
+
+func (f *fakeDynamoDB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	partition := *input.Item[dynamoDBPartitionAttribute].S
+	marker := *input.Item[dynamoDBMarkerAttribute].S
+	if _, ok := f.items[partition][marker]; ok && input.ConditionExpression != nil {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+	}
+	if f.items[partition] == nil {
+		f.items[partition] = map[string]map[string]*dynamodb.AttributeValue{}
+	}
+	f.items[partition][marker] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) QueryPages(input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool) error {
+	partition := *input.ExpressionAttributeValues[":partition"].S
+	f.queries = append(f.queries, partition)
+	markers := []string{}
+	for marker := range f.items[partition] {
+		markers = append(markers, marker)
+	}
+	sort.Strings(markers)
+	// Return one item per page, to exercise pagination.
+	for i, marker := range markers {
+		page := &dynamodb.QueryOutput{
+			Items: []map[string]*dynamodb.AttributeValue{f.items[partition][marker]},
+		}
+		if !fn(page, i == len(markers)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestDynamoDBTaskMarkerStore(t *testing.T) {
+	now, _ := time.Parse("2006/01/02/15/04", "2020/11/01/00/30")
+	fake := &fakeDynamoDB{items: map[string]map[string]map[string]*dynamodb.AttributeValue{}}
+	store := newDynamoDBTaskMarkerStore("us-west-2", "task-markers", "", 24*time.Hour, false)
+	store.clock = wftime.ClockWithFixedNow(now)
+	store.dynamoDBService = fake
+
+	markers := []string{
+		"intake-kittens-seen-2020-10-31-20-15-batch-1",
+		"intake-kittens-seen-2020-10-31-20-45-batch-2",
+		"intake-kittens-seen-2020-10-31-21-15-batch-3",
+		"intake-kittens-seen-2020-10-31-22-15-batch-4",
+		"intake-dogs-seen-2020-10-31-20-15-batch-5",
+		"aggregate-kittens-seen-2020-10-31-16-00-2020-11-01-00-00",
+	}
+	for _, marker := range append(markers, markers[0]) {
+		if err := store.WriteTaskMarker(marker); err != nil {
+			t.Fatalf("unexpected error writing marker %q: %q", marker, err)
+		}
+	}
+	if err := store.WriteTaskMarker("run-config-2020-10-31-20-15"); err == nil {
+		t.Errorf("expected error writing malformed marker")
+	}
+
+	item := fake.items["intake-kittens-seen-2020-10-31-20"][markers[0]]
+	if expiry := *item[dynamoDBExpiryAttribute].N; expiry != "1604277000" {
+		t.Errorf("unexpected expiry %q", expiry)
+	}
+
+	intervalStart, _ := time.Parse("2006/01/02/15/04", "2020/10/31/20/00")
+	intervalEnd, _ := time.Parse("2006/01/02/15/04", "2020/10/31/22/00")
+	intakeMarkers, err := store.ListIntakeTaskMarkers("kittens-seen", wftime.Interval{
+		Begin: intervalStart,
+		End:   intervalEnd,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if !reflect.DeepEqual(intakeMarkers, markers[0:3]) {
+		t.Errorf("unexpected intake markers %q", intakeMarkers)
+	}
+	if !reflect.DeepEqual(fake.queries, []string{
+		"intake-kittens-seen-2020-10-31-20",
+		"intake-kittens-seen-2020-10-31-21",
+	}) {
+		t.Errorf("unexpected queries %q", fake.queries)
+	}
+
+	aggregateMarkers, err := store.ListAggregateTaskMarkers("kittens-seen")
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if !reflect.DeepEqual(aggregateMarkers, markers[5:]) {
+		t.Errorf("unexpected aggregate markers %q", aggregateMarkers)
+	}
+}
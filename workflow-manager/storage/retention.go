@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/letsencrypt/prio-server/workflow-manager/batchpath"
+)
+
+// DeletedObjects counts the objects deleted by Bucket.DeleteBatchFiles, or
+// that would have been deleted in dry-run mode.
+type DeletedObjects struct {
+	Objects int
+	Bytes   int64
+}
+
+// expiredBatchFiles returns those of the objects in listing, listed under
+// "${aggregationID}/", whose batch timestamp is before cutoff, with the size
+// of each. Objects which aren't for exactly aggregationID, or whose names
+// don't parse as batch paths, are never expired.
+func expiredBatchFiles(aggregationID string, listing *listResult, cutoff time.Time) ([]string, map[string]int64) {
+	expired := []string{}
+	sizes := map[string]int64{}
+	for i, object := range listing.objects {
+		batch, err := batchpath.New(object)
+		if err != nil || batch.AggregationID != aggregationID || !batch.Time.Before(cutoff) {
+			continue
+		}
+		expired = append(expired, object)
+		if i < len(listing.sizes) {
+			sizes[object] = listing.sizes[i]
+		}
+	}
+	return expired, sizes
+}
+
+// countDeleted returns the number & total size of the deleted objects.
+func countDeleted(deleted []string, sizes map[string]int64) DeletedObjects {
+	counts := DeletedObjects{Objects: len(deleted)}
+	for _, object := range deleted {
+		counts.Bytes += sizes[object]
+	}
+	return counts
+}
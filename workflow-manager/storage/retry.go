@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/api/googleapi"
+
+	wftime "github.com/letsencrypt/prio-server/workflow-manager/time"
+)
+
+var (
+	storageCallsRetried = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "workflow_manager_storage_calls_retried_total",
+			Help: "The number of failed storage bucket operations which were retried, by bucket & operation",
+		},
+		[]string{"bucket", "operation"},
+	)
+	storageCallsFailed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "workflow_manager_storage_calls_failed_total",
+			Help: "The number of storage bucket operations which failed, either with an error which is not retryable or after all attempts, by bucket & operation",
+		},
+		[]string{"bucket", "operation"},
+	)
+)
+
+// IsTransient returns true if err, returned by an S3Bucket or GCSBucket, is
+// likely to be transient, such that retrying the operation may succeed:
+// server errors (HTTP 5xx), throttling (HTTP 429), network failures and
+// timeouts.
+func IsTransient(err error) bool {
+	var requestFailure awserr.RequestFailure
+	if errors.As(err, &requestFailure) {
+		return isTransientStatus(requestFailure.StatusCode())
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return isTransientStatus(apiErr.Code)
+	}
+	// The AWS SDK reports failures to send a request, e.g. because a
+	// connection was reset, as a RequestError.
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == request.ErrCodeRequestError {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func isTransientStatus(code int) bool {
+	return code >= http.StatusInternalServerError || code == http.StatusTooManyRequests
+}
+
+// RetryingBucket implements Bucket by wrapping another Bucket, and
+// re-attempting operations which fail with retryable errors, with exponential
+// backoff and jitter between attempts. Every Bucket operation is idempotent,
+// so an operation which succeeded despite reporting an error is safe to
+// retry.
+type RetryingBucket struct {
+	bucket         Bucket
+	label          string
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	retryOn        func(error) bool
+	sleep          func(time.Duration)               // time.Sleep, except in tests
+	jitter         func(time.Duration) time.Duration // returns a random duration in [0, d)
+}
+
+// NewRetryingBucket creates a bucket that makes up to maxAttempts attempts at
+// each operation against the provided bucket, retrying those which fail with
+// errors for which retryOn returns true, e.g. IsTransient. The delay before
+// the second attempt is between half of initialBackoff and initialBackoff,
+// doubling for each subsequent attempt up to a maximum of maxBackoff. label
+// identifies the bucket in logs & metrics, e.g. "own-validation".
+func NewRetryingBucket(bucket Bucket, label string, maxAttempts int, initialBackoff, maxBackoff time.Duration, retryOn func(error) bool) *RetryingBucket {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &RetryingBucket{
+		bucket:         bucket,
+		label:          label,
+		maxAttempts:    maxAttempts,
+		initialBackoff: initialBackoff,
+		maxBackoff:     maxBackoff,
+		retryOn:        retryOn,
+		sleep:          time.Sleep,
+		jitter: func(d time.Duration) time.Duration {
+			if d <= 0 {
+				return 0
+			}
+			return time.Duration(rand.Int63n(int64(d))) // nolint:gosec // Jitter needn't be cryptographically random.
+		},
+	}
+}
+
+// do invokes f until it succeeds, fails with an error that is not retryable,
+// or has been attempted maxAttempts times.
+func (b *RetryingBucket) do(operation string, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if !b.retryOn(err) {
+			storageCallsFailed.WithLabelValues(b.label, operation).Inc()
+			return err
+		}
+		if attempt >= b.maxAttempts {
+			storageCallsFailed.WithLabelValues(b.label, operation).Inc()
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		backoff := b.backoff(attempt)
+		log.Warn().Err(err).
+			Str("bucket", b.label).
+			Str("operation", operation).
+			Int("attempt", attempt).
+			Msgf("storage operation failed, retrying in %s", backoff)
+		storageCallsRetried.WithLabelValues(b.label, operation).Inc()
+		b.sleep(backoff)
+	}
+}
+
+// backoff returns the delay to wait after the given (1-indexed) failed
+// attempt before making the next attempt. The upper half of the delay is
+// randomized, so that workflow-manager instances failing at once don't retry
+// in lockstep.
+func (b *RetryingBucket) backoff(attempt int) time.Duration {
+	backoff := b.initialBackoff
+	for i := 1; i < attempt && backoff < b.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > b.maxBackoff {
+		backoff = b.maxBackoff
+	}
+	return backoff/2 + b.jitter(backoff-backoff/2)
+}
+
+func (b *RetryingBucket) ListAggregationIDs() ([]string, error) {
+	var ids []string
+	err := b.do("ListAggregationIDs", func() (err error) {
+		ids, err = b.bucket.ListAggregationIDs()
+		return
+	})
+	return ids, err
+}
+
+func (b *RetryingBucket) ListBatchFiles(aggregationID string, interval wftime.Interval) ([]string, error) {
+	var files []string
+	err := b.do("ListBatchFiles", func() (err error) {
+		files, err = b.bucket.ListBatchFiles(aggregationID, interval)
+		return
+	})
+	return files, err
+}
+
+func (b *RetryingBucket) ReadBatchFile(name string) ([]byte, error) {
+	var contents []byte
+	err := b.do("ReadBatchFile", func() (err error) {
+		contents, err = b.bucket.ReadBatchFile(name)
+		return
+	})
+	return contents, err
+}
+
+func (b *RetryingBucket) ListIntakeTaskMarkers(aggregationID string, interval wftime.Interval) ([]string, error) {
+	var markers []string
+	err := b.do("ListIntakeTaskMarkers", func() (err error) {
+		markers, err = b.bucket.ListIntakeTaskMarkers(aggregationID, interval)
+		return
+	})
+	return markers, err
+}
+
+func (b *RetryingBucket) ListAggregateTaskMarkers(aggregationID string) ([]string, error) {
+	var markers []string
+	err := b.do("ListAggregateTaskMarkers", func() (err error) {
+		markers, err = b.bucket.ListAggregateTaskMarkers(aggregationID)
+		return
+	})
+	return markers, err
+}
+
+func (b *RetryingBucket) WriteTaskMarker(marker string) error {
+	return b.do("WriteTaskMarker", func() error { return b.bucket.WriteTaskMarker(marker) })
+}
+
+func (b *RetryingBucket) DeleteTaskMarkers(aggregationID string, cutoff time.Time) (int, error) {
+	var deleted int
+	err := b.do("DeleteTaskMarkers", func() (err error) {
+		deleted, err = b.bucket.DeleteTaskMarkers(aggregationID, cutoff)
+		return
+	})
+	return deleted, err
+}
+
+func (b *RetryingBucket) DeleteBatchFiles(aggregationID string, cutoff time.Time) (DeletedObjects, error) {
+	var deleted DeletedObjects
+	err := b.do("DeleteBatchFiles", func() (err error) {
+		deleted, err = b.bucket.DeleteBatchFiles(aggregationID, cutoff)
+		return
+	})
+	return deleted, err
+}
+
+func (b *RetryingBucket) WriteRunConfig(name string, contents []byte) error {
+	return b.do("WriteRunConfig", func() error { return b.bucket.WriteRunConfig(name, contents) })
+}
+
+func (b *RetryingBucket) WriteDeadLetterTask(marker string, task []byte) error {
+	return b.do("WriteDeadLetterTask", func() error { return b.bucket.WriteDeadLetterTask(marker, task) })
+}
+
+func (b *RetryingBucket) WriteReport(name string, report []byte) error {
+	return b.do("WriteReport", func() error { return b.bucket.WriteReport(name, report) })
+}
+
+func (b *RetryingBucket) ListReaggregationTriggers(aggregationID string) ([]string, error) {
+	var triggers []string
+	err := b.do("ListReaggregationTriggers", func() (err error) {
+		triggers, err = b.bucket.ListReaggregationTriggers(aggregationID)
+		return
+	})
+	return triggers, err
+}
+
+func (b *RetryingBucket) DeleteReaggregationTrigger(aggregationID, window string) error {
+	return b.do("DeleteReaggregationTrigger", func() error { return b.bucket.DeleteReaggregationTrigger(aggregationID, window) })
+}
+
+func (b *RetryingBucket) WriteProbe(name string, contents []byte) error {
+	return b.do("WriteProbe", func() error { return b.bucket.WriteProbe(name, contents) })
+}
+
+func (b *RetryingBucket) ReadProbe(name string) ([]byte, error) {
+	var contents []byte
+	err := b.do("ReadProbe", func() (err error) {
+		contents, err = b.bucket.ReadProbe(name)
+		return
+	})
+	return contents, err
+}
+
+func (b *RetryingBucket) DeleteProbe(name string) error {
+	return b.do("DeleteProbe", func() error { return b.bucket.DeleteProbe(name) })
+}
+
+func (b *RetryingBucket) WriteState(name string, contents []byte) error {
+	return b.do("WriteState", func() error { return b.bucket.WriteState(name, contents) })
+}
+
+func (b *RetryingBucket) ReadState(name string) ([]byte, error) {
+	var contents []byte
+	err := b.do("ReadState", func() (err error) {
+		contents, err = b.bucket.ReadState(name)
+		return
+	})
+	return contents, err
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsTransient(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "S3 server error",
+			err:  fmt.Errorf("storage.PutObject: %w", awserr.NewRequestFailure(awserr.New("InternalError", "", nil), 500, "request")),
+			want: true,
+		},
+		{
+			name: "S3 throttling",
+			err:  awserr.NewRequestFailure(awserr.New("SlowDown", "", nil), 503, "request"),
+			want: true,
+		},
+		{
+			name: "S3 access denied",
+			err:  awserr.NewRequestFailure(awserr.New("AccessDenied", "", nil), 403, "request"),
+		},
+		{
+			name: "S3 request error",
+			err:  awserr.New(request.ErrCodeRequestError, "send request failed", errors.New("connection reset by peer")),
+			want: true,
+		},
+		{
+			name: "GCS server error",
+			err:  fmt.Errorf("failed to close GCS writer: %w", &googleapi.Error{Code: 503}),
+			want: true,
+		},
+		{
+			name: "GCS rate limit",
+			err:  &googleapi.Error{Code: 429},
+			want: true,
+		},
+		{
+			name: "GCS not found",
+			err:  &googleapi.Error{Code: 404},
+		},
+		{
+			name: "timeout",
+			err:  fmt.Errorf("storage.nextPage: %w", context.DeadlineExceeded),
+			want: true,
+		},
+		{
+			name: "other",
+			err:  errors.New("bucket URL has unrecognized scheme"),
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsTransient(test.err); got != test.want {
+				t.Errorf("IsTransient(%v) = %t, want %t", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+// flakyBucket implements the parts of Bucket used in tests, failing each
+// operation with the errors in errs before succeeding.
+type flakyBucket struct {
+	Bucket
+	errs     []error
+	attempts int
+}
+
+func (b *flakyBucket) attempt() error {
+	b.attempts++
+	if len(b.errs) == 0 {
+		return nil
+	}
+	err := b.errs[0]
+	b.errs = b.errs[1:]
+	return err
+}
+
+func (b *flakyBucket) ListAggregationIDs() ([]string, error) {
+	if err := b.attempt(); err != nil {
+		return nil, err
+	}
+	return []string{"kittens-seen"}, nil
+}
+
+func (b *flakyBucket) WriteTaskMarker(string) error {
+	return b.attempt()
+}
+
+func TestRetryingBucket(t *testing.T) {
+	transient := &googleapi.Error{Code: 503}
+	permanent := &googleapi.Error{Code: 403}
+
+	for _, test := range []struct {
+		name         string
+		errs         []error
+		wantAttempts int
+		wantSleeps   []time.Duration
+		wantErr      error
+	}{
+		{
+			name:         "success",
+			wantAttempts: 1,
+		},
+		{
+			name:         "transient errors",
+			errs:         []error{transient, transient},
+			wantAttempts: 3,
+			wantSleeps:   []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name:         "permanent error",
+			errs:         []error{permanent},
+			wantAttempts: 1,
+			wantErr:      permanent,
+		},
+		{
+			name:         "too many transient errors",
+			errs:         []error{transient, transient, transient, transient, transient},
+			wantAttempts: 4,
+			wantSleeps:   []time.Duration{time.Second, 2 * time.Second, 3 * time.Second},
+			wantErr:      transient,
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			flaky := &flakyBucket{errs: test.errs}
+			bucket := NewRetryingBucket(flaky, "test", 4, 2*time.Second, 6*time.Second, IsTransient)
+			var sleeps []time.Duration
+			bucket.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+			// The delay is always the lower bound of the jittered range.
+			bucket.jitter = func(time.Duration) time.Duration { return 0 }
+
+			err := bucket.WriteTaskMarker("marker")
+			if !errors.Is(err, test.wantErr) || (err == nil) != (test.wantErr == nil) {
+				t.Errorf("Got error %v, want %v", err, test.wantErr)
+			}
+			if flaky.attempts != test.wantAttempts {
+				t.Errorf("Got %d attempts, want %d", flaky.attempts, test.wantAttempts)
+			}
+			if !reflect.DeepEqual(sleeps, test.wantSleeps) {
+				t.Errorf("Got sleeps %v, want %v", sleeps, test.wantSleeps)
+			}
+		})
+	}
+}
+
+func TestRetryingBucketReturnsResults(t *testing.T) {
+	flaky := &flakyBucket{errs: []error{&googleapi.Error{Code: 500}}}
+	bucket := NewRetryingBucket(flaky, "test", 3, time.Second, time.Second, IsTransient)
+	bucket.sleep = func(time.Duration) {}
+
+	ids, err := bucket.ListAggregationIDs()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(ids, []string{"kittens-seen"}) {
+		t.Errorf("Got aggregation IDs %q, want %q", ids, []string{"kittens-seen"})
+	}
+}
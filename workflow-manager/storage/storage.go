@@ -1,10 +1,15 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -15,13 +20,22 @@ import (
 
 	"cloud.google.com/go/storage"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"google.golang.org/api/iterator"
 )
 
 const (
-	taskMarkerDirectory = "task-markers"
+	taskMarkerDirectory           = "task-markers"
+	deadLetterTaskDirectory       = "dead-letter-tasks"
+	reaggregationTriggerDirectory = "reaggregate"
+	reportDirectory               = "reports"
+	probeDirectory                = "probes"
+	stateDirectory                = "state"
 )
 
 // Bucket represents a cloud storage bucket
@@ -33,6 +47,9 @@ type Bucket interface {
 	// a batch (e.g., ingestion or validation) whose timestamp is within the
 	// provided interval.
 	ListBatchFiles(aggregationID string, interval wftime.Interval) ([]string, error)
+	// ReadBatchFile reads the contents of an object that is part of a batch,
+	// whose key is as returned by ListBatchFiles.
+	ReadBatchFile(name string) ([]byte, error)
 	// ListIntakeTaskMarkers returns a list of objects in this storage that are
 	// intake task markers for batches whose timestamp is within the provided
 	// interval.
@@ -52,13 +69,111 @@ type Bucket interface {
 	// https://aws.amazon.com/s3/consistency/
 	// https://cloud.google.com/storage/docs/consistency
 	WriteTaskMarker(marker string) error
+	// DeleteTaskMarkers deletes the intake and aggregation task markers for
+	// the specified aggregation ID whose timestamp is before cutoff: the
+	// timestamp of the batch for an intake task marker, or the end of the
+	// aggregation window for an aggregation task marker. It returns the
+	// number of markers deleted, or that would have been deleted in dry-run
+	// mode.
+	DeleteTaskMarkers(aggregationID string, cutoff time.Time) (int, error)
+	// DeleteBatchFiles deletes the objects under "${aggregationID}/" that are
+	// part of a batch whose timestamp is before cutoff, and returns the
+	// number & total size of the objects deleted, or that would have been
+	// deleted in dry-run mode.
+	DeleteBatchFiles(aggregationID string, cutoff time.Time) (DeletedObjects, error)
+	// WriteRunConfig writes a snapshot of the configuration of a run of
+	// workflow-manager to an object in the bucket whose key is
+	// "task-markers/${name}", alongside the task markers written by the run.
+	WriteRunConfig(name string, contents []byte) error
+	// WriteDeadLetterTask writes the serialized form of a task which could not
+	// be enqueued to an object in the bucket whose key is
+	// "dead-letter-tasks/${marker}", so that it may later be replayed.
+	WriteDeadLetterTask(marker string, task []byte) error
+	// WriteReport writes a report intended for human consumption to an object
+	// in the bucket whose key is "reports/${name}", replacing any existing
+	// report with that name.
+	WriteReport(name string, report []byte) error
+	// ListReaggregationTriggers lists the aggregation windows for which an
+	// operator has requested re-aggregation for the specified aggregation ID,
+	// i.e. the names of objects under "reaggregate/${aggregationID}/". The
+	// windows are in the format returned by wftime.Interval.MarkerString.
+	ListReaggregationTriggers(aggregationID string) ([]string, error)
+	// DeleteReaggregationTrigger deletes the reaggregation trigger for the
+	// specified aggregation ID and window.
+	DeleteReaggregationTrigger(aggregationID, window string) error
+	// WriteProbe writes contents to an object in the bucket whose key is
+	// "probes/${name}", used to check that the bucket is writable and offers
+	// read-after-write consistency.
+	WriteProbe(name string, contents []byte) error
+	// ReadProbe reads the contents of the object written by WriteProbe.
+	ReadProbe(name string) ([]byte, error)
+	// DeleteProbe deletes the object written by WriteProbe.
+	DeleteProbe(name string) error
+	// WriteState writes contents to an object in the bucket whose key is
+	// "state/${name}", replacing any existing state with that name. State
+	// objects persist information between runs of workflow-manager.
+	WriteState(name string, contents []byte) error
+	// ReadState reads the contents of the object written by WriteState. If no
+	// such object exists, ReadState returns nil contents and no error.
+	ReadState(name string) ([]byte, error)
 }
 
-// NewBucket creates a new Bucket from a URL and identity. If dryRun is true,
-// then any operations with side effects will not actually be performed.
-// bucketURL must have a scheme indicating which cloud storage service should be
-// used (e.g., "gs://" for Google Cloud Storage or "s3://" for Amazon S3).
-func NewBucket(bucketURL, identity string, dryRun bool) (Bucket, error) {
+// S3Options configures access to S3-compatible storage other than AWS S3,
+// such as MinIO. The zero value accesses AWS S3.
+type S3Options struct {
+	// Endpoint is the URL of the S3 API, e.g. "http://minio:9000". If empty,
+	// the AWS S3 endpoint for the bucket's region is used.
+	Endpoint string
+	// ForcePathStyle addresses buckets as "${endpoint}/${bucket}" rather
+	// than as "${bucket}.${endpoint}", as most S3-compatible services
+	// require.
+	ForcePathStyle bool
+	// AccessKeyID and SecretAccessKey are static credentials, used in place
+	// of an identity or the AWS SDK's default credentials if both are set.
+	AccessKeyID, SecretAccessKey string
+}
+
+// parseS3Options returns options, overridden by any of the parameters in the
+// query of an S3 bucket URL: "endpoint", "path_style", "access_key_id" and
+// "secret_access_key".
+func parseS3Options(query string, options S3Options) (S3Options, error) {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return S3Options{}, fmt.Errorf("couldn't parse S3 bucket URL parameters: %w", err)
+	}
+	for name := range values {
+		value := values.Get(name)
+		switch name {
+		case "endpoint":
+			options.Endpoint = value
+		case "path_style":
+			if options.ForcePathStyle, err = strconv.ParseBool(value); err != nil {
+				return S3Options{}, fmt.Errorf("invalid S3 bucket URL parameter path_style=%q: %w", value, err)
+			}
+		case "access_key_id":
+			options.AccessKeyID = value
+		case "secret_access_key":
+			options.SecretAccessKey = value
+		default:
+			return S3Options{}, fmt.Errorf("unknown S3 bucket URL parameter %q", name)
+		}
+	}
+	if (options.AccessKeyID == "") != (options.SecretAccessKey == "") {
+		return S3Options{}, fmt.Errorf("S3 access key ID and secret access key must be specified together")
+	}
+	return options, nil
+}
+
+// NewBucket creates a new Bucket from a URL and identity. If requesterPays is
+// true, requests acknowledge that the requester will be charged for them, as
+// is required to access requester-pays S3 buckets. s3Options configures
+// access to S3 buckets, and may be overridden by parameters in the URL of an
+// S3 bucket, e.g. "s3://region/bucket?endpoint=http://minio:9000&path_style=true".
+// If dryRun is true, then any operations with side effects will not actually
+// be performed. bucketURL must have a scheme indicating which cloud storage
+// service should be used (e.g., "gs://" for Google Cloud Storage or "s3://"
+// for Amazon S3).
+func NewBucket(bucketURL, identity string, requesterPays bool, s3Options S3Options, dryRun bool) (Bucket, error) {
 	if bucketURL == "" {
 		return nil, fmt.Errorf("empty Bucket URL")
 	}
@@ -72,12 +187,33 @@ func NewBucket(bucketURL, identity string, dryRun bool) (Bucket, error) {
 
 	switch service {
 	case "s3":
-		return newS3(bucketName, identity, dryRun)
+		bucketName, query, _ := strings.Cut(bucketName, "?")
+		options, err := parseS3Options(query, s3Options)
+		if err != nil {
+			return nil, err
+		}
+		if identity != "" && options.AccessKeyID != "" {
+			return nil, fmt.Errorf("S3 static credentials can't be used with an identity (%s) for s3:// Bucket (%q)",
+				identity, bucketName)
+		}
+		bucket, err := newS3(bucketName, identity, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		bucket.requesterPays = requesterPays
+		bucket.options = options
+		return bucket, nil
 	case "gs":
+		if strings.Contains(bucketName, "?") {
+			return nil, fmt.Errorf("workflow-manager doesn't support URL parameters for gs:// Bucket (%q)", bucketName)
+		}
 		if identity != "" {
 			return nil, fmt.Errorf("workflow-manager doesn't support alternate identities (%s) for gs:// Bucket (%q)",
 				identity, bucketName)
 		}
+		if requesterPays {
+			return nil, fmt.Errorf("workflow-manager doesn't support requester pays for gs:// Bucket (%q)", bucketName)
+		}
 		return newGCS(bucketName, dryRun)
 	default:
 		return nil, fmt.Errorf("bucket URL has unrecognized scheme: %q", bucketURL)
@@ -88,13 +224,39 @@ func taskMarkerObject(task string) string {
 	return fmt.Sprintf("%s/%s", taskMarkerDirectory, task)
 }
 
+func deadLetterTaskObject(task string) string {
+	return fmt.Sprintf("%s/%s", deadLetterTaskDirectory, task)
+}
+
+func reportObject(name string) string {
+	return fmt.Sprintf("%s/%s", reportDirectory, name)
+}
+
+func probeObject(name string) string {
+	return fmt.Sprintf("%s/%s", probeDirectory, name)
+}
+
+func stateObject(name string) string {
+	return fmt.Sprintf("%s/%s", stateDirectory, name)
+}
+
+func reaggregationTriggerPrefix(aggregationID string) string {
+	return fmt.Sprintf("%s/%s/", reaggregationTriggerDirectory, aggregationID)
+}
+
 // filterTaskMarkers takes a list of directories (i.e., the top level of a
 // storage bucket's contents) and returns the list of aggregations in the bucket
 func filterTaskMarkers(directories []string) []string {
 	var aggregationIDs []string
 	for _, aggregationID := range directories {
-		// "task-markers" is a reserved name and cannot be an aggregation
-		if aggregationID == taskMarkerDirectory {
+		// "task-markers", "dead-letter-tasks", "reaggregate", "reports",
+		// "probes" and "state" are reserved names and cannot be aggregations
+		if aggregationID == taskMarkerDirectory ||
+			aggregationID == deadLetterTaskDirectory ||
+			aggregationID == reaggregationTriggerDirectory ||
+			aggregationID == reportDirectory ||
+			aggregationID == probeDirectory ||
+			aggregationID == stateDirectory {
 			continue
 		}
 		aggregationIDs = append(aggregationIDs, aggregationID)
@@ -103,9 +265,26 @@ func filterTaskMarkers(directories []string) []string {
 	return aggregationIDs
 }
 
+// archivalStorageClasses are the S3 storage classes whose objects must be
+// restored before they can be read.
+var archivalStorageClasses = map[string]bool{
+	s3.ObjectStorageClassGlacier:     true,
+	s3.ObjectStorageClassDeepArchive: true,
+}
+
+var archivedObjectsSkipped = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "workflow_manager_archived_objects_skipped",
+		Help: "The number of objects skipped when listing an S3 bucket because they are in the GLACIER or DEEP_ARCHIVE storage classes",
+	},
+	[]string{"bucket"},
+)
+
 type listResult struct {
 	prefixes []string
 	objects  []string
+	// sizes are the sizes in bytes of each of objects.
+	sizes []int64
 }
 
 // S3Bucket represents an AWS S3 bucket
@@ -120,10 +299,21 @@ type S3Bucket struct {
 	// dryRun controls whether any operations are actually performed by this
 	// S3Bucket.
 	dryRun bool
+	// requesterPays controls whether requests acknowledge that the requester
+	// will be charged for them, which S3 requires for requester-pays buckets.
+	requesterPays bool
+	// options configures access to S3-compatible storage other than AWS S3.
+	options S3Options
+	// label identifies the bucket in metrics of the pages & objects listed,
+	// once set by NewInstrumentedBucket. Listings are not recorded if unset.
+	label string
 	// s3Service is an implementation of s3iface.S3API that may be optionally
 	// provided. If set, it will be used for all S3 API calls. If unset,
 	// S3Bucket will use the AWS SDK to create a client that uses the real S3.
 	s3Service s3iface.S3API
+	// mu protects s3Service, which is created on first use, since the bucket
+	// may be used to schedule tasks for several aggregation IDs concurrently.
+	mu sync.Mutex
 }
 
 func newS3(bucketName, identity string, dryRun bool) (*S3Bucket, error) {
@@ -141,6 +331,8 @@ func newS3(bucketName, identity string, dryRun bool) (*S3Bucket, error) {
 }
 
 func (b *S3Bucket) service() (s3iface.S3API, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	if b.s3Service != nil {
 		return b.s3Service, nil
 	}
@@ -149,11 +341,28 @@ func (b *S3Bucket) service() (s3iface.S3API, error) {
 	if err != nil {
 		return nil, err
 	}
+	if b.options.Endpoint != "" {
+		config = config.WithEndpoint(b.options.Endpoint)
+	}
+	if b.options.ForcePathStyle {
+		config = config.WithS3ForcePathStyle(true)
+	}
+	if b.options.AccessKeyID != "" {
+		config = config.WithCredentials(credentials.NewStaticCredentials(b.options.AccessKeyID, b.options.SecretAccessKey, ""))
+	}
 
 	b.s3Service = s3.New(sess, config)
 	return b.s3Service, nil
 }
 
+// requestPayer returns the value of the RequestPayer parameter of S3 requests.
+func (b *S3Bucket) requestPayer() *string {
+	if b.requesterPays {
+		return aws.String(s3.RequestPayerRequester)
+	}
+	return nil
+}
+
 func (b *S3Bucket) ListAggregationIDs() ([]string, error) {
 	// To list the top level "directories" in an S3 bucket, we set no prefix and
 	// delimiter = "/". There's no particularly good documentation on how
@@ -161,7 +370,7 @@ func (b *S3Bucket) ListAggregationIDs() ([]string, error) {
 	// but empirically this combination works.
 	// [1] https://docs.aws.amazon.com/AmazonS3/latest/API/API_ListObjectsV2.html
 	// [2] https://docs.aws.amazon.com/AmazonS3/latest/dev/ListingKeysHierarchy.html
-	listResult, err := b.listObjects("", s3.ListObjectsV2Input{
+	listResult, err := b.listObjects("ListAggregationIDs", "", s3.ListObjectsV2Input{
 		Delimiter: aws.String("/"),
 	})
 	if err != nil {
@@ -201,7 +410,7 @@ func (b *S3Bucket) ListBatchFiles(aggregationID string, interval wftime.Interval
 	// batchpath.List.WithinInterval().
 	objects := []string{}
 	for _, timestampPrefix := range interval.TimestampPrefixes() {
-		listResult, err := b.listObjects("", s3.ListObjectsV2Input{
+		listResult, err := b.listObjects("ListBatchFiles", "", s3.ListObjectsV2Input{
 			Prefix: aws.String(fmt.Sprintf("%s/%s", aggregationID, timestampPrefix.TruncatedTimestamp())),
 		})
 		if err != nil {
@@ -224,6 +433,10 @@ func (b *S3Bucket) ListBatchFiles(aggregationID string, interval wftime.Interval
 	return objects, nil
 }
 
+func (b *S3Bucket) ReadBatchFile(name string) ([]byte, error) {
+	return b.readObject("batch file", name)
+}
+
 func (b *S3Bucket) ListIntakeTaskMarkers(aggregationID string, interval wftime.Interval) ([]string, error) {
 	// See the comment in ListBatchFiles for discussion of the usage of
 	// interval.TimestampPrefixes. The difference here is that we don't bother
@@ -233,7 +446,7 @@ func (b *S3Bucket) ListIntakeTaskMarkers(aggregationID string, interval wftime.I
 	objects := []string{}
 	for _, timestampPrefix := range interval.TimestampPrefixes() {
 		prefix := fmt.Sprintf("%s/intake-%s-%s", taskMarkerDirectory, aggregationID, timestampPrefix.TruncatedMarkerString())
-		listResult, err := b.listObjects(taskMarkerDirectory+"/", s3.ListObjectsV2Input{
+		listResult, err := b.listObjects("ListIntakeTaskMarkers", taskMarkerDirectory+"/", s3.ListObjectsV2Input{
 			Prefix: aws.String(prefix),
 		})
 		if err != nil {
@@ -247,7 +460,19 @@ func (b *S3Bucket) ListIntakeTaskMarkers(aggregationID string, interval wftime.I
 
 func (b *S3Bucket) ListAggregateTaskMarkers(aggregationID string) ([]string, error) {
 	prefix := fmt.Sprintf("%s/aggregate-%s-", taskMarkerDirectory, aggregationID)
-	listResult, err := b.listObjects(taskMarkerDirectory+"/", s3.ListObjectsV2Input{
+	listResult, err := b.listObjects("ListAggregateTaskMarkers", taskMarkerDirectory+"/", s3.ListObjectsV2Input{
+		Prefix: aws.String(prefix),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return listResult.objects, nil
+}
+
+func (b *S3Bucket) ListReaggregationTriggers(aggregationID string) ([]string, error) {
+	prefix := reaggregationTriggerPrefix(aggregationID)
+	listResult, err := b.listObjects("ListReaggregationTriggers", prefix, s3.ListObjectsV2Input{
 		Prefix: aws.String(prefix),
 	})
 	if err != nil {
@@ -257,7 +482,83 @@ func (b *S3Bucket) ListAggregateTaskMarkers(aggregationID string) ([]string, err
 	return listResult.objects, nil
 }
 
-func (b *S3Bucket) listObjects(trimObjectPrefix string, listInput s3.ListObjectsV2Input) (*listResult, error) {
+func (b *S3Bucket) DeleteReaggregationTrigger(aggregationID, window string) error {
+	return b.deleteObject("reaggregation trigger", reaggregationTriggerPrefix(aggregationID)+window)
+}
+
+func (b *S3Bucket) WriteProbe(name string, contents []byte) error {
+	return b.writeObject("probe", probeObject(name), contents)
+}
+
+func (b *S3Bucket) ReadProbe(name string) ([]byte, error) {
+	return b.readObject("probe", probeObject(name))
+}
+
+func (b *S3Bucket) DeleteProbe(name string) error {
+	return b.deleteObject("probe", probeObject(name))
+}
+
+func (b *S3Bucket) WriteState(name string, contents []byte) error {
+	return b.writeObject("state", stateObject(name), contents)
+}
+
+func (b *S3Bucket) ReadState(name string) ([]byte, error) {
+	contents, err := b.readObject("state", stateObject(name))
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, nil
+	}
+	return contents, err
+}
+
+func (b *S3Bucket) readObject(kind, object string) ([]byte, error) {
+	log.Debug().Msgf("reading %s s3://%s/%s as %q", kind, b.bucketName, object, b.identity)
+
+	svc, err := b.service()
+	if err != nil {
+		return nil, err
+	}
+	output, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket:       aws.String(b.bucketName),
+		Key:          aws.String(object),
+		RequestPayer: b.requestPayer(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("storage.GetObject: %w", err)
+	}
+	defer output.Body.Close()
+
+	contents, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from S3: %w", kind, err)
+	}
+	return contents, nil
+}
+
+func (b *S3Bucket) deleteObject(kind, object string) error {
+	log.Info().Msgf("deleting %s s3://%s/%s as %q", kind, b.bucketName, object, b.identity)
+
+	if b.dryRun {
+		log.Info().Msgf("dry run, skipping %s deletion", kind)
+		return nil
+	}
+
+	svc, err := b.service()
+	if err != nil {
+		return err
+	}
+	if _, err := svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket:       aws.String(b.bucketName),
+		Key:          aws.String(object),
+		RequestPayer: b.requestPayer(),
+	}); err != nil {
+		return fmt.Errorf("storage.DeleteObject: %w", err)
+	}
+
+	return nil
+}
+
+func (b *S3Bucket) listObjects(operation, trimObjectPrefix string, listInput s3.ListObjectsV2Input) (*listResult, error) {
 	log.Debug().Msgf("listing files in s3://%s as %q", b.bucketName, b.identity)
 
 	svc, err := b.service()
@@ -267,37 +568,179 @@ func (b *S3Bucket) listObjects(trimObjectPrefix string, listInput s3.ListObjects
 
 	var output listResult
 	var nextContinuationToken = ""
+	archivedObjects := 0
 	for {
 		listInput.MaxKeys = aws.Int64(1000)
 		listInput.Bucket = aws.String(b.bucketName)
+		listInput.RequestPayer = b.requestPayer()
 		if nextContinuationToken != "" {
 			listInput.ContinuationToken = &nextContinuationToken
 		}
 		resp, err := svc.ListObjectsV2(&listInput)
 		if err != nil {
+			var awsErr awserr.Error
+			if errors.As(err, &awsErr) && awsErr.Code() == "AccessDenied" && !b.requesterPays {
+				return nil, fmt.Errorf("unable to list items in Bucket %q (if it is a requester-pays bucket, requester pays must be enabled), %w", b.bucketName, err)
+			}
 			return nil, fmt.Errorf("unable to list items in Bucket %q, %w", b.bucketName, err)
 		}
 		for _, item := range resp.Contents {
+			// Objects in archival storage classes cannot be read without
+			// first being restored, so there's no use scheduling tasks for
+			// them.
+			if item.StorageClass != nil && archivalStorageClasses[*item.StorageClass] {
+				log.Debug().Msgf("skipping s3://%s/%s in storage class %s", b.bucketName, *item.Key, *item.StorageClass)
+				archivedObjects++
+				continue
+			}
 			trimmedObjectKey := strings.TrimPrefix(*item.Key, trimObjectPrefix)
 			output.objects = append(output.objects, trimmedObjectKey)
+			output.sizes = append(output.sizes, aws.Int64Value(item.Size))
 		}
 		for _, item := range resp.CommonPrefixes {
 			output.prefixes = append(output.prefixes, *item.Prefix)
 		}
+		recordListPage(b.label, operation, len(resp.Contents)+len(resp.CommonPrefixes))
 		if !*resp.IsTruncated {
 			break
 		}
 		nextContinuationToken = *resp.NextContinuationToken
 	}
+	if archivedObjects > 0 {
+		log.Warn().
+			Str("bucket", b.bucketName).
+			Int("archived objects", archivedObjects).
+			Msg("skipped objects in archival storage classes")
+		archivedObjectsSkipped.WithLabelValues(b.bucketName).Add(float64(archivedObjects))
+	}
 	return &output, nil
 }
 
 func (b *S3Bucket) WriteTaskMarker(marker string) error {
-	markerObject := taskMarkerObject(marker)
-	log.Info().Msgf("writing task marker to s3://%s/%s as %q", b.bucketName, markerObject, b.identity)
+	// Doesn't matter what the file contents are, but use the task name just in
+	// case S3 balks at an empty body
+	return b.writeObject("task marker", taskMarkerObject(marker), []byte(marker))
+}
+
+func (b *S3Bucket) DeleteTaskMarkers(aggregationID string, cutoff time.Time) (int, error) {
+	markers := []string{}
+	for _, prefix := range taskMarkerPrefixes(aggregationID) {
+		listResult, err := b.listObjects("DeleteTaskMarkers", taskMarkerDirectory+"/", s3.ListObjectsV2Input{
+			Prefix: aws.String(prefix),
+		})
+		if err != nil {
+			return 0, err
+		}
+		markers = append(markers, listResult.objects...)
+	}
+	expired := expiredTaskMarkers(aggregationID, markers, cutoff)
+
+	log.Info().Msgf("deleting %d task markers for aggregation ID %s older than %s from s3://%s as %q",
+		len(expired), aggregationID, cutoff.Format(time.RFC3339), b.bucketName, b.identity)
+
+	if b.dryRun || len(expired) == 0 {
+		if b.dryRun {
+			log.Info().Msg("dry run, skipping task marker deletion")
+		}
+		return len(expired), nil
+	}
+
+	objects := []string{}
+	for _, marker := range expired {
+		objects = append(objects, taskMarkerObject(marker))
+	}
+	deleted, err := b.deleteObjects("task marker", objects)
+	return len(deleted), err
+}
+
+func (b *S3Bucket) DeleteBatchFiles(aggregationID string, cutoff time.Time) (DeletedObjects, error) {
+	listResult, err := b.listObjects("DeleteBatchFiles", "", s3.ListObjectsV2Input{
+		Prefix: aws.String(aggregationID + "/"),
+	})
+	if err != nil {
+		return DeletedObjects{}, err
+	}
+	expired, sizes := expiredBatchFiles(aggregationID, listResult, cutoff)
+
+	log.Info().Msgf("deleting %d batch files for aggregation ID %s older than %s from s3://%s as %q",
+		len(expired), aggregationID, cutoff.Format(time.RFC3339), b.bucketName, b.identity)
+
+	if b.dryRun || len(expired) == 0 {
+		if b.dryRun {
+			log.Info().Msg("dry run, skipping batch file deletion")
+		}
+		return countDeleted(expired, sizes), nil
+	}
+
+	deleted, err := b.deleteObjects("batch file", expired)
+	return countDeleted(deleted, sizes), err
+}
+
+// deleteObjects deletes the objects, which are of the given kind, and returns
+// those which were deleted, even if it fails to delete others.
+func (b *S3Bucket) deleteObjects(kind string, objects []string) ([]string, error) {
+	svc, err := b.service()
+	if err != nil {
+		return nil, err
+	}
+
+	// DeleteObjects deletes up to 1,000 objects per request.
+	deleted := []string{}
+	for len(objects) > 0 {
+		n := len(objects)
+		if n > 1000 {
+			n = 1000
+		}
+		identifiers := []*s3.ObjectIdentifier{}
+		for _, object := range objects[:n] {
+			identifiers = append(identifiers, &s3.ObjectIdentifier{Key: aws.String(object)})
+		}
+		output, err := svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket:       aws.String(b.bucketName),
+			Delete:       &s3.Delete{Objects: identifiers, Quiet: aws.Bool(true)},
+			RequestPayer: b.requestPayer(),
+		})
+		if err != nil {
+			return deleted, fmt.Errorf("storage.DeleteObjects: %w", err)
+		}
+		// In quiet mode, only the objects which couldn't be deleted are
+		// reported.
+		failed := map[string]bool{}
+		for _, deleteError := range output.Errors {
+			failed[aws.StringValue(deleteError.Key)] = true
+		}
+		for _, object := range objects[:n] {
+			if !failed[object] {
+				deleted = append(deleted, object)
+			}
+		}
+		if len(output.Errors) > 0 {
+			return deleted, fmt.Errorf("failed to delete %d %ss, including %s: %s",
+				len(output.Errors), kind, aws.StringValue(output.Errors[0].Key), aws.StringValue(output.Errors[0].Message))
+		}
+		objects = objects[n:]
+	}
+
+	return deleted, nil
+}
+
+func (b *S3Bucket) WriteRunConfig(name string, contents []byte) error {
+	return b.writeObject("run configuration", taskMarkerObject(name), contents)
+}
+
+func (b *S3Bucket) WriteDeadLetterTask(marker string, task []byte) error {
+	return b.writeObject("dead-letter task", deadLetterTaskObject(marker), task)
+}
+
+func (b *S3Bucket) WriteReport(name string, report []byte) error {
+	return b.writeObject("report", reportObject(name), report)
+}
+
+func (b *S3Bucket) writeObject(kind, object string, contents []byte) error {
+	log.Info().Msgf("writing %s to s3://%s/%s as %q", kind, b.bucketName, object, b.identity)
 
 	if b.dryRun {
-		log.Info().Msg("dry run, skipping marker write")
+		log.Info().Msgf("dry run, skipping %s write", kind)
 		return nil
 	}
 
@@ -306,11 +749,10 @@ func (b *S3Bucket) WriteTaskMarker(marker string) error {
 		return err
 	}
 	input := &s3.PutObjectInput{
-		// Doesn't matter what the file contents are, but use the task name just
-		// in case S3 balks at an empty body
-		Body:   aws.ReadSeekCloser(strings.NewReader(marker)),
-		Bucket: aws.String(b.bucketName),
-		Key:    aws.String(markerObject),
+		Body:         aws.ReadSeekCloser(bytes.NewReader(contents)),
+		Bucket:       aws.String(b.bucketName),
+		Key:          aws.String(object),
+		RequestPayer: b.requestPayer(),
 	}
 
 	// Deliberately ignore the result, we only care if the write succeeds
@@ -325,6 +767,9 @@ type GCSBucket struct {
 	// bucketName is the name of the bucket, without any service prefix
 	bucketName string
 	dryRun     bool
+	// label identifies the bucket in metrics of the pages & objects listed,
+	// once set by NewInstrumentedBucket. Listings are not recorded if unset.
+	label string
 }
 
 func newGCS(bucketName string, dryRun bool) (*GCSBucket, error) {
@@ -353,7 +798,7 @@ func (b *GCSBucket) ListAggregationIDs() ([]string, error) {
 	// get a listing of top-level "directories" in the bucket. For discussion of
 	// delimiter and prefix parameters:
 	// https://cloud.google.com/storage/docs/json_api/v1/objects/list
-	listResult, err := b.listObjects("", storage.Query{
+	listResult, err := b.listObjects("ListAggregationIDs", "", storage.Query{
 		Delimiter: "/",
 	})
 	if err != nil {
@@ -367,7 +812,7 @@ func (b *GCSBucket) ListBatchFiles(aggregationID string, interval wftime.Interva
 	startOffset := fmt.Sprintf("%s/%s", aggregationID, wftime.FmtTime(interval.Begin))
 	endOffset := fmt.Sprintf("%s/%s", aggregationID, wftime.FmtTime(interval.End))
 
-	listResult, err := b.listObjects("", storage.Query{
+	listResult, err := b.listObjects("ListBatchFiles", "", storage.Query{
 		StartOffset: startOffset,
 		EndOffset:   endOffset,
 	})
@@ -378,11 +823,15 @@ func (b *GCSBucket) ListBatchFiles(aggregationID string, interval wftime.Interva
 	return listResult.objects, nil
 }
 
+func (b *GCSBucket) ReadBatchFile(name string) ([]byte, error) {
+	return b.readObject("batch file", name)
+}
+
 func (b *GCSBucket) ListIntakeTaskMarkers(aggregationID string, interval wftime.Interval) ([]string, error) {
 	startOffset := fmt.Sprintf("%s/intake-%s-%s", taskMarkerDirectory, aggregationID, (*wftime.Timestamp)(&interval.Begin).MarkerString())
 	endOffset := fmt.Sprintf("%s/intake-%s-%s", taskMarkerDirectory, aggregationID, (*wftime.Timestamp)(&interval.End).MarkerString())
 
-	listResult, err := b.listObjects(taskMarkerDirectory+"/", storage.Query{
+	listResult, err := b.listObjects("ListIntakeTaskMarkers", taskMarkerDirectory+"/", storage.Query{
 		StartOffset: startOffset,
 		EndOffset:   endOffset,
 	})
@@ -395,7 +844,7 @@ func (b *GCSBucket) ListIntakeTaskMarkers(aggregationID string, interval wftime.
 
 func (b *GCSBucket) ListAggregateTaskMarkers(aggregationID string) ([]string, error) {
 	prefix := fmt.Sprintf("%s/aggregate-%s-", taskMarkerDirectory, aggregationID)
-	listResult, err := b.listObjects(taskMarkerDirectory+"/", storage.Query{
+	listResult, err := b.listObjects("ListAggregateTaskMarkers", taskMarkerDirectory+"/", storage.Query{
 		Prefix: prefix,
 	})
 	if err != nil {
@@ -405,7 +854,96 @@ func (b *GCSBucket) ListAggregateTaskMarkers(aggregationID string) ([]string, er
 	return listResult.objects, nil
 }
 
-func (b *GCSBucket) listObjects(trimObjectPrefix string, query storage.Query) (*listResult, error) {
+func (b *GCSBucket) ListReaggregationTriggers(aggregationID string) ([]string, error) {
+	prefix := reaggregationTriggerPrefix(aggregationID)
+	listResult, err := b.listObjects("ListReaggregationTriggers", prefix, storage.Query{
+		Prefix: prefix,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return listResult.objects, nil
+}
+
+func (b *GCSBucket) DeleteReaggregationTrigger(aggregationID, window string) error {
+	return b.deleteObject("reaggregation trigger", reaggregationTriggerPrefix(aggregationID)+window)
+}
+
+func (b *GCSBucket) WriteProbe(name string, contents []byte) error {
+	return b.writeObject("probe", probeObject(name), contents)
+}
+
+func (b *GCSBucket) ReadProbe(name string) ([]byte, error) {
+	return b.readObject("probe", probeObject(name))
+}
+
+func (b *GCSBucket) DeleteProbe(name string) error {
+	return b.deleteObject("probe", probeObject(name))
+}
+
+func (b *GCSBucket) WriteState(name string, contents []byte) error {
+	return b.writeObject("state", stateObject(name), contents)
+}
+
+func (b *GCSBucket) ReadState(name string) ([]byte, error) {
+	contents, err := b.readObject("state", stateObject(name))
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, nil
+	}
+	return contents, err
+}
+
+func (b *GCSBucket) readObject(kind, objectName string) ([]byte, error) {
+	client, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug().Msgf("reading %s gs://%s/%s as (ambient service account)",
+		kind, b.bucketName, objectName)
+
+	ctx, cancel := wftime.ContextWithTimeout()
+	defer cancel()
+
+	reader, err := client.Bucket(b.bucketName).Object(objectName).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s from GCS: %w", kind, err)
+	}
+	defer reader.Close()
+
+	contents, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from GCS: %w", kind, err)
+	}
+	return contents, nil
+}
+
+func (b *GCSBucket) deleteObject(kind, objectName string) error {
+	client, err := b.client()
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("deleting %s gs://%s/%s as (ambient service account)",
+		kind, b.bucketName, objectName)
+
+	if b.dryRun {
+		log.Info().Msgf("dry run, skipping %s deletion", kind)
+		return nil
+	}
+
+	ctx, cancel := wftime.ContextWithTimeout()
+	defer cancel()
+
+	if err := client.Bucket(b.bucketName).Object(objectName).Delete(ctx); err != nil {
+		return fmt.Errorf("failed to delete %s from GCS: %w", kind, err)
+	}
+
+	return nil
+}
+
+func (b *GCSBucket) listObjects(operation, trimObjectPrefix string, query storage.Query) (*listResult, error) {
 	// This timeout has to cover potentially numerous roundtrips to the
 	// paginated API for listing objects, so we use a longer timeout than usual.
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
@@ -418,10 +956,10 @@ func (b *GCSBucket) listObjects(trimObjectPrefix string, query storage.Query) (*
 
 	bkt := client.Bucket(b.bucketName)
 
-	// We only need the "Name" (for objects). Prefix will be set on objects in
+	// We only need the "Name" & "Size" (for objects). Prefix will be set on objects in
 	// the response if the query included Delimiter.
 	// https://pkg.go.dev/cloud.google.com/go/storage#Query.SetAttrSelection
-	if err := query.SetAttrSelection([]string{"Name"}); err != nil {
+	if err := query.SetAttrSelection([]string{"Name", "Size"}); err != nil {
 		return nil, fmt.Errorf("query.SetAttrSelection: %w", err)
 	}
 
@@ -436,10 +974,12 @@ func (b *GCSBucket) listObjects(trimObjectPrefix string, query storage.Query) (*
 	var objects []*storage.ObjectAttrs
 	for {
 		// NextPage will append to the objects slice
+		listed := len(objects)
 		nextPageToken, err := p.NextPage(&objects)
 		if err != nil {
 			return nil, fmt.Errorf("storage.nextPage: %w", err)
 		}
+		recordListPage(b.label, operation, len(objects)-listed)
 
 		if nextPageToken == "" {
 			// no more data
@@ -453,6 +993,7 @@ func (b *GCSBucket) listObjects(trimObjectPrefix string, query storage.Query) (*
 		} else if object.Name != "" {
 			trimmedName := strings.TrimPrefix(object.Name, trimObjectPrefix)
 			output.objects = append(output.objects, trimmedName)
+			output.sizes = append(output.sizes, object.Size)
 		} else {
 			return nil, fmt.Errorf("object listing contained neither Prefix or Name: %v", object)
 		}
@@ -462,6 +1003,105 @@ func (b *GCSBucket) listObjects(trimObjectPrefix string, query storage.Query) (*
 }
 
 func (b *GCSBucket) WriteTaskMarker(marker string) error {
+	return b.writeObject("task marker", taskMarkerObject(marker), []byte(marker))
+}
+
+func (b *GCSBucket) DeleteTaskMarkers(aggregationID string, cutoff time.Time) (int, error) {
+	markers := []string{}
+	for _, prefix := range taskMarkerPrefixes(aggregationID) {
+		listResult, err := b.listObjects("DeleteTaskMarkers", taskMarkerDirectory+"/", storage.Query{
+			Prefix: prefix,
+		})
+		if err != nil {
+			return 0, err
+		}
+		markers = append(markers, listResult.objects...)
+	}
+	expired := expiredTaskMarkers(aggregationID, markers, cutoff)
+
+	log.Info().Msgf("deleting %d task markers for aggregation ID %s older than %s from gs://%s as (ambient service account)",
+		len(expired), aggregationID, cutoff.Format(time.RFC3339), b.bucketName)
+
+	if b.dryRun || len(expired) == 0 {
+		if b.dryRun {
+			log.Info().Msg("dry run, skipping task marker deletion")
+		}
+		return len(expired), nil
+	}
+
+	objects := []string{}
+	for _, marker := range expired {
+		objects = append(objects, taskMarkerObject(marker))
+	}
+	deleted, err := b.deleteObjects("task marker", objects)
+	return len(deleted), err
+}
+
+func (b *GCSBucket) DeleteBatchFiles(aggregationID string, cutoff time.Time) (DeletedObjects, error) {
+	// Batch timestamps sort lexicographically, so only objects before the
+	// cutoff need be listed.
+	listResult, err := b.listObjects("DeleteBatchFiles", "", storage.Query{
+		Prefix:    aggregationID + "/",
+		EndOffset: fmt.Sprintf("%s/%s", aggregationID, wftime.FmtTime(cutoff)),
+	})
+	if err != nil {
+		return DeletedObjects{}, err
+	}
+	expired, sizes := expiredBatchFiles(aggregationID, listResult, cutoff)
+
+	log.Info().Msgf("deleting %d batch files for aggregation ID %s older than %s from gs://%s as (ambient service account)",
+		len(expired), aggregationID, cutoff.Format(time.RFC3339), b.bucketName)
+
+	if b.dryRun || len(expired) == 0 {
+		if b.dryRun {
+			log.Info().Msg("dry run, skipping batch file deletion")
+		}
+		return countDeleted(expired, sizes), nil
+	}
+
+	deleted, err := b.deleteObjects("batch file", expired)
+	return countDeleted(deleted, sizes), err
+}
+
+// deleteObjects deletes the objects, which are of the given kind, and returns
+// those which were deleted, even if it fails to delete others.
+func (b *GCSBucket) deleteObjects(kind string, objects []string) ([]string, error) {
+	client, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+	bkt := client.Bucket(b.bucketName)
+
+	// GCS has no batch deletion API in the Go client, so each object is
+	// deleted individually. An object that no longer exists, e.g. because a
+	// previous attempt deleted it, counts as deleted.
+	deleted := []string{}
+	for _, object := range objects {
+		ctx, cancel := wftime.ContextWithTimeout()
+		err := bkt.Object(object).Delete(ctx)
+		cancel()
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return deleted, fmt.Errorf("failed to delete %s %s from GCS: %w", kind, object, err)
+		}
+		deleted = append(deleted, object)
+	}
+
+	return deleted, nil
+}
+
+func (b *GCSBucket) WriteRunConfig(name string, contents []byte) error {
+	return b.writeObject("run configuration", taskMarkerObject(name), contents)
+}
+
+func (b *GCSBucket) WriteDeadLetterTask(marker string, task []byte) error {
+	return b.writeObject("dead-letter task", deadLetterTaskObject(marker), task)
+}
+
+func (b *GCSBucket) WriteReport(name string, report []byte) error {
+	return b.writeObject("report", reportObject(name), report)
+}
+
+func (b *GCSBucket) writeObject(kind, objectName string, contents []byte) error {
 	client, err := b.client()
 	if err != nil {
 		return err
@@ -469,25 +1109,23 @@ func (b *GCSBucket) WriteTaskMarker(marker string) error {
 
 	bkt := client.Bucket(b.bucketName)
 
-	markerObject := taskMarkerObject(marker)
-	log.Info().Msgf("writing task marker to gs://%s/%s as (ambient service account)",
-		b.bucketName, markerObject)
+	log.Info().Msgf("writing %s to gs://%s/%s as (ambient service account)",
+		kind, b.bucketName, objectName)
 
 	if b.dryRun {
-		log.Info().Msg("dry run, skipping marker write")
+		log.Info().Msgf("dry run, skipping %s write", kind)
 		return nil
 	}
 
-	object := bkt.Object(markerObject)
+	object := bkt.Object(objectName)
 
 	ctx, cancel := wftime.ContextWithTimeout()
 	defer cancel()
 
 	writer := object.NewWriter(ctx)
-	_, err = io.WriteString(writer, marker)
-	if err != nil {
+	if _, err := writer.Write(contents); err != nil {
 		writer.Close()
-		return fmt.Errorf("failed to write marker to GCS: %w", err)
+		return fmt.Errorf("failed to write %s to GCS: %w", kind, err)
 	}
 
 	// If writes to GCS fail, we won't find out until we call Close, so we don't
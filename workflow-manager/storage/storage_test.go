@@ -17,6 +17,8 @@ func TestNewBucket(t *testing.T) {
 		name              string
 		bucketURL         string
 		identity          string
+		requesterPays     bool
+		s3Options         S3Options
 		expectedS3Bucket  *S3Bucket
 		expectedGCSBucket *GCSBucket
 		expectedError     bool
@@ -57,12 +59,69 @@ func TestNewBucket(t *testing.T) {
 				dryRun:     false,
 			},
 		},
+		{
+			name:          "s3 requester pays OK",
+			bucketURL:     "s3://region/bucketname",
+			requesterPays: true,
+			expectedS3Bucket: &S3Bucket{
+				region:        "region",
+				bucketName:    "bucketname",
+				requesterPays: true,
+			},
+		},
+		{
+			name:      "s3 options",
+			bucketURL: "s3://region/bucketname",
+			s3Options: S3Options{Endpoint: "http://minio:9000", ForcePathStyle: true},
+			expectedS3Bucket: &S3Bucket{
+				region:     "region",
+				bucketName: "bucketname",
+				options:    S3Options{Endpoint: "http://minio:9000", ForcePathStyle: true},
+			},
+		},
+		{
+			name:      "s3 options overridden by URL",
+			bucketURL: "s3://region/bucketname?endpoint=http://other:9000&path_style=false&access_key_id=minio&secret_access_key=hunter2",
+			s3Options: S3Options{Endpoint: "http://minio:9000", ForcePathStyle: true},
+			expectedS3Bucket: &S3Bucket{
+				region:     "region",
+				bucketName: "bucketname",
+				options:    S3Options{Endpoint: "http://other:9000", AccessKeyID: "minio", SecretAccessKey: "hunter2"},
+			},
+		},
+		{
+			name:          "s3 unknown URL parameter",
+			bucketURL:     "s3://region/bucketname?colour=blue",
+			expectedError: true,
+		},
+		{
+			name:          "s3 access key ID without secret",
+			bucketURL:     "s3://region/bucketname?access_key_id=minio",
+			expectedError: true,
+		},
+		{
+			name:          "s3 static credentials with identity",
+			bucketURL:     "s3://region/bucketname?access_key_id=minio&secret_access_key=hunter2",
+			identity:      "somebody",
+			expectedError: true,
+		},
+		{
+			name:          "gs URL parameters",
+			bucketURL:     "gs://bucketname?endpoint=http://minio:9000",
+			expectedError: true,
+		},
 		{
 			name:          "gs has identity",
 			bucketURL:     "gs://bucketname",
 			identity:      "not-empty-string",
 			expectedError: true,
 		},
+		{
+			name:          "gs requester pays",
+			bucketURL:     "gs://bucketname",
+			requesterPays: true,
+			expectedError: true,
+		},
 		{
 			name:      "gs OK",
 			bucketURL: "gs://bucketname",
@@ -75,7 +134,7 @@ func TestNewBucket(t *testing.T) {
 
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
-			bucket, err := NewBucket(testCase.bucketURL, testCase.identity, false)
+			bucket, err := NewBucket(testCase.bucketURL, testCase.identity, testCase.requesterPays, testCase.s3Options, false)
 			if testCase.expectedS3Bucket != nil {
 				if err != nil {
 					t.Errorf("unexpected error %q", err)
@@ -87,7 +146,9 @@ func TestNewBucket(t *testing.T) {
 				if testCase.expectedS3Bucket.bucketName != s3Bucket.bucketName ||
 					testCase.expectedS3Bucket.region != s3Bucket.region ||
 					testCase.expectedS3Bucket.identity != s3Bucket.identity ||
-					testCase.expectedS3Bucket.dryRun != s3Bucket.dryRun {
+					testCase.expectedS3Bucket.dryRun != s3Bucket.dryRun ||
+					testCase.expectedS3Bucket.requesterPays != s3Bucket.requesterPays ||
+					testCase.expectedS3Bucket.options != s3Bucket.options {
 					t.Errorf("wrong S3 bucket: %v", s3Bucket)
 				}
 			}
@@ -115,9 +176,13 @@ type mockS3Service struct {
 	s3iface.S3API
 	listOutputs       []s3.ListObjectsV2Output
 	listOutputCounter int
+	listInputs        []s3.ListObjectsV2Input
+	deleteInputs      []s3.DeleteObjectsInput
+	deleteErrors      []*s3.Error
 }
 
-func (m *mockS3Service) ListObjectsV2(*s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+func (m *mockS3Service) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	m.listInputs = append(m.listInputs, *input)
 	m.listOutputCounter += 1
 	return &m.listOutputs[m.listOutputCounter-1], nil
 }
@@ -126,6 +191,11 @@ func (m *mockS3Service) PutObject(*s3.PutObjectInput) (*s3.PutObjectOutput, erro
 	return nil, nil
 }
 
+func (m *mockS3Service) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	m.deleteInputs = append(m.deleteInputs, *input)
+	return &s3.DeleteObjectsOutput{Errors: m.deleteErrors}, nil
+}
+
 func TestS3ClientListAggregationIDs(t *testing.T) {
 	mockS3Service := mockS3Service{
 		listOutputs: []s3.ListObjectsV2Output{
@@ -134,6 +204,10 @@ func TestS3ClientListAggregationIDs(t *testing.T) {
 					{Prefix: aws.String("aggregation-id-1/")},
 					{Prefix: aws.String("aggregation-id-2/")},
 					{Prefix: aws.String("task-markers/")},
+					{Prefix: aws.String("dead-letter-tasks/")},
+					{Prefix: aws.String("reaggregate/")},
+					{Prefix: aws.String("reports/")},
+					{Prefix: aws.String("probes/")},
 				},
 				IsTruncated: aws.Bool(false),
 			},
@@ -315,3 +389,171 @@ func TestS3ListAggregateTaskMarkers(t *testing.T) {
 		t.Errorf("unexpected aggregate markers %q", markers)
 	}
 }
+
+func TestS3ListRequesterPaysAndArchivedObjects(t *testing.T) {
+	intervalStart, _ := time.Parse("2006/01/02/15/04", "2020/10/31/20/00")
+	intervalEnd, _ := time.Parse("2006/01/02/15/04", "2020/10/31/21/00")
+
+	mockS3Service := mockS3Service{
+		listOutputs: []s3.ListObjectsV2Output{
+			{
+				Contents: []*s3.Object{
+					{
+						Key:          aws.String("kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch"),
+						StorageClass: aws.String(s3.ObjectStorageClassStandard),
+					},
+					{
+						Key:          aws.String("kittens-seen/2020/10/31/20/35/0f0317b2-c612-48c2-b08d-d98529d6eae4.batch"),
+						StorageClass: aws.String(s3.ObjectStorageClassGlacier),
+					},
+					{
+						Key:          aws.String("kittens-seen/2020/10/31/20/40/7a1c0fbc-2b7f-4307-8185-9ea88961bb64.batch"),
+						StorageClass: aws.String(s3.ObjectStorageClassDeepArchive),
+					},
+					{
+						Key: aws.String("kittens-seen/2020/10/31/20/45/af97ffdd-00fc-4d6a-9790-e5c0de82e7b0.batch"),
+					},
+				},
+				IsTruncated: aws.Bool(false),
+			},
+		},
+	}
+
+	bucket, err := NewBucket("s3://region/bucketname", "", true, S3Options{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	s3Bucket := bucket.(*S3Bucket)
+	s3Bucket.s3Service = &mockS3Service
+
+	batchFiles, err := s3Bucket.ListBatchFiles("kittens-seen", wftime.Interval{
+		Begin: intervalStart,
+		End:   intervalEnd,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+
+	if !reflect.DeepEqual(batchFiles, []string{
+		"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch",
+		"kittens-seen/2020/10/31/20/45/af97ffdd-00fc-4d6a-9790-e5c0de82e7b0.batch",
+	}) {
+		t.Errorf("unexpected batch files %q", batchFiles)
+	}
+	for _, input := range mockS3Service.listInputs {
+		if aws.StringValue(input.RequestPayer) != s3.RequestPayerRequester {
+			t.Errorf("list request did not set RequestPayer: %v", input)
+		}
+	}
+}
+
+func TestS3DeleteTaskMarkers(t *testing.T) {
+	cutoff, _ := time.Parse("2006/01/02/15/04", "2020/11/01/00/00")
+	mockS3Service := mockS3Service{
+		listOutputs: []s3.ListObjectsV2Output{
+			{
+				Contents: []*s3.Object{
+					{Key: aws.String("task-markers/intake-kittens-seen-2020-10-31-20-15-batch-1")},
+					{Key: aws.String("task-markers/intake-kittens-seen-2020-11-01-00-15-batch-2")},
+				},
+				IsTruncated: aws.Bool(false),
+			},
+			{
+				Contents: []*s3.Object{
+					{Key: aws.String("task-markers/aggregate-kittens-seen-2020-10-31-16-00-2020-10-31-20-00")},
+				},
+				IsTruncated: aws.Bool(false),
+			},
+		},
+	}
+
+	s3Bucket, err := newS3("region/bucketname", "", false)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	s3Bucket.s3Service = &mockS3Service
+
+	deleted, err := s3Bucket.DeleteTaskMarkers("kittens-seen", cutoff)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if deleted != 2 {
+		t.Errorf("expected 2 markers deleted, got %d", deleted)
+	}
+
+	var prefixes []string
+	for _, input := range mockS3Service.listInputs {
+		prefixes = append(prefixes, aws.StringValue(input.Prefix))
+	}
+	if !reflect.DeepEqual(prefixes, []string{
+		"task-markers/intake-kittens-seen-",
+		"task-markers/aggregate-kittens-seen-",
+	}) {
+		t.Errorf("unexpected list prefixes %q", prefixes)
+	}
+	if len(mockS3Service.deleteInputs) != 1 {
+		t.Fatalf("expected 1 DeleteObjects request, got %d", len(mockS3Service.deleteInputs))
+	}
+	var keys []string
+	for _, object := range mockS3Service.deleteInputs[0].Delete.Objects {
+		keys = append(keys, aws.StringValue(object.Key))
+	}
+	if !reflect.DeepEqual(keys, []string{
+		"task-markers/intake-kittens-seen-2020-10-31-20-15-batch-1",
+		"task-markers/aggregate-kittens-seen-2020-10-31-16-00-2020-10-31-20-00",
+	}) {
+		t.Errorf("unexpected deleted objects %q", keys)
+	}
+}
+
+func TestS3DeleteBatchFiles(t *testing.T) {
+	cutoff, _ := time.Parse("2006/01/02/15/04", "2020/11/01/00/00")
+	mockS3Service := mockS3Service{
+		listOutputs: []s3.ListObjectsV2Output{
+			{
+				Contents: []*s3.Object{
+					{Key: aws.String("kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch"), Size: aws.Int64(10)},
+					{Key: aws.String("kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.avro"), Size: aws.Int64(100)},
+					{Key: aws.String("kittens-seen/2020/11/01/00/15/7add42ed-b6a5-4b2c-a8f6-3a2fb9b8a5c0.batch"), Size: aws.Int64(20)},
+					{Key: aws.String("kittens-seen/not-a-batch"), Size: aws.Int64(1)},
+				},
+				IsTruncated: aws.Bool(false),
+			},
+		},
+		deleteErrors: []*s3.Error{{
+			Key:     aws.String("kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.avro"),
+			Message: aws.String("Access Denied"),
+		}},
+	}
+
+	s3Bucket, err := newS3("region/bucketname", "", false)
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	s3Bucket.s3Service = &mockS3Service
+
+	deleted, err := s3Bucket.DeleteBatchFiles("kittens-seen", cutoff)
+	if err == nil {
+		t.Error("expected error for object which couldn't be deleted")
+	}
+	if deleted != (DeletedObjects{Objects: 1, Bytes: 10}) {
+		t.Errorf("unexpected deleted objects %+v", deleted)
+	}
+
+	if len(mockS3Service.listInputs) != 1 || aws.StringValue(mockS3Service.listInputs[0].Prefix) != "kittens-seen/" {
+		t.Errorf("unexpected list requests %v", mockS3Service.listInputs)
+	}
+	if len(mockS3Service.deleteInputs) != 1 {
+		t.Fatalf("expected 1 DeleteObjects request, got %d", len(mockS3Service.deleteInputs))
+	}
+	var keys []string
+	for _, object := range mockS3Service.deleteInputs[0].Delete.Objects {
+		keys = append(keys, aws.StringValue(object.Key))
+	}
+	if !reflect.DeepEqual(keys, []string{
+		"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch",
+		"kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771.batch.avro",
+	}) {
+		t.Errorf("unexpected deleted objects %q", keys)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/letsencrypt/prio-server/workflow-manager/storage"
+	"github.com/letsencrypt/prio-server/workflow-manager/task"
+)
+
+// Phases of scheduling tasks for an aggregation ID, timed in runStats.
+const (
+	phaseListIngestionBatches     = "list-ingestion-batches"
+	phaseScheduleIntakeTasks      = "schedule-intake-tasks"
+	phaseScheduleAggregationTasks = "schedule-aggregation-tasks"
+	phaseDrainEnqueuers           = "drain-enqueuers"
+)
+
+// runSummary is an auditable record of the scheduling decisions made by a
+// single run: the aggregation IDs it discovered, the batches it found, and the
+// tasks it scheduled or skipped. It is richer than the metrics exported by the
+// run, which hold only counts.
+type runSummary struct {
+	RunID           string                 `json:"run-id"` // identifies the run's recorded configuration; see runConfigName
+	StartTime       time.Time              `json:"start-time"`
+	EndTime         time.Time              `json:"end-time"`
+	DurationSeconds float64                `json:"duration-seconds"`
+	Error           string                 `json:"error,omitempty"` // if the run failed
+	AggregationIDs  []aggregationIDSummary `json:"aggregation-ids"`
+}
+
+// aggregationIDSummary summarizes the scheduling of tasks for a single
+// aggregation ID during a run. Skipped & deferred tasks are counted, while
+// each scheduled task is listed.
+type aggregationIDSummary struct {
+	AggregationID              string             `json:"aggregation-id"`
+	Error                      string             `json:"error,omitempty"` // if scheduling failed, in which case the counts may be incomplete
+	IngestionBatches           int                `json:"ingestion-batches"`
+	IncompleteIngestionBatches int                `json:"incomplete-ingestion-batches"`
+	InvalidIngestionBatches    int                `json:"invalid-ingestion-batches"`
+	IntakeTasksScheduled       int64              `json:"intake-tasks-scheduled"`
+	IntakeTasksSkipped         int                `json:"intake-tasks-skipped"`
+	IntakeTasksDeferred        int                `json:"intake-tasks-deferred"`
+	AggregationTasksScheduled  int64              `json:"aggregation-tasks-scheduled"`
+	AggregationTasksSkipped    int                `json:"aggregation-tasks-skipped"`
+	ScheduledTasks             []scheduledTask    `json:"scheduled-tasks"`
+	PhaseSeconds               map[string]float64 `json:"phase-seconds"`
+}
+
+// scheduledTask identifies a task which was successfully enqueued.
+type scheduledTask struct {
+	Queue   string `json:"queue"` // "intake" or "aggregate"
+	Marker  string `json:"marker"`
+	TraceID string `json:"trace-id"`
+}
+
+// recordScheduledTask records that t was enqueued to the given queue. It is
+// safe for concurrent use. A nil runStats records nothing.
+func (s *runStats) recordScheduledTask(queue string, t task.Task) {
+	if s == nil {
+		return
+	}
+	scheduled := scheduledTask{Queue: queue, Marker: t.Marker()}
+	switch t := t.(type) {
+	case task.IntakeBatch:
+		scheduled.TraceID = t.TraceID.String()
+	case task.IntakeBatches:
+		scheduled.TraceID = t.TraceID.String()
+	case task.Aggregation:
+		scheduled.TraceID = t.TraceID.String()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scheduledTasks = append(s.scheduledTasks, scheduled)
+}
+
+// recordPhase records the time since start as the duration of the named phase
+// of scheduling, and returns the current time, from which the next phase may
+// be timed. A nil runStats records nothing.
+func (s *runStats) recordPhase(name string, start time.Time) time.Time {
+	now := time.Now()
+	if s == nil {
+		return now
+	}
+	if s.phaseSeconds == nil {
+		s.phaseSeconds = map[string]float64{}
+	}
+	s.phaseSeconds[name] += now.Sub(start).Seconds()
+	return now
+}
+
+// newAggregationIDSummary summarizes stats, describing the scheduling of tasks
+// for the aggregation ID, which failed with err if it is not nil.
+func newAggregationIDSummary(aggregationID string, stats *runStats, err error) aggregationIDSummary {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	summary := aggregationIDSummary{
+		AggregationID:              aggregationID,
+		IngestionBatches:           stats.ingestionBatches,
+		IncompleteIngestionBatches: stats.incompleteIngestionBatches,
+		InvalidIngestionBatches:    stats.invalidIngestionBatches,
+		IntakeTasksScheduled:       stats.intakeTasks,
+		IntakeTasksSkipped:         stats.intakeTasksSkipped,
+		IntakeTasksDeferred:        stats.intakeTasksDeferred,
+		AggregationTasksScheduled:  stats.aggregationTasks,
+		AggregationTasksSkipped:    stats.aggregationTasksSkipped,
+		ScheduledTasks:             append([]scheduledTask{}, stats.scheduledTasks...),
+		PhaseSeconds:               map[string]float64{},
+	}
+	for phase, seconds := range stats.phaseSeconds {
+		summary.PhaseSeconds[phase] = seconds
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	return summary
+}
+
+// runSummaryName returns the name of the report holding the summary of the
+// run with the given ID.
+func runSummaryName(prefix, runID string) string {
+	return fmt.Sprintf("%s/run-summary-%s.json", prefix, runID)
+}
+
+// writeRunSummary writes summary as JSON to w, and to
+// "reports/${prefix}/run-summary-${run ID}.json" in bucket.
+func writeRunSummary(bucket storage.Bucket, prefix string, summary runSummary, w io.Writer) error {
+	contents, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't marshal run summary: %w", err)
+	}
+	if _, err := w.Write(append(contents, '\n')); err != nil {
+		return fmt.Errorf("couldn't write run summary: %w", err)
+	}
+	if err := bucket.WriteReport(runSummaryName(prefix, summary.RunID), contents); err != nil {
+		return fmt.Errorf("couldn't write run summary report: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package task
+
+import (
+	"time"
+)
+
+const (
+	// PriorityAttribute is the name of the message attribute holding the
+	// task's Priority, if it is not PriorityDefault.
+	PriorityAttribute = "priority"
+	// NotBeforeAttribute is the name of the message attribute holding the RFC
+	// 3339 time before which the task should not be processed, if any.
+	NotBeforeAttribute = "not-before"
+)
+
+// Priority is a hint to facilitators as to the order in which tasks should be
+// processed.
+type Priority string
+
+const (
+	// PriorityDefault is the priority of tasks with no priority attribute.
+	PriorityDefault Priority = ""
+	// PriorityLow marks tasks, such as those scheduled by a backfill, which
+	// should be processed after tasks of default priority.
+	PriorityLow Priority = "low"
+)
+
+// DeliveryAttributes describe how a task should be delivered. They are sent as
+// message attributes alongside the serialized task, rather than in it, so
+// they are not covered by the task's signature. The zero value sends no
+// attributes.
+type DeliveryAttributes struct {
+	// Priority is the task's priority.
+	Priority Priority
+	// NotBefore, if not zero, is the time before which the task should not be
+	// processed. Enqueuers whose queue supports scheduled delivery also delay
+	// delivery of the task until then.
+	NotBefore time.Time
+}
+
+// messageAttributes returns the message attributes carrying a.
+func (a DeliveryAttributes) messageAttributes() map[string]string {
+	attributes := map[string]string{}
+	if a.Priority != PriorityDefault {
+		attributes[PriorityAttribute] = string(a.Priority)
+	}
+	if !a.NotBefore.IsZero() {
+		attributes[NotBeforeAttribute] = a.NotBefore.UTC().Format(time.RFC3339)
+	}
+	return attributes
+}
+
+// taskAttributes returns the message attributes which should accompany the
+// serialized task: its delivery attributes and, if signer is not nil, its
+// signature. Returns nil if there are none.
+func taskAttributes(signer *Signer, task Task, jsonTask []byte) (map[string]string, error) {
+	attributes, err := signTask(signer, jsonTask)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range task.DeliveryAttributes().messageAttributes() {
+		if attributes == nil {
+			attributes = map[string]string{}
+		}
+		attributes[name] = value
+	}
+	return attributes, nil
+}
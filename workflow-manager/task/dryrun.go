@@ -0,0 +1,142 @@
+package task
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// DryRunTask describes a task which would have been enqueued by a dry run.
+type DryRunTask struct {
+	// Queue is the name of the queue into which the task would have been
+	// enqueued, e.g. "intake" or "aggregate".
+	Queue string `json:"queue"`
+	// Marker is the name of the task marker that would have been written for
+	// the task.
+	Marker string `json:"marker"`
+	// Task is the JSON encoding of the task, without its trace ID, which is
+	// chosen randomly on each run.
+	Task json.RawMessage `json:"task"`
+}
+
+// key uniquely identifies a DryRunTask, for sorting and diffing.
+func (t DryRunTask) key() string {
+	return t.Queue + "\x00" + t.Marker + "\x00" + string(t.Task)
+}
+
+// DryRunReport describes all of the tasks which would have been enqueued by a
+// dry run. Two dry runs which would enqueue the same tasks produce identical
+// reports.
+type DryRunReport struct {
+	// Hash is the hex-encoded SHA-256 hash of Tasks, which may be compared to
+	// the hash of another report to check whether two dry runs would enqueue
+	// the same tasks.
+	Hash string `json:"hash"`
+	// Tasks is the list of tasks which would have been enqueued, in a
+	// deterministic order.
+	Tasks []DryRunTask `json:"tasks"`
+}
+
+// Diff returns the tasks present in r but not in previous (added) and the
+// tasks present in previous but not in r (removed).
+func (r DryRunReport) Diff(previous DryRunReport) (added, removed []DryRunTask) {
+	current := map[string]struct{}{}
+	for _, t := range r.Tasks {
+		current[t.key()] = struct{}{}
+	}
+	prior := map[string]struct{}{}
+	for _, t := range previous.Tasks {
+		prior[t.key()] = struct{}{}
+		if _, ok := current[t.key()]; !ok {
+			removed = append(removed, t)
+		}
+	}
+	for _, t := range r.Tasks {
+		if _, ok := prior[t.key()]; !ok {
+			added = append(added, t)
+		}
+	}
+	return added, removed
+}
+
+// DryRunRecorder records the tasks successfully enqueued into any of the
+// Enqueuers it wraps, so that a dry run can report the tasks it would have
+// enqueued. It is safe for concurrent use.
+type DryRunRecorder struct {
+	mu    sync.Mutex
+	tasks []DryRunTask
+}
+
+// NewDryRunRecorder creates a DryRunRecorder with no recorded tasks.
+func NewDryRunRecorder() *DryRunRecorder {
+	return &DryRunRecorder{}
+}
+
+// Wrap returns an Enqueuer which enqueues tasks into enqueuer, recording each
+// task which is successfully enqueued as belonging to the named queue.
+func (r *DryRunRecorder) Wrap(queue string, enqueuer Enqueuer) Enqueuer {
+	return &recordingEnqueuer{recorder: r, queue: queue, enqueuer: enqueuer}
+}
+
+func (r *DryRunRecorder) record(queue string, task Task) error {
+	// Tasks are encoded via a generic map so that the trace ID can be removed
+	// and so that fields are encoded in a stable (sorted) order.
+	jsonTask, err := json.Marshal(task)
+	if err != nil {
+		return fmt.Errorf("marshaling task to JSON: %w", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(jsonTask, &fields); err != nil {
+		return fmt.Errorf("unmarshaling task from JSON: %w", err)
+	}
+	delete(fields, "trace-id")
+	jsonTask, err = json.Marshal(fields)
+	if err != nil {
+		return fmt.Errorf("marshaling task to JSON: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tasks = append(r.tasks, DryRunTask{Queue: queue, Marker: task.Marker(), Task: jsonTask})
+	return nil
+}
+
+// Report returns a report of the tasks recorded so far.
+func (r *DryRunRecorder) Report() DryRunReport {
+	r.mu.Lock()
+	tasks := make([]DryRunTask, len(r.tasks))
+	copy(tasks, r.tasks)
+	r.mu.Unlock()
+
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].key() < tasks[j].key() })
+	hash := sha256.New()
+	for _, t := range tasks {
+		hash.Write([]byte(t.key()))
+		hash.Write([]byte{'\n'})
+	}
+	return DryRunReport{Hash: hex.EncodeToString(hash.Sum(nil)), Tasks: tasks}
+}
+
+// recordingEnqueuer implements Enqueuer by wrapping another Enqueuer, and
+// recording successfully-enqueued tasks in a DryRunRecorder.
+type recordingEnqueuer struct {
+	recorder *DryRunRecorder
+	queue    string
+	enqueuer Enqueuer
+}
+
+func (e *recordingEnqueuer) Enqueue(task Task, completion func(error)) {
+	e.enqueuer.Enqueue(task, func(err error) {
+		if err == nil {
+			err = e.recorder.record(e.queue, task)
+		}
+		completion(err)
+	})
+}
+
+func (e *recordingEnqueuer) Stop() {
+	e.enqueuer.Stop()
+}
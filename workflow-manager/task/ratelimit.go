@@ -0,0 +1,65 @@
+package task
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the rate at which tasks are enqueued into any of the
+// Enqueuers it wraps, so that tasks enqueued into several queues share a
+// single limit. It is safe for concurrent use.
+type RateLimiter struct {
+	interval time.Duration
+	// now and sleep are time.Now and time.Sleep, except in tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	mu   sync.Mutex
+	next time.Time // the earliest time at which the next task may be enqueued
+}
+
+// NewRateLimiter creates a RateLimiter which allows at most tasksPerSecond
+// tasks to be enqueued per second. tasksPerSecond must be positive.
+func NewRateLimiter(tasksPerSecond float64) *RateLimiter {
+	return &RateLimiter{
+		interval: time.Duration(float64(time.Second) / tasksPerSecond),
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+// Wrap returns an Enqueuer which enqueues tasks into enqueuer, blocking in
+// Enqueue until the rate limit allows the task to be enqueued.
+func (l *RateLimiter) Wrap(enqueuer Enqueuer) Enqueuer {
+	return rateLimitedEnqueuer{limiter: l, enqueuer: enqueuer}
+}
+
+// wait blocks until another task may be enqueued.
+func (l *RateLimiter) wait() {
+	l.mu.Lock()
+	now := l.now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if delay > 0 {
+		l.sleep(delay)
+	}
+}
+
+type rateLimitedEnqueuer struct {
+	limiter  *RateLimiter
+	enqueuer Enqueuer
+}
+
+func (e rateLimitedEnqueuer) Enqueue(task Task, completion func(error)) {
+	e.limiter.wait()
+	e.enqueuer.Enqueue(task, completion)
+}
+
+func (e rateLimitedEnqueuer) Stop() {
+	e.enqueuer.Stop()
+}
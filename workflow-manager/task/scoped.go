@@ -0,0 +1,32 @@
+package task
+
+import "sync"
+
+// ScopedEnqueuer implements Enqueuer by wrapping another Enqueuer which may be
+// shared with other goroutines. Its Stop blocks only until the tasks passed to
+// its own Enqueue have been enqueued and their completion functions have
+// returned, and doesn't stop the wrapped Enqueuer, so that each of several
+// goroutines sharing an Enqueuer can wait for its own tasks without waiting
+// for, or racing with, the others'.
+type ScopedEnqueuer struct {
+	enqueuer  Enqueuer
+	waitGroup sync.WaitGroup
+}
+
+// NewScopedEnqueuer creates a ScopedEnqueuer which enqueues tasks into the
+// provided enqueuer.
+func NewScopedEnqueuer(enqueuer Enqueuer) *ScopedEnqueuer {
+	return &ScopedEnqueuer{enqueuer: enqueuer}
+}
+
+func (e *ScopedEnqueuer) Enqueue(task Task, completion func(error)) {
+	e.waitGroup.Add(1)
+	e.enqueuer.Enqueue(task, func(err error) {
+		defer e.waitGroup.Done()
+		completion(err)
+	})
+}
+
+func (e *ScopedEnqueuer) Stop() {
+	e.waitGroup.Wait()
+}
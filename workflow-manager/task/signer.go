@@ -0,0 +1,89 @@
+package task
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// SignatureAttribute is the name of the message attribute holding the
+	// base64-encoded ASN.1 ECDSA signature over the SHA-256 digest of the
+	// serialized task.
+	SignatureAttribute = "signature"
+	// SignatureKeyIDAttribute is the name of the message attribute holding
+	// the identifier of the task signing key version used to sign the task,
+	// which identifies its public key in our specific manifests.
+	SignatureKeyIDAttribute = "signature-key-id"
+)
+
+// Signer signs serialized tasks, so that facilitators can verify that tasks
+// were published by workflow-manager.
+type Signer struct {
+	keyID string
+	key   *ecdsa.PrivateKey
+}
+
+// NewSigner creates a Signer from the key identifier and the base64-encoded
+// PKCS#8 serialization of a P-256 ECDSA private key.
+func NewSigner(keyID string, pkcs8Base64 []byte) (*Signer, error) {
+	pkcs8, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(pkcs8Base64)))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode task signing key as base64: %w", err)
+	}
+	privKey, err := x509.ParsePKCS8PrivateKey(pkcs8)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse task signing key as PKCS#8: %w", err)
+	}
+	ecdsaKey, ok := privKey.(*ecdsa.PrivateKey)
+	if !ok || ecdsaKey.Curve != elliptic.P256() {
+		return nil, errors.New("task signing key is not a P-256 ECDSA key")
+	}
+	return &Signer{keyID: keyID, key: ecdsaKey}, nil
+}
+
+// NewSignerFromDirectory creates a Signer from a directory into which the
+// Kubernetes secret holding the task signing key, as written by key-rotator,
+// is mounted.
+func NewSignerFromDirectory(dir string) (*Signer, error) {
+	secretKey, err := os.ReadFile(filepath.Join(dir, "secret_key"))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read task signing key: %w", err)
+	}
+	keyID, err := os.ReadFile(filepath.Join(dir, "primary_kid"))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read task signing key ID: %w", err)
+	}
+	return NewSigner(strings.TrimSpace(string(keyID)), secretKey)
+}
+
+// Sign signs the serialized task, returning the message attributes which
+// should accompany it.
+func (s *Signer) Sign(message []byte) (map[string]string, error) {
+	digest := sha256.Sum256(message)
+	sig, err := ecdsa.SignASN1(rand.Reader, s.key, digest[:])
+	if err != nil {
+		return nil, fmt.Errorf("couldn't sign task: %w", err)
+	}
+	return map[string]string{
+		SignatureAttribute:      base64.StdEncoding.EncodeToString(sig),
+		SignatureKeyIDAttribute: s.keyID,
+	}, nil
+}
+
+// signTask returns the message attributes carrying the signature of the
+// serialized task, or nil if signer is nil.
+func signTask(signer *Signer, jsonTask []byte) (map[string]string, error) {
+	if signer == nil {
+		return nil, nil
+	}
+	return signer.Sign(jsonTask)
+}
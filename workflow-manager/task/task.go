@@ -5,9 +5,20 @@
 package task
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -16,12 +27,16 @@ import (
 	"github.com/rs/zerolog/log"
 
 	leaws "github.com/letsencrypt/prio-server/workflow-manager/aws"
+	leazure "github.com/letsencrypt/prio-server/workflow-manager/azure"
 	"github.com/letsencrypt/prio-server/workflow-manager/limiter"
 	wftime "github.com/letsencrypt/prio-server/workflow-manager/time"
 
 	"cloud.google.com/go/pubsub"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
 )
 
 // Task is a task that can be enqueued into an Enqueuer
@@ -29,6 +44,9 @@ type Task interface {
 	// Marker returns the name that should be used when writing out a marker for
 	// this task
 	Marker() string
+	// DeliveryAttributes returns the attributes describing how this task
+	// should be delivered
+	DeliveryAttributes() DeliveryAttributes
 }
 
 // Aggregation represents an aggregation task
@@ -45,6 +63,8 @@ type Aggregation struct {
 	// Batches is the list of batch ID date pairs of the batches aggregated by
 	// this task
 	Batches []Batch `json:"batches"`
+	// Delivery is how the task should be delivered. It is not serialized.
+	Delivery DeliveryAttributes `json:"-"`
 }
 
 func (a Aggregation) PrepareLog(event *zerolog.Event) *zerolog.Event {
@@ -63,6 +83,10 @@ func (a Aggregation) Marker() string {
 	)
 }
 
+func (a Aggregation) DeliveryAttributes() DeliveryAttributes {
+	return a.Delivery
+}
+
 // Batch represents a batch included in an aggregation task
 type Batch struct {
 	// ID is the batch ID. Typically a UUID.
@@ -80,6 +104,8 @@ type IntakeBatch struct {
 	BatchID string `json:"batch-id"`
 	// Date is the timestamp on the batch
 	Date wftime.Timestamp `json:"date"`
+	// Delivery is how the task should be delivered. It is not serialized.
+	Delivery DeliveryAttributes `json:"-"`
 }
 
 func (i IntakeBatch) PrepareLog(event *zerolog.Event) *zerolog.Event {
@@ -93,11 +119,63 @@ func (i IntakeBatch) Marker() string {
 	return fmt.Sprintf("intake-%s-%s-%s", i.AggregationID, i.Date.MarkerString(), i.BatchID)
 }
 
+func (i IntakeBatch) DeliveryAttributes() DeliveryAttributes {
+	return i.Delivery
+}
+
+// IntakeBatches represents an intake task for several batches of the same
+// aggregation ID, coalesced into a single task to reduce the number of tasks
+// sent for chatty ingestors. It is sent to the same queue as IntakeBatch, but
+// has no batch ID or date, so that facilitators which don't support it reject
+// it rather than intake only one of its batches.
+type IntakeBatches struct {
+	// TraceID is the tracing identifier for the intake.
+	TraceID uuid.UUID `json:"trace-id"`
+	// AggregationID is the identifier for the aggregation
+	AggregationID string `json:"aggregation-id"`
+	// Batches is the list of batch ID date pairs of the batches intaken by
+	// this task, oldest first. Never empty.
+	Batches []Batch `json:"batches"`
+	// Delivery is how the task should be delivered. It is not serialized.
+	Delivery DeliveryAttributes `json:"-"`
+}
+
+func (i IntakeBatches) PrepareLog(event *zerolog.Event) *zerolog.Event {
+	return event.
+		Str("trace ID", i.TraceID.String()).
+		Str("aggregation ID", i.AggregationID).
+		Int("batch count", len(i.Batches))
+}
+
+// Marker returns a name for the task, used for dead-letter tasks & task
+// events. Unlike other tasks, no marker of this name is written: instead,
+// the intake task marker of each of its batches, returned by BatchMarkers, is
+// written, so that its batches are treated like those with their own intake
+// tasks.
+func (i IntakeBatches) Marker() string {
+	return fmt.Sprintf("intake-%s-%s-coalesced-%s", i.AggregationID, i.Batches[0].Time.MarkerString(), i.TraceID)
+}
+
+// BatchMarkers returns the intake task markers of each of the task's batches,
+// as returned by IntakeBatch.Marker.
+func (i IntakeBatches) BatchMarkers() []string {
+	markers := []string{}
+	for _, batch := range i.Batches {
+		markers = append(markers, IntakeBatch{AggregationID: i.AggregationID, BatchID: batch.ID, Date: batch.Time}.Marker())
+	}
+	return markers
+}
+
+func (i IntakeBatches) DeliveryAttributes() DeliveryAttributes {
+	return i.Delivery
+}
+
 // Enqueuer allows enqueuing tasks.
 type Enqueuer interface {
-	// Enqueue enqueues a task to be executed later. The provided completion
-	// function will be invoked once the task is either successfully enqueued or
-	// some unretryable error has occurred. A call to Stop() will not return
+	// Enqueue enqueues a task to be executed later, sending its delivery
+	// attributes as message attributes. The provided completion function will
+	// be invoked once the task is either successfully enqueued or some
+	// unretryable error has occurred. A call to Stop() will not return
 	// until completion functions passed to any and all calls to Enqueue() have
 	// returned.
 	Enqueue(task Task, completion func(error))
@@ -145,13 +223,15 @@ type GCPPubSubEnqueuer struct {
 	waitGroup sync.WaitGroup
 	dryRun    bool
 	limiter   *limiter.Limiter
+	signer    *Signer
 }
 
 // NewGCPPubSubEnqueuer creates a task enqueuer for a given project and topic
-// in GCP PubSub. If dryRun is true, no tasks will actually be enqueued. Clients
-// should re-use a single instance as much as possible to enable batching of
-// publish requests.
-func NewGCPPubSubEnqueuer(project string, topicID string, dryRun bool, maxWorkers int32) (*GCPPubSubEnqueuer, error) {
+// in GCP PubSub. If dryRun is true, no tasks will actually be enqueued. If
+// signer is not nil, tasks are signed and the signature is included in the
+// message's attributes. Clients should re-use a single instance as much as
+// possible to enable batching of publish requests.
+func NewGCPPubSubEnqueuer(project string, topicID string, dryRun bool, maxWorkers int32, signer *Signer) (*GCPPubSubEnqueuer, error) {
 	// Google documentation advises against timeouts on client creation
 	// https://godoc.org/cloud.google.com/go#hdr-Timeouts_and_Cancellation
 	ctx := context.Background()
@@ -165,6 +245,7 @@ func NewGCPPubSubEnqueuer(project string, topicID string, dryRun bool, maxWorker
 		topic:   client.Topic(topicID),
 		dryRun:  dryRun,
 		limiter: limiter.New(maxWorkers),
+		signer:  signer,
 	}, nil
 }
 
@@ -179,6 +260,11 @@ func (e *GCPPubSubEnqueuer) Enqueue(task Task, completion func(error)) {
 				completion(fmt.Errorf("marshaling task to JSON: %w", err))
 				return
 			}
+			attributes, err := taskAttributes(e.signer, task, jsonTask)
+			if err != nil {
+				completion(err)
+				return
+			}
 
 			if e.dryRun {
 				log.Info().Msg("dry run, not enqueuing task")
@@ -193,7 +279,7 @@ func (e *GCPPubSubEnqueuer) Enqueue(task Task, completion func(error)) {
 			// block in Stop() until all tasks have been enqueued
 			ctx, cancel := wftime.ContextWithTimeout()
 			defer cancel()
-			res := e.topic.Publish(ctx, &pubsub.Message{Data: jsonTask})
+			res := e.topic.Publish(ctx, &pubsub.Message{Data: jsonTask, Attributes: attributes})
 			if _, err := res.Get(ctx); err != nil {
 				completion(fmt.Errorf("failed to publish task %+v: %w", task, err))
 				return
@@ -207,15 +293,75 @@ func (e *GCPPubSubEnqueuer) Stop() {
 	e.waitGroup.Wait()
 }
 
+// CreateSNSTopic creates the AWS SNS topic with the provided ARN if it does
+// not already exist, with the provided tags and, if kmsKeyID is not empty,
+// server-side encryption using that KMS key. Existing topics are left
+// unmodified. Returns error on failure.
+func CreateSNSTopic(region, identity, topicARN string, tags map[string]string, kmsKeyID string) error {
+	session, config, err := leaws.ClientConfig(region, identity)
+	if err != nil {
+		return err
+	}
+	return createSNSTopic(sns.New(session, config), topicARN, tags, kmsKeyID)
+}
+
+func createSNSTopic(service snsiface.SNSAPI, topicARN string, tags map[string]string, kmsKeyID string) error {
+	parsedARN, err := arn.Parse(topicARN)
+	if err != nil {
+		return fmt.Errorf("parsing SNS topic ARN %q: %w", topicARN, err)
+	}
+	if parsedARN.Service != sns.ServiceName {
+		return fmt.Errorf("%q is not an SNS topic ARN", topicARN)
+	}
+
+	_, err = service.GetTopicAttributes(&sns.GetTopicAttributesInput{TopicArn: aws.String(topicARN)})
+	if err == nil {
+		log.Info().Msgf("SNS topic %s already exists", topicARN)
+		return nil
+	}
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) || awsErr.Code() != sns.ErrCodeNotFoundException {
+		return fmt.Errorf("sns.GetTopicAttributes: %w", err)
+	}
+
+	input := &sns.CreateTopicInput{Name: aws.String(parsedARN.Resource)}
+	if kmsKeyID != "" {
+		input.Attributes = map[string]*string{"KmsMasterKeyId": aws.String(kmsKeyID)}
+	}
+	tagKeys := make([]string, 0, len(tags))
+	for key := range tags {
+		tagKeys = append(tagKeys, key)
+	}
+	sort.Strings(tagKeys)
+	for _, key := range tagKeys {
+		input.Tags = append(input.Tags, &sns.Tag{Key: aws.String(key), Value: aws.String(tags[key])})
+	}
+	output, err := service.CreateTopic(input)
+	if err != nil {
+		return fmt.Errorf("sns.CreateTopic: %w", err)
+	}
+	// Topics are created in the region & account of the client, which may
+	// not be those of the ARN.
+	if createdARN := aws.StringValue(output.TopicArn); createdARN != topicARN {
+		return fmt.Errorf("created SNS topic %s, not %s: check --aws-sns-region and --aws-sns-identity", createdARN, topicARN)
+	}
+	log.Info().Msgf("created SNS topic %s", topicARN)
+	return nil
+}
+
 // AWSSNSEnqueuer implements Enqueuer using AWS SNS
 type AWSSNSEnqueuer struct {
 	service   *sns.SNS
 	topicARN  string
 	waitGroup sync.WaitGroup
 	dryRun    bool
+	signer    *Signer
 }
 
-func NewAWSSNSEnqueuer(region, identity, topicARN string, dryRun bool) (*AWSSNSEnqueuer, error) {
+// NewAWSSNSEnqueuer creates a task enqueuer for a given topic in AWS SNS. If
+// dryRun is true, no tasks will actually be enqueued. If signer is not nil,
+// tasks are signed and the signature is included in the message's attributes.
+func NewAWSSNSEnqueuer(region, identity, topicARN string, dryRun bool, signer *Signer) (*AWSSNSEnqueuer, error) {
 	session, config, err := leaws.ClientConfig(region, identity)
 	if err != nil {
 		return nil, err
@@ -225,6 +371,7 @@ func NewAWSSNSEnqueuer(region, identity, topicARN string, dryRun bool) (*AWSSNSE
 		service:  sns.New(session, config),
 		topicARN: topicARN,
 		dryRun:   dryRun,
+		signer:   signer,
 	}, nil
 }
 
@@ -241,16 +388,32 @@ func (e *AWSSNSEnqueuer) Enqueue(task Task, completion func(error)) {
 		completion(fmt.Errorf("marshaling task to JSON: %w", err))
 		return
 	}
+	attributes, err := taskAttributes(e.signer, task, jsonTask)
+	if err != nil {
+		completion(err)
+		return
+	}
 
 	if e.dryRun {
 		log.Info().Msg("dry run, not enqueuing task")
 		completion(nil)
 		return
 	}
+	var messageAttributes map[string]*sns.MessageAttributeValue
+	if len(attributes) > 0 {
+		messageAttributes = map[string]*sns.MessageAttributeValue{}
+	}
+	for name, value := range attributes {
+		messageAttributes[name] = &sns.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
 	// There's nothing in the PublishOutput we care about, so we discard it.
 	_, err = e.service.Publish(&sns.PublishInput{
-		TopicArn: aws.String(e.topicARN),
-		Message:  aws.String(string(jsonTask)),
+		TopicArn:          aws.String(e.topicARN),
+		Message:           aws.String(string(jsonTask)),
+		MessageAttributes: messageAttributes,
 	})
 	if err != nil {
 		completion(fmt.Errorf("failed to publish task %+v: %w", task, err))
@@ -263,3 +426,340 @@ func (e *AWSSNSEnqueuer) Enqueue(task Task, completion func(error)) {
 func (e *AWSSNSEnqueuer) Stop() {
 	e.waitGroup.Wait()
 }
+
+// azureServiceBusTokenLifetime is how long each shared access signature used
+// to publish to Azure Service Bus is valid for. A token is generated for each
+// request, so it need only outlive a single request.
+const azureServiceBusTokenLifetime = time.Hour
+
+// AzureServiceBusEnqueuer implements Enqueuer using Azure Service Bus, via its
+// REST API. Messages may be sent to either a queue or a topic.
+type AzureServiceBusEnqueuer struct {
+	client      *http.Client
+	credentials leazure.ServiceBusConnectionString
+	entityURI   string // e.g. https://prio.servicebus.windows.net/intake-tasks
+	waitGroup   sync.WaitGroup
+	dryRun      bool
+	signer      *Signer
+}
+
+// NewAzureServiceBusEnqueuer creates a task enqueuer for a given queue or
+// topic in the given fully-qualified Azure Service Bus namespace (e.g.
+// "prio.servicebus.windows.net"), authorizing requests with shared access
+// signatures derived from credentials. If namespace is empty, the namespace
+// from the credentials' endpoint is used. If dryRun is true, no tasks will
+// actually be enqueued. If signer is not nil, tasks are signed and the
+// signature is included in the message's custom properties.
+func NewAzureServiceBusEnqueuer(namespace string, credentials leazure.ServiceBusConnectionString, entity string, dryRun bool, signer *Signer) (*AzureServiceBusEnqueuer, error) {
+	if namespace == "" {
+		namespace = credentials.Namespace
+	}
+	if namespace == "" {
+		return nil, fmt.Errorf("no Azure Service Bus namespace provided, and connection string has no endpoint")
+	}
+
+	return &AzureServiceBusEnqueuer{
+		client:      &http.Client{},
+		credentials: credentials,
+		entityURI:   (&url.URL{Scheme: "https", Host: namespace, Path: "/" + entity}).String(),
+		dryRun:      dryRun,
+		signer:      signer,
+	}, nil
+}
+
+func (e *AzureServiceBusEnqueuer) Enqueue(task Task, completion func(error)) {
+	// Like sns.Publish(), sending a message blocks until the message has been
+	// saved by Service Bus, but we still use a waitgroup so that Stop() will
+	// block until all pending calls to Enqueue() complete.
+	e.waitGroup.Add(1)
+	defer e.waitGroup.Done()
+
+	jsonTask, err := json.Marshal(task)
+	if err != nil {
+		completion(fmt.Errorf("marshaling task to JSON: %w", err))
+		return
+	}
+	attributes, err := taskAttributes(e.signer, task, jsonTask)
+	if err != nil {
+		completion(err)
+		return
+	}
+
+	if e.dryRun {
+		log.Info().Msg("dry run, not enqueuing task")
+		completion(nil)
+		return
+	}
+
+	// The task marker is used as the message ID so that, if duplicate
+	// detection is enabled on the queue or topic, retried sends of the same
+	// task are delivered only once. Service Bus supports scheduled delivery,
+	// so tasks are also held until their not-before time, if any.
+	properties := map[string]string{"MessageId": task.Marker()}
+	if notBefore := task.DeliveryAttributes().NotBefore; !notBefore.IsZero() {
+		properties["ScheduledEnqueueTimeUtc"] = notBefore.UTC().Format(http.TimeFormat)
+	}
+	brokerProperties, err := json.Marshal(properties)
+	if err != nil {
+		completion(fmt.Errorf("marshaling broker properties to JSON: %w", err))
+		return
+	}
+
+	ctx, cancel := wftime.ContextWithTimeout()
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.entityURI+"/messages", bytes.NewReader(jsonTask))
+	if err != nil {
+		completion(fmt.Errorf("building request: %w", err))
+		return
+	}
+	req.Header.Set("Authorization", e.credentials.SharedAccessSignature(e.entityURI, time.Now().Add(azureServiceBusTokenLifetime)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("BrokerProperties", string(brokerProperties))
+	// Custom message properties are sent as HTTP headers.
+	for name, value := range attributes {
+		req.Header.Set(name, strconv.Quote(value))
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		completion(fmt.Errorf("failed to publish task %+v: %w", task, err))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		completion(fmt.Errorf("failed to publish task %+v: status code %d: %s", task, resp.StatusCode, body))
+		return
+	}
+
+	completion(nil)
+}
+
+func (e *AzureServiceBusEnqueuer) Stop() {
+	e.waitGroup.Wait()
+}
+
+const (
+	// HTTPWebhookTimestampHeader is the name of the header holding the time, in
+	// seconds since the UNIX epoch, at which a task was sent to an HTTP webhook.
+	HTTPWebhookTimestampHeader = "X-Prio-Timestamp"
+	// HTTPWebhookSignatureHeader is the name of the header holding the HMAC
+	// authenticating a task sent to an HTTP webhook, formatted like
+	// "sha256=<hex>". See HTTPWebhookSignature.
+	HTTPWebhookSignatureHeader = "X-Prio-Signature"
+	// HTTPWebhookTaskIDHeader is the name of the header holding the marker of a
+	// task sent to an HTTP webhook, which receivers may use to discard retried
+	// sends of the same task.
+	HTTPWebhookTaskIDHeader = "X-Prio-Task-Id"
+	// HTTPWebhookAttributeHeaderPrefix prefixes the names of the headers
+	// holding a task's message attributes, e.g. "X-Prio-Attribute-Priority".
+	HTTPWebhookAttributeHeaderPrefix = "X-Prio-Attribute-"
+)
+
+// HTTPWebhookSignature returns the value of the HTTPWebhookSignatureHeader
+// for a request with the provided body, sent at the provided time in seconds
+// since the UNIX epoch: the hex-encoded HMAC-SHA256, keyed with key, of the
+// timestamp, a period, and the body. Covering the timestamp allows receivers
+// to reject replayed requests.
+func HTTPWebhookSignature(key []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ReadHTTPWebhookKey reads the HMAC key used to sign requests to an HTTP
+// webhook from the file at path, e.g. a mounted Kubernetes secret. Leading &
+// trailing whitespace is ignored.
+func ReadHTTPWebhookKey(path string) ([]byte, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading HTTP webhook key: %w", err)
+	}
+	key := bytes.TrimSpace(contents)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("HTTP webhook key file %s is empty", path)
+	}
+	return key, nil
+}
+
+// HTTPWebhookEnqueuer implements Enqueuer by POSTing tasks as JSON to an
+// HTTPS endpoint, e.g. a facilitator run as a plain service, authenticating
+// each request with an HMAC. Any 2xx response means the task was accepted.
+type HTTPWebhookEnqueuer struct {
+	client    *http.Client
+	url       string // e.g. https://facilitator.example.com/tasks/intake-tasks
+	key       []byte
+	waitGroup sync.WaitGroup
+	dryRun    bool
+	signer    *Signer
+}
+
+// NewHTTPWebhookEnqueuer creates a task enqueuer which POSTs tasks to the
+// given topic beneath the HTTPS URL endpoint, e.g. to
+// "https://facilitator.example.com/tasks/intake-tasks" for the endpoint
+// "https://facilitator.example.com/tasks" and topic "intake-tasks", signing
+// requests with key. If dryRun is true, no tasks will actually be enqueued. If
+// signer is not nil, tasks are also signed and the signature is included in
+// the request's attribute headers.
+func NewHTTPWebhookEnqueuer(endpoint string, topic string, key []byte, dryRun bool, signer *Signer) (*HTTPWebhookEnqueuer, error) {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing HTTP webhook URL: %w", err)
+	}
+	if endpointURL.Scheme != "https" || endpointURL.Host == "" {
+		return nil, fmt.Errorf("HTTP webhook URL %q is not an https:// URL", endpoint)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("no HTTP webhook key provided")
+	}
+
+	return &HTTPWebhookEnqueuer{
+		client: &http.Client{},
+		url:    endpointURL.JoinPath(topic).String(),
+		key:    key,
+		dryRun: dryRun,
+		signer: signer,
+	}, nil
+}
+
+func (e *HTTPWebhookEnqueuer) Enqueue(task Task, completion func(error)) {
+	// As with Service Bus, the request blocks until the task has been
+	// accepted, but we still use a waitgroup so that Stop() will block until
+	// all pending calls to Enqueue() complete.
+	e.waitGroup.Add(1)
+	defer e.waitGroup.Done()
+
+	jsonTask, err := json.Marshal(task)
+	if err != nil {
+		completion(fmt.Errorf("marshaling task to JSON: %w", err))
+		return
+	}
+	attributes, err := taskAttributes(e.signer, task, jsonTask)
+	if err != nil {
+		completion(err)
+		return
+	}
+
+	if e.dryRun {
+		log.Info().Msg("dry run, not enqueuing task")
+		completion(nil)
+		return
+	}
+
+	ctx, cancel := wftime.ContextWithTimeout()
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(jsonTask))
+	if err != nil {
+		completion(fmt.Errorf("building request: %w", err))
+		return
+	}
+	// The timestamp is regenerated for each attempt, so that retried sends
+	// aren't rejected as replays.
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HTTPWebhookTimestampHeader, timestamp)
+	req.Header.Set(HTTPWebhookSignatureHeader, HTTPWebhookSignature(e.key, timestamp, jsonTask))
+	req.Header.Set(HTTPWebhookTaskIDHeader, task.Marker())
+	for name, value := range attributes {
+		req.Header.Set(HTTPWebhookAttributeHeaderPrefix+name, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		completion(fmt.Errorf("failed to publish task %+v: %w", task, err))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		completion(fmt.Errorf("failed to publish task %+v: status code %d: %s", task, resp.StatusCode, body))
+		return
+	}
+
+	completion(nil)
+}
+
+func (e *HTTPWebhookEnqueuer) Stop() {
+	e.waitGroup.Wait()
+}
+
+// RetryingEnqueuer implements Enqueuer by wrapping another Enqueuer, and
+// re-attempting to enqueue tasks whose enqueueing fails, with exponential
+// backoff between attempts. Completion functions passed to Enqueue() are
+// invoked only once the task has been successfully enqueued or all attempts
+// have failed, in which case the error from the final attempt is provided.
+type RetryingEnqueuer struct {
+	enqueuer       Enqueuer
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	waitGroup      sync.WaitGroup
+}
+
+// NewRetryingEnqueuer creates a task enqueuer that makes up to maxAttempts
+// attempts to enqueue each task into the provided enqueuer. The delay before
+// the second attempt is initialBackoff, doubling for each subsequent attempt
+// up to a maximum of maxBackoff.
+func NewRetryingEnqueuer(enqueuer Enqueuer, maxAttempts int, initialBackoff, maxBackoff time.Duration) *RetryingEnqueuer {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &RetryingEnqueuer{
+		enqueuer:       enqueuer,
+		maxAttempts:    maxAttempts,
+		initialBackoff: initialBackoff,
+		maxBackoff:     maxBackoff,
+	}
+}
+
+func (e *RetryingEnqueuer) Enqueue(task Task, completion func(error)) {
+	e.waitGroup.Add(1)
+	e.enqueue(task, 1, completion)
+}
+
+func (e *RetryingEnqueuer) enqueue(task Task, attempt int, completion func(error)) {
+	e.enqueuer.Enqueue(task, func(err error) {
+		if err == nil || attempt >= e.maxAttempts {
+			defer e.waitGroup.Done()
+			if err != nil {
+				err = fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+			}
+			completion(err)
+			return
+		}
+
+		backoff := e.backoff(attempt)
+		log.Warn().Err(err).
+			Str("task", task.Marker()).
+			Int("attempt", attempt).
+			Msgf("failed to enqueue task, retrying in %s", backoff)
+		// Retry from a new goroutine: the wrapped enqueuer may be holding
+		// resources (e.g. a limiter ticket) until this completion function
+		// returns, which could otherwise deadlock the retry.
+		go func() {
+			time.Sleep(backoff)
+			e.enqueue(task, attempt+1, completion)
+		}()
+	})
+}
+
+// backoff returns the delay to wait after the given (1-indexed) failed
+// attempt before making the next attempt.
+func (e *RetryingEnqueuer) backoff(attempt int) time.Duration {
+	backoff := e.initialBackoff
+	for i := 1; i < attempt && backoff < e.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > e.maxBackoff {
+		backoff = e.maxBackoff
+	}
+	return backoff
+}
+
+func (e *RetryingEnqueuer) Stop() {
+	// Wait for all retries to complete before stopping the wrapped enqueuer,
+	// since retries may still call its Enqueue().
+	e.waitGroup.Wait()
+	e.enqueuer.Stop()
+}
@@ -0,0 +1,602 @@
+package task
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/google/uuid"
+
+	leazure "github.com/letsencrypt/prio-server/workflow-manager/azure"
+)
+
+// flakyEnqueuer fails to enqueue each task until it has been attempted
+// failures times.
+type flakyEnqueuer struct {
+	mu       sync.Mutex
+	failures int
+	attempts map[string]int
+}
+
+func (e *flakyEnqueuer) Enqueue(task Task, completion func(error)) {
+	e.mu.Lock()
+	e.attempts[task.Marker()]++
+	attempts := e.attempts[task.Marker()]
+	e.mu.Unlock()
+
+	if attempts <= e.failures {
+		completion(errors.New("enqueue failed"))
+		return
+	}
+	completion(nil)
+}
+
+func (e *flakyEnqueuer) Stop() {}
+
+func TestRetryingEnqueuer(t *testing.T) {
+	for _, testCase := range []struct {
+		name             string
+		failures         int
+		maxAttempts      int
+		expectedAttempts int
+		expectError      bool
+	}{
+		{
+			name:             "success-first-attempt",
+			failures:         0,
+			maxAttempts:      3,
+			expectedAttempts: 1,
+		},
+		{
+			name:             "success-after-retry",
+			failures:         2,
+			maxAttempts:      3,
+			expectedAttempts: 3,
+		},
+		{
+			name:             "attempts-exhausted",
+			failures:         3,
+			maxAttempts:      3,
+			expectedAttempts: 3,
+			expectError:      true,
+		},
+		{
+			name:             "no-retries",
+			failures:         1,
+			maxAttempts:      1,
+			expectedAttempts: 1,
+			expectError:      true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			flaky := &flakyEnqueuer{failures: testCase.failures, attempts: map[string]int{}}
+			enqueuer := NewRetryingEnqueuer(flaky, testCase.maxAttempts, time.Millisecond, 2*time.Millisecond)
+
+			intakeTask := IntakeBatch{AggregationID: "kittens-seen", BatchID: "batch"}
+			var completionErr error
+			completions := 0
+			enqueuer.Enqueue(intakeTask, func(err error) {
+				completionErr = err
+				completions++
+			})
+			enqueuer.Stop()
+
+			if completions != 1 {
+				t.Errorf("completion called %d times, expected 1", completions)
+			}
+			if attempts := flaky.attempts[intakeTask.Marker()]; attempts != testCase.expectedAttempts {
+				t.Errorf("made %d attempts, expected %d", attempts, testCase.expectedAttempts)
+			}
+			if testCase.expectError && completionErr == nil {
+				t.Errorf("expected error, got none")
+			}
+			if !testCase.expectError && completionErr != nil {
+				t.Errorf("unexpected error %q", completionErr)
+			}
+		})
+	}
+}
+
+func TestRetryingEnqueuerBackoff(t *testing.T) {
+	enqueuer := NewRetryingEnqueuer(&flakyEnqueuer{}, 10, time.Second, 5*time.Second)
+	for attempt, expected := range map[int]time.Duration{
+		1: time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		4: 5 * time.Second,
+		9: 5 * time.Second,
+	} {
+		if backoff := enqueuer.backoff(attempt); backoff != expected {
+			t.Errorf("backoff after attempt %d was %s, expected %s", attempt, backoff, expected)
+		}
+	}
+}
+
+func TestDryRunRecorder(t *testing.T) {
+	intakeTasks := []IntakeBatch{
+		{AggregationID: "kittens-seen", BatchID: "batch-1"},
+		{AggregationID: "kittens-seen", BatchID: "batch-2"},
+	}
+	aggregationTask := Aggregation{
+		AggregationID: "kittens-seen",
+		Batches:       []Batch{{ID: "batch-1"}, {ID: "batch-2"}},
+	}
+
+	// runDryRun records the tasks above, enqueued in the provided order and
+	// with fresh trace IDs.
+	runDryRun := func(intakeOrder []int) DryRunReport {
+		recorder := NewDryRunRecorder()
+		intakeEnqueuer := recorder.Wrap("intake", &flakyEnqueuer{attempts: map[string]int{}})
+		aggregationEnqueuer := recorder.Wrap("aggregate", &flakyEnqueuer{attempts: map[string]int{}})
+		for _, i := range intakeOrder {
+			intakeTask := intakeTasks[i]
+			intakeTask.TraceID = uuid.New()
+			intakeEnqueuer.Enqueue(intakeTask, func(err error) {
+				if err != nil {
+					t.Errorf("unexpected error %q", err)
+				}
+			})
+		}
+		aggregationTask := aggregationTask
+		aggregationTask.TraceID = uuid.New()
+		aggregationEnqueuer.Enqueue(aggregationTask, func(err error) {
+			if err != nil {
+				t.Errorf("unexpected error %q", err)
+			}
+		})
+		return recorder.Report()
+	}
+
+	first := runDryRun([]int{0, 1})
+	second := runDryRun([]int{1, 0})
+	if len(first.Tasks) != 3 {
+		t.Fatalf("recorded %d tasks, expected 3", len(first.Tasks))
+	}
+	if first.Hash != second.Hash {
+		t.Errorf("hashes of equivalent dry runs differ: %s, %s", first.Hash, second.Hash)
+	}
+	if added, removed := second.Diff(first); len(added) != 0 || len(removed) != 0 {
+		t.Errorf("equivalent dry runs differ: added %+v, removed %+v", added, removed)
+	}
+
+	third := runDryRun([]int{0})
+	if third.Hash == first.Hash {
+		t.Errorf("hashes of different dry runs are both %s", first.Hash)
+	}
+	added, removed := third.Diff(first)
+	if len(added) != 0 {
+		t.Errorf("unexpected added tasks %+v", added)
+	}
+	if len(removed) != 1 || removed[0].Marker != intakeTasks[1].Marker() {
+		t.Errorf("unexpected removed tasks %+v, expected only %s", removed, intakeTasks[1].Marker())
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(4)
+	now := time.Unix(1000, 0)
+	var slept time.Duration
+	limiter.now = func() time.Time { return now }
+	limiter.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+
+	// Tasks enqueued into either wrapped enqueuer share the limit, so
+	// enqueueing five tasks at once takes a second.
+	intakeEnqueuer := limiter.Wrap(&flakyEnqueuer{attempts: map[string]int{}})
+	aggregationEnqueuer := limiter.Wrap(&flakyEnqueuer{attempts: map[string]int{}})
+	for i := 0; i < 4; i++ {
+		intakeEnqueuer.Enqueue(IntakeBatch{AggregationID: "kittens-seen", BatchID: "batch"}, func(error) {})
+	}
+	aggregationEnqueuer.Enqueue(Aggregation{AggregationID: "kittens-seen"}, func(error) {})
+	if slept != time.Second {
+		t.Errorf("slept %s enqueueing five tasks, expected 1s", slept)
+	}
+
+	// After an idle period, tasks are not delayed to catch up.
+	now = now.Add(time.Minute)
+	slept = 0
+	intakeEnqueuer.Enqueue(IntakeBatch{AggregationID: "kittens-seen", BatchID: "batch"}, func(error) {})
+	if slept != 0 {
+		t.Errorf("slept %s enqueueing a task after an idle period, expected none", slept)
+	}
+}
+
+// gatedEnqueuer completes each task asynchronously, once the gate for its
+// aggregation ID is closed.
+type gatedEnqueuer struct {
+	gates map[string]chan struct{}
+}
+
+func (e *gatedEnqueuer) Enqueue(task Task, completion func(error)) {
+	gate := e.gates[task.(IntakeBatch).AggregationID]
+	go func() {
+		<-gate
+		completion(nil)
+	}()
+}
+
+func (e *gatedEnqueuer) Stop() {}
+
+func TestScopedEnqueuer(t *testing.T) {
+	shared := &gatedEnqueuer{gates: map[string]chan struct{}{
+		"kittens-seen": make(chan struct{}),
+		"dogs-seen":    make(chan struct{}),
+	}}
+	kittens, dogs := NewScopedEnqueuer(shared), NewScopedEnqueuer(shared)
+
+	var kittensCompleted, dogsCompleted int
+	var mu sync.Mutex
+	for i := 0; i < 3; i++ {
+		kittens.Enqueue(IntakeBatch{AggregationID: "kittens-seen", BatchID: fmt.Sprint(i)}, func(error) {
+			mu.Lock()
+			kittensCompleted++
+			mu.Unlock()
+		})
+		dogs.Enqueue(IntakeBatch{AggregationID: "dogs-seen", BatchID: fmt.Sprint(i)}, func(error) {
+			mu.Lock()
+			dogsCompleted++
+			mu.Unlock()
+		})
+	}
+
+	// Stopping one scope waits for its own tasks only, while the other's are
+	// still pending.
+	close(shared.gates["kittens-seen"])
+	kittens.Stop()
+	mu.Lock()
+	if kittensCompleted != 3 || dogsCompleted != 0 {
+		t.Errorf("after stopping kittens-seen scope, %d kittens-seen & %d dogs-seen tasks completed, expected 3 & 0",
+			kittensCompleted, dogsCompleted)
+	}
+	mu.Unlock()
+
+	close(shared.gates["dogs-seen"])
+	dogs.Stop()
+	mu.Lock()
+	if dogsCompleted != 3 {
+		t.Errorf("after stopping dogs-seen scope, %d dogs-seen tasks completed, expected 3", dogsCompleted)
+	}
+	mu.Unlock()
+}
+
+func TestSigner(t *testing.T) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Couldn't generate key: %v", err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		t.Fatalf("Couldn't marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "secret_key"), []byte(base64.StdEncoding.EncodeToString(pkcs8)), 0600); err != nil {
+		t.Fatalf("Couldn't write secret key: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "primary_kid"), []byte("env-locality-task-signing-key-1000"), 0600); err != nil {
+		t.Fatalf("Couldn't write key ID: %v", err)
+	}
+	signer, err := NewSignerFromDirectory(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error from NewSignerFromDirectory: %v", err)
+	}
+
+	message := []byte(`{"aggregation-id":"kittens-seen"}`)
+	attributes, err := signTask(signer, message)
+	if err != nil {
+		t.Fatalf("Unexpected error from signTask: %v", err)
+	}
+	if got, want := attributes[SignatureKeyIDAttribute], "env-locality-task-signing-key-1000"; got != want {
+		t.Errorf("Unexpected key ID attribute %q, want %q", got, want)
+	}
+	sig, err := base64.StdEncoding.DecodeString(attributes[SignatureAttribute])
+	if err != nil {
+		t.Fatalf("Couldn't decode signature: %v", err)
+	}
+	digest := sha256.Sum256(message)
+	if !ecdsa.VerifyASN1(&privKey.PublicKey, digest[:], sig) {
+		t.Errorf("Signature did not verify")
+	}
+	otherDigest := sha256.Sum256([]byte(`{"aggregation-id":"puppies-seen"}`))
+	if ecdsa.VerifyASN1(&privKey.PublicKey, otherDigest[:], sig) {
+		t.Errorf("Signature verified over a different message")
+	}
+
+	if attributes, err := signTask(nil, message); err != nil || attributes != nil {
+		t.Errorf("signTask with nil signer = (%v, %v), want (nil, nil)", attributes, err)
+	}
+	if _, err := NewSigner("kid", []byte("not-a-real-key")); err == nil {
+		t.Errorf("Wanted error from NewSigner with placeholder key, got none")
+	}
+}
+
+func TestTaskAttributes(t *testing.T) {
+	task := IntakeBatch{AggregationID: "kittens-seen", BatchID: "batch-1"}
+
+	attributes, err := taskAttributes(nil, task, []byte("{}"))
+	if err != nil {
+		t.Fatalf("Unexpected error from taskAttributes: %v", err)
+	}
+	if attributes != nil {
+		t.Errorf("Got attributes %v for unsigned task with default delivery, want nil", attributes)
+	}
+
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Couldn't generate key: %v", err)
+	}
+	signer := &Signer{keyID: "key-1", key: privKey}
+	task.Delivery = DeliveryAttributes{
+		Priority:  PriorityLow,
+		NotBefore: time.Date(2021, 1, 1, 0, 0, 0, 0, time.FixedZone("UTC-8", -8*60*60)),
+	}
+	attributes, err = taskAttributes(signer, task, []byte("{}"))
+	if err != nil {
+		t.Fatalf("Unexpected error from taskAttributes: %v", err)
+	}
+	for name, want := range map[string]string{
+		PriorityAttribute:       "low",
+		NotBeforeAttribute:      "2021-01-01T08:00:00Z",
+		SignatureKeyIDAttribute: "key-1",
+	} {
+		if got := attributes[name]; got != want {
+			t.Errorf("Attribute %q = %q, want %q", name, got, want)
+		}
+	}
+	if attributes[SignatureAttribute] == "" {
+		t.Errorf("Missing attribute %q", SignatureAttribute)
+	}
+	if len(attributes) != 4 {
+		t.Errorf("Got attributes %v, want 4", attributes)
+	}
+}
+
+func TestAzureServiceBusEnqueuer(t *testing.T) {
+	var (
+		status  = http.StatusCreated
+		gotReqs []*http.Request
+		gotBody []string
+	)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotReqs = append(gotReqs, r)
+		gotBody = append(gotBody, string(body))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("Couldn't parse server URL: %v", err)
+	}
+	credentials := leazure.ServiceBusConnectionString{Namespace: serverURL.Host, KeyName: "workflow-manager", Key: "secret"}
+	enqueuer, err := NewAzureServiceBusEnqueuer("", credentials, "intake-tasks", false, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from NewAzureServiceBusEnqueuer: %v", err)
+	}
+	enqueuer.client = server.Client()
+
+	task := IntakeBatch{AggregationID: "kittens-seen", BatchID: "batch-1"}
+	var enqueueErr error
+	enqueuer.Enqueue(task, func(err error) { enqueueErr = err })
+	enqueuer.Stop()
+	if enqueueErr != nil {
+		t.Fatalf("Unexpected error from Enqueue: %v", enqueueErr)
+	}
+	if len(gotReqs) != 1 {
+		t.Fatalf("Got %d requests, want 1", len(gotReqs))
+	}
+	req := gotReqs[0]
+	if req.Method != http.MethodPost || req.URL.Path != "/intake-tasks/messages" {
+		t.Errorf("Got request %s %s, want POST /intake-tasks/messages", req.Method, req.URL.Path)
+	}
+	if got := req.Header.Get("Authorization"); !strings.HasPrefix(got, "SharedAccessSignature sr=") || !strings.Contains(got, "skn=workflow-manager") {
+		t.Errorf("Unexpected Authorization header %q", got)
+	}
+	if got, want := req.Header.Get("BrokerProperties"), fmt.Sprintf(`{"MessageId":%q}`, task.Marker()); got != want {
+		t.Errorf("BrokerProperties header = %q, want %q", got, want)
+	}
+	wantBody, _ := json.Marshal(task)
+	if gotBody[0] != string(wantBody) {
+		t.Errorf("Body = %q, want %q", gotBody[0], wantBody)
+	}
+
+	// Delivery attributes are sent as custom properties, and tasks are
+	// scheduled for delivery at their not-before time.
+	notBefore := time.Date(2021, 1, 1, 8, 0, 0, 0, time.UTC)
+	task.Delivery = DeliveryAttributes{Priority: PriorityLow, NotBefore: notBefore}
+	enqueuer.Enqueue(task, func(err error) { enqueueErr = err })
+	enqueuer.Stop()
+	if enqueueErr != nil {
+		t.Fatalf("Unexpected error from Enqueue: %v", enqueueErr)
+	}
+	req = gotReqs[len(gotReqs)-1]
+	if got, want := req.Header.Get("BrokerProperties"), fmt.Sprintf(`{"MessageId":%q,"ScheduledEnqueueTimeUtc":"Fri, 01 Jan 2021 08:00:00 GMT"}`, task.Marker()); got != want {
+		t.Errorf("BrokerProperties header = %q, want %q", got, want)
+	}
+	if got, want := req.Header.Get(PriorityAttribute), `"low"`; got != want {
+		t.Errorf("%s header = %q, want %q", PriorityAttribute, got, want)
+	}
+	if got, want := req.Header.Get(NotBeforeAttribute), `"2021-01-01T08:00:00Z"`; got != want {
+		t.Errorf("%s header = %q, want %q", NotBeforeAttribute, got, want)
+	}
+	if gotBody[len(gotBody)-1] != string(wantBody) {
+		t.Errorf("Body = %q, want %q", gotBody[len(gotBody)-1], wantBody)
+	}
+
+	// Failed sends are reported to the completion function.
+	status = http.StatusUnauthorized
+	enqueuer.Enqueue(task, func(err error) { enqueueErr = err })
+	enqueuer.Stop()
+	if enqueueErr == nil || !strings.Contains(enqueueErr.Error(), "status code 401") {
+		t.Errorf("Wanted error with status code 401, got: %v", enqueueErr)
+	}
+
+	if _, err := NewAzureServiceBusEnqueuer("", leazure.ServiceBusConnectionString{KeyName: "k", Key: "secret"}, "intake-tasks", false, nil); err == nil {
+		t.Errorf("Wanted error from NewAzureServiceBusEnqueuer without a namespace, got none")
+	}
+}
+
+func TestHTTPWebhookEnqueuer(t *testing.T) {
+	var (
+		status  = http.StatusAccepted
+		gotReqs []*http.Request
+		gotBody []string
+	)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotReqs = append(gotReqs, r)
+		gotBody = append(gotBody, string(body))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	key := []byte("secret")
+	enqueuer, err := NewHTTPWebhookEnqueuer(server.URL+"/tasks", "intake-tasks", key, false, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from NewHTTPWebhookEnqueuer: %v", err)
+	}
+	enqueuer.client = server.Client()
+
+	task := IntakeBatch{AggregationID: "kittens-seen", BatchID: "batch-1"}
+	var enqueueErr error
+	enqueuer.Enqueue(task, func(err error) { enqueueErr = err })
+	enqueuer.Stop()
+	if enqueueErr != nil {
+		t.Fatalf("Unexpected error from Enqueue: %v", enqueueErr)
+	}
+	if len(gotReqs) != 1 {
+		t.Fatalf("Got %d requests, want 1", len(gotReqs))
+	}
+	req := gotReqs[0]
+	if req.Method != http.MethodPost || req.URL.Path != "/tasks/intake-tasks" {
+		t.Errorf("Got request %s %s, want POST /tasks/intake-tasks", req.Method, req.URL.Path)
+	}
+	wantBody, _ := json.Marshal(task)
+	if gotBody[0] != string(wantBody) {
+		t.Errorf("Body = %q, want %q", gotBody[0], wantBody)
+	}
+	timestamp := req.Header.Get(HTTPWebhookTimestampHeader)
+	if got, want := req.Header.Get(HTTPWebhookSignatureHeader), HTTPWebhookSignature(key, timestamp, wantBody); got != want {
+		t.Errorf("%s header = %q, want %q", HTTPWebhookSignatureHeader, got, want)
+	}
+	if got := HTTPWebhookSignature([]byte("other"), timestamp, wantBody); got == req.Header.Get(HTTPWebhookSignatureHeader) {
+		t.Errorf("Signature with another key matches %q", got)
+	}
+	if got, want := req.Header.Get(HTTPWebhookTaskIDHeader), task.Marker(); got != want {
+		t.Errorf("%s header = %q, want %q", HTTPWebhookTaskIDHeader, got, want)
+	}
+
+	// Delivery attributes are sent as attribute headers.
+	task.Delivery = DeliveryAttributes{Priority: PriorityLow}
+	enqueuer.Enqueue(task, func(err error) { enqueueErr = err })
+	enqueuer.Stop()
+	if enqueueErr != nil {
+		t.Fatalf("Unexpected error from Enqueue: %v", enqueueErr)
+	}
+	if got, want := gotReqs[len(gotReqs)-1].Header.Get(HTTPWebhookAttributeHeaderPrefix+PriorityAttribute), "low"; got != want {
+		t.Errorf("priority attribute header = %q, want %q", got, want)
+	}
+
+	// Failed sends are reported to the completion function.
+	status = http.StatusUnauthorized
+	enqueuer.Enqueue(task, func(err error) { enqueueErr = err })
+	enqueuer.Stop()
+	if enqueueErr == nil || !strings.Contains(enqueueErr.Error(), "status code 401") {
+		t.Errorf("Wanted error with status code 401, got: %v", enqueueErr)
+	}
+
+	for _, endpoint := range []string{"http://facilitator.example.com/tasks", "facilitator.example.com", "https://"} {
+		if _, err := NewHTTPWebhookEnqueuer(endpoint, "intake-tasks", key, false, nil); err == nil {
+			t.Errorf("Wanted error from NewHTTPWebhookEnqueuer with URL %q, got none", endpoint)
+		}
+	}
+	if _, err := NewHTTPWebhookEnqueuer(server.URL, "intake-tasks", nil, false, nil); err == nil {
+		t.Errorf("Wanted error from NewHTTPWebhookEnqueuer without a key, got none")
+	}
+}
+
+// fakeSNS implements the parts of snsiface.SNSAPI used to create topics,
+// holding topics in memory.
+type fakeSNS struct {
+	snsiface.SNSAPI
+	region, account string
+	topics          map[string]*sns.CreateTopicInput // by ARN
+}
+
+func (f *fakeSNS) GetTopicAttributes(input *sns.GetTopicAttributesInput) (*sns.GetTopicAttributesOutput, error) {
+	if _, ok := f.topics[aws.StringValue(input.TopicArn)]; !ok {
+		return nil, awserr.New(sns.ErrCodeNotFoundException, "Topic does not exist", nil)
+	}
+	return &sns.GetTopicAttributesOutput{}, nil
+}
+
+func (f *fakeSNS) CreateTopic(input *sns.CreateTopicInput) (*sns.CreateTopicOutput, error) {
+	topicARN := fmt.Sprintf("arn:aws:sns:%s:%s:%s", f.region, f.account, aws.StringValue(input.Name))
+	f.topics[topicARN] = input
+	return &sns.CreateTopicOutput{TopicArn: aws.String(topicARN)}, nil
+}
+
+func TestCreateSNSTopic(t *testing.T) {
+	const topicARN = "arn:aws:sns:us-west-2:123456789012:intake-tasks"
+	service := &fakeSNS{region: "us-west-2", account: "123456789012", topics: map[string]*sns.CreateTopicInput{}}
+	tags := map[string]string{"locality": "us-ca", "environment": "prod-us"}
+
+	// A missing topic is created with the given tags & KMS key.
+	if err := createSNSTopic(service, topicARN, tags, "alias/sns"); err != nil {
+		t.Fatalf("Unexpected error from createSNSTopic: %v", err)
+	}
+	input, ok := service.topics[topicARN]
+	if !ok {
+		t.Fatalf("Topic %s not created", topicARN)
+	}
+	if got := aws.StringValue(input.Attributes["KmsMasterKeyId"]); got != "alias/sns" {
+		t.Errorf("Got KMS key %q, want %q", got, "alias/sns")
+	}
+	var gotTags []string
+	for _, tag := range input.Tags {
+		gotTags = append(gotTags, aws.StringValue(tag.Key)+"="+aws.StringValue(tag.Value))
+	}
+	if got, want := strings.Join(gotTags, ","), "environment=prod-us,locality=us-ca"; got != want {
+		t.Errorf("Got tags %q, want %q", got, want)
+	}
+
+	// An existing topic is left unmodified.
+	if err := createSNSTopic(service, topicARN, nil, ""); err != nil {
+		t.Fatalf("Unexpected error from createSNSTopic: %v", err)
+	}
+	if service.topics[topicARN] != input {
+		t.Errorf("Existing topic was recreated")
+	}
+
+	// Topics which would be created in another region or account are
+	// rejected.
+	if err := createSNSTopic(service, "arn:aws:sns:us-east-1:123456789012:intake-tasks", nil, ""); err == nil {
+		t.Errorf("Wanted error creating topic in another region, got none")
+	}
+	if err := createSNSTopic(service, "arn:aws:sqs:us-west-2:123456789012:intake-tasks", nil, ""); err == nil {
+		t.Errorf("Wanted error creating topic with non-SNS ARN, got none")
+	}
+}
@@ -0,0 +1,356 @@
+// Package taskevent publishes CloudEvents describing the tasks scheduled and
+// skipped by workflow-manager, so that analytics pipelines can consume them in
+// a standard format rather than by scraping logs. Events are published in the
+// structured content mode of the CloudEvents 1.0 JSON event format.
+//
+// https://github.com/cloudevents/spec/blob/v1.0.2/cloudevents/spec.md
+package taskevent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+
+	leaws "github.com/letsencrypt/prio-server/workflow-manager/aws"
+	"github.com/letsencrypt/prio-server/workflow-manager/limiter"
+	"github.com/letsencrypt/prio-server/workflow-manager/task"
+	wftime "github.com/letsencrypt/prio-server/workflow-manager/time"
+)
+
+const (
+	// ScheduledType is the type of events describing a task which was
+	// enqueued.
+	ScheduledType = "org.isrg-prio.workflow-manager.task.scheduled"
+	// SkippedType is the type of events describing a task which was not
+	// enqueued, for the reason given in the event's data.
+	SkippedType = "org.isrg-prio.workflow-manager.task.skipped"
+
+	// contentType is the media type of events in the structured content mode
+	// of the JSON event format.
+	contentType = "application/cloudevents+json; charset=UTF-8"
+)
+
+// Reasons for which tasks are skipped.
+const (
+	// ReasonMarker is given for tasks whose task marker exists.
+	ReasonMarker = "marker"
+	// ReasonOwnValidation is given for intake tasks whose batch already has
+	// an own validation batch, so that only its task marker is written.
+	ReasonOwnValidation = "own-validation"
+	// ReasonDeferred is given for intake tasks deferred to a later run by
+	// --max-tasks-per-run.
+	ReasonDeferred = "deferred"
+	// ReasonWindowScheduled is given for aggregation windows which are not
+	// split into sub-windows because a task was already scheduled for the
+	// window or one of its sub-windows.
+	ReasonWindowScheduled = "window-scheduled"
+)
+
+var eventsFailed = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "workflow_manager_task_events_failed_total",
+		Help: "The number of task events which could not be published",
+	},
+)
+
+// Event is a CloudEvent describing a task.
+type Event struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject"` // the task's aggregation ID
+	Time            string    `json:"time"`    // RFC 3339
+	DataContentType string    `json:"datacontenttype"`
+	Data            EventData `json:"data"`
+}
+
+// EventData describes the task which is the subject of an Event.
+type EventData struct {
+	// Queue is the queue into which the task was or would have been enqueued:
+	// "intake" or "aggregate".
+	Queue string `json:"queue"`
+	// AggregationID is the task's aggregation ID.
+	AggregationID string `json:"aggregation-id"`
+	// BatchID is the ID of an intake task's batch, unless the task is
+	// coalesced from several batches.
+	BatchID string `json:"batch-id,omitempty"`
+	// BatchCount is the number of batches in the task: 1 for intake tasks,
+	// unless coalesced from several batches.
+	BatchCount int `json:"batch-count"`
+	// IntervalStart & IntervalEnd are the aggregation window of an
+	// aggregation task, the timestamp of an intake task's batch, or the
+	// timestamps of the oldest & newest batches of a coalesced intake task.
+	IntervalStart wftime.Timestamp `json:"interval-start"`
+	IntervalEnd   wftime.Timestamp `json:"interval-end"`
+	// TraceID is the trace ID of a scheduled task, as sent to the
+	// facilitator. Skipped tasks have none.
+	TraceID string `json:"trace-id,omitempty"`
+	// Marker is the name of the task's task marker.
+	Marker string `json:"marker"`
+	// Reason is why a skipped task was skipped: one of the Reason*
+	// constants.
+	Reason string `json:"reason,omitempty"`
+}
+
+// newEventData describes the provided task, which must be a task.IntakeBatch,
+// a task.IntakeBatches or a task.Aggregation.
+func newEventData(t task.Task) (EventData, error) {
+	switch t := t.(type) {
+	case task.IntakeBatch:
+		return EventData{
+			Queue:         "intake",
+			AggregationID: t.AggregationID,
+			BatchID:       t.BatchID,
+			BatchCount:    1,
+			IntervalStart: t.Date,
+			IntervalEnd:   t.Date,
+			TraceID:       t.TraceID.String(),
+			Marker:        t.Marker(),
+		}, nil
+	case task.IntakeBatches:
+		return EventData{
+			Queue:         "intake",
+			AggregationID: t.AggregationID,
+			BatchCount:    len(t.Batches),
+			IntervalStart: t.Batches[0].Time,
+			IntervalEnd:   t.Batches[len(t.Batches)-1].Time,
+			TraceID:       t.TraceID.String(),
+			Marker:        t.Marker(),
+		}, nil
+	case task.Aggregation:
+		return EventData{
+			Queue:         "aggregate",
+			AggregationID: t.AggregationID,
+			BatchCount:    len(t.Batches),
+			IntervalStart: t.AggregationStart,
+			IntervalEnd:   t.AggregationEnd,
+			TraceID:       t.TraceID.String(),
+			Marker:        t.Marker(),
+		}, nil
+	default:
+		return EventData{}, fmt.Errorf("unsupported task type %T", t)
+	}
+}
+
+// sender delivers the JSON encoding of an event.
+type sender interface {
+	send(ctx context.Context, event []byte) error
+}
+
+// Publisher publishes task events asynchronously. A nil *Publisher publishes
+// nothing, so that callers need not check whether events are enabled.
+type Publisher struct {
+	sender    sender
+	source    string
+	dryRun    bool
+	clock     wftime.Clock
+	limiter   *limiter.Limiter
+	waitGroup sync.WaitGroup
+}
+
+// NewPublisher creates a Publisher publishing events with the provided source
+// attribute to target, which is one of:
+//
+//   - an http:// or https:// URL, to which each event is POSTed;
+//   - "gcp-pubsub:projects/${project}/topics/${topic}", naming a GCP Pub/Sub
+//     topic to which each event is published, with a "content-type" attribute;
+//   - "aws-sns:${topic ARN}", naming an AWS SNS topic to which each event is
+//     published as the provided identity, with a "content-type" message
+//     attribute.
+//
+// If dryRun is true, no events will actually be published. At most maxWorkers
+// events are published concurrently.
+func NewPublisher(target, source, identity string, dryRun bool, maxWorkers int32) (*Publisher, error) {
+	var s sender
+	switch {
+	case strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://"):
+		s = httpSender{client: &http.Client{}, url: target}
+	case strings.HasPrefix(target, "gcp-pubsub:"):
+		topicName := strings.TrimPrefix(target, "gcp-pubsub:")
+		parts := strings.Split(topicName, "/")
+		if len(parts) != 4 || parts[0] != "projects" || parts[2] != "topics" || parts[1] == "" || parts[3] == "" {
+			return nil, fmt.Errorf("malformed topic name %q, want projects/{project}/topics/{topic}", topicName)
+		}
+		// Google documentation advises against timeouts on client creation
+		// https://godoc.org/cloud.google.com/go#hdr-Timeouts_and_Cancellation
+		client, err := pubsub.NewClient(context.Background(), parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("pubsub.NewClient: %w", err)
+		}
+		s = pubSubSender{topic: client.Topic(parts[3])}
+	case strings.HasPrefix(target, "aws-sns:"):
+		topicARN := strings.TrimPrefix(target, "aws-sns:")
+		parsedARN, err := arn.Parse(topicARN)
+		if err != nil || parsedARN.Service != sns.ServiceName {
+			return nil, fmt.Errorf("%q is not an SNS topic ARN", topicARN)
+		}
+		session, config, err := leaws.ClientConfig(parsedARN.Region, identity)
+		if err != nil {
+			return nil, err
+		}
+		s = snsSender{service: sns.New(session, config), topicARN: topicARN}
+	default:
+		return nil, fmt.Errorf("unsupported task event target %q, want an http(s):// URL, gcp-pubsub:projects/{project}/topics/{topic} or aws-sns:{topic ARN}", target)
+	}
+	return newPublisher(s, source, dryRun, maxWorkers, wftime.DefaultClock()), nil
+}
+
+func newPublisher(s sender, source string, dryRun bool, maxWorkers int32, clock wftime.Clock) *Publisher {
+	return &Publisher{
+		sender:  s,
+		source:  source,
+		dryRun:  dryRun,
+		clock:   clock,
+		limiter: limiter.New(maxWorkers),
+	}
+}
+
+// Scheduled publishes an event describing the provided task, which was
+// enqueued.
+func (p *Publisher) Scheduled(t task.Task) {
+	p.publish(ScheduledType, t, "")
+}
+
+// Skipped publishes an event describing the provided task, which was not
+// enqueued for the provided reason, one of the Reason* constants.
+func (p *Publisher) Skipped(t task.Task, reason string) {
+	p.publish(SkippedType, t, reason)
+}
+
+func (p *Publisher) publish(eventType string, t task.Task, reason string) {
+	if p == nil {
+		return
+	}
+	data, err := newEventData(t)
+	if err != nil {
+		log.Err(err).Msgf("failed to describe task for event: %s", err)
+		eventsFailed.Inc()
+		return
+	}
+	if eventType == SkippedType {
+		data.TraceID = ""
+	}
+	data.Reason = reason
+	event := Event{
+		SpecVersion:     "1.0",
+		ID:              uuid.New().String(),
+		Source:          p.source,
+		Type:            eventType,
+		Subject:         data.AggregationID,
+		Time:            p.clock.Now().UTC().Format(time.RFC3339Nano),
+		DataContentType: "application/json",
+		Data:            data,
+	}
+	jsonEvent, err := json.Marshal(event)
+	if err != nil {
+		log.Err(err).Msgf("failed to marshal event to JSON: %s", err)
+		eventsFailed.Inc()
+		return
+	}
+
+	if p.dryRun {
+		log.Debug().Str("event", string(jsonEvent)).Msg("dry run, not publishing task event")
+		return
+	}
+
+	p.limiter.Execute(func(ticket *limiter.Ticket) {
+		p.waitGroup.Add(1)
+		go func() {
+			defer p.waitGroup.Done()
+			defer p.limiter.Done(ticket)
+			ctx, cancel := wftime.ContextWithTimeout()
+			defer cancel()
+			if err := p.sender.send(ctx, jsonEvent); err != nil {
+				log.Err(err).
+					Str("event ID", event.ID).
+					Str("aggregation ID", data.AggregationID).
+					Msgf("failed to publish task event: %s", err)
+				eventsFailed.Inc()
+			}
+		}()
+	})
+}
+
+// Stop blocks until all events passed to the Publisher have been published or
+// have failed, so that it is safe to exit the program without losing events.
+func (p *Publisher) Stop() {
+	if p == nil {
+		return
+	}
+	p.waitGroup.Wait()
+}
+
+// httpSender POSTs events to a URL.
+type httpSender struct {
+	client *http.Client
+	url    string
+}
+
+func (s httpSender) send(ctx context.Context, event []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(event))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("posting event to %s: %w", s.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("posting event to %s: unexpected status %s: %s", s.url, resp.Status, body)
+	}
+	return nil
+}
+
+// pubSubSender publishes events to a GCP Pub/Sub topic.
+type pubSubSender struct {
+	topic *pubsub.Topic
+}
+
+func (s pubSubSender) send(ctx context.Context, event []byte) error {
+	res := s.topic.Publish(ctx, &pubsub.Message{
+		Data:       event,
+		Attributes: map[string]string{"content-type": contentType},
+	})
+	if _, err := res.Get(ctx); err != nil {
+		return fmt.Errorf("publishing event to %s: %w", s.topic, err)
+	}
+	return nil
+}
+
+// snsSender publishes events to an AWS SNS topic.
+type snsSender struct {
+	service  *sns.SNS
+	topicARN string
+}
+
+func (s snsSender) send(ctx context.Context, event []byte) error {
+	if _, err := s.service.PublishWithContext(ctx, &sns.PublishInput{
+		TopicArn: aws.String(s.topicARN),
+		Message:  aws.String(string(event)),
+		MessageAttributes: map[string]*sns.MessageAttributeValue{
+			"content-type": {DataType: aws.String("String"), StringValue: aws.String(contentType)},
+		},
+	}); err != nil {
+		return fmt.Errorf("publishing event to %s: %w", s.topicARN, err)
+	}
+	return nil
+}
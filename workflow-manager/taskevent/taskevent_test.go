@@ -0,0 +1,157 @@
+package taskevent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/letsencrypt/prio-server/workflow-manager/task"
+	wftime "github.com/letsencrypt/prio-server/workflow-manager/time"
+)
+
+// recordingSender implements sender, recording the events sent.
+type recordingSender struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (s *recordingSender) send(ctx context.Context, event []byte) error {
+	var e Event
+	if err := json.Unmarshal(event, &e); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func TestPublisher(t *testing.T) {
+	now := time.Date(2020, 10, 31, 20, 29, 0, 0, time.UTC)
+	traceID := uuid.New()
+	intakeTask := task.IntakeBatch{
+		TraceID:       traceID,
+		AggregationID: "kittens-seen",
+		BatchID:       "b8a5579a-f984-460a-a42d-2813cbf57771",
+		Date:          wftime.Timestamp(now.Add(-time.Hour)),
+	}
+	aggregationTask := task.Aggregation{
+		TraceID:          traceID,
+		AggregationID:    "kittens-seen",
+		AggregationStart: wftime.Timestamp(now.Add(-8 * time.Hour)),
+		AggregationEnd:   wftime.Timestamp(now),
+		Batches: []task.Batch{
+			{ID: "b8a5579a-f984-460a-a42d-2813cbf57771", Time: wftime.Timestamp(now.Add(-time.Hour))},
+			{ID: "af97ffdd-00fc-4d6a-9790-e5c0de82e7b0", Time: wftime.Timestamp(now.Add(-2 * time.Hour))},
+		},
+	}
+
+	s := &recordingSender{}
+	publisher := newPublisher(s, "test", false, 2, wftime.ClockWithFixedNow(now))
+	publisher.Scheduled(intakeTask)
+	publisher.Skipped(aggregationTask, ReasonMarker)
+	publisher.Stop()
+
+	if len(s.events) != 2 {
+		t.Fatalf("got %d events, want 2", len(s.events))
+	}
+	// Events are sent concurrently, so may arrive in either order.
+	if s.events[0].Type != ScheduledType {
+		s.events[0], s.events[1] = s.events[1], s.events[0]
+	}
+	for _, event := range s.events {
+		if event.SpecVersion != "1.0" || event.Source != "test" || event.Subject != "kittens-seen" ||
+			event.Time != "2020-10-31T20:29:00Z" || event.ID == "" {
+			t.Errorf("unexpected event attributes %+v", event)
+		}
+	}
+
+	wantIntake := EventData{
+		Queue:         "intake",
+		AggregationID: "kittens-seen",
+		BatchID:       intakeTask.BatchID,
+		BatchCount:    1,
+		IntervalStart: intakeTask.Date,
+		IntervalEnd:   intakeTask.Date,
+		TraceID:       traceID.String(),
+		Marker:        intakeTask.Marker(),
+	}
+	if s.events[0].Type != ScheduledType || !reflect.DeepEqual(s.events[0].Data, wantIntake) {
+		t.Errorf("got event %s %+v, want %s %+v", s.events[0].Type, s.events[0].Data, ScheduledType, wantIntake)
+	}
+
+	// Skipped tasks were never sent to the facilitator, so have no trace ID.
+	wantAggregation := EventData{
+		Queue:         "aggregate",
+		AggregationID: "kittens-seen",
+		BatchCount:    2,
+		IntervalStart: aggregationTask.AggregationStart,
+		IntervalEnd:   aggregationTask.AggregationEnd,
+		Marker:        aggregationTask.Marker(),
+		Reason:        ReasonMarker,
+	}
+	if s.events[1].Type != SkippedType || !reflect.DeepEqual(s.events[1].Data, wantAggregation) {
+		t.Errorf("got event %s %+v, want %s %+v", s.events[1].Type, s.events[1].Data, SkippedType, wantAggregation)
+	}
+
+	// No events are sent in dry run mode.
+	s = &recordingSender{}
+	publisher = newPublisher(s, "test", true, 2, wftime.ClockWithFixedNow(now))
+	publisher.Scheduled(intakeTask)
+	publisher.Stop()
+	if len(s.events) != 0 {
+		t.Errorf("got %d events in dry run mode, want 0", len(s.events))
+	}
+
+	// A nil Publisher publishes nothing.
+	var nilPublisher *Publisher
+	nilPublisher.Scheduled(intakeTask)
+	nilPublisher.Skipped(aggregationTask, ReasonMarker)
+	nilPublisher.Stop()
+}
+
+func TestHTTPSender(t *testing.T) {
+	var gotContentType, gotBody string
+	status := http.StatusAccepted
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotContentType = r.Header.Get("Content-Type")
+		body, _ := io.ReadAll(r.Body)
+		gotBody = string(body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	s := httpSender{client: server.Client(), url: server.URL}
+	if err := s.send(context.Background(), []byte(`{"id":"1"}`)); err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if gotContentType != contentType || gotBody != `{"id":"1"}` {
+		t.Errorf("got content type %q and body %q", gotContentType, gotBody)
+	}
+
+	status = http.StatusInternalServerError
+	if err := s.send(context.Background(), []byte(`{"id":"2"}`)); err == nil {
+		t.Errorf("expected error for status %d", status)
+	}
+}
+
+func TestNewPublisherTargets(t *testing.T) {
+	for _, target := range []string{
+		"",
+		"kafka://broker/topic",
+		"gcp-pubsub:topics/task-events",
+		"aws-sns:arn:aws:sqs:us-west-2:123456789012:task-events",
+	} {
+		if _, err := NewPublisher(target, "test", "", false, 1); err == nil {
+			t.Errorf("expected error for target %q", target)
+		}
+	}
+}
@@ -54,6 +54,18 @@ func OverrideAggregationWindow(when time.Time, aggregationPeriod time.Duration)
 	return func(time.Time) Interval { return AggregationIntervalIncluding(when, aggregationPeriod) }
 }
 
+// OffsetAggregationWindow returns an aggregation interval function which
+// produces the aggregation window offset windows from the window containing
+// now, e.g. an offset of -1 produces the most recently ended aggregation
+// window, and -2 the window before that. Windows are aligned on multiples of
+// the aggregation period relative to the zero time, so the result does not
+// depend on the time zone of now.
+func OffsetAggregationWindow(offset int, aggregationPeriod time.Duration) AggregationIntervalFunc {
+	return func(now time.Time) Interval {
+		return AggregationIntervalIncluding(now.Add(time.Duration(offset)*aggregationPeriod), aggregationPeriod)
+	}
+}
+
 // Interval represents a half-open interval of time.
 // It includes `begin` and excludes `end`.
 type Interval struct {
@@ -86,6 +98,34 @@ func (i Interval) String() string {
 	return fmt.Sprintf("%s to %s", FmtTime(i.Begin), FmtTime(i.End))
 }
 
+// MarkerString returns the representation of the interval as it is
+// incorporated into aggregation task markers and reaggregation triggers, e.g.
+// "2021-01-01-00-00-2021-01-01-08-00".
+func (i Interval) MarkerString() string {
+	return fmt.Sprintf("%s-%s", (*Timestamp)(&i.Begin).MarkerString(), (*Timestamp)(&i.End).MarkerString())
+}
+
+// ParseMarkerInterval parses an Interval from the representation returned by
+// Interval.MarkerString.
+func ParseMarkerInterval(s string) (Interval, error) {
+	const markerLayout = "2006-01-02-15-04"
+	if len(s) != 2*len(markerLayout)+1 || s[len(markerLayout)] != '-' {
+		return Interval{}, fmt.Errorf("malformed interval %q", s)
+	}
+	begin, err := time.Parse(markerLayout, s[:len(markerLayout)])
+	if err != nil {
+		return Interval{}, fmt.Errorf("couldn't parse interval start in %q: %w", s, err)
+	}
+	end, err := time.Parse(markerLayout, s[len(markerLayout)+1:])
+	if err != nil {
+		return Interval{}, fmt.Errorf("couldn't parse interval end in %q: %w", s, err)
+	}
+	if !begin.Before(end) {
+		return Interval{}, fmt.Errorf("interval %q does not end after it begins", s)
+	}
+	return Interval{Begin: begin, End: end}, nil
+}
+
 // TimestampPrefixes returns a list of timestamps, truncated to the hour,
 // representing hours included in the Interval. For example, if the Interval
 // were 2021/01/01/00/00 - 2021/01/01/06/00, this would return
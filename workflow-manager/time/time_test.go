@@ -127,3 +127,90 @@ func TestIntervalIncludes(t *testing.T) {
 		})
 	}
 }
+
+func TestOffsetAggregationWindow(t *testing.T) {
+	aggregationPeriod := 8 * time.Hour
+
+	var testCases = []struct {
+		name     string
+		offset   int
+		now      time.Time
+		expected Interval
+	}{
+		{
+			name:   "previous window",
+			offset: -1,
+			now:    time.Date(2021, 1, 1, 9, 30, 0, 0, time.UTC),
+			expected: Interval{
+				Begin: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+				End:   time.Date(2021, 1, 1, 8, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:   "two windows before, across UTC midnight",
+			offset: -2,
+			now:    time.Date(2021, 1, 1, 1, 0, 0, 0, time.UTC),
+			expected: Interval{
+				Begin: time.Date(2020, 12, 31, 8, 0, 0, 0, time.UTC),
+				End:   time.Date(2020, 12, 31, 16, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:   "at window boundary",
+			offset: -1,
+			now:    time.Date(2021, 1, 1, 16, 0, 0, 0, time.UTC),
+			expected: Interval{
+				Begin: time.Date(2021, 1, 1, 8, 0, 0, 0, time.UTC),
+				End:   time.Date(2021, 1, 1, 16, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:   "non-UTC now",
+			offset: -1,
+			now:    time.Date(2021, 1, 1, 1, 30, 0, 0, time.FixedZone("UTC+2", 2*60*60)), // 2020-12-31 23:30 UTC
+			expected: Interval{
+				Begin: time.Date(2020, 12, 31, 8, 0, 0, 0, time.UTC),
+				End:   time.Date(2020, 12, 31, 16, 0, 0, 0, time.UTC),
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			got := OffsetAggregationWindow(testCase.offset, aggregationPeriod)(testCase.now)
+			if !got.Begin.Equal(testCase.expected.Begin) || !got.End.Equal(testCase.expected.End) {
+				t.Errorf("got interval %s, want %s", got, testCase.expected)
+			}
+		})
+	}
+}
+
+func TestParseMarkerInterval(t *testing.T) {
+	interval := Interval{
+		Begin: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		End:   time.Date(2021, 1, 1, 8, 0, 0, 0, time.UTC),
+	}
+	if marker := interval.MarkerString(); marker != "2021-01-01-00-00-2021-01-01-08-00" {
+		t.Errorf("unexpected marker string %q", marker)
+	}
+
+	parsed, err := ParseMarkerInterval(interval.MarkerString())
+	if err != nil {
+		t.Fatalf("unexpected error %q", err)
+	}
+	if !parsed.Begin.Equal(interval.Begin) || !parsed.End.Equal(interval.End) {
+		t.Errorf("unexpected interval %s", parsed)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"2021-01-01-00-00",
+		"2021-01-01-00-00_2021-01-01-08-00",
+		"2021-01-01-08-00-2021-01-01-00-00",
+		"2021-13-01-00-00-2021-13-01-08-00",
+	} {
+		if _, err := ParseMarkerInterval(invalid); err == nil {
+			t.Errorf("expected error parsing %q", invalid)
+		}
+	}
+}
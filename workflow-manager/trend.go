@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+
+	"github.com/letsencrypt/prio-server/workflow-manager/storage"
+	"github.com/letsencrypt/prio-server/workflow-manager/task"
+)
+
+// trendWeek is the period over which run statistics are averaged when
+// computing week-over-week growth.
+const trendWeek = 7 * 24 * time.Hour
+
+var (
+	ingestionBatchesGrowth = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "workflow_manager_ingestion_batches_week_over_week_growth",
+			Help: "Growth in the mean number of ingestion batches found per run over the past week, relative to the week before (e.g. 0.1 is 10% growth)",
+		},
+		[]string{"aggregation_id"},
+	)
+	intakeTasksGrowth = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "workflow_manager_intake_tasks_week_over_week_growth",
+			Help: "Growth in the mean number of intake tasks scheduled per run over the past week, relative to the week before",
+		},
+		[]string{"aggregation_id"},
+	)
+	aggregationTasksGrowth = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "workflow_manager_aggregation_tasks_week_over_week_growth",
+			Help: "Growth in the mean number of aggregate tasks scheduled per run over the past week, relative to the week before",
+		},
+		[]string{"aggregation_id"},
+	)
+	runDurationGrowth = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "workflow_manager_scheduling_duration_week_over_week_growth",
+			Help: "Growth in the mean time taken to schedule tasks per run over the past week, relative to the week before",
+		},
+		[]string{"aggregation_id"},
+	)
+)
+
+// runStats are statistics describing the scheduling of tasks for a single
+// aggregation ID during a single run.
+type runStats struct {
+	ingestionBatches           int
+	ingestionBatchIDs          []string
+	incompleteIngestionBatches int
+	invalidIngestionBatches    int   // per --validate-batch-headers
+	intakeTasks                int64 // updated atomically by countingEnqueuer
+	aggregationTasks           int64 // updated atomically by countingEnqueuer
+	intakeTasksSkipped         int   // due to task markers or own validations
+	intakeTasksDeferred        int
+	intakeTasksSubmitted       int // for ingestion batches in the intake window, whether or not enqueued successfully
+	intakeMarkersBackfilled    int
+	aggregationTasksSkipped    int                // due to task markers
+	phaseSeconds               map[string]float64 // by phase of scheduling; see recordPhase
+	tasksSubmitted             int64              // updated atomically by countingEnqueuer
+	taskCompletions            int64              // updated atomically by countingEnqueuer
+	taskMarkersDue             int64              // by tasks enqueued successfully; updated atomically by countingEnqueuer
+	taskMarkerWrites           int64              // updated atomically by countingBucket
+	deadLetterWrites           int64              // updated atomically by countingBucket
+
+	mu             sync.Mutex
+	scheduledTasks []scheduledTask // appended by countingEnqueuer
+}
+
+// countingEnqueuer implements task.Enqueuer by wrapping another Enqueuer,
+// counting the tasks submitted, the completion functions invoked and the
+// tasks which are successfully enqueued, and recording the latter in stats.
+type countingEnqueuer struct {
+	enqueuer task.Enqueuer
+	count    *int64
+	stats    *runStats
+	queue    string // "intake" or "aggregate"
+}
+
+var _ task.Enqueuer = countingEnqueuer{}
+
+func (e countingEnqueuer) Enqueue(t task.Task, completion func(error)) {
+	atomic.AddInt64(&e.stats.tasksSubmitted, 1)
+	e.enqueuer.Enqueue(t, func(err error) {
+		atomic.AddInt64(&e.stats.taskCompletions, 1)
+		if err == nil {
+			atomic.AddInt64(e.count, 1)
+			atomic.AddInt64(&e.stats.taskMarkersDue, int64(taskMarkerCount(t)))
+			e.stats.recordScheduledTask(e.queue, t)
+		}
+		completion(err)
+	})
+}
+
+// taskMarkerCount returns the number of task markers written once t is
+// enqueued successfully: one for each batch of a coalesced intake task, and
+// one for any other task.
+func taskMarkerCount(t task.Task) int {
+	if coalesced, ok := t.(task.IntakeBatches); ok {
+		return len(coalesced.BatchMarkers())
+	}
+	return 1
+}
+
+func (e countingEnqueuer) Stop() {
+	e.enqueuer.Stop()
+}
+
+// runRecord records the statistics of a single run for an aggregation ID.
+type runRecord struct {
+	Time             time.Time `json:"time"`
+	RunID            string    `json:"run-id,omitempty"` // identifies the run's recorded configuration; see runConfigName
+	IngestionBatches int       `json:"ingestion-batches"`
+	IntakeTasks      int64     `json:"intake-tasks"`
+	AggregationTasks int64     `json:"aggregation-tasks"`
+	DurationSeconds  float64   `json:"duration-seconds"`
+}
+
+// trendState is the rolling record of recent runs for an aggregation ID,
+// persisted in the own validation bucket between runs.
+type trendState struct {
+	Runs []runRecord `json:"runs"`
+}
+
+// trendStateName returns the name of the state object holding the trend
+// state for the aggregation ID.
+func trendStateName(aggregationID string) string {
+	return fmt.Sprintf("trends-%s.json", aggregationID)
+}
+
+// add appends record to the state, then discards records older than
+// retention relative to the time of record.
+func (s *trendState) add(record runRecord, retention time.Duration) {
+	s.Runs = append(s.Runs, record)
+	cutoff := record.Time.Add(-retention)
+	runs := s.Runs[:0]
+	for _, run := range s.Runs {
+		if !run.Time.Before(cutoff) {
+			runs = append(runs, run)
+		}
+	}
+	s.Runs = runs
+}
+
+// trendGrowth describes the growth of per-run means over one week relative
+// to the week before, as a fraction (e.g. 0.1 is 10% growth).
+type trendGrowth struct {
+	ingestionBatches, intakeTasks, aggregationTasks, duration float64
+}
+
+// weekOverWeekGrowth compares the mean of each statistic over runs in the
+// week before now to the mean over runs in the week before that. ok is false
+// if either week has no runs. Growth in a statistic whose mean was zero in the
+// earlier week is reported as zero.
+func (s trendState) weekOverWeekGrowth(now time.Time) (growth trendGrowth, ok bool) {
+	var current, previous trendGrowth
+	var currentRuns, previousRuns float64
+	for _, run := range s.Runs {
+		var sums *trendGrowth
+		switch age := now.Sub(run.Time); {
+		case age < 0 || age >= 2*trendWeek:
+			continue
+		case age < trendWeek:
+			sums = &current
+			currentRuns++
+		default:
+			sums = &previous
+			previousRuns++
+		}
+		sums.ingestionBatches += float64(run.IngestionBatches)
+		sums.intakeTasks += float64(run.IntakeTasks)
+		sums.aggregationTasks += float64(run.AggregationTasks)
+		sums.duration += run.DurationSeconds
+	}
+	if currentRuns == 0 || previousRuns == 0 {
+		return trendGrowth{}, false
+	}
+
+	ratio := func(current, previous float64) float64 {
+		if previous == 0 {
+			return 0
+		}
+		return (current/currentRuns)/(previous/previousRuns) - 1
+	}
+	return trendGrowth{
+		ingestionBatches: ratio(current.ingestionBatches, previous.ingestionBatches),
+		intakeTasks:      ratio(current.intakeTasks, previous.intakeTasks),
+		aggregationTasks: ratio(current.aggregationTasks, previous.aggregationTasks),
+		duration:         ratio(current.duration, previous.duration),
+	}, true
+}
+
+// updateTrendState adds record to the trend state for the aggregation ID
+// stored in bucket, discarding records older than retention, and updates the
+// week-over-week growth metrics. Unreadable state is logged and replaced.
+func updateTrendState(bucket storage.Bucket, aggregationID string, record runRecord, retention time.Duration) error {
+	name := trendStateName(aggregationID)
+	contents, err := bucket.ReadState(name)
+	if err != nil {
+		return fmt.Errorf("couldn't read trend state: %w", err)
+	}
+
+	var state trendState
+	if contents != nil {
+		if err := json.Unmarshal(contents, &state); err != nil {
+			log.Warn().Err(err).
+				Str("aggregation ID", aggregationID).
+				Msgf("discarding malformed trend state: %s", err)
+			state = trendState{}
+		}
+	}
+
+	state.add(record, retention)
+	contents, err = json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("couldn't marshal trend state: %w", err)
+	}
+	if err := bucket.WriteState(name, contents); err != nil {
+		return fmt.Errorf("couldn't write trend state: %w", err)
+	}
+
+	growth, ok := state.weekOverWeekGrowth(record.Time)
+	if !ok {
+		log.Info().
+			Str("aggregation ID", aggregationID).
+			Int("recorded runs", len(state.Runs)).
+			Msg("not enough recorded runs to compute week-over-week growth")
+		return nil
+	}
+	ingestionBatchesGrowth.WithLabelValues(aggregationID).Set(growth.ingestionBatches)
+	intakeTasksGrowth.WithLabelValues(aggregationID).Set(growth.intakeTasks)
+	aggregationTasksGrowth.WithLabelValues(aggregationID).Set(growth.aggregationTasks)
+	runDurationGrowth.WithLabelValues(aggregationID).Set(growth.duration)
+	log.Info().
+		Str("aggregation ID", aggregationID).
+		Float64("ingestion batches growth", growth.ingestionBatches).
+		Float64("intake tasks growth", growth.intakeTasks).
+		Float64("aggregation tasks growth", growth.aggregationTasks).
+		Float64("scheduling duration growth", growth.duration).
+		Msg("computed week-over-week growth")
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+
+	"github.com/letsencrypt/prio-server/workflow-manager/batchpath"
+	"github.com/letsencrypt/prio-server/workflow-manager/notification"
+	"github.com/letsencrypt/prio-server/workflow-manager/storage"
+	"github.com/letsencrypt/prio-server/workflow-manager/task"
+	"github.com/letsencrypt/prio-server/workflow-manager/taskevent"
+	wftime "github.com/letsencrypt/prio-server/workflow-manager/time"
+)
+
+var (
+	batchNotificationsReceived = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "workflow_manager_batch_notifications_received_total",
+			Help: "The number of notifications of objects written to the ingestion bucket received in --watch mode",
+		},
+	)
+	lastReconciliation = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "workflow_manager_last_reconciliation_seconds",
+			Help: "Time of the last reconciliation scan in --watch mode in seconds since UNIX epoch, by result ('success' or 'failure')",
+		},
+		[]string{"result"},
+	)
+)
+
+type watchConfig struct {
+	// Dependencies.
+	source              notification.Source
+	ownValidationBucket storage.Bucket
+	intakeTaskEnqueuer  task.Enqueuer
+	taskEvents          *taskevent.Publisher // may be nil
+	clock               wftime.Clock
+	pushMetrics         func() // called after each reconciliation
+
+	// Configuration.
+	maxAge                 time.Duration       // batches older than this are not scheduled, as with scans
+	reconciliationInterval time.Duration       // the time between reconciliation scans
+	aggregationIDs         aggregationIDFilter // batches of aggregation IDs it excludes are not scheduled, as with scans
+}
+
+// watch schedules intake tasks for ingestion batches as soon as notifications
+// from cfg.source reveal that they are complete, until ctx is canceled. It
+// also calls reconcile, which is expected to scan buckets & schedule tasks as
+// a single run of workflow-manager would, immediately and then every
+// cfg.reconciliationInterval: reconciliation schedules aggregation tasks, and
+// any intake tasks for batches whose notifications were missed, e.g. because
+// they were written while workflow-manager was not running. Errors from
+// reconcile, or from scheduling a notified batch, are logged but do not stop
+// watch; errors receiving notifications do.
+func watch(ctx context.Context, cfg watchConfig, reconcile func() error) error {
+	// Notifications are handed off to this goroutine, so that batches are
+	// tracked & scheduled by one goroutine, between reconciliations. A
+	// notification dropped during shutdown is still acknowledged, but its
+	// batch is scheduled by the next reconciliation.
+	objects := make(chan string)
+	receiveErr := make(chan error, 1)
+	go func() {
+		receiveErr <- cfg.source.Receive(ctx, func(object string) {
+			select {
+			case objects <- object:
+			case <-ctx.Done():
+			}
+		})
+	}()
+
+	tracker := newBatchTracker()
+	runReconciliation := func() {
+		// Wait for tasks enqueued for notified batches, so that their task
+		// markers are written before reconciliation looks for them.
+		cfg.intakeTaskEnqueuer.Stop()
+		tracker.prune(cfg.clock.Now().Add(-cfg.maxAge))
+		if err := reconcile(); err != nil {
+			log.Err(err).Msgf("reconciliation failed: %s", err)
+			lastReconciliation.WithLabelValues("failure").SetToCurrentTime()
+		} else {
+			lastReconciliation.WithLabelValues("success").SetToCurrentTime()
+		}
+		cfg.pushMetrics()
+	}
+
+	runReconciliation()
+	ticker := time.NewTicker(cfg.reconciliationInterval)
+	defer ticker.Stop()
+	defer cfg.intakeTaskEnqueuer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return <-receiveErr
+		case err := <-receiveErr:
+			if ctx.Err() != nil {
+				return err
+			}
+			if err == nil {
+				err = errors.New("notification source stopped unexpectedly")
+			}
+			return fmt.Errorf("couldn't receive batch notifications: %w", err)
+		case <-ticker.C:
+			runReconciliation()
+		case object := <-objects:
+			batchNotificationsReceived.Inc()
+			batch, ok := tracker.add(object)
+			if !ok {
+				continue
+			}
+			if err := scheduleNotifiedBatch(cfg, batch); err != nil {
+				log.Err(err).
+					Str("aggregation ID", batch.AggregationID).
+					Str("batch ID", batch.ID).
+					Msgf("failed to schedule intake task for notified batch: %s", err)
+			}
+		}
+	}
+}
+
+// newBatchNotificationSource returns a source of notifications of the given
+// kind, either "gcp-pubsub" or "aws-sqs", for objects written to the ingestion
+// bucket with the provided URL.
+func newBatchNotificationSource(kind, bucketURL, subscription, sqsQueueURL, identity string) (notification.Source, error) {
+	switch kind {
+	case "gcp-pubsub":
+		if !strings.HasPrefix(bucketURL, "gs://") {
+			return nil, fmt.Errorf("--batch-notifications-kind=gcp-pubsub requires a gs:// --ingestor-input")
+		}
+		if subscription == "" {
+			return nil, fmt.Errorf("--batch-notifications-subscription is required for --batch-notifications-kind=gcp-pubsub")
+		}
+		source, err := notification.NewGCPPubSubSource(subscription, strings.TrimPrefix(bucketURL, "gs://"))
+		if err != nil {
+			return nil, fmt.Errorf("--batch-notifications-subscription: %w", err)
+		}
+		return source, nil
+	case "aws-sqs":
+		// S3 bucket URLs are like "s3://us-west-2/bucket-name", optionally
+		// followed by parameters.
+		bucketURL, _, _ := strings.Cut(bucketURL, "?")
+		regionAndName := strings.SplitN(strings.TrimPrefix(bucketURL, "s3://"), "/", 2)
+		if !strings.HasPrefix(bucketURL, "s3://") || len(regionAndName) != 2 {
+			return nil, fmt.Errorf("--batch-notifications-kind=aws-sqs requires an s3:// --ingestor-input")
+		}
+		if sqsQueueURL == "" {
+			return nil, fmt.Errorf("--batch-notifications-sqs-queue-url is required for --batch-notifications-kind=aws-sqs")
+		}
+		source, err := notification.NewAWSSQSSource(sqsQueueURL, identity, regionAndName[1])
+		if err != nil {
+			return nil, fmt.Errorf("--batch-notifications-sqs-queue-url: %w", err)
+		}
+		return source, nil
+	default:
+		return nil, fmt.Errorf("--batch-notifications-kind must be one of 'gcp-pubsub' or 'aws-sqs'")
+	}
+}
+
+// scheduleNotifiedBatch schedules an intake task for a batch which
+// notifications revealed to be complete, unless the batch is older than
+// cfg.maxAge, its aggregation ID is excluded by cfg.aggregationIDs, or it has
+// an intake task marker.
+func scheduleNotifiedBatch(cfg watchConfig, batch *batchpath.BatchPath) error {
+	if !cfg.aggregationIDs.includes(batch.AggregationID) {
+		log.Debug().
+			Str("aggregation ID", batch.AggregationID).
+			Str("batch ID", batch.ID).
+			Msg("ignoring notified batch of excluded aggregation ID")
+		return nil
+	}
+	if batch.Time.Before(cfg.clock.Now().Add(-cfg.maxAge)) {
+		log.Info().
+			Str("aggregation ID", batch.AggregationID).
+			Str("batch ID", batch.ID).
+			Msg("ignoring notified batch older than intake window")
+		return nil
+	}
+
+	// Only the task markers for the batch's own minute are listed, which is
+	// far cheaper than a scan.
+	markers, err := cfg.ownValidationBucket.ListIntakeTaskMarkers(
+		batch.AggregationID, wftime.Interval{Begin: batch.Time, End: batch.Time.Add(time.Minute)})
+	if err != nil {
+		return fmt.Errorf("couldn't list intake task markers: %w", err)
+	}
+	taskMarkers := map[string]struct{}{}
+	for _, marker := range markers {
+		taskMarkers[marker] = struct{}{}
+	}
+
+	_, err = enqueueIntakeTasks(batchpath.List{batch}, taskMarkers, nil, 0, time.Time{}, intakeCoalescing{},
+		cfg.ownValidationBucket, cfg.intakeTaskEnqueuer, cfg.taskEvents, cfg.clock)
+	return err
+}
+
+// batchObjectSuffixes are the suffixes of the objects making up an ingestion
+// batch, in the order of the bits in trackedBatch.objects.
+var batchObjectSuffixes = []string{".batch", ".batch.avro", ".batch.sig"}
+
+// trackedBatch is an ingestion batch for which notifications have been
+// received.
+type trackedBatch struct {
+	batch   *batchpath.BatchPath
+	objects int // bitmask of notified objects, indexed by batchObjectSuffixes
+}
+
+// batchTracker tracks the objects of ingestion batches revealed by
+// notifications, to determine when each batch is complete, i.e. when its
+// header, packet file & signature have all been written.
+type batchTracker struct {
+	batches map[string]*trackedBatch // by batch name, e.g. "kittens-seen/2020/10/31/20/29/b8a5579a-f984-460a-a42d-2813cbf57771"
+}
+
+func newBatchTracker() *batchTracker {
+	return &batchTracker{batches: map[string]*trackedBatch{}}
+}
+
+// add records that object has been written, returning the batch it belongs to
+// if this completes that batch. Objects which are not part of an ingestion
+// batch, and repeated notifications for a complete batch, are ignored.
+func (t *batchTracker) add(object string) (*batchpath.BatchPath, bool) {
+	for i, suffix := range batchObjectSuffixes {
+		if !strings.HasSuffix(object, suffix) {
+			continue
+		}
+		name := strings.TrimSuffix(object, suffix)
+		tracked, ok := t.batches[name]
+		if !ok {
+			batch, err := batchpath.New(name)
+			if err != nil {
+				log.Debug().Str("object", object).Msgf("ignoring notified object which is not part of a batch: %s", err)
+				return nil, false
+			}
+			tracked = &trackedBatch{batch: batch}
+			t.batches[name] = tracked
+		}
+
+		complete := 1<<len(batchObjectSuffixes) - 1
+		if tracked.objects == complete {
+			return nil, false
+		}
+		tracked.objects |= 1 << i
+		return tracked.batch, tracked.objects == complete
+	}
+	return nil, false
+}
+
+// prune forgets batches whose timestamp is before the provided time, which
+// will no longer be scheduled.
+func (t *batchTracker) prune(before time.Time) {
+	for name, tracked := range t.batches {
+		if tracked.batch.Time.Before(before) {
+			delete(t.batches, name)
+		}
+	}
+}